@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/perbu/vcltest/pkg/impact"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// runAffected implements `vcltest affected`: it runs only the tests whose
+// recorded VCL coverage intersects the lines changed since a git revision.
+func runAffected(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("vcltest affected", flag.ExitOnError)
+	since := flags.String("since", "", "git revision to diff the VCL against (default: the commit the coverage cache was recorded at)")
+	vclFileFlag := flags.String("vcl", "", "VCL file to use for tests (overrides auto-detection)")
+	cachePath := flags.String("coverage-cache", "", "coverage cache file (default: .<testfile>.coverage.json next to the test file)")
+	verbose := flags.Bool("verbose", false, "verbose output")
+	flags.BoolVar(verbose, "v", false, "verbose output (shorthand)")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("missing test spec file argument\nUsage: vcltest affected [options] <test-spec.yaml>")
+	}
+
+	testFile := flags.Arg(0)
+	if *cachePath == "" {
+		*cachePath = impact.DefaultCachePath(testFile)
+	}
+
+	opts := runOptions{
+		testFile:      testFile,
+		vclPath:       *vclFileFlag,
+		verbose:       *verbose,
+		coverageCache: *cachePath,
+	}
+
+	cache, err := impact.Load(*cachePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Printf("No coverage cache at %s, running full suite to record it\n\n", *cachePath)
+		return runTests(ctx, opts)
+	}
+	if errors.Is(err, impact.ErrCacheVersion) {
+		fmt.Printf("Coverage cache at %s is from another vcltest version, running full suite to record it\n\n", *cachePath)
+		return runTests(ctx, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	vclPath, err := testspec.ResolveVCL(testFile, *vclFileFlag)
+	if err != nil {
+		return err
+	}
+	vclPath, err = filepath.Abs(vclPath)
+	if err != nil {
+		return fmt.Errorf("resolving VCL path: %w", err)
+	}
+
+	// Cached line numbers are those of the recorded sources, so diff against
+	// the commit they were recorded at, and only if its files are those sources
+	rev := *since
+	switch {
+	case rev != "":
+	case cache.Commit != "":
+		rev = cache.Commit
+		*since = shortCommit(cache.Commit)
+	default:
+		rev, *since = "HEAD", "HEAD"
+	}
+	stale, err := cache.Stale(filepath.Dir(vclPath), rev)
+	if err != nil {
+		return err
+	}
+	if stale != "" {
+		fmt.Printf("Coverage cache was not recorded from %s at %s, running full suite to refresh it\n\n", stale, *since)
+		return runTests(ctx, opts)
+	}
+
+	changes, err := impact.GitDiff(filepath.Dir(vclPath), rev, cache.FilePaths())
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Printf("No VCL changes since %s, nothing to run\n", *since)
+		return nil
+	}
+
+	names, runAll := cache.Affected(changes)
+	if runAll {
+		fmt.Printf("VCL changes since %s are outside recorded subroutines, running full suite\n\n", *since)
+		return runTests(ctx, opts)
+	}
+
+	// Tests without recorded coverage (new tests, or tests that errored) always run
+	tests, err := testspec.Load(testFile)
+	if err != nil {
+		return fmt.Errorf("loading test file: %w", err)
+	}
+	for _, test := range tests {
+		if !cache.HasTest(test.Name) {
+			names = append(names, test.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		fmt.Printf("No tests affected by VCL changes since %s\n", *since)
+		return nil
+	}
+
+	fmt.Printf("Running %d of %d tests affected by VCL changes since %s\n\n", len(names), len(tests), *since)
+	opts.onlyTests = names
+	return runTests(ctx, opts)
+}
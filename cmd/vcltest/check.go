@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/perbu/vcltest/pkg/formatter"
+	"github.com/perbu/vcltest/pkg/vclcheck"
+)
+
+// runCheck implements `vcltest check`: it compiles every VCL file under a
+// directory and reports per-file errors, without running any tests.
+func runCheck(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("vcltest check", flag.ExitOnError)
+	varnishd := flags.String("varnishd", "", "varnishd binary to compile with (default: varnishd in PATH)")
+	parserOnly := flags.Bool("parser", false, "check syntax with the built-in VCL parser instead of varnishd")
+	jobs := flags.Int("j", 0, "number of files to compile in parallel (default: number of CPUs)")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("missing directory argument\nUsage: vcltest check [options] <vcl-dir>")
+	}
+
+	report, err := vclcheck.Check(ctx, flags.Arg(0), vclcheck.Options{
+		Varnishd:   *varnishd,
+		ParserOnly: *parserOnly,
+		Jobs:       *jobs,
+	})
+	if err != nil {
+		return err
+	}
+
+	useColor := formatter.ShouldUseColor()
+	included := 0
+	for _, result := range report.Results {
+		included += len(result.Includes)
+		if result.Err == nil {
+			if useColor {
+				fmt.Printf("%s✓%s %s\n", formatter.ColorGreen, formatter.ColorReset, result.Path)
+			} else {
+				fmt.Printf("✓ %s\n", result.Path)
+			}
+			continue
+		}
+		if useColor {
+			fmt.Printf("%s✗%s %s\n", formatter.ColorRed, formatter.ColorReset, result.Path)
+		} else {
+			fmt.Printf("✗ %s\n", result.Path)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(result.Err.Error()), "\n") {
+			fmt.Printf("    %s\n", line)
+		}
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("====================\n")
+	fmt.Printf("VCL files compiled with %s: %d/%d\n", report.Checker, len(report.Results)-report.Failed(), len(report.Results))
+	if included > 0 {
+		fmt.Printf("Included files checked through their includers: %d\n", included)
+	}
+
+	if report.Failed() > 0 {
+		return fmt.Errorf("some VCL files failed to compile")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/perbu/vcltest/pkg/curlspec"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// runCurl2Spec implements `vcltest curl2spec`: it converts a curl command
+// line into the equivalent request spec YAML.
+func runCurl2Spec(_ context.Context, args []string) error {
+	flags := flag.NewFlagSet("vcltest curl2spec", flag.ExitOnError)
+	name := flags.String("name", "", "emit a complete test with this name instead of just the request")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+
+	// The command is given as one quoted argument, as separate arguments,
+	// or on stdin (handy for multi-line "Copy as cURL" output)
+	var req testspec.RequestSpec
+	var err error
+	switch flags.NArg() {
+	case 0:
+		data, readErr := io.ReadAll(os.Stdin)
+		if readErr != nil {
+			return fmt.Errorf("reading curl command from stdin: %w", readErr)
+		}
+		if strings.TrimSpace(string(data)) == "" {
+			return fmt.Errorf("missing curl command\nUsage: vcltest curl2spec [options] 'curl ...'")
+		}
+		req, err = curlspec.Parse(string(data))
+	case 1:
+		req, err = curlspec.Parse(flags.Arg(0))
+	default:
+		req, err = curlspec.FromArgs(flags.Args())
+	}
+	if err != nil {
+		return fmt.Errorf("converting curl command: %w", err)
+	}
+
+	var doc any = struct {
+		Request testspec.RequestSpec `yaml:"request"`
+	}{req}
+	if *name != "" {
+		doc = testspec.TestSpec{
+			Name:    *name,
+			Request: req,
+			Expectations: testspec.ExpectationsSpec{
+				Response: testspec.ResponseExpectations{Status: 200},
+			},
+		}
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("encoding request spec: %w", err)
+	}
+	return encoder.Close()
+}
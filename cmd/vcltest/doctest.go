@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/perbu/vcltest/pkg/doctest"
+)
+
+// runDoctest implements `vcltest doctest`: it runs the tests written as
+// "# vcltest: ..." comments in a VCL file and its includes.
+func runDoctest(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("vcltest doctest", flag.ExitOnError)
+	verbose := flags.Bool("verbose", false, "verbose output")
+	flags.BoolVar(verbose, "v", false, "verbose output (shorthand)")
+	explain := flags.Bool("explain", false, "show how each assertion's value was derived")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("missing VCL file argument\nUsage: vcltest doctest [options] <main.vcl>")
+	}
+
+	vclPath := flags.Arg(0)
+	tests, err := doctest.Extract(vclPath)
+	if err != nil {
+		return fmt.Errorf("extracting doctests: %w", err)
+	}
+	if len(tests) == 0 {
+		fmt.Printf("No vcltest comments in %s\n", vclPath)
+		return nil
+	}
+
+	return runTests(ctx, runOptions{
+		testFile: vclPath,
+		vclPath:  vclPath,
+		tests:    tests,
+		verbose:  *verbose,
+		explain:  *explain,
+	})
+}
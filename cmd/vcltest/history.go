@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/formatter"
+	"github.com/perbu/vcltest/pkg/history"
+)
+
+// runHistory implements `vcltest history merge`: it merges results files
+// written with -results-json into a per-test trend report.
+func runHistory(_ context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "merge" {
+		return fmt.Errorf("missing history command\nUsage: vcltest history merge [options] <results.json>...")
+	}
+
+	flags := flag.NewFlagSet("vcltest history merge", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("missing results files\nUsage: vcltest history merge [options] <results.json>...")
+	}
+
+	var runs []*history.Run
+	for _, path := range flags.Args() {
+		run, err := history.Load(path)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+	report := history.Merge(runs)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	useColor := formatter.ShouldUseColor()
+	fmt.Printf("History: %d runs from %s to %s\n\n", report.Runs, report.From.Format(time.DateTime), report.To.Format(time.DateTime))
+	for _, trend := range report.Tests {
+		mark := "✓"
+		if !trend.LastPassed {
+			mark = "✗"
+			if useColor {
+				mark = formatter.ColorRed + mark + formatter.ColorReset
+			}
+		} else if useColor {
+			mark = formatter.ColorGreen + mark + formatter.ColorReset
+		}
+
+		fmt.Printf("%s %s  %s\n", mark, trend.ID, trend.Name)
+		fmt.Printf("    passed %d/%d (%.0f%%), duration avg %s, last %s\n",
+			trend.Passed, trend.Runs, trend.PassRate*100,
+			time.Duration(trend.AvgDurationMS())*time.Millisecond,
+			time.Duration(trend.DurationsMS[len(trend.DurationsMS)-1])*time.Millisecond)
+		if trend.Flaky() {
+			fmt.Printf("    flaky: flipped between passing and failing %d times\n", trend.Flips)
+		}
+		if trend.FirstFailedCommit != "" {
+			fmt.Printf("    failing since commit %s\n", shortCommit(trend.FirstFailedCommit))
+		}
+	}
+	return nil
+}
+
+// shortCommit abbreviates a commit hash for display
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
@@ -6,9 +6,14 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"strings"
 
 	"github.com/invopop/jsonschema"
+	"github.com/perbu/vcltest/pkg/eventstream"
+	"github.com/perbu/vcltest/pkg/harness"
 	"github.com/perbu/vcltest/pkg/testspec"
 )
 
@@ -24,14 +29,53 @@ func main() {
 }
 
 func run(ctx context.Context, args []string) error {
+	// Subcommands
+	if len(args) > 0 {
+		switch args[0] {
+		case "affected":
+			return runAffected(ctx, args[1:])
+		case "check":
+			return runCheck(ctx, args[1:])
+		case "doctest":
+			return runDoctest(ctx, args[1:])
+		case "curl2spec":
+			return runCurl2Spec(ctx, args[1:])
+		case "history":
+			return runHistory(ctx, args[1:])
+		case "monitor":
+			return runMonitor(ctx, args[1:])
+		}
+	}
+
 	// Parse flags
 	flags := flag.NewFlagSet("vcltest", flag.ExitOnError)
 	verbose := flags.Bool("verbose", false, "verbose output")
 	flags.BoolVar(verbose, "v", false, "verbose output (shorthand)")
 	showVersion := flags.Bool("version", false, "show version")
-	vclFileFlag := flags.String("vcl", "", "VCL file to use for tests (overrides auto-detection)")
+	vclFileFlag := flags.String("vcl", "", "VCL file to use for tests (overrides auto-detection), or - to read VCL from stdin")
 	debugDump := flags.Bool("debug-dump", false, "preserve all artifacts in /tmp for debugging (no cleanup)")
+	varnishdLogs := flags.String("varnishd-logs", "", "copy varnishd's stdout and stderr to this directory when the run ends")
 	generateSchema := flags.Bool("generate-schema", false, "generate JSON schema for test specification")
+	generateResultSchema := flags.Bool("generate-result-schema", false, "generate JSON schema for test results (what -report-json writes)")
+	coverageCache := flags.String("coverage-cache", "", "record per-test VCL coverage to this file (used by 'vcltest affected')")
+	eventsFD := flags.Int("events-fd", 0, "write an NDJSON event stream to this file descriptor (e.g. 3)")
+	eventsSocket := flags.String("events-socket", "", "write an NDJSON event stream to this unix socket")
+	showEffectiveVCL := flags.Bool("show-effective-vcl", false, "print a diff of the VCL against the backend-rewritten version loaded into varnishd")
+	chaosSpec := flags.String("chaos", "", "re-run passing tests with random backend faults, e.g. p=0.05[,iterations=10][,seed=N]")
+	harFile := flags.String("har", "", "record every client request and response to this HAR file")
+	timelineOut := flags.String("timeline", "", "show a per-test timeline of requests, VCL states and backend fetches: text, or a .html file to write")
+	resultsJSON := flags.String("results-json", "", "write per-test results (with stable test IDs) to this file, for 'vcltest history merge'")
+	commit := flags.String("commit", "", "commit recorded in -results-json (default: from CI environment or git)")
+	reportJSON := flags.String("report-json", "", "write the full run result (see -generate-result-schema) as JSON to this file")
+	baselineFile := flags.String("baseline", "", "known failures recorded in this file are reported but do not fail the run")
+	updateBaseline := flags.Bool("update-baseline", false, "record the current failures to the -baseline file")
+	allowNetwork := flags.Bool("allow-network", false, "let VCL backends without a mock in the spec connect to their real hosts (by default such connections fail the test)")
+	strictBackends := flags.Bool("strict-backends", false, "fail the run if a backend route declared in the spec was never requested by any test")
+	explain := flags.Bool("explain", false, "show how each assertion's value was derived (header, VSL record or backend counter), pass or fail")
+	suiteTimeout := flags.Duration("suite-timeout", 0, "bound the total runtime of the suite, e.g. 10m; on expiry, report where the time went (0 for no limit)")
+	startupTimeout := flags.Duration("startup-timeout", harness.DefaultStartupTimeout, "how long varnishd and varnishlog may take to become ready; on expiry, report how far startup got")
+	expose := flags.String("expose", "", "after the tests, keep varnishd and the mock backends up and forward this address (e.g. 127.0.0.1:9999) to varnishd until Ctrl-C")
+	dryRun := flags.Bool("dry-run", false, "validate the spec and compile the VCL, then print the execution plan without running tests")
 
 	if err := flags.Parse(args); err != nil {
 		return fmt.Errorf("parsing flags: %w", err)
@@ -47,16 +91,104 @@ func run(ctx context.Context, args []string) error {
 	if *generateSchema {
 		return generateJSONSchema()
 	}
+	if *generateResultSchema {
+		return generateResultJSONSchema()
+	}
 
 	// Check for test spec file argument
 	if flags.NArg() == 0 {
-		return fmt.Errorf("missing test spec file argument\nUsage: vcltest [options] <test-spec.yaml>")
+		return fmt.Errorf("missing test spec file argument\nUsage: vcltest [options] <test-spec.yaml>\n       vcltest affected [options] <test-spec.yaml>\n       vcltest check [options] <vcl-dir>\n       vcltest curl2spec [options] 'curl ...'\n       vcltest doctest [options] <main.vcl>\n       vcltest history merge [options] <results.json>...\n       vcltest monitor [options] <invariants.yaml>")
 	}
 
 	testSpecFile := flags.Arg(0)
 
+	// Read VCL from stdin if requested
+	vclPath, vclSource := *vclFileFlag, ""
+	if vclPath == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("reading VCL from stdin: %w", err)
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("-vcl -: no VCL on stdin")
+		}
+		vclPath, vclSource = "", string(data)
+	}
+
+	if *timelineOut != "" && *timelineOut != "text" && !strings.HasSuffix(*timelineOut, ".html") {
+		return fmt.Errorf("-timeline must be text or a .html file, got %q", *timelineOut)
+	}
+	if *updateBaseline && *baselineFile == "" {
+		return fmt.Errorf("-update-baseline requires -baseline")
+	}
+
+	var chaos *harness.ChaosConfig
+	if *chaosSpec != "" {
+		var err error
+		if chaos, err = harness.ParseChaos(*chaosSpec); err != nil {
+			return err
+		}
+	}
+
+	// Open the event stream, if requested
+	eventsOut, err := openEventStream(*eventsFD, *eventsSocket)
+	if err != nil {
+		return err
+	}
+	var events *eventstream.Emitter
+	if eventsOut != nil {
+		defer eventsOut.Close()
+		events = eventstream.New(eventsOut)
+	}
+
 	// Run tests
-	return runTests(ctx, testSpecFile, *verbose, *vclFileFlag, *debugDump)
+	return runTests(ctx, runOptions{
+		testFile:         testSpecFile,
+		vclPath:          vclPath,
+		vclSource:        vclSource,
+		verbose:          *verbose,
+		debugDump:        *debugDump,
+		varnishdLogDir:   *varnishdLogs,
+		coverageCache:    *coverageCache,
+		showEffectiveVCL: *showEffectiveVCL,
+		chaos:            chaos,
+		events:           events,
+		timeline:         *timelineOut,
+		harFile:          *harFile,
+		resultsJSON:      *resultsJSON,
+		commit:           *commit,
+		reportJSON:       *reportJSON,
+		baseline:         *baselineFile,
+		updateBaseline:   *updateBaseline,
+		dryRun:           *dryRun,
+		explain:          *explain,
+		allowNetwork:     *allowNetwork,
+		strictBackends:   *strictBackends,
+		suiteTimeout:     *suiteTimeout,
+		expose:           *expose,
+		startupTimeout:   *startupTimeout,
+	})
+}
+
+// openEventStream opens the event stream destination given by -events-fd or
+// -events-socket. Returns nil if neither is set.
+func openEventStream(fd int, socket string) (io.WriteCloser, error) {
+	switch {
+	case fd != 0 && socket != "":
+		return nil, fmt.Errorf("-events-fd and -events-socket are mutually exclusive")
+	case fd != 0:
+		if fd < 3 {
+			return nil, fmt.Errorf("-events-fd must be 3 or higher (0-2 are stdin/stdout/stderr)")
+		}
+		return os.NewFile(uintptr(fd), "events"), nil
+	case socket != "":
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to event socket: %w", err)
+		}
+		return conn, nil
+	}
+	return nil, nil
 }
 
 func generateJSONSchema() error {
@@ -78,3 +210,26 @@ func generateJSONSchema() error {
 	fmt.Println(string(output))
 	return nil
 }
+
+// generateResultJSONSchema prints the schema of the JSON encoding of
+// harness.Result. Unlike the test spec schema, it uses $defs, since coverage
+// blocks nest recursively.
+func generateResultJSONSchema() error {
+	reflector := jsonschema.Reflector{
+		ExpandedStruct: true,
+	}
+
+	schema := reflector.Reflect(&harness.Result{})
+	schema.ID = jsonschema.ID(fmt.Sprintf("urn:vcltest:result:v%d", harness.ResultSchemaVersion))
+	schema.Title = "VCLTest Result"
+	schema.Description = fmt.Sprintf("Schema for the JSON encoding of VCLTest run results, as written by -report-json (schema_version %d)", harness.ResultSchemaVersion)
+	schema.Version = "https://json-schema.org/draft/2020-12/schema"
+
+	output, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling schema: %w", err)
+	}
+
+	fmt.Println(string(output))
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/formatter"
+	"github.com/perbu/vcltest/pkg/monitor"
+)
+
+// runMonitor implements `vcltest monitor`: it attaches read-only to a
+// running Varnish's VSL and checks sampled transactions against invariants.
+func runMonitor(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("vcltest monitor", flag.ExitOnError)
+	name := flags.String("n", "", "varnishd instance name or working directory (default: varnishlog's default)")
+	readFile := flags.String("r", "", "read transactions from a varnishlog binary file instead of live VSL")
+	query := flags.String("q", "", "VSL query passed to varnishlog to pre-filter transactions")
+	sample := flags.Float64("sample", 1, "fraction of transactions to check (0-1)")
+	duration := flags.Duration("duration", 0, "stop after this long (default: until interrupted)")
+	maxTx := flags.Int("max", 0, "stop after checking this many transactions (default: no limit)")
+	varnishlog := flags.String("varnishlog", "varnishlog", "varnishlog binary")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("missing invariants file argument\nUsage: vcltest monitor [options] <invariants.yaml>")
+	}
+	if *sample <= 0 || *sample > 1 {
+		return fmt.Errorf("-sample must be between 0 (exclusive) and 1, got %v", *sample)
+	}
+
+	spec, err := monitor.LoadSpec(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	// Stops varnishlog once the run is over (e.g. -max reached)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	vslArgs := []string{"-g", "request"}
+	if *name != "" {
+		vslArgs = append(vslArgs, "-n", *name)
+	}
+	if *readFile != "" {
+		vslArgs = append(vslArgs, "-r", *readFile)
+	}
+	if *query != "" {
+		vslArgs = append(vslArgs, "-q", *query)
+	}
+	cmd := exec.CommandContext(ctx, *varnishlog, vslArgs...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("creating varnishlog pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting varnishlog: %w", err)
+	}
+
+	useColor := formatter.ShouldUseColor()
+	start := time.Now()
+	report, runErr := monitor.Run(ctx, spec, stdout, monitor.Options{
+		SampleRate:      *sample,
+		MaxTransactions: *maxTx,
+		OnViolation: func(v monitor.Violation) {
+			tx := v.Transaction
+			if useColor {
+				fmt.Printf("%s✗%s %s: %s %s (vxid %s, status %d)\n", formatter.ColorRed, formatter.ColorReset, v.Invariant, tx.Method, tx.URL, tx.VXID, tx.Status)
+			} else {
+				fmt.Printf("✗ %s: %s %s (vxid %s, status %d)\n", v.Invariant, tx.Method, tx.URL, tx.VXID, tx.Status)
+			}
+			for _, e := range v.Errors {
+				for _, line := range strings.Split(e, "\n") {
+					fmt.Printf("    %s\n", line)
+				}
+			}
+		},
+	})
+	// varnishlog is killed when the run ends early; only report it failing on its own
+	stoppedEarly := ctx.Err() != nil || (*maxTx > 0 && report.Sampled >= *maxTx)
+	cancel()
+	waitErr := cmd.Wait()
+	if runErr != nil {
+		return fmt.Errorf("reading VSL: %w", runErr)
+	}
+	if waitErr != nil && !stoppedEarly {
+		return fmt.Errorf("varnishlog: %w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+
+	fmt.Printf("\n")
+	fmt.Printf("====================\n")
+	fmt.Printf("Transactions: %d seen, %d checked in %s\n", report.Seen, report.Sampled, formatter.FormatSeconds(time.Since(start).Round(time.Second)))
+	for _, inv := range report.Invariants {
+		fmt.Printf("  %s: %d checked, %d violations\n", inv.Name, inv.Checked, inv.Violations)
+	}
+
+	if report.Violations() > 0 {
+		return fmt.Errorf("%d invariant violations", report.Violations())
+	}
+	return nil
+}
@@ -2,62 +2,399 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/perbu/vcltest/pkg/baseline"
+	"github.com/perbu/vcltest/pkg/eventstream"
 	"github.com/perbu/vcltest/pkg/formatter"
 	"github.com/perbu/vcltest/pkg/harness"
+	"github.com/perbu/vcltest/pkg/history"
+	"github.com/perbu/vcltest/pkg/impact"
+	"github.com/perbu/vcltest/pkg/runner"
+	"github.com/perbu/vcltest/pkg/testspec"
+	"github.com/perbu/vcltest/pkg/timeline"
 )
 
+// runOptions holds the options for a test run.
+type runOptions struct {
+	testFile         string
+	vclPath          string
+	vclSource        string              // VCL text read from stdin (-vcl -)
+	tests            []testspec.TestSpec // Run these instead of loading testFile
+	verbose          bool
+	debugDump        bool
+	varnishdLogDir   string   // Where to keep varnishd's output (empty: not kept)
+	onlyTests        []string // Run only these tests (all if empty)
+	coverageCache    string   // Record per-test coverage to this file (full runs only)
+	showEffectiveVCL bool     // Print a diff of the VCL against what varnishd loads
+	chaos            *harness.ChaosConfig
+	events           *eventstream.Emitter
+	timeline         string        // "text" or an HTML file for per-test timelines (-timeline)
+	harFile          string        // Client traffic recording (-har)
+	resultsJSON      string        // Per-run results file for history tracking
+	commit           string        // Commit recorded in resultsJSON (detected if empty)
+	reportJSON       string        // File for the JSON encoding of harness.Result
+	baseline         string        // Known failures file (-baseline)
+	updateBaseline   bool          // Record current failures to the baseline file
+	dryRun           bool          // Validate and print the plan without running tests
+	explain          bool          // Show how each assertion's value was derived
+	allowNetwork     bool          // Don't guard VCL backends without a mock
+	strictBackends   bool          // Fail if a declared backend route was never requested
+	suiteTimeout     time.Duration // Bound on the whole run (0 for none)
+	startupTimeout   time.Duration // Bound on varnishd and varnishlog readiness
+	expose           string        // Forward this address to varnishd after the tests until interrupted
+}
+
 // runTests runs the test file using the harness.
-func runTests(ctx context.Context, testFile string, verbose bool, cliVCL string, debugDump bool) error {
+func runTests(ctx context.Context, opts runOptions) error {
 	// Setup logger
 	logLevel := slog.LevelInfo
-	if verbose {
+	if opts.verbose {
 		logLevel = slog.LevelDebug
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level: logLevel,
 	}))
 
+	// Known failures only apply when checking against an existing baseline
+	known := &baseline.Baseline{}
+	if opts.baseline != "" && !opts.updateBaseline {
+		var err error
+		if known, err = baseline.Load(opts.baseline); err != nil {
+			return err
+		}
+	}
+
+	recordCoverage := opts.coverageCache != "" && len(opts.onlyTests) == 0 && opts.vclSource == ""
+
 	// Create harness configuration
 	cfg := &harness.Config{
-		TestFile:  testFile,
-		VCLPath:   cliVCL,
-		Verbose:   verbose,
-		DebugDump: debugDump,
-		Logger:    logger,
+		TestFile:       opts.testFile,
+		VCLPath:        opts.vclPath,
+		VCLSource:      opts.vclSource,
+		Tests:          opts.tests,
+		Verbose:        opts.verbose,
+		DebugDump:      opts.debugDump,
+		VarnishdLogDir: opts.varnishdLogDir,
+		StartupTimeout: opts.startupTimeout,
+		OnlyTests:      opts.onlyTests,
+		CollectTraces:  recordCoverage,
+		Timeline:       opts.timeline != "",
+		HARFile:        opts.harFile,
+		Explain:        opts.explain,
+		AllowNetwork:   opts.allowNetwork,
+		StrictBackends: opts.strictBackends,
+		Chaos:          opts.chaos,
+		Events:         opts.events,
+		Logger:         logger,
+	}
+	if opts.showEffectiveVCL {
+		cfg.EffectiveVCL = os.Stdout
+	}
+	if opts.expose != "" {
+		cfg.AfterTests = exposeVarnish(opts.expose)
 	}
 
 	// Create and run harness
 	h := harness.New(cfg)
-	result, err := h.Run(ctx)
+	if opts.dryRun {
+		plan, err := h.DryRun(ctx)
+		if err != nil {
+			return err
+		}
+		displayPlan(plan)
+		return nil
+	}
+	runCtx := ctx
+	if opts.suiteTimeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, opts.suiteTimeout)
+		defer cancel()
+	}
+	started := time.Now()
+	result, err := h.Run(runCtx)
+	if opts.suiteTimeout > 0 && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		displayPhases(h.Phases(), opts.suiteTimeout)
+		return fmt.Errorf("suite timeout of %s exceeded", opts.suiteTimeout)
+	}
 	if err != nil {
 		return err
 	}
 
 	// Display results
-	displayResults(result)
+	displayResults(result, known)
+	if opts.timeline == "text" {
+		displayTimelines(result.Results)
+	} else if opts.timeline != "" {
+		if err := writeTimelines(opts.timeline, result.Results); err != nil {
+			return err
+		}
+		fmt.Printf("\nTimeline written to: %s\n", opts.timeline)
+	}
+	if result.HARPath != "" {
+		fmt.Printf("\nHAR written to: %s\n", result.HARPath)
+	}
+	if result.Chaos != nil {
+		displayChaos(result.Chaos)
+	}
+	if len(result.UnusedRoutes) > 0 {
+		displayUnusedRoutes(result.UnusedRoutes)
+	}
+
+	if err := opts.events.Err(); err != nil {
+		logger.Warn("Event stream failed", "error", err)
+	}
+
+	// Record coverage for later impact analysis (needs the VCL on disk)
+	if recordCoverage && result.VCLPath == "" {
+		fmt.Printf("\nCoverage not recorded: VCL was given inline\n")
+	} else if recordCoverage {
+		cache, err := impact.Build(result.VCLPath, result.Results)
+		if err != nil {
+			return fmt.Errorf("recording coverage: %w", err)
+		}
+		if err := cache.Save(opts.coverageCache); err != nil {
+			return err
+		}
+		fmt.Printf("\nCoverage recorded to: %s\n", opts.coverageCache)
+	}
+
+	// Record results for history tracking
+	if opts.resultsJSON != "" {
+		commit := opts.commit
+		if commit == "" {
+			commit = history.DetectCommit(filepath.Dir(opts.testFile))
+		}
+		if err := history.NewRun(opts.testFile, commit, started, result.Results).Save(opts.resultsJSON); err != nil {
+			return err
+		}
+		fmt.Printf("\nResults written to: %s\n", opts.resultsJSON)
+	}
+	if opts.reportJSON != "" {
+		if err := writeReport(opts.reportJSON, result); err != nil {
+			return err
+		}
+		fmt.Printf("\nReport written to: %s\n", opts.reportJSON)
+	}
 
 	// Report debug dump location if created
 	if result.DebugDumpPath != "" {
 		fmt.Printf("\nDebug artifacts saved to: %s\n", result.DebugDumpPath)
 	}
 
-	if result.Failed > 0 {
+	if opts.updateBaseline {
+		if err := baseline.FromResults(result.Results).Save(opts.baseline); err != nil {
+			return err
+		}
+		fmt.Printf("\nBaseline updated: %s (%d known failures)\n", opts.baseline, result.Failed)
+	} else if stale := known.Stale(result.Results); len(stale) > 0 {
+		fmt.Printf("\nBaselined tests now passing (refresh with -update-baseline): %s\n", strings.Join(stale, ", "))
+	}
+
+	if result.AfterSuiteError != "" {
+		return errors.New(result.AfterSuiteError)
+	}
+	if newFailures := result.Failed - countKnown(result.Results, known); newFailures > 0 && !opts.updateBaseline {
 		return fmt.Errorf("some tests failed")
 	}
+	if len(result.UnusedRoutes) > 0 {
+		return fmt.Errorf("%d declared backend routes were never requested (-strict-backends)", len(result.UnusedRoutes))
+	}
+	if result.Chaos != nil && len(result.Chaos.Sensitive()) > 0 {
+		return fmt.Errorf("%d tests are sensitive to backend faults", len(result.Chaos.Sensitive()))
+	}
 
 	return nil
 }
 
-// displayResults prints test results to stdout.
-func displayResults(result *harness.Result) {
+// displayPlan prints the execution plan of a dry run
+func displayPlan(plan *harness.Plan) {
+	vcl := plan.VCLPath
+	if vcl == "" {
+		vcl = "inline"
+	}
+	fmt.Printf("Dry run: %s\n", plan.TestFile)
+	fmt.Printf("VCL: %s (compiled with %s)\n", vcl, plan.Checker)
+	fmt.Printf("Backends: %s (mock servers on random loopback ports)\n", strings.Join(plan.Backends, ", "))
+	for _, command := range plan.Hooks.BeforeSuite {
+		fmt.Printf("before_suite: %s\n", command)
+	}
+	for _, command := range plan.Hooks.AfterSuite {
+		fmt.Printf("after_suite: %s\n", command)
+	}
+	switch {
+	case !plan.Varnishd:
+		fmt.Printf("varnishd: not started (all tests simulated)\n")
+	case plan.FakeTime:
+		fmt.Printf("varnishd: HTTP and admin on random ports, with a controllable clock for scenario tests\n")
+	default:
+		fmt.Printf("varnishd: HTTP and admin on random ports\n")
+	}
+
+	fmt.Printf("\nTests:\n")
+	for i, test := range plan.Tests {
+		engine := test.Engine
+		if test.EngineReason != "" {
+			engine += " (simulation unavailable: " + test.EngineReason + ")"
+		}
+		fmt.Printf("  %d. %s [%s] on %s\n", i+1, test.Name, test.ID, engine)
+		if test.Warmup > 0 {
+			fmt.Printf("       warmup: %d requests\n", test.Warmup)
+		}
+		for _, step := range test.Steps {
+			if step.At != "" {
+				fmt.Printf("       at %-6s %s %s\n", step.At, step.Method, step.URL)
+			} else {
+				fmt.Printf("       %s %s\n", step.Method, step.URL)
+			}
+		}
+	}
+	fmt.Printf("\n%d tests would run\n", len(plan.Tests))
+}
+
+// displayPhases shows where the time went when the suite timeout expired
+func displayPhases(phases []harness.Phase, timeout time.Duration) {
+	useColor := formatter.ShouldUseColor()
+
+	fmt.Printf("\nSuite timeout of %s exceeded. Where the time went:\n", timeout)
+	for _, phase := range phases {
+		line := fmt.Sprintf("  %10s  %s", phase.Duration.Round(time.Millisecond), phase.Name)
+		if phase.Note != "" {
+			line += " (" + phase.Note + ")"
+		}
+		if phase.Interrupted {
+			marker := "<- interrupted"
+			if useColor {
+				marker = formatter.ColorRed + marker + formatter.ColorReset
+			}
+			line += "  " + marker
+		}
+		fmt.Println(line)
+	}
+}
+
+// countKnown returns the number of failed results covered by the baseline
+func countKnown(results []runner.TestResult, known *baseline.Baseline) int {
+	n := 0
+	for _, r := range results {
+		if known.Known(r) {
+			n++
+		}
+	}
+	return n
+}
+
+// exposeVarnish returns an AfterTests hook that forwards addr to varnishd
+// until interrupted (-expose)
+func exposeVarnish(addr string) func(context.Context, *harness.Harness) error {
+	return func(ctx context.Context, h *harness.Harness) error {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("exposing varnishd: %w", err)
+		}
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		fmt.Printf("\nVarnish is exposed at http://%s (varnishd listens on %s)\n", listener.Addr(), h.VarnishURL())
+		fmt.Printf("Tests are done; press Ctrl-C to stop and see the results\n")
+		return h.Expose(ctx, listener)
+	}
+}
+
+// maxWarmupFailures is how many warmup failures are listed per test
+const maxWarmupFailures = 5
+
+// displayWarmup prints the warmup summary of a test
+func displayWarmup(w *runner.WarmupReport, useColor bool) {
+	if len(w.Failures) == 0 {
+		fmt.Printf("  Warmup: %d requests\n", w.Requests)
+		return
+	}
+	summary := fmt.Sprintf("Warmup: %d requests, %d failed", w.Requests, len(w.Failures))
+	if useColor {
+		summary = formatter.ColorYellow + summary + formatter.ColorReset
+	}
+	fmt.Printf("  %s\n", summary)
+	for i, failure := range w.Failures {
+		if i == maxWarmupFailures {
+			fmt.Printf("    ... and %d more\n", len(w.Failures)-maxWarmupFailures)
+			break
+		}
+		fmt.Printf("    - %s\n", failure)
+	}
+}
+
+// displayExplained prints how each assertion of a test was derived
+func displayExplained(steps []runner.ExplainedStep, useColor bool) {
+	fmt.Printf("  Assertions:\n")
+	for _, step := range steps {
+		indent := "    "
+		if step.Step > 0 {
+			fmt.Printf("    Step %d (at %s):\n", step.Step, formatter.FormatSimulatedTime(step.At))
+			indent = "      "
+		}
+		for _, e := range step.Explanations {
+			mark := "✓"
+			if !e.Passed {
+				mark = "✗"
+				if useColor {
+					mark = formatter.ColorRed + mark + formatter.ColorReset
+				}
+			} else if useColor {
+				mark = formatter.ColorGreen + mark + formatter.ColorReset
+			}
+			fmt.Printf("%s%s %s = %s: %s\n", indent, mark, e.Field, e.Expected, e.Derivation)
+		}
+	}
+}
+
+// displayResults prints test results to stdout. Failures covered by the
+// baseline are marked as known.
+func displayResults(result *harness.Result, known *baseline.Baseline) {
 	useColor := formatter.ShouldUseColor()
 
 	for i, testResult := range result.Results {
-		fmt.Printf("\nTest %d: %s\n", i+1, testResult.TestName)
+		fmt.Printf("\nTest %d: %s [%s]\n", i+1, testResult.TestName, testResult.ID)
+		if testResult.Warmup != nil {
+			displayWarmup(testResult.Warmup, useColor)
+		}
+		if len(testResult.Explained) > 0 {
+			displayExplained(testResult.Explained, useColor)
+		}
+
+		if known.Known(testResult) {
+			if useColor {
+				fmt.Printf("  %s⚠ KNOWN FAILURE%s (in baseline)\n", formatter.ColorYellow, formatter.ColorReset)
+			} else {
+				fmt.Printf("  ⚠ KNOWN FAILURE (in baseline)\n")
+			}
+			for _, errMsg := range testResult.Errors {
+				fmt.Printf("    - %s\n", errMsg)
+			}
+			continue
+		}
+
+		// Annotations help route failures; passing tests stay compact
+		if !testResult.Passed {
+			if testResult.Description != "" {
+				fmt.Printf("  %s\n", testResult.Description)
+			}
+			if testResult.Owner != "" {
+				fmt.Printf("  Owner: %s\n", testResult.Owner)
+			}
+			if testResult.Link != "" {
+				fmt.Printf("  Link: %s\n", testResult.Link)
+			}
+		}
 
 		if testResult.Passed {
 			if useColor {
@@ -92,6 +429,7 @@ func displayResults(result *harness.Result) {
 					output := formatter.FormatTestFailureWithBlocks(
 						testResult.TestName,
 						testResult.Errors,
+						testResult.SpecLocations,
 						files,
 						testResult.VCLTrace.BackendCalls,
 						useColor,
@@ -112,6 +450,7 @@ func displayResults(result *harness.Result) {
 					output := formatter.FormatTestFailure(
 						testResult.TestName,
 						testResult.Errors,
+						testResult.SpecLocations,
 						files,
 						testResult.VCLTrace.BackendCalls,
 						useColor,
@@ -128,6 +467,7 @@ func displayResults(result *harness.Result) {
 				for _, errMsg := range testResult.Errors {
 					fmt.Printf("    - %s\n", errMsg)
 				}
+				fmt.Print(formatter.FormatSpecLocations(testResult.SpecLocations, useColor))
 			}
 		}
 	}
@@ -138,6 +478,115 @@ func displayResults(result *harness.Result) {
 	fmt.Printf("Tests passed: %d/%d\n", result.Passed, result.Total)
 
 	if result.Failed > 0 {
-		fmt.Printf("Tests failed: %d/%d\n", result.Failed, result.Total)
+		if n := countKnown(result.Results, known); n > 0 {
+			fmt.Printf("Tests failed: %d/%d (%d known)\n", result.Failed, result.Total, n)
+		} else {
+			fmt.Printf("Tests failed: %d/%d\n", result.Failed, result.Total)
+		}
+		displayFailuresByOwner(result.Results, known)
+	}
+}
+
+// displayFailuresByOwner lists new failures per owner, if any failed test has one
+func displayFailuresByOwner(results []runner.TestResult, known *baseline.Baseline) {
+	var owners []string
+	failed := make(map[string][]string)
+	for _, r := range results {
+		if r.Passed || known.Known(r) {
+			continue
+		}
+		owner := r.Owner
+		if owner == "" {
+			owner = "(no owner)"
+		}
+		if _, ok := failed[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		failed[owner] = append(failed[owner], r.TestName)
+	}
+	if len(owners) == 0 || (len(owners) == 1 && owners[0] == "(no owner)") {
+		return
+	}
+
+	fmt.Printf("Failures by owner:\n")
+	for _, owner := range owners {
+		fmt.Printf("  %s: %s\n", owner, strings.Join(failed[owner], ", "))
+	}
+}
+
+// displayTimelines prints each test's timeline
+func displayTimelines(results []runner.TestResult) {
+	for _, r := range results {
+		if r.Timeline == nil {
+			continue
+		}
+		fmt.Printf("\nTimeline: %s\n", r.TestName)
+		fmt.Print(r.Timeline.Text())
+	}
+}
+
+// writeTimelines writes all tests' timelines to an HTML file
+func writeTimelines(path string, results []runner.TestResult) error {
+	var timelines []*timeline.Timeline
+	for _, r := range results {
+		if r.Timeline != nil {
+			timelines = append(timelines, r.Timeline)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating timeline file: %w", err)
+	}
+	defer f.Close()
+	if err := timeline.WriteHTML(f, timelines); err != nil {
+		return fmt.Errorf("writing timeline: %w", err)
+	}
+	return nil
+}
+
+// writeReport writes the JSON encoding of result, described by the schema
+// from -generate-result-schema
+func writeReport(path string, result *harness.Result) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling report: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing report: %w", err)
+	}
+	return nil
+}
+
+// displayUnusedRoutes lists the backend routes no test requested
+func displayUnusedRoutes(routes []harness.UnusedRoute) {
+	fmt.Printf("\nBackend routes never requested:\n")
+	for _, r := range routes {
+		fmt.Printf("  - %s %s (declared by %s)\n", r.Backend, r.Route, strings.Join(r.Tests, ", "))
+	}
+}
+
+// displayChaos shows how each test fared under random backend faults
+func displayChaos(report *harness.ChaosReport) {
+	useColor := formatter.ShouldUseColor()
+
+	fmt.Printf("\nChaos: p=%g, %d iterations, seed=%d\n", report.Probability, report.Iterations, report.Seed)
+	for _, t := range report.Tests {
+		switch {
+		case t.Skipped:
+			fmt.Printf("  - %s: skipped (fails without chaos)\n", t.TestName)
+		case t.Failures > 0:
+			mark := "✗"
+			if useColor {
+				mark = formatter.ColorRed + mark + formatter.ColorReset
+			}
+			fmt.Printf("  %s %s: failed %d/%d iterations (%d faults injected)\n", mark, t.TestName, t.Failures, report.Iterations, t.Faults)
+		default:
+			mark := "✓"
+			if useColor {
+				mark = formatter.ColorGreen + mark + formatter.ColorReset
+			}
+			fmt.Printf("  %s %s: passed %d/%d iterations (%d faults injected)\n", mark, t.TestName, report.Iterations, report.Iterations, t.Faults)
+		}
 	}
+	fmt.Printf("Tests sensitive to backend faults: %d\n", len(report.Sensitive()))
 }
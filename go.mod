@@ -4,7 +4,9 @@ go 1.24.4
 
 require (
 	github.com/borud/broker v1.0.2
+	github.com/invopop/jsonschema v0.13.0
 	github.com/perbu/vclparser v0.0.0-20251123183552-14568509436e
+	golang.org/x/term v0.37.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -12,9 +14,7 @@ require (
 	github.com/bahlo/generic-list-go v0.2.0 // indirect
 	github.com/buger/jsonparser v1.1.1 // indirect
 	github.com/dghubble/trie v0.0.0-20201011220304-ed6d6b8add55 // indirect
-	github.com/invopop/jsonschema v0.13.0 // indirect
 	github.com/mailru/easyjson v0.7.7 // indirect
 	github.com/wk8/go-ordered-map/v2 v2.1.8 // indirect
 	golang.org/x/sys v0.38.0 // indirect
-	golang.org/x/term v0.37.0 // indirect
 )
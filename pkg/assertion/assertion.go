@@ -1,13 +1,21 @@
 package assertion
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"maps"
+	"math"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/perbu/vcltest/pkg/backend"
 	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/formatter"
+	"github.com/perbu/vcltest/pkg/recorder"
 	"github.com/perbu/vcltest/pkg/testspec"
 )
 
@@ -15,6 +23,27 @@ import (
 type Result struct {
 	Passed bool
 	Errors []string
+
+	// Explanations records how each checked value was derived, pass or fail
+	Explanations []Explanation
+}
+
+// Explanation describes one assertion for -explain
+type Explanation struct {
+	Field      string `json:"field"` // Expectation name, e.g. "response.status" or "cache.hit"
+	Expected   string `json:"expected"`
+	Passed     bool   `json:"passed"`
+	Derivation string `json:"derivation"` // Where the actual value came from, and what it was
+}
+
+// explain records an explanation for one assertion
+func (r *Result) explain(field, expected string, passed bool, format string, args ...any) {
+	r.Explanations = append(r.Explanations, Explanation{
+		Field:      field,
+		Expected:   expected,
+		Passed:     passed,
+		Derivation: fmt.Sprintf(format, args...),
+	})
 }
 
 // Check verifies all expectations against actual results
@@ -47,33 +76,212 @@ func Check(expectations testspec.ExpectationsSpec, response *client.Response, ba
 	return result
 }
 
+// equalSecret compares header values in constant time, so that a token
+// expected in a spec cannot be guessed from how long a comparison takes.
+// Check does not know which headers are redacted, so it is used for all.
+func equalSecret(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
 func checkResponseExpectations(exp *testspec.ResponseExpectations, response *client.Response, result *Result) {
-	if response.Status != exp.Status {
-		result.Passed = false
-		result.Errors = append(result.Errors,
-			fmt.Sprintf("Response status: expected %d, got %d", exp.Status, response.Status))
+	// Status 0 matches any status (tests always set it; monitor invariants may not)
+	if exp.Status != 0 {
+		passed := response.Status == exp.Status
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Response status: expected %d, got %d", exp.Status, response.Status))
+		}
+		result.explain("response.status", strconv.Itoa(exp.Status), passed,
+			"status line of the final response: %d", response.Status)
 	}
 
-	for key, expectedValue := range exp.Headers {
+	for _, key := range slices.Sorted(maps.Keys(exp.Headers)) {
+		expectedValue := exp.Headers[key]
 		actualValue := response.Headers.Get(key)
-		if actualValue != expectedValue {
+		passed := equalSecret(actualValue, expectedValue)
+		if !passed {
 			result.Passed = false
 			result.Errors = append(result.Errors,
 				fmt.Sprintf("Response header %q: expected %q, got %q", key, expectedValue, actualValue))
 		}
+		result.explain("response.headers."+key, strconv.Quote(expectedValue), passed,
+			"%s header of the final response: %s", key, describeHeader(response.Headers, key))
 	}
 
 	if exp.BodyContains != "" {
-		if !strings.Contains(response.Body, exp.BodyContains) {
+		passed := strings.Contains(response.Body, exp.BodyContains)
+		if !passed {
 			result.Passed = false
 			bodyPreview := truncateBody(response.Body, 500)
 			result.Errors = append(result.Errors,
 				fmt.Sprintf("Response body should contain \"%s\", but doesn't.\n  Actual body: %s", exp.BodyContains, bodyPreview))
 		}
+		result.explain("response.body_contains", strconv.Quote(exp.BodyContains), passed,
+			"substring search in the decoded response body (%d bytes)", len(response.Body))
+	}
+
+	if exp.BodySize != nil {
+		want := int64(*exp.BodySize)
+		passed := response.BodySize == want
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Response body size: expected %d bytes, got %d", want, response.BodySize))
+		}
+		result.explain("response.body_size", strconv.FormatInt(want, 10), passed,
+			"bytes of the decoded response body: %d", response.BodySize)
+	}
+
+	// A body cut short fails unless the test expects it
+	complete := response.BodyError == ""
+	if exp.BodyComplete != nil || !complete {
+		want := exp.BodyComplete == nil || *exp.BodyComplete
+		passed := complete == want
+		if !passed && !complete {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Response body incomplete after %d bytes: %s", response.BodySize, response.BodyError))
+		} else if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Response body: expected it to be cut short, but all %d bytes arrived", response.BodySize))
+		}
+		derivation := "the body was read to its end"
+		if !complete {
+			derivation = "reading the body failed: " + response.BodyError
+		}
+		result.explain("response.body_complete", strconv.FormatBool(want), passed, "%s (%d bytes)", derivation, response.BodySize)
+	}
+
+	if exp.FinalURL != "" {
+		passed := response.FinalURL == exp.FinalURL
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Final URL: expected %q, got %q", exp.FinalURL, response.FinalURL))
+		}
+		result.explain("response.final_url", strconv.Quote(exp.FinalURL), passed,
+			"URL of the last request after following %d redirect(s): %q", len(response.RedirectChain), response.FinalURL)
+	}
+
+	if len(exp.RedirectChain) > 0 {
+		passed := slices.Equal(exp.RedirectChain, response.RedirectChain)
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Redirect chain: expected %s, got %s", formatChain(exp.RedirectChain), formatChain(response.RedirectChain)))
+		}
+		result.explain("response.redirect_chain", formatChain(exp.RedirectChain), passed,
+			"Location headers of the redirects followed: %s", formatChain(response.RedirectChain))
+	}
+
+	if exp.NoStoreForClient {
+		checkNoStoreForClient(response, result)
+	}
+}
+
+// CheckPrevious compares response headers with the responses of earlier
+// scenario steps (header_equals_previous, header_differs_previous).
+// previous holds the response of each earlier step, in order.
+func CheckPrevious(exp *testspec.ResponseExpectations, response *client.Response, previous []*client.Response, result *Result) {
+	lookup := func(check testspec.PreviousHeaderSpec) (current, earlier string, ok bool) {
+		if check.Step < 1 || check.Step > len(previous) || previous[check.Step-1] == nil {
+			result.Passed = false
+			result.Errors = append(result.Errors, fmt.Sprintf("Response header %q: no response from step %d to compare with", check.Header, check.Step))
+			return "", "", false
+		}
+		return response.Headers.Get(check.Header), previous[check.Step-1].Headers.Get(check.Header), true
+	}
+
+	for _, check := range exp.HeaderEqualsPrevious {
+		current, earlier, ok := lookup(check)
+		switch {
+		case !ok:
+			continue
+		case earlier == "":
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Response header %q: missing in step %d, nothing to compare with", check.Header, check.Step))
+		case current != earlier:
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Response header %q: expected same value as step %d (%q), got %q", check.Header, check.Step, earlier, current))
+		}
+		result.explain("response.header_equals_previous."+check.Header, fmt.Sprintf("same as step %d", check.Step),
+			earlier != "" && current == earlier, "%s header of this response (%q) and of step %d (%q)", check.Header, current, check.Step, earlier)
+	}
+	for _, check := range exp.HeaderDiffersPrevious {
+		current, earlier, ok := lookup(check)
+		if !ok {
+			continue
+		}
+		if current == earlier {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Response header %q: expected a different value than step %d, got %q again", check.Header, check.Step, current))
+		}
+		result.explain("response.header_differs_previous."+check.Header, fmt.Sprintf("different from step %d", check.Step),
+			current != earlier, "%s header of this response (%q) and of step %d (%q)", check.Header, current, check.Step, earlier)
+	}
+}
+
+// checkNoStoreForClient verifies that a response cannot be cached downstream:
+// Cache-Control must carry no-store or private, and validators (which let a
+// client revalidate a stored copy) must not be sent
+func checkNoStoreForClient(response *client.Response, result *Result) {
+	cacheControl := strings.Join(response.Headers.Values("Cache-Control"), ", ")
+	directives := make(map[string]bool)
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		directives[strings.ToLower(name)] = true
+	}
+	passed := directives["no-store"] || directives["private"]
+	if !passed {
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("No store for client: Cache-Control must contain no-store or private, got %q", cacheControl))
+	}
+
+	var validators []string
+	for _, validator := range []string{"ETag", "Last-Modified"} {
+		if value := response.Headers.Get(validator); value != "" {
+			passed = false
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("No store for client: validator %s must not be sent, got %q", validator, value))
+		}
+		validators = append(validators, validator+" "+describeHeader(response.Headers, validator))
 	}
+	result.explain("response.no_store_for_client", "no-store or private, no validators", passed,
+		"Cache-Control header: %s; %s", describeHeader(response.Headers, "Cache-Control"), strings.Join(validators, ", "))
+}
+
+// describeHeader formats a response header value for explanations
+func describeHeader(headers http.Header, key string) string {
+	values := headers.Values(key)
+	if len(values) == 0 {
+		return "(absent)"
+	}
+	return strconv.Quote(strings.Join(values, ", "))
+}
+
+// formatAge formats an age in seconds the way all durations are shown
+func formatAge(seconds int) string {
+	return formatter.FormatSeconds(time.Duration(seconds) * time.Second)
+}
+
+// formatChain formats a redirect chain for error messages
+func formatChain(chain []string) string {
+	if len(chain) == 0 {
+		return "(no redirects)"
+	}
+	return strings.Join(chain, " -> ")
 }
 
 func checkBackendExpectations(exp *testspec.BackendExpectations, backendCalls map[string]int, result *Result) {
+	counters := "mock backend request counters: " + formatBackendCalls(backendCalls)
+
 	// Format 1: Simple string (backend: "api_server")
 	// Asserts that this backend was called at least once
 	if exp.Name != "" {
@@ -83,6 +291,7 @@ func checkBackendExpectations(exp *testspec.BackendExpectations, backendCalls ma
 			result.Errors = append(result.Errors,
 				fmt.Sprintf("Backend %q: expected to be called, but was not.\n  Backends called: %s", exp.Name, formatBackendCalls(backendCalls)))
 		}
+		result.explain("backend", strconv.Quote(exp.Name), calls > 0, "%s", counters)
 		return
 	}
 
@@ -94,6 +303,7 @@ func checkBackendExpectations(exp *testspec.BackendExpectations, backendCalls ma
 			result.Errors = append(result.Errors,
 				fmt.Sprintf("Backend %q: expected to be called, but was not.\n  Backends called: %s", exp.Used, formatBackendCalls(backendCalls)))
 		}
+		result.explain("backend.used", strconv.Quote(exp.Used), calls > 0, "%s", counters)
 	}
 
 	// Check total call count across all backends
@@ -107,21 +317,217 @@ func checkBackendExpectations(exp *testspec.BackendExpectations, backendCalls ma
 			result.Errors = append(result.Errors,
 				fmt.Sprintf("Backend calls: expected %d total, got %d", *exp.Calls, totalCalls))
 		}
+		result.explain("backend.calls", strconv.Itoa(*exp.Calls), totalCalls == *exp.Calls,
+			"sum of %s = %d", counters, totalCalls)
 	}
 
 	// Format 3: Per-backend call counts (backends: {api_server: {calls: 1}})
-	if len(exp.PerBackend) > 0 {
-		for backendName, expectation := range exp.PerBackend {
-			actualCalls := backendCalls[backendName]
-			if actualCalls != expectation.Calls {
-				result.Passed = false
-				result.Errors = append(result.Errors,
-					fmt.Sprintf("Backend %q calls: expected %d, got %d", backendName, expectation.Calls, actualCalls))
+	for _, backendName := range slices.Sorted(maps.Keys(exp.PerBackend)) {
+		expectation := exp.PerBackend[backendName]
+		actualCalls := backendCalls[backendName]
+		if actualCalls != expectation.Calls {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Backend %q calls: expected %d, got %d", backendName, expectation.Calls, actualCalls))
+		}
+		result.explain("backends."+backendName+".calls", strconv.Itoa(expectation.Calls), actualCalls == expectation.Calls,
+			"%s", counters)
+	}
+}
+
+// CheckStorage checks a storage expectation. storage is the VSL Storage
+// record of the fetch that created the delivered object (e.g. "malloc s0"),
+// empty if none was found; source says how that fetch was identified.
+func CheckStorage(expected, storage, source string, result *Result) {
+	if storage == "" {
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("Storage: expected %s, but no Storage record was found (%s)", expected, source))
+		result.explain("storage", expected, false, "no VSL Storage record for %s", source)
+		return
+	}
+	actual := storageClass(storage)
+	if actual != expected {
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("Storage: expected %s, got %s (Storage %s).\n  Object from %s", expected, actual, storage, source))
+	}
+	result.explain("storage", expected, actual == expected, "VSL: Storage %s of %s", storage, source)
+}
+
+// storageClass returns the storage expectation value of a VSL Storage
+// record: transient for Varnish's Transient storage, main for any other
+func storageClass(storage string) string {
+	fields := strings.Fields(storage)
+	if len(fields) > 0 && fields[len(fields)-1] == "Transient" {
+		return testspec.StorageTransient
+	}
+	return testspec.StorageMain
+}
+
+// CheckBackendParams checks the route parameters of per-backend
+// expectations against the last request each backend received (from its
+// access log). last has no entry for backends that received no request.
+func CheckBackendParams(exp *testspec.BackendExpectations, last map[string]backend.Request, result *Result) {
+	for _, backendName := range slices.Sorted(maps.Keys(exp.PerBackend)) {
+		want := exp.PerBackend[backendName].Params
+		if len(want) == 0 {
+			continue
+		}
+		field := "backends." + backendName + ".params"
+		req, ok := last[backendName]
+		if !ok {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Backend %q params: expected %s, but the backend received no request", backendName, formatParams(want)))
+			result.explain(field, formatParams(want), false, "mock backend access log: (empty)")
+			continue
+		}
+		passed := true
+		for _, name := range slices.Sorted(maps.Keys(want)) {
+			if actual, found := req.Params[name]; !found || actual != want[name] {
+				passed = false
 			}
 		}
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Backend %q params: expected %s, got %s (last request: %s %s)",
+					backendName, formatParams(want), formatParams(req.Params), req.Method, req.URL))
+		}
+		result.explain(field, formatParams(want), passed,
+			"route parameters of the last request in the mock backend access log (%s %s): %s", req.Method, req.URL, formatParams(req.Params))
+	}
+}
+
+// BackendCall is a request received by a mock backend, placed on the
+// simulated clock of a scenario
+type BackendCall struct {
+	Backend string
+	At      time.Duration // Simulated time offset from the scenario start
+	Method  string
+	URL     string
+}
+
+// CheckCallsBetween checks backend.calls_between windows against the calls
+// made since the scenario started
+func CheckCallsBetween(windows testspec.CallWindows, calls []BackendCall, result *Result) {
+	for _, w := range windows {
+		from, to := time.Duration(w.From), time.Duration(w.To)
+		var matched []string
+		for _, call := range calls {
+			if call.At < from || call.At >= to || (w.Backend != "" && call.Backend != w.Backend) {
+				continue
+			}
+			matched = append(matched, fmt.Sprintf("%s %s at %s on %s", call.Method, call.URL, call.At.Round(time.Millisecond), call.Backend))
+		}
+		scope := "Backend calls"
+		if w.Backend != "" {
+			scope = fmt.Sprintf("Backend %q calls", w.Backend)
+		}
+		seen := "none"
+		if len(matched) > 0 {
+			seen = strings.Join(matched, ", ")
+		}
+		passed := len(matched) == *w.Calls
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("%s between %s and %s: expected %d, got %d (%s)", scope, w.From, w.To, *w.Calls, len(matched), seen))
+		}
+		result.explain("backend.calls_between", fmt.Sprintf("%d in [%s, %s)", *w.Calls, w.From, w.To), passed,
+			"mock backend access logs on the simulated clock: %s", seen)
 	}
 }
 
+// CheckContinue checks the 100-continue exchange of a request sent with
+// expect_continue. Backend expectations use the latest request a backend
+// received after the client sent its headers, from the access logs in last.
+func CheckContinue(exp *testspec.ContinueExpectations, response *client.Response, last map[string]backend.Request, result *Result) {
+	cont := response.Continue
+	if cont == nil {
+		// The body was dropped on a redirect, so nothing was held back
+		cont = &client.Continue{}
+	}
+	received := !cont.Received.IsZero()
+	waited := "no 100 Continue"
+	if received {
+		waited = fmt.Sprintf("100 Continue after %s", cont.Received.Sub(cont.HeadersSent).Round(time.Microsecond))
+	}
+
+	if exp.Received != nil {
+		passed := received == *exp.Received
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors, fmt.Sprintf("100 Continue received: expected %t, got %t", *exp.Received, received))
+		}
+		result.explain("continue.received", strconv.FormatBool(*exp.Received), passed, "client trace: %s", waited)
+	}
+	if exp.Within != nil {
+		within := time.Duration(*exp.Within)
+		passed := received && cont.Received.Sub(cont.HeadersSent) <= within
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors, fmt.Sprintf("100 Continue within %s: got %s", within, waited))
+		}
+		result.explain("continue.within", within.String(), passed, "client trace: %s", waited)
+	}
+
+	if exp.ExpectForwarded == nil && exp.BodyAfterContinue == nil {
+		return
+	}
+	var name string
+	var req backend.Request
+	for n, r := range last {
+		if !r.Time.Before(cont.HeadersSent) && (name == "" || r.Time.After(req.Time)) {
+			name, req = n, r
+		}
+	}
+	if name == "" {
+		result.Passed = false
+		result.Errors = append(result.Errors, "100-continue: expected a backend request, but no backend received one")
+		result.explain("continue", "a backend request", false, "mock backend access logs: no request since the client sent its headers")
+		return
+	}
+
+	if exp.ExpectForwarded != nil {
+		forwarded := req.Expect != ""
+		passed := forwarded == *exp.ExpectForwarded
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors, fmt.Sprintf("Expect header forwarded to backend %q: expected %t, got %t (Expect: %q)", name, *exp.ExpectForwarded, forwarded, req.Expect))
+		}
+		result.explain("continue.expect_forwarded", strconv.FormatBool(*exp.ExpectForwarded), passed,
+			"Expect header of the last request to %s (%s %s): %q", name, req.Method, req.URL, req.Expect)
+	}
+	if exp.BodyAfterContinue != nil {
+		after := received && !req.BodyAt.IsZero() && !req.BodyAt.Before(cont.Received)
+		passed := after == *exp.BodyAfterContinue
+		body := "no body"
+		if !req.BodyAt.IsZero() {
+			body = fmt.Sprintf("body read %s after the client sent its headers", req.BodyAt.Sub(cont.HeadersSent).Round(time.Microsecond))
+		}
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors, fmt.Sprintf("Backend %q received the body after 100 Continue: expected %t, got %t (%s, %s)", name, *exp.BodyAfterContinue, after, waited, body))
+		}
+		result.explain("continue.body_after_continue", strconv.FormatBool(*exp.BodyAfterContinue), passed,
+			"client trace: %s; mock backend %s: %s", waited, name, body)
+	}
+}
+
+// formatParams formats route parameters as name=value pairs in name order
+func formatParams(params map[string]string) string {
+	if len(params) == 0 {
+		return "(none)"
+	}
+	var parts []string
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, params[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
 func checkCacheExpectations(exp *testspec.CacheExpectations, response *client.Response, result *Result) {
 	if exp.Hit != nil {
 		isCached := checkIfCached(response)
@@ -132,10 +538,19 @@ func checkCacheExpectations(exp *testspec.CacheExpectations, response *client.Re
 			result.Errors = append(result.Errors,
 				fmt.Sprintf("Cache hit: expected %v, got %v.\n  X-Varnish: %q, Age: %q", *exp.Hit, isCached, xVarnish, age))
 		}
+		result.explain("cache.hit", strconv.FormatBool(*exp.Hit), isCached == *exp.Hit, "%s", explainCached(response))
 	}
 
 	if exp.AgeGt != nil || exp.AgeLt != nil {
 		ageStr := response.Headers.Get("Age")
+		var bounds []string
+		if exp.AgeGt != nil {
+			bounds = append(bounds, "> "+exp.AgeGt.String())
+		}
+		if exp.AgeLt != nil {
+			bounds = append(bounds, "< "+exp.AgeLt.String())
+		}
+		errorsBefore := len(result.Errors)
 		if ageStr == "" {
 			result.Passed = false
 			result.Errors = append(result.Errors, "Age header is missing but age constraint specified")
@@ -147,23 +562,454 @@ func checkCacheExpectations(exp *testspec.CacheExpectations, response *client.Re
 					fmt.Sprintf("Age header is not a valid number: %q", ageStr))
 			} else {
 				if exp.AgeGt != nil {
-					if age <= *exp.AgeGt {
+					if float64(age) <= exp.AgeGt.Seconds() {
 						result.Passed = false
 						result.Errors = append(result.Errors,
-							fmt.Sprintf("Age: expected > %d, got %d", *exp.AgeGt, age))
+							fmt.Sprintf("Age: expected > %s, got %s", exp.AgeGt, formatAge(age)))
 					}
 				}
 				if exp.AgeLt != nil {
-					if age >= *exp.AgeLt {
+					if float64(age) >= exp.AgeLt.Seconds() {
 						result.Passed = false
 						result.Errors = append(result.Errors,
-							fmt.Sprintf("Age: expected < %d, got %d", *exp.AgeLt, age))
+							fmt.Sprintf("Age: expected < %s, got %s", exp.AgeLt, formatAge(age)))
 					}
 				}
 			}
 		}
+		result.explain("cache.age", strings.Join(bounds, " and "), len(result.Errors) == errorsBefore,
+			"Age header of the final response: %s", describeHeader(response.Headers, "Age"))
 	}
+}
 
+// CheckTTL checks cache.ttl_gt and ttl_lt expectations against the TTL the
+// delivered object was stored with. found is false when no TTL record was
+// found; source describes the fetch the TTL was read from.
+func CheckTTL(exp *testspec.CacheExpectations, ttl float64, found bool, source string, result *Result) {
+	var bounds []string
+	if exp.TTLGt != nil {
+		bounds = append(bounds, "> "+exp.TTLGt.String())
+	}
+	if exp.TTLLt != nil {
+		bounds = append(bounds, "< "+exp.TTLLt.String())
+	}
+	expected := strings.Join(bounds, " and ")
+	if !found {
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("TTL: expected %s, but no TTL record was found (%s)", expected, source))
+		result.explain("cache.ttl", expected, false, "no VSL TTL record for %s", source)
+		return
+	}
+
+	actual := formatter.FormatSeconds(time.Duration(ttl * float64(time.Second)))
+	passed := (exp.TTLGt == nil || ttl > exp.TTLGt.Seconds()) && (exp.TTLLt == nil || ttl < exp.TTLLt.Seconds())
+	if !passed {
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("TTL: expected %s, got %s.\n  Object from %s", expected, actual, source))
+	}
+	result.explain("cache.ttl", expected, passed, "VSL: TTL %s of %s", actual, source)
+}
+
+// clockSkew is varnishd's default clock_skew: a Date header closer than
+// this to its own clock means the clocks agree
+const clockSkew = 10
+
+// HeaderTTL derives a TTL in seconds from backend response headers the way
+// varnishd does for cacheable statuses: s-maxage, then max-age, then
+// Expires counted from now (or from Date, when the clocks disagree). source
+// is a testspec.TTLSource value; with TTLSourceDefault the TTL is
+// default_ttl, which the headers do not tell, and ttl is 0.
+func HeaderTTL(headers http.Header, now float64) (ttl float64, source string) {
+	for _, directive := range []string{testspec.TTLSourceSMaxAge, testspec.TTLSourceMaxAge} {
+		if value, ok := cacheControl(headers, directive); ok {
+			return parseMaxAge(value), directive
+		}
+	}
+	expiresTime, err := http.ParseTime(headers.Get("Expires"))
+	if err != nil {
+		return 0, testspec.TTLSourceDefault
+	}
+	expires, date := float64(expiresTime.Unix()), 0.0
+	if dateTime, err := http.ParseTime(headers.Get("Date")); err == nil {
+		date = float64(dateTime.Unix())
+	}
+	switch {
+	case expires < date:
+		return 0, testspec.TTLSourceExpires
+	case date == 0 || math.Abs(date-now) < clockSkew:
+		// An Expires already past by our clock gives 0, as in varnishd
+		return max(expires-now, 0), testspec.TTLSourceExpires
+	default:
+		return expires - date, testspec.TTLSourceExpires
+	}
+}
+
+// cacheControl returns the value of a Cache-Control directive that has one
+func cacheControl(headers http.Header, directive string) (string, bool) {
+	for _, header := range headers.Values("Cache-Control") {
+		for _, field := range strings.Split(header, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(name), directive) {
+				return strings.Trim(value, `" `), true
+			}
+		}
+	}
+	return "", false
+}
+
+// parseMaxAge parses a delta-seconds value like varnishd: digits up to the
+// first other character, so "-1" and garbage are 0
+func parseMaxAge(value string) float64 {
+	end := 0
+	for end < len(value) && value[end] >= '0' && value[end] <= '9' {
+		end++
+	}
+	seconds, _ := strconv.ParseFloat(value[:end], 64)
+	return seconds
+}
+
+// formatTTL formats a TTL in seconds the way all durations are shown
+func formatTTL(seconds float64) string {
+	return formatter.FormatSeconds(time.Duration(seconds * float64(time.Second)))
+}
+
+// CheckFreshness checks cache.ttl_respects_age and ttl_source expectations
+// against the fetch that created the delivered object. f is nil when that
+// fetch has no RFC TTL record; source describes the fetch.
+func CheckFreshness(exp *testspec.CacheExpectations, f *recorder.Freshness, source string, result *Result) {
+	if !exp.TTLRespectsAge && exp.TTLSource == "" {
+		return
+	}
+	if f == nil {
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("TTL: cannot check ttl_respects_age or ttl_source, no RFC TTL record was found (%s)", source))
+		result.explain("cache.ttl_freshness", "an RFC TTL record", false, "no VSL RFC TTL record for %s", source)
+		return
+	}
+
+	lifetime, from := HeaderTTL(f.Headers, f.Now)
+	if from == testspec.TTLSourceDefault {
+		lifetime = f.RFCTTL
+	}
+	headers := fmt.Sprintf("Cache-Control %s, Expires %s, Age %s",
+		describeHeader(f.Headers, "Cache-Control"), describeHeader(f.Headers, "Expires"), describeHeader(f.Headers, "Age"))
+
+	if exp.TTLRespectsAge {
+		// A TTL counts from the time the object was created upstream, Age
+		// seconds ago, so what is left is the TTL minus the Age
+		want, got := lifetime-f.Age, f.TTL-f.Age
+		passed := math.Abs(got-want) <= 1
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("TTL respects Age: expected %s left (%s from %s, minus Age %s), got %s.\n  Object from %s",
+					formatTTL(want), formatTTL(lifetime), from, formatTTL(f.Age), formatTTL(got), source))
+		}
+		result.explain("cache.ttl_respects_age", formatTTL(want)+" left", passed,
+			"VSL: TTL %s of %s minus Age %s leaves %s; backend response: %s", formatTTL(f.TTL), source, formatTTL(f.Age), formatTTL(got), headers)
+	}
+
+	if exp.TTLSource != "" {
+		passed := from == exp.TTLSource && math.Abs(f.TTL-lifetime) <= 1
+		switch {
+		case from != exp.TTLSource:
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("TTL source: expected %s, got %s (%s).\n  Object from %s", exp.TTLSource, from, headers, source))
+		case !passed:
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("TTL source: %s gives %s, but the object was stored with %s (set in VCL).\n  Object from %s",
+					from, formatTTL(lifetime), formatTTL(f.TTL), source))
+		}
+		result.explain("cache.ttl_source", exp.TTLSource, passed,
+			"%s gives %s by %s; VSL: stored with TTL %s by %s", headers, formatTTL(lifetime), from, formatTTL(f.TTL), source)
+	}
+}
+
+// CheckESI checks esi expectations. The body is checked against the
+// response, the rest against esi, read from the VSL of the request; esi is
+// nil when the VSL could not be read, and source says why.
+func CheckESI(exp *testspec.ESIExpectations, response *client.Response, esi *recorder.ESIRequest, source string, result *Result) {
+	if exp.Body != nil {
+		passed := response.Body == *exp.Body
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("ESI body: expected %s, got %s", truncateBody(*exp.Body, 500), truncateBody(response.Body, 500)))
+		}
+		result.explain("esi.body", truncateBody(*exp.Body, 100), passed,
+			"the decoded response body (%d bytes)", len(response.Body))
+	}
+	if exp.Includes == nil && len(exp.Fragments) == 0 && exp.ParentCached == nil {
+		return
+	}
+	if esi == nil {
+		result.Passed = false
+		result.Errors = append(result.Errors, fmt.Sprintf("ESI: cannot check includes, fragments or parent_cached (%s)", source))
+		result.explain("esi", "VSL of the request", false, "%s", source)
+		return
+	}
+
+	if exp.Includes != nil {
+		passed := len(esi.Fragments) == *exp.Includes
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("ESI includes: expected %d, got %d (%s)", *exp.Includes, len(esi.Fragments), formatFragments(esi.Fragments)))
+		}
+		result.explain("esi.includes", strconv.Itoa(*exp.Includes), passed,
+			"VSL: %d subrequests begun with reason esi (%s)", len(esi.Fragments), formatFragments(esi.Fragments))
+	}
+
+	for _, url := range slices.Sorted(maps.Keys(exp.Fragments)) {
+		want := exp.Fragments[url]
+		var statuses []int
+		for _, fragment := range esi.Fragments {
+			if fragment.URL == url {
+				statuses = append(statuses, fragment.Status)
+			}
+		}
+		passed := len(statuses) > 0
+		for _, status := range statuses {
+			passed = passed && status == want
+		}
+		switch {
+		case len(statuses) == 0:
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("ESI fragment %s: expected status %d, but it was not included (%s)", url, want, formatFragments(esi.Fragments)))
+		case !passed:
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("ESI fragment %s: expected status %d, got %s", url, want, fmt.Sprint(statuses)))
+		}
+		result.explain("esi.fragments."+url, strconv.Itoa(want), passed,
+			"VSL: RespStatus of the esi subrequests for %s: %s", url, fmt.Sprint(statuses))
+	}
+
+	if exp.ParentCached != nil {
+		actual := esi.Cached()
+		passed := actual == *exp.ParentCached
+		if !passed {
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("ESI parent cached: expected %t, got %t (%s)", *exp.ParentCached, actual, describeParent(esi)))
+		}
+		result.explain("esi.parent_cached", strconv.FormatBool(*exp.ParentCached), passed, "VSL: %s", describeParent(esi))
+	}
+}
+
+// formatFragments lists ESI subrequests as "url status", or says there were none
+func formatFragments(fragments []recorder.ESIFragment) string {
+	if len(fragments) == 0 {
+		return "no ESI subrequests"
+	}
+	parts := make([]string, len(fragments))
+	for i, fragment := range fragments {
+		parts[i] = fmt.Sprintf("%s %d", fragment.URL, fragment.Status)
+	}
+	return "included: " + strings.Join(parts, ", ")
+}
+
+// describeParent says how the parent of an ESI response was delivered
+func describeParent(esi *recorder.ESIRequest) string {
+	switch {
+	case esi.Hit:
+		return "the parent was a cache hit"
+	case esi.FetchReason == "":
+		return "the parent had no backend fetch"
+	case esi.FetchReason != "fetch":
+		return fmt.Sprintf("the parent's backend request was a %s", esi.FetchReason)
+	case esi.FetchTTL == "":
+		return "the parent's fetch logged no TTL record"
+	default:
+		return fmt.Sprintf("the parent's fetch logged TTL %s", esi.FetchTTL)
+	}
+}
+
+// CheckHitRatio checks the second-pass responses of a cache.hit_ratio
+// expectation. responses[i] is the response for exp.URLs[i].
+func CheckHitRatio(exp *testspec.HitRatioSpec, responses []*client.Response, result *Result) {
+	var hitURLs, misses []string
+	for i, response := range responses {
+		if checkIfCached(response) {
+			hitURLs = append(hitURLs, exp.URLs[i])
+		} else {
+			misses = append(misses, exp.URLs[i])
+		}
+	}
+
+	hits := len(hitURLs)
+	ratio := float64(hits) / float64(len(responses))
+	expected := fmt.Sprintf(">= %g", exp.Min)
+	passed := ratio >= exp.Min
+	if ratio < exp.Min {
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("Cache hit ratio: expected >= %g, got %.2f (%d/%d hits on second pass).\n  Misses: %s",
+				exp.Min, ratio, hits, len(responses), strings.Join(misses, ", ")))
+	}
+	if exp.Max != nil {
+		expected = fmt.Sprintf("<= %g", *exp.Max)
+		if exp.Min > 0 {
+			expected = fmt.Sprintf("between %g and %g", exp.Min, *exp.Max)
+		}
+		if ratio > *exp.Max {
+			passed = false
+			result.Passed = false
+			result.Errors = append(result.Errors,
+				fmt.Sprintf("Cache hit ratio: expected <= %g, got %.2f (%d/%d hits on second pass).\n  Hits: %s",
+					*exp.Max, ratio, hits, len(responses), strings.Join(hitURLs, ", ")))
+		}
+	}
+	result.explain("cache.hit_ratio", expected, passed,
+		"each URL requested twice; %d/%d second-pass responses were hits by X-Varnish/Age (ratio %.2f)", hits, len(responses), ratio)
+}
+
+// CheckAENormalization checks the second-pass responses of a
+// cache.ae_normalization expectation: all must be hits, served from at most
+// MaxVariants objects. responses[i] is the response for values[i]; fetches is
+// the number of backend fetches over both passes.
+func CheckAENormalization(exp *testspec.AENormalizationSpec, values []string, responses []*client.Response, fetches int, result *Result) {
+	maxVariants := exp.MaxVariants
+	if maxVariants == 0 {
+		maxVariants = 1
+	}
+
+	// On a hit, the second X-Varnish ID identifies the cached object
+	var misses, objects []string
+	served := make(map[string][]string)
+	for i, response := range responses {
+		parts := strings.Fields(response.Headers.Get("X-Varnish"))
+		if len(parts) != 2 {
+			misses = append(misses, fmt.Sprintf("%q", values[i]))
+			continue
+		}
+		if _, ok := served[parts[1]]; !ok {
+			objects = append(objects, parts[1])
+		}
+		served[parts[1]] = append(served[parts[1]], fmt.Sprintf("%q", values[i]))
+	}
+
+	if len(misses) > 0 {
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("Accept-Encoding normalization: %d/%d responses on second pass were not cache hits (%d backend fetches).\n  Not cached: %s",
+				len(misses), len(responses), fetches, strings.Join(misses, ", ")))
+	}
+	if len(objects) > maxVariants {
+		var variants []string
+		for _, obj := range objects {
+			variants = append(variants, fmt.Sprintf("object %s: %s", obj, strings.Join(served[obj], ", ")))
+		}
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("Accept-Encoding normalization: expected at most %d cached variants, got %d (%d backend fetches).\n  %s",
+				maxVariants, len(objects), fetches, strings.Join(variants, "\n  ")))
+	}
+	result.explain("cache.ae_normalization", fmt.Sprintf("all hits, at most %d variant(s)", maxVariants),
+		len(misses) == 0 && len(objects) <= maxVariants,
+		"%d Accept-Encoding values requested twice; second pass: %d miss(es), %d distinct object(s) by the second X-Varnish ID; %d backend fetch(es) from the mock backend counters",
+		len(values), len(misses), len(objects), fetches)
+}
+
+// CheckCookieVariation checks the second-pass responses of a
+// cache.cookie_variation matrix, one per row: noise-only rows must be hits on
+// a single object, and no significant cookie may be served from the noise
+// object, from another significant cookie's object, or from a different
+// object once noise cookies are added. Significant rows that are not cached
+// count as their own variant. The variation table is added to the error.
+func CheckCookieVariation(rows []testspec.CookieVariationRow, responses []*client.Response, fetches int, result *Result) {
+	// On a hit, the second X-Varnish ID identifies the cached object
+	objects := make([]string, len(responses))
+	for i, response := range responses {
+		if parts := strings.Fields(response.Headers.Get("X-Varnish")); len(parts) == 2 {
+			objects[i] = parts[1]
+		}
+	}
+
+	var noiseObject string
+	noiseObjects := 0
+	owner := make(map[string]string) // object -> significant cookie first served from it
+	verdicts := make([]string, len(rows))
+	for i, row := range rows {
+		obj := objects[i]
+		if row.Significant != "" {
+			continue
+		}
+		switch {
+		case obj == "":
+			verdicts[i] = "not cached, expected a hit on the shared object"
+		case noiseObject == "":
+			noiseObject = obj
+			noiseObjects = 1
+		case obj != noiseObject:
+			verdicts[i] = "separate variant, expected the shared object"
+			noiseObjects++
+		}
+	}
+	for i, row := range rows {
+		obj := objects[i]
+		if row.Significant == "" || obj == "" {
+			continue
+		}
+		switch other, seen := owner[obj]; {
+		case obj == noiseObject:
+			verdicts[i] = "served from the shared object, cookie ignored"
+		case !seen:
+			owner[obj] = row.Significant
+		case other != row.Significant:
+			verdicts[i] = fmt.Sprintf("shares a variant with %s", other)
+		}
+	}
+	// A significant cookie must keep its variant when noise is added
+	for i, row := range rows {
+		if row.Significant == "" || row.Cookie == row.Significant || verdicts[i] != "" {
+			continue
+		}
+		for j, alone := range rows {
+			if alone.Cookie == row.Significant && objects[i] != "" && objects[j] != "" && objects[i] != objects[j] {
+				verdicts[i] = "separate variant from the cookie alone, noise not stripped"
+			}
+		}
+	}
+
+	var failures int
+	table := []string{fmt.Sprintf("%-40s %-12s %s", "Cookie", "Served by", "Verdict")}
+	for i, row := range rows {
+		cookie := row.Cookie
+		switch {
+		case cookie == "":
+			cookie = "(none)"
+		case len(cookie) > 40:
+			cookie = cookie[:37] + "..."
+		}
+		servedBy := "not cached"
+		if objects[i] != "" {
+			servedBy = "object " + objects[i]
+		}
+		verdict := verdicts[i]
+		if verdict == "" {
+			verdict = "ok"
+		} else {
+			failures++
+		}
+		table = append(table, fmt.Sprintf("%-40s %-12s %s", cookie, servedBy, verdict))
+	}
+
+	if failures > 0 {
+		result.Passed = false
+		result.Errors = append(result.Errors,
+			fmt.Sprintf("Cookie variation: %d/%d requests on second pass served wrongly (%d backend fetches).\n  %s",
+				failures, len(rows), fetches, strings.Join(table, "\n  ")))
+	}
+	result.explain("cache.cookie_variation", "noise cookies share one object, significant cookies vary", failures == 0,
+		"%d cookie combinations requested twice; second pass: noise served from %d object(s), %d wrong by the second X-Varnish ID; %d backend fetch(es) from the mock backend counters\n      %s",
+		len(rows), noiseObjects, failures, fetches, strings.Join(table, "\n      "))
 }
 
 // checkIfCached determines if a response was served from cache
@@ -192,6 +1038,22 @@ func checkIfCached(response *client.Response) bool {
 	return false
 }
 
+// explainCached describes how checkIfCached reached its verdict
+func explainCached(response *client.Response) string {
+	xVarnish := response.Headers.Get("X-Varnish")
+	if parts := strings.Fields(xVarnish); len(parts) == 2 {
+		return fmt.Sprintf("X-Varnish header %q has two IDs (request %s, cached object %s): hit", xVarnish, parts[0], parts[1])
+	}
+	verdict := "miss"
+	if checkIfCached(response) {
+		verdict = "hit"
+	}
+	if xVarnish == "" {
+		return fmt.Sprintf("X-Varnish header absent; Age header %s: %s", describeHeader(response.Headers, "Age"), verdict)
+	}
+	return fmt.Sprintf("X-Varnish header %q has one ID; Age header %s: %s", xVarnish, describeHeader(response.Headers, "Age"), verdict)
+}
+
 // formatBackendCalls formats the backend call map for error messages
 func formatBackendCalls(calls map[string]int) string {
 	if len(calls) == 0 {
@@ -243,15 +1105,22 @@ func checkCookieExpectations(expected map[string]string, jar http.CookieJar, req
 	}
 
 	// Check each expected cookie
-	for name, expectedValue := range expected {
-		if actualValue, ok := jarMap[name]; !ok {
+	for _, name := range slices.Sorted(maps.Keys(expected)) {
+		expectedValue := expected[name]
+		actualValue, ok := jarMap[name]
+		if !ok {
 			result.Passed = false
 			result.Errors = append(result.Errors,
 				fmt.Sprintf("cookie %q: expected in jar, but not present", name))
-		} else if actualValue != expectedValue {
+			result.explain("cookies."+name, strconv.Quote(expectedValue), false, "cookie jar for %s: (absent)", requestURL.Host)
+			continue
+		}
+		if actualValue != expectedValue {
 			result.Passed = false
 			result.Errors = append(result.Errors,
 				fmt.Sprintf("cookie %q: expected %q, got %q", name, expectedValue, actualValue))
 		}
+		result.explain("cookies."+name, strconv.Quote(expectedValue), actualValue == expectedValue,
+			"cookie jar for %s: %q", requestURL.Host, actualValue)
 	}
 }
@@ -4,8 +4,11 @@ import (
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/perbu/vcltest/pkg/backend"
 	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/recorder"
 	"github.com/perbu/vcltest/pkg/testspec"
 )
 
@@ -263,6 +266,7 @@ func TestCheck_BackendCacheHit_ZeroCalls(t *testing.T) {
 }
 
 func TestCheck_ResponseExpectations(t *testing.T) {
+	oneMB, oneKB := testspec.Size(1<<20), testspec.Size(1<<10)
 	tests := []struct {
 		name           string
 		responseExp    testspec.ResponseExpectations
@@ -293,6 +297,41 @@ func TestCheck_ResponseExpectations(t *testing.T) {
 			expectErrorStr: "Response status: expected 200, got 404",
 		},
 
+		// Body size and completeness
+		{
+			name:        "body size match",
+			responseExp: testspec.ResponseExpectations{Status: 200, BodySize: &oneMB},
+			response:    &client.Response{Status: 200, Headers: http.Header{}, BodySize: 1 << 20},
+			expectPass:  true,
+		},
+		{
+			name:           "body size mismatch",
+			responseExp:    testspec.ResponseExpectations{Status: 200, BodySize: &oneKB},
+			response:       &client.Response{Status: 200, Headers: http.Header{}, BodySize: 512},
+			expectPass:     false,
+			expectErrorStr: "Response body size: expected 1024 bytes, got 512",
+		},
+		{
+			name:           "body cut short",
+			responseExp:    testspec.ResponseExpectations{Status: 200},
+			response:       &client.Response{Status: 200, Headers: http.Header{}, BodySize: 512, BodyError: "unexpected EOF"},
+			expectPass:     false,
+			expectErrorStr: "Response body incomplete after 512 bytes: unexpected EOF",
+		},
+		{
+			name:        "body cut short as expected",
+			responseExp: testspec.ResponseExpectations{Status: 200, BodyComplete: new(bool)},
+			response:    &client.Response{Status: 200, Headers: http.Header{}, BodySize: 512, BodyError: "unexpected EOF"},
+			expectPass:  true,
+		},
+		{
+			name:           "body complete but expected cut short",
+			responseExp:    testspec.ResponseExpectations{Status: 200, BodyComplete: new(bool)},
+			response:       &client.Response{Status: 200, Headers: http.Header{}, BodySize: 512},
+			expectPass:     false,
+			expectErrorStr: "Response body: expected it to be cut short, but all 512 bytes arrived",
+		},
+
 		// Header expectations
 		{
 			name: "header match",
@@ -396,6 +435,91 @@ func TestCheck_ResponseExpectations(t *testing.T) {
 			},
 			expectPass: true,
 		},
+
+		// Redirect expectations
+		{
+			name: "final url and chain match",
+			responseExp: testspec.ResponseExpectations{
+				Status:        200,
+				FinalURL:      "https://www.example.com/new",
+				RedirectChain: []string{"/old-2", "https://www.example.com/new"},
+			},
+			response: &client.Response{
+				Status:        200,
+				Headers:       http.Header{},
+				FinalURL:      "https://www.example.com/new",
+				RedirectChain: []string{"/old-2", "https://www.example.com/new"},
+			},
+			expectPass: true,
+		},
+		{
+			name: "final url mismatch",
+			responseExp: testspec.ResponseExpectations{
+				Status:   200,
+				FinalURL: "/new",
+			},
+			response: &client.Response{
+				Status:   200,
+				Headers:  http.Header{},
+				FinalURL: "/old",
+			},
+			expectPass:     false,
+			expectErrorStr: `Final URL: expected "/new", got "/old"`,
+		},
+		{
+			name: "redirect chain mismatch",
+			responseExp: testspec.ResponseExpectations{
+				Status:        200,
+				RedirectChain: []string{"/a", "/b"},
+			},
+			response: &client.Response{
+				Status:   200,
+				Headers:  http.Header{},
+				FinalURL: "/",
+			},
+			expectPass:     false,
+			expectErrorStr: "Redirect chain: expected /a -> /b, got (no redirects)",
+		},
+
+		// No store for client preset
+		{
+			name:        "no store for client private",
+			responseExp: testspec.ResponseExpectations{Status: 200, NoStoreForClient: true},
+			response: &client.Response{
+				Status:  200,
+				Headers: http.Header{"Cache-Control": []string{"Private, max-age=0"}},
+			},
+			expectPass: true,
+		},
+		{
+			name:        "no store for client no-store in second header",
+			responseExp: testspec.ResponseExpectations{Status: 200, NoStoreForClient: true},
+			response: &client.Response{
+				Status:  200,
+				Headers: http.Header{"Cache-Control": []string{"max-age=0", "no-store"}},
+			},
+			expectPass: true,
+		},
+		{
+			name:        "no store for client cacheable",
+			responseExp: testspec.ResponseExpectations{Status: 200, NoStoreForClient: true},
+			response: &client.Response{
+				Status:  200,
+				Headers: http.Header{"Cache-Control": []string{"public, max-age=60, no-store-x"}},
+			},
+			expectPass:     false,
+			expectErrorStr: `Cache-Control must contain no-store or private, got "public, max-age=60, no-store-x"`,
+		},
+		{
+			name:        "no store for client leaked validator",
+			responseExp: testspec.ResponseExpectations{Status: 200, NoStoreForClient: true},
+			response: &client.Response{
+				Status:  200,
+				Headers: http.Header{"Cache-Control": []string{"no-store"}, "Etag": []string{`"abc"`}},
+			},
+			expectPass:     false,
+			expectErrorStr: `validator ETag must not be sent, got "\"abc\""`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -428,10 +552,64 @@ func TestCheck_ResponseExpectations(t *testing.T) {
 	}
 }
 
+func TestCheckPrevious(t *testing.T) {
+	first := &client.Response{Headers: http.Header{"Etag": []string{`"v1"`}, "X-Request-Id": []string{"a"}}}
+
+	tests := []struct {
+		name       string
+		exp        testspec.ResponseExpectations
+		headers    http.Header
+		wantErrors []string
+	}{
+		{
+			name:    "same etag and new request id",
+			exp:     testspec.ResponseExpectations{HeaderEqualsPrevious: testspec.PreviousHeaderChecks{{Header: "ETag", Step: 1}}, HeaderDiffersPrevious: testspec.PreviousHeaderChecks{{Header: "X-Request-ID", Step: 1}}},
+			headers: http.Header{"Etag": []string{`"v1"`}, "X-Request-Id": []string{"b"}},
+		},
+		{
+			name:       "etag changed",
+			exp:        testspec.ResponseExpectations{HeaderEqualsPrevious: testspec.PreviousHeaderChecks{{Header: "ETag", Step: 1}}},
+			headers:    http.Header{"Etag": []string{`"v2"`}},
+			wantErrors: []string{`Response header "ETag": expected same value as step 1 ("\"v1\""), got "\"v2\""`},
+		},
+		{
+			name:       "header missing in earlier step",
+			exp:        testspec.ResponseExpectations{HeaderEqualsPrevious: testspec.PreviousHeaderChecks{{Header: "Last-Modified", Step: 1}}},
+			headers:    http.Header{},
+			wantErrors: []string{`Response header "Last-Modified": missing in step 1, nothing to compare with`},
+		},
+		{
+			name:       "request id reused",
+			exp:        testspec.ResponseExpectations{HeaderDiffersPrevious: testspec.PreviousHeaderChecks{{Header: "X-Request-ID", Step: 1}}},
+			headers:    http.Header{"X-Request-Id": []string{"a"}},
+			wantErrors: []string{`Response header "X-Request-ID": expected a different value than step 1, got "a" again`},
+		},
+		{
+			name:       "step without response",
+			exp:        testspec.ResponseExpectations{HeaderEqualsPrevious: testspec.PreviousHeaderChecks{{Header: "ETag", Step: 2}}},
+			headers:    http.Header{},
+			wantErrors: []string{`Response header "ETag": no response from step 2 to compare with`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckPrevious(&tt.exp, &client.Response{Headers: tt.headers}, []*client.Response{first}, result)
+			if result.Passed != (len(tt.wantErrors) == 0) || strings.Join(result.Errors, "\n") != strings.Join(tt.wantErrors, "\n") {
+				t.Errorf("CheckPrevious() passed=%v errors=%q, want %q", result.Passed, result.Errors, tt.wantErrors)
+			}
+		})
+	}
+}
+
 func TestCheck_CacheExpectations(t *testing.T) {
 	// Helper to create bool pointer
 	boolPtr := func(b bool) *bool { return &b }
-	intPtr := func(i int) *int { return &i }
+	seconds := func(i int) *testspec.Duration {
+		d := testspec.Duration(time.Duration(i) * time.Second)
+		return &d
+	}
 
 	tests := []struct {
 		name           string
@@ -483,7 +661,7 @@ func TestCheck_CacheExpectations(t *testing.T) {
 		// Age greater than expectations
 		{
 			name:     "age_gt satisfied",
-			cacheExp: &testspec.CacheExpectations{AgeGt: intPtr(5)},
+			cacheExp: &testspec.CacheExpectations{AgeGt: seconds(5)},
 			headers: http.Header{
 				"Age": []string{"10"},
 			},
@@ -491,23 +669,23 @@ func TestCheck_CacheExpectations(t *testing.T) {
 		},
 		{
 			name:           "age_gt not satisfied - equal",
-			cacheExp:       &testspec.CacheExpectations{AgeGt: intPtr(10)},
+			cacheExp:       &testspec.CacheExpectations{AgeGt: seconds(10)},
 			headers:        http.Header{"Age": []string{"10"}},
 			expectPass:     false,
-			expectErrorStr: "Age: expected > 10, got 10",
+			expectErrorStr: "Age: expected > 10s, got 10s",
 		},
 		{
 			name:           "age_gt not satisfied - less",
-			cacheExp:       &testspec.CacheExpectations{AgeGt: intPtr(10)},
+			cacheExp:       &testspec.CacheExpectations{AgeGt: seconds(10)},
 			headers:        http.Header{"Age": []string{"5"}},
 			expectPass:     false,
-			expectErrorStr: "Age: expected > 10, got 5",
+			expectErrorStr: "Age: expected > 10s, got 5s",
 		},
 
 		// Age less than expectations
 		{
 			name:     "age_lt satisfied",
-			cacheExp: &testspec.CacheExpectations{AgeLt: intPtr(10)},
+			cacheExp: &testspec.CacheExpectations{AgeLt: seconds(10)},
 			headers: http.Header{
 				"Age": []string{"5"},
 			},
@@ -515,25 +693,25 @@ func TestCheck_CacheExpectations(t *testing.T) {
 		},
 		{
 			name:           "age_lt not satisfied - equal",
-			cacheExp:       &testspec.CacheExpectations{AgeLt: intPtr(5)},
+			cacheExp:       &testspec.CacheExpectations{AgeLt: seconds(5)},
 			headers:        http.Header{"Age": []string{"5"}},
 			expectPass:     false,
-			expectErrorStr: "Age: expected < 5, got 5",
+			expectErrorStr: "Age: expected < 5s, got 5s",
 		},
 		{
 			name:           "age_lt not satisfied - greater",
-			cacheExp:       &testspec.CacheExpectations{AgeLt: intPtr(5)},
+			cacheExp:       &testspec.CacheExpectations{AgeLt: seconds(5)},
 			headers:        http.Header{"Age": []string{"10"}},
 			expectPass:     false,
-			expectErrorStr: "Age: expected < 5, got 10",
+			expectErrorStr: "Age: expected < 5s, got 10s",
 		},
 
 		// Combined age expectations
 		{
 			name: "age in range (gt and lt both satisfied)",
 			cacheExp: &testspec.CacheExpectations{
-				AgeGt: intPtr(5),
-				AgeLt: intPtr(15),
+				AgeGt: seconds(5),
+				AgeLt: seconds(15),
 			},
 			headers:    http.Header{"Age": []string{"10"}},
 			expectPass: true,
@@ -541,25 +719,33 @@ func TestCheck_CacheExpectations(t *testing.T) {
 		{
 			name: "age outside range - too low",
 			cacheExp: &testspec.CacheExpectations{
-				AgeGt: intPtr(5),
-				AgeLt: intPtr(15),
+				AgeGt: seconds(5),
+				AgeLt: seconds(15),
 			},
 			headers:        http.Header{"Age": []string{"3"}},
 			expectPass:     false,
-			expectErrorStr: "Age: expected > 5, got 3",
+			expectErrorStr: "Age: expected > 5s, got 3s",
+		},
+
+		{
+			name:           "age below a duration in minutes",
+			cacheExp:       &testspec.CacheExpectations{AgeGt: seconds(120)},
+			headers:        http.Header{"Age": []string{"100"}},
+			expectPass:     false,
+			expectErrorStr: "Age: expected > 120s, got 100s",
 		},
 
 		// Age header edge cases
 		{
 			name:           "age constraint with missing Age header",
-			cacheExp:       &testspec.CacheExpectations{AgeGt: intPtr(5)},
+			cacheExp:       &testspec.CacheExpectations{AgeGt: seconds(5)},
 			headers:        http.Header{},
 			expectPass:     false,
 			expectErrorStr: "Age header is missing",
 		},
 		{
 			name:           "age constraint with invalid Age header",
-			cacheExp:       &testspec.CacheExpectations{AgeGt: intPtr(5)},
+			cacheExp:       &testspec.CacheExpectations{AgeGt: seconds(5)},
 			headers:        http.Header{"Age": []string{"not-a-number"}},
 			expectPass:     false,
 			expectErrorStr: "Age header is not a valid number",
@@ -615,3 +801,668 @@ func TestCheck_CacheExpectations(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckHitRatio(t *testing.T) {
+	hit := &client.Response{Headers: http.Header{"X-Varnish": []string{"123 456"}}}
+	miss := &client.Response{Headers: http.Header{"X-Varnish": []string{"789"}}}
+	urls := []string{"/a", "/b", "/c", "/d"}
+
+	tests := []struct {
+		name           string
+		min            float64
+		max            *float64
+		responses      []*client.Response
+		expectPass     bool
+		expectErrorStr string
+	}{
+		{
+			name:       "all hits",
+			min:        1,
+			responses:  []*client.Response{hit, hit, hit, hit},
+			expectPass: true,
+		},
+		{
+			name:       "ratio at minimum",
+			min:        0.75,
+			responses:  []*client.Response{hit, miss, hit, hit},
+			expectPass: true,
+		},
+		{
+			name:           "ratio below minimum lists misses",
+			min:            0.9,
+			responses:      []*client.Response{hit, miss, hit, miss},
+			expectPass:     false,
+			expectErrorStr: "Cache hit ratio: expected >= 0.9, got 0.50 (2/4 hits on second pass).\n  Misses: /b, /d",
+		},
+		{
+			name:       "no hits under maximum 0",
+			max:        new(float64),
+			responses:  []*client.Response{miss, miss, miss, miss},
+			expectPass: true,
+		},
+		{
+			name:           "ratio above maximum lists hits",
+			max:            new(float64),
+			responses:      []*client.Response{miss, hit, miss, miss},
+			expectPass:     false,
+			expectErrorStr: "Cache hit ratio: expected <= 0, got 0.25 (1/4 hits on second pass).\n  Hits: /b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckHitRatio(&testspec.HitRatioSpec{URLs: urls, Min: tt.min, Max: tt.max}, tt.responses, result)
+			if result.Passed != tt.expectPass {
+				t.Fatalf("Passed = %v, want %v (errors: %v)", result.Passed, tt.expectPass, result.Errors)
+			}
+			if tt.expectErrorStr != "" && (len(result.Errors) != 1 || result.Errors[0] != tt.expectErrorStr) {
+				t.Errorf("Errors = %q, want %q", result.Errors, tt.expectErrorStr)
+			}
+		})
+	}
+}
+
+func TestCheckAENormalization(t *testing.T) {
+	hitFrom := func(obj string) *client.Response {
+		return &client.Response{Headers: http.Header{"X-Varnish": []string{"123 " + obj}}}
+	}
+	miss := &client.Response{Headers: http.Header{"X-Varnish": []string{"789"}}}
+	values := []string{"gzip", "br, gzip", "br"}
+
+	tests := []struct {
+		name           string
+		maxVariants    int
+		responses      []*client.Response
+		expectPass     bool
+		expectErrorStr string
+	}{
+		{
+			name:       "single variant",
+			responses:  []*client.Response{hitFrom("10"), hitFrom("10"), hitFrom("10")},
+			expectPass: true,
+		},
+		{
+			name:           "too many variants",
+			responses:      []*client.Response{hitFrom("10"), hitFrom("10"), hitFrom("12")},
+			expectErrorStr: "Accept-Encoding normalization: expected at most 1 cached variants, got 2 (3 backend fetches).\n  object 10: \"gzip\", \"br, gzip\"\n  object 12: \"br\"",
+		},
+		{
+			name:        "gzip and identity variants allowed",
+			maxVariants: 2,
+			responses:   []*client.Response{hitFrom("10"), hitFrom("10"), hitFrom("12")},
+			expectPass:  true,
+		},
+		{
+			name:           "misses",
+			responses:      []*client.Response{hitFrom("10"), miss, hitFrom("10")},
+			expectErrorStr: "Accept-Encoding normalization: 1/3 responses on second pass were not cache hits (3 backend fetches).\n  Not cached: \"br, gzip\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckAENormalization(&testspec.AENormalizationSpec{MaxVariants: tt.maxVariants}, values, tt.responses, 3, result)
+			if result.Passed != tt.expectPass {
+				t.Fatalf("Passed = %v, want %v (errors: %v)", result.Passed, tt.expectPass, result.Errors)
+			}
+			if tt.expectErrorStr != "" && (len(result.Errors) != 1 || result.Errors[0] != tt.expectErrorStr) {
+				t.Errorf("Errors = %q, want %q", result.Errors, tt.expectErrorStr)
+			}
+		})
+	}
+}
+
+func TestCheckCookieVariation(t *testing.T) {
+	hitFrom := func(obj string) *client.Response {
+		return &client.Response{Headers: http.Header{"X-Varnish": []string{"123 " + obj}}}
+	}
+	miss := &client.Response{Headers: http.Header{"X-Varnish": []string{"789"}}}
+	rows := (&testspec.CookieVariationSpec{Noise: []string{"_ga=1"}, Significant: []string{"lang=fr", "lang=de"}}).Rows()
+	// Rows: (none), _ga=1, lang=fr, lang=fr+noise, lang=de, lang=de+noise
+
+	tests := []struct {
+		name           string
+		responses      []*client.Response
+		expectPass     bool
+		expectErrorStr string
+	}{
+		{
+			name:       "whitelisted",
+			responses:  []*client.Response{hitFrom("10"), hitFrom("10"), hitFrom("20"), hitFrom("20"), hitFrom("30"), hitFrom("30")},
+			expectPass: true,
+		},
+		{
+			name:       "significant cookies passed",
+			responses:  []*client.Response{hitFrom("10"), hitFrom("10"), miss, miss, miss, miss},
+			expectPass: true,
+		},
+		{
+			name:      "noise varies the cache",
+			responses: []*client.Response{hitFrom("10"), hitFrom("12"), hitFrom("20"), hitFrom("20"), hitFrom("30"), hitFrom("30")},
+			expectErrorStr: "Cookie variation: 1/6 requests on second pass served wrongly (4 backend fetches).\n" +
+				"  Cookie                                   Served by    Verdict\n" +
+				"  (none)                                   object 10    ok\n" +
+				"  _ga=1                                    object 12    separate variant, expected the shared object\n" +
+				"  lang=fr                                  object 20    ok\n" +
+				"  lang=fr; _ga=1                           object 20    ok\n" +
+				"  lang=de                                  object 30    ok\n" +
+				"  lang=de; _ga=1                           object 30    ok",
+		},
+		{
+			name:       "significant cookie ignored",
+			responses:  []*client.Response{hitFrom("10"), hitFrom("10"), hitFrom("10"), hitFrom("10"), hitFrom("30"), hitFrom("30")},
+			expectPass: false,
+		},
+		{
+			name:       "significant cookies share a variant",
+			responses:  []*client.Response{hitFrom("10"), hitFrom("10"), hitFrom("20"), hitFrom("20"), hitFrom("20"), hitFrom("20")},
+			expectPass: false,
+		},
+		{
+			name:       "noise not stripped next to a significant cookie",
+			responses:  []*client.Response{hitFrom("10"), hitFrom("10"), hitFrom("20"), hitFrom("22"), hitFrom("30"), hitFrom("30")},
+			expectPass: false,
+		},
+		{
+			name:       "noise not cached",
+			responses:  []*client.Response{hitFrom("10"), miss, hitFrom("20"), hitFrom("20"), hitFrom("30"), hitFrom("30")},
+			expectPass: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckCookieVariation(rows, tt.responses, 4, result)
+			if result.Passed != tt.expectPass {
+				t.Fatalf("Passed = %v, want %v (errors: %v)", result.Passed, tt.expectPass, result.Errors)
+			}
+			if tt.expectErrorStr != "" && (len(result.Errors) != 1 || result.Errors[0] != tt.expectErrorStr) {
+				t.Errorf("Errors = %q, want %q", result.Errors, tt.expectErrorStr)
+			}
+		})
+	}
+}
+
+func TestCheck_Explanations(t *testing.T) {
+	hit := true
+	calls := 0
+	expectations := testspec.ExpectationsSpec{
+		Response: testspec.ResponseExpectations{
+			Status:  200,
+			Headers: map[string]string{"X-Cache": "HIT"},
+		},
+		Backend: &testspec.BackendExpectations{Calls: &calls},
+		Cache:   &testspec.CacheExpectations{Hit: &hit},
+	}
+	response := &client.Response{
+		Status:  200,
+		Headers: http.Header{"X-Varnish": {"32770 3"}, "X-Cache": {"MISS"}},
+	}
+
+	result := Check(expectations, response, map[string]int{"default": 0}, nil, nil)
+
+	want := []struct {
+		field      string
+		passed     bool
+		derivation string
+	}{
+		{"response.status", true, "status line of the final response: 200"},
+		{"response.headers.X-Cache", false, `X-Cache header of the final response: "MISS"`},
+		{"backend.calls", true, "mock backend request counters: (none)"},
+		{"cache.hit", true, `X-Varnish header "32770 3" has two IDs`},
+	}
+	if len(result.Explanations) != len(want) {
+		t.Fatalf("got %d explanations, want %d: %+v", len(result.Explanations), len(want), result.Explanations)
+	}
+	for i, w := range want {
+		e := result.Explanations[i]
+		if e.Field != w.field || e.Passed != w.passed || !strings.Contains(e.Derivation, w.derivation) {
+			t.Errorf("explanation %d: got %+v, want field %q, passed %v, derivation containing %q", i, e, w.field, w.passed, w.derivation)
+		}
+	}
+}
+
+func TestCheckBackendParams(t *testing.T) {
+	exp := &testspec.BackendExpectations{
+		PerBackend: map[string]testspec.BackendCallExpectation{
+			"api": {Calls: 1, Params: map[string]string{"id": "42"}},
+			"web": {Calls: 0},
+		},
+	}
+	tests := []struct {
+		name    string
+		last    map[string]backend.Request
+		wantErr string
+	}{
+		{
+			name: "matching params",
+			last: map[string]backend.Request{"api": {Method: "GET", URL: "/users/42", Params: map[string]string{"id": "42"}}},
+		},
+		{
+			name:    "different params",
+			last:    map[string]backend.Request{"api": {Method: "GET", URL: "/users/7", Params: map[string]string{"id": "7"}}},
+			wantErr: `Backend "api" params: expected id="42", got id="7" (last request: GET /users/7)`,
+		},
+		{
+			name:    "no request",
+			last:    map[string]backend.Request{},
+			wantErr: `Backend "api" params: expected id="42", but the backend received no request`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckBackendParams(exp, tt.last, result)
+			if tt.wantErr == "" {
+				if !result.Passed {
+					t.Errorf("expected pass, got errors: %v", result.Errors)
+				}
+				return
+			}
+			if result.Passed || len(result.Errors) != 1 || result.Errors[0] != tt.wantErr {
+				t.Errorf("errors = %v, want [%s]", result.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckContinue(t *testing.T) {
+	yes, no := true, false
+	oneMs, tenMs := testspec.Duration(time.Millisecond), testspec.Duration(10*time.Millisecond)
+	sent := time.Now()
+	continued := &client.Continue{HeadersSent: sent, Received: sent.Add(2 * time.Millisecond)}
+	withBody := backend.Request{Method: "POST", URL: "/upload", Time: sent.Add(time.Millisecond), BodyAt: sent.Add(3 * time.Millisecond)}
+	tests := []struct {
+		name    string
+		exp     testspec.ContinueExpectations
+		cont    *client.Continue
+		last    map[string]backend.Request
+		wantErr string
+	}{
+		{
+			name: "received within bound",
+			exp:  testspec.ContinueExpectations{Received: &yes, Within: &tenMs},
+			cont: continued,
+		},
+		{
+			name:    "not received",
+			exp:     testspec.ContinueExpectations{Received: &yes},
+			cont:    &client.Continue{HeadersSent: sent},
+			wantErr: "100 Continue received: expected true, got false",
+		},
+		{
+			name:    "received too late",
+			exp:     testspec.ContinueExpectations{Within: &oneMs},
+			cont:    continued,
+			wantErr: "100 Continue within 1ms: got 100 Continue after 2ms",
+		},
+		{
+			name: "expect consumed, body after continue",
+			exp:  testspec.ContinueExpectations{ExpectForwarded: &no, BodyAfterContinue: &yes},
+			cont: continued,
+			last: map[string]backend.Request{"default": withBody},
+		},
+		{
+			name:    "expect forwarded",
+			exp:     testspec.ContinueExpectations{ExpectForwarded: &no},
+			cont:    continued,
+			last:    map[string]backend.Request{"default": {Method: "POST", URL: "/upload", Time: sent, Expect: "100-continue"}},
+			wantErr: `Expect header forwarded to backend "default": expected false, got true (Expect: "100-continue")`,
+		},
+		{
+			name:    "earlier requests are ignored",
+			exp:     testspec.ContinueExpectations{ExpectForwarded: &no},
+			cont:    continued,
+			last:    map[string]backend.Request{"default": {Time: sent.Add(-time.Second)}},
+			wantErr: "100-continue: expected a backend request, but no backend received one",
+		},
+		{
+			name:    "body before continue",
+			exp:     testspec.ContinueExpectations{BodyAfterContinue: &yes},
+			cont:    &client.Continue{HeadersSent: sent},
+			last:    map[string]backend.Request{"default": withBody},
+			wantErr: `Backend "default" received the body after 100 Continue: expected true, got false (no 100 Continue, body read 3ms after the client sent its headers)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckContinue(&tt.exp, &client.Response{Status: 200, Continue: tt.cont}, tt.last, result)
+			if tt.wantErr == "" {
+				if !result.Passed {
+					t.Errorf("expected pass, got errors: %v", result.Errors)
+				}
+				return
+			}
+			if result.Passed || len(result.Errors) != 1 || result.Errors[0] != tt.wantErr {
+				t.Errorf("errors = %v, want [%s]", result.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckCallsBetween(t *testing.T) {
+	one, two := 1, 2
+	calls := []BackendCall{
+		{Backend: "default", At: 0, Method: "GET", URL: "/article"},
+		{Backend: "default", At: 30*time.Second + 4*time.Millisecond, Method: "GET", URL: "/article"},
+		{Backend: "api", At: 45 * time.Second, Method: "GET", URL: "/api"},
+	}
+	tests := []struct {
+		name    string
+		window  testspec.CallWindow
+		wantErr string
+	}{
+		{
+			name:   "one revalidation in the grace window",
+			window: testspec.CallWindow{From: testspec.Duration(10 * time.Second), To: testspec.Duration(40 * time.Second), Calls: &one},
+		},
+		{
+			name:   "to is exclusive",
+			window: testspec.CallWindow{From: 0, To: testspec.Duration(30 * time.Second), Calls: &one},
+		},
+		{
+			name:   "per backend",
+			window: testspec.CallWindow{From: 0, To: testspec.Duration(time.Minute), Calls: &one, Backend: "api"},
+		},
+		{
+			name:    "too many",
+			window:  testspec.CallWindow{From: 0, To: testspec.Duration(40 * time.Second), Calls: &one},
+			wantErr: "Backend calls between 0s and 40s: expected 1, got 2 (GET /article at 0s on default, GET /article at 30.004s on default)",
+		},
+		{
+			name:    "none",
+			window:  testspec.CallWindow{From: testspec.Duration(50 * time.Second), To: testspec.Duration(time.Minute), Calls: &two, Backend: "api"},
+			wantErr: `Backend "api" calls between 50s and 60s: expected 2, got 0 (none)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckCallsBetween(testspec.CallWindows{tt.window}, calls, result)
+			if tt.wantErr == "" {
+				if !result.Passed {
+					t.Errorf("expected pass, got errors: %v", result.Errors)
+				}
+				return
+			}
+			if result.Passed || len(result.Errors) != 1 || result.Errors[0] != tt.wantErr {
+				t.Errorf("errors = %v, want [%s]", result.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckStorage(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		storage  string
+		wantErr  string
+	}{
+		{name: "transient", expected: "transient", storage: "malloc Transient"},
+		{name: "main", expected: "main", storage: "file s0"},
+		{
+			name:     "main instead of transient",
+			expected: "transient",
+			storage:  "malloc s0",
+			wantErr:  "Storage: expected transient, got main (Storage malloc s0).\n  Object from fetch 32770",
+		},
+		{
+			name:     "no record",
+			expected: "main",
+			wantErr:  "Storage: expected main, but no Storage record was found (fetch 32770)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckStorage(tt.expected, tt.storage, "fetch 32770", result)
+			if tt.wantErr == "" {
+				if !result.Passed {
+					t.Errorf("expected pass, got errors: %v", result.Errors)
+				}
+				return
+			}
+			if result.Passed || len(result.Errors) != 1 || result.Errors[0] != tt.wantErr {
+				t.Errorf("errors = %q, want [%q]", result.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckESI(t *testing.T) {
+	body := "<h1>Shop</h1><p>Price unavailable</p>"
+	two, yes, no := 2, true, false
+	esi := &recorder.ESIRequest{
+		Fragments:   []recorder.ESIFragment{{URL: "/fragments/header", Status: 200}, {URL: "/fragments/price", Status: 500}},
+		FetchReason: "fetch",
+		FetchTTL:    "VCL 300 10 0 1700000000 cacheable",
+	}
+	tests := []struct {
+		name    string
+		exp     testspec.ESIExpectations
+		esi     *recorder.ESIRequest
+		wantErr string
+	}{
+		{
+			name: "failed fragment in a cached page",
+			exp:  testspec.ESIExpectations{Body: &body, Includes: &two, Fragments: map[string]int{"/fragments/price": 500}, ParentCached: &yes},
+			esi:  esi,
+		},
+		{
+			name:    "composite body",
+			exp:     testspec.ESIExpectations{Body: new(string)},
+			esi:     esi,
+			wantErr: `ESI body: expected (empty), got "` + body + `"`,
+		},
+		{
+			name:    "fragment status",
+			exp:     testspec.ESIExpectations{Fragments: map[string]int{"/fragments/price": 200}},
+			esi:     esi,
+			wantErr: "ESI fragment /fragments/price: expected status 200, got [500]",
+		},
+		{
+			name:    "fragment not included",
+			exp:     testspec.ESIExpectations{Fragments: map[string]int{"/fragments/cart": 200}},
+			esi:     esi,
+			wantErr: "ESI fragment /fragments/cart: expected status 200, but it was not included (included: /fragments/header 200, /fragments/price 500)",
+		},
+		{
+			name:    "parent cached",
+			exp:     testspec.ESIExpectations{ParentCached: &no},
+			esi:     esi,
+			wantErr: "ESI parent cached: expected false, got true (the parent's fetch logged TTL VCL 300 10 0 1700000000 cacheable)",
+		},
+		{
+			name:    "no varnishlog",
+			exp:     testspec.ESIExpectations{Includes: &two},
+			wantErr: "ESI: cannot check includes, fragments or parent_cached (varnishlog is not recording)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckESI(&tt.exp, &client.Response{Status: 200, Body: body}, tt.esi, "varnishlog is not recording", result)
+			if tt.wantErr == "" {
+				if !result.Passed {
+					t.Errorf("expected pass, got errors: %v", result.Errors)
+				}
+				return
+			}
+			if result.Passed || len(result.Errors) != 1 || result.Errors[0] != tt.wantErr {
+				t.Errorf("errors = %q, want [%q]", result.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEqualSecret(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"Bearer abc", "Bearer abc", true},
+		{"Bearer abc", "Bearer abd", false},
+		{"Bearer abc", "Bearer ab", false},
+		{"", "", true},
+		{"", "x", false},
+	}
+	for _, tt := range tests {
+		if got := equalSecret(tt.a, tt.b); got != tt.want {
+			t.Errorf("equalSecret(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestHeaderTTL(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	httpDate := func(d time.Duration) string { return now.Add(d).Format(http.TimeFormat) }
+	tests := []struct {
+		name       string
+		headers    http.Header
+		wantTTL    float64
+		wantSource string
+	}{
+		{"s-maxage over max-age", http.Header{"Cache-Control": {"public, max-age=60, s-maxage=3600"}}, 3600, testspec.TTLSourceSMaxAge},
+		{"max-age over Expires", http.Header{"Cache-Control": {"max-age=60"}, "Expires": {httpDate(time.Hour)}}, 60, testspec.TTLSourceMaxAge},
+		{"negative max-age", http.Header{"Cache-Control": {"max-age=-1"}}, 0, testspec.TTLSourceMaxAge},
+		{"Expires from now", http.Header{"Expires": {httpDate(time.Hour)}, "Date": {httpDate(2 * time.Second)}}, 3600, testspec.TTLSourceExpires},
+		{"Expires from a skewed Date", http.Header{"Expires": {httpDate(time.Hour)}, "Date": {httpDate(-time.Hour)}}, 7200, testspec.TTLSourceExpires},
+		{"Expires before Date", http.Header{"Expires": {httpDate(-time.Hour)}, "Date": {httpDate(0)}}, 0, testspec.TTLSourceExpires},
+		{"Expires in the past", http.Header{"Expires": {httpDate(-time.Hour)}}, 0, testspec.TTLSourceExpires},
+		{"Expires in the past by a close Date", http.Header{"Expires": {httpDate(-2 * time.Second)}, "Date": {httpDate(-5 * time.Second)}}, 0, testspec.TTLSourceExpires},
+		{"invalid Expires", http.Header{"Expires": {"0"}}, 0, testspec.TTLSourceDefault},
+		{"no-cache only", http.Header{"Cache-Control": {"no-cache"}}, 0, testspec.TTLSourceDefault},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, source := HeaderTTL(tt.headers, float64(now.Unix()))
+			if ttl != tt.wantTTL || source != tt.wantSource {
+				t.Errorf("HeaderTTL() = %v, %q, want %v, %q", ttl, source, tt.wantTTL, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestCheckFreshness(t *testing.T) {
+	shield := http.Header{"Age": {"600"}, "Cache-Control": {"max-age=3600"}}
+	tests := []struct {
+		name      string
+		exp       *testspec.CacheExpectations
+		freshness *recorder.Freshness
+		wantErr   string
+	}{
+		{
+			name:      "Age respected",
+			exp:       &testspec.CacheExpectations{TTLRespectsAge: true, TTLSource: testspec.TTLSourceMaxAge},
+			freshness: &recorder.Freshness{Headers: shield, Age: 600, RFCTTL: 3600, TTL: 3600},
+		},
+		{
+			name:      "VCL ignores Age",
+			exp:       &testspec.CacheExpectations{TTLRespectsAge: true},
+			freshness: &recorder.Freshness{Headers: shield, Age: 600, RFCTTL: 3600, TTL: 4200},
+			wantErr:   "TTL respects Age: expected 3000s left (3600s from max-age, minus Age 600s), got 3600s.\n  Object from fetch 32770",
+		},
+		{
+			name:      "wrong source",
+			exp:       &testspec.CacheExpectations{TTLSource: testspec.TTLSourceSMaxAge},
+			freshness: &recorder.Freshness{Headers: shield, Age: 600, RFCTTL: 3600, TTL: 3600},
+			wantErr:   `TTL source: expected s-maxage, got max-age (Cache-Control "max-age=3600", Expires (absent), Age "600").` + "\n  Object from fetch 32770",
+		},
+		{
+			name:      "overridden in VCL",
+			exp:       &testspec.CacheExpectations{TTLSource: testspec.TTLSourceMaxAge},
+			freshness: &recorder.Freshness{Headers: shield, Age: 600, RFCTTL: 3600, TTL: 900},
+			wantErr:   "TTL source: max-age gives 3600s, but the object was stored with 900s (set in VCL).\n  Object from fetch 32770",
+		},
+		{
+			name:      "already expired",
+			exp:       &testspec.CacheExpectations{TTLRespectsAge: true, TTLSource: testspec.TTLSourceExpires},
+			freshness: &recorder.Freshness{Headers: http.Header{"Expires": {"Thu, 01 Jan 2025 00:00:00 GMT"}}, Now: 1735776000, RFCTTL: 0, TTL: 0},
+		},
+		{
+			name:      "default_ttl",
+			exp:       &testspec.CacheExpectations{TTLRespectsAge: true, TTLSource: testspec.TTLSourceDefault},
+			freshness: &recorder.Freshness{Headers: http.Header{}, RFCTTL: 120, TTL: 120},
+		},
+		{
+			name:    "no RFC record",
+			exp:     &testspec.CacheExpectations{TTLRespectsAge: true},
+			wantErr: "TTL: cannot check ttl_respects_age or ttl_source, no RFC TTL record was found (fetch 32770)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckFreshness(tt.exp, tt.freshness, "fetch 32770", result)
+			if tt.wantErr == "" {
+				if !result.Passed {
+					t.Errorf("expected pass, got errors: %v", result.Errors)
+				}
+				return
+			}
+			if result.Passed || len(result.Errors) != 1 || result.Errors[0] != tt.wantErr {
+				t.Errorf("errors = %q, want [%q]", result.Errors, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckTTL(t *testing.T) {
+	zero, tenMinutes := testspec.Duration(0), testspec.Duration(10*time.Minute)
+	tests := []struct {
+		name    string
+		exp     *testspec.CacheExpectations
+		ttl     float64
+		found   bool
+		wantErr string
+	}{
+		{
+			name:  "within bounds",
+			exp:   &testspec.CacheExpectations{TTLGt: &zero, TTLLt: &tenMinutes},
+			ttl:   120,
+			found: true,
+		},
+		{
+			name:    "too long",
+			exp:     &testspec.CacheExpectations{TTLLt: &tenMinutes},
+			ttl:     86400,
+			found:   true,
+			wantErr: "TTL: expected < 600s, got 86400s.\n  Object from fetch 32770",
+		},
+		{
+			name:    "uncacheable",
+			exp:     &testspec.CacheExpectations{TTLGt: &zero},
+			ttl:     0,
+			found:   true,
+			wantErr: "TTL: expected > 0s, got 0s.\n  Object from fetch 32770",
+		},
+		{
+			name:    "no TTL record",
+			exp:     &testspec.CacheExpectations{TTLGt: &zero},
+			wantErr: "TTL: expected > 0s, but no TTL record was found (fetch 32770)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := &Result{Passed: true}
+			CheckTTL(tt.exp, tt.ttl, tt.found, "fetch 32770", result)
+			if tt.wantErr == "" {
+				if !result.Passed {
+					t.Errorf("expected pass, got errors: %v", result.Errors)
+				}
+				return
+			}
+			if result.Passed || len(result.Errors) != 1 || result.Errors[0] != tt.wantErr {
+				t.Errorf("errors = %q, want [%q]", result.Errors, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package backend
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Chaos faults
+const (
+	ChaosDelay = "delay" // Respond normally after a random delay
+	ChaosReset = "reset" // Reset the connection
+	ChaosError = "error" // Respond 500
+)
+
+// DefaultChaosMaxDelay is the upper bound of injected delays when Chaos.MaxDelay is not set
+const DefaultChaosMaxDelay = time.Second
+
+// chaosFaults are picked with equal probability
+var chaosFaults = []string{ChaosDelay, ChaosReset, ChaosError}
+
+// Chaos injects a random fault into a fraction of backend requests.
+// A nil *Chaos injects nothing.
+type Chaos struct {
+	Probability float64       // Chance that a request gets a fault (0-1)
+	MaxDelay    time.Duration // Upper bound of ChaosDelay (default DefaultChaosMaxDelay)
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewChaos creates a fault injector with its own random source
+func NewChaos(probability float64, seed uint64) *Chaos {
+	return &Chaos{
+		Probability: probability,
+		rng:         rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)),
+	}
+}
+
+// pick returns the fault for a request (or "" for none) and the delay for ChaosDelay
+func (c *Chaos) pick() (string, time.Duration) {
+	if c == nil {
+		return "", 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.rng.Float64() >= c.Probability {
+		return "", 0
+	}
+	fault := chaosFaults[c.rng.IntN(len(chaosFaults))]
+	if fault != ChaosDelay {
+		return fault, 0
+	}
+	maxDelay := c.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultChaosMaxDelay
+	}
+	return fault, time.Duration(c.rng.Int64N(int64(maxDelay)))
+}
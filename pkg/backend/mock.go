@@ -1,13 +1,23 @@
 package backend
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // MockBackend is a simple HTTP server that returns configured responses
@@ -16,27 +26,86 @@ type MockBackend struct {
 	listener   net.Listener
 	callCount  atomic.Int32
 	config     Config
-	configMu   sync.RWMutex  // Protects config field
-	shutdownCh chan struct{} // Closed on Stop() to unblock frozen handlers
+	configMu   sync.RWMutex  // Protects config and shutdownCh fields
+	shutdownCh chan struct{} // Closed on Stop() or Down() to unblock frozen handlers
+
+	stateMu sync.Mutex // Serializes Down/Up/Stop
+	addr    string     // Listen address, kept so Up can rebind after Down
+	down    bool
+
+	chaos       atomic.Pointer[Chaos] // Random fault injection, independent of config
+	chaosFaults atomic.Int32          // Faults injected so far
+
+	logMu     sync.Mutex
+	requests  []Request      // Access log since the last ResetCallCount
+	routeHits map[string]int // Requests per route key since the backend started
+}
+
+// Request is an entry of the access log of a mock backend
+type Request struct {
+	Method string
+	URL    string            // Path and query as received
+	Params map[string]string // Parameters captured by the matched route pattern
+	Time   time.Time         // When the request arrived
+	Expect string            // Expect header as received (Varnish normally handles it itself)
+	BodyAt time.Time         // When the request body had been read; zero without a body
 }
 
-// RouteConfig defines response for a specific URL path
+// maxLoggedRequests bounds the access log; older entries are dropped
+const maxLoggedRequests = 1000
+
+// RouteConfig defines response for a specific URL path, or for a pattern
+// of paths (see matchRoute). Parameters captured by a pattern replace
+// {name} placeholders in the body and header values.
 type RouteConfig struct {
-	Status      int
-	Headers     map[string]string
-	Body        string
-	FailureMode string
-	EchoRequest bool
+	Status         int
+	Headers        map[string]string
+	Body           string
+	FailureMode    string
+	EchoRequest    bool
+	EchoConnection bool
+	Generate       *Generated
+	ServeDir       string // Only set on the fallback config (see getRouteConfig)
+}
+
+// Generated describes a generated response body (see serveGenerated)
+type Generated struct {
+	Size         int64 // Body bytes before compression
+	Gzip         bool  // Send gzip compressed, with Content-Encoding: gzip
+	DeclaredSize int64 // Content-Length to declare regardless of what is sent; 0 for the actual length
 }
 
+// Failure modes
+const (
+	FailureFailed          = "failed"            // Connection reset
+	FailureFrozen          = "frozen"            // Never responds
+	FailureTruncated       = "truncated"         // Declares a longer body than it sends, then closes
+	FailureOversizedHeader = "oversized_headers" // One header larger than http_resp_hdr_len
+	FailureTooManyHeaders  = "too_many_headers"  // More headers than http_max_hdr
+)
+
+// oversizedHeaderLen exceeds the default (and common) values of varnishd's
+// http_resp_hdr_len (8k) and http_resp_size (32k)
+const oversizedHeaderLen = 64 << 10
+
+// tooManyHeaders exceeds varnishd's default http_max_hdr (64)
+const tooManyHeaders = 128
+
+// truncatedMissingBytes is how much shorter a truncated body is than declared
+const truncatedMissingBytes = 1024
+
 // Config defines the mock backend response configuration
 type Config struct {
-	Status      int
-	Headers     map[string]string
-	Body        string
-	FailureMode string                 // "failed" = connection reset, "frozen" = never responds, "" = normal
-	Routes      map[string]RouteConfig // URL path to response mapping
-	EchoRequest bool                   // Return incoming request as JSON
+	Status         int
+	Headers        map[string]string
+	Body           string
+	FailureMode    string                 // "" = normal, or one of the failure modes below
+	Routes         map[string]RouteConfig // URL path or pattern (/users/{id}) to response mapping
+	EchoRequest    bool                   // Return incoming request as JSON
+	EchoConnection bool                   // Include the connection in the echo (see EchoConnection)
+	Generate       *Generated             // Generate a large or compressible body instead of Body
+	ServeDir       string                 // Serve static files from this directory for paths without a route
+	Bandwidth      int64                  // Pace response bodies to this many bytes per second (0 = unlimited)
 }
 
 // New creates a new mock backend with the given configuration
@@ -55,6 +124,14 @@ func (m *MockBackend) Start() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to create listener: %w", err)
 	}
+	m.addr = listener.Addr().String()
+	m.serve(listener)
+
+	return m.addr, nil
+}
+
+// serve starts an HTTP server on listener in the background
+func (m *MockBackend) serve(listener net.Listener) {
 	m.listener = listener
 
 	// Create HTTP server
@@ -63,31 +140,96 @@ func (m *MockBackend) Start() (string, error) {
 	}
 
 	// Start server in background
+	server := m.server
 	go func() {
-		_ = m.server.Serve(listener)
+		_ = server.Serve(listener)
 	}()
+}
+
+// Down closes the listener and all open connections, so new connections are
+// refused at the socket level (unlike failure_mode, which still accepts them).
+// The address is kept; Up rebinds it. Calling Down on a down backend is a no-op.
+func (m *MockBackend) Down() error {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	if m.down || m.server == nil {
+		return nil
+	}
+	m.down = true
+
+	// Unblock frozen handlers
+	m.configMu.Lock()
+	closeOnce(m.shutdownCh)
+	m.configMu.Unlock()
+
+	// Close the listener directly: server.Close only closes listeners that
+	// Serve has started tracking, and the serve goroutine may not have yet
+	_ = m.listener.Close()
+	return m.server.Close()
+}
+
+// Up rebinds the address released by Down and resumes serving.
+// Calling Up on a running backend is a no-op.
+func (m *MockBackend) Up() error {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	if !m.down {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", m.addr)
+	if err != nil {
+		return fmt.Errorf("rebinding %s: %w", m.addr, err)
+	}
+
+	m.configMu.Lock()
+	m.shutdownCh = make(chan struct{})
+	m.configMu.Unlock()
+
+	m.serve(listener)
+	m.down = false
+	return nil
+}
+
+// IsDown reports whether the backend was taken down with Down
+func (m *MockBackend) IsDown() bool {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.down
+}
 
-	return listener.Addr().String(), nil
+// closeOnce closes ch unless it is already closed
+func closeOnce(ch chan struct{}) {
+	select {
+	case <-ch:
+		// Already closed
+	default:
+		close(ch)
+	}
 }
 
-// getRouteConfig returns the response config for a given path.
+// getRouteConfig returns the response config for a given path, with the
+// route key and the parameters captured by the route pattern, if any.
 // If the path matches a route, that route's config is returned.
-// Otherwise, the top-level config is returned as fallback.
-func (m *MockBackend) getRouteConfig(path string) RouteConfig {
+// Otherwise, the top-level config is returned as fallback, with an empty key.
+func (m *MockBackend) getRouteConfig(path string) (RouteConfig, string, map[string]string) {
 	// Check if path matches a route
-	if m.config.Routes != nil {
-		if route, ok := m.config.Routes[path]; ok {
-			return route
-		}
+	if key, route, params, ok := matchRoute(m.config.Routes, path); ok {
+		return route, key, params
 	}
 	// Fallback to top-level config
 	return RouteConfig{
-		Status:      m.config.Status,
-		Headers:     m.config.Headers,
-		Body:        m.config.Body,
-		FailureMode: m.config.FailureMode,
-		EchoRequest: m.config.EchoRequest,
-	}
+		Status:         m.config.Status,
+		Headers:        m.config.Headers,
+		Body:           m.config.Body,
+		FailureMode:    m.config.FailureMode,
+		EchoRequest:    m.config.EchoRequest,
+		EchoConnection: m.config.EchoConnection,
+		Generate:       m.config.Generate,
+		ServeDir:       m.config.ServeDir,
+	}, "", nil
 }
 
 // EchoResponse is the JSON structure returned when echo_request is enabled
@@ -98,6 +240,50 @@ type EchoResponse struct {
 	Query   map[string][]string `json:"query"`
 	Headers map[string][]string `json:"headers"`
 	Body    string              `json:"body"`
+	Params  map[string]string   `json:"params,omitempty"` // Captured by the route pattern
+
+	Connection *EchoConnection `json:"connection,omitempty"` // Only with echo_connection
+}
+
+// EchoConnection describes the connection and framing of an echoed request,
+// which net/http keeps out of its headers
+type EchoConnection struct {
+	RemoteAddr       string   `json:"remote_addr"`    // Varnish's end of the backend connection
+	Proto            string   `json:"proto"`          // e.g. HTTP/1.1
+	Host             string   `json:"host"`           // Host header
+	ContentLength    int64    `json:"content_length"` // -1 when unknown (chunked)
+	TransferEncoding []string `json:"transfer_encoding,omitempty"`
+	Close            bool     `json:"close"`         // Varnish asked to close the connection after this request
+	TLS              *EchoTLS `json:"tls,omitempty"` // Nil for plain HTTP
+}
+
+// EchoTLS describes the TLS session of an echoed request
+type EchoTLS struct {
+	Version     string `json:"version"` // e.g. TLS 1.3
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"` // SNI
+	ALPN        string `json:"alpn,omitempty"`
+}
+
+// echoConnection describes the connection r arrived on
+func echoConnection(r *http.Request) *EchoConnection {
+	conn := &EchoConnection{
+		RemoteAddr:       r.RemoteAddr,
+		Proto:            r.Proto,
+		Host:             r.Host,
+		ContentLength:    r.ContentLength,
+		TransferEncoding: r.TransferEncoding,
+		Close:            r.Close,
+	}
+	if r.TLS != nil {
+		conn.TLS = &EchoTLS{
+			Version:     tls.VersionName(r.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:  r.TLS.ServerName,
+			ALPN:        r.TLS.NegotiatedProtocol,
+		}
+	}
+	return conn
 }
 
 // handleRequest handles incoming HTTP requests
@@ -107,8 +293,54 @@ func (m *MockBackend) handleRequest(w http.ResponseWriter, r *http.Request) {
 
 	// Read config with lock, using path-based routing
 	m.configMu.RLock()
-	routeConfig := m.getRouteConfig(r.URL.Path)
+	routeConfig, route, params := m.getRouteConfig(r.URL.Path)
+	bandwidth := m.config.Bandwidth
+	shutdownCh := m.shutdownCh
 	m.configMu.RUnlock()
+	if route != "" {
+		m.logMu.Lock()
+		if m.routeHits == nil {
+			m.routeHits = make(map[string]int)
+		}
+		m.routeHits[route]++
+		m.logMu.Unlock()
+	}
+
+	// Read the body up front, so the log records when it arrived (reading
+	// answers 100 Continue if the request asked for it)
+	logged := Request{Method: r.Method, URL: r.URL.RequestURI(), Params: params, Time: time.Now(), Expect: r.Header.Get("Expect")}
+	if r.ContentLength != 0 {
+		bodyBytes, _ := io.ReadAll(r.Body)
+		logged.BodyAt = time.Now()
+		r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	}
+	m.logRequest(logged)
+
+	// Inject a random fault if chaos is enabled
+	if fault, delay := m.chaos.Load().pick(); fault != "" {
+		m.chaosFaults.Add(1)
+		switch fault {
+		case ChaosReset:
+			resetConnection(w)
+			return
+		case ChaosError:
+			http.Error(w, "chaos: injected backend error", http.StatusInternalServerError)
+			return
+		case ChaosDelay:
+			select {
+			case <-time.After(delay):
+			case <-shutdownCh:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	// Pace all response bodies below, including routes, echo and files
+	if bandwidth > 0 {
+		w = newThrottledWriter(r.Context(), w, bandwidth, shutdownCh)
+	}
 
 	// Handle echo mode - returns the incoming request as JSON
 	if routeConfig.EchoRequest {
@@ -120,6 +352,10 @@ func (m *MockBackend) handleRequest(w http.ResponseWriter, r *http.Request) {
 			Query:   r.URL.Query(),
 			Headers: r.Header,
 			Body:    string(bodyBytes),
+			Params:  params,
+		}
+		if routeConfig.EchoConnection {
+			echo.Connection = echoConnection(r)
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -129,39 +365,54 @@ func (m *MockBackend) handleRequest(w http.ResponseWriter, r *http.Request) {
 
 	status := routeConfig.Status
 	headers := routeConfig.Headers
-	body := routeConfig.Body
+	body := expandParams(routeConfig.Body, params)
 	failureMode := routeConfig.FailureMode
 
 	// Handle failure modes
 	switch failureMode {
-	case "frozen":
+	case FailureFrozen:
 		// Block until either backend is stopped or client disconnects
 		select {
-		case <-m.shutdownCh:
+		case <-shutdownCh:
 		case <-r.Context().Done():
 		}
 		// Connection closes without response, triggering timeout in Varnish
 		return
 
-	case "failed":
-		// Hijack connection and close it immediately to simulate connection reset
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "hijacking not supported", http.StatusInternalServerError)
-			return
-		}
-		conn, _, err := hj.Hijack()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		conn.Close()
+	case FailureFailed:
+		resetConnection(w)
 		return
 	}
 
 	// Set response headers
 	for key, value := range headers {
-		w.Header().Set(key, value)
+		w.Header().Set(key, expandParams(value, params))
+	}
+
+	switch failureMode {
+	case FailureOversizedHeader:
+		w.Header().Set("X-Oversized", strings.Repeat("x", oversizedHeaderLen))
+	case FailureTooManyHeaders:
+		for i := range tooManyHeaders {
+			w.Header().Set(fmt.Sprintf("X-Header-%03d", i), "value")
+		}
+	case FailureTruncated:
+		// The server closes the connection when fewer bytes than
+		// Content-Length are written
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)+truncatedMissingBytes))
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+		return
+	}
+
+	if routeConfig.Generate != nil {
+		serveGenerated(w, routeConfig.Generate, status)
+		return
+	}
+
+	// Serve a static file if one exists; otherwise fall through to status/body
+	if routeConfig.ServeDir != "" && serveFile(w, r, routeConfig.ServeDir) {
+		return
 	}
 
 	// Set Content-Length if body is present
@@ -179,15 +430,196 @@ func (m *MockBackend) handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// generatedChunk is the filler a generated body repeats; it compresses
+// about 1000:1
+var generatedChunk = bytes.Repeat([]byte("0"), 32<<10)
+
+// serveGenerated writes gen.Size bytes of filler, gzip compressed if
+// gen.Gzip. Content-Length is gen.DeclaredSize if set: writing stops there,
+// and the server closes the connection if less was written. Otherwise it is
+// the actual length, or the body is chunked when compressed (unless it fits
+// the server's write buffer).
+func serveGenerated(w http.ResponseWriter, gen *Generated, status int) {
+	if gen.Gzip {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	switch {
+	case gen.DeclaredSize > 0:
+		w.Header().Set("Content-Length", strconv.FormatInt(gen.DeclaredSize, 10))
+	case !gen.Gzip:
+		w.Header().Set("Content-Length", strconv.FormatInt(gen.Size, 10))
+	}
+	w.WriteHeader(status)
+
+	// The server rejects whole writes past Content-Length, so cut the last
+	// one at the declared size
+	out := io.Writer(w)
+	if gen.DeclaredSize > 0 {
+		out = &limitedWriter{w: w, remaining: gen.DeclaredSize}
+	}
+	var zw *gzip.Writer
+	if gen.Gzip {
+		zw, _ = gzip.NewWriterLevel(out, gzip.BestCompression)
+		out = zw
+	}
+	// Write errors mean the client went away or the declared size was
+	// reached
+	for remaining := gen.Size; remaining > 0; {
+		n := min(remaining, int64(len(generatedChunk)))
+		if _, err := out.Write(generatedChunk[:n]); err != nil {
+			return
+		}
+		remaining -= n
+	}
+	if zw != nil {
+		_ = zw.Close()
+	}
+}
+
+// limitedWriter writes up to remaining bytes, then fails
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, io.ErrShortWrite
+	}
+	short := int64(len(p)) > l.remaining
+	if short {
+		p = p[:l.remaining]
+	}
+	n, err := l.w.Write(p)
+	l.remaining -= int64(n)
+	if err == nil && short {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// resetConnection hijacks the connection and closes it immediately to
+// simulate a connection reset
+func resetConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conn.Close()
+}
+
+// serveFile serves the file for the request path from dir, with Content-Type
+// by extension (unless already set) and conditional/range request handling.
+// A directory serves its index.html. Returns false if there is no such file.
+func serveFile(w http.ResponseWriter, r *http.Request, dir string) bool {
+	// Clean the path as an absolute path first so ".." cannot escape dir
+	name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+
+	info, err := os.Stat(name)
+	if err == nil && info.IsDir() {
+		name = filepath.Join(name, "index.html")
+		info, err = os.Stat(name)
+	}
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, name, info.ModTime(), f)
+	return true
+}
+
 // GetCallCount returns the number of times the backend has been called
 func (m *MockBackend) GetCallCount() int {
 	return int(m.callCount.Load())
 }
 
-// ResetCallCount resets the call counter to zero
+// ResetCallCount resets the call counter to zero and clears the access log
 // This is useful for resetting state between tests in shared VCL mode
 func (m *MockBackend) ResetCallCount() {
 	m.callCount.Store(0)
+	m.logMu.Lock()
+	m.requests = nil
+	m.logMu.Unlock()
+}
+
+// CallSnapshot is a mock backend's call counter and access log at one
+// point, for RestoreCalls
+type CallSnapshot struct {
+	count    int32
+	requests []Request
+}
+
+// SnapshotCalls returns the current call counter and access log
+func (m *MockBackend) SnapshotCalls() CallSnapshot {
+	return CallSnapshot{count: m.callCount.Load(), requests: m.Requests()}
+}
+
+// RestoreCalls sets the call counter and access log back to a snapshot,
+// forgetting the requests received since. Route hits are kept.
+func (m *MockBackend) RestoreCalls(s CallSnapshot) {
+	m.callCount.Store(s.count)
+	m.logMu.Lock()
+	m.requests = s.requests
+	m.logMu.Unlock()
+}
+
+// Requests returns the access log: the requests received since the last
+// ResetCallCount (at most the latest 1000), oldest first
+func (m *MockBackend) Requests() []Request {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+	return append([]Request(nil), m.requests...)
+}
+
+// RouteHits returns the number of requests each route key matched since the
+// backend started. Unlike the access log, it is not reset by ResetCallCount.
+func (m *MockBackend) RouteHits() map[string]int {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+	return maps.Clone(m.routeHits)
+}
+
+// LastRequest returns the latest entry of the access log, if any
+func (m *MockBackend) LastRequest() (Request, bool) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+	if len(m.requests) == 0 {
+		return Request{}, false
+	}
+	return m.requests[len(m.requests)-1], true
+}
+
+// logRequest appends a request to the access log
+func (m *MockBackend) logRequest(req Request) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+	if len(m.requests) == maxLoggedRequests {
+		m.requests = m.requests[1:]
+	}
+	m.requests = append(m.requests, req)
+}
+
+// SetChaos enables random fault injection, or disables it if c is nil.
+// Unlike failure_mode it survives UpdateConfig.
+func (m *MockBackend) SetChaos(c *Chaos) {
+	m.chaos.Store(c)
+}
+
+// ChaosFaults returns the number of faults injected by chaos so far
+func (m *MockBackend) ChaosFaults() int {
+	return int(m.chaosFaults.Load())
 }
 
 // UpdateConfig atomically updates the backend response configuration
@@ -200,13 +632,13 @@ func (m *MockBackend) UpdateConfig(newConfig Config) {
 
 // Stop gracefully stops the mock backend
 func (m *MockBackend) Stop() error {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
 	// Signal frozen handlers to unblock
-	select {
-	case <-m.shutdownCh:
-		// Already closed
-	default:
-		close(m.shutdownCh)
-	}
+	m.configMu.Lock()
+	closeOnce(m.shutdownCh)
+	m.configMu.Unlock()
 
 	if m.server != nil {
 		return m.server.Close()
@@ -1,8 +1,16 @@
 package backend
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
@@ -561,6 +569,86 @@ func TestFailureMode_Failed(t *testing.T) {
 	}
 }
 
+func TestFailureMode_Truncated(t *testing.T) {
+	backend := New(Config{
+		Status:      200,
+		Body:        "partial",
+		FailureMode: FailureTruncated,
+	})
+
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	resp, err := http.Get("http://" + addr + "/test")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Status = %d, want 200", resp.StatusCode)
+	}
+	if resp.ContentLength != int64(len("partial")+truncatedMissingBytes) {
+		t.Errorf("ContentLength = %d, want %d", resp.ContentLength, len("partial")+truncatedMissingBytes)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Reading body error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if string(body) != "partial" {
+		t.Errorf("Body = %q, want %q", body, "partial")
+	}
+}
+
+func TestFailureMode_HeaderOverflow(t *testing.T) {
+	tests := []struct {
+		mode         string
+		checkHeaders func(t *testing.T, h http.Header)
+	}{
+		{FailureOversizedHeader, func(t *testing.T, h http.Header) {
+			if got := len(h.Get("X-Oversized")); got != oversizedHeaderLen {
+				t.Errorf("X-Oversized length = %d, want %d", got, oversizedHeaderLen)
+			}
+		}},
+		{FailureTooManyHeaders, func(t *testing.T, h http.Header) {
+			if len(h) < tooManyHeaders {
+				t.Errorf("Header count = %d, want at least %d", len(h), tooManyHeaders)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			backend := New(Config{
+				Status:      200,
+				Headers:     map[string]string{"X-Custom": "kept"},
+				Body:        "body",
+				FailureMode: tt.mode,
+			})
+
+			addr, err := backend.Start()
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			defer backend.Stop()
+
+			resp, err := http.Get("http://" + addr + "/test")
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.Header.Get("X-Custom") != "kept" {
+				t.Errorf("X-Custom = %q, want %q", resp.Header.Get("X-Custom"), "kept")
+			}
+			tt.checkHeaders(t, resp.Header)
+		})
+	}
+}
+
 func TestFailureMode_CanBeUpdated(t *testing.T) {
 	backend := New(Config{
 		Status: 200,
@@ -739,6 +827,113 @@ func TestRoutes_ExactPathMatch(t *testing.T) {
 	}
 }
 
+func TestRoutes_Params(t *testing.T) {
+	backend := New(Config{
+		Status: 404,
+		Body:   "Not Found",
+		Routes: map[string]RouteConfig{
+			"/users/{id}": {
+				Status:  200,
+				Headers: map[string]string{"X-User": "{id}"},
+				Body:    `{"id": "{id}", "other": "{other}"}`,
+			},
+			"/users/{id}/orders/{order}": {Status: 200, Body: "order {order} of {id}"},
+			"/users/me":                  {Status: 200, Body: "me"},
+			"/files/{name}/raw":          {Status: 200, Body: "raw {name}"},
+			"/files/latest/{format}":     {Status: 200, Body: "latest as {format}"},
+		},
+	})
+
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+		wantHeader string
+		wantParams map[string]string
+	}{
+		{"/users/42", 200, `{"id": "42", "other": "{other}"}`, "42", map[string]string{"id": "42"}},
+		{"/users/42/orders/7", 200, "order 7 of 42", "", map[string]string{"id": "42", "order": "7"}},
+		{"/users/me", 200, "me", "", nil},
+		{"/files/latest/raw", 200, "latest as raw", "", map[string]string{"format": "raw"}},
+		{"/users/", 404, "Not Found", "", nil},
+		{"/users/42/orders", 404, "Not Found", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get("http://" + addr + tt.path + "?q=1")
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus || string(body) != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", resp.StatusCode, body, tt.wantStatus, tt.wantBody)
+			}
+			if got := resp.Header.Get("X-User"); got != tt.wantHeader {
+				t.Errorf("X-User = %q, want %q", got, tt.wantHeader)
+			}
+
+			last, ok := backend.LastRequest()
+			if !ok || last.URL != tt.path+"?q=1" || !reflect.DeepEqual(last.Params, tt.wantParams) {
+				t.Errorf("LastRequest() = %+v, %v, want URL %q, params %v", last, ok, tt.path+"?q=1", tt.wantParams)
+			}
+		})
+	}
+
+	if n := len(backend.Requests()); n != len(tests) {
+		t.Errorf("Requests() has %d entries, want %d", n, len(tests))
+	}
+	backend.ResetCallCount()
+	if _, ok := backend.LastRequest(); ok {
+		t.Error("LastRequest() after ResetCallCount: want no request")
+	}
+}
+
+func TestAccessLog_ExpectAndBody(t *testing.T) {
+	backend := New(Config{Status: 200, EchoRequest: true})
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	// The transport waits for the 100 Continue the backend sends on reading
+	httpClient := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	req, _ := http.NewRequest("POST", "http://"+addr+"/upload", strings.NewReader("payload"))
+	req.Header.Set("Expect", "100-continue")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"body":"payload"`) {
+		t.Errorf("echo body = %s, want the request body after it was logged", body)
+	}
+
+	last, ok := backend.LastRequest()
+	if !ok || last.Expect != "100-continue" || last.BodyAt.Before(last.Time) {
+		t.Errorf("LastRequest() = %+v, want Expect and a body read after arrival", last)
+	}
+
+	resp, err = http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if last, _ := backend.LastRequest(); last.Expect != "" || !last.BodyAt.IsZero() {
+		t.Errorf("LastRequest() = %+v, want no Expect and no body", last)
+	}
+}
+
 func TestRoutes_WithHeaders(t *testing.T) {
 	backend := New(Config{
 		Status: 200,
@@ -874,6 +1069,42 @@ func TestRoutes_FallbackToTopLevel(t *testing.T) {
 	}
 }
 
+func TestRoutes_Hits(t *testing.T) {
+	backend := New(Config{
+		Status: 404,
+		Routes: map[string]RouteConfig{
+			"/coffee":      {Status: 200},
+			"/orders/{id}": {Status: 200},
+			"/tea":         {Status: 200},
+		},
+	})
+
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	get := func(path string) {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+	get("/coffee")
+	get("/orders/1")
+	backend.ResetCallCount() // Route hits survive resets
+	get("/orders/2")
+	get("/unrouted")
+
+	want := map[string]int{"/coffee": 1, "/orders/{id}": 2}
+	if got := backend.RouteHits(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RouteHits() = %v, want %v", got, want)
+	}
+}
+
 func TestRoutes_UpdateConfigWithRoutes(t *testing.T) {
 	backend := New(Config{
 		Status: 200,
@@ -1199,6 +1430,53 @@ func TestEchoRequest_TopLevelEchoWithRouteOverride(t *testing.T) {
 	}
 }
 
+func TestEchoRequest_Connection(t *testing.T) {
+	backend := New(Config{
+		EchoRequest: true,
+		Routes: map[string]RouteConfig{
+			"/conn": {EchoRequest: true, EchoConnection: true},
+		},
+	})
+
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	echoOf := func(path string) EchoResponse {
+		t.Helper()
+		req, _ := http.NewRequest("POST", "http://"+addr+path, strings.NewReader("body"))
+		req.Host = "www.example.com"
+		req.Close = true
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var echo EchoResponse
+		if err := json.NewDecoder(resp.Body).Decode(&echo); err != nil {
+			t.Fatalf("decoding echo: %v", err)
+		}
+		return echo
+	}
+
+	if echo := echoOf("/plain"); echo.Connection != nil {
+		t.Errorf("Connection = %+v without echo_connection, want nil", echo.Connection)
+	}
+
+	conn := echoOf("/conn").Connection
+	if conn == nil {
+		t.Fatal("Connection = nil, want the connection details")
+	}
+	if conn.Proto != "HTTP/1.1" || conn.Host != "www.example.com" || conn.ContentLength != 4 || !conn.Close || conn.TLS != nil {
+		t.Errorf("Connection = %+v, want HTTP/1.1 to www.example.com, 4 bytes, close, no TLS", conn)
+	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr); err != nil || host != "127.0.0.1" {
+		t.Errorf("RemoteAddr = %q, want 127.0.0.1:port", conn.RemoteAddr)
+	}
+}
+
 func TestEchoRequest_CallCountStillWorks(t *testing.T) {
 	backend := New(Config{
 		EchoRequest: true,
@@ -1229,3 +1507,374 @@ func TestEchoRequest_CallCountStillWorks(t *testing.T) {
 		t.Errorf("Call count after 3 requests = %d, want 3", count)
 	}
 }
+
+func TestDownUp(t *testing.T) {
+	backend := New(Config{Status: 200, Body: "OK"})
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	get := func() error {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get("http://" + addr)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := backend.Down(); err != nil {
+		t.Fatalf("Down() error = %v", err)
+	}
+	if !backend.IsDown() {
+		t.Error("IsDown() = false after Down()")
+	}
+	if err := get(); err == nil {
+		t.Error("request to a down backend succeeded, want connection refused")
+	}
+	if err := backend.Down(); err != nil {
+		t.Errorf("second Down() error = %v", err)
+	}
+
+	if err := backend.Up(); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	if err := get(); err != nil {
+		t.Errorf("request after Up() failed: %v", err)
+	}
+	if backend.IsDown() {
+		t.Error("IsDown() = true after Up()")
+	}
+}
+
+func TestDown_UnblocksFrozen(t *testing.T) {
+	backend := New(Config{FailureMode: "frozen"})
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err == nil {
+			resp.Body.Close()
+		}
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	backend.Down()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("frozen request not released by Down()")
+	}
+}
+
+func TestServeDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"style.css":       "body {}",
+		"docs/index.html": "<h1>docs</h1>",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := New(Config{
+		Status:   404,
+		Body:     "not found",
+		Headers:  map[string]string{"Cache-Control": "max-age=60"},
+		ServeDir: dir,
+		Routes: map[string]RouteConfig{
+			"/style.css": {Status: 200, Body: "route wins"},
+		},
+	})
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	tests := []struct {
+		path        string
+		wantStatus  int
+		wantBody    string
+		wantType    string
+		wantControl string
+	}{
+		{"/docs/", 200, "<h1>docs</h1>", "text/html; charset=utf-8", "max-age=60"},
+		{"/docs/index.html", 200, "<h1>docs</h1>", "text/html; charset=utf-8", "max-age=60"},
+		{"/style.css", 200, "route wins", "", ""},
+		{"/missing.txt", 404, "not found", "", "max-age=60"},
+		{"/../../etc/passwd", 404, "not found", "", "max-age=60"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			// Send the path verbatim so ".." reaches the backend
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n", tt.path)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("ReadResponse failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("Status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("Body = %q, want %q", body, tt.wantBody)
+			}
+			if tt.wantType != "" && resp.Header.Get("Content-Type") != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", resp.Header.Get("Content-Type"), tt.wantType)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != tt.wantControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.wantControl)
+			}
+		})
+	}
+}
+
+func TestChaos_Pick(t *testing.T) {
+	tests := []struct {
+		name        string
+		probability float64
+		wantFaults  bool
+	}{
+		{"disabled", 0, false},
+		{"always", 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChaos(tt.probability, 1)
+			c.MaxDelay = 10 * time.Millisecond
+			seen := make(map[string]int)
+			for range 300 {
+				fault, delay := c.pick()
+				seen[fault]++
+				if delay < 0 || delay >= c.MaxDelay || (fault != ChaosDelay && delay != 0) {
+					t.Fatalf("pick() = %q, %v: delay out of range", fault, delay)
+				}
+			}
+			if !tt.wantFaults {
+				if seen[""] != 300 {
+					t.Errorf("faults = %v, want none", seen)
+				}
+				return
+			}
+			for _, fault := range []string{ChaosDelay, ChaosReset, ChaosError} {
+				if seen[fault] == 0 {
+					t.Errorf("fault %q never picked: %v", fault, seen)
+				}
+			}
+		})
+	}
+
+	var c *Chaos
+	if fault, _ := c.pick(); fault != "" {
+		t.Errorf("nil Chaos picked %q", fault)
+	}
+}
+
+func TestChaos_InjectsFaults(t *testing.T) {
+	backend := New(Config{Status: 200, Body: "ok"})
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	chaos := NewChaos(1, 42)
+	chaos.MaxDelay = 10 * time.Millisecond
+	backend.SetChaos(chaos)
+
+	// Config updates keep chaos enabled
+	backend.UpdateConfig(Config{Status: 200, Body: "updated"})
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	outcomes := make(map[string]int)
+	for range 30 {
+		resp, err := client.Get("http://" + addr + "/")
+		if err != nil {
+			outcomes["reset"]++
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == 500:
+			outcomes["error"]++
+		case resp.StatusCode == 200 && string(body) == "updated":
+			outcomes["delay"]++
+		default:
+			t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+		}
+	}
+	if len(outcomes) != 3 {
+		t.Errorf("outcomes = %v, want resets, errors and delayed responses", outcomes)
+	}
+	if got := backend.ChaosFaults(); got != 30 {
+		t.Errorf("ChaosFaults() = %d, want 30", got)
+	}
+
+	backend.SetChaos(nil)
+	resp, err := client.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("Request after disabling chaos failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || backend.ChaosFaults() != 30 {
+		t.Errorf("after SetChaos(nil): status %d, faults %d, want 200 and 30", resp.StatusCode, backend.ChaosFaults())
+	}
+}
+
+func TestBandwidth_PacesBody(t *testing.T) {
+	body := strings.Repeat("x", 20<<10)
+	backend := New(Config{
+		Status:    200,
+		Body:      body,
+		Bandwidth: 100 << 10, // 20KB at 100KB/s takes ~200ms
+	})
+
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer backend.Stop()
+
+	start := time.Now()
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf("Content-Length = %d, want %d", resp.ContentLength, len(body))
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response body: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if string(respBody) != body {
+		t.Errorf("Body length = %d, want %d", len(respBody), len(body))
+	}
+	if elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Body took %v, want ~200ms", elapsed)
+	}
+}
+
+func TestBandwidth_StopAbortsBody(t *testing.T) {
+	backend := New(Config{
+		Status:    200,
+		Body:      strings.Repeat("x", 1<<20),
+		Bandwidth: 1 << 10, // Would take ~17 minutes
+	})
+
+	addr, err := backend.Start()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := backend.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() did not abort the throttled response")
+	}
+}
+
+func TestServeGenerated(t *testing.T) {
+	tests := []struct {
+		name         string
+		gen          Generated
+		wantLength   string // Content-Length header
+		wantEncoding string
+		wantSize     int // Bytes read, decompressed; -1 to skip
+		wantReadErr  bool
+	}{
+		{"plain", Generated{Size: 100 << 10}, "102400", "", 100 << 10, false},
+		{"gzip", Generated{Size: 16 << 20, Gzip: true}, "", "gzip", 16 << 20, false},
+		{"gzip declared smaller", Generated{Size: 16 << 20, Gzip: true, DeclaredSize: 1000}, "1000", "gzip", -1, true},
+		{"declared larger", Generated{Size: 1000, DeclaredSize: 5000}, "5000", "", 1000, true},
+		{"declared smaller", Generated{Size: 5000, DeclaredSize: 1000}, "1000", "", 1000, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := New(Config{Status: 200, Routes: map[string]RouteConfig{"/big": {Status: 200, Generate: &tt.gen}}})
+			addr, err := backend.Start()
+			if err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			defer backend.Stop()
+
+			// Ask for gzip explicitly, so the transport does not decode it
+			req, _ := http.NewRequest("GET", "http://"+addr+"/big", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Get("Content-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length = %q, want %q", got, tt.wantLength)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+
+			body := io.Reader(resp.Body)
+			if tt.gen.Gzip {
+				zr, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader() error = %v", err)
+				}
+				body = zr
+			}
+			n, err := io.Copy(io.Discard, body)
+			if (err != nil) != tt.wantReadErr {
+				t.Errorf("reading body: error = %v, wantErr %v", err, tt.wantReadErr)
+			}
+			if tt.wantSize >= 0 && n != int64(tt.wantSize) {
+				t.Errorf("read %d bytes, want %d", n, tt.wantSize)
+			}
+		})
+	}
+}
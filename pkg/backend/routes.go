@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"sort"
+	"strings"
+)
+
+// Route keys are exact paths, or patterns where whole path segments are
+// parameters: /users/{id}/orders/{order}. A parameter matches one non-empty
+// segment. Exact paths win over patterns; among patterns, the one with the
+// most literal segments wins, then the first in lexical order.
+
+// matchRoute returns the key and config of the route for path, and the
+// parameters captured by its pattern (nil for exact matches)
+func matchRoute(routes map[string]RouteConfig, path string) (string, RouteConfig, map[string]string, bool) {
+	if route, ok := routes[path]; ok {
+		return path, route, nil, true
+	}
+
+	var best string
+	var bestParams map[string]string
+	bestLiterals := -1
+	for _, pattern := range sortedPatterns(routes) {
+		params, literals, ok := matchPattern(pattern, path)
+		if ok && literals > bestLiterals {
+			best, bestParams, bestLiterals = pattern, params, literals
+		}
+	}
+	if bestLiterals < 0 {
+		return "", RouteConfig{}, nil, false
+	}
+	return best, routes[best], bestParams, true
+}
+
+// sortedPatterns returns the route keys with parameters, in lexical order
+func sortedPatterns(routes map[string]RouteConfig) []string {
+	var patterns []string
+	for key := range routes {
+		if strings.Contains(key, "{") {
+			patterns = append(patterns, key)
+		}
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// matchPattern matches path against a route pattern, returning the captured
+// parameters and the number of literal segments
+func matchPattern(pattern, path string) (map[string]string, int, bool) {
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+	if len(patternSegments) != len(pathSegments) {
+		return nil, 0, false
+	}
+
+	params := make(map[string]string)
+	literals := 0
+	for i, segment := range patternSegments {
+		if name, ok := paramName(segment); ok {
+			if pathSegments[i] == "" {
+				return nil, 0, false
+			}
+			params[name] = pathSegments[i]
+			continue
+		}
+		if segment != pathSegments[i] {
+			return nil, 0, false
+		}
+		literals++
+	}
+	return params, literals, true
+}
+
+// paramName returns the parameter name of a {name} segment
+func paramName(segment string) (string, bool) {
+	if len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+// expandParams replaces {name} placeholders in s with captured parameters.
+// Placeholders that are not parameters of the route are left as they are.
+func expandParams(s string, params map[string]string) string {
+	if len(params) == 0 || !strings.Contains(s, "{") {
+		return s
+	}
+	pairs := make([]string, 0, 2*len(params))
+	for name, value := range params {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
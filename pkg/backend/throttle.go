@@ -0,0 +1,84 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// throttleInterval is how often a throttled response body is flushed
+const throttleInterval = 50 * time.Millisecond
+
+// errThrottleAborted is returned by writes on a throttled response once the
+// backend stops or the client goes away
+var errThrottleAborted = errors.New("throttled write aborted")
+
+// throttledWriter paces the response body to a fixed number of bytes per
+// second, flushing each chunk so the client receives it as it is paced
+type throttledWriter struct {
+	http.ResponseWriter
+	rate    int64 // Bytes per second
+	chunk   int
+	start   time.Time
+	written int64
+	stop    <-chan struct{}
+	ctx     context.Context
+}
+
+func newThrottledWriter(ctx context.Context, w http.ResponseWriter, rate int64, stop <-chan struct{}) *throttledWriter {
+	chunk := int(rate * int64(throttleInterval) / int64(time.Second))
+	if chunk < 1 {
+		chunk = 1
+	}
+	return &throttledWriter{ResponseWriter: w, rate: rate, chunk: chunk, stop: stop, ctx: ctx}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	n := 0
+	for len(p) > 0 {
+		size := min(t.chunk, len(p))
+		written, err := t.ResponseWriter.Write(p[:size])
+		n += written
+		t.written += int64(written)
+		if err != nil {
+			return n, err
+		}
+		p = p[size:]
+		if f, ok := t.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		// Sleep until the bytes written so far are due at the configured rate
+		due := t.start.Add(time.Duration(t.written * int64(time.Second) / t.rate))
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-t.stop:
+				return n, errThrottleAborted
+			case <-t.ctx.Done():
+				return n, errThrottleAborted
+			}
+		}
+	}
+	return n, nil
+}
+
+// Hijack lets failure modes reset the connection of a throttled response
+func (t *throttledWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := t.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	return hj.Hijack()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
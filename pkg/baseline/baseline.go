@@ -0,0 +1,112 @@
+// Package baseline records known test failures so a suite can be adopted on
+// a VCL with existing deviations without failing CI.
+//
+// A baseline maps each failing test to its assertion failure messages. A later
+// failure is "known" when every one of its messages is in the baseline for that
+// test; any new message makes it a regular failure.
+package baseline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+
+	"github.com/perbu/vcltest/pkg/runner"
+)
+
+// baselineVersion is bumped whenever the file format changes incompatibly
+const baselineVersion = 1
+
+// Baseline holds the known failures of a test suite
+type Baseline struct {
+	Version int `json:"version"`
+
+	// Tests maps test name -> failure messages recorded for it
+	Tests map[string][]string `json:"tests"`
+}
+
+// FromResults creates a baseline from the failures in results
+func FromResults(results []runner.TestResult) *Baseline {
+	b := &Baseline{Version: baselineVersion, Tests: make(map[string][]string)}
+	for _, r := range results {
+		if r.Passed {
+			continue
+		}
+		errs := slices.Clone(r.Errors)
+		sort.Strings(errs)
+		b.Tests[r.TestName] = slices.Compact(errs)
+	}
+	return b
+}
+
+// Load reads a baseline file. A missing file is an empty baseline, so
+// -baseline can be given before the file has been created.
+func Load(path string) (*Baseline, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Baseline{Version: baselineVersion, Tests: make(map[string][]string)}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading baseline: %w", err)
+	}
+
+	var b Baseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("parsing baseline %s: %w", path, err)
+	}
+	if b.Version != baselineVersion {
+		return nil, fmt.Errorf("baseline %s has version %d, expected %d (refresh it with -update-baseline)", path, b.Version, baselineVersion)
+	}
+	if b.Tests == nil {
+		b.Tests = make(map[string][]string)
+	}
+	return &b, nil
+}
+
+// Save writes the baseline to path
+func (b *Baseline) Save(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling baseline: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing baseline: %w", err)
+	}
+	return nil
+}
+
+// Known reports whether a failed result is covered by the baseline
+func (b *Baseline) Known(r runner.TestResult) bool {
+	known, ok := b.Tests[r.TestName]
+	if r.Passed || !ok {
+		return false
+	}
+	for _, msg := range r.Errors {
+		if !slices.Contains(known, msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Stale returns the baselined tests that did not fail in results, sorted.
+// Their entries can be dropped with -update-baseline.
+func (b *Baseline) Stale(results []runner.TestResult) []string {
+	failed := make(map[string]bool)
+	for _, r := range results {
+		if !r.Passed {
+			failed[r.TestName] = true
+		}
+	}
+	var stale []string
+	for name := range b.Tests {
+		if !failed[name] {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
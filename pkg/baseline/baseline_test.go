@@ -0,0 +1,70 @@
+package baseline
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/perbu/vcltest/pkg/runner"
+)
+
+func TestKnown(t *testing.T) {
+	b := FromResults([]runner.TestResult{
+		{TestName: "legacy", Errors: []string{"status: expected 200, got 301", "header X-Cache missing"}},
+		{TestName: "passing", Passed: true},
+	})
+
+	tests := []struct {
+		name   string
+		result runner.TestResult
+		want   bool
+	}{
+		{"same failures", runner.TestResult{TestName: "legacy", Errors: []string{"header X-Cache missing", "status: expected 200, got 301"}}, true},
+		{"subset of failures", runner.TestResult{TestName: "legacy", Errors: []string{"header X-Cache missing"}}, true},
+		{"new failure", runner.TestResult{TestName: "legacy", Errors: []string{"status: expected 200, got 500"}}, false},
+		{"not in baseline", runner.TestResult{TestName: "passing", Errors: []string{"header X-Cache missing"}}, false},
+		{"passed", runner.TestResult{TestName: "legacy", Passed: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.Known(tt.result); got != tt.want {
+				t.Errorf("Known() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures.json")
+
+	// A missing file is an empty baseline
+	b, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() missing file error = %v", err)
+	}
+	if len(b.Tests) != 0 {
+		t.Errorf("Load() missing file = %v, want empty", b.Tests)
+	}
+
+	b = FromResults([]runner.TestResult{
+		{TestName: "a", Errors: []string{"y", "x", "y"}},
+		{TestName: "b", Errors: []string{"z"}},
+	})
+	if err := b.Save(path); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want := map[string][]string{"a": {"x", "y"}, "b": {"z"}}
+	if !reflect.DeepEqual(loaded.Tests, want) {
+		t.Errorf("Load() = %v, want %v", loaded.Tests, want)
+	}
+
+	stale := loaded.Stale([]runner.TestResult{{TestName: "a", Errors: []string{"x"}}, {TestName: "b", Passed: true}})
+	if !reflect.DeepEqual(stale, []string{"b"}) {
+		t.Errorf("Stale() = %v, want [b]", stale)
+	}
+}
@@ -1,25 +1,159 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/perbu/vcltest/pkg/testspec"
 )
 
+// DefaultMaxRedirects is the redirect hop limit when follow_redirects is set
+// without max_redirects
+const DefaultMaxRedirects = 10
+
 // Response represents an HTTP response
 type Response struct {
 	Status  int
 	Headers http.Header
 	Body    string
+
+	// BodySize counts the body bytes received; Body keeps the first
+	// MaxBodyBytes of them
+	BodySize int64
+
+	// BodyError is set when the body was cut short (e.g. Varnish closed the
+	// connection mid-stream); Body holds what arrived
+	BodyError string
+
+	// FinalURL is the URL of the last request made. Equal to the request URL
+	// unless redirects were followed.
+	FinalURL string
+
+	// RedirectChain lists the Location of every redirect followed, each resolved
+	// against the URL it was received from. Empty if no redirects were followed.
+	RedirectChain []string
+
+	// Continue reports the 100-continue exchange of a request sent with
+	// expect_continue; nil otherwise
+	Continue *Continue
+}
+
+// Continue is the timing of a request sent with Expect: 100-continue
+type Continue struct {
+	HeadersSent time.Time // When the request headers were written
+	Received    time.Time // When 100 Continue arrived; zero if it did not
+}
+
+// MaxBodyBytes bounds the response body kept in memory; larger bodies (e.g.
+// generated by a backend to test size limits) are counted, not kept
+const MaxBodyBytes = 64 << 20
+
+// ExpectContinueTimeout is how long a request sent with expect_continue
+// holds its body back waiting for 100 Continue, before sending it anyway
+const ExpectContinueTimeout = 2 * time.Second
+
+// MaxIdleConnsPerHost bounds the idle keep-alive connections to Varnish kept
+// by a NewTransport; enough for concurrent warmup requests
+const MaxIdleConnsPerHost = 16
+
+// defaultClient serves MakeRequest calls without a client. It does not keep
+// connections alive, since nothing would close them before Varnish stops.
+var defaultClient = NewHTTPClient(&http.Transport{DisableKeepAlives: true, ExpectContinueTimeout: ExpectContinueTimeout}, nil)
+
+// NewTransport returns a pooled keep-alive transport for requests to Varnish,
+// to be shared by the requests of a suite. The owner must call
+// CloseIdleConnections before Varnish stops, so it can shut down cleanly, and
+// when Varnish may have dropped idle sessions (e.g. after its clock jumped).
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		MaxIdleConns:          MaxIdleConnsPerHost,
+		MaxIdleConnsPerHost:   MaxIdleConnsPerHost,
+		IdleConnTimeout:       30 * time.Second,
+		ExpectContinueTimeout: ExpectContinueTimeout,
+	}
+}
+
+// TransportWrapper wraps the transport of the clients a runner creates for
+// MakeRequest, e.g. to record or trace requests, or to reach a remote Varnish
+// through a proxy. It receives the pooled transport (see NewTransport) and
+// may return it wrapped or return a replacement. If the result has a
+// CloseIdleConnections method, it is called along with the pool's.
+type TransportWrapper func(http.RoundTripper) http.RoundTripper
+
+// NewHTTPClient returns a client for MakeRequest over transport. It does not
+// follow redirects, so the redirect response itself can be checked. jar may
+// be nil for no cookie persistence.
+func NewHTTPClient(transport http.RoundTripper, jar http.CookieJar) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		Jar:       jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
 }
 
 // MakeRequest makes an HTTP request to Varnish according to the test spec.
-// If httpClient is nil, a default client is created (no cookie persistence).
-// Pass a client with a CookieJar for cookie persistence across requests.
+// If httpClient is nil, a shared client without keep-alive or cookie
+// persistence is used. Pass a client from NewHTTPClient with a CookieJar for
+// cookie persistence across requests.
+//
+// Redirects are not followed unless req.FollowRedirects is set. Followed
+// redirects are always sent to Varnish: a Location with a different host is
+// requested by path with that host in the Host header.
 func MakeRequest(httpClient *http.Client, varnishURL string, req testspec.RequestSpec) (*Response, error) {
+	return MakeRequestContext(context.Background(), httpClient, varnishURL, req)
+}
+
+// MakeRequestContext is MakeRequest with a context that cancels the request
+// (and any redirects followed)
+func MakeRequestContext(ctx context.Context, httpClient *http.Client, varnishURL string, req testspec.RequestSpec) (*Response, error) {
+	if httpClient == nil {
+		httpClient = defaultClient
+	}
+
+	maxRedirects := req.MaxRedirects
+	if maxRedirects == 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+
+	current := req.URL
+	var chain []string
+	for {
+		resp, err := doRequest(ctx, httpClient, varnishURL, req)
+		if err != nil {
+			return nil, err
+		}
+		resp.FinalURL = current
+		resp.RedirectChain = chain
+
+		location := resp.Headers.Get("Location")
+		if !req.FollowRedirects || !isRedirect(resp.Status) || location == "" {
+			return resp, nil
+		}
+		if len(chain) >= maxRedirects {
+			return nil, fmt.Errorf("stopped after %d redirects (last Location: %s)", maxRedirects, location)
+		}
+
+		next, err := resolveRedirect(current, location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect Location %q: %w", location, err)
+		}
+		current = next.String()
+		chain = append(chain, current)
+		req = redirectRequest(req, resp.Status, next)
+	}
+}
+
+// doRequest sends a single request to Varnish
+func doRequest(ctx context.Context, httpClient *http.Client, varnishURL string, req testspec.RequestSpec) (*Response, error) {
 	// Build full URL
 	url := varnishURL + req.URL
 
@@ -29,29 +163,40 @@ func MakeRequest(httpClient *http.Client, varnishURL string, req testspec.Reques
 		bodyReader = strings.NewReader(req.Body)
 	}
 
-	httpReq, err := http.NewRequest(req.Method, url, bodyReader)
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, url, bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("creating request: %w", err)
 	}
 
-	// Add headers
+	// Add headers. Host is not sent from the header map by net/http,
+	// so it must be set on the request itself.
 	for key, value := range req.Headers {
+		if strings.EqualFold(key, "Host") {
+			httpReq.Host = value
+			continue
+		}
 		httpReq.Header.Set(key, value)
 	}
 
-	// Use provided client or create default
-	// Important: Don't follow redirects automatically - we want to test the redirect response itself
-	// Also disable keep-alive to ensure connections are closed after each request,
-	// which allows varnish to shut down cleanly.
-	if httpClient == nil {
-		httpClient = &http.Client{
-			Transport: &http.Transport{
-				DisableKeepAlives: true,
-			},
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				return http.ErrUseLastResponse
-			},
+	// With expect_continue, the transport holds the body back until 100
+	// Continue arrives; the trace records when it did. The hooks run on the
+	// transport's goroutines.
+	var cont *Continue
+	var contMu sync.Mutex
+	if req.ExpectContinue && req.Body != "" {
+		httpReq.Header.Set("Expect", "100-continue")
+		cont = &Continue{}
+		record := func(t *time.Time) func() {
+			return func() {
+				contMu.Lock()
+				defer contMu.Unlock()
+				*t = time.Now()
+			}
 		}
+		httpReq = httpReq.WithContext(httptrace.WithClientTrace(httpReq.Context(), &httptrace.ClientTrace{
+			WroteHeaders:   record(&cont.HeadersSent),
+			Got100Continue: record(&cont.Received),
+		}))
 	}
 
 	resp, err := httpClient.Do(httpReq)
@@ -60,15 +205,82 @@ func MakeRequest(httpClient *http.Client, varnishURL string, req testspec.Reques
 	}
 	defer resp.Body.Close()
 
-	// Read response body
-	bodyBytes, err := io.ReadAll(resp.Body)
+	// Read response body. A body cut short is reported in the response, for
+	// the expectations to judge.
+	bodyBytes, err := io.ReadAll(io.LimitReader(resp.Body, MaxBodyBytes))
+	size := int64(len(bodyBytes))
+	if err == nil {
+		var rest int64
+		rest, err = io.Copy(io.Discard, resp.Body)
+		size += rest
+	}
+	var bodyErr string
 	if err != nil {
-		return nil, fmt.Errorf("reading response body: %w", err)
+		bodyErr = err.Error()
+	}
+
+	if cont != nil {
+		contMu.Lock()
+		timing := *cont
+		contMu.Unlock()
+		cont = &timing
 	}
 
 	return &Response{
-		Status:  resp.StatusCode,
-		Headers: resp.Header,
-		Body:    string(bodyBytes),
+		Status:    resp.StatusCode,
+		Headers:   resp.Header,
+		Body:      string(bodyBytes),
+		BodySize:  size,
+		BodyError: bodyErr,
+		Continue:  cont,
 	}, nil
 }
+
+// isRedirect reports whether status is a redirect that carries a Location
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// resolveRedirect resolves a Location header against the URL it was received from
+func resolveRedirect(current, location string) (*url.URL, error) {
+	base, err := url.Parse(current)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	return base.ResolveReference(loc), nil
+}
+
+// redirectRequest builds the request for the next hop, following browser
+// semantics: 301/302/303 switch to GET without a body (except HEAD), while
+// 307/308 repeat the method and body.
+func redirectRequest(prev testspec.RequestSpec, status int, next *url.URL) testspec.RequestSpec {
+	req := prev
+	req.URL = next.RequestURI()
+
+	if status != http.StatusTemporaryRedirect && status != http.StatusPermanentRedirect && req.Method != http.MethodHead {
+		req.Method = http.MethodGet
+		req.Body = ""
+	}
+
+	if next.Host != "" {
+		headers := make(map[string]string, len(prev.Headers)+1)
+		for key, value := range prev.Headers {
+			if !strings.EqualFold(key, "Host") {
+				headers[key] = value
+			}
+		}
+		headers["Host"] = next.Host
+		req.Headers = headers
+	}
+
+	return req
+}
@@ -366,3 +366,146 @@ func TestMakeRequest_MultipleHeaders(t *testing.T) {
 		t.Errorf("Content-Type = %q, want %q", resp.Headers.Get("Content-Type"), "application/json")
 	}
 }
+
+func TestMakeRequest_FollowRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/old":
+			http.Redirect(w, r, "/moved", http.StatusMovedPermanently)
+		case r.URL.Path == "/moved":
+			// Cross-host redirect, as VCL would emit for a canonical host
+			w.Header().Set("Location", "https://www.example.com/final?x=1")
+			w.WriteHeader(http.StatusFound)
+		case r.URL.Path == "/final" && r.Host == "www.example.com":
+			w.Write([]byte(r.Method + " " + r.URL.RequestURI()))
+		case r.URL.Path == "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("follows chain across hosts", func(t *testing.T) {
+		resp, err := MakeRequest(nil, server.URL, testspec.RequestSpec{
+			Method:          "POST",
+			URL:             "/old",
+			Body:            "data",
+			FollowRedirects: true,
+		})
+		if err != nil {
+			t.Fatalf("MakeRequest() error = %v", err)
+		}
+		if resp.Status != http.StatusOK {
+			t.Fatalf("Status = %d, want 200", resp.Status)
+		}
+		// 301 turns POST into GET
+		if resp.Body != "GET /final?x=1" {
+			t.Errorf("Body = %q, want %q", resp.Body, "GET /final?x=1")
+		}
+		if resp.FinalURL != "https://www.example.com/final?x=1" {
+			t.Errorf("FinalURL = %q", resp.FinalURL)
+		}
+		want := []string{"/moved", "https://www.example.com/final?x=1"}
+		if strings.Join(resp.RedirectChain, ",") != strings.Join(want, ",") {
+			t.Errorf("RedirectChain = %v, want %v", resp.RedirectChain, want)
+		}
+	})
+
+	t.Run("not following reports request url", func(t *testing.T) {
+		resp, err := MakeRequest(nil, server.URL, testspec.RequestSpec{Method: "GET", URL: "/old"})
+		if err != nil {
+			t.Fatalf("MakeRequest() error = %v", err)
+		}
+		if resp.FinalURL != "/old" || len(resp.RedirectChain) != 0 {
+			t.Errorf("FinalURL = %q, RedirectChain = %v", resp.FinalURL, resp.RedirectChain)
+		}
+	})
+
+	t.Run("max redirects", func(t *testing.T) {
+		_, err := MakeRequest(nil, server.URL, testspec.RequestSpec{
+			Method:          "GET",
+			URL:             "/loop",
+			FollowRedirects: true,
+			MaxRedirects:    3,
+		})
+		if err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+			t.Errorf("MakeRequest() error = %v, want redirect limit error", err)
+		}
+	})
+}
+
+func TestMakeRequest_HostHeader(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer server.Close()
+
+	resp, err := MakeRequest(nil, server.URL, testspec.RequestSpec{
+		Method:  "GET",
+		URL:     "/",
+		Headers: map[string]string{"Host": "api.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("MakeRequest() error = %v", err)
+	}
+	if resp.Body != "api.example.com" {
+		t.Errorf("Host = %q, want api.example.com", resp.Body)
+	}
+}
+
+func TestMakeRequest_ExpectContinue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/reject" {
+			// Answer without reading the body, so no 100 Continue is sent
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Header.Get("Expect") + " " + string(body)))
+	}))
+	defer server.Close()
+
+	resp, err := MakeRequest(nil, server.URL, testspec.RequestSpec{Method: "POST", URL: "/", Body: "data", ExpectContinue: true})
+	if err != nil {
+		t.Fatalf("MakeRequest() error = %v", err)
+	}
+	if resp.Body != "100-continue data" {
+		t.Errorf("server saw %q, want the Expect header and the body", resp.Body)
+	}
+	if resp.Continue == nil || resp.Continue.Received.IsZero() || resp.Continue.Received.Before(resp.Continue.HeadersSent) {
+		t.Errorf("Continue = %+v, want 100 Continue received after the headers were sent", resp.Continue)
+	}
+
+	resp, err = MakeRequest(nil, server.URL, testspec.RequestSpec{Method: "POST", URL: "/reject", Body: "data", ExpectContinue: true})
+	if err != nil {
+		t.Fatalf("MakeRequest() error = %v", err)
+	}
+	if resp.Status != http.StatusRequestEntityTooLarge || resp.Continue == nil || !resp.Continue.Received.IsZero() {
+		t.Errorf("status %d, Continue = %+v, want 413 without 100 Continue", resp.Status, resp.Continue)
+	}
+
+	resp, err = MakeRequest(nil, server.URL, testspec.RequestSpec{Method: "POST", URL: "/", Body: "data"})
+	if err != nil {
+		t.Fatalf("MakeRequest() error = %v", err)
+	}
+	if resp.Continue != nil || resp.Body != " data" {
+		t.Errorf("without expect_continue: Continue = %+v, body %q", resp.Continue, resp.Body)
+	}
+}
+
+func TestMakeRequest_BodyCutShort(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("only part"))
+	}))
+	defer server.Close()
+
+	resp, err := MakeRequest(nil, server.URL, testspec.RequestSpec{Method: "GET", URL: "/"})
+	if err != nil {
+		t.Fatalf("MakeRequest() error = %v, want the cut short body in the response", err)
+	}
+	if resp.Body != "only part" || resp.BodySize != 9 || resp.BodyError == "" {
+		t.Errorf("body %q, size %d, error %q, want the 9 bytes that arrived and an error", resp.Body, resp.BodySize, resp.BodyError)
+	}
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// PipelineTimeout bounds a whole pipelined exchange, so a server that
+// neither answers nor closes the connection cannot hang a test
+const PipelineTimeout = 30 * time.Second
+
+// PipelineResult holds the responses of a pipelined exchange, in request order
+type PipelineResult struct {
+	Responses []*Response
+
+	// Closed is set when the server closed the connection before answering
+	// every request
+	Closed bool
+
+	// WriteErr is set when the server stopped reading the requests, e.g.
+	// because it closed the connection after the first response
+	WriteErr error
+}
+
+// ExchangeRecorder receives each pipelined request with its response, whose
+// body was read into body, e.g. to add them to a HAR file. Pipelined
+// requests do not go through a TransportWrapper. started is when the
+// requests were written.
+type ExchangeRecorder func(req *http.Request, resp *http.Response, body []byte, started time.Time)
+
+// Pipeline writes all requests to a single connection to Varnish before
+// reading any response (HTTP/1.1 pipelining), then reads the responses in
+// order. If the server closes the connection early, the responses read so
+// far are returned with Closed set; the caller decides whether that is a
+// correct rejection or a failure. record, if not nil, gets every exchange
+// that was answered.
+func Pipeline(varnishURL string, reqs []testspec.RequestSpec, record ExchangeRecorder) (*PipelineResult, error) {
+	base, err := url.Parse(varnishURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Varnish URL: %w", err)
+	}
+
+	// Serialize all requests up front, so they leave in as few writes as possible
+	var buf bytes.Buffer
+	httpReqs := make([]*http.Request, len(reqs))
+	for i, req := range reqs {
+		httpReq, err := newPipelinedRequest(base, req)
+		if err != nil {
+			return nil, fmt.Errorf("request %d: %w", i+1, err)
+		}
+		if err := httpReq.Write(&buf); err != nil {
+			return nil, fmt.Errorf("request %d: serializing: %w", i+1, err)
+		}
+		httpReqs[i] = httpReq
+	}
+
+	conn, err := net.DialTimeout("tcp", base.Host, PipelineTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Varnish: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(PipelineTimeout)); err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	result := &PipelineResult{}
+	started := time.Now()
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		// The server may have answered and closed before taking all requests
+		result.WriteErr = err
+	}
+
+	reader := bufio.NewReader(conn)
+	for _, httpReq := range httpReqs {
+		resp, err := http.ReadResponse(reader, httpReq)
+		if err != nil {
+			if isClosed(err) {
+				result.Closed = true
+				return result, nil
+			}
+			return nil, fmt.Errorf("reading response %d: %w", len(result.Responses)+1, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading response %d body: %w", len(result.Responses)+1, err)
+		}
+		if record != nil {
+			record(httpReq, resp, body, started)
+		}
+		result.Responses = append(result.Responses, &Response{
+			Status:   resp.StatusCode,
+			Headers:  resp.Header,
+			Body:     string(body),
+			FinalURL: httpReq.URL.RequestURI(),
+		})
+		if resp.Close {
+			// Connection: close; nothing more will be answered
+			result.Closed = len(result.Responses) < len(httpReqs)
+			return result, nil
+		}
+	}
+	return result, nil
+}
+
+// newPipelinedRequest builds a keep-alive request for Pipeline
+func newPipelinedRequest(base *url.URL, req testspec.RequestSpec) (*http.Request, error) {
+	var body io.Reader
+	if req.Body != "" {
+		body = strings.NewReader(req.Body)
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	httpReq, err := http.NewRequest(method, base.String()+req.URL, body)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+	for key, value := range req.Headers {
+		if strings.EqualFold(key, "Host") {
+			httpReq.Host = value
+			continue
+		}
+		httpReq.Header.Set(key, value)
+	}
+	return httpReq, nil
+}
+
+// isClosed reports whether a read error means the server closed the connection
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
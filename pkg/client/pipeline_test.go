@@ -0,0 +1,50 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+func TestPipeline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/close" {
+			w.Header().Set("Connection", "close")
+		}
+		w.Header().Set("X-URL", r.URL.Path)
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	t.Run("in order", func(t *testing.T) {
+		reqs := []testspec.RequestSpec{{URL: "/a"}, {Method: "HEAD", URL: "/b"}, {URL: "/c"}}
+		result, err := Pipeline(server.URL, reqs, nil)
+		if err != nil {
+			t.Fatalf("Pipeline() error = %v", err)
+		}
+		if result.Closed || len(result.Responses) != 3 {
+			t.Fatalf("Pipeline() = %d responses, closed=%v, want 3 and open", len(result.Responses), result.Closed)
+		}
+		for i, want := range []string{"/a", "/b", "/c"} {
+			if got := result.Responses[i].Headers.Get("X-URL"); got != want {
+				t.Errorf("response %d X-URL = %q, want %q", i+1, got, want)
+			}
+		}
+		if result.Responses[0].Body != "body of /a" || result.Responses[1].Body != "" {
+			t.Errorf("bodies = %q, %q, want the GET body and an empty HEAD body", result.Responses[0].Body, result.Responses[1].Body)
+		}
+	})
+
+	t.Run("closed early", func(t *testing.T) {
+		reqs := []testspec.RequestSpec{{URL: "/a"}, {URL: "/close"}, {URL: "/c"}}
+		result, err := Pipeline(server.URL, reqs, nil)
+		if err != nil {
+			t.Fatalf("Pipeline() error = %v", err)
+		}
+		if !result.Closed || len(result.Responses) != 2 {
+			t.Errorf("Pipeline() = %d responses, closed=%v, want 2 and closed", len(result.Responses), result.Closed)
+		}
+	})
+}
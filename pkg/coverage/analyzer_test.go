@@ -259,3 +259,41 @@ sub vcl_recv {
 		t.Errorf("expected line 1 to not be in status map")
 	}
 }
+
+func TestFileBlocks_IndexBlocks(t *testing.T) {
+	vcl := `vcl 4.1;
+
+sub vcl_recv {
+    if (req.url == "/a") {
+        return (pass);
+    } else {
+        return (hash);
+    }
+}
+
+sub vcl_deliver {
+    return (deliver);
+}
+`
+	fb, err := AnalyzeVCL(vcl, "/test.vcl")
+	if err != nil {
+		t.Fatalf("AnalyzeVCL failed: %v", err)
+	}
+
+	indexed := fb.IndexBlocks()
+	wantIDs := []string{"vcl_recv#0", "vcl_recv#0/0", "vcl_recv#0/1", "vcl_deliver#0"}
+	if len(indexed) != len(wantIDs) {
+		t.Fatalf("expected %d indexed blocks, got %d", len(wantIDs), len(indexed))
+	}
+	for i, want := range wantIDs {
+		if indexed[i].ID != want {
+			t.Errorf("block %d: expected ID %q, got %q", i, want, indexed[i].ID)
+		}
+	}
+	if indexed[1].ParentID != "vcl_recv#0" {
+		t.Errorf("expected parent 'vcl_recv#0', got %q", indexed[1].ParentID)
+	}
+	if indexed[0].ParentID != "" {
+		t.Errorf("expected empty parent for sub, got %q", indexed[0].ParentID)
+	}
+}
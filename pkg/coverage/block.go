@@ -6,15 +6,18 @@
 // to determine which blocks were entered during execution.
 package coverage
 
+import "fmt"
+
 // Block represents a compound block in VCL (subroutine body, if branch, etc.)
 type Block struct {
-	Type       BlockType // Type of block (sub, if, elseif, else)
-	Name       string    // For subs: "vcl_recv"; for if/elseif: condition text; for else: empty
-	HeaderLine int       // Line containing the block header (sub/if/else keyword)
-	OpenBrace  int       // Line of the opening {
-	CloseBrace int       // Line of the closing }
-	Entered    bool      // Whether VCL_trace fired for this block
-	Children   []*Block  // Nested blocks (if statements inside subs, etc.)
+	Type       BlockType `json:"type" jsonschema:"enum=sub,enum=if,enum=elseif,enum=else"` // Type of block (sub, if, elseif, else)
+	Name       string    `json:"name"`                                                     // For subs: "vcl_recv"; for if/elseif: condition text; for else: empty
+	HeaderLine int       `json:"header_line"`                                              // Line containing the block header (sub/if/else keyword)
+	OpenBrace  int       `json:"open_brace"`                                               // Line of the opening {
+	CloseBrace int       `json:"close_brace"`                                              // Line of the closing }
+	Entered    bool      `json:"entered"`                                                  // Whether VCL_trace fired for this block
+	Requests   []int     `json:"requests,omitempty"`                                       // 1-based requests that entered the block, in tests that make several
+	Children   []*Block  `json:"children,omitempty"`                                       // Nested blocks (if statements inside subs, etc.)
 }
 
 // BlockType indicates the kind of VCL block
@@ -29,9 +32,9 @@ const (
 
 // FileBlocks contains all blocks extracted from a single VCL file
 type FileBlocks struct {
-	ConfigID int      // Varnish config ID for this file
-	Filename string   // Path to the VCL file
-	Blocks   []*Block // Top-level blocks (subroutines)
+	ConfigID int      `json:"config_id"`        // Varnish config ID for this file
+	Filename string   `json:"filename"`         // Path to the VCL file
+	Blocks   []*Block `json:"blocks,omitempty"` // Top-level blocks (subroutines)
 }
 
 // LineInBlock checks if a line number falls within this block's range (inclusive)
@@ -48,6 +51,25 @@ func (b *Block) AllBlocks() []*Block {
 	return result
 }
 
+// Clone returns a deep copy of the blocks, so a cached analysis can be
+// matched against the traces of each test without sharing Entered flags
+func (fb *FileBlocks) Clone() *FileBlocks {
+	return &FileBlocks{ConfigID: fb.ConfigID, Filename: fb.Filename, Blocks: cloneBlocks(fb.Blocks)}
+}
+
+func cloneBlocks(blocks []*Block) []*Block {
+	if blocks == nil {
+		return nil
+	}
+	clones := make([]*Block, len(blocks))
+	for i, b := range blocks {
+		clone := *b
+		clone.Children = cloneBlocks(b.Children)
+		clones[i] = &clone
+	}
+	return clones
+}
+
 // FindBlockAtLine finds the deepest (most specific) block containing the given line.
 // Returns nil if no block contains the line.
 func (fb *FileBlocks) FindBlockAtLine(line int) *Block {
@@ -94,3 +116,33 @@ func fillLineStatus(block *Block, status map[int]bool) {
 		fillLineStatus(child, status)
 	}
 }
+
+// IndexedBlock pairs a block with a structural identifier that is stable across
+// re-rendering of the same VCL (line numbers may change, structure does not).
+type IndexedBlock struct {
+	ID       string // e.g. "vcl_recv#0/1" (second child of the first vcl_recv)
+	ParentID string // Empty for subroutines
+	Block    *Block
+}
+
+// IndexBlocks returns all blocks in the file in depth-first order with structural IDs.
+// Subroutines are identified by name and occurrence (VCL allows repeating a sub),
+// nested blocks by their position among their siblings.
+func (fb *FileBlocks) IndexBlocks() []IndexedBlock {
+	var result []IndexedBlock
+	occurrences := make(map[string]int)
+	for _, block := range fb.Blocks {
+		id := fmt.Sprintf("%s#%d", block.Name, occurrences[block.Name])
+		occurrences[block.Name]++
+		result = indexBlockRecursive(block, id, "", result)
+	}
+	return result
+}
+
+func indexBlockRecursive(block *Block, id, parentID string, result []IndexedBlock) []IndexedBlock {
+	result = append(result, IndexedBlock{ID: id, ParentID: parentID, Block: block})
+	for i, child := range block.Children {
+		result = indexBlockRecursive(child, fmt.Sprintf("%s/%d", id, i), id, result)
+	}
+	return result
+}
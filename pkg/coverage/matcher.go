@@ -40,6 +40,23 @@ func matchBlockRecursive(block *Block, tracedSet map[int]bool) {
 	//
 	// VCL_trace fires at statements inside blocks, so valid entry traces
 	// should be at lines OpenBrace < line < CloseBrace.
+	if tracedInside(block, tracedSet) {
+		block.Entered = true
+	}
+
+	// Also mark as entered if any child was entered (you can't enter a child
+	// without entering the parent)
+	for _, child := range block.Children {
+		if child.Entered {
+			block.Entered = true
+			break
+		}
+	}
+}
+
+// tracedInside reports whether a traced line falls inside block and outside
+// its children
+func tracedInside(block *Block, tracedSet map[int]bool) bool {
 	for line := range tracedSet {
 		if line > block.OpenBrace && line < block.CloseBrace {
 			// Check if this line is inside any child block
@@ -51,20 +68,41 @@ func matchBlockRecursive(block *Block, tracedSet map[int]bool) {
 				}
 			}
 			if !insideChild {
-				block.Entered = true
-				break
+				return true
 			}
 		}
 	}
+	return false
+}
 
-	// Also mark as entered if any child was entered (you can't enter a child
-	// without entering the parent)
+// MatchRequestToBlocks adds request to the Requests of the blocks that the
+// request's traced lines entered, by the rules of MatchTracesToBlocks.
+// Tests that make several requests call it once per request, in order.
+func MatchRequestToBlocks(fb *FileBlocks, tracedLines []int, request int) {
+	if fb == nil || len(tracedLines) == 0 {
+		return
+	}
+	tracedSet := make(map[int]bool, len(tracedLines))
+	for _, line := range tracedLines {
+		tracedSet[line] = true
+	}
+	for _, block := range fb.Blocks {
+		matchRequestRecursive(block, tracedSet, request)
+	}
+}
+
+func matchRequestRecursive(block *Block, tracedSet map[int]bool, request int) bool {
+	entered := false
 	for _, child := range block.Children {
-		if child.Entered {
-			block.Entered = true
-			break
+		if matchRequestRecursive(child, tracedSet, request) {
+			entered = true
 		}
 	}
+	if entered || tracedInside(block, tracedSet) {
+		block.Requests = append(block.Requests, request)
+		return true
+	}
+	return false
 }
 
 // MatchTracesToBlocksWithTolerance is like MatchTracesToBlocks but allows for
@@ -1,6 +1,7 @@
 package coverage
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -157,6 +158,38 @@ sub vcl_recv {
 	}
 }
 
+func TestMatchRequestToBlocks(t *testing.T) {
+	vcl := `vcl 4.1;
+
+sub vcl_recv {
+    if (req.url ~ "^/api") {
+        return (pass);
+    }
+    return (hash);
+}
+`
+	fb, err := AnalyzeVCL(vcl, "/test.vcl")
+	if err != nil {
+		t.Fatalf("AnalyzeVCL failed: %v", err)
+	}
+
+	// Request 1 takes the if, request 2 falls through, request 3 ran no VCL
+	MatchRequestToBlocks(fb, []int{5}, 1)
+	MatchRequestToBlocks(fb, []int{7}, 2)
+	MatchRequestToBlocks(fb, nil, 3)
+
+	sub, ifBlock := fb.Blocks[0], fb.Blocks[0].Children[0]
+	if !reflect.DeepEqual(sub.Requests, []int{1, 2}) {
+		t.Errorf("vcl_recv requests = %v, want [1 2]", sub.Requests)
+	}
+	if !reflect.DeepEqual(ifBlock.Requests, []int{1}) {
+		t.Errorf("if requests = %v, want [1]", ifBlock.Requests)
+	}
+	if sub.Entered || ifBlock.Entered {
+		t.Error("MatchRequestToBlocks must not set Entered")
+	}
+}
+
 func TestMatchTracesToBlocksWithTolerance(t *testing.T) {
 	vcl := `vcl 4.1;
 
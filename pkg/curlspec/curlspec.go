@@ -0,0 +1,367 @@
+// Package curlspec converts curl command lines into test request specs, so
+// reproduction commands can be turned into regression tests.
+package curlspec
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// option describes a curl command line option
+type option struct {
+	name       string // Long name without dashes
+	takesValue bool
+	ignored    bool // Does not change the request (output, TLS, timeouts, ...)
+}
+
+// options are the curl options understood by FromArgs, by long name
+var options = map[string]option{}
+
+// shortOptions maps single-letter options to their long name
+var shortOptions = map[byte]string{}
+
+func init() {
+	add := func(short byte, name string, takesValue, ignored bool) {
+		options[name] = option{name: name, takesValue: takesValue, ignored: ignored}
+		if short != 0 {
+			shortOptions[short] = name
+		}
+	}
+
+	// Options that shape the request
+	add('X', "request", true, false)
+	add('H', "header", true, false)
+	add('d', "data", true, false)
+	add(0, "data-raw", true, false)
+	add(0, "data-binary", true, false)
+	add(0, "data-ascii", true, false)
+	add(0, "data-urlencode", true, false)
+	add('G', "get", false, false)
+	add('I', "head", false, false)
+	add('A', "user-agent", true, false)
+	add('e', "referer", true, false)
+	add('b', "cookie", true, false)
+	add('u', "user", true, false)
+	add(0, "oauth2-bearer", true, false)
+	add('r', "range", true, false)
+	add(0, "compressed", false, false)
+	add('L', "location", false, false)
+	add(0, "location-trusted", false, false)
+	add(0, "max-redirs", true, false)
+	add(0, "url", true, false)
+
+	// Options that only affect output or the connection; the request always goes to Varnish
+	for _, name := range []string{"silent", "show-error", "verbose", "include", "insecure", "fail",
+		"http1.0", "http1.1", "http2", "no-buffer", "globoff", "no-progress-meter", "ipv4", "ipv6"} {
+		add(0, name, false, true)
+	}
+	for _, name := range []string{"output", "write-out", "max-time", "connect-timeout", "resolve",
+		"connect-to", "proxy", "retry", "cacert", "cert", "key", "dump-header", "trace", "trace-ascii"} {
+		add(0, name, true, true)
+	}
+	for short, name := range map[byte]string{'s': "silent", 'S': "show-error", 'v': "verbose", 'i': "include",
+		'k': "insecure", 'f': "fail", 'N': "no-buffer", 'g': "globoff", '4': "ipv4", '6': "ipv6",
+		'o': "output", 'w': "write-out", 'm': "max-time", 'x': "proxy", 'E': "cert", 'D': "dump-header"} {
+		shortOptions[short] = name
+	}
+}
+
+// Parse converts a curl command line into a request spec
+func Parse(command string) (testspec.RequestSpec, error) {
+	args, err := Split(command)
+	if err != nil {
+		return testspec.RequestSpec{}, err
+	}
+	return FromArgs(args)
+}
+
+// FromArgs converts curl arguments into a request spec. A leading "curl" is skipped.
+// The URL's host becomes the Host header; the request itself is made to Varnish.
+func FromArgs(args []string) (testspec.RequestSpec, error) {
+	if len(args) > 0 && path.Base(args[0]) == "curl" {
+		args = args[1:]
+	}
+
+	var req testspec.RequestSpec
+	var rawURL, method string
+	var data []string
+	var head, get bool
+	headers := newHeaderSet() // From -H and -b
+	implied := newHeaderSet() // From other options; -H wins
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			if rawURL != "" {
+				return req, fmt.Errorf("multiple URLs (%s and %s): a request spec has one", rawURL, arg)
+			}
+			rawURL = arg
+			continue
+		}
+
+		// Expand the argument into options and their values
+		type parsed struct{ name, value string }
+		var opts []parsed
+		if strings.HasPrefix(arg, "--") {
+			opt, ok := options[arg[2:]]
+			if !ok {
+				return req, fmt.Errorf("unsupported curl option %s", arg)
+			}
+			value := ""
+			if opt.takesValue {
+				if i+1 >= len(args) {
+					return req, fmt.Errorf("option %s requires a value", arg)
+				}
+				i++
+				value = args[i]
+			}
+			opts = append(opts, parsed{opt.name, value})
+		} else {
+			// Short options can be combined (-sSL) and take attached values (-XPOST)
+			for j := 1; j < len(arg); j++ {
+				name, ok := shortOptions[arg[j]]
+				if !ok {
+					return req, fmt.Errorf("unsupported curl option -%c", arg[j])
+				}
+				if !options[name].takesValue {
+					opts = append(opts, parsed{name, ""})
+					continue
+				}
+				value := arg[j+1:]
+				if value == "" {
+					if i+1 >= len(args) {
+						return req, fmt.Errorf("option -%c requires a value", arg[j])
+					}
+					i++
+					value = args[i]
+				}
+				opts = append(opts, parsed{name, value})
+				break
+			}
+		}
+
+		for _, opt := range opts {
+			if options[opt.name].ignored {
+				continue
+			}
+			switch opt.name {
+			case "request":
+				method = opt.value
+			case "header":
+				name, value, ok := strings.Cut(opt.value, ":")
+				if !ok {
+					// "Name;" sends an empty header
+					if n, found := strings.CutSuffix(opt.value, ";"); found {
+						headers.add(strings.TrimSpace(n), "")
+						continue
+					}
+					return req, fmt.Errorf("invalid header %q: expected 'Name: value'", opt.value)
+				}
+				if value = strings.TrimSpace(value); value == "" {
+					// "Name:" removes a header curl would send by default
+					continue
+				}
+				headers.add(strings.TrimSpace(name), value)
+			case "data", "data-ascii", "data-binary":
+				if strings.HasPrefix(opt.value, "@") {
+					return req, fmt.Errorf("--%s %s: reading the body from a file is not supported, paste the body instead", opt.name, opt.value)
+				}
+				value := opt.value
+				if opt.name != "data-binary" {
+					// curl strips newlines from -d data
+					value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+				}
+				data = append(data, value)
+			case "data-raw":
+				data = append(data, opt.value)
+			case "data-urlencode":
+				encoded, err := urlencode(opt.value)
+				if err != nil {
+					return req, err
+				}
+				data = append(data, encoded)
+			case "get":
+				get = true
+			case "head":
+				head = true
+			case "user-agent":
+				implied.set("User-Agent", opt.value)
+			case "referer":
+				implied.set("Referer", strings.TrimSuffix(opt.value, ";auto"))
+			case "cookie":
+				if !strings.Contains(opt.value, "=") {
+					return req, fmt.Errorf("--cookie %s: reading cookies from a file is not supported", opt.value)
+				}
+				headers.add("Cookie", opt.value)
+			case "user":
+				implied.set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(opt.value)))
+			case "oauth2-bearer":
+				implied.set("Authorization", "Bearer "+opt.value)
+			case "range":
+				implied.set("Range", "bytes="+opt.value)
+			case "compressed":
+				implied.set("Accept-Encoding", "deflate, gzip")
+			case "location", "location-trusted":
+				req.FollowRedirects = true
+			case "max-redirs":
+				n, err := strconv.Atoi(opt.value)
+				if err != nil {
+					return req, fmt.Errorf("--max-redirs %s: %w", opt.value, err)
+				}
+				req.MaxRedirects = n
+			case "url":
+				if rawURL != "" {
+					return req, fmt.Errorf("multiple URLs (%s and %s): a request spec has one", rawURL, opt.value)
+				}
+				rawURL = opt.value
+			}
+		}
+	}
+
+	if rawURL == "" {
+		return req, fmt.Errorf("no URL in curl command")
+	}
+	u, err := parseURL(rawURL)
+	if err != nil {
+		return req, err
+	}
+
+	body := strings.Join(data, "&")
+	if get && body != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += body
+		body = ""
+	}
+
+	req.URL = u.EscapedPath()
+	if req.URL == "" {
+		req.URL = "/"
+	}
+	if u.RawQuery != "" {
+		req.URL += "?" + u.RawQuery
+	}
+
+	switch {
+	case method != "":
+		req.Method = method
+	case head:
+		req.Method = "HEAD"
+	case body != "":
+		req.Method = "POST"
+	}
+	if req.Method == "GET" {
+		req.Method = "" // The default
+	}
+
+	for name, value := range implied.values {
+		headers.setDefault(name, value)
+	}
+	if body != "" {
+		req.Body = body
+		headers.setDefault("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if host := u.Host; host != "" {
+		if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+			host = u.Hostname()
+		}
+		headers.setDefault("Host", host)
+	}
+
+	// max_redirects is only valid when following redirects; -1 means unlimited
+	if !req.FollowRedirects || req.MaxRedirects < 0 {
+		req.MaxRedirects = 0
+	}
+
+	if len(headers.values) > 0 {
+		req.Headers = headers.values
+	}
+	return req, nil
+}
+
+// parseURL parses a curl URL, which may omit the scheme
+func parseURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL: %w", err)
+	}
+	return u, nil
+}
+
+// urlencode encodes a --data-urlencode value: "content", "=content" or "name=content"
+func urlencode(value string) (string, error) {
+	if strings.HasPrefix(value, "@") || (strings.Contains(value, "@") && !strings.Contains(value, "=")) {
+		return "", fmt.Errorf("--data-urlencode %s: reading data from a file is not supported", value)
+	}
+	name, content, ok := strings.Cut(value, "=")
+	if !ok {
+		return escape(value), nil
+	}
+	if name == "" {
+		return escape(content), nil
+	}
+	return name + "=" + escape(content), nil
+}
+
+// escape percent-encodes s the way curl does (spaces as %20)
+func escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// headerSet collects request headers, matching names case-insensitively
+type headerSet struct {
+	values map[string]string
+}
+
+func newHeaderSet() *headerSet {
+	return &headerSet{values: make(map[string]string)}
+}
+
+// lookup returns the stored name for name, or "" if the header is not set
+func (h *headerSet) lookup(name string) string {
+	for existing := range h.values {
+		if strings.EqualFold(existing, name) {
+			return existing
+		}
+	}
+	return ""
+}
+
+// add sets a header, joining repeated headers the way they combine on the wire
+func (h *headerSet) add(name, value string) {
+	existing := h.lookup(name)
+	if existing == "" {
+		h.values[name] = value
+		return
+	}
+	sep := ", "
+	if strings.EqualFold(name, "Cookie") {
+		sep = "; "
+	}
+	h.values[existing] += sep + value
+}
+
+// set sets a header, replacing any previous value
+func (h *headerSet) set(name, value string) {
+	if existing := h.lookup(name); existing != "" {
+		delete(h.values, existing)
+	}
+	h.values[name] = value
+}
+
+// setDefault sets a header unless it is already set
+func (h *headerSet) setDefault(name, value string) {
+	if h.lookup(name) == "" {
+		h.values[name] = value
+	}
+}
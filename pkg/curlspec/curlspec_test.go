@@ -0,0 +1,158 @@
+package curlspec
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    []string
+		wantErr bool
+	}{
+		{"plain", "curl -s http://x/", []string{"curl", "-s", "http://x/"}, false},
+		{"single quotes", `curl -H 'X-A: "b" c'`, []string{"curl", "-H", `X-A: "b" c`}, false},
+		{"double quotes", `curl -d "a=\"1\" \$x \n"`, []string{"curl", "-d", `a="1" $x \n`}, false},
+		{"backslash escape", `curl a\ b`, []string{"curl", "a b"}, false},
+		{"line continuation", "curl \\\n  -I \\\r\n  http://x/", []string{"curl", "-I", "http://x/"}, false},
+		{"adjacent quotes", `curl 'a'"b"c`, []string{"curl", "abc"}, false},
+		{"empty argument", `curl -H ''`, []string{"curl", "-H", ""}, false},
+		{"ansi-c quoting", `curl --data-raw $'{"a":"x\ny\'\x41\101"}'`, []string{"curl", "--data-raw", "{\"a\":\"x\ny'AA\"}"}, false},
+		{"unterminated single", `curl 'abc`, nil, true},
+		{"unterminated double", `curl "abc`, nil, true},
+		{"unterminated ansi-c", `curl $'abc`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Split(tt.command)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Split() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Split() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    testspec.RequestSpec
+		wantErr bool
+	}{
+		{
+			name:    "simple GET",
+			command: "curl https://www.example.com/path?a=1#frag",
+			want:    testspec.RequestSpec{URL: "/path?a=1", Headers: map[string]string{"Host": "www.example.com"}},
+		},
+		{
+			name:    "no scheme, no path, non-default port",
+			command: "curl example.com:8080",
+			want:    testspec.RequestSpec{URL: "/", Headers: map[string]string{"Host": "example.com:8080"}},
+		},
+		{
+			name:    "default port is dropped",
+			command: "curl https://example.com:443/",
+			want:    testspec.RequestSpec{URL: "/", Headers: map[string]string{"Host": "example.com"}},
+		},
+		{
+			name:    "headers and explicit host",
+			command: `curl -H 'Accept: text/html' -H 'X-Multi: a' -H 'X-Multi: b' -H 'host: api.internal' http://x/`,
+			want: testspec.RequestSpec{URL: "/", Headers: map[string]string{
+				"Accept": "text/html", "X-Multi": "a, b", "host": "api.internal",
+			}},
+		},
+		{
+			name:    "empty and removed headers",
+			command: `curl -H 'X-Empty;' -H 'Accept:' http://x/`,
+			want:    testspec.RequestSpec{URL: "/", Headers: map[string]string{"X-Empty": "", "Host": "x"}},
+		},
+		{
+			name:    "data implies POST and form content type",
+			command: `curl -d a=1 -d b=2 http://x/form`,
+			want: testspec.RequestSpec{Method: "POST", URL: "/form", Body: "a=1&b=2", Headers: map[string]string{
+				"Content-Type": "application/x-www-form-urlencoded", "Host": "x",
+			}},
+		},
+		{
+			name:    "explicit method and content type",
+			command: `curl -XPUT -H 'Content-Type: application/json' --data-binary '{"a":1}' http://x/`,
+			want: testspec.RequestSpec{Method: "PUT", URL: "/", Body: `{"a":1}`, Headers: map[string]string{
+				"Content-Type": "application/json", "Host": "x",
+			}},
+		},
+		{
+			name:    "get moves data to query",
+			command: `curl -G --data-urlencode 'q=a b&c' -d x=1 'http://x/search?lang=en'`,
+			want:    testspec.RequestSpec{URL: "/search?lang=en&q=a%20b%26c&x=1", Headers: map[string]string{"Host": "x"}},
+		},
+		{
+			name:    "head",
+			command: `curl -sI http://x/`,
+			want:    testspec.RequestSpec{Method: "HEAD", URL: "/", Headers: map[string]string{"Host": "x"}},
+		},
+		{
+			name:    "explicit GET is the default",
+			command: `curl -X GET http://x/`,
+			want:    testspec.RequestSpec{URL: "/", Headers: map[string]string{"Host": "x"}},
+		},
+		{
+			name:    "options that imply headers",
+			command: `curl -A agent/1 -e http://ref/ -u user:pw -r 0-99 --compressed -b a=1 -H 'Cookie: b=2' http://x/`,
+			want: testspec.RequestSpec{URL: "/", Headers: map[string]string{
+				"User-Agent": "agent/1", "Referer": "http://ref/", "Authorization": "Basic dXNlcjpwdw==",
+				"Range": "bytes=0-99", "Accept-Encoding": "deflate, gzip", "Cookie": "a=1; b=2", "Host": "x",
+			}},
+		},
+		{
+			name:    "header wins over implied header",
+			command: `curl -A agent/1 -H 'user-agent: custom' http://x/`,
+			want:    testspec.RequestSpec{URL: "/", Headers: map[string]string{"user-agent": "custom", "Host": "x"}},
+		},
+		{
+			name:    "redirects",
+			command: `curl -L --max-redirs 3 http://x/`,
+			want:    testspec.RequestSpec{URL: "/", FollowRedirects: true, MaxRedirects: 3, Headers: map[string]string{"Host": "x"}},
+		},
+		{
+			name:    "max-redirs without location is dropped",
+			command: `curl --max-redirs 3 http://x/`,
+			want:    testspec.RequestSpec{URL: "/", Headers: map[string]string{"Host": "x"}},
+		},
+		{
+			name:    "ignored options",
+			command: `curl -sSk -o /dev/null -w '%{http_code}' --max-time 5 --url http://x/`,
+			want:    testspec.RequestSpec{URL: "/", Headers: map[string]string{"Host": "x"}},
+		},
+		{name: "no URL", command: `curl -s`, wantErr: true},
+		{name: "two URLs", command: `curl http://x/a http://x/b`, wantErr: true},
+		{name: "unsupported long option", command: `curl --form a=1 http://x/`, wantErr: true},
+		{name: "unsupported short option", command: `curl -F a=1 http://x/`, wantErr: true},
+		{name: "missing value", command: `curl http://x/ -H`, wantErr: true},
+		{name: "body from file", command: `curl -d @body.json http://x/`, wantErr: true},
+		{name: "cookie file", command: `curl -b cookies.txt http://x/`, wantErr: true},
+		{name: "invalid header", command: `curl -H 'nocolon' http://x/`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.command)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package curlspec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Split splits a command line into arguments using POSIX shell quoting
+// ('single', "double", backslash escapes and line continuations) and bash
+// $'ANSI-C' quoting, as produced by browsers' "Copy as cURL". Variables and
+// other expansions are not performed.
+func Split(command string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+
+		case c == '\\':
+			if i+1 >= len(command) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			if command[i] == '\n' {
+				continue // Line continuation
+			}
+			if command[i] == '\r' && i+1 < len(command) && command[i+1] == '\n' {
+				i++
+				continue
+			}
+			current.WriteByte(command[i])
+			inArg = true
+
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			current.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+
+		case c == '"':
+			i++
+			for ; i < len(command) && command[i] != '"'; i++ {
+				// Inside double quotes a backslash only escapes $ ` " \ and newline
+				if command[i] == '\\' && i+1 < len(command) && strings.IndexByte("$`\"\\\n", command[i+1]) >= 0 {
+					i++
+					if command[i] == '\n' {
+						continue
+					}
+				}
+				current.WriteByte(command[i])
+			}
+			if i >= len(command) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inArg = true
+
+		case c == '$' && i+1 < len(command) && command[i+1] == '\'':
+			n, err := ansiCQuoted(command[i+2:], &current)
+			if err != nil {
+				return nil, err
+			}
+			i += n + 2
+			inArg = true
+
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// ansiCQuoted decodes the body of a $'...' string up to and including the
+// closing quote into sb, returning the number of bytes consumed
+func ansiCQuoted(s string, sb *strings.Builder) (int, error) {
+	escapes := map[byte]byte{'n': '\n', 't': '\t', 'r': '\r', 'a': '\a', 'b': '\b', 'f': '\f', 'v': '\v',
+		'e': 0x1b, 'E': 0x1b, '\\': '\\', '\'': '\'', '"': '"', '?': '?'}
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			return i, nil
+		case '\\':
+			if i+1 >= len(s) {
+				return 0, fmt.Errorf("unterminated $' quote")
+			}
+			i++
+			if b, ok := escapes[s[i]]; ok {
+				sb.WriteByte(b)
+				continue
+			}
+			if s[i] == 'x' {
+				// \xHH: one or two hex digits
+				end := i + 1
+				for end < len(s) && end < i+3 && strings.IndexByte("0123456789abcdefABCDEF", s[end]) >= 0 {
+					end++
+				}
+				if end == i+1 {
+					sb.WriteString(`\x`)
+					continue
+				}
+				v, _ := strconv.ParseUint(s[i+1:end], 16, 8)
+				sb.WriteByte(byte(v))
+				i = end - 1
+				continue
+			}
+			if s[i] >= '0' && s[i] <= '7' {
+				// \NNN: one to three octal digits
+				end := i
+				for end < len(s) && end < i+3 && s[end] >= '0' && s[end] <= '7' {
+					end++
+				}
+				v, _ := strconv.ParseUint(s[i:end], 8, 16)
+				sb.WriteByte(byte(v))
+				i = end - 1
+				continue
+			}
+			// Unknown escapes are kept as is
+			sb.WriteByte('\\')
+			sb.WriteByte(s[i])
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return 0, fmt.Errorf("unterminated $' quote")
+}
@@ -0,0 +1,228 @@
+// Package doctest extracts lightweight tests from structured comments in
+// VCL, so trivial behavioral examples can live next to the code they
+// document:
+//
+//	# vcltest: GET /admin expect status=403
+//	// vcltest: /api/users Host:api.example.com expect status=200 backend=api hit=false
+//
+// Before "expect" come an optional method (default GET), the URL and request
+// headers as Name:value. After it come the expectations:
+//
+//	status=N         response status (default 200)
+//	hit=true|false   cache hit; hit=true first warms the cache with the same request
+//	backend=NAME     backend used
+//	calls=N          total backend calls
+//	storage=transient|main
+//	Name=value       response header (names start with an uppercase letter)
+//
+// Values may be quoted with shell quoting: X-Reason="not found".
+package doctest
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/perbu/vcltest/pkg/curlspec"
+	"github.com/perbu/vcltest/pkg/testspec"
+	"github.com/perbu/vcltest/pkg/vclmod"
+)
+
+// marker starts a doctest, after the comment delimiter
+const marker = "vcltest:"
+
+// Extract returns the doctests of a VCL file and the files it includes. Each
+// test gets a mock with status 200 for every backend the VCL declares.
+func Extract(vclPath string) ([]testspec.TestSpec, error) {
+	files, backends, err := vclmod.IncludeTree(vclPath)
+	if err != nil {
+		return nil, err
+	}
+	baseDir := filepath.Dir(files[0])
+
+	var tests []testspec.TestSpec
+	for _, file := range files {
+		name, err := filepath.Rel(baseDir, file)
+		if err != nil {
+			name = filepath.Base(file)
+		}
+		fileTests, err := extractFile(file, name)
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, fileTests...)
+	}
+
+	for i := range tests {
+		tests[i].Backends = make(map[string]testspec.BackendSpec, len(backends))
+		for _, backend := range backends {
+			tests[i].Backends[backend] = testspec.BackendSpec{Status: 200}
+		}
+	}
+	return tests, nil
+}
+
+// extractFile returns the doctests of one file. name is the file name used
+// in test names and errors.
+func extractFile(path, name string) ([]testspec.TestSpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading VCL file: %w", err)
+	}
+	defer f.Close()
+
+	var tests []testspec.TestSpec
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, ok := doctestComment(scanner.Text())
+		if !ok {
+			continue
+		}
+		test, err := Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		test.Name = fmt.Sprintf("%s:%d: %s", name, line, text)
+		tests = append(tests, test)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading VCL file: %w", err)
+	}
+	return tests, nil
+}
+
+// doctestComment returns the text after the marker of a "# vcltest:" or
+// "// vcltest:" comment line
+func doctestComment(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	for _, delimiter := range []string{"#", "//"} {
+		if comment, ok := strings.CutPrefix(line, delimiter); ok {
+			text, ok := strings.CutPrefix(strings.TrimSpace(comment), marker)
+			return strings.TrimSpace(text), ok
+		}
+	}
+	return "", false
+}
+
+// Parse parses the text of a doctest comment (after "vcltest:") into a
+// test without name and backends
+func Parse(text string) (testspec.TestSpec, error) {
+	args, err := curlspec.Split(text)
+	if err != nil {
+		return testspec.TestSpec{}, err
+	}
+
+	expectAt := -1
+	for i, arg := range args {
+		if arg == "expect" {
+			expectAt = i
+			break
+		}
+	}
+	if expectAt < 0 {
+		return testspec.TestSpec{}, fmt.Errorf("missing \"expect\", e.g. GET /foo expect status=200")
+	}
+
+	req, err := parseRequest(args[:expectAt])
+	if err != nil {
+		return testspec.TestSpec{}, err
+	}
+	exp, err := parseExpectations(args[expectAt+1:])
+	if err != nil {
+		return testspec.TestSpec{}, err
+	}
+
+	test := testspec.TestSpec{Request: req, Expectations: exp}
+	if exp.Cache != nil && exp.Cache.Hit != nil && *exp.Cache.Hit {
+		test.Warmup = []testspec.RequestSpec{req}
+	}
+	return test, nil
+}
+
+// parseRequest parses [METHOD] URL [Name:value ...]
+func parseRequest(args []string) (testspec.RequestSpec, error) {
+	var req testspec.RequestSpec
+	if len(args) > 0 && !strings.HasPrefix(args[0], "/") {
+		if strings.ToUpper(args[0]) != args[0] {
+			return req, fmt.Errorf("expected a method or URL path, got %q", args[0])
+		}
+		req.Method, args = args[0], args[1:]
+	}
+	if len(args) == 0 || !strings.HasPrefix(args[0], "/") {
+		return req, fmt.Errorf("missing URL path before \"expect\"")
+	}
+	req.URL = args[0]
+
+	for _, arg := range args[1:] {
+		name, value, ok := strings.Cut(arg, ":")
+		if !ok || name == "" {
+			return req, fmt.Errorf("expected a request header Name:value, got %q", arg)
+		}
+		if req.Headers == nil {
+			req.Headers = make(map[string]string)
+		}
+		req.Headers[name] = strings.TrimSpace(value)
+	}
+	return req, nil
+}
+
+// parseExpectations parses the key=value expectations after "expect"
+func parseExpectations(args []string) (testspec.ExpectationsSpec, error) {
+	exp := testspec.ExpectationsSpec{Response: testspec.ResponseExpectations{Status: 200}}
+	if len(args) == 0 {
+		return exp, fmt.Errorf("no expectations after \"expect\"")
+	}
+
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return exp, fmt.Errorf("expected key=value after \"expect\", got %q", arg)
+		}
+		switch key {
+		case "status":
+			status, err := strconv.Atoi(value)
+			if err != nil || status < 100 || status > 999 {
+				return exp, fmt.Errorf("status must be an HTTP status code, got %q", value)
+			}
+			exp.Response.Status = status
+		case "hit":
+			hit, err := strconv.ParseBool(value)
+			if err != nil {
+				return exp, fmt.Errorf("hit must be true or false, got %q", value)
+			}
+			exp.Cache = &testspec.CacheExpectations{Hit: &hit}
+		case "backend":
+			if exp.Backend == nil {
+				exp.Backend = &testspec.BackendExpectations{}
+			}
+			exp.Backend.Used = value
+		case "calls":
+			calls, err := strconv.Atoi(value)
+			if err != nil || calls < 0 {
+				return exp, fmt.Errorf("calls must be a number, got %q", value)
+			}
+			if exp.Backend == nil {
+				exp.Backend = &testspec.BackendExpectations{}
+			}
+			exp.Backend.Calls = &calls
+		case "storage":
+			if value != testspec.StorageTransient && value != testspec.StorageMain {
+				return exp, fmt.Errorf("storage must be %s or %s, got %q", testspec.StorageTransient, testspec.StorageMain, value)
+			}
+			exp.Storage = value
+		default:
+			if !unicode.IsUpper(rune(key[0])) {
+				return exp, fmt.Errorf("unknown expectation %q (response headers start with an uppercase letter)", key)
+			}
+			if exp.Response.Headers == nil {
+				exp.Response.Headers = make(map[string]string)
+			}
+			exp.Response.Headers[key] = value
+		}
+	}
+	return exp, nil
+}
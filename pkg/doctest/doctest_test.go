@@ -0,0 +1,128 @@
+package doctest
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+func TestParse(t *testing.T) {
+	hit, miss := true, false
+	calls := 1
+	tests := []struct {
+		name    string
+		text    string
+		want    testspec.TestSpec
+		wantErr string
+	}{
+		{
+			name: "method and status",
+			text: "GET /admin expect status=403",
+			want: testspec.TestSpec{
+				Request:      testspec.RequestSpec{Method: "GET", URL: "/admin"},
+				Expectations: testspec.ExpectationsSpec{Response: testspec.ResponseExpectations{Status: 403}},
+			},
+		},
+		{
+			name: "headers, backend and cache",
+			text: `/api/users Host:api.example.com expect backend=api calls=1 hit=false X-Reason="no cache"`,
+			want: testspec.TestSpec{
+				Request: testspec.RequestSpec{URL: "/api/users", Headers: map[string]string{"Host": "api.example.com"}},
+				Expectations: testspec.ExpectationsSpec{
+					Response: testspec.ResponseExpectations{Status: 200, Headers: map[string]string{"X-Reason": "no cache"}},
+					Backend:  &testspec.BackendExpectations{Used: "api", Calls: &calls},
+					Cache:    &testspec.CacheExpectations{Hit: &miss},
+				},
+			},
+		},
+		{
+			name: "hit warms the cache",
+			text: "GET /static/app.js expect hit=true storage=main",
+			want: testspec.TestSpec{
+				Request: testspec.RequestSpec{Method: "GET", URL: "/static/app.js"},
+				Expectations: testspec.ExpectationsSpec{
+					Response: testspec.ResponseExpectations{Status: 200},
+					Cache:    &testspec.CacheExpectations{Hit: &hit},
+					Storage:  "main",
+				},
+				Warmup: []testspec.RequestSpec{{Method: "GET", URL: "/static/app.js"}},
+			},
+		},
+		{name: "no expect", text: "GET /foo status=200", wantErr: `missing "expect"`},
+		{name: "no URL", text: "GET expect status=200", wantErr: "missing URL path"},
+		{name: "lowercase method", text: "get /foo expect status=200", wantErr: `expected a method or URL path, got "get"`},
+		{name: "unknown key", text: "/foo expect stauts=200", wantErr: `unknown expectation "stauts"`},
+		{name: "bad status", text: "/foo expect status=ok", wantErr: "status must be an HTTP status code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.text)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir := t.TempDir()
+	main := `vcl 4.1;
+include "api.vcl";
+backend default { .host = "127.0.0.1"; .port = "8080"; }
+
+sub vcl_recv {
+	# vcltest: GET /admin expect status=403
+	if (req.url ~ "^/admin") {
+		return (synth(403));
+	}
+}
+`
+	api := `backend api { .host = "127.0.0.1"; .port = "8081"; }
+
+// vcltest: /api/ expect backend=api
+`
+	if err := os.WriteFile(filepath.Join(dir, "main.vcl"), []byte(main), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "api.vcl"), []byte(api), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests, err := Extract(filepath.Join(dir, "main.vcl"))
+	if err != nil {
+		t.Fatalf("Extract() error = %v", err)
+	}
+	var names []string
+	for _, test := range tests {
+		names = append(names, test.Name)
+		if len(test.Backends) != 2 || test.Backends["api"].Status != 200 || test.Backends["default"].Status != 200 {
+			t.Errorf("%s: backends = %v, want api and default mocked", test.Name, test.Backends)
+		}
+	}
+	want := []string{"main.vcl:6: GET /admin expect status=403", "api.vcl:3: /api/ expect backend=api"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %q, want %q", names, want)
+	}
+
+	// Errors point at the comment
+	bad := main + "# vcltest: /foo expect status=abc\n"
+	if err := os.WriteFile(filepath.Join(dir, "main.vcl"), []byte(bad), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Extract(filepath.Join(dir, "main.vcl")); err == nil || !strings.HasPrefix(err.Error(), "main.vcl:11: ") {
+		t.Errorf("Extract() error = %v, want it at main.vcl:11", err)
+	}
+}
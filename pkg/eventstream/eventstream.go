@@ -0,0 +1,115 @@
+// Package eventstream emits a newline-delimited JSON (NDJSON) stream of test
+// lifecycle events for external tools (web UIs, IDE integrations, CI wrappers)
+// that want structured progress without parsing the human-readable output.
+package eventstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	SuiteStart      = "suite_start"
+	VarnishReady    = "varnish_ready"
+	TestStart       = "test_start"
+	AssertionFailed = "assertion_failed"
+	TestEnd         = "test_end"
+	SuiteEnd        = "suite_end"
+)
+
+// Event is a single line in the stream. Only the fields relevant to the
+// event type are set.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// suite_start
+	TestFile string `json:"test_file,omitempty"`
+	VCLPath  string `json:"vcl_path,omitempty"`
+
+	// varnish_ready
+	URL string `json:"url,omitempty"`
+
+	// test_start, assertion_failed, test_end
+	Test   string `json:"test,omitempty"`
+	TestID string `json:"test_id,omitempty"` // Stable across runs (hash of test file and name)
+	Index  int    `json:"index,omitempty"`   // 1-based position in the run
+
+	// test_start, test_end: annotations from the test spec
+	Owner       string `json:"owner,omitempty"`
+	Link        string `json:"link,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// assertion_failed
+	Message   string   `json:"message,omitempty"`
+	Step      int      `json:"step,omitempty"`       // 1-based scenario step
+	AtSeconds *float64 `json:"at_seconds,omitempty"` // Simulated time of the step
+
+	// test_end
+	Passed     *bool `json:"passed,omitempty"`
+	DurationMS int64 `json:"duration_ms,omitempty"`
+
+	// suite_start, suite_end; always written, so zero counts are explicit
+	Total     int `json:"total"`
+	PassCount int `json:"pass_count"`
+	FailCount int `json:"fail_count"`
+
+	// suite_end: why the run failed, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// Emitter writes events to an io.Writer, one JSON object per line.
+// A nil *Emitter is valid and discards all events.
+type Emitter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+	err error // First write error; later events are dropped
+}
+
+// New creates an emitter writing to w
+func New(w io.Writer) *Emitter {
+	return &Emitter{w: w, now: time.Now}
+}
+
+// Emit writes an event, stamping its time if unset.
+// Write errors are remembered (see Err) rather than returned, so a
+// disconnected consumer never fails the test run.
+func (e *Emitter) Emit(ev Event) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.err != nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = e.now()
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		e.err = fmt.Errorf("marshaling %s event: %w", ev.Type, err)
+		return
+	}
+	data = append(data, '\n')
+	if _, err := e.w.Write(data); err != nil {
+		e.err = fmt.Errorf("writing %s event: %w", ev.Type, err)
+	}
+}
+
+// Err returns the first error encountered while emitting, if any
+func (e *Emitter) Err() error {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
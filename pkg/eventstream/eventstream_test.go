@@ -0,0 +1,78 @@
+package eventstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEmitter_Emit(t *testing.T) {
+	var buf bytes.Buffer
+	e := New(&buf)
+	fixed := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	e.now = func() time.Time { return fixed }
+
+	passed := false
+	e.Emit(Event{Type: TestStart, Test: "cache hit", Index: 1})
+	e.Emit(Event{Type: AssertionFailed, Test: "cache hit", Index: 1, Message: "status: expected 200, got 404"})
+	e.Emit(Event{Type: TestEnd, Test: "cache hit", Index: 1, Passed: &passed, DurationMS: 12})
+
+	var lines []map[string]any
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var m map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, m)
+	}
+
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3", len(lines))
+	}
+	if lines[0]["type"] != TestStart || lines[0]["time"] != "2025-01-02T03:04:05Z" {
+		t.Errorf("test_start = %v", lines[0])
+	}
+	if _, ok := lines[0]["message"]; ok {
+		t.Errorf("test_start should omit message, got %v", lines[0])
+	}
+	if lines[1]["message"] != "status: expected 200, got 404" {
+		t.Errorf("assertion_failed message = %v", lines[1]["message"])
+	}
+	if lines[2]["passed"] != false {
+		t.Errorf("test_end passed = %v, want false", lines[2]["passed"])
+	}
+}
+
+type failingWriter struct{ writes int }
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	f.writes++
+	return 0, errors.New("broken pipe")
+}
+
+func TestEmitter_WriteError(t *testing.T) {
+	w := &failingWriter{}
+	e := New(w)
+
+	e.Emit(Event{Type: SuiteStart})
+	e.Emit(Event{Type: SuiteEnd})
+
+	if e.Err() == nil {
+		t.Error("Err() = nil, want write error")
+	}
+	if w.writes != 1 {
+		t.Errorf("writes = %d, want 1 (events after an error are dropped)", w.writes)
+	}
+}
+
+func TestEmitter_Nil(t *testing.T) {
+	var e *Emitter
+	e.Emit(Event{Type: SuiteStart}) // must not panic
+	if e.Err() != nil {
+		t.Error("nil emitter should report no error")
+	}
+}
@@ -0,0 +1,75 @@
+package formatter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{
+			name: "identical",
+			old:  "a\nb\n",
+			new:  "a\nb\n",
+			want: "",
+		},
+		{
+			name: "changed line with context",
+			old:  "vcl 4.1;\nbackend default {\n    .host = \"example.com\";\n    .port = \"80\";\n}\n",
+			new:  "vcl 4.1;\nbackend default {\n    .host = \"127.0.0.1\";\n    .port = \"40123\";\n}\n",
+			want: "--- a.vcl\n+++ b.vcl\n" +
+				"@@ -1,5 +1,5 @@\n" +
+				" vcl 4.1;\n" +
+				" backend default {\n" +
+				"-    .host = \"example.com\";\n" +
+				"-    .port = \"80\";\n" +
+				"+    .host = \"127.0.0.1\";\n" +
+				"+    .port = \"40123\";\n" +
+				" }\n",
+		},
+		{
+			name: "insertion",
+			old:  "a\nb\n",
+			new:  "a\nx\nb\n",
+			want: "--- a.vcl\n+++ b.vcl\n" +
+				"@@ -1,2 +1,3 @@\n" +
+				" a\n" +
+				"+x\n" +
+				" b\n",
+		},
+		{
+			name: "distant changes make separate hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n",
+			want: "--- a.vcl\n+++ b.vcl\n" +
+				"@@ -1,4 +1,4 @@\n" +
+				"-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -9,4 +9,4 @@\n" +
+				" 9\n 10\n 11\n-12\n+twelve\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := UnifiedDiff("a.vcl", "b.vcl", tt.old, tt.new)
+			if got != tt.want {
+				t.Errorf("UnifiedDiff() =\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiffLargeInput(t *testing.T) {
+	// Past the LCS size limit the middle is reported as one replacement
+	old := strings.Repeat("a\n", 5000)
+	new := strings.Repeat("b\n", 5000)
+	got := UnifiedDiff("a", "b", old, new)
+	if !strings.Contains(got, "@@ -1,5000 +1,5000 @@") {
+		t.Errorf("expected a single replacement hunk, got header %q", strings.SplitN(got, "\n", 4)[2])
+	}
+}
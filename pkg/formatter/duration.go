@@ -0,0 +1,18 @@
+package formatter
+
+import (
+	"strconv"
+	"time"
+)
+
+// FormatSeconds formats a duration in seconds, the single unit used for all
+// durations and ages in output: 3600s, 1.5s, 0s.
+func FormatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// FormatSimulatedTime formats a scenario step's offset on the simulated clock,
+// e.g. "T+3600s simulated"
+func FormatSimulatedTime(offset time.Duration) string {
+	return "T+" + FormatSeconds(offset) + " simulated"
+}
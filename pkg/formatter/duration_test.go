@@ -0,0 +1,30 @@
+package formatter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{30 * time.Second, "30s"},
+		{time.Hour, "3600s"},
+		{1500 * time.Millisecond, "1.5s"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatSeconds(tt.d); got != tt.want {
+			t.Errorf("FormatSeconds(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestFormatSimulatedTime(t *testing.T) {
+	if got := FormatSimulatedTime(time.Hour); got != "T+3600s simulated" {
+		t.Errorf("FormatSimulatedTime(1h) = %q, want %q", got, "T+3600s simulated")
+	}
+}
@@ -3,9 +3,11 @@ package formatter
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/perbu/vcltest/pkg/coverage"
+	"github.com/perbu/vcltest/pkg/testspec"
 	"golang.org/x/term"
 )
 
@@ -65,8 +67,9 @@ type VCLFileInfo struct {
 	ExecutedLines []int
 }
 
-// FormatTestFailure formats a complete test failure message with multi-file VCL trace
-func FormatTestFailure(testName string, errors []string, files []VCLFileInfo, backendCalls int, useColor bool) string {
+// FormatTestFailure formats a complete test failure message with multi-file
+// VCL trace, and where the failed expectations are set in the test file
+func FormatTestFailure(testName string, errors []string, spec []testspec.Location, files []VCLFileInfo, backendCalls int, useColor bool) string {
 	var output strings.Builder
 
 	// Test name
@@ -84,6 +87,7 @@ func FormatTestFailure(testName string, errors []string, files []VCLFileInfo, ba
 			fmt.Fprintf(&output, "  ✗ %s\n", err)
 		}
 	}
+	output.WriteString(FormatSpecLocations(spec, useColor))
 
 	// VCL execution trace
 	if len(files) > 0 {
@@ -160,13 +164,23 @@ func ShouldUseColor() bool {
 // Lines within non-entered blocks are shown in gray/dimmed with no marker.
 // Lines outside any block are shown in normal color with no marker.
 // The * marker ensures both humans (via colors) and LLMs (via markers) can see coverage.
+// In tests that make several requests, block headers are annotated with the
+// requests that entered the block, e.g. "← requests 1, 3".
 func FormatVCLWithBlocks(vclSource string, blocks *coverage.FileBlocks, useColor bool) string {
 	lines := strings.Split(vclSource, "\n")
 
 	// Get line status from blocks (line -> entered)
 	var lineStatus map[int]bool
+	requests := make(map[int]string)
 	if blocks != nil {
 		lineStatus = blocks.GetLineStatus()
+		for _, block := range blocks.Blocks {
+			for _, b := range block.AllBlocks() {
+				if len(b.Requests) > 0 {
+					requests[b.HeaderLine] = requestsLabel(b.Requests)
+				}
+			}
+		}
 	} else {
 		lineStatus = make(map[int]bool)
 	}
@@ -176,24 +190,31 @@ func FormatVCLWithBlocks(vclSource string, blocks *coverage.FileBlocks, useColor
 	for i, line := range lines {
 		lineNum := i + 1
 		entered, inBlock := lineStatus[lineNum]
+		note := ""
+		if label, ok := requests[lineNum]; ok {
+			note = "  ← " + label
+			if useColor {
+				note = ColorGray + note + ColorReset
+			}
+		}
 
 		if useColor {
 			if !inBlock {
 				// Line outside any block - normal color, no marker
-				fmt.Fprintf(&output, "  %4d | %s\n", lineNum, line)
+				fmt.Fprintf(&output, "  %4d | %s%s\n", lineNum, line, note)
 			} else if entered {
 				// Line inside entered block - green with * marker
-				fmt.Fprintf(&output, "%s* %4d | %s%s\n", ColorGreen, lineNum, line, ColorReset)
+				fmt.Fprintf(&output, "%s* %4d | %s%s%s\n", ColorGreen, lineNum, line, ColorReset, note)
 			} else {
 				// Line inside non-entered block - gray/dimmed, no marker
-				fmt.Fprintf(&output, "%s  %4d | %s%s\n", ColorGray, lineNum, line, ColorReset)
+				fmt.Fprintf(&output, "%s  %4d | %s%s%s\n", ColorGray, lineNum, line, ColorReset, note)
 			}
 		} else {
 			// Plain text - use * marker for entered blocks
 			if inBlock && entered {
-				fmt.Fprintf(&output, "* %4d | %s\n", lineNum, line)
+				fmt.Fprintf(&output, "* %4d | %s%s\n", lineNum, line, note)
 			} else {
-				fmt.Fprintf(&output, "  %4d | %s\n", lineNum, line)
+				fmt.Fprintf(&output, "  %4d | %s%s\n", lineNum, line, note)
 			}
 		}
 	}
@@ -209,8 +230,51 @@ type VCLFileInfoWithBlocks struct {
 	Blocks   *coverage.FileBlocks
 }
 
-// FormatTestFailureWithBlocks formats a test failure message with block-level coverage.
-func FormatTestFailureWithBlocks(testName string, errors []string, files []VCLFileInfoWithBlocks, backendCalls int, useColor bool) string {
+// requestsLabel names the requests that entered a block, e.g. "requests 1, 3"
+func requestsLabel(requests []int) string {
+	numbers := make([]string, len(requests))
+	for i, n := range requests {
+		numbers[i] = strconv.Itoa(n)
+	}
+	if len(numbers) == 1 {
+		return "request " + numbers[0]
+	}
+	return "requests " + strings.Join(numbers, ", ")
+}
+
+// FormatSpecLocations lists where the failed expectations are set, one
+// "file:line" per line so that editors can jump to them, or returns "" if
+// there are none
+func FormatSpecLocations(locations []testspec.Location, useColor bool) string {
+	if len(locations) == 0 {
+		return ""
+	}
+	var output strings.Builder
+	if useColor {
+		fmt.Fprintf(&output, "\n%sSpec:%s\n", ColorBold, ColorReset)
+	} else {
+		output.WriteString("\nSpec:\n")
+	}
+	for _, loc := range locations {
+		var what []string
+		if loc.Request > 0 {
+			what = append(what, fmt.Sprintf("request %d", loc.Request))
+		}
+		if loc.Field != "" {
+			what = append(what, loc.Field)
+		}
+		fmt.Fprintf(&output, "  %s:%d", loc.File, loc.Line)
+		if len(what) > 0 {
+			fmt.Fprintf(&output, ": %s", strings.Join(what, " "))
+		}
+		output.WriteString("\n")
+	}
+	return output.String()
+}
+
+// FormatTestFailureWithBlocks formats a test failure message with block-level
+// coverage, and where the failed expectations are set in the test file
+func FormatTestFailureWithBlocks(testName string, errors []string, spec []testspec.Location, files []VCLFileInfoWithBlocks, backendCalls int, useColor bool) string {
 	var output strings.Builder
 
 	// Test name
@@ -228,6 +292,7 @@ func FormatTestFailureWithBlocks(testName string, errors []string, files []VCLFi
 			fmt.Fprintf(&output, "  ✗ %s\n", err)
 		}
 	}
+	output.WriteString(FormatSpecLocations(spec, useColor))
 
 	// VCL execution trace
 	if len(files) > 0 {
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/perbu/vcltest/pkg/coverage"
+	"github.com/perbu/vcltest/pkg/testspec"
 )
 
 func TestFormatVCLWithTrace(t *testing.T) {
@@ -85,6 +86,7 @@ func TestFormatTestFailure(t *testing.T) {
 	result := FormatTestFailure(
 		"Test name",
 		errors,
+		nil,
 		files,
 		1,
 		false,
@@ -225,9 +227,12 @@ sub vcl_recv {
 		},
 	}
 
+	spec := []testspec.Location{{File: "tests/api.yaml", Line: 12, Request: 2, Field: "response.status"}}
+
 	result := FormatTestFailureWithBlocks(
 		"Test name",
 		errors,
+		spec,
 		files,
 		1,
 		false,
@@ -267,4 +272,66 @@ sub vcl_recv {
 	if !strings.Contains(result, "if@4") {
 		t.Errorf("Expected if@4 in blocks not entered")
 	}
+
+	if !strings.Contains(result, "Spec:\n  tests/api.yaml:12: request 2 response.status\n") {
+		t.Errorf("Expected spec location in output")
+	}
+}
+
+func TestFormatVCLWithBlocksRequests(t *testing.T) {
+	vclSource := `vcl 4.1;
+
+sub vcl_recv {
+    if (req.url ~ "^/api") {
+        return (pass);
+    }
+    return (hash);
+}`
+
+	fb, err := coverage.AnalyzeVCL(vclSource, "/test.vcl")
+	if err != nil {
+		t.Fatalf("Failed to analyze VCL: %v", err)
+	}
+	coverage.MatchTracesToBlocks(fb, []int{5, 7})
+	coverage.MatchRequestToBlocks(fb, []int{7}, 1)
+	coverage.MatchRequestToBlocks(fb, []int{5}, 2)
+
+	lines := strings.Split(FormatVCLWithBlocks(vclSource, fb, false), "\n")
+	want := map[int]string{
+		2: "*    3 | sub vcl_recv {  ← requests 1, 2",
+		3: `*    4 |     if (req.url ~ "^/api") {  ← request 2`,
+		4: "*    5 |         return (pass);",
+	}
+	for i, line := range want {
+		if lines[i] != line {
+			t.Errorf("line %d = %q, want %q", i+1, lines[i], line)
+		}
+	}
+}
+
+func TestFormatSpecLocations(t *testing.T) {
+	tests := []struct {
+		name      string
+		locations []testspec.Location
+		want      string
+	}{
+		{name: "none", want: ""},
+		{
+			name:      "single-request test",
+			locations: []testspec.Location{{File: "tests/a.yaml", Line: 7, Field: "cache.hit"}},
+			want:      "\nSpec:\n  tests/a.yaml:7: cache.hit\n",
+		},
+		{
+			name:      "no single field",
+			locations: []testspec.Location{{File: "tests/a.yaml", Line: 3, Request: 1}, {File: "tests/a.yaml", Line: 9}},
+			want:      "\nSpec:\n  tests/a.yaml:3: request 1\n  tests/a.yaml:9\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatSpecLocations(tt.locations, false); got != tt.want {
+				t.Errorf("FormatSpecLocations() = %q, want %q", got, tt.want)
+			}
+		})
+	}
 }
@@ -0,0 +1,392 @@
+// Package har records the HTTP traffic of a test run as a HAR 1.2 file
+// (HTTP Archive), for inspection in browser devtools and reuse by replay and
+// load tools.
+//
+// A Recorder wraps the transport of the test client (see
+// client.TransportWrapper), and records pipelined requests, which have their
+// own connection, through RecordExchange. Each test is a page, so tools
+// group the requests of a test together.
+package har
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/perbu/vcltest/pkg/redact"
+)
+
+// File is the top-level HAR object
+type File struct {
+	Log Log `json:"log"`
+}
+
+// Log holds the pages and entries of a HAR file
+type Log struct {
+	Version string  `json:"version"`
+	Creator Creator `json:"creator"`
+	Pages   []Page  `json:"pages"`
+	Entries []Entry `json:"entries"`
+}
+
+// Creator names the application that wrote the file
+type Creator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Page groups the requests of one test
+type Page struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	ID              string      `json:"id"`
+	Title           string      `json:"title"`
+	PageTimings     PageTimings `json:"pageTimings"`
+}
+
+// PageTimings are not measured; -1 means not available
+type PageTimings struct {
+	OnContentLoad float64 `json:"onContentLoad"`
+	OnLoad        float64 `json:"onLoad"`
+}
+
+// Entry is one request and its response
+type Entry struct {
+	Pageref         string    `json:"pageref,omitempty"`
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Time            float64   `json:"time"` // Milliseconds
+	Request         Request   `json:"request"`
+	Response        Response  `json:"response"`
+	Cache           struct{}  `json:"cache"`
+	Timings         Timings   `json:"timings"`
+	Comment         string    `json:"comment,omitempty"` // Transport error, or why the body was recorded cut short
+}
+
+// Request is the request of an entry
+type Request struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	QueryString []NameValue `json:"queryString"`
+	PostData    *PostData   `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+// Response is the response of an entry. Status is 0 if the request failed.
+type Response struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []NameValue `json:"cookies"`
+	Headers     []NameValue `json:"headers"`
+	Content     Content     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int         `json:"bodySize"`
+}
+
+// NameValue is a header, cookie or query parameter
+type NameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PostData is a request body
+type PostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// Content is a response body; binary bodies are base64 encoded
+type Content struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Timings splits the time of an entry; the request is sent in no
+// measurable time, since it goes to a local listener
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Recorder collects entries from the transports it wraps. It is safe for
+// concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	pages   []Page
+	entries []Entry
+}
+
+// New creates an empty recorder
+func New() *Recorder {
+	return &Recorder{}
+}
+
+// BeginPage starts a page; the entries recorded until the next page belong
+// to it
+func (r *Recorder) BeginPage(title string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pages = append(r.pages, Page{
+		StartedDateTime: time.Now(),
+		ID:              fmt.Sprintf("page_%d", len(r.pages)+1),
+		Title:           title,
+		PageTimings:     PageTimings{OnContentLoad: -1, OnLoad: -1},
+	})
+}
+
+// Wrap returns a transport that records the requests sent through base.
+// It has the signature of client.TransportWrapper.
+func (r *Recorder) Wrap(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base, recorder: r}
+}
+
+// RecordExchange records a request whose response was read without the
+// wrapped transport, such as a pipelined one. It has the signature of
+// client.ExchangeRecorder.
+func (r *Recorder) RecordExchange(req *http.Request, resp *http.Response, body []byte, started time.Time) {
+	entry := Entry{StartedDateTime: started, Request: newRequest(req), Comment: "pipelined"}
+	if len(body) > maxBodyBytes {
+		body = body[:maxBodyBytes]
+		entry.Comment = fmt.Sprintf("pipelined, body recorded up to %d bytes", maxBodyBytes)
+	}
+	entry.Response = newResponse(resp, body)
+	entry.Time = milliseconds(time.Since(started))
+	entry.Timings.Wait = entry.Time
+	r.add(entry)
+}
+
+// add appends an entry to the current page
+func (r *Recorder) add(entry Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pages) > 0 {
+		entry.Pageref = r.pages[len(r.pages)-1].ID
+	}
+	r.entries = append(r.entries, entry)
+}
+
+// File returns the recorded traffic with header values, URLs and bodies
+// masked by redactor (which may be nil), entries ordered by start time
+func (r *Recorder) File(redactor *redact.Redactor) *File {
+	r.mu.Lock()
+	pages := append([]Page{}, r.pages...)
+	entries := append([]Entry{}, r.entries...)
+	r.mu.Unlock()
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].StartedDateTime.Before(entries[j].StartedDateTime)
+	})
+	for i := range entries {
+		redactEntry(&entries[i], redactor)
+	}
+
+	version := "(unknown)"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+	return &File{Log: Log{
+		Version: "1.2",
+		Creator: Creator{Name: "vcltest", Version: version},
+		Pages:   pages,
+		Entries: entries,
+	}}
+}
+
+// WriteFile writes the recorded traffic to path (see File)
+func (r *Recorder) WriteFile(path string, redactor *redact.Redactor) error {
+	data, err := json.MarshalIndent(r.File(redactor), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding HAR: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing HAR: %w", err)
+	}
+	return nil
+}
+
+// redactEntry masks the secrets in a copy of a recorded entry. The lists
+// and post data are replaced, so the recorded entry is not changed.
+func redactEntry(entry *Entry, redactor *redact.Redactor) {
+	if redactor == nil {
+		return
+	}
+	entry.Request.URL = redactor.String(entry.Request.URL)
+	for _, list := range []*[]NameValue{&entry.Request.Headers, &entry.Request.Cookies, &entry.Request.QueryString,
+		&entry.Response.Headers, &entry.Response.Cookies} {
+		masked := make([]NameValue, len(*list))
+		for i, nv := range *list {
+			masked[i] = NameValue{Name: nv.Name, Value: redactor.String(nv.Value)}
+			if redactor.IsRedacted(nv.Name) {
+				masked[i].Value = redact.Mask
+			}
+		}
+		*list = masked
+	}
+	if entry.Request.PostData != nil {
+		entry.Request.PostData = &PostData{MimeType: entry.Request.PostData.MimeType, Text: redactor.String(entry.Request.PostData.Text)}
+	}
+	if entry.Response.Content.Encoding == "" {
+		entry.Response.Content.Text = redactor.String(entry.Response.Content.Text)
+	}
+	entry.Response.RedirectURL = redactor.String(entry.Response.RedirectURL)
+}
+
+// transport records each round trip to its recorder
+type transport struct {
+	base     http.RoundTripper
+	recorder *Recorder
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	entry := Entry{StartedDateTime: started, Request: newRequest(req)}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		entry.Time = milliseconds(time.Since(started))
+		entry.Timings.Wait = entry.Time
+		entry.Response = Response{Cookies: []NameValue{}, Headers: []NameValue{}, HeadersSize: -1, BodySize: -1}
+		entry.Comment = err.Error()
+		t.recorder.add(entry)
+		return nil, err
+	}
+	waited := time.Now()
+
+	// Read the body so it can be recorded, and hand the client a copy. Only
+	// the first maxBodyBytes are recorded, the rest is passed through, and a
+	// read error reaches the client after the bytes that arrived.
+	body, readErr := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	rest := io.Reader(resp.Body)
+	if readErr != nil {
+		rest = errReader{readErr}
+	}
+	resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), rest), Closer: resp.Body}
+
+	entry.Response = newResponse(resp, body)
+	entry.Timings = Timings{Wait: milliseconds(waited.Sub(started)), Receive: milliseconds(time.Since(waited))}
+	entry.Time = entry.Timings.Wait + entry.Timings.Receive
+	switch {
+	case readErr != nil:
+		entry.Comment = readErr.Error()
+	case len(body) == maxBodyBytes:
+		entry.Comment = fmt.Sprintf("body recorded up to %d bytes", maxBodyBytes)
+	}
+	t.recorder.add(entry)
+	return resp, nil
+}
+
+// maxBodyBytes bounds the response body recorded per entry
+const maxBodyBytes = 1 << 20
+
+// readCloser reads the recorded body and the rest of the response, and
+// closes the response body
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// errReader fails reads with the error that cut a recorded body short
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// CloseIdleConnections passes through to the wrapped transport
+func (t *transport) CloseIdleConnections() {
+	if closer, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// newRequest records a request. The body is read through GetBody, so the
+// request sent is not consumed.
+func newRequest(req *http.Request) Request {
+	headers := nameValues(req.Header)
+	if req.Host != "" {
+		headers = append([]NameValue{{Name: "Host", Value: req.Host}}, headers...)
+	}
+	r := Request{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []NameValue{},
+		Headers:     headers,
+		QueryString: []NameValue{},
+		HeadersSize: -1,
+	}
+	for _, c := range req.Cookies() {
+		r.Cookies = append(r.Cookies, NameValue{Name: c.Name, Value: c.Value})
+	}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			r.QueryString = append(r.QueryString, NameValue{Name: name, Value: value})
+		}
+	}
+	sort.Slice(r.QueryString, func(i, j int) bool { return r.QueryString[i].Name < r.QueryString[j].Name })
+
+	if req.GetBody != nil && req.ContentLength != 0 {
+		if rc, err := req.GetBody(); err == nil {
+			body, _ := io.ReadAll(rc)
+			rc.Close()
+			r.BodySize = len(body)
+			r.PostData = &PostData{MimeType: req.Header.Get("Content-Type"), Text: string(body)}
+		}
+	}
+	return r
+}
+
+// newResponse records a response and its body
+func newResponse(resp *http.Response, body []byte) Response {
+	r := Response{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     []NameValue{},
+		Headers:     nameValues(resp.Header),
+		Content:     Content{Size: len(body), MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    len(body),
+	}
+	for _, c := range resp.Cookies() {
+		r.Cookies = append(r.Cookies, NameValue{Name: c.Name, Value: c.Value})
+	}
+	if utf8.Valid(body) {
+		r.Content.Text = string(body)
+	} else {
+		r.Content.Text = base64.StdEncoding.EncodeToString(body)
+		r.Content.Encoding = "base64"
+	}
+	return r
+}
+
+// nameValues lists headers in name order
+func nameValues(header http.Header) []NameValue {
+	list := []NameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			list = append(list, NameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
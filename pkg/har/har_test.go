@@ -0,0 +1,165 @@
+package har
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/redact"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+func TestRecorder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/binary" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte{0xff, 0xfe, 0x00})
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cret"})
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello " + r.Host))
+	}))
+	defer server.Close()
+
+	rec := New()
+	httpClient := &http.Client{Transport: rec.Wrap(http.DefaultTransport)}
+	do := func(method, path, reqBody string, headers map[string]string) string {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(reqBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		req.Host = "www.example.com"
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	rec.BeginPage("First test")
+	if got := do("GET", "/page?b=2&a=1", "", map[string]string{"Authorization": "Bearer token", "Cookie": "consent=1"}); got != "hello www.example.com" {
+		t.Errorf("client got body %q, want the response body", got)
+	}
+	rec.BeginPage("Second test")
+	do("POST", "/form", "name=value", map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	do("GET", "/binary", "", nil)
+
+	redactor := redact.New([]string{"Authorization"})
+	redactor.AddValue("s3cret")
+	path := filepath.Join(t.TempDir(), "out.har")
+	if err := rec.WriteFile(path, redactor); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("HAR is not valid JSON: %v", err)
+	}
+
+	log := file.Log
+	if log.Version != "1.2" || len(log.Pages) != 2 || len(log.Entries) != 3 {
+		t.Fatalf("log = version %s, %d pages, %d entries, want 1.2, 2, 3", log.Version, len(log.Pages), len(log.Entries))
+	}
+	first, post, binary := log.Entries[0], log.Entries[1], log.Entries[2]
+	if first.Pageref != "page_1" || post.Pageref != "page_2" || log.Pages[1].Title != "Second test" {
+		t.Errorf("pagerefs = %s, %s, pages = %+v", first.Pageref, post.Pageref, log.Pages)
+	}
+	if header(first.Request.Headers, "Host") != "www.example.com" || header(first.Request.Headers, "Authorization") != redact.Mask {
+		t.Errorf("request headers = %+v, want Host and a masked Authorization", first.Request.Headers)
+	}
+	if len(first.Request.QueryString) != 2 || first.Request.QueryString[0].Name != "a" {
+		t.Errorf("query string = %+v", first.Request.QueryString)
+	}
+	if len(first.Request.Cookies) != 1 || first.Request.Cookies[0].Value != "1" {
+		t.Errorf("request cookies = %+v", first.Request.Cookies)
+	}
+	if first.Response.Status != 200 || first.Response.Content.Text != "hello www.example.com" {
+		t.Errorf("response = %+v", first.Response)
+	}
+	if strings.Contains(string(data), "s3cret") {
+		t.Error("HAR contains a redacted value")
+	}
+	if post.Request.PostData == nil || post.Request.PostData.Text != "name=value" || post.Request.BodySize != 10 {
+		t.Errorf("post data = %+v", post.Request.PostData)
+	}
+	if binary.Response.Content.Encoding != "base64" || binary.Response.Content.Size != 3 {
+		t.Errorf("binary content = %+v, want 3 base64 encoded bytes", binary.Response.Content)
+	}
+
+	// Redaction works on copies
+	if raw := rec.File(nil).Log.Entries[0]; header(raw.Request.Headers, "Authorization") != "Bearer token" {
+		t.Error("redaction changed the recorded entry")
+	}
+}
+
+func TestRecorder_FailedRequest(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	rec := New()
+	httpClient := &http.Client{Transport: rec.Wrap(http.DefaultTransport)}
+	if _, err := httpClient.Get(url); err == nil {
+		t.Fatal("request to a closed server succeeded")
+	}
+	entries := rec.File(nil).Log.Entries
+	if len(entries) != 1 || entries[0].Response.Status != 0 || entries[0].Comment == "" {
+		t.Errorf("entries = %+v, want one failed entry with the error as comment", entries)
+	}
+}
+
+func TestRecorder_RecordExchange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("page " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	rec := New()
+	rec.BeginPage("Pipelined")
+	reqs := []testspec.RequestSpec{{URL: "/a"}, {Method: "POST", URL: "/b", Body: "x=1"}}
+	if _, err := client.Pipeline(server.URL, reqs, rec.RecordExchange); err != nil {
+		t.Fatalf("Pipeline() error = %v", err)
+	}
+
+	entries := rec.File(nil).Log.Entries
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	for i, want := range []string{"page /a", "page /b"} {
+		entry := entries[i]
+		if entry.Response.Status != 200 || entry.Response.Content.Text != want || entry.Pageref != "page_1" || entry.Comment != "pipelined" {
+			t.Errorf("entry %d = %+v, want %q on page_1", i, entry, want)
+		}
+	}
+	if post := entries[1].Request; post.Method != "POST" || post.PostData == nil || post.PostData.Text != "x=1" {
+		t.Errorf("request = %+v, want the POST with its body", post)
+	}
+}
+
+func header(headers []NameValue, name string) string {
+	for _, h := range headers {
+		if h.Name == name {
+			return h.Value
+		}
+	}
+	return ""
+}
@@ -19,27 +19,23 @@ func convertRoutes(routes map[string]testspec.RouteSpec) map[string]backend.Rout
 	result := make(map[string]backend.RouteConfig, len(routes))
 	for path, spec := range routes {
 		result[path] = backend.RouteConfig{
-			Status:      spec.Status,
-			Headers:     spec.Headers,
-			Body:        spec.Body,
-			FailureMode: spec.FailureMode,
-			EchoRequest: spec.EchoRequest,
+			Status:         spec.Status,
+			Headers:        spec.Headers,
+			Body:           spec.Body,
+			FailureMode:    spec.FailureMode,
+			EchoRequest:    spec.EchoRequest,
+			EchoConnection: spec.EchoConnection,
+			Generate:       spec.Generate.Generated(),
 		}
 	}
 	return result
 }
 
-// startAllBackends starts all mock backends needed across all tests.
-// It collects backend configurations from all tests and starts a mock backend
-// for each unique backend name (using the first test's configuration for that backend).
-func startAllBackends(tests []testspec.TestSpec, logger *slog.Logger) (map[string]vclmod.BackendAddress, map[string]*backend.MockBackend, error) {
-	addresses := make(map[string]vclmod.BackendAddress)
-	mockBackends := make(map[string]*backend.MockBackend)
-
-	// Collect backend configurations from all tests
-	// For shared VCL mode, we use the configuration from the FIRST test that defines each backend
+// collectBackendSpecs returns the backend configuration for each backend
+// name across all tests. For shared VCL mode, we use the configuration from
+// the FIRST test that defines each backend.
+func collectBackendSpecs(tests []testspec.TestSpec) map[string]testspec.BackendSpec {
 	backendConfigs := make(map[string]testspec.BackendSpec)
-
 	for _, test := range tests {
 		for name, spec := range test.Backends {
 			if _, exists := backendConfigs[name]; !exists {
@@ -54,16 +50,31 @@ func startAllBackends(tests []testspec.TestSpec, logger *slog.Logger) (map[strin
 			Status: 200,
 		}
 	}
+	return backendConfigs
+}
+
+// startAllBackends starts all mock backends needed across all tests.
+// It collects backend configurations from all tests and starts a mock backend
+// for each unique backend name (using the first test's configuration for that backend).
+func startAllBackends(tests []testspec.TestSpec, logger *slog.Logger) (map[string]vclmod.BackendAddress, map[string]*backend.MockBackend, error) {
+	addresses := make(map[string]vclmod.BackendAddress)
+	mockBackends := make(map[string]*backend.MockBackend)
+
+	backendConfigs := collectBackendSpecs(tests)
 
 	// Start a mock backend for each configuration
 	for name, spec := range backendConfigs {
 		cfg := backend.Config{
-			Status:      spec.Status,
-			Headers:     spec.Headers,
-			Body:        spec.Body,
-			FailureMode: spec.FailureMode,
-			Routes:      convertRoutes(spec.Routes),
-			EchoRequest: spec.EchoRequest,
+			Status:         spec.Status,
+			Headers:        spec.Headers,
+			Body:           spec.Body,
+			FailureMode:    spec.FailureMode,
+			Routes:         convertRoutes(spec.Routes),
+			EchoRequest:    spec.EchoRequest,
+			EchoConnection: spec.EchoConnection,
+			Generate:       spec.Generate.Generated(),
+			ServeDir:       spec.ServeDir,
+			Bandwidth:      int64(spec.Bandwidth),
 		}
 		// Apply default status if not set
 		if cfg.Status == 0 {
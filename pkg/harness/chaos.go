@@ -0,0 +1,152 @@
+package harness
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/perbu/vcltest/pkg/backend"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// DefaultChaosIterations is the number of chaos runs when ChaosConfig.Iterations is not set
+const DefaultChaosIterations = 10
+
+// ChaosConfig re-runs the suite with random backend faults after the normal run
+type ChaosConfig struct {
+	// Probability is the chance that a backend request gets a fault (delay, reset or 500)
+	Probability float64
+
+	// Iterations is the number of chaos runs (default DefaultChaosIterations)
+	Iterations int
+
+	// Seed seeds the fault injectors. If 0, a random seed is used (see ChaosReport.Seed).
+	Seed uint64
+}
+
+// ParseChaos parses a chaos spec of comma-separated key=value pairs:
+// p (fault probability, required), iterations and seed. Example: "p=0.05,iterations=20".
+func ParseChaos(spec string) (*ChaosConfig, error) {
+	cfg := &ChaosConfig{Probability: -1}
+	for _, part := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("chaos: expected key=value, got %q", part)
+		}
+		var err error
+		switch key {
+		case "p":
+			cfg.Probability, err = strconv.ParseFloat(value, 64)
+			if err == nil && (cfg.Probability <= 0 || cfg.Probability > 1) {
+				err = fmt.Errorf("must be in (0, 1]")
+			}
+		case "iterations":
+			cfg.Iterations, err = strconv.Atoi(value)
+			if err == nil && cfg.Iterations <= 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "seed":
+			cfg.Seed, err = strconv.ParseUint(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("chaos: unknown key %q (want p, iterations or seed)", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chaos: %s=%s: %w", key, value, err)
+		}
+	}
+	if cfg.Probability < 0 {
+		return nil, fmt.Errorf("chaos: p (fault probability) is required")
+	}
+	return cfg, nil
+}
+
+// ChaosReport is the outcome of the chaos runs
+type ChaosReport struct {
+	Probability float64           `json:"probability"`
+	Iterations  int               `json:"iterations"`
+	Seed        uint64            `json:"seed"`
+	Tests       []ChaosTestResult `json:"tests"` // In run order
+}
+
+// ChaosTestResult is how one test fared under chaos
+type ChaosTestResult struct {
+	TestName string `json:"test_name"`
+	Skipped  bool   `json:"skipped"`  // Failed without chaos, so not run under chaos
+	Failures int    `json:"failures"` // Iterations in which the test failed
+	Faults   int    `json:"faults"`   // Faults injected while the test ran, over all iterations
+}
+
+// Sensitive returns the tests that pass normally but failed under chaos
+func (r *ChaosReport) Sensitive() []ChaosTestResult {
+	var sensitive []ChaosTestResult
+	for _, t := range r.Tests {
+		if !t.Skipped && t.Failures > 0 {
+			sensitive = append(sensitive, t)
+		}
+	}
+	return sensitive
+}
+
+// runChaos re-runs the tests that passed in baseline with chaos enabled on all backends.
+// Results are not reported as regular results or events.
+func (h *Harness) runChaos(tests []testspec.TestSpec, baseline *Result) *ChaosReport {
+	cfg := h.cfg.Chaos
+	report := &ChaosReport{
+		Probability: cfg.Probability,
+		Iterations:  cfg.Iterations,
+		Seed:        cfg.Seed,
+		Tests:       make([]ChaosTestResult, len(tests)),
+	}
+	if report.Iterations <= 0 {
+		report.Iterations = DefaultChaosIterations
+	}
+	if report.Seed == 0 {
+		report.Seed = rand.Uint64()
+	}
+	for i, test := range tests {
+		report.Tests[i] = ChaosTestResult{TestName: test.Name, Skipped: !baseline.Results[i].Passed}
+	}
+
+	// One injector per backend, seeded in name order for reproducible fault sequences
+	names := make([]string, 0, len(h.mockBackends))
+	for name := range h.mockBackends {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for i, name := range names {
+		h.mockBackends[name].SetChaos(backend.NewChaos(cfg.Probability, report.Seed+uint64(i)))
+	}
+	defer func() {
+		for _, mock := range h.mockBackends {
+			mock.SetChaos(nil)
+		}
+	}()
+
+	h.logger.Info("Running chaos iterations", "iterations", report.Iterations, "probability", cfg.Probability, "seed", report.Seed)
+	for iteration := 1; iteration <= report.Iterations; iteration++ {
+		for i, test := range tests {
+			if report.Tests[i].Skipped {
+				continue
+			}
+			faultsBefore := h.chaosFaults()
+			result := h.runTest(i, test)
+			report.Tests[i].Faults += h.chaosFaults() - faultsBefore
+			if !result.Passed {
+				report.Tests[i].Failures++
+				h.logger.Debug("Test failed under chaos", "test", test.Name, "iteration", iteration, "errors", result.Errors)
+			}
+		}
+	}
+	return report
+}
+
+// chaosFaults returns the faults injected so far across all backends
+func (h *Harness) chaosFaults() int {
+	total := 0
+	for _, mock := range h.mockBackends {
+		total += mock.ChaosFaults()
+	}
+	return total
+}
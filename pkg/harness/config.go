@@ -1,9 +1,15 @@
 package harness
 
 import (
+	"context"
+	"io"
 	"log/slog"
+	"time"
 
+	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/eventstream"
 	"github.com/perbu/vcltest/pkg/runner"
+	"github.com/perbu/vcltest/pkg/testspec"
 )
 
 // Config holds configuration for the test harness.
@@ -11,34 +17,143 @@ type Config struct {
 	// TestFile is the path to the YAML test specification file.
 	TestFile string
 
+	// Tests are run instead of the tests in TestFile, which then only names
+	// the suite (test IDs, reports). For tests that do not come from YAML,
+	// such as VCL doctests.
+	Tests []testspec.TestSpec
+
 	// VCLPath is an optional explicit path to the VCL file.
 	// If empty, the harness will auto-detect based on the test file name.
 	VCLPath string
 
+	// VCLSource is VCL text to test instead of a file (e.g. read from stdin).
+	// It takes precedence over VCLPath and vcl_source in the spec.
+	VCLSource string
+
 	// Verbose enables debug logging.
 	Verbose bool
 
 	// DebugDump preserves all artifacts in /tmp for debugging.
 	DebugDump bool
 
+	// StartupTimeout bounds how long varnishd and varnishlog may take to
+	// become ready. When it runs out, Run fails with a report of how far
+	// startup got. If zero, DefaultStartupTimeout is used.
+	StartupTimeout time.Duration
+
+	// VarnishdLogDir receives a copy of varnishd's stdout and stderr when
+	// the run ends, pass or fail. If empty, they go with the work dir.
+	VarnishdLogDir string
+
+	// OnlyTests restricts execution to tests with these names.
+	// If empty, all tests in the file are run.
+	OnlyTests []string
+
+	// CollectTraces attaches VCL traces to every test result, not only failures.
+	// This is needed to record per-test coverage.
+	CollectTraces bool
+
+	// Timeline attaches a timeline of client requests, VCL states and backend
+	// fetches (from VSL) to every test result.
+	Timeline bool
+
+	// AllowNetwork leaves VCL backends without a mock pointing at their
+	// declared hosts. By default they are rewritten to a guard that fails
+	// any test that connects to them.
+	AllowNetwork bool
+
+	// StrictBackends reports, in Result.UnusedRoutes, the backend routes
+	// declared by the tests that no request matched.
+	StrictBackends bool
+
+	// Explain attaches to every test result how each assertion's value was
+	// derived (which header, VSL record or backend counter).
+	Explain bool
+
+	// EffectiveVCL receives a diff of each VCL file against the backend-rewritten
+	// version loaded into varnishd, written before varnishd starts.
+	// If nil, nothing is written.
+	EffectiveVCL io.Writer
+
+	// Chaos re-runs the passing tests with random backend faults and reports
+	// which ones are sensitive to origin instability. If nil, chaos is off.
+	Chaos *ChaosConfig
+
+	// HARFile receives the requests tests made to Varnish and their
+	// responses as a HAR file after the tests, one page per test, with
+	// redacted headers masked. Pipelined requests are not included. If
+	// empty, no HAR is written.
+	HARFile string
+
+	// WrapTransport wraps the transport of the requests tests make to
+	// Varnish (or the simulator), e.g. to record them, add tracing headers or
+	// route them through a proxy. Pipelined requests are not wrapped. If nil,
+	// the pooled transport is used as is.
+	WrapTransport client.TransportWrapper
+
+	// AfterTests runs after the tests, while varnishd and the mock backends
+	// are still up, so that Go code can make its own requests with
+	// Harness.Do and assert on them. An error fails Run. If nil, Run goes
+	// straight to teardown.
+	AfterTests func(ctx context.Context, h *Harness) error
+
+	// Hooks are shell commands run before varnishd starts and after the
+	// tests. If nil, the hooks in the test file are used.
+	Hooks *testspec.HooksSpec
+
+	// Events receives structured lifecycle events (suite_start, test_end, ...).
+	// If nil, no events are emitted.
+	Events *eventstream.Emitter
+
 	// Logger is the structured logger to use. If nil, a default is created.
 	Logger *slog.Logger
 }
 
-// Result holds the outcome of running all tests.
+// DefaultStartupTimeout is the startup budget when Config.StartupTimeout is zero
+const DefaultStartupTimeout = 60 * time.Second
+
+// ResultSchemaVersion is the version of the JSON encoding of Result, as
+// published by -generate-result-schema. It is bumped whenever a field is
+// renamed or removed, or its meaning changes; new optional fields do not
+// bump it.
+const ResultSchemaVersion = 1
+
+// Result holds the outcome of running all tests. Its JSON encoding is a
+// stable contract, described by the schema from -generate-result-schema.
 type Result struct {
+	// SchemaVersion is ResultSchemaVersion, for consumers of the JSON encoding.
+	SchemaVersion int `json:"schema_version"`
+
 	// Passed is the count of tests that passed.
-	Passed int
+	Passed int `json:"passed"`
 
 	// Failed is the count of tests that failed.
-	Failed int
+	Failed int `json:"failed"`
 
 	// Total is the total number of tests run.
-	Total int
+	Total int `json:"total"`
 
 	// Results contains detailed results for each test.
-	Results []runner.TestResult
+	Results []runner.TestResult `json:"results"`
 
 	// DebugDumpPath is the path to debug artifacts, if DebugDump was enabled.
-	DebugDumpPath string
+	DebugDumpPath string `json:"debug_dump_path,omitempty"`
+
+	// AfterSuiteError is the failure of an after_suite hook, if any. The run
+	// failed even when every test passed.
+	AfterSuiteError string `json:"after_suite_error,omitempty"`
+
+	// HARPath is the HAR file written, if HARFile was set.
+	HARPath string `json:"har_path,omitempty"`
+
+	// Chaos is the outcome of the chaos runs, if Chaos was configured.
+	Chaos *ChaosReport `json:"chaos,omitempty"`
+
+	// UnusedRoutes are the declared backend routes no request matched, if
+	// StrictBackends was set.
+	UnusedRoutes []UnusedRoute `json:"unused_routes,omitempty"`
+
+	// VCLPath is the resolved path to the VCL file under test.
+	// Empty when the VCL was given inline (vcl_source or stdin).
+	VCLPath string `json:"vcl_path,omitempty"`
 }
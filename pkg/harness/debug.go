@@ -1,20 +1,24 @@
 package harness
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/perbu/vcltest/pkg/redact"
 	"github.com/perbu/vcltest/pkg/runner"
 	"github.com/perbu/vcltest/pkg/testspec"
+	"github.com/perbu/vcltest/pkg/varnish"
 )
 
 // createDebugDump creates a debug dump directory with all test artifacts.
-func createDebugDump(testFile, vclPath, workDir, varnishDir string, testRunner *runner.Runner, tests []testspec.TestSpec, passed, failed int, logger *slog.Logger) (string, error) {
+func createDebugDump(testFile, vclPath, workDir, varnishDir string, testRunner *runner.Runner, tests []testspec.TestSpec, passed, failed int, redactor *redact.Redactor, logger *slog.Logger) (string, error) {
 	// Create dump directory with timestamp
 	timestamp := time.Now().Format("20060102-150405")
 	testBasename := filepath.Base(testFile)
@@ -28,7 +32,7 @@ func createDebugDump(testFile, vclPath, workDir, varnishDir string, testRunner *
 	logger.Debug("Creating debug dump", "dir", dumpDir)
 
 	// Copy test YAML file
-	if err := copyFile(testFile, filepath.Join(dumpDir, "test.yaml")); err != nil {
+	if err := copyFileRedacted(testFile, filepath.Join(dumpDir, "test.yaml"), redactor); err != nil {
 		logger.Warn("Failed to copy test file", "error", err)
 	}
 
@@ -37,8 +41,11 @@ func createDebugDump(testFile, vclPath, workDir, varnishDir string, testRunner *
 		logger.Warn("Failed to copy VCL file", "error", err)
 	}
 
-	// Save modified VCL (from runner)
-	if modifiedVCL := testRunner.GetLoadedVCLSource(); modifiedVCL != "" {
+	// Save modified VCL (from runner, which is nil if the run failed before
+	// varnishd started)
+	if testRunner == nil {
+		logger.Debug("No runner, modified VCL not saved")
+	} else if modifiedVCL := testRunner.GetLoadedVCLSource(); modifiedVCL != "" {
 		if err := os.WriteFile(filepath.Join(dumpDir, "modified.vcl"), []byte(modifiedVCL), 0644); err != nil {
 			logger.Warn("Failed to save modified VCL", "error", err)
 		}
@@ -46,7 +53,7 @@ func createDebugDump(testFile, vclPath, workDir, varnishDir string, testRunner *
 
 	// Copy varnishlog output
 	varnishLogPath := filepath.Join(varnishDir, "varnish.log")
-	if err := copyFile(varnishLogPath, filepath.Join(dumpDir, "varnish.log")); err != nil {
+	if err := copyFileRedacted(varnishLogPath, filepath.Join(dumpDir, "varnish.log"), redactor); err != nil {
 		logger.Warn("Failed to copy varnishlog", "error", err)
 	}
 
@@ -81,12 +88,24 @@ func createDebugDump(testFile, vclPath, workDir, varnishDir string, testRunner *
 		logger.Warn("Failed to copy secret file", "error", err)
 	}
 
+	// Copy varnishd stdout and stderr
+	for _, path := range varnish.OutputFiles(workDir) {
+		if err := copyFileRedacted(path, filepath.Join(dumpDir, filepath.Base(path)), redactor); err != nil {
+			logger.Warn("Failed to copy varnishd output", "file", filepath.Base(path), "error", err)
+		}
+	}
+
 	// Copy varnishadm traffic log
 	transcriptPath := filepath.Join(workDir, "varnishadm-traffic.log")
-	if err := copyFile(transcriptPath, filepath.Join(dumpDir, "varnishadm-traffic.log")); err != nil {
+	if err := copyFileRedacted(transcriptPath, filepath.Join(dumpDir, "varnishadm-traffic.log"), redactor); err != nil {
 		logger.Debug("Varnishadm traffic log not found", "error", err)
 	}
 
+	// Copy hook output
+	if err := copyFileRedacted(filepath.Join(workDir, hooksLogFile), filepath.Join(dumpDir, hooksLogFile), redactor); err != nil {
+		logger.Debug("Hooks log not found (expected without hooks)", "error", err)
+	}
+
 	// Create README with test run information
 	readme := fmt.Sprintf(`VCLTest Debug Dump
 ==================
@@ -104,7 +123,9 @@ Files in this directory:
 - original.vcl: The original VCL file before modification
 - modified.vcl: The VCL file with backend addresses replaced
 - varnish.log: The varnishlog output from test execution
+- varnishd.stdout.log, varnishd.stderr.log: Output of the varnishd manager and child processes
 - varnishadm-traffic.log: Transcript of varnishadm CLI commands and responses
+- hooks.log: Output of the before_suite and after_suite hooks (if any)
 - faketime.control: The libfaketime control file (if time scenarios used)
 - faketime-info.txt: Explanation of how faketime works (if time scenarios used)
 - secret: The varnishadm authentication secret
@@ -123,7 +144,7 @@ Example commands:
   varnishadm -T localhost:6082 -S %s backend.list
 
 Note: Varnish is no longer running, these directories are for forensic analysis only.
-`,
+%s`,
 		time.Now().Format("2006-01-02 15:04:05"),
 		testFile,
 		vclPath,
@@ -135,6 +156,7 @@ Note: Varnish is no longer running, these directories are for forensic analysis
 		filepath.Join(dumpDir, "secret"),
 		filepath.Join(dumpDir, "secret"),
 		filepath.Join(dumpDir, "secret"),
+		redactionNote(redactor),
 	)
 
 	if err := os.WriteFile(filepath.Join(dumpDir, "README.txt"), []byte(readme), 0644); err != nil {
@@ -144,6 +166,29 @@ Note: Varnish is no longer running, these directories are for forensic analysis
 	return dumpDir, nil
 }
 
+// redactionNote explains which files in the dump are redacted
+func redactionNote(redactor *redact.Redactor) string {
+	if redactor == nil {
+		return ""
+	}
+	return "\nRedaction: test.yaml, varnish.log and varnishadm-traffic.log in this directory have\n" +
+		"redacted header values masked as " + redact.Mask + ". The preserved temporary\n" +
+		"directories above are NOT redacted.\n"
+}
+
+// copyFileRedacted copies a text file from src to dst, masking redacted values.
+// Without a redactor it is a plain copy.
+func copyFileRedacted(src, dst string, redactor *redact.Redactor) error {
+	if redactor == nil {
+		return copyFile(src, dst)
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, []byte(redactor.String(string(data))), 0644)
+}
+
 // copyFile copies a file from src to dst.
 func copyFile(src, dst string) error {
 	srcFile, err := os.Open(src)
@@ -164,3 +209,37 @@ func copyFile(src, dst string) error {
 
 	return dstFile.Sync()
 }
+
+// varnishdOutputLines is how much of varnishd's output a startup failure shows
+const varnishdOutputLines = 20
+
+// withVarnishdOutput appends the tail of varnishd's output to a startup
+// error, since the cause (VSM permissions, a VMOD that fails to load, ...)
+// is usually only printed there
+func withVarnishdOutput(err error, workDir string) error {
+	tail := varnish.OutputTail(workDir, varnishdOutputLines)
+	if tail == "" {
+		return err
+	}
+	return fmt.Errorf("%w\n%s", err, tail)
+}
+
+// keepVarnishdLogs copies varnishd's output files to Config.VarnishdLogDir
+func (h *Harness) keepVarnishdLogs() {
+	if h.cfg.VarnishdLogDir == "" {
+		return
+	}
+	if err := os.MkdirAll(h.cfg.VarnishdLogDir, 0755); err != nil {
+		h.logger.Warn("Failed to create varnishd log dir", "error", err)
+		return
+	}
+	for _, path := range varnish.OutputFiles(h.workDir) {
+		err := copyFileRedacted(path, filepath.Join(h.cfg.VarnishdLogDir, filepath.Base(path)), h.redactor)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // varnishd never started
+		}
+		if err != nil {
+			h.logger.Warn("Failed to keep varnishd output", "file", filepath.Base(path), "error", err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/perbu/vcltest/pkg/simulator"
+	"github.com/perbu/vcltest/pkg/testspec"
+	"github.com/perbu/vcltest/pkg/vclcheck"
+	"github.com/perbu/vcltest/pkg/vclmod"
+)
+
+// Plan is what a run would do, as worked out by DryRun
+type Plan struct {
+	TestFile string
+	VCLPath  string // Empty when the VCL was given inline
+	Checker  string // How the VCL was compiled: vclcheck.Varnishd or vclcheck.VCLParser
+	Backends []string
+	Hooks    testspec.HooksSpec // Suite hooks that would run (not run by DryRun)
+	Tests    []PlanTest
+
+	Varnishd bool // Whether varnishd would be started
+	FakeTime bool // Whether varnishd would run with a controllable clock (scenario tests)
+}
+
+// PlanTest is one test of a plan
+type PlanTest struct {
+	Name         string
+	ID           string
+	Engine       string
+	EngineReason string // Why a simulated test would run on varnishd
+	Steps        []PlanStep
+	Warmup       int // Number of warmup requests
+}
+
+// PlanStep is one request of a test. At is empty for single-request tests.
+type PlanStep struct {
+	At     string
+	Method string
+	URL    string
+}
+
+// DryRun validates the test file and the VCL without starting varnishd or
+// any backend: it loads and validates the specs, resolves the VCL, checks
+// the backends against it, and compiles the rewritten VCL (varnishd -C, or
+// the built-in parser when varnishd is not installed).
+func (h *Harness) DryRun(ctx context.Context) (*Plan, error) {
+	tests, err := h.loadTests()
+	if err != nil {
+		return nil, err
+	}
+	selected := filterTests(tests, h.cfg.OnlyTests)
+
+	if err := h.createTempDirs(); err != nil {
+		return nil, err
+	}
+	defer h.cleanupTempDirs()
+
+	vclPath, inline, err := h.resolveVCL(tests)
+	if err != nil {
+		return nil, fmt.Errorf("resolving VCL file: %w", err)
+	}
+	plan := &Plan{TestFile: h.cfg.TestFile}
+	hooks, err := h.suiteHooks(tests)
+	if err != nil {
+		return nil, err
+	}
+	plan.Hooks = *hooks
+	if !inline {
+		plan.VCLPath = vclPath
+	}
+
+	// Backends listen on random ports at run time; any address will do for
+	// validation and compilation
+	backends := make(map[string]vclmod.BackendAddress)
+	for name := range collectBackendSpecs(tests) {
+		backends[name] = vclmod.BackendAddress{Host: "127.0.0.1", Port: "1"}
+		plan.Backends = append(plan.Backends, name)
+	}
+	sort.Strings(plan.Backends)
+
+	// Validates the backends against the VCL (warnings are logged)
+	modifiedVCLPath, err := h.prepareVCL(vclPath, backends)
+	if err != nil {
+		return nil, err
+	}
+	plan.Checker, err = vclcheck.CompileFile(ctx, modifiedVCLPath, filepath.Join(h.workDir, "vcl"), vclcheck.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("compiling VCL: %w", err)
+	}
+
+	simulatorErr := h.checkSimulator(selected, modifiedVCLPath)
+	for _, test := range selected {
+		pt := PlanTest{
+			Name:   test.Name,
+			ID:     testspec.TestID(h.cfg.TestFile, test.Name),
+			Engine: testspec.EngineVarnishd,
+			Warmup: len(test.Warmup),
+		}
+		if test.Engine == testspec.EngineSimulated {
+			if err := simulatorErr; err == nil {
+				err = simulator.CheckTest(test)
+			}
+			if err != nil {
+				pt.EngineReason = err.Error()
+			} else {
+				pt.Engine = testspec.EngineSimulated
+			}
+		}
+		if pt.Engine == testspec.EngineVarnishd {
+			plan.Varnishd = true
+		}
+
+		switch {
+		case test.IsScenario():
+			plan.FakeTime = true
+			for _, step := range test.Scenario {
+				pt.Steps = append(pt.Steps, PlanStep{At: step.Offset().String(), Method: step.Request.Method, URL: step.Request.URL})
+			}
+		case test.IsPipeline():
+			for _, step := range test.Pipeline {
+				pt.Steps = append(pt.Steps, PlanStep{Method: step.Request.Method, URL: step.Request.URL})
+			}
+		default:
+			pt.Steps = []PlanStep{{Method: test.Request.Method, URL: test.Request.URL}}
+		}
+		plan.Tests = append(plan.Tests, pt)
+	}
+	plan.Varnishd = plan.Varnishd || h.cfg.DebugDump
+	return plan, nil
+}
+
+// checkSimulator returns why simulated tests would run on varnishd instead,
+// or nil if the simulator can run them (subject to simulator.CheckTest)
+func (h *Harness) checkSimulator(tests []testspec.TestSpec, vclPath string) error {
+	for _, test := range tests {
+		if test.Engine != testspec.EngineSimulated {
+			continue
+		}
+		if h.cfg.CollectTraces || h.cfg.Timeline {
+			return fmt.Errorf("VSL is being collected")
+		}
+		engine, err := simulator.Compile(vclPath, nil, h.logger)
+		if err != nil {
+			return err
+		}
+		engine.Close()
+		return nil
+	}
+	return nil
+}
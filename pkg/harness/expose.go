@@ -0,0 +1,84 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// exposeDialTimeout bounds connecting an exposed connection to varnishd
+const exposeDialTimeout = 5 * time.Second
+
+// VarnishURL returns the URL varnishd listens on, or "" if it is not running
+func (h *Harness) VarnishURL() string {
+	if h.httpPort == 0 {
+		return ""
+	}
+	return fmt.Sprintf("http://127.0.0.1:%d", h.httpPort)
+}
+
+// Expose forwards the connections accepted on listener to varnishd until ctx
+// is done, so that requests can be made by hand (curl, a browser) against
+// the suite's VCL and mock backends. Like Do, it is for Config.AfterTests.
+// The listener and open connections are closed when it returns.
+func (h *Harness) Expose(ctx context.Context, listener net.Listener) error {
+	defer listener.Close()
+	if h.httpPort == 0 {
+		return fmt.Errorf("varnishd is not running (Expose is available in Config.AfterTests, unless every test is simulated)")
+	}
+	target := fmt.Sprintf("127.0.0.1:%d", h.httpPort)
+
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("accepting connection: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.forward(ctx, conn, target)
+		}()
+	}
+}
+
+// forward copies bytes between a client connection and varnishd until both
+// directions are done or ctx is
+func (h *Harness) forward(ctx context.Context, conn net.Conn, target string) {
+	defer conn.Close()
+	upstream, err := net.DialTimeout("tcp", target, exposeDialTimeout)
+	if err != nil {
+		h.logger.Warn("Failed to connect exposed connection to varnishd", "client", conn.RemoteAddr(), "error", err)
+		return
+	}
+	defer upstream.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		upstream.Close()
+	})
+	defer stop()
+
+	h.logger.Debug("Forwarding exposed connection", "client", conn.RemoteAddr())
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// Pass the half-close on, so the other direction can finish
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	<-done
+	<-done
+}
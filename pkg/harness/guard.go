@@ -0,0 +1,129 @@
+package harness
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/perbu/vcltest/pkg/runner"
+	"github.com/perbu/vcltest/pkg/vclmod"
+)
+
+// networkGuard stands in for the VCL backends that have no mock, so a test
+// cannot silently reach a real host: each such backend is rewritten to a
+// guard listener that records the connection attempt and closes it.
+type networkGuard struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	origins   map[string]string // Backend name -> declared address
+	attempts  map[string]int    // Backend name -> connections since the last take
+	err       error             // First listen error
+}
+
+func newNetworkGuard() *networkGuard {
+	return &networkGuard{
+		origins:  make(map[string]string),
+		attempts: make(map[string]int),
+	}
+}
+
+// address starts a listener for a backend and returns its address.
+// It is a vclmod.GuardFunc.
+func (g *networkGuard) address(name string, original vclmod.BackendAddress) vclmod.BackendAddress {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		g.mu.Lock()
+		if g.err == nil {
+			g.err = fmt.Errorf("starting network guard for backend %q: %w", name, err)
+		}
+		g.mu.Unlock()
+		return vclmod.BackendAddress{Host: "127.0.0.1", Port: "1"}
+	}
+
+	origin := original.Host
+	if original.Port != "" {
+		origin = net.JoinHostPort(original.Host, original.Port)
+	}
+	g.mu.Lock()
+	g.listeners = append(g.listeners, listener)
+	g.origins[name] = origin
+	g.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Count before closing, so the attempt is recorded by the
+			// time the failed fetch completes
+			g.mu.Lock()
+			g.attempts[name]++
+			g.mu.Unlock()
+			conn.Close()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return vclmod.BackendAddress{Host: host, Port: port}
+}
+
+// take returns one error per guarded backend that was connected to since
+// the last call, and resets the counts
+func (g *networkGuard) take() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var names []string
+	for name := range g.attempts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		origin := g.origins[name]
+		if origin == "" {
+			origin = "unknown address"
+		}
+		errs = append(errs, fmt.Sprintf(
+			"Backend %q is not mocked: %d connection(s) to it were blocked by the network guard (declared address: %s).\n  Add it to the test spec, e.g. backends: {%s: {status: 200}}, or run with -allow-network",
+			name, g.attempts[name], origin, name))
+	}
+	clear(g.attempts)
+	return errs
+}
+
+// check fails the result if guarded backends were connected to during the test
+func (g *networkGuard) check(result *runner.TestResult) {
+	errs := g.take()
+	if len(errs) == 0 {
+		return
+	}
+	result.Passed = false
+	result.Errors = append(result.Errors, errs...)
+}
+
+// close stops all guard listeners
+func (g *networkGuard) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, listener := range g.listeners {
+		listener.Close()
+	}
+	g.listeners = nil
+}
+
+// guardedNames returns the guarded backends, for logging
+func (g *networkGuard) guardedNames() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var names []string
+	for name := range g.origins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -3,15 +3,24 @@ package harness
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/perbu/vcltest/pkg/backend"
+	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/eventstream"
+	"github.com/perbu/vcltest/pkg/formatter"
+	"github.com/perbu/vcltest/pkg/har"
 	"github.com/perbu/vcltest/pkg/recorder"
+	"github.com/perbu/vcltest/pkg/redact"
 	"github.com/perbu/vcltest/pkg/runner"
 	"github.com/perbu/vcltest/pkg/service"
+	"github.com/perbu/vcltest/pkg/simulator"
 	"github.com/perbu/vcltest/pkg/testspec"
 	"github.com/perbu/vcltest/pkg/varnish"
 	"github.com/perbu/vcltest/pkg/vclmod"
@@ -32,6 +41,16 @@ type Harness struct {
 	mockBackends   map[string]*backend.MockBackend
 	cancelServices context.CancelFunc // Cancels the service context to stop varnishd
 	transcriptFile *os.File           // varnishadm traffic log (when DebugDump enabled)
+	redactor       *redact.Redactor   // Masks secret header values in output (nil if unused)
+	guard          *networkGuard      // Blocks VCL backends without a mock (nil with AllowNetwork)
+	har            *har.Recorder      // Client traffic for HARFile (nil if unused)
+	timer          phaseTimer         // Where the time of the run went (see Phases)
+
+	// Simulated engine (engine: simulated), nil if unused
+	simulator *simulator.Engine
+	simServer *http.Server
+	simRunner *runner.Runner
+	simulated map[int]bool // Indexes of the selected tests run on the simulator
 }
 
 // New creates a new test harness with the given configuration.
@@ -53,23 +72,26 @@ func New(cfg *Config) *Harness {
 	}
 }
 
-// Run executes all tests and returns the results.
-func (h *Harness) Run(ctx context.Context) (*Result, error) {
-	// Resolve VCL file path
-	vclPath, err := testspec.ResolveVCL(h.cfg.TestFile, h.cfg.VCLPath)
-	if err != nil {
-		return nil, fmt.Errorf("resolving VCL file: %w", err)
-	}
-	h.logger.Debug("Resolved VCL file", "path", vclPath)
+// Run executes all tests and returns the results. A failing after_suite hook
+// is reported in Result.AfterSuiteError, not as an error, so the results of
+// the tests are kept.
+func (h *Harness) Run(ctx context.Context) (_ *Result, err error) {
+	h.timer = phaseTimer{ctx: ctx}
+	h.timer.begin("startup")
+	defer h.timer.end() // Registered first, so teardown is timed too
 
 	// Load test specifications
-	h.logger.Debug("Loading test file", "file", h.cfg.TestFile)
-	tests, err := testspec.Load(h.cfg.TestFile)
+	tests, err := h.loadTests()
 	if err != nil {
-		return nil, fmt.Errorf("loading test file: %w", err)
+		return nil, err
 	}
 	h.logger.Debug("Loaded tests", "count", len(tests))
 
+	h.redactor = newRedactor(tests)
+	if h.cfg.HARFile != "" {
+		h.har = har.New()
+	}
+
 	// Check if any tests are scenario-based (require time control)
 	hasScenarioTests := false
 	for _, test := range tests {
@@ -87,6 +109,67 @@ func (h *Harness) Run(ctx context.Context) (*Result, error) {
 		defer h.cleanupTempDirs()
 	}
 
+	// Resolve VCL file path (inline VCL is written to the work dir)
+	vclPath, inline, err := h.resolveVCL(tests)
+	if err != nil {
+		return nil, fmt.Errorf("resolving VCL file: %w", err)
+	}
+	h.logger.Debug("Resolved VCL file", "path", vclPath)
+
+	selected := filterTests(tests, h.cfg.OnlyTests)
+	h.cfg.Events.Emit(eventstream.Event{
+		Type:     eventstream.SuiteStart,
+		TestFile: h.cfg.TestFile,
+		VCLPath:  vclPath,
+		Total:    len(selected),
+	})
+
+	// Every suite_start gets a suite_end, also when the run fails, so
+	// consumers never wait for one. Counts cover the tests that ran.
+	var summary *Result
+	defer func() {
+		end := eventstream.Event{Type: eventstream.SuiteEnd, Total: len(selected)}
+		if summary != nil {
+			end.Total, end.PassCount, end.FailCount = summary.Total, summary.Passed, summary.Failed
+		}
+		if err != nil {
+			end.Error = err.Error()
+		} else if summary != nil && summary.AfterSuiteError != "" {
+			end.Error = summary.AfterSuiteError
+		}
+		h.cfg.Events.Emit(end)
+	}()
+
+	// Suite hooks: after_suite runs once, after the tests or when the run
+	// fails, provided before_suite got to run
+	hooks, err := h.suiteHooks(tests)
+	if err != nil {
+		return nil, err
+	}
+	afterSuiteDone := false
+	afterSuite := func() error {
+		if afterSuiteDone {
+			return nil
+		}
+		afterSuiteDone = true
+		return h.runHooks(context.WithoutCancel(ctx), "after_suite", hooks.AfterSuite)
+	}
+	defer func() {
+		if err := afterSuite(); err != nil {
+			h.logger.Error("after_suite hook failed", "error", err)
+		}
+	}()
+	if err := h.runHooks(ctx, "before_suite", hooks.BeforeSuite); err != nil {
+		// Clean up first, so the dump has the output of both stages
+		if err := afterSuite(); err != nil {
+			h.logger.Error("after_suite hook failed", "error", err)
+		}
+		if dumpPath := h.debugDump(vclPath, tests, 0, 0); dumpPath != "" {
+			return nil, fmt.Errorf("%w\ndebug artifacts saved to: %s", err, dumpPath)
+		}
+		return nil, err
+	}
+
 	// === NEW SIMPLIFIED STARTUP FLOW ===
 	// 1. Start backends FIRST (need addresses for VCL modification)
 	backendAddresses, err := h.startBackendsEarly(tests)
@@ -95,37 +178,146 @@ func (h *Harness) Run(ctx context.Context) (*Result, error) {
 	}
 	defer stopAllBackends(h.mockBackends, h.logger)
 
-	// 2. Prepare VCL with modified backend addresses and write to workdir
+	// 2. Prepare VCL with modified backend addresses and write to workdir.
+	// VCL backends without a mock are pointed at the network guard.
+	if !h.cfg.AllowNetwork {
+		h.guard = newNetworkGuard()
+		defer h.guard.close()
+	}
 	modifiedVCLPath, err := h.prepareVCL(vclPath, backendAddresses)
 	if err != nil {
 		return nil, err
 	}
 
-	// 3. Start services with the modified VCL
-	if err := h.startServices(ctx, modifiedVCLPath, hasScenarioTests); err != nil {
+	// 3. Serve the modified VCL in-process for tests that opt in to simulation
+	if err := h.startSimulator(selected, modifiedVCLPath); err != nil {
 		return nil, err
 	}
-	defer h.stopServices() // Stop varnishd and recorder when done
+	defer h.stopSimulator()
+
+	// 4. Start services with the modified VCL, unless every test is simulated
+	if len(h.simulated) < len(selected) || h.cfg.DebugDump {
+		defer h.keepVarnishdLogs() // Before the work dir is removed
+		if err := h.startServices(ctx, modifiedVCLPath, hasScenarioTests); err != nil {
+			return nil, err
+		}
+		defer h.stopServices() // Stop varnishd and recorder when done
+
+		h.cfg.Events.Emit(eventstream.Event{
+			Type: eventstream.VarnishReady,
+			URL:  h.VarnishURL(),
+		})
+	} else {
+		h.logger.Debug("All tests are simulated, not starting varnishd")
+	}
 
 	// Run tests (VCL is already loaded at startup, no need for LoadVCL/UnloadVCL)
-	result := h.runTests(tests)
+	result := h.runTests(ctx, selected)
+	summary = result
+	if err := ctx.Err(); err != nil {
+		h.timer.begin("teardown")
+		return nil, fmt.Errorf("run interrupted after %d of %d tests: %w", len(result.Results), len(selected), err)
+	}
+	if !inline {
+		result.VCLPath = vclPath
+	}
+	if h.cfg.AfterTests != nil {
+		if h.har != nil {
+			h.har.BeginPage("after tests")
+		}
+		if err := h.cfg.AfterTests(ctx, h); err != nil {
+			h.timer.begin("teardown")
+			return nil, fmt.Errorf("after tests: %w", err)
+		}
+	}
+	if h.cfg.StrictBackends {
+		result.UnusedRoutes = unusedRoutes(selected, h.mockBackends)
+	}
+	if h.cfg.Chaos != nil {
+		h.timer.begin("chaos")
+		result.Chaos = h.runChaos(selected, result)
+	}
 
-	// Create debug dump if enabled
-	if h.cfg.DebugDump {
-		dumpPath, err := createDebugDump(
-			h.cfg.TestFile, vclPath, h.workDir, h.varnishDir,
-			h.testRunner, tests, result.Passed, result.Failed, h.logger,
-		)
-		if err != nil {
-			h.logger.Warn("Failed to create debug dump", "error", err)
+	if h.har != nil {
+		if err := h.har.WriteFile(h.cfg.HARFile, h.redactor); err != nil {
+			h.logger.Warn("Failed to write HAR file", "path", h.cfg.HARFile, "error", err)
 		} else {
-			result.DebugDumpPath = dumpPath
+			result.HARPath = h.cfg.HARFile
 		}
 	}
 
+	if err := afterSuite(); err != nil {
+		result.AfterSuiteError = err.Error()
+	}
+
+	result.DebugDumpPath = h.debugDump(vclPath, tests, result.Passed, result.Failed)
+
+	h.timer.begin("teardown")
 	return result, nil
 }
 
+// debugDump creates the debug dump if enabled and returns its path, or "" if
+// there is none
+func (h *Harness) debugDump(vclPath string, tests []testspec.TestSpec, passed, failed int) string {
+	if !h.cfg.DebugDump {
+		return ""
+	}
+	h.timer.begin("debug dump")
+	dumpPath, err := createDebugDump(
+		h.cfg.TestFile, vclPath, h.workDir, h.varnishDir,
+		h.testRunner, tests, passed, failed, h.redactor, h.logger,
+	)
+	if err != nil {
+		h.logger.Warn("Failed to create debug dump", "error", err)
+		return ""
+	}
+	return dumpPath
+}
+
+// wrapTransport returns the wrapper for the test client's transport: the HAR
+// recorder, if any, under the embedder's WrapTransport, so the HAR shows what
+// was sent. Nil if neither is set.
+func (h *Harness) wrapTransport() client.TransportWrapper {
+	if h.har == nil {
+		return h.cfg.WrapTransport
+	}
+	return func(base http.RoundTripper) http.RoundTripper {
+		rt := h.har.Wrap(base)
+		if h.cfg.WrapTransport != nil {
+			rt = h.cfg.WrapTransport(rt)
+		}
+		return rt
+	}
+}
+
+// resolveVCL returns the path of the VCL under test.
+// Priority: 1) VCL from stdin (-vcl -), 2) -vcl flag, 3) vcl_source in the
+// spec, 4) same-named .vcl file. Inline VCL is written to the work dir; since
+// it has no directory of its own, relative includes are not supported.
+func (h *Harness) resolveVCL(tests []testspec.TestSpec) (path string, inline bool, err error) {
+	source := h.cfg.VCLSource
+	if source == "" && h.cfg.VCLPath == "" {
+		source, err = testspec.InlineVCL(tests)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	if source == "" {
+		path, err = testspec.ResolveVCL(h.cfg.TestFile, h.cfg.VCLPath)
+		return path, false, err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(h.cfg.TestFile), filepath.Ext(h.cfg.TestFile))
+	path = filepath.Join(h.workDir, "source", base+".vcl")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", false, fmt.Errorf("creating inline VCL dir: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		return "", false, fmt.Errorf("writing inline VCL: %w", err)
+	}
+	return path, true, nil
+}
+
 // createTempDirs creates temporary directories for Varnish.
 func (h *Harness) createTempDirs() error {
 	var err error
@@ -161,6 +353,11 @@ func (h *Harness) stopServices() {
 		h.recorder.Stop()
 	}
 
+	// Drop pooled client connections, so varnishd has no sessions to wait for
+	if h.testRunner != nil {
+		h.testRunner.CloseIdleConnections()
+	}
+
 	// Cancel context to trigger varnishd shutdown.
 	// This kills the entire process group (manager + child) via SIGKILL.
 	// We don't use varnishadm "stop" command because it can timeout waiting
@@ -237,11 +434,16 @@ func (h *Harness) startServices(ctx context.Context, vclPath string, hasScenario
 		}
 	}()
 
+	// Both varnishd and varnishlog must be ready within the startup budget
+	budget := h.startupTimeout()
+	deadline := time.NewTimer(budget)
+	defer deadline.Stop()
+
 	// Wait for varnish to be ready and discover HTTP port
 	// debug.listen_address blocks until pool_accepting is true
-	h.logger.Debug("Waiting for Varnish to be ready...")
-	if err := h.waitForVarnishReady(ctx, errChan); err != nil {
-		return err
+	h.logger.Debug("Waiting for Varnish to be ready...", "startup_timeout", budget)
+	if err := h.waitForVarnishReady(ctx, errChan, deadline.C, budget); err != nil {
+		return withVarnishdOutput(err, h.workDir)
 	}
 	h.logger.Debug("Discovered HTTP port", "port", h.httpPort)
 
@@ -261,13 +463,29 @@ func (h *Harness) startServices(ctx context.Context, vclPath string, hasScenario
 		return fmt.Errorf("starting recorder: %w", err)
 	}
 
-	// Give varnishlog time to connect to VSM
-	time.Sleep(500 * time.Millisecond)
+	// Give varnishlog time to connect to VSM; it exits if it cannot
+	select {
+	case <-time.After(500 * time.Millisecond):
+	case <-deadline.C:
+		return withVarnishdOutput(h.startupTimeoutError("varnishlog", budget), h.workDir)
+	}
+	if exited, _ := h.recorder.Exited(); exited {
+		return withVarnishdOutput(fmt.Errorf("varnishlog exited during startup:\n%s%s",
+			h.startupState(), recorderOutput(h.recorder.GetOutputFile())), h.workDir)
+	}
 
 	// Create test runner with discovered HTTP port
-	varnishURL := fmt.Sprintf("http://127.0.0.1:%d", h.httpPort)
+	varnishURL := h.VarnishURL()
 	h.testRunner = runner.New(varnishadm, varnishURL, h.workDir, h.logger, h.recorder)
 	h.testRunner.SetTimeController(h.manager)
+	h.testRunner.SetCollectTraces(h.cfg.CollectTraces)
+	h.testRunner.SetCollectTimeline(h.cfg.Timeline)
+	h.testRunner.SetExplain(h.cfg.Explain)
+	h.testRunner.SetRedactor(h.redactor)
+	h.testRunner.SetTransportWrapper(h.wrapTransport())
+	if h.har != nil {
+		h.testRunner.SetExchangeRecorder(h.har.RecordExchange)
+	}
 
 	// Set mock backends on the runner (they were started before services)
 	if h.mockBackends != nil {
@@ -289,9 +507,12 @@ func (h *Harness) startServices(ctx context.Context, vclPath string, hasScenario
 // waitForVarnishReady waits for varnishd to be ready to accept HTTP connections.
 // It polls for varnishd crashes while waiting for debug.listen_address to succeed.
 // The debug.listen_address command blocks until pool_accepting is true.
-func (h *Harness) waitForVarnishReady(ctx context.Context, errChan <-chan error) error {
+// When deadline fires first, it fails with a report of how far startup got.
+func (h *Harness) waitForVarnishReady(ctx context.Context, errChan <-chan error, deadline <-chan time.Time, budget time.Duration) error {
 	// Check for early crash before attempting to get port
 	select {
+	case <-deadline:
+		return h.startupTimeoutError("varnishd", budget)
 	case err := <-errChan:
 		return fmt.Errorf("varnish failed to start: %w", err)
 	case <-time.After(100 * time.Millisecond):
@@ -314,6 +535,8 @@ func (h *Harness) waitForVarnishReady(ctx context.Context, errChan <-chan error)
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
+	case <-deadline:
+		return h.startupTimeoutError("varnishd", budget)
 	case err := <-errChan:
 		return fmt.Errorf("varnish failed to start: %w", err)
 	case err := <-portErrChan:
@@ -342,7 +565,11 @@ func (h *Harness) prepareVCL(vclPath string, backends map[string]vclmod.BackendA
 	h.logger.Debug("Preparing VCL with backend modifications", "path", vclPath)
 
 	// Process VCL with includes - walks the include tree and modifies each file
-	processedFiles, validationResult, err := vclmod.ProcessVCLWithIncludes(vclPath, backends)
+	var guard vclmod.GuardFunc
+	if h.guard != nil {
+		guard = h.guard.address
+	}
+	processedFiles, validationResult, err := vclmod.ProcessVCLWithGuard(vclPath, backends, guard)
 	if err != nil {
 		// Log validation errors
 		if validationResult != nil {
@@ -352,6 +579,14 @@ func (h *Harness) prepareVCL(vclPath string, backends map[string]vclmod.BackendA
 		}
 		return "", fmt.Errorf("processing VCL with includes: %w", err)
 	}
+	if h.guard != nil {
+		if h.guard.err != nil {
+			return "", h.guard.err
+		}
+		if names := h.guard.guardedNames(); names != "" {
+			h.logger.Debug("Network guard enabled", "backends", names)
+		}
+	}
 
 	// Log warnings about unused backends
 	if validationResult != nil {
@@ -360,6 +595,10 @@ func (h *Harness) prepareVCL(vclPath string, backends map[string]vclmod.BackendA
 		}
 	}
 
+	if h.cfg.EffectiveVCL != nil {
+		writeEffectiveVCL(h.cfg.EffectiveVCL, processedFiles)
+	}
+
 	// Use the vcl subdirectory of workDir - this is where Varnish's vcl_path points
 	// so relative includes will be resolved correctly
 	vclDir := filepath.Join(h.workDir, "vcl")
@@ -392,17 +631,39 @@ func (h *Harness) prepareVCL(vclPath string, backends map[string]vclmod.BackendA
 	return mainVCLFile, nil
 }
 
+// writeEffectiveVCL writes a diff of each original VCL file against its
+// backend-rewritten version, so users can see exactly what vclmod changed.
+func writeEffectiveVCL(w io.Writer, files []vclmod.ProcessedVCLFile) {
+	for _, file := range files {
+		original, err := os.ReadFile(file.AbsolutePath)
+		if err != nil {
+			fmt.Fprintf(w, "Effective VCL %s: reading original: %v\n\n", file.RelativePath, err)
+			continue
+		}
+		diff := formatter.UnifiedDiff(file.RelativePath+" (original)", file.RelativePath+" (effective)", string(original), file.Content)
+		if diff == "" {
+			fmt.Fprintf(w, "Effective VCL %s: unchanged\n\n", file.RelativePath)
+			continue
+		}
+		fmt.Fprintf(w, "Effective VCL %s:\n%s\n", file.RelativePath, diff)
+	}
+}
+
 // configureBackendsForTest updates mock backend configurations for a specific test.
 func (h *Harness) configureBackendsForTest(test testspec.TestSpec) {
 	for name, spec := range test.Backends {
 		if mock, ok := h.mockBackends[name]; ok {
 			cfg := backend.Config{
-				Status:      spec.Status,
-				Headers:     spec.Headers,
-				Body:        spec.Body,
-				FailureMode: spec.FailureMode,
-				Routes:      convertRoutes(spec.Routes),
-				EchoRequest: spec.EchoRequest,
+				Status:         spec.Status,
+				Headers:        spec.Headers,
+				Body:           spec.Body,
+				FailureMode:    spec.FailureMode,
+				Routes:         convertRoutes(spec.Routes),
+				EchoRequest:    spec.EchoRequest,
+				EchoConnection: spec.EchoConnection,
+				Generate:       spec.Generate.Generated(),
+				ServeDir:       spec.ServeDir,
+				Bandwidth:      int64(spec.Bandwidth),
 			}
 			if cfg.Status == 0 {
 				cfg.Status = 200
@@ -413,58 +674,242 @@ func (h *Harness) configureBackendsForTest(test testspec.TestSpec) {
 	}
 }
 
-// runTests executes all tests and collects results.
-func (h *Harness) runTests(tests []testspec.TestSpec) *Result {
-	result := &Result{
-		Total:   len(tests),
-		Results: make([]runner.TestResult, 0, len(tests)),
+// newRedactor creates a redactor for the union of header names listed in the
+// tests' redact fields, seeded with the values of those headers found in the
+// specs. Returns nil if no test asks for redaction.
+func newRedactor(tests []testspec.TestSpec) *redact.Redactor {
+	var names []string
+	for _, test := range tests {
+		names = append(names, test.Redact...)
+	}
+	r := redact.New(names)
+	if r == nil {
+		return nil
 	}
 
-	varnishadm := h.manager.GetVarnishadm()
+	addBackends := func(backends map[string]testspec.BackendSpec) {
+		for _, spec := range backends {
+			r.AddHeaders(spec.Headers)
+			for _, route := range spec.Routes {
+				r.AddHeaders(route.Headers)
+			}
+		}
+	}
+	for _, test := range tests {
+		r.AddHeaders(test.Request.Headers)
+		r.AddHeaders(test.Expectations.Response.Headers)
+		addBackends(test.Backends)
+		for _, step := range test.Scenario {
+			r.AddHeaders(step.Request.Headers)
+			r.AddHeaders(step.Expectations.Response.Headers)
+			addBackends(step.Backends)
+		}
+	}
+	return r
+}
 
+// filterTests returns the tests whose names are in only, preserving file order.
+// All tests are returned if only is empty.
+func filterTests(tests []testspec.TestSpec, only []string) []testspec.TestSpec {
+	if len(only) == 0 {
+		return tests
+	}
+	wanted := make(map[string]bool, len(only))
+	for _, name := range only {
+		wanted[name] = true
+	}
+	filtered := make([]testspec.TestSpec, 0, len(only))
 	for _, test := range tests {
+		if wanted[test.Name] {
+			filtered = append(filtered, test)
+		}
+	}
+	return filtered
+}
+
+// loadTests returns Config.Tests, or the tests of the test file
+func (h *Harness) loadTests() ([]testspec.TestSpec, error) {
+	if h.cfg.Tests != nil {
+		return h.cfg.Tests, nil
+	}
+	h.logger.Debug("Loading test file", "file", h.cfg.TestFile)
+	tests, err := testspec.Load(h.cfg.TestFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading test file: %w", err)
+	}
+	return tests, nil
+}
+
+// runTests executes all tests and collects results. Once ctx expires, the
+// remaining tests are skipped.
+func (h *Harness) runTests(ctx context.Context, tests []testspec.TestSpec) *Result {
+	result := &Result{
+		SchemaVersion: ResultSchemaVersion,
+		Total:         len(tests),
+		Results:       make([]runner.TestResult, 0, len(tests)),
+	}
+
+	for i, test := range tests {
+		if ctx.Err() != nil {
+			break
+		}
+		id := testspec.TestID(h.cfg.TestFile, test.Name)
+		h.cfg.Events.Emit(eventstream.Event{
+			Type:        eventstream.TestStart,
+			Test:        test.Name,
+			TestID:      id,
+			Index:       i + 1,
+			Owner:       test.Owner,
+			Link:        test.Link,
+			Description: test.Description,
+		})
+		start := time.Now()
+
+		h.timer.begin("test: " + test.Name)
+		testResult := h.runTest(i, test)
+		h.timer.end()
+		if testResult.Passed {
+			h.timer.note("passed")
+		} else {
+			h.timer.note("failed")
+		}
+		testResult.ID, testResult.Duration = id, time.Since(start)
+		testResult.Owner, testResult.Link, testResult.Description = test.Owner, test.Link, test.Description
+		h.redactor.Strings(testResult.Errors)
+		for j := range testResult.Failures {
+			testResult.Failures[j].Message = h.redactor.String(testResult.Failures[j].Message)
+		}
+		for _, step := range testResult.Explained {
+			for j := range step.Explanations {
+				e := &step.Explanations[j]
+				e.Expected, e.Derivation = h.redactor.String(e.Expected), h.redactor.String(e.Derivation)
+			}
+		}
+		if testResult.Passed {
+			result.Passed++
+		} else {
+			result.Failed++
+		}
+		result.Results = append(result.Results, *testResult)
+
+		h.emitTestEnd(i+1, testResult)
+	}
+
+	return result
+}
+
+// runTest runs the selected test at index i against the shared VCL, on
+// varnishd or the simulator. Harness-level errors are reported as a failed
+// result.
+func (h *Harness) runTest(i int, test testspec.TestSpec) *runner.TestResult {
+	if h.har != nil {
+		h.har.BeginPage(test.Name)
+	}
+
+	testRunner := h.simRunner
+	if !h.simulated[i] {
+		testRunner = h.testRunner
+
 		// Nuke the cache before each test to ensure clean state
 		h.logger.Debug("Nuking cache before test", "test", test.Name)
-		if _, err := varnishadm.BanNukeCache(); err != nil {
+		if _, err := h.manager.GetVarnishadm().BanNukeCache(); err != nil {
 			h.logger.Error("Failed to nuke cache before test", "test", test.Name, "error", err)
-			result.Failed++
-			result.Results = append(result.Results, runner.TestResult{
+			return &runner.TestResult{
 				TestName: test.Name,
 				Passed:   false,
 				Errors:   []string{fmt.Sprintf("failed to nuke cache: %v", err)},
-			})
-			continue
+			}
 		}
+	}
 
-		// Reconfigure backends for this specific test
-		h.configureBackendsForTest(test)
+	// Reconfigure backends for this specific test
+	h.configureBackendsForTest(test)
 
-		testResult, err := h.testRunner.RunTestWithSharedVCL(test)
-		if err != nil {
-			h.logger.Debug("Test failed with error", "test", test.Name, "error", err)
-			result.Failed++
-			result.Results = append(result.Results, runner.TestResult{
-				TestName: test.Name,
-				Passed:   false,
-				Errors:   []string{err.Error()},
-			})
-			continue
+	// Connections that arrive after a test ends are not blamed on the next one
+	if h.guard != nil {
+		if late := h.guard.take(); len(late) > 0 {
+			h.logger.Debug("Network guard blocked connections between tests", "count", len(late))
 		}
+	}
 
-		if testResult.Passed {
-			result.Passed++
-		} else {
-			result.Failed++
+	testResult, err := testRunner.RunTestWithSharedVCL(test)
+	if err != nil {
+		h.logger.Debug("Test failed with error", "test", test.Name, "error", err)
+		testResult = &runner.TestResult{
+			TestName: test.Name,
+			Passed:   false,
+			Errors:   []string{err.Error()},
 		}
-		result.Results = append(result.Results, *testResult)
 	}
+	if h.guard != nil {
+		h.guard.check(testResult)
+	}
+	return testResult
+}
 
-	return result
+// TraceInfo is what varnishlog recorded for a request made with Do
+type TraceInfo = runner.RequestTrace
+
+// Do makes a single request to the running Varnish, for Go code in
+// Config.AfterTests to mix its own assertions with the YAML tests. It
+// returns the response and the request's VSL trace: its records and the
+// VCL lines it executed. Nothing is checked, the cache is not cleared and
+// backends are as the last test left them.
+func (h *Harness) Do(ctx context.Context, req testspec.RequestSpec) (*client.Response, *TraceInfo, error) {
+	if h.testRunner == nil {
+		return nil, nil, fmt.Errorf("varnishd is not running (Do is available in Config.AfterTests, unless every test is simulated)")
+	}
+	return h.testRunner.Do(ctx, req)
+}
+
+// emitTestEnd emits assertion_failed for each error followed by test_end.
+// Scenario failures carry their step and simulated time as raw fields.
+func (h *Harness) emitTestEnd(index int, result *runner.TestResult) {
+	if len(result.Failures) > 0 {
+		for _, f := range result.Failures {
+			at := f.At.Seconds()
+			h.cfg.Events.Emit(eventstream.Event{
+				Type:      eventstream.AssertionFailed,
+				Test:      result.TestName,
+				TestID:    result.ID,
+				Index:     index,
+				Message:   f.String(),
+				Step:      f.Step,
+				AtSeconds: &at,
+			})
+		}
+	} else {
+		for _, msg := range result.Errors {
+			h.cfg.Events.Emit(eventstream.Event{
+				Type:    eventstream.AssertionFailed,
+				Test:    result.TestName,
+				TestID:  result.ID,
+				Index:   index,
+				Message: msg,
+			})
+		}
+	}
+	passed := result.Passed
+	h.cfg.Events.Emit(eventstream.Event{
+		Type:        eventstream.TestEnd,
+		Test:        result.TestName,
+		TestID:      result.ID,
+		Index:       index,
+		Owner:       result.Owner,
+		Link:        result.Link,
+		Description: result.Description,
+		Passed:      &passed,
+		DurationMS:  result.Duration.Milliseconds(),
+	})
 }
 
 // Cleanup releases resources. Call this if you need to stop early.
 func (h *Harness) Cleanup() {
+	h.stopSimulator()
 	h.stopServices()
 	stopAllBackends(h.mockBackends, h.logger)
+	if h.guard != nil {
+		h.guard.close()
+	}
 	h.cleanupTempDirs()
 }
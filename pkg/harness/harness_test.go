@@ -1,11 +1,29 @@
 package harness
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/perbu/vcltest/pkg/backend"
+	"github.com/perbu/vcltest/pkg/eventstream"
+	"github.com/perbu/vcltest/pkg/runner"
 	"github.com/perbu/vcltest/pkg/testspec"
+	"github.com/perbu/vcltest/pkg/vclmod"
 )
 
 func TestNew(t *testing.T) {
@@ -270,6 +288,29 @@ func TestResult(t *testing.T) {
 	}
 }
 
+func TestResult_JSON(t *testing.T) {
+	r := &Result{
+		SchemaVersion: ResultSchemaVersion,
+		Passed:        1,
+		Total:         1,
+		Results: []runner.TestResult{{
+			TestName: "home",
+			ID:       "abc123",
+			Duration: 1500 * time.Millisecond,
+			Passed:   true,
+		}},
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	want := `{"schema_version":1,"passed":1,"failed":0,"total":1,"results":[{"test_name":"home","id":"abc123","duration":1500000000,"passed":true}]}`
+	if string(data) != want {
+		t.Errorf("Marshal() = %s, want %s", data, want)
+	}
+}
+
 func TestConfig(t *testing.T) {
 	cfg := &Config{
 		TestFile:  "/path/to/test.yaml",
@@ -291,3 +332,761 @@ func TestConfig(t *testing.T) {
 		t.Error("DebugDump should be true")
 	}
 }
+
+func TestFilterTests(t *testing.T) {
+	tests := []testspec.TestSpec{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	if got := filterTests(tests, nil); len(got) != 3 {
+		t.Errorf("filterTests(nil) returned %d tests, want 3", len(got))
+	}
+
+	got := filterTests(tests, []string{"c", "a", "missing"})
+	if len(got) != 2 {
+		t.Fatalf("filterTests() returned %d tests, want 2", len(got))
+	}
+	if got[0].Name != "a" || got[1].Name != "c" {
+		t.Errorf("filterTests() = [%s %s], want file order [a c]", got[0].Name, got[1].Name)
+	}
+}
+
+func TestEmitTestEnd(t *testing.T) {
+	var buf bytes.Buffer
+	h := New(&Config{TestFile: "test.yaml", Events: eventstream.New(&buf)})
+
+	h.emitTestEnd(2, &runner.TestResult{
+		TestName: "cache miss",
+		ID:       "0123456789ab",
+		Duration: 15 * time.Millisecond,
+		Passed:   false,
+		Errors:   []string{"status: expected 200, got 503", "backend calls: expected 1, got 0"},
+		Owner:    "team-cache",
+		Link:     "https://tickets.example.com/CACHE-1",
+	})
+
+	var types []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var ev eventstream.Event
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("invalid event line %q: %v", line, err)
+		}
+		if ev.Test != "cache miss" || ev.TestID != "0123456789ab" || ev.Index != 2 {
+			t.Errorf("event %s has test=%q test_id=%q index=%d", ev.Type, ev.Test, ev.TestID, ev.Index)
+		}
+		if ev.Type == eventstream.TestEnd && (ev.Owner != "team-cache" || ev.Link != "https://tickets.example.com/CACHE-1" || ev.DurationMS != 15) {
+			t.Errorf("test_end has owner=%q link=%q duration_ms=%d", ev.Owner, ev.Link, ev.DurationMS)
+		}
+		types = append(types, ev.Type)
+	}
+
+	want := []string{eventstream.AssertionFailed, eventstream.AssertionFailed, eventstream.TestEnd}
+	if strings.Join(types, ",") != strings.Join(want, ",") {
+		t.Errorf("event types = %v, want %v", types, want)
+	}
+}
+
+func TestNewRedactor(t *testing.T) {
+	if r := newRedactor([]testspec.TestSpec{{Name: "plain"}}); r != nil {
+		t.Error("newRedactor() without redact fields should return nil")
+	}
+
+	tests := []testspec.TestSpec{
+		{
+			Name:    "login",
+			Redact:  []string{"Authorization"},
+			Request: testspec.RequestSpec{Headers: map[string]string{"Authorization": "Bearer token-one"}},
+		},
+		{
+			Name:   "session",
+			Redact: []string{"Set-Cookie"},
+			Scenario: []testspec.ScenarioStep{{
+				Backends: map[string]testspec.BackendSpec{
+					"default": {Headers: map[string]string{"Set-Cookie": "sid=cookie-two"}},
+				},
+			}},
+		},
+	}
+
+	r := newRedactor(tests)
+	got := r.String(`expected "Bearer token-one", backend sent "sid=cookie-two"`)
+	want := `expected "[REDACTED]", backend sent "[REDACTED]"`
+	if got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveVCL(t *testing.T) {
+	dir := t.TempDir()
+	testFile := filepath.Join(dir, "site.yaml")
+	fileVCL := filepath.Join(dir, "site.vcl")
+	if err := os.WriteFile(fileVCL, []byte("vcl 4.1; // file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inlineSpec := []testspec.TestSpec{{Name: "a", VCLSource: "vcl 4.1; // spec"}}
+
+	tests := []struct {
+		name       string
+		cfg        Config
+		specs      []testspec.TestSpec
+		wantSource string
+		wantInline bool
+	}{
+		{"same-named file", Config{}, []testspec.TestSpec{{Name: "a"}}, "vcl 4.1; // file", false},
+		{"vcl_source beats same-named file", Config{}, inlineSpec, "vcl 4.1; // spec", true},
+		{"-vcl flag beats vcl_source", Config{VCLPath: fileVCL}, inlineSpec, "vcl 4.1; // file", false},
+		{"stdin beats everything", Config{VCLPath: fileVCL, VCLSource: "vcl 4.1; // stdin"}, inlineSpec, "vcl 4.1; // stdin", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.TestFile = testFile
+			h := New(&cfg)
+			h.workDir = t.TempDir()
+
+			path, inline, err := h.resolveVCL(tt.specs)
+			if err != nil {
+				t.Fatalf("resolveVCL() error = %v", err)
+			}
+			if inline != tt.wantInline {
+				t.Errorf("resolveVCL() inline = %v, want %v", inline, tt.wantInline)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("reading resolved VCL: %v", err)
+			}
+			if string(data) != tt.wantSource {
+				t.Errorf("resolved VCL = %q, want %q", data, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestWriteEffectiveVCL(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := filepath.Join(dir, "main.vcl")
+	incPath := filepath.Join(dir, "inc.vcl")
+	if err := os.WriteFile(mainPath, []byte("vcl 4.1;\nbackend default {\n    .host = \"example.com\";\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(incPath, []byte("sub vcl_recv {\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writeEffectiveVCL(&buf, []vclmod.ProcessedVCLFile{
+		{AbsolutePath: mainPath, RelativePath: "main.vcl", Content: "vcl 4.1;\nbackend default {\n    .host = \"127.0.0.1\";\n}\n"},
+		{AbsolutePath: incPath, RelativePath: "inc.vcl", Content: "sub vcl_recv {\n}\n"},
+	})
+
+	out := buf.String()
+	for _, want := range []string{
+		"Effective VCL main.vcl:\n--- main.vcl (original)\n+++ main.vcl (effective)\n",
+		"-    .host = \"example.com\";\n+    .host = \"127.0.0.1\";\n",
+		"Effective VCL inc.vcl: unchanged\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestParseChaos(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    ChaosConfig
+		wantErr bool
+	}{
+		{"p=0.05", ChaosConfig{Probability: 0.05}, false},
+		{"p=1, iterations=20, seed=42", ChaosConfig{Probability: 1, Iterations: 20, Seed: 42}, false},
+		{"iterations=5", ChaosConfig{}, true},
+		{"p=0", ChaosConfig{}, true},
+		{"p=1.5", ChaosConfig{}, true},
+		{"p=abc", ChaosConfig{}, true},
+		{"p=0.1,iterations=0", ChaosConfig{}, true},
+		{"p=0.1,mode=reset", ChaosConfig{}, true},
+		{"0.05", ChaosConfig{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseChaos(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseChaos() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("ParseChaos() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChaosReport_Sensitive(t *testing.T) {
+	report := &ChaosReport{Tests: []ChaosTestResult{
+		{TestName: "robust", Faults: 3},
+		{TestName: "fragile", Failures: 2, Faults: 4},
+		{TestName: "broken", Skipped: true},
+	}}
+
+	sensitive := report.Sensitive()
+	if len(sensitive) != 1 || sensitive[0].TestName != "fragile" {
+		t.Errorf("Sensitive() = %+v, want only fragile", sensitive)
+	}
+}
+
+func TestRun_Simulated(t *testing.T) {
+	dir := t.TempDir()
+	vcl := `vcl 4.1;
+backend default { .host = "127.0.0.1"; .port = "8080"; }
+backend api { .host = "127.0.0.1"; .port = "8081"; }
+
+sub vcl_recv {
+	if (req.url ~ "^/api/") {
+		set req.backend_hint = api;
+	}
+	if (req.url == "/blocked") {
+		return (synth(403, "Forbidden"));
+	}
+}
+
+sub vcl_deliver {
+	set resp.http.X-Route = req.url;
+}
+`
+	spec := `name: API is routed
+engine: simulated
+request:
+  url: /api/users
+backends:
+  default:
+    status: 200
+  api:
+    status: 200
+    body: users
+expectations:
+  response:
+    status: 200
+    body_contains: users
+    headers:
+      X-Route: /api/users
+  backend:
+    used: api
+---
+name: Blocked
+engine: simulated
+request:
+  url: /blocked
+expectations:
+  response:
+    status: 403
+  backend:
+    calls: 0
+---
+name: Wrong expectation
+engine: simulated
+request:
+  url: /
+expectations:
+  response:
+    status: 404
+`
+	testFile := filepath.Join(dir, "routing.yaml")
+	if err := os.WriteFile(filepath.Join(dir, "routing.vcl"), []byte(vcl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(testFile, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(&Config{TestFile: testFile, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	result, err := h.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if result.Passed != 2 || result.Failed != 1 {
+		t.Errorf("Run() passed %d, failed %d, want 2 and 1: %+v", result.Passed, result.Failed, result.Results)
+	}
+	if h.manager != nil {
+		t.Error("varnishd was started although every test is simulated")
+	}
+
+	var phases []string
+	for _, phase := range h.Phases() {
+		phases = append(phases, phase.Name+" "+phase.Note)
+	}
+	want := []string{"startup ", "test: API is routed passed", "test: Blocked passed", "test: Wrong expectation failed", "teardown "}
+	if !slices.Equal(phases, want) {
+		t.Errorf("Phases() = %q, want %q", phases, want)
+	}
+}
+
+func TestStartSimulator_DuplicateNames(t *testing.T) {
+	dir := t.TempDir()
+	vclPath := filepath.Join(dir, "same.vcl")
+	vcl := "vcl 4.1;\nbackend default { .host = \"127.0.0.1\"; .port = \"8080\"; }\n"
+	if err := os.WriteFile(vclPath, []byte(vcl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []testspec.TestSpec{
+		{Name: "Same", Engine: testspec.EngineSimulated, Request: testspec.RequestSpec{URL: "/"}},
+		{Name: "Same", Engine: testspec.EngineSimulated, Request: testspec.RequestSpec{URL: "/"}, Expectations: testspec.ExpectationsSpec{Cache: &testspec.CacheExpectations{}}},
+		{Name: "Same", Request: testspec.RequestSpec{URL: "/"}},
+	}
+
+	h := New(&Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	h.workDir = dir
+	if err := h.startSimulator(tests, vclPath); err != nil {
+		t.Fatalf("startSimulator() error = %v", err)
+	}
+	defer h.stopSimulator()
+
+	// Only the first test can be simulated; the others share its name
+	if want := map[int]bool{0: true}; !maps.Equal(h.simulated, want) {
+		t.Errorf("simulated = %v, want %v", h.simulated, want)
+	}
+}
+
+func TestRun_ExplainRedacted(t *testing.T) {
+	dir := t.TempDir()
+	vcl := `vcl 4.1;
+backend default { .host = "127.0.0.1"; .port = "8080"; }
+
+sub vcl_deliver {
+	set resp.http.X-Api-Key = "s3cret-key";
+	set resp.http.X-Session = "s3cret-session";
+}
+`
+	spec := `name: Keys are not shown
+engine: simulated
+redact: [X-Api-Key, X-Session]
+request:
+  url: /
+backends:
+  default:
+    status: 200
+expectations:
+  response:
+    status: 200
+    headers:
+      X-Api-Key: s3cret-key
+      X-Session: other
+`
+	testFile := filepath.Join(dir, "redact.yaml")
+	if err := os.WriteFile(filepath.Join(dir, "redact.vcl"), []byte(vcl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(testFile, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(&Config{TestFile: testFile, Explain: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	result, err := h.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if len(result.Results) != 1 || len(result.Results[0].Explained) == 0 {
+		t.Fatalf("Run() results = %+v, want one test with explanations", result.Results)
+	}
+	out, err := json.Marshal(result.Results[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"s3cret-key", "s3cret-session"} {
+		if strings.Contains(string(out), secret) {
+			t.Errorf("result contains %q: %s", secret, out)
+		}
+	}
+	if !strings.Contains(string(out), "X-Api-Key") {
+		t.Errorf("result should still name the header: %s", out)
+	}
+}
+
+func TestPhaseTimer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := phaseTimer{ctx: ctx}
+	timer.begin("startup")
+	timer.begin("test: slow")
+	cancel()
+	timer.begin("teardown")
+	timer.end()
+	timer.end() // No current phase
+
+	var got []string
+	for _, phase := range timer.phases {
+		got = append(got, fmt.Sprintf("%s interrupted=%v", phase.Name, phase.Interrupted))
+	}
+	want := []string{"startup interrupted=false", "test: slow interrupted=true", "teardown interrupted=false"}
+	if !slices.Equal(got, want) {
+		t.Errorf("phases = %q, want %q", got, want)
+	}
+}
+
+func TestRun_NetworkGuard(t *testing.T) {
+	dir := t.TempDir()
+	vcl := `vcl 4.1;
+probe health { .url = "/"; }
+backend default { .host = "127.0.0.1"; .port = "8080"; }
+backend analytics {
+	.host = "analytics.example.com";
+	.port = "80";
+	.probe = health;
+}
+
+sub vcl_recv {
+	if (req.url ~ "^/track") {
+		set req.backend_hint = analytics;
+	}
+}
+`
+	spec := `name: Page
+engine: simulated
+request:
+  url: /
+backends:
+  default:
+    status: 200
+expectations:
+  response:
+    status: 200
+---
+name: Tracking
+engine: simulated
+request:
+  url: /track
+expectations:
+  response:
+    status: 503
+`
+	testFile := filepath.Join(dir, "guard.yaml")
+	if err := os.WriteFile(filepath.Join(dir, "guard.vcl"), []byte(vcl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(testFile, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(&Config{TestFile: testFile, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	result, err := h.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if !result.Results[0].Passed {
+		t.Errorf("Page: want pass, got %v", result.Results[0].Errors)
+	}
+	tracking := result.Results[1]
+	if tracking.Passed || len(tracking.Errors) != 1 ||
+		!strings.Contains(tracking.Errors[0], `Backend "analytics" is not mocked`) ||
+		!strings.Contains(tracking.Errors[0], "analytics.example.com:80") {
+		t.Errorf("Tracking: want a network guard failure, got passed=%v %v", tracking.Passed, tracking.Errors)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	vcl := `vcl 4.1;
+backend default { .host = "127.0.0.1"; .port = "8080"; }
+
+sub vcl_recv {
+	if (req.url ~ "^/private") {
+		return (pass);
+	}
+}
+`
+	spec := `name: Cached page
+request:
+  url: /page
+expectations:
+  response:
+    status: 200
+---
+name: Private pages are not cached
+scenario:
+  - at: 0s
+    request:
+      url: /private
+    expectations:
+      response:
+        status: 200
+  - at: 30s
+    request:
+      url: /private
+    expectations:
+      response:
+        status: 200
+`
+	testFile := filepath.Join(dir, "plan.yaml")
+	if err := os.WriteFile(filepath.Join(dir, "plan.vcl"), []byte(vcl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(testFile, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(&Config{TestFile: testFile, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	plan, err := h.DryRun(context.Background())
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if h.manager != nil || h.mockBackends != nil {
+		t.Error("DryRun() started varnishd or backends")
+	}
+	if !plan.Varnishd || !plan.FakeTime || len(plan.Tests) != 2 {
+		t.Fatalf("DryRun() = %+v", plan)
+	}
+	if !reflect.DeepEqual(plan.Backends, []string{"default"}) {
+		t.Errorf("Backends = %v, want [default]", plan.Backends)
+	}
+	wantSteps := []PlanStep{{At: "0s", Method: "GET", URL: "/private"}, {At: "30s", Method: "GET", URL: "/private"}}
+	if !reflect.DeepEqual(plan.Tests[1].Steps, wantSteps) {
+		t.Errorf("Steps = %+v, want %+v", plan.Tests[1].Steps, wantSteps)
+	}
+
+	// A syntax error fails the dry run
+	broken := strings.Replace(vcl, `"^/private")`, `"^/private"`, 1)
+	if err := os.WriteFile(filepath.Join(dir, "plan.vcl"), []byte(broken), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(&Config{TestFile: testFile, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}).DryRun(context.Background()); err == nil {
+		t.Error("DryRun() with a VCL syntax error succeeded")
+	}
+}
+
+func TestDo_NotRunning(t *testing.T) {
+	h := New(&Config{TestFile: "test.yaml", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if _, _, err := h.Do(context.Background(), testspec.RequestSpec{URL: "/"}); err == nil || !strings.Contains(err.Error(), "varnishd is not running") {
+		t.Errorf("Do() error = %v, want varnishd is not running", err)
+	}
+}
+
+func TestStartupState(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "_.vsm_mgt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := New(&Config{StartupTimeout: 15 * time.Second, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	h.workDir, h.varnishDir = dir, dir
+	if got := h.startupTimeout(); got != 15*time.Second {
+		t.Errorf("startupTimeout() = %s, want 15s", got)
+	}
+
+	err := h.startupTimeoutError("varnishd", h.startupTimeout())
+	want := "varnishd not ready within 15s (-startup-timeout):\n" +
+		"  varnishd: not started\n" +
+		"  child: varnishd has not reported a child process\n" +
+		"  CLI: varnishd has not connected\n" +
+		"  VSM: _.vsm_mgt present, _.vsm_child missing\n" +
+		"  HTTP port: not bound (debug.listen_address has not answered)\n" +
+		"  varnishlog: not started"
+	if err.Error() != want {
+		t.Errorf("startupTimeoutError() =\n%s\nwant\n%s", err, want)
+	}
+
+	state := startupState{
+		Process:      "running (pid 42)",
+		CLIConnected: true,
+		RecentCLI:    []string{">>> 0 debug.listen_address"},
+		HTTPAddr:     "127.0.0.1:8080",
+		Recorder:     "exited: exit status 1",
+	}
+	for _, line := range []string{"CLI: connected", "last CLI exchanges:\n    >>> 0 debug.listen_address", "HTTP port: 127.0.0.1:8080 accepting connections", "varnishlog: exited: exit status 1"} {
+		if !strings.Contains(state.String(), line) {
+			t.Errorf("startupState.String() missing %q:\n%s", line, state)
+		}
+	}
+
+	if got := New(&Config{}).startupTimeout(); got != DefaultStartupTimeout {
+		t.Errorf("default startupTimeout() = %s, want %s", got, DefaultStartupTimeout)
+	}
+}
+
+func TestRun_Hooks(t *testing.T) {
+	dir := t.TempDir()
+	vcl := "vcl 4.1;\nbackend default { .host = \"127.0.0.1\"; .port = \"8080\"; }\n"
+	spec := `name: Simulated
+engine: simulated
+request:
+  url: /
+backends:
+  default:
+    status: 200
+expectations:
+  response:
+    status: 200
+`
+	testFile := filepath.Join(dir, "hooks.yaml")
+	if err := os.WriteFile(filepath.Join(dir, "hooks.vcl"), []byte(vcl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(testFile, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		hooks        testspec.HooksSpec
+		debugDump    bool
+		wantErr      string
+		wantAfterErr string
+		wantTrace    string
+	}{
+		{
+			name:      "before and after",
+			hooks:     testspec.HooksSpec{BeforeSuite: []string{"echo before >> trace"}, AfterSuite: []string{"echo after >> trace"}},
+			wantTrace: "before\nafter\n",
+		},
+		{
+			name:      "failing before_suite aborts but cleans up",
+			hooks:     testspec.HooksSpec{BeforeSuite: []string{"echo before >> trace", "echo no redis; exit 3", "echo skipped >> trace"}, AfterSuite: []string{"echo after >> trace"}},
+			wantErr:   "before_suite hook \"echo no redis; exit 3\" failed: exit status 3\noutput:\n  no redis",
+			wantTrace: "before\nafter\n",
+		},
+		{
+			name:      "failing before_suite is in the debug dump",
+			hooks:     testspec.HooksSpec{BeforeSuite: []string{"echo no redis; exit 3"}, AfterSuite: []string{"echo after >> trace"}},
+			debugDump: true,
+			wantErr:   "debug artifacts saved to: ",
+			wantTrace: "after\n",
+		},
+		{
+			name:         "failing after_suite fails the run but keeps the results",
+			hooks:        testspec.HooksSpec{AfterSuite: []string{"echo after >> trace", "false"}},
+			wantAfterErr: "after_suite hook \"false\" failed",
+			wantTrace:    "after\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trace := filepath.Join(dir, "trace")
+			os.Remove(trace)
+			var events bytes.Buffer
+			h := New(&Config{TestFile: testFile, Hooks: &tt.hooks, DebugDump: tt.debugDump, Events: eventstream.New(&events), Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+			result, err := h.Run(context.Background())
+
+			// suite_end is the last event, also when the run fails
+			lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+			var end eventstream.Event
+			if jerr := json.Unmarshal([]byte(lines[len(lines)-1]), &end); jerr != nil || end.Type != eventstream.SuiteEnd {
+				t.Fatalf("last event = %s, want suite_end", lines[len(lines)-1])
+			}
+			if (end.Error != "") != (tt.wantErr != "" || tt.wantAfterErr != "") || end.Total != 1 {
+				t.Errorf("suite_end = %+v, want error only when the run fails", end)
+			}
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+				}
+				if tt.debugDump {
+					dumpDir := err.Error()[strings.LastIndex(err.Error(), " ")+1:]
+					defer os.RemoveAll(dumpDir)
+					hooksLog, _ := os.ReadFile(filepath.Join(dumpDir, hooksLogFile))
+					if !strings.Contains(string(hooksLog), "no redis") {
+						t.Errorf("dumped hooks log = %q, want the before_suite output", hooksLog)
+					}
+				}
+			} else if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			} else if result.Passed != 1 {
+				t.Errorf("Run() passed %d, want 1", result.Passed)
+			} else if !strings.Contains(result.AfterSuiteError, tt.wantAfterErr) || (result.AfterSuiteError == "") != (tt.wantAfterErr == "") {
+				t.Errorf("Run() AfterSuiteError = %q, want %q", result.AfterSuiteError, tt.wantAfterErr)
+			}
+			got, _ := os.ReadFile(trace)
+			if string(got) != tt.wantTrace {
+				t.Errorf("hooks ran %q, want %q", got, tt.wantTrace)
+			}
+		})
+	}
+}
+
+func TestUnusedRoutes(t *testing.T) {
+	routes := func(keys ...string) map[string]testspec.RouteSpec {
+		m := make(map[string]testspec.RouteSpec)
+		for _, key := range keys {
+			m[key] = testspec.RouteSpec{Status: 200}
+		}
+		return m
+	}
+	tests := []testspec.TestSpec{
+		{Name: "products", Backends: map[string]testspec.BackendSpec{"api": {Routes: routes("/products/{id}", "/legacy")}}},
+		{Name: "legacy again", Backends: map[string]testspec.BackendSpec{"api": {Routes: routes("/legacy")}}},
+		{Name: "scenario", Scenario: []testspec.ScenarioStep{
+			{At: new(testspec.Duration), Backends: map[string]testspec.BackendSpec{"images": {Routes: routes("/logo.png")}}},
+		}},
+	}
+
+	mocks := make(map[string]*backend.MockBackend)
+	for _, name := range []string{"api", "images"} {
+		mocks[name] = backend.New(backend.Config{Status: 200, Routes: map[string]backend.RouteConfig{
+			"/products/{id}": {Status: 200}, "/legacy": {Status: 200}, "/logo.png": {Status: 200},
+		}})
+		addr, err := mocks[name].Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer mocks[name].Stop()
+		if name == "api" {
+			resp, err := http.Get("http://" + addr + "/products/7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	want := []UnusedRoute{
+		{Backend: "api", Route: "/legacy", Tests: []string{"products", "legacy again"}},
+		{Backend: "images", Route: "/logo.png", Tests: []string{"scenario"}},
+	}
+	if got := unusedRoutes(tests, mocks); !reflect.DeepEqual(got, want) {
+		t.Errorf("unusedRoutes() = %+v, want %+v", got, want)
+	}
+}
+
+func TestExpose(t *testing.T) {
+	varnishd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer varnishd.Close()
+
+	h := New(&Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Expose(context.Background(), listener); err == nil || !strings.Contains(err.Error(), "varnishd is not running") {
+		t.Errorf("Expose() without varnishd error = %v, want varnishd is not running", err)
+	}
+
+	h.httpPort = varnishd.Listener.Addr().(*net.TCPAddr).Port
+	if got, want := h.VarnishURL(), varnishd.URL; got != want {
+		t.Errorf("VarnishURL() = %q, want %q", got, want)
+	}
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	exposed := make(chan error, 1)
+	go func() { exposed <- h.Expose(ctx, listener) }()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/page")
+	if err != nil {
+		t.Fatalf("request through exposed address: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello /page" {
+		t.Errorf("body = %q, want %q", body, "hello /page")
+	}
+
+	cancel()
+	select {
+	case err := <-exposed:
+		if err != nil {
+			t.Errorf("Expose() = %v, want nil after cancel", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expose() did not return after cancel")
+	}
+}
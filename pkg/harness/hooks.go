@@ -0,0 +1,85 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// hooksLogFile is the file in the work dir that captures hook output
+const hooksLogFile = "hooks.log"
+
+// hookOutputLines is how much of a failing hook's output its error shows
+const hookOutputLines = 10
+
+// suiteHooks returns the hooks to run: Config.Hooks, or those of the tests
+func (h *Harness) suiteHooks(tests []testspec.TestSpec) (*testspec.HooksSpec, error) {
+	if h.cfg.Hooks != nil {
+		return h.cfg.Hooks, nil
+	}
+	hooks, err := testspec.SuiteHooks(tests)
+	if err != nil || hooks == nil {
+		return &testspec.HooksSpec{}, err
+	}
+	return hooks, nil
+}
+
+// runHooks runs the commands of a hook stage in order with sh -c, from the
+// test file's directory, stopping at the first that fails. Their output is
+// appended to hooks.log in the work dir.
+func (h *Harness) runHooks(ctx context.Context, stage string, commands []string) error {
+	if len(commands) == 0 {
+		return nil
+	}
+	log, err := os.OpenFile(filepath.Join(h.workDir, hooksLogFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening hooks log: %w", err)
+	}
+	defer log.Close()
+
+	dir := ""
+	if h.cfg.TestFile != "" {
+		dir = filepath.Dir(h.cfg.TestFile)
+	}
+	for _, command := range commands {
+		h.logger.Debug("Running hook", "stage", stage, "command", command)
+		var output bytes.Buffer
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Dir = dir
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		runErr := cmd.Run()
+
+		status := "ok"
+		if runErr != nil {
+			status = runErr.Error()
+		}
+		fmt.Fprintf(log, "=== %s: %s\n%s--- %s\n", stage, command, output.Bytes(), status)
+		if runErr != nil {
+			return fmt.Errorf("%s hook %q failed: %w%s", stage, command, runErr, hookOutput(output.String()))
+		}
+	}
+	return nil
+}
+
+// hookOutput returns the last lines of a hook's output, indented under a
+// heading, or "" if it printed nothing
+func hookOutput(output string) string {
+	output = strings.TrimRight(output, "\n")
+	if strings.TrimSpace(output) == "" {
+		return ""
+	}
+	lines := strings.Split(output, "\n")
+	var b strings.Builder
+	b.WriteString("\noutput:")
+	for _, line := range lines[max(0, len(lines)-hookOutputLines):] {
+		fmt.Fprintf(&b, "\n  %s", line)
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package harness
+
+import (
+	"context"
+	"time"
+)
+
+// Phase is a timed part of a run: startup, one test, chaos, teardown, ...
+type Phase struct {
+	Name     string
+	Duration time.Duration
+	Note     string // Outcome, e.g. "passed" or "failed" for tests
+
+	// Interrupted is set on the phase that was running when the run's
+	// context expired (e.g. -suite-timeout)
+	Interrupted bool
+}
+
+// phaseTimer records consecutive phases of a run
+type phaseTimer struct {
+	ctx         context.Context
+	phases      []Phase
+	current     string
+	start       time.Time
+	interrupted bool // A phase was already marked as interrupted
+}
+
+// begin ends the current phase, if any, and starts the next
+func (t *phaseTimer) begin(name string) {
+	t.end()
+	t.current, t.start = name, time.Now()
+}
+
+// end ends the current phase, if any
+func (t *phaseTimer) end() {
+	if t.current == "" {
+		return
+	}
+	phase := Phase{Name: t.current, Duration: time.Since(t.start)}
+	if t.ctx != nil && t.ctx.Err() != nil && !t.interrupted {
+		phase.Interrupted, t.interrupted = true, true
+	}
+	t.phases = append(t.phases, phase)
+	t.current = ""
+}
+
+// note sets the outcome of the last ended phase
+func (t *phaseTimer) note(note string) {
+	if len(t.phases) > 0 {
+		t.phases[len(t.phases)-1].Note = note
+	}
+}
+
+// Phases returns where the time of the last Run went, in order. It is
+// complete once Run has returned, including when Run failed or its context
+// expired.
+func (h *Harness) Phases() []Phase {
+	return h.timer.phases
+}
@@ -0,0 +1,83 @@
+package harness
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/perbu/vcltest/pkg/runner"
+	"github.com/perbu/vcltest/pkg/simulator"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// startSimulator serves the prepared VCL with the in-process simulator if any
+// test opts in with engine: simulated. Tests whose VCL or features the
+// simulator cannot handle run on varnishd instead, and the reason is logged.
+// The simulated tests are recorded in h.simulated by their index in tests,
+// as names need not be unique.
+func (h *Harness) startSimulator(tests []testspec.TestSpec, vclPath string) error {
+	var wanted []int
+	for i, test := range tests {
+		if test.Engine == testspec.EngineSimulated {
+			wanted = append(wanted, i)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	if h.cfg.CollectTraces || h.cfg.Timeline {
+		h.logger.Info("Running simulated tests on varnishd", "reason", "VSL is being collected")
+		return nil
+	}
+
+	// Backend addresses are already rewritten in the prepared VCL
+	engine, err := simulator.Compile(vclPath, nil, h.logger)
+	if err != nil {
+		h.logger.Info("Running simulated tests on varnishd", "reason", err)
+		return nil
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		engine.Close()
+		return fmt.Errorf("starting simulator: %w", err)
+	}
+	h.simulator = engine
+	h.simServer = &http.Server{Handler: engine}
+	server := h.simServer
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	h.simRunner = runner.New(nil, "http://"+listener.Addr().String(), h.workDir, h.logger, nil)
+	h.simRunner.SetMockBackends(h.mockBackends)
+	h.simRunner.SetRedactor(h.redactor)
+	h.simRunner.SetExplain(h.cfg.Explain)
+	h.simRunner.SetTransportWrapper(h.wrapTransport())
+	h.simRunner.SetVCLShowResult(nil) // Loaded, without a trace source
+
+	h.simulated = make(map[int]bool)
+	for _, i := range wanted {
+		if err := simulator.CheckTest(tests[i]); err != nil {
+			h.logger.Info("Running simulated test on varnishd", "test", tests[i].Name, "reason", err)
+			continue
+		}
+		h.simulated[i] = true
+	}
+	h.logger.Debug("Simulator started", "address", listener.Addr().String(), "tests", len(h.simulated))
+	return nil
+}
+
+// stopSimulator stops the simulator if it was started
+func (h *Harness) stopSimulator() {
+	if h.simRunner != nil {
+		h.simRunner.CloseIdleConnections()
+	}
+	if h.simServer != nil {
+		_ = h.simServer.Close()
+		h.simServer = nil
+	}
+	if h.simulator != nil {
+		h.simulator.Close()
+		h.simulator = nil
+	}
+}
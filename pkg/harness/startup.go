@@ -0,0 +1,141 @@
+package harness
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/varnish"
+)
+
+// vsmDirs are the shared memory directories varnishd creates in its -n
+// directory: the manager's, then the child's once it runs
+var vsmDirs = []string{"_.vsm_mgt", "_.vsm_child"}
+
+// startupState is how far startup got, reported when it runs out of time
+type startupState struct {
+	Process      string   // varnishd process state
+	ChildEvent   string   // Last child process line varnishd printed
+	CLIConnected bool     // varnishd connected and authenticated to the CLI
+	RecentCLI    []string // Last CLI exchanges
+	VSM          map[string]bool
+	HTTPAddr     string // Listen address, empty if debug.listen_address never answered
+	HTTPErr      error  // Error connecting to HTTPAddr
+	Recorder     string // varnishlog state
+}
+
+func (s startupState) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "  varnishd: %s\n", s.Process)
+	child := s.ChildEvent
+	if child == "" {
+		child = "varnishd has not reported a child process"
+	}
+	fmt.Fprintf(&b, "  child: %s\n", child)
+	if s.CLIConnected {
+		b.WriteString("  CLI: connected\n")
+	} else {
+		b.WriteString("  CLI: varnishd has not connected\n")
+	}
+	if len(s.RecentCLI) > 0 {
+		b.WriteString("  last CLI exchanges:\n")
+		for _, line := range s.RecentCLI {
+			fmt.Fprintf(&b, "    %s\n", line)
+		}
+	}
+	var vsm []string
+	for _, dir := range vsmDirs {
+		if s.VSM[dir] {
+			vsm = append(vsm, dir+" present")
+		} else {
+			vsm = append(vsm, dir+" missing")
+		}
+	}
+	fmt.Fprintf(&b, "  VSM: %s\n", strings.Join(vsm, ", "))
+	switch {
+	case s.HTTPAddr == "":
+		b.WriteString("  HTTP port: not bound (debug.listen_address has not answered)\n")
+	case s.HTTPErr != nil:
+		fmt.Fprintf(&b, "  HTTP port: %s not accepting connections: %v\n", s.HTTPAddr, s.HTTPErr)
+	default:
+		fmt.Fprintf(&b, "  HTTP port: %s accepting connections\n", s.HTTPAddr)
+	}
+	fmt.Fprintf(&b, "  varnishlog: %s", s.Recorder)
+	return b.String()
+}
+
+// startupTimeout returns the startup budget
+func (h *Harness) startupTimeout() time.Duration {
+	if h.cfg.StartupTimeout > 0 {
+		return h.cfg.StartupTimeout
+	}
+	return DefaultStartupTimeout
+}
+
+// startupState collects how far startup got
+func (h *Harness) startupState() startupState {
+	state := startupState{
+		Process:    "not started",
+		ChildEvent: varnish.LastChildEvent(h.workDir),
+		VSM:        make(map[string]bool),
+		Recorder:   "not started",
+	}
+	if h.manager != nil {
+		state.Process = h.manager.GetVarnishManager().ProcessState()
+		state.CLIConnected, state.RecentCLI = h.manager.CLIState()
+	}
+	for _, dir := range vsmDirs {
+		if info, err := os.Stat(filepath.Join(h.varnishDir, dir)); err == nil && info.IsDir() {
+			state.VSM[dir] = true
+		}
+	}
+	if h.httpPort != 0 {
+		state.HTTPAddr = fmt.Sprintf("127.0.0.1:%d", h.httpPort)
+		conn, err := net.DialTimeout("tcp", state.HTTPAddr, time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		state.HTTPErr = err
+	}
+	if h.recorder != nil {
+		state.Recorder = "running"
+		switch exited, err := h.recorder.Exited(); {
+		case exited && err != nil:
+			state.Recorder = fmt.Sprintf("exited: %v", err)
+		case exited:
+			state.Recorder = "exited"
+		}
+	}
+	return state
+}
+
+// startupTimeoutError reports what was not ready when the startup budget ran out
+func (h *Harness) startupTimeoutError(what string, budget time.Duration) error {
+	return fmt.Errorf("%s not ready within %s (-startup-timeout):\n%s", what, budget, h.startupState())
+}
+
+// recorderOutputLines is how much of varnishlog's output a startup failure shows
+const recorderOutputLines = 10
+
+// recorderOutput returns the last lines varnishlog wrote to path, under a
+// heading, or "" if it wrote nothing
+func recorderOutput(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	text := strings.TrimRight(string(data), "\n")
+	if strings.TrimSpace(text) == "" {
+		return ""
+	}
+	lines := strings.Split(text, "\n")
+	var b strings.Builder
+	b.WriteString("\nvarnishlog output:")
+	for _, line := range lines[max(0, len(lines)-recorderOutputLines):] {
+		fmt.Fprintf(&b, "\n  %s", line)
+	}
+	return b.String()
+}
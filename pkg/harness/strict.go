@@ -0,0 +1,58 @@
+package harness
+
+import (
+	"slices"
+	"sort"
+
+	"github.com/perbu/vcltest/pkg/backend"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// UnusedRoute is a declared backend route that no request matched
+type UnusedRoute struct {
+	Backend string   `json:"backend"`
+	Route   string   `json:"route"`
+	Tests   []string `json:"tests"` // Tests that declare the route, in run order
+}
+
+// unusedRoutes returns the routes the tests declare, in their backends or
+// scenario step overrides, that their mock backend never matched, sorted by
+// backend and route
+func unusedRoutes(tests []testspec.TestSpec, mocks map[string]*backend.MockBackend) []UnusedRoute {
+	type routeKey struct{ backend, route string }
+	declared := make(map[routeKey][]string)
+	declare := func(test string, backends map[string]testspec.BackendSpec) {
+		for name, spec := range backends {
+			for route := range spec.Routes {
+				key := routeKey{name, route}
+				if !slices.Contains(declared[key], test) {
+					declared[key] = append(declared[key], test)
+				}
+			}
+		}
+	}
+	for _, test := range tests {
+		declare(test.Name, test.Backends)
+		for _, step := range test.Scenario {
+			declare(test.Name, step.Backends)
+		}
+	}
+
+	hits := make(map[string]map[string]int)
+	for name, mock := range mocks {
+		hits[name] = mock.RouteHits()
+	}
+	var unused []UnusedRoute
+	for key, names := range declared {
+		if hits[key.backend][key.route] == 0 {
+			unused = append(unused, UnusedRoute{Backend: key.backend, Route: key.route, Tests: names})
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		if unused[i].Backend != unused[j].Backend {
+			return unused[i].Backend < unused[j].Backend
+		}
+		return unused[i].Route < unused[j].Route
+	})
+	return unused
+}
@@ -0,0 +1,191 @@
+// Package history records the results of test runs and merges them into a
+// trend report, to manage flaky and regressing tests across CI runs.
+//
+// Tests are identified by their stable ID (see testspec.TestID), so a renamed
+// test starts a new history while a test moved within its file keeps its own.
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/runner"
+)
+
+// runVersion is bumped whenever the results file format changes incompatibly
+const runVersion = 1
+
+// Run is the results file of one test run (-results-json)
+type Run struct {
+	Version  int       `json:"version"`
+	TestFile string    `json:"test_file"`
+	Commit   string    `json:"commit,omitempty"`
+	Started  time.Time `json:"started"`
+	Tests    []TestRun `json:"tests"`
+}
+
+// TestRun is the outcome of one test in a run
+type TestRun struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Passed     bool     `json:"passed"`
+	DurationMS int64    `json:"duration_ms"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// NewRun creates a run record from test results
+func NewRun(testFile, commit string, started time.Time, results []runner.TestResult) *Run {
+	run := &Run{Version: runVersion, TestFile: testFile, Commit: commit, Started: started.UTC()}
+	for _, r := range results {
+		run.Tests = append(run.Tests, TestRun{
+			ID:         r.ID,
+			Name:       r.TestName,
+			Passed:     r.Passed,
+			DurationMS: r.Duration.Milliseconds(),
+			Errors:     r.Errors,
+		})
+	}
+	return run
+}
+
+// Load reads a results file
+func Load(path string) (*Run, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading results: %w", err)
+	}
+	var run Run
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, fmt.Errorf("parsing results %s: %w", path, err)
+	}
+	if run.Version != runVersion {
+		return nil, fmt.Errorf("results %s have version %d, expected %d", path, run.Version, runVersion)
+	}
+	return &run, nil
+}
+
+// Save writes the run to path
+func (r *Run) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling results: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("writing results: %w", err)
+	}
+	return nil
+}
+
+// DetectCommit returns the commit under test: from common CI environment
+// variables, else from git in dir. Returns "" if neither is available.
+func DetectCommit(dir string) string {
+	for _, name := range []string{"GITHUB_SHA", "CI_COMMIT_SHA", "BUILDKITE_COMMIT", "GIT_COMMIT"} {
+		if sha := os.Getenv(name); sha != "" {
+			return sha
+		}
+	}
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Trend is one test's history across runs, oldest run first
+type Trend struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"` // Name in the latest run
+	Runs        int     `json:"runs"`
+	Passed      int     `json:"passed"`
+	PassRate    float64 `json:"pass_rate"`
+	Flips       int     `json:"flips"` // Transitions between passing and failing
+	LastPassed  bool    `json:"last_passed"`
+	DurationsMS []int64 `json:"durations_ms"`
+
+	// FirstFailedCommit is the commit of the first run in the current failure
+	// streak; empty when the latest run passed
+	FirstFailedCommit string `json:"first_failed_commit,omitempty"`
+}
+
+// Flaky reports whether the test went back and forth between passing and
+// failing, rather than breaking once
+func (t *Trend) Flaky() bool {
+	return t.Flips >= 2
+}
+
+// AvgDurationMS returns the mean duration over all runs
+func (t *Trend) AvgDurationMS() int64 {
+	if len(t.DurationsMS) == 0 {
+		return 0
+	}
+	var sum int64
+	for _, d := range t.DurationsMS {
+		sum += d
+	}
+	return sum / int64(len(t.DurationsMS))
+}
+
+// Report is the merged history of several runs
+type Report struct {
+	Runs  int       `json:"runs"`
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Tests []*Trend  `json:"tests"` // Failing first, then by pass rate, then by name
+}
+
+// Merge combines runs into a trend report. Runs are ordered by start time.
+func Merge(runs []*Run) *Report {
+	runs = append([]*Run(nil), runs...)
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+
+	report := &Report{Runs: len(runs)}
+	if len(runs) > 0 {
+		report.From, report.To = runs[0].Started, runs[len(runs)-1].Started
+	}
+
+	trends := make(map[string]*Trend)
+	for _, run := range runs {
+		for _, test := range run.Tests {
+			trend, ok := trends[test.ID]
+			if !ok {
+				trend = &Trend{ID: test.ID}
+				trends[test.ID] = trend
+				report.Tests = append(report.Tests, trend)
+			}
+			if trend.Runs > 0 && test.Passed != trend.LastPassed {
+				trend.Flips++
+			}
+			if !test.Passed && (trend.Runs == 0 || trend.LastPassed) {
+				trend.FirstFailedCommit = run.Commit
+			}
+			trend.Name = test.Name
+			trend.Runs++
+			if test.Passed {
+				trend.Passed++
+				trend.FirstFailedCommit = ""
+			}
+			trend.LastPassed = test.Passed
+			trend.DurationsMS = append(trend.DurationsMS, test.DurationMS)
+		}
+	}
+
+	for _, trend := range report.Tests {
+		trend.PassRate = float64(trend.Passed) / float64(trend.Runs)
+	}
+	sort.SliceStable(report.Tests, func(i, j int) bool {
+		a, b := report.Tests[i], report.Tests[j]
+		if a.LastPassed != b.LastPassed {
+			return !a.LastPassed
+		}
+		if a.PassRate != b.PassRate {
+			return a.PassRate < b.PassRate
+		}
+		return a.Name < b.Name
+	})
+	return report
+}
@@ -0,0 +1,74 @@
+package history
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/runner"
+)
+
+func TestSaveLoad(t *testing.T) {
+	started := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	run := NewRun("tests.yaml", "abc123", started, []runner.TestResult{
+		{TestName: "hit", ID: "aaaaaaaaaaaa", Passed: true, Duration: 12 * time.Millisecond},
+		{TestName: "miss", ID: "bbbbbbbbbbbb", Errors: []string{"status: expected 200, got 503"}},
+	})
+	path := filepath.Join(t.TempDir(), "results.json")
+	if err := run.Save(path); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded, run) {
+		t.Errorf("Load() = %+v, want %+v", loaded, run)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 0, 0, 0, 0, time.UTC) }
+	run := func(d int, commit string, tests ...TestRun) *Run {
+		return &Run{Version: runVersion, Commit: commit, Started: day(d), Tests: tests}
+	}
+	pass := func(id string, ms int64) TestRun {
+		return TestRun{ID: id, Name: "test " + id, Passed: true, DurationMS: ms}
+	}
+	fail := func(id string, ms int64) TestRun { return TestRun{ID: id, Name: "test " + id, DurationMS: ms} }
+
+	// Given out of order: Merge sorts by start time
+	report := Merge([]*Run{
+		run(3, "c3", pass("stable", 10), fail("broken", 30), fail("flaky", 5)),
+		run(1, "c1", pass("stable", 10), pass("broken", 10), fail("flaky", 5)),
+		run(2, "c2", pass("stable", 20), pass("broken", 20), pass("flaky", 5)),
+		run(4, "c4", pass("stable", 20), fail("broken", 40), pass("flaky", 5)),
+	})
+
+	if report.Runs != 4 || !report.From.Equal(day(1)) || !report.To.Equal(day(4)) {
+		t.Errorf("report covers %d runs from %v to %v", report.Runs, report.From, report.To)
+	}
+
+	var order []string
+	for _, trend := range report.Tests {
+		order = append(order, trend.ID)
+	}
+	if want := []string{"broken", "flaky", "stable"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+
+	broken, flaky, stable := report.Tests[0], report.Tests[1], report.Tests[2]
+	if broken.FirstFailedCommit != "c3" || broken.PassRate != 0.5 || broken.Flaky() {
+		t.Errorf("broken = %+v, want first failed at c3, pass rate 0.5, not flaky", broken)
+	}
+	if !reflect.DeepEqual(broken.DurationsMS, []int64{10, 20, 30, 40}) || broken.AvgDurationMS() != 25 {
+		t.Errorf("broken durations = %v (avg %d)", broken.DurationsMS, broken.AvgDurationMS())
+	}
+	if !flaky.Flaky() || flaky.Flips != 3 || flaky.FirstFailedCommit != "" {
+		t.Errorf("flaky = %+v, want 3 flips and no current failure", flaky)
+	}
+	if stable.PassRate != 1 || stable.Flips != 0 {
+		t.Errorf("stable = %+v", stable)
+	}
+}
@@ -0,0 +1,274 @@
+// Package impact maps VCL changes to the tests that exercise them.
+//
+// A full test run records which VCL blocks each test entered. Changed lines
+// from a git diff are later mapped onto those blocks, so only tests whose
+// executed blocks intersect the change need to be re-run.
+//
+// Blocks are identified structurally (see coverage.IndexBlocks) rather than by
+// line number, because the VCL loaded into varnishd is re-rendered by vclmod
+// and its line numbers do not match the original files.
+package impact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/perbu/vcltest/pkg/coverage"
+	"github.com/perbu/vcltest/pkg/runner"
+)
+
+// cacheVersion is bumped whenever the cache format changes incompatibly
+const cacheVersion = 2
+
+// ErrCacheVersion is returned by Load for a cache written in another format
+var ErrCacheVersion = errors.New("coverage cache has an unsupported version")
+
+// Cache holds per-test block coverage from the last full run
+type Cache struct {
+	Version int    `json:"version"`
+	VCLPath string `json:"vcl_path"`
+
+	// Commit is the git commit checked out when the cache was recorded,
+	// empty outside a git repository
+	Commit string `json:"commit,omitempty"`
+
+	// Files maps VCL paths (relative to the main VCL directory) to their block layout
+	Files map[string]*FileBlocks `json:"files"`
+
+	// Tests maps test name -> VCL file -> IDs of blocks the test entered
+	Tests map[string]map[string][]string `json:"tests"`
+}
+
+// FileBlocks is the block layout of one original (unmodified) VCL file
+type FileBlocks struct {
+	SHA256 string       `json:"sha256"` // Hash of the file the layout was taken from
+	Blocks []BlockRange `json:"blocks"`
+}
+
+// BlockRange is a block's structural ID and its line span in the original file
+type BlockRange struct {
+	ID         string `json:"id"`
+	ParentID   string `json:"parent,omitempty"`
+	HeaderLine int    `json:"header"`
+	OpenBrace  int    `json:"open"`
+	CloseBrace int    `json:"close"`
+}
+
+// DefaultCachePath returns the cache location used when none is given:
+// a hidden file next to the test file, e.g. tests.yaml -> .tests.coverage.json
+func DefaultCachePath(testFile string) string {
+	base := strings.TrimSuffix(filepath.Base(testFile), filepath.Ext(testFile))
+	return filepath.Join(filepath.Dir(testFile), "."+base+".coverage.json")
+}
+
+// Build creates a cache from test results that carry VCL traces.
+// Block line spans are taken from the original VCL files on disk, resolved
+// relative to the directory of vclPath.
+func Build(vclPath string, results []runner.TestResult) (*Cache, error) {
+	vclDir := filepath.Dir(vclPath)
+	cache := &Cache{
+		Version: cacheVersion,
+		VCLPath: vclPath,
+		Commit:  GitHead(vclDir),
+		Files:   make(map[string]*FileBlocks),
+		Tests:   make(map[string]map[string][]string),
+	}
+
+	for _, result := range results {
+		if result.VCLTrace == nil {
+			// No trace (e.g. harness error) - leave the test out so it is always re-run
+			continue
+		}
+
+		entered := make(map[string][]string)
+		for _, file := range result.VCLTrace.Files {
+			if file.RelativePath == "" || file.Blocks == nil {
+				continue
+			}
+
+			if _, ok := cache.Files[file.RelativePath]; !ok {
+				layout, err := analyzeOriginal(filepath.Join(vclDir, file.RelativePath))
+				if err != nil {
+					return nil, err
+				}
+				cache.Files[file.RelativePath] = layout
+			}
+
+			ids := make([]string, 0)
+			for _, ib := range file.Blocks.IndexBlocks() {
+				if ib.Block.Entered {
+					ids = append(ids, ib.ID)
+				}
+			}
+			entered[file.RelativePath] = ids
+		}
+		cache.Tests[result.TestName] = entered
+	}
+
+	return cache, nil
+}
+
+// analyzeOriginal reads a VCL file and returns its block layout
+func analyzeOriginal(path string) (*FileBlocks, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading VCL file: %w", err)
+	}
+	fb, err := coverage.AnalyzeVCL(string(source), path)
+	if err != nil {
+		return nil, fmt.Errorf("analyzing %s: %w", path, err)
+	}
+
+	layout := &FileBlocks{SHA256: hashSource(source)}
+	for _, ib := range fb.IndexBlocks() {
+		layout.Blocks = append(layout.Blocks, BlockRange{
+			ID:         ib.ID,
+			ParentID:   ib.ParentID,
+			HeaderLine: ib.Block.HeaderLine,
+			OpenBrace:  ib.Block.OpenBrace,
+			CloseBrace: ib.Block.CloseBrace,
+		})
+	}
+	return layout, nil
+}
+
+// Load reads a cache file
+func Load(path string) (*Cache, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading coverage cache: %w", err)
+	}
+
+	var cache Cache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, fmt.Errorf("parsing coverage cache %s: %w", path, err)
+	}
+	if cache.Version != cacheVersion {
+		return nil, fmt.Errorf("%w: %s has version %d, expected %d (re-run the full suite to refresh it)", ErrCacheVersion, path, cache.Version, cacheVersion)
+	}
+
+	return &cache, nil
+}
+
+// Save writes the cache to path
+func (c *Cache) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling coverage cache: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing coverage cache: %w", err)
+	}
+	return nil
+}
+
+// hashSource returns the hex SHA-256 of a VCL file's contents
+func hashSource(source []byte) string {
+	sum := sha256.Sum256(source)
+	return hex.EncodeToString(sum[:])
+}
+
+// Stale returns the first cached VCL file whose contents at git revision rev
+// differ from the sources the cache was recorded from, or "" if they all
+// match. Changed lines from a diff against rev can only be mapped onto the
+// cached block layout when none is stale. dir is the main VCL directory.
+func (c *Cache) Stale(dir, rev string) (string, error) {
+	for _, path := range c.FilePaths() {
+		source, err := GitShow(dir, rev, path)
+		if err != nil {
+			return "", err
+		}
+		if source == nil || hashSource(source) != c.Files[path].SHA256 {
+			return path, nil
+		}
+	}
+	return "", nil
+}
+
+// FilePaths returns the VCL files known to the cache, sorted
+func (c *Cache) FilePaths() []string {
+	paths := make([]string, 0, len(c.Files))
+	for path := range c.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// HasTest reports whether coverage was recorded for the named test
+func (c *Cache) HasTest(name string) bool {
+	_, ok := c.Tests[name]
+	return ok
+}
+
+// Affected returns the names of tests whose entered blocks intersect the
+// changed lines (file -> line numbers in the cached version of the file).
+//
+// runAll is true when a change cannot be attributed to blocks: it touches a
+// file the cache does not know, or a line outside any subroutine (backend,
+// acl, import, ...). Callers should then run the whole suite.
+func (c *Cache) Affected(changes map[string][]int) (names []string, runAll bool) {
+	affected := make(map[string]bool)
+
+	for file, lines := range changes {
+		layout, ok := c.Files[file]
+		if !ok {
+			return nil, true
+		}
+
+		for _, line := range lines {
+			block := layout.deepestBlockAt(line)
+			if block == nil {
+				return nil, true
+			}
+
+			// A change in a block's header (e.g. an if condition) matters to every
+			// test that evaluated it, i.e. every test that entered the parent.
+			required := block.ID
+			if line <= block.OpenBrace && block.ParentID != "" {
+				required = block.ParentID
+			}
+
+			for name, files := range c.Tests {
+				for _, id := range files[file] {
+					if id == required {
+						affected[name] = true
+						break
+					}
+				}
+			}
+		}
+	}
+
+	names = make([]string, 0, len(affected))
+	for name := range affected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, false
+}
+
+// deepestBlockAt returns the most nested block whose span contains line
+func (fb *FileBlocks) deepestBlockAt(line int) *BlockRange {
+	var deepest *BlockRange
+	// Blocks are stored depth-first, so containing blocks form a chain
+	// and the last match is the most nested one.
+	for i := range fb.Blocks {
+		b := &fb.Blocks[i]
+		start := b.HeaderLine
+		if b.OpenBrace < start {
+			start = b.OpenBrace
+		}
+		if line >= start && line <= b.CloseBrace {
+			deepest = b
+		}
+	}
+	return deepest
+}
@@ -0,0 +1,123 @@
+package impact
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hunkHeader matches unified diff hunk headers: @@ -a[,b] +c[,d] @@
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+\d+(?:,\d+)? @@`)
+
+// GitDiff returns the lines changed in the given VCL files since a git revision.
+// dir is the main VCL directory; paths are relative to it. Line numbers are in
+// the coordinates of the file at revision since (see ParseDiff).
+func GitDiff(dir, since string, paths []string) (map[string][]int, error) {
+	args := []string{"-C", dir, "diff", "--unified=0", "--no-color", "--no-ext-diff",
+		"--relative", "--src-prefix=a/", "--dst-prefix=b/", since, "--"}
+	args = append(args, paths...)
+
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff %s: %w: %s", since, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return ParseDiff(bytes.NewReader(out))
+}
+
+// GitHead returns the commit checked out in dir, or "" if dir is not in a
+// git repository
+func GitHead(dir string) string {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// GitShow returns the contents of path (relative to dir) at git revision
+// rev, or nil if the file does not exist at rev
+func GitShow(dir, rev, path string) ([]byte, error) {
+	if err := exec.Command("git", "-C", dir, "cat-file", "-e", rev+":./"+path).Run(); err != nil {
+		if err := exec.Command("git", "-C", dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}").Run(); err != nil {
+			return nil, fmt.Errorf("git revision %s not found in %s", rev, dir)
+		}
+		return nil, nil
+	}
+	cmd := exec.Command("git", "-C", dir, "show", rev+":./"+path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git show %s:%s: %w: %s", rev, path, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// ParseDiff parses `git diff --unified=0` output and returns changed line
+// numbers per file, in the coordinates of the old version of each file.
+// Pure insertions are reported as the lines on either side of the insertion
+// point. Files that are new in the diff are reported with no lines.
+func ParseDiff(r io.Reader) (map[string][]int, error) {
+	changes := make(map[string][]int)
+	var current string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "--- "):
+			current = ""
+			if path, ok := strings.CutPrefix(line, "--- a/"); ok {
+				current = path
+			}
+		case strings.HasPrefix(line, "+++ "):
+			// New file: there is no old version, so key it by the new path
+			if current == "" {
+				if path, ok := strings.CutPrefix(line, "+++ b/"); ok {
+					changes[path] = nil
+				}
+			}
+		case strings.HasPrefix(line, "@@ "):
+			if current == "" {
+				continue
+			}
+			m := hunkHeader.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("invalid hunk header: %q", line)
+			}
+			start, _ := strconv.Atoi(m[1])
+			count := 1
+			if m[2] != "" {
+				count, _ = strconv.Atoi(m[2])
+			}
+
+			if count == 0 {
+				// Insertion after line start: the new code sits between start and start+1
+				if start > 0 {
+					changes[current] = append(changes[current], start)
+				}
+				changes[current] = append(changes[current], start+1)
+				continue
+			}
+			for l := start; l < start+count; l++ {
+				changes[current] = append(changes[current], l)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading diff: %w", err)
+	}
+
+	return changes, nil
+}
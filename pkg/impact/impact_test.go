@@ -0,0 +1,183 @@
+package impact
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDiff(t *testing.T) {
+	diff := `diff --git a/main.vcl b/main.vcl
+index 1111111..2222222 100644
+--- a/main.vcl
++++ b/main.vcl
+@@ -10 +10 @@ sub vcl_recv {
+-        return (pass);
++        return (hash);
+@@ -20,2 +20,0 @@ sub vcl_deliver {
+-    unset resp.http.X-A;
+-    unset resp.http.X-B;
+@@ -30,0 +29,1 @@ sub vcl_deliver {
++    set resp.http.X-C = "1";
+diff --git a/new.vcl b/new.vcl
+new file mode 100644
+--- /dev/null
++++ b/new.vcl
+@@ -0,0 +1,3 @@
++sub vcl_hit {
++    return (deliver);
++}
+`
+	changes, err := ParseDiff(strings.NewReader(diff))
+	if err != nil {
+		t.Fatalf("ParseDiff() error = %v", err)
+	}
+
+	want := map[string][]int{
+		"main.vcl": {10, 20, 21, 30, 31},
+		"new.vcl":  nil,
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("ParseDiff() = %v, want %v", changes, want)
+	}
+}
+
+func TestCache_Affected(t *testing.T) {
+	// Layout of:
+	//  3 sub vcl_recv {
+	//  4     if (req.url == "/a") {
+	//  5         return (pass);
+	//  6     }
+	//  7     return (hash);
+	//  8 }
+	//  9
+	// 10 sub vcl_deliver {
+	// 11     set resp.http.X = "1";
+	// 12 }
+	cache := &Cache{
+		Version: cacheVersion,
+		Files: map[string]*FileBlocks{
+			"main.vcl": {Blocks: []BlockRange{
+				{ID: "vcl_recv#0", HeaderLine: 3, OpenBrace: 3, CloseBrace: 8},
+				{ID: "vcl_recv#0/0", ParentID: "vcl_recv#0", HeaderLine: 4, OpenBrace: 4, CloseBrace: 6},
+				{ID: "vcl_deliver#0", HeaderLine: 10, OpenBrace: 10, CloseBrace: 12},
+			}},
+		},
+		Tests: map[string]map[string][]string{
+			"takes branch": {"main.vcl": {"vcl_recv#0", "vcl_recv#0/0"}},
+			"skips branch": {"main.vcl": {"vcl_recv#0", "vcl_deliver#0"}},
+			"synth only":   {"main.vcl": {}},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		changes    map[string][]int
+		wantNames  []string
+		wantRunAll bool
+	}{
+		{
+			name:      "change inside branch body",
+			changes:   map[string][]int{"main.vcl": {5}},
+			wantNames: []string{"takes branch"},
+		},
+		{
+			name:      "change to branch condition affects all tests entering the parent",
+			changes:   map[string][]int{"main.vcl": {4}},
+			wantNames: []string{"skips branch", "takes branch"},
+		},
+		{
+			name:      "change in vcl_deliver",
+			changes:   map[string][]int{"main.vcl": {11}},
+			wantNames: []string{"skips branch"},
+		},
+		{
+			name:       "change outside any sub runs everything",
+			changes:    map[string][]int{"main.vcl": {1}},
+			wantRunAll: true,
+		},
+		{
+			name:       "unknown file runs everything",
+			changes:    map[string][]int{"other.vcl": {1}},
+			wantRunAll: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, runAll := cache.Affected(tt.changes)
+			if runAll != tt.wantRunAll {
+				t.Fatalf("Affected() runAll = %v, want %v", runAll, tt.wantRunAll)
+			}
+			if tt.wantRunAll {
+				return
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("Affected() = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestDefaultCachePath(t *testing.T) {
+	got := DefaultCachePath("/suite/tests.yaml")
+	if got != "/suite/.tests.coverage.json" {
+		t.Errorf("DefaultCachePath() = %q, want %q", got, "/suite/.tests.coverage.json")
+	}
+}
+
+func TestCache_Stale(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found in PATH")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	recorded := "vcl 4.1;\nsub vcl_recv {\n    return (hash);\n}\n"
+	git("init", "-q")
+	if err := os.WriteFile(filepath.Join(dir, "main.vcl"), []byte(recorded), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "main.vcl")
+	git("commit", "-q", "-m", "recorded")
+	if err := os.WriteFile(filepath.Join(dir, "main.vcl"), []byte(strings.Replace(recorded, "hash", "pass", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("commit", "-q", "-am", "changed")
+
+	cache := &Cache{Files: map[string]*FileBlocks{"main.vcl": {SHA256: hashSource([]byte(recorded))}}}
+	tests := []struct {
+		name    string
+		rev     string
+		want    string
+		wantErr bool
+	}{
+		{name: "recorded commit", rev: "HEAD~1"},
+		{name: "later commit", rev: "HEAD", want: "main.vcl"},
+		{name: "unknown revision", rev: "nope", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cache.Stale(dir, tt.rev)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Stale() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Stale() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	cache.Files["gone.vcl"] = &FileBlocks{}
+	if got, err := cache.Stale(dir, "HEAD~1"); err != nil || got != "gone.vcl" {
+		t.Errorf("Stale() with a file missing at the revision = %q, %v, want gone.vcl", got, err)
+	}
+}
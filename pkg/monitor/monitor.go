@@ -0,0 +1,102 @@
+// Package monitor checks invariants against live Varnish traffic. It reads
+// transactions from varnishlog (read-only), samples them, and evaluates each
+// invariant's expectations with the same assertion engine tests use.
+package monitor
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+
+	"github.com/perbu/vcltest/pkg/assertion"
+	"github.com/perbu/vcltest/pkg/client"
+)
+
+// Options configures a monitoring run
+type Options struct {
+	// SampleRate is the fraction of transactions checked (0 means all)
+	SampleRate float64
+
+	// MaxTransactions stops after this many sampled transactions (0 means no limit)
+	MaxTransactions int
+
+	// OnViolation is called for every violation as it is found
+	OnViolation func(Violation)
+}
+
+// Violation is a transaction that broke an invariant
+type Violation struct {
+	Invariant   string
+	Transaction *Transaction
+	Errors      []string
+}
+
+// InvariantStats counts the transactions an invariant was checked against
+type InvariantStats struct {
+	Name       string
+	Checked    int
+	Violations int
+}
+
+// Report summarizes a monitoring run
+type Report struct {
+	Seen       int // Client transactions read
+	Sampled    int // Transactions checked against the invariants
+	Invariants []InvariantStats
+}
+
+// Violations returns the total number of violations
+func (r *Report) Violations() int {
+	total := 0
+	for _, inv := range r.Invariants {
+		total += inv.Violations
+	}
+	return total
+}
+
+// Run checks transactions read from vsl (`varnishlog -g request` output)
+// against the invariants in spec until vsl ends, ctx is done, or
+// opts.MaxTransactions is reached.
+func Run(ctx context.Context, spec *Spec, vsl io.Reader, opts Options) (*Report, error) {
+	report := &Report{Invariants: make([]InvariantStats, len(spec.Invariants))}
+	for i, inv := range spec.Invariants {
+		report.Invariants[i].Name = inv.Name
+	}
+
+	err := ReadTransactions(vsl, func(tx *Transaction) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		report.Seen++
+		if opts.SampleRate > 0 && opts.SampleRate < 1 && rand.Float64() >= opts.SampleRate {
+			return true
+		}
+		report.Sampled++
+
+		for i := range spec.Invariants {
+			if errs := Check(&spec.Invariants[i], tx); errs != nil {
+				report.Invariants[i].Checked++
+				if len(errs) > 0 {
+					report.Invariants[i].Violations++
+					if opts.OnViolation != nil {
+						opts.OnViolation(Violation{Invariant: spec.Invariants[i].Name, Transaction: tx, Errors: errs})
+					}
+				}
+			}
+		}
+
+		return opts.MaxTransactions <= 0 || report.Sampled < opts.MaxTransactions
+	})
+	return report, err
+}
+
+// Check evaluates inv against tx. Returns nil if the invariant does not
+// apply to tx, and an empty slice if it holds.
+func Check(inv *Invariant, tx *Transaction) []string {
+	if !inv.Matches(tx) {
+		return nil
+	}
+	response := &client.Response{Status: tx.Status, Headers: tx.RespHeaders}
+	result := assertion.Check(inv.Expect, response, tx.BackendCalls, nil, nil)
+	return result.Errors
+}
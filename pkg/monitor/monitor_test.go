@@ -0,0 +1,225 @@
+package monitor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// vsl is `varnishlog -g request` output: a passed checkout request that
+// opened a backend connection, a cache hit with HSTS, and a background fetch
+const vsl = `*   << Request  >> 32770
+-   Begin          req 32769 rxreq
+-   ReqStart       127.0.0.1 52100 a0
+-   ReqMethod      POST
+-   ReqURL         /checkout/pay
+-   ReqProtocol    HTTP/1.1
+-   ReqHeader      Host: shop.example.com
+-   ReqHeader      User-Agent: curl/8.0
+-   VCL_call       RECV
+-   ReqURL         /rewritten
+-   ReqHeader      X-Added: in-vcl
+-   VCL_return     pass
+-   RespProtocol   HTTP/1.1
+-   RespStatus     200
+-   RespHeader     X-Varnish: 32770
+-   RespHeader     Age: 0
+-   RespHeader     Set-Cookie: session=abc
+-   RespHeader     X-Internal: secret
+-   RespUnset      X-Internal: secret
+-   End
+**  << BeReq    >> 32771
+--  Begin          bereq 32770 pass
+--  BackendOpen    26 boot.default 127.0.0.1 8080 127.0.0.1 52102 connect
+--  End
+
+*   << Request  >> 32772
+-   Begin          req 32769 rxreq
+-   ReqMethod      GET
+-   ReqURL         /checkout/cart
+-   ReqHeader      Host: shop.example.com
+-   VCL_call       RECV
+-   RespStatus     200
+-   RespHeader     X-Varnish: 32772 32768
+-   RespHeader     Age: 12
+-   RespHeader     Strict-Transport-Security: max-age=31536000
+-   End
+
+*   << BeReq    >> 32774
+-   Begin          bereq 32773 bgfetch
+-   BackendOpen    26 default 127.0.0.1 8080 127.0.0.1 52104 connect
+-   End
+
+`
+
+func TestReadTransactions(t *testing.T) {
+	var txs []*Transaction
+	err := ReadTransactions(strings.NewReader(vsl), func(tx *Transaction) bool {
+		txs = append(txs, tx)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("ReadTransactions() error = %v", err)
+	}
+	if len(txs) != 2 {
+		t.Fatalf("got %d transactions, want 2", len(txs))
+	}
+
+	tx := txs[0]
+	if tx.VXID != "32770" || tx.Method != "POST" || tx.URL != "/checkout/pay" || tx.Status != 200 {
+		t.Errorf("first transaction = %s %s %s %d, want 32770 POST /checkout/pay 200", tx.VXID, tx.Method, tx.URL, tx.Status)
+	}
+	if got := tx.ReqHeaders.Get("Host"); got != "shop.example.com" {
+		t.Errorf("Host = %q, want shop.example.com", got)
+	}
+	if got := tx.ReqHeaders.Get("X-Added"); got != "" {
+		t.Errorf("X-Added = %q, want it excluded (set in VCL)", got)
+	}
+	if got := tx.RespHeaders.Get("X-Internal"); got != "" {
+		t.Errorf("X-Internal = %q, want it unset", got)
+	}
+	if got := tx.RespHeaders.Get("Set-Cookie"); got != "session=abc" {
+		t.Errorf("Set-Cookie = %q, want session=abc", got)
+	}
+	if tx.BackendCalls["default"] != 1 {
+		t.Errorf("BackendCalls = %v, want default=1", tx.BackendCalls)
+	}
+
+	if txs[1].URL != "/checkout/cart" || len(txs[1].BackendCalls) != 0 {
+		t.Errorf("second transaction = %s %v, want /checkout/cart without backend calls", txs[1].URL, txs[1].BackendCalls)
+	}
+}
+
+func TestReadTransactions_Stop(t *testing.T) {
+	count := 0
+	err := ReadTransactions(strings.NewReader(vsl), func(tx *Transaction) bool {
+		count++
+		return false
+	})
+	if err != nil {
+		t.Fatalf("ReadTransactions() error = %v", err)
+	}
+	if count != 1 {
+		t.Errorf("fn called %d times, want 1", count)
+	}
+}
+
+func TestRun(t *testing.T) {
+	spec := loadSpec(t, `invariants:
+  - name: Never cache checkout
+    match:
+      url: ^/checkout
+    expect:
+      cache:
+        hit: false
+  - name: Always HSTS
+    expect:
+      response:
+        headers:
+          Strict-Transport-Security: max-age=31536000
+  - name: No cookies on GET
+    match:
+      method: GET
+      host: ^shop\.
+    expect:
+      response:
+        headers:
+          Set-Cookie: ""
+  - name: POSTs pass to default
+    match:
+      method: POST
+    expect:
+      response:
+        status: 200
+      backend:
+        used: default
+`)
+
+	var violations []Violation
+	report, err := Run(context.Background(), spec, strings.NewReader(vsl), Options{
+		OnViolation: func(v Violation) { violations = append(violations, v) },
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if report.Seen != 2 || report.Sampled != 2 {
+		t.Errorf("Seen/Sampled = %d/%d, want 2/2", report.Seen, report.Sampled)
+	}
+	want := []InvariantStats{
+		{"Never cache checkout", 2, 1},
+		{"Always HSTS", 2, 1},
+		{"No cookies on GET", 1, 0},
+		{"POSTs pass to default", 1, 0},
+	}
+	for i, w := range want {
+		if report.Invariants[i] != w {
+			t.Errorf("Invariants[%d] = %+v, want %+v", i, report.Invariants[i], w)
+		}
+	}
+	if report.Violations() != 2 || len(violations) != 2 {
+		t.Fatalf("violations = %d reported, %d callbacks, want 2", report.Violations(), len(violations))
+	}
+	if v := violations[0]; v.Invariant != "Always HSTS" || v.Transaction.VXID != "32770" {
+		t.Errorf("first violation = %s on %s, want Always HSTS on 32770", v.Invariant, v.Transaction.VXID)
+	}
+	if v := violations[1]; v.Invariant != "Never cache checkout" || !strings.Contains(v.Errors[0], "Cache hit") {
+		t.Errorf("second violation = %s %q, want Never cache checkout with a cache hit error", v.Invariant, v.Errors)
+	}
+}
+
+func TestRun_MaxTransactions(t *testing.T) {
+	spec := loadSpec(t, "invariants:\n  - name: Any\n    expect:\n      response:\n        status: 200\n")
+	report, err := Run(context.Background(), spec, strings.NewReader(vsl), Options{MaxTransactions: 1})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.Sampled != 1 {
+		t.Errorf("Sampled = %d, want 1", report.Sampled)
+	}
+}
+
+func TestLoadSpec_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"no invariants", "invariants: []\n"},
+		{"missing name", "invariants:\n  - expect:\n      response:\n        status: 200\n"},
+		{"empty expect", "invariants:\n  - name: x\n"},
+		{"bad url regexp", "invariants:\n  - name: x\n    match:\n      url: '('\n    expect:\n      response:\n        status: 200\n"},
+		{"body_contains", "invariants:\n  - name: x\n    expect:\n      response:\n        body_contains: foo\n"},
+		{"cookies", "invariants:\n  - name: x\n    expect:\n      cookies:\n        a: b\n"},
+		{"hit_ratio", "invariants:\n  - name: x\n    expect:\n      cache:\n        hit_ratio:\n          urls: [/]\n"},
+		{"cookie_variation", "invariants:\n  - name: x\n    expect:\n      cache:\n        cookie_variation:\n          significant: [lang=fr]\n"},
+		{"ae_normalization", "invariants:\n  - name: x\n    expect:\n      cache:\n        ae_normalization: true\n"},
+		{"unknown field", "invariants:\n  - name: x\n    when: {}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "invariants.yaml")
+			if err := os.WriteFile(filename, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadSpec(filename); err == nil {
+				t.Error("LoadSpec() error = nil, want error")
+			}
+		})
+	}
+}
+
+func loadSpec(t *testing.T, content string) *Spec {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "invariants.yaml")
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spec, err := LoadSpec(filename)
+	if err != nil {
+		t.Fatalf("LoadSpec() error = %v", err)
+	}
+	return spec
+}
@@ -0,0 +1,139 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// Spec is a set of invariants checked against live traffic
+type Spec struct {
+	Invariants []Invariant `yaml:"invariants"`
+}
+
+// Invariant is an expectation that must hold for every matching transaction
+type Invariant struct {
+	Name   string                    `yaml:"name"`
+	Match  Match                     `yaml:"match,omitempty"`
+	Expect testspec.ExpectationsSpec `yaml:"expect"`
+
+	url  *regexp.Regexp
+	host *regexp.Regexp
+}
+
+// Match selects the transactions an invariant applies to. Empty fields match anything.
+type Match struct {
+	URL    string `yaml:"url,omitempty"`    // Regexp on the request URL as received
+	Host   string `yaml:"host,omitempty"`   // Regexp on the Host header as received
+	Method string `yaml:"method,omitempty"` // Request method
+}
+
+// Matches reports whether tx is selected by the invariant
+func (inv *Invariant) Matches(tx *Transaction) bool {
+	if inv.Match.Method != "" && inv.Match.Method != tx.Method {
+		return false
+	}
+	if inv.url != nil && !inv.url.MatchString(tx.URL) {
+		return false
+	}
+	if inv.host != nil && !inv.host.MatchString(tx.ReqHeaders.Get("Host")) {
+		return false
+	}
+	return true
+}
+
+// LoadSpec reads and validates an invariants file
+func LoadSpec(filename string) (*Spec, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading invariants file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var spec Spec
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("parsing invariants file: %w", err)
+	}
+	if err := spec.compile(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// compile validates the invariants and compiles their match patterns
+func (s *Spec) compile() error {
+	if len(s.Invariants) == 0 {
+		return fmt.Errorf("no invariants defined")
+	}
+	for i := range s.Invariants {
+		inv := &s.Invariants[i]
+		if err := inv.compile(); err != nil {
+			return fmt.Errorf("invariant %d (%q): %w", i+1, inv.Name, err)
+		}
+	}
+	return nil
+}
+
+func (inv *Invariant) compile() error {
+	if inv.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	var err error
+	if inv.Match.URL != "" {
+		if inv.url, err = regexp.Compile(inv.Match.URL); err != nil {
+			return fmt.Errorf("match.url: %w", err)
+		}
+	}
+	if inv.Match.Host != "" {
+		if inv.host, err = regexp.Compile(inv.Match.Host); err != nil {
+			return fmt.Errorf("match.host: %w", err)
+		}
+	}
+
+	// VSL has no bodies, and nothing is requested, so only a subset applies
+	exp := inv.Expect
+	switch {
+	case exp.Response.BodyContains != "":
+		return fmt.Errorf("expect.response.body_contains is not available from VSL")
+	case exp.Response.FinalURL != "" || len(exp.Response.RedirectChain) > 0:
+		return fmt.Errorf("expect.response.final_url and redirect_chain are not available from VSL")
+	case exp.Response.BodySize != nil || exp.Response.BodyComplete != nil:
+		return fmt.Errorf("expect.response.body_size and body_complete are not available from VSL")
+	case len(exp.Response.HeaderEqualsPrevious) > 0 || len(exp.Response.HeaderDiffersPrevious) > 0:
+		return fmt.Errorf("expect.response.header_equals_previous and header_differs_previous need scenario steps")
+	case exp.Backend != nil && len(exp.Backend.CallsBetween) > 0:
+		return fmt.Errorf("expect.backend.calls_between needs scenario steps")
+	case len(exp.Cookies) > 0:
+		return fmt.Errorf("expect.cookies is not available from VSL")
+	case exp.Continue != nil:
+		return fmt.Errorf("expect.continue does not apply to observed traffic")
+	case exp.Eventually != nil:
+		return fmt.Errorf("expect.eventually does not apply to observed traffic")
+	case exp.Cache != nil && exp.Cache.HitRatio != nil:
+		return fmt.Errorf("expect.cache.hit_ratio does not apply to observed traffic")
+	case exp.Cache != nil && exp.Cache.CookieVariation != nil:
+		return fmt.Errorf("expect.cache.cookie_variation does not apply to observed traffic")
+	case exp.Cache != nil && exp.Cache.AENormalization != nil:
+		return fmt.Errorf("expect.cache.ae_normalization does not apply to observed traffic")
+	case exp.Storage != "":
+		return fmt.Errorf("expect.storage needs the fetch of cached objects, which observed traffic may not include")
+	case exp.Cache.ChecksTTL():
+		return fmt.Errorf("expect.cache.ttl_gt, ttl_lt, ttl_respects_age and ttl_source need the fetch of cached objects, which observed traffic may not include")
+	case exp.ESI != nil:
+		return fmt.Errorf("expect.esi is only available in test files")
+	case len(exp.Preset) > 0:
+		return fmt.Errorf("expect.preset is only available in test files")
+	}
+	if exp.Response.Status == 0 && len(exp.Response.Headers) == 0 && exp.Backend == nil && exp.Cache == nil {
+		return fmt.Errorf("expect is empty")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package monitor
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Transaction is a client request as seen in VSL
+type Transaction struct {
+	VXID         string
+	Method       string
+	URL          string         // As received, before any VCL rewrite
+	ReqHeaders   http.Header    // As received
+	Status       int            // As delivered
+	RespHeaders  http.Header    // As delivered
+	BackendCalls map[string]int // Backend connections opened for this request, by backend name
+}
+
+// ReadTransactions parses `varnishlog -g request` output and calls fn for
+// each client request until fn returns false. Other top-level groups
+// (e.g. background fetches) are skipped.
+func ReadTransactions(r io.Reader, fn func(*Transaction) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+
+	var tx *Transaction
+	inRecv := false // Between the start of the request and vcl_recv
+	flush := func() bool {
+		if tx == nil {
+			return true
+		}
+		done := tx
+		tx = nil
+		return fn(done)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			if !flush() {
+				return nil
+			}
+			continue
+		}
+
+		// Group header: "*   << Request  >> 32770"
+		if fields[0] == "*" {
+			if !flush() {
+				return nil
+			}
+			if len(fields) >= 5 && fields[1] == "<<" && fields[2] == "Request" {
+				tx = &Transaction{
+					VXID:         fields[len(fields)-1],
+					ReqHeaders:   make(http.Header),
+					RespHeaders:  make(http.Header),
+					BackendCalls: make(map[string]int),
+				}
+				inRecv = true
+			}
+			continue
+		}
+		if tx == nil || len(fields) < 2 {
+			continue
+		}
+
+		tag := fields[1]
+		value := ""
+		if i := strings.Index(line, tag); i >= 0 {
+			value = strings.TrimSpace(line[i+len(tag):])
+		}
+
+		// Backend connections of nested backend requests count for this request
+		if tag == "BackendOpen" && len(fields) >= 4 {
+			tx.BackendCalls[backendName(fields[3])]++
+			continue
+		}
+		// Everything else comes from the client request itself ("-" lines)
+		if fields[0] != "-" {
+			continue
+		}
+
+		switch tag {
+		case "ReqMethod":
+			if tx.Method == "" {
+				tx.Method = value
+			}
+		case "ReqURL":
+			if tx.URL == "" {
+				tx.URL = value
+			}
+		case "ReqHeader":
+			if inRecv {
+				addHeader(tx.ReqHeaders, value)
+			}
+		case "VCL_call":
+			inRecv = false
+		case "RespStatus":
+			tx.Status, _ = strconv.Atoi(value)
+		case "RespHeader":
+			addHeader(tx.RespHeaders, value)
+		case "RespUnset":
+			unsetHeader(tx.RespHeaders, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+// backendName strips the VCL name prefix some Varnish versions log ("boot.default")
+func backendName(name string) string {
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// addHeader adds a "Name: value" VSL header line to h
+func addHeader(h http.Header, line string) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return
+	}
+	h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+}
+
+// unsetHeader removes a "Name: value" VSL header line from h
+func unsetHeader(h http.Header, line string) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return
+	}
+	key := http.CanonicalHeaderKey(strings.TrimSpace(name))
+	value = strings.TrimSpace(value)
+	values := h[key]
+	for i, v := range values {
+		if v == value {
+			values = append(values[:i], values[i+1:]...)
+			break
+		}
+	}
+	if len(values) == 0 {
+		delete(h, key)
+	} else {
+		h[key] = values
+	}
+}
@@ -2,6 +2,8 @@ package recorder
 
 import (
 	"fmt"
+	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -71,6 +73,235 @@ func ParseBackendCall(msg Message) (BackendCall, bool) {
 	}, true
 }
 
+// ParseFetchLink parses a Link record to a backend request and returns the
+// VXID of the fetch and the reason ("fetch", "pass", "bgfetch", ...)
+// Example: "Link bereq 32770 fetch"
+func ParseFetchLink(msg Message) (vxid, reason string, ok bool) {
+	if msg.Type != MessageTypeLink {
+		return "", "", false
+	}
+
+	// Fields: ["-", "Link", "bereq", "32770", "fetch"]
+	if len(msg.Fields) < 5 || msg.Fields[2] != "bereq" {
+		return "", "", false
+	}
+	return msg.Fields[3], msg.Fields[4], true
+}
+
+// FetchStorage maps the VXID of each backend fetch to the storage its object
+// was allocated in, from its Storage record (e.g. "malloc s0" or
+// "malloc Transient"). With -g request, varnishlog prints the backend
+// requests of a client request after it, in the order of its Link records.
+func FetchStorage(messages []Message) map[string]string {
+	storage := make(map[string]string)
+	var pending []string // Linked fetches of the current request without a Storage record yet
+	for _, msg := range messages {
+		switch {
+		case msg.Type == MessageTypeBegin && len(msg.Fields) > 2 && msg.Fields[0] == "-" && msg.Fields[2] == "req":
+			pending = nil
+		case msg.Type == MessageTypeLink:
+			if vxid, _, ok := ParseFetchLink(msg); ok {
+				pending = append(pending, vxid)
+			}
+		case msg.Type == MessageTypeStorage && len(pending) > 0 && msg.Fields[0] != "-":
+			// Only backend requests ("--" lines) fetch objects
+			storage[pending[0]] = msg.Content
+			pending = pending[1:]
+		}
+	}
+	return storage
+}
+
+// FetchTTL maps the VXID of each backend fetch to the TTL in seconds its
+// object was stored with, from its last TTL record: the VCL record when
+// vcl_backend_response set beresp.ttl, else the RFC one (e.g.
+// "TTL VCL 300 10 0 1700000000"). Backend requests are matched to the Link
+// records of their client request in order, as in FetchStorage.
+func FetchTTL(messages []Message) map[string]float64 {
+	ttls := make(map[string]float64)
+	var pending []string // Linked fetches of the current request not begun yet
+	current := ""
+	for _, msg := range messages {
+		switch {
+		case msg.Type == MessageTypeBegin && len(msg.Fields) > 2 && msg.Fields[0] == "-" && msg.Fields[2] == "req":
+			pending, current = nil, ""
+		case msg.Type == MessageTypeLink:
+			if vxid, _, ok := ParseFetchLink(msg); ok {
+				pending = append(pending, vxid)
+			}
+		case msg.Type == MessageTypeBegin && len(msg.Fields) > 2 && msg.Fields[2] == "bereq" && len(pending) > 0:
+			current, pending = pending[0], pending[1:]
+		case msg.Type == MessageTypeTTL && current != "" && msg.Fields[0] != "-" && len(msg.Fields) > 3:
+			if ttl, err := strconv.ParseFloat(msg.Fields[3], 64); err == nil {
+				ttls[current] = ttl
+			}
+		}
+	}
+	return ttls
+}
+
+// FetchFreshness maps the VXID of each backend fetch with an RFC TTL record
+// to the headers and TTL records its TTL came from. The RFC record reads
+// "TTL RFC <ttl> <grace> <keep> <now> <origin> <date> <expires> <max-age>
+// cacheable", where origin is now minus the Age header. Fetches are matched
+// to Link records as in FetchTTL.
+func FetchFreshness(messages []Message) map[string]Freshness {
+	result := make(map[string]Freshness)
+	var pending []string
+	current := ""
+	var f Freshness
+	received := false // vcl_backend_response was called, later headers are set by VCL
+	for _, msg := range messages {
+		switch {
+		case msg.Type == MessageTypeBegin && len(msg.Fields) > 2 && msg.Fields[0] == "-" && msg.Fields[2] == "req":
+			pending, current = nil, ""
+		case msg.Type == MessageTypeLink:
+			if vxid, _, ok := ParseFetchLink(msg); ok {
+				pending = append(pending, vxid)
+			}
+		case msg.Type == MessageTypeBegin && len(msg.Fields) > 2 && msg.Fields[2] == "bereq" && len(pending) > 0:
+			current, pending = pending[0], pending[1:]
+			f, received = Freshness{Headers: make(http.Header)}, false
+		case current == "" || len(msg.Fields) == 0 || msg.Fields[0] == "-":
+			// Not part of a linked backend request
+		case msg.Type == MessageTypeBerespHeader && !received:
+			if name, value, ok := strings.Cut(msg.Content, ":"); ok {
+				f.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+			}
+		case msg.Type == MessageTypeVCLCall && msg.Content == "BACKEND_RESPONSE":
+			received = true
+		case msg.Type == MessageTypeTTL && len(msg.Fields) > 7 && msg.Fields[2] == "RFC":
+			ttl, err1 := strconv.ParseFloat(msg.Fields[3], 64)
+			now, err2 := strconv.ParseFloat(msg.Fields[6], 64)
+			origin, err3 := strconv.ParseFloat(msg.Fields[7], 64)
+			if err1 != nil || err2 != nil || err3 != nil {
+				continue
+			}
+			f.Now, f.Age, f.RFCTTL, f.TTL = now, now-origin, ttl, ttl
+			result[current] = f
+		case msg.Type == MessageTypeTTL && len(msg.Fields) > 3:
+			if _, ok := result[current]; !ok {
+				continue
+			}
+			if ttl, err := strconv.ParseFloat(msg.Fields[3], 64); err == nil {
+				f.TTL = ttl
+				result[current] = f
+			}
+		}
+	}
+	return result
+}
+
+// TransactionVCLs returns the VCL that handled each transaction, in log
+// order. The name comes from the VCL_use record (e.g. "VCL_use vcl1" or
+// "VCL_use vcl1 via label1"), or from the transaction's VCL_trace records
+// when it has none; the config IDs come from its VCL_trace records.
+func TransactionVCLs(messages []Message) []TransactionVCL {
+	var result []TransactionVCL
+	var current *TransactionVCL
+	for _, msg := range messages {
+		switch msg.Type {
+		case MessageTypeBegin:
+			if len(msg.Fields) < 3 {
+				continue
+			}
+			result = append(result, TransactionVCL{Kind: msg.Fields[2]})
+			current = &result[len(result)-1]
+		case MessageTypeVCLUse:
+			// Fields: ["-", "VCL_use", "vcl1", "via", "label1"]
+			if current == nil || len(msg.Fields) < 3 {
+				continue
+			}
+			current.VCL = msg.Fields[2]
+			if len(msg.Fields) >= 5 && msg.Fields[3] == "via" {
+				current.Label = msg.Fields[4]
+			}
+		case MessageTypeVCLTrace:
+			trace, ok := ParseVCLTrace(msg)
+			if current == nil || !ok {
+				continue
+			}
+			if current.VCL == "" {
+				current.VCL = trace.VCLName
+			}
+			if !slices.Contains(current.ConfigIDs, trace.Config) {
+				current.ConfigIDs = append(current.ConfigIDs, trace.Config)
+			}
+		}
+	}
+
+	// Drop transactions that ran no VCL, such as those of a failed request
+	return slices.DeleteFunc(result, func(t TransactionVCL) bool { return t.VCL == "" })
+}
+
+// SplitRequests splits messages logged with -g request into the records of
+// each top-level client request, in log order. Other top-level transactions,
+// such as background fetches, stay with the request before them.
+func SplitRequests(messages []Message) [][]Message {
+	var requests [][]Message
+	for _, msg := range messages {
+		if msg.Type == MessageTypeBegin && len(msg.Fields) >= 3 && msg.Fields[0] == "-" && msg.Fields[2] == "req" {
+			requests = append(requests, nil)
+		}
+		if len(requests) > 0 {
+			requests[len(requests)-1] = append(requests[len(requests)-1], msg)
+		}
+	}
+	return requests
+}
+
+// ParseESI returns the ESI subrequests of the first client request in
+// messages, and what its parent fetch did. With -g request, the parent is
+// the top-level ("-") request, its own backend fetch the first "--" backend
+// request, and each ESI subrequest a request begun with reason "esi".
+func ParseESI(messages []Message) ESIRequest {
+	var esi ESIRequest
+	var fragment *ESIFragment
+	level, kind := "", ""
+	parentFetched, inParentFetch := false, false
+	for _, msg := range messages {
+		if len(msg.Fields) < 3 {
+			continue
+		}
+		switch {
+		case msg.Type == MessageTypeBegin:
+			if level != "" && msg.Fields[0] == "-" && msg.Fields[2] == "req" {
+				return esi // The next client request
+			}
+			level, kind = msg.Fields[0], msg.Fields[2]
+			fragment, inParentFetch = nil, false
+			if kind == "req" && len(msg.Fields) > 4 && msg.Fields[4] == "esi" {
+				esi.Fragments = append(esi.Fragments, ESIFragment{})
+				fragment = &esi.Fragments[len(esi.Fragments)-1]
+			}
+			if kind == "bereq" && level == "--" && !parentFetched {
+				parentFetched, inParentFetch = true, true
+			}
+		case msg.Fields[0] != level:
+			continue
+		case level == "-" && msg.Type == MessageTypeVCLCall && msg.Content == "HIT":
+			esi.Hit = true
+		case level == "-" && msg.Type == MessageTypeLink:
+			if _, reason, ok := ParseFetchLink(msg); ok && esi.FetchReason == "" {
+				esi.FetchReason = reason
+			}
+		case fragment != nil && msg.Type == MessageTypeReqURL && fragment.URL == "":
+			fragment.URL = msg.Content
+		case fragment != nil && msg.Type == MessageTypeRespStatus:
+			fragment.Status, _ = strconv.Atoi(msg.Content)
+		case inParentFetch && msg.Type == MessageTypeTTL:
+			esi.FetchTTL = msg.Content
+		}
+	}
+	return esi
+}
+
+// Cached reports whether the parent object is in cache after the request:
+// it was a hit, or its fetch stored an object the TTL record calls cacheable
+func (e ESIRequest) Cached() bool {
+	return e.Hit || (e.FetchReason == "fetch" && strings.HasSuffix(e.FetchTTL, " cacheable"))
+}
+
 // GetExecutedLinesByConfig extracts line numbers from VCL trace messages per config ID
 // Only includes config IDs present in configMap (filters out built-in VCL)
 // Returns map of config ID to sorted list of executed line numbers
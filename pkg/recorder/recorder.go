@@ -1,6 +1,7 @@
 package recorder
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -68,6 +69,11 @@ func (r *Recorder) Start() error {
 
 	r.running = true
 	r.outFile = outFile
+	r.done = make(chan struct{})
+	go func() {
+		r.waitErr = r.cmd.Wait()
+		close(r.done)
+	}()
 
 	// Give varnishlog a moment to start
 	time.Sleep(100 * time.Millisecond)
@@ -84,20 +90,15 @@ func (r *Recorder) Stop() error {
 	r.logger.Debug("Stopping varnishlog recorder")
 
 	// Send interrupt signal to process group to ensure varnishlog receives it
-	if err := r.cmd.Process.Signal(os.Interrupt); err != nil {
+	if err := r.cmd.Process.Signal(os.Interrupt); err != nil && !errors.Is(err, os.ErrProcessDone) {
 		return fmt.Errorf("failed to signal varnishlog: %w", err)
 	}
 
 	// Wait for process to exit (with timeout)
-	done := make(chan error, 1)
-	go func() {
-		done <- r.cmd.Wait()
-	}()
-
 	select {
-	case err := <-done:
-		if err != nil {
-			r.logger.Warn("varnishlog exited with error", "error", err)
+	case <-r.done:
+		if r.waitErr != nil {
+			r.logger.Warn("varnishlog exited with error", "error", r.waitErr)
 		}
 	case <-time.After(1 * time.Second):
 		r.logger.Warn("varnishlog did not exit in time, killing process")
@@ -105,7 +106,7 @@ func (r *Recorder) Stop() error {
 			return fmt.Errorf("failed to kill varnishlog: %w", err)
 		}
 		// Wait for kill to complete
-		<-done
+		<-r.done
 	}
 
 	r.running = false
@@ -128,6 +129,21 @@ func (r *Recorder) IsRunning() bool {
 	return r.running
 }
 
+// Exited reports whether varnishlog exited on its own while recording, and
+// its exit status. varnishlog gives up when varnishd's shared memory does not
+// show up in time.
+func (r *Recorder) Exited() (bool, error) {
+	if !r.running {
+		return false, nil
+	}
+	select {
+	case <-r.done:
+		return true, r.waitErr
+	default:
+		return false, nil
+	}
+}
+
 // Flush forces varnishlog to flush its buffer by sending SIGUSR1
 func (r *Recorder) Flush() error {
 	if !r.running {
@@ -162,6 +178,12 @@ func (r *Recorder) MarkPosition() (int64, error) {
 
 // GetMessagesSince reads log entries from a specific file offset
 func (r *Recorder) GetMessagesSince(offset int64) ([]Message, error) {
+	return r.GetMessagesBetween(offset, -1)
+}
+
+// GetMessagesBetween reads log entries between two file offsets.
+// An end of -1 reads to the end of the file.
+func (r *Recorder) GetMessagesBetween(offset, end int64) ([]Message, error) {
 	// Check if log file exists
 	if _, err := os.Stat(r.outputFile); os.IsNotExist(err) {
 		return nil, fmt.Errorf("log file does not exist: %s", r.outputFile)
@@ -179,7 +201,11 @@ func (r *Recorder) GetMessagesSince(offset int64) ([]Message, error) {
 	}
 
 	// Read from offset to end
-	data, err := io.ReadAll(file)
+	var reader io.Reader = file
+	if end >= 0 {
+		reader = io.LimitReader(file, end-offset)
+	}
+	data, err := io.ReadAll(reader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read log file: %w", err)
 	}
@@ -215,6 +241,11 @@ func (r *Recorder) GetVCLMessages() ([]Message, error) {
 	return r.GetVCLMessagesSince(0)
 }
 
+// ParseLog parses varnishlog output captured outside a recorder
+func ParseLog(output string) []Message {
+	return (&Recorder{}).parseMessages(output)
+}
+
 // parseMessages parses raw varnishlog output into structured messages
 func (r *Recorder) parseMessages(output string) []Message {
 	messages := make([]Message, 0)
@@ -296,6 +327,51 @@ func (r *Recorder) parseLine(line string) Message {
 		if len(fields) >= 3 {
 			msg.Content = strings.Join(fields[2:], " ")
 		}
+	case "BerespHeader":
+		msg.Type = MessageTypeBerespHeader
+		if len(fields) >= 3 {
+			msg.Content = strings.Join(fields[2:], " ")
+		}
+	case "Begin":
+		msg.Type = MessageTypeBegin
+		if len(fields) >= 3 {
+			msg.Content = strings.Join(fields[2:], " ")
+		}
+	case "Timestamp":
+		msg.Type = MessageTypeTimestamp
+		if len(fields) >= 3 {
+			msg.Content = strings.Join(fields[2:], " ")
+		}
+	case "ReqMethod":
+		msg.Type = MessageTypeReqMethod
+		if len(fields) >= 3 {
+			msg.Content = fields[2]
+		}
+	case "TTL":
+		msg.Type = MessageTypeTTL
+		if len(fields) >= 3 {
+			msg.Content = strings.Join(fields[2:], " ")
+		}
+	case "BerespStatus":
+		msg.Type = MessageTypeBerespStatus
+		if len(fields) >= 3 {
+			msg.Content = fields[2]
+		}
+	case "Storage":
+		msg.Type = MessageTypeStorage
+		if len(fields) >= 3 {
+			msg.Content = strings.Join(fields[2:], " ")
+		}
+	case "Link":
+		msg.Type = MessageTypeLink
+		if len(fields) >= 3 {
+			msg.Content = strings.Join(fields[2:], " ")
+		}
+	case "VCL_use":
+		msg.Type = MessageTypeVCLUse
+		if len(fields) >= 3 {
+			msg.Content = strings.Join(fields[2:], " ")
+		}
 	}
 
 	return msg
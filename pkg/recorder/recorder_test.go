@@ -2,7 +2,9 @@ package recorder
 
 import (
 	"log/slog"
+	"net/http"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -104,6 +106,24 @@ func TestParseLine(t *testing.T) {
 			wantType:    MessageTypeRespStatus,
 			wantContent: "403",
 		},
+		{
+			name:        "Begin in nested backend transaction",
+			line:        "--  Begin          bereq 32770 fetch",
+			wantType:    MessageTypeBegin,
+			wantContent: "bereq 32770 fetch",
+		},
+		{
+			name:        "Timestamp",
+			line:        "-   Timestamp      Start: 1700000000.123456 0.000000 0.000000",
+			wantType:    MessageTypeTimestamp,
+			wantContent: "Start: 1700000000.123456 0.000000 0.000000",
+		},
+		{
+			name:        "VCL_use through a label",
+			line:        "-   VCL_use        vcl-api via api",
+			wantType:    MessageTypeVCLUse,
+			wantContent: "vcl-api via api",
+		},
 		{
 			name:     "empty line",
 			line:     "",
@@ -249,6 +269,209 @@ func TestParseBackendCall(t *testing.T) {
 	}
 }
 
+func TestFetchStorage(t *testing.T) {
+	log := `*   << Request  >> 32769
+-   Begin          req 32768 rxreq
+-   ReqURL         /short
+-   Link           bereq 32770 fetch
+-   RespStatus     200
+**  << BeReq    >> 32770
+--  Begin          bereq 32769 fetch
+--  Storage        malloc Transient
+--  BerespStatus   200
+
+*   << Request  >> 32771
+-   Begin          req 32768 rxreq
+-   ReqURL         /error
+-   Link           bereq 32772 fetch
+-   Storage        malloc Transient
+**  << BeReq    >> 32772
+--  Begin          bereq 32771 fetch
+--  BerespStatus   503
+
+*   << Request  >> 32773
+-   Begin          req 32768 rxreq
+-   ReqURL         /long
+-   Link           bereq 32774 fetch
+**  << BeReq    >> 32774
+--  Begin          bereq 32773 fetch
+--  Storage        malloc s0
+`
+	got := FetchStorage(ParseLog(log))
+	want := map[string]string{"32770": "malloc Transient", "32774": "malloc s0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FetchStorage() = %v, want %v", got, want)
+	}
+}
+
+func TestFetchTTL(t *testing.T) {
+	log := `*   << Request  >> 32769
+-   Begin          req 32768 rxreq
+-   ReqURL         /page
+-   Link           bereq 32770 fetch
+-   RespStatus     200
+**  << BeReq    >> 32770
+--  Begin          bereq 32769 fetch
+--  TTL            RFC 120 10 0 1700000000 1700000000 1700000000 0 0 cacheable
+--  TTL            VCL 300 10 0 1700000000 cacheable
+--  BerespStatus   200
+
+*   << Request  >> 32771
+-   Begin          req 32768 rxreq
+-   ReqURL         /asset
+-   Link           bereq 32772 fetch
+-   TTL            HFP 0 0 0 1700000000 uncacheable
+**  << BeReq    >> 32772
+--  Begin          bereq 32771 fetch
+--  TTL            RFC 86400 10 0 1700000000 1700000000 1700000000 0 0 cacheable
+`
+	got := FetchTTL(ParseLog(log))
+	want := map[string]float64{"32770": 300, "32772": 86400}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FetchTTL() = %v, want %v", got, want)
+	}
+}
+
+func TestFetchFreshness(t *testing.T) {
+	log := `*   << Request  >> 32769
+-   Begin          req 32768 rxreq
+-   ReqURL         /article
+-   Link           bereq 32770 fetch
+-   RespStatus     200
+**  << BeReq    >> 32770
+--  Begin          bereq 32769 fetch
+--  BerespHeader   Age: 600
+--  BerespHeader   Cache-Control: s-maxage=7200, max-age=3600
+--  TTL            RFC 7200 10 0 1700000600 1700000000 1700000600 0 7200 cacheable
+--  VCL_call       BACKEND_RESPONSE
+--  BerespHeader   X-Cache-Tag: article
+--  TTL            VCL 4200 10 0 1700000000 cacheable
+
+*   << Request  >> 32771
+-   Begin          req 32768 rxreq
+-   Link           bereq 32772 pass
+-   TTL            HFP 0 0 0 1700000000 uncacheable
+`
+	got := FetchFreshness(ParseLog(log))
+	want := map[string]Freshness{"32770": {
+		Headers: http.Header{"Age": {"600"}, "Cache-Control": {"s-maxage=7200, max-age=3600"}},
+		Now:     1700000600,
+		Age:     600,
+		RFCTTL:  7200,
+		TTL:     4200,
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FetchFreshness() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSplitRequests(t *testing.T) {
+	log := `*   << Request  >> 32769
+-   Begin          req 32768 rxreq
+-   VCL_trace      boot 1 0.3.5
+**  << Request  >> 32770
+--  Begin          req 32769 esi
+--  VCL_trace      boot 2 0.4.5
+
+*   << BeReq    >> 32771
+-   Begin          bereq 32769 bgfetch
+-   VCL_trace      boot 3 0.9.5
+
+*   << Request  >> 32772
+-   Begin          req 32768 rxreq
+-   VCL_trace      boot 4 0.5.5
+`
+	var got [][]string
+	for _, request := range SplitRequests(ParseLog(log)) {
+		var traces []string
+		for _, msg := range request {
+			if msg.Type == MessageTypeVCLTrace {
+				traces = append(traces, msg.Content)
+			}
+		}
+		got = append(got, traces)
+	}
+	want := [][]string{{"boot 1 0.3.5", "boot 2 0.4.5", "boot 3 0.9.5"}, {"boot 4 0.5.5"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SplitRequests() traces = %v, want %v", got, want)
+	}
+}
+
+func TestTransactionVCLs(t *testing.T) {
+	log := `*   << Request  >> 32769
+-   Begin          req 32768 rxreq
+-   VCL_use        vcl-main
+-   VCL_trace      vcl-main 1 0.4.1
+-   VCL_trace      vcl-main 2 1.2.3
+-   VCL_trace      vcl-main 3 0.9.5
+-   Link           bereq 32770 fetch
+**  << BeReq    >> 32770
+--  Begin          bereq 32769 fetch
+--  VCL_trace      vcl-main 7 0.20.1
+
+*   << Request  >> 32771
+-   Begin          req 32768 rxreq
+-   VCL_use        vcl-api via api
+-   VCL_trace      vcl-api 1 0.3.1
+`
+	got := TransactionVCLs(ParseLog(log))
+	want := []TransactionVCL{
+		{Kind: "req", VCL: "vcl-main", ConfigIDs: []int{0, 1}},
+		{Kind: "bereq", VCL: "vcl-main", ConfigIDs: []int{0}},
+		{Kind: "req", VCL: "vcl-api", Label: "api", ConfigIDs: []int{0}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TransactionVCLs() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseESI(t *testing.T) {
+	log := `*   << Request  >> 32769
+-   Begin          req 32768 rxreq
+-   ReqURL         /page
+-   VCL_call       MISS
+-   Link           bereq 32770 fetch
+-   Link           req 32771 esi
+-   Link           req 32773 esi
+-   RespStatus     200
+**  << BeReq    >> 32770
+--  Begin          bereq 32769 fetch
+--  TTL            RFC 120 10 0 1700000000 1700000000 1700000000 0 0 cacheable
+--  TTL            VCL 300 10 0 1700000000 cacheable
+**  << Request  >> 32771
+--  Begin          req 32769 esi
+--  ReqURL         /fragments/header
+--  Link           bereq 32772 fetch
+--  RespStatus     200
+*** << BeReq    >> 32772
+--- Begin          bereq 32771 fetch
+--- TTL            HFP 0 0 0 1700000000 uncacheable
+**  << Request  >> 32773
+--  Begin          req 32769 esi
+--  ReqURL         /fragments/price
+--  RespStatus     500
+
+*   << Request  >> 32775
+-   Begin          req 32768 rxreq
+-   VCL_call       HIT
+`
+	got := ParseESI(ParseLog(log))
+	want := ESIRequest{
+		Fragments:   []ESIFragment{{URL: "/fragments/header", Status: 200}, {URL: "/fragments/price", Status: 500}},
+		FetchReason: "fetch",
+		FetchTTL:    "VCL 300 10 0 1700000000 cacheable",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseESI() = %+v, want %+v", got, want)
+	}
+	if !got.Cached() {
+		t.Error("Cached() = false, want true for a cacheable fetch")
+	}
+	if passed := (ESIRequest{FetchReason: "pass"}); passed.Cached() {
+		t.Error("Cached() = true, want false for a pass")
+	}
+}
+
 func TestGetExecutedLines(t *testing.T) {
 	messages := []Message{
 		{
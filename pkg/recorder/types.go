@@ -2,6 +2,7 @@ package recorder
 
 import (
 	"log/slog"
+	"net/http"
 	"os"
 	"os/exec"
 )
@@ -10,15 +11,24 @@ import (
 type MessageType string
 
 const (
-	MessageTypeVCLTrace    MessageType = "VCL_trace"
-	MessageTypeVCLCall     MessageType = "VCL_call"
-	MessageTypeVCLReturn   MessageType = "VCL_return"
-	MessageTypeBackendOpen MessageType = "BackendOpen"
-	MessageTypeReqURL      MessageType = "ReqURL"
-	MessageTypeRespStatus  MessageType = "RespStatus"
-	MessageTypeReqHeader   MessageType = "ReqHeader"
-	MessageTypeRespHeader  MessageType = "RespHeader"
-	MessageTypeOther       MessageType = "Other"
+	MessageTypeVCLTrace     MessageType = "VCL_trace"
+	MessageTypeVCLCall      MessageType = "VCL_call"
+	MessageTypeVCLReturn    MessageType = "VCL_return"
+	MessageTypeBackendOpen  MessageType = "BackendOpen"
+	MessageTypeReqURL       MessageType = "ReqURL"
+	MessageTypeRespStatus   MessageType = "RespStatus"
+	MessageTypeReqHeader    MessageType = "ReqHeader"
+	MessageTypeRespHeader   MessageType = "RespHeader"
+	MessageTypeBerespHeader MessageType = "BerespHeader"
+	MessageTypeBegin        MessageType = "Begin"
+	MessageTypeTimestamp    MessageType = "Timestamp"
+	MessageTypeReqMethod    MessageType = "ReqMethod"
+	MessageTypeBerespStatus MessageType = "BerespStatus"
+	MessageTypeStorage      MessageType = "Storage"
+	MessageTypeLink         MessageType = "Link"
+	MessageTypeTTL          MessageType = "TTL"
+	MessageTypeVCLUse       MessageType = "VCL_use"
+	MessageTypeOther        MessageType = "Other"
 )
 
 // Message represents a parsed varnishlog message
@@ -39,6 +49,38 @@ type VCLTrace struct {
 	Column         int    // Column position
 }
 
+// TransactionVCL is the VCL that handled a client or backend transaction
+type TransactionVCL struct {
+	Kind      string // "req" or "bereq"
+	VCL       string // Loaded VCL name
+	Label     string // Label the VCL was reached through, if any
+	ConfigIDs []int  // Config IDs (source files) with executed lines, in order of first use
+}
+
+// ESIFragment is an ESI subrequest and the status it delivered
+type ESIFragment struct {
+	URL    string
+	Status int
+}
+
+// ESIRequest is how a client request was assembled from ESI includes
+type ESIRequest struct {
+	Fragments   []ESIFragment // ESI subrequests, nested ones included, in log order
+	Hit         bool          // The parent was served from cache
+	FetchReason string        // Reason of the parent's backend fetch ("fetch", "pass", ...), "" if none
+	FetchTTL    string        // Last TTL record of the parent's fetch, e.g. "VCL 300 10 0 1700000000 cacheable"
+}
+
+// Freshness is what the TTL of a backend fetch was derived from, and what
+// it ended up as
+type Freshness struct {
+	Headers http.Header // Backend response headers as received, before vcl_backend_response
+	Now     float64     // Reference time of the RFC TTL record (Unix seconds)
+	Age     float64     // Seconds the object was backdated by the Age header
+	RFCTTL  float64     // TTL varnishd derived from the headers
+	TTL     float64     // TTL the object was stored with (last TTL record), counted from Now - Age
+}
+
 // BackendCall represents a parsed BackendOpen log entry
 type BackendCall struct {
 	ID          string
@@ -55,4 +97,6 @@ type Recorder struct {
 	cmd        *exec.Cmd
 	logger     *slog.Logger
 	running    bool
+	done       chan struct{} // Closed when varnishlog exits
+	waitErr    error         // varnishlog's exit status, set before done closes
 }
@@ -0,0 +1,121 @@
+// Package redact masks secret header values (Authorization, Set-Cookie, ...)
+// in test output and debug artifacts while leaving assertions untouched.
+package redact
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces redacted values in output
+const Mask = "[REDACTED]"
+
+// minValueLength is the shortest value that is scrubbed verbatim from text.
+// Shorter values (e.g. "1") would mangle unrelated output.
+const minValueLength = 4
+
+// Redactor masks the values of a set of header names.
+// A nil *Redactor is valid and redacts nothing.
+type Redactor struct {
+	names   map[string]bool // Canonical header names
+	pattern *regexp.Regexp  // Matches "Name: value" up to end of line
+
+	mu     sync.Mutex
+	values map[string]bool // Known secret values, scrubbed wherever they appear
+}
+
+// New creates a redactor for the given header names (case-insensitive).
+// Returns nil if names is empty.
+func New(names []string) *Redactor {
+	if len(names) == 0 {
+		return nil
+	}
+
+	r := &Redactor{
+		names:  make(map[string]bool, len(names)),
+		values: make(map[string]bool),
+	}
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		r.names[http.CanonicalHeaderKey(name)] = true
+		quoted = append(quoted, regexp.QuoteMeta(name))
+	}
+	// Header lines as they appear in varnishlog, YAML and the CLI transcript:
+	// "ReqHeader  Authorization: Bearer x", "  Authorization: \"Bearer x\""
+	r.pattern = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)(\s*:[ \t]*)[^\r\n]*`)
+
+	return r
+}
+
+// IsRedacted reports whether values of the named header are masked
+func (r *Redactor) IsRedacted(name string) bool {
+	if r == nil {
+		return false
+	}
+	return r.names[http.CanonicalHeaderKey(name)]
+}
+
+// AddValue registers a secret value to be scrubbed from all output
+func (r *Redactor) AddValue(value string) {
+	if r == nil || len(value) < minValueLength {
+		return
+	}
+	r.mu.Lock()
+	r.values[value] = true
+	r.mu.Unlock()
+}
+
+// AddHeaders registers the values of redacted headers in a string map
+func (r *Redactor) AddHeaders(headers map[string]string) {
+	for name, value := range headers {
+		if r.IsRedacted(name) {
+			r.AddValue(value)
+		}
+	}
+}
+
+// AddHTTPHeaders registers the values of redacted headers in an http.Header
+func (r *Redactor) AddHTTPHeaders(headers http.Header) {
+	for name, values := range headers {
+		if !r.IsRedacted(name) {
+			continue
+		}
+		for _, value := range values {
+			r.AddValue(value)
+		}
+	}
+}
+
+// String masks redacted header lines and known secret values in s
+func (r *Redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+
+	s = r.pattern.ReplaceAllString(s, "${1}${2}"+Mask)
+
+	r.mu.Lock()
+	values := make([]string, 0, len(r.values))
+	for value := range r.values {
+		values = append(values, value)
+	}
+	r.mu.Unlock()
+
+	// Longest first, so a value containing another is masked as a whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		s = strings.ReplaceAll(s, value, Mask)
+	}
+	return s
+}
+
+// Strings masks each string in ss in place and returns it
+func (r *Redactor) Strings(ss []string) []string {
+	for i := range ss {
+		ss[i] = r.String(ss[i])
+	}
+	return ss
+}
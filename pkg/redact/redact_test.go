@@ -0,0 +1,67 @@
+package redact
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRedactor_String(t *testing.T) {
+	r := New([]string{"authorization", "Set-Cookie"})
+	r.AddValue("Bearer s3cr3t")
+	r.AddHTTPHeaders(http.Header{"Set-Cookie": {"session=abc123; Path=/"}, "X-Other": {"visible"}})
+	r.AddValue("x") // too short to scrub
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "varnishlog header line",
+			in:   "-   ReqHeader      Authorization: Bearer s3cr3t",
+			want: "-   ReqHeader      Authorization: [REDACTED]",
+		},
+		{
+			name: "yaml header case-insensitive",
+			in:   "    authorization: \"Bearer other\"\n    X-Keep: yes",
+			want: "    authorization: [REDACTED]\n    X-Keep: yes",
+		},
+		{
+			name: "assertion error with known values",
+			in:   `Response header "Set-Cookie": expected "session=xyz", got "session=abc123; Path=/"`,
+			want: `Response header "Set-Cookie": expected "session=xyz", got "[REDACTED]"`,
+		},
+		{
+			name: "value embedded in body",
+			in:   `{"authorization_echo":["Bearer s3cr3t"]}`,
+			want: `{"authorization_echo":["[REDACTED]"]}`,
+		},
+		{
+			name: "unrelated text untouched",
+			in:   "X-Other: visible, x marks the spot",
+			want: "X-Other: visible, x marks the spot",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.String(tt.in); got != tt.want {
+				t.Errorf("String() =\n  %q\nwant\n  %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactor_Nil(t *testing.T) {
+	r := New(nil)
+	if r != nil {
+		t.Fatal("New(nil) should return nil")
+	}
+	r.AddValue("secret")
+	if got := r.String("Authorization: secret"); got != "Authorization: secret" {
+		t.Errorf("nil redactor changed output: %q", got)
+	}
+	if r.IsRedacted("Authorization") {
+		t.Error("nil redactor should not redact anything")
+	}
+}
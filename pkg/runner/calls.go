@@ -0,0 +1,75 @@
+package runner
+
+import (
+	"sort"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/assertion"
+	"github.com/perbu/vcltest/pkg/backend"
+)
+
+// callHistory keeps the backend requests of a scenario across the per-step
+// resets of the mock backends' counters and access logs, and places them on
+// the simulated clock for calls_between expectations
+type callHistory struct {
+	backends map[string]*backend.MockBackend
+	past     map[string][]backend.Request // Access log entries taken before resets
+	steps    []stepClock
+}
+
+// stepClock is the simulated time a step set, and when it did
+type stepClock struct {
+	at    time.Duration
+	began time.Time
+}
+
+func newCallHistory(backends map[string]*backend.MockBackend) *callHistory {
+	return &callHistory{backends: backends, past: make(map[string][]backend.Request)}
+}
+
+// mark records that the simulated clock was set to at
+func (h *callHistory) mark(at time.Duration) {
+	h.steps = append(h.steps, stepClock{at: at, began: time.Now()})
+}
+
+// reset saves the access logs and resets the mock backends' counters
+func (h *callHistory) reset() {
+	for name, mock := range h.backends {
+		h.past[name] = append(h.past[name], mock.Requests()...)
+		mock.ResetCallCount()
+	}
+}
+
+// calls returns the requests received since the first step, oldest first.
+// A request is placed at the simulated time of the step it arrived in, plus
+// the real time elapsed since that step set the clock.
+func (h *callHistory) calls() []assertion.BackendCall {
+	var calls []assertion.BackendCall
+	for name, mock := range h.backends {
+		for _, req := range append(h.past[name], mock.Requests()...) {
+			at, ok := h.simulated(req.Time)
+			if !ok {
+				continue
+			}
+			calls = append(calls, assertion.BackendCall{Backend: name, At: at, Method: req.Method, URL: req.URL})
+		}
+	}
+	sort.SliceStable(calls, func(i, j int) bool {
+		if calls[i].At != calls[j].At {
+			return calls[i].At < calls[j].At
+		}
+		return calls[i].Backend < calls[j].Backend
+	})
+	return calls
+}
+
+// simulated maps a real time to the simulated clock; false for times
+// before the first step (leftovers of an earlier test)
+func (h *callHistory) simulated(t time.Time) (time.Duration, bool) {
+	for i := len(h.steps) - 1; i >= 0; i-- {
+		if !t.Before(h.steps[i].began) {
+			return h.steps[i].at + t.Sub(h.steps[i].began), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,59 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/recorder"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// RequestTrace is what varnishlog recorded for a request made with Do
+type RequestTrace struct {
+	// VCL holds the lines the request executed in each VCL file (nil if the
+	// VCL structure is unknown)
+	VCL *VCLTraceInfo
+
+	// Messages are the VSL records of the request's transactions: the client
+	// request and the backend fetches it made
+	Messages []recorder.Message
+}
+
+// Do makes a single request to Varnish outside any test, over the suite's
+// pooled client, and returns the response with the VSL trace of the request
+// (nil without a recorder). No expectations are checked and backends are
+// left as the last test configured them.
+func (r *Runner) Do(ctx context.Context, req testspec.RequestSpec) (*client.Response, *RequestTrace, error) {
+	if req.Method == "" {
+		req.Method = "GET"
+	}
+
+	var logOffset int64
+	if r.recorder != nil {
+		offset, err := r.recorder.MarkPosition()
+		if err != nil {
+			return nil, nil, fmt.Errorf("marking log position: %w", err)
+		}
+		logOffset = offset
+	}
+
+	response, err := client.MakeRequestContext(ctx, r.httpClient, r.varnishURL, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.redactor.AddHTTPHeaders(response.Headers)
+
+	if r.recorder == nil {
+		return response, nil, nil
+	}
+	messages, err := r.recorder.GetMessagesSince(logOffset)
+	if err != nil {
+		return response, nil, fmt.Errorf("reading varnishlog: %w", err)
+	}
+	trace := &RequestTrace{Messages: messages}
+	if r.vclShowResult != nil {
+		trace.VCL = r.collectTrace(r.vclShowResult, logOffset)
+	}
+	return response, trace, nil
+}
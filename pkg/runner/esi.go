@@ -0,0 +1,29 @@
+package runner
+
+import (
+	"github.com/perbu/vcltest/pkg/assertion"
+	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/recorder"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// checkESI checks esi expectations against the response and the VSL of the
+// request that started at logStart: its ESI subrequests and parent fetch
+func (r *Runner) checkESI(exp *testspec.ESIExpectations, logStart int64, response *client.Response, result *assertion.Result) {
+	if r.recorder == nil || logStart < 0 {
+		assertion.CheckESI(exp, response, nil, "varnishlog is not recording", result)
+		return
+	}
+	end, err := r.recorder.MarkPosition()
+	if err != nil {
+		assertion.CheckESI(exp, response, nil, "reading varnishlog: "+err.Error(), result)
+		return
+	}
+	messages, err := r.recorder.GetMessagesBetween(logStart, end)
+	if err != nil {
+		assertion.CheckESI(exp, response, nil, "reading varnishlog: "+err.Error(), result)
+		return
+	}
+	esi := recorder.ParseESI(messages)
+	assertion.CheckESI(exp, response, &esi, "", result)
+}
@@ -0,0 +1,71 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/assertion"
+	"github.com/perbu/vcltest/pkg/recorder"
+)
+
+// ExplainedStep holds the assertion explanations of one request. Step is 0
+// for single-request tests.
+type ExplainedStep struct {
+	Step         int                     `json:"step,omitempty"`                                                                                   // 1-based scenario step number
+	At           time.Duration           `json:"at,omitempty" jsonschema:"description=Simulated time offset in nanoseconds (scenario tests only)"` // Simulated time offset (scenario tests only)
+	Explanations []assertion.Explanation `json:"explanations,omitempty"`
+}
+
+// addVSLEvidence adds what varnishlog recorded for the request to the
+// explanations of cache.hit and backend assertions, which are otherwise
+// inferred from response headers and mock backend counters
+func (r *Runner) addVSLEvidence(result *assertion.Result, logStart int64) {
+	end, err := r.recorder.MarkPosition()
+	if err != nil {
+		return
+	}
+	messages, err := r.recorder.GetMessagesBetween(logStart, end)
+	if err != nil {
+		r.logger.Debug("Failed to read VSL for explanations", "error", err)
+		return
+	}
+	evidence := vslEvidence(messages)
+
+	for i, e := range result.Explanations {
+		if e.Field == "cache.hit" || strings.HasPrefix(e.Field, "backend") {
+			result.Explanations[i].Derivation += "; " + evidence
+		}
+	}
+}
+
+// vslEvidence summarizes the cache outcome and backend connections of a
+// request's VSL records, e.g. "VSL: VCL_call MISS, BackendOpen default"
+func vslEvidence(messages []recorder.Message) string {
+	outcome := "no VCL_call HIT/MISS/PASS/PIPE"
+	fetches := 0
+	var backends []string
+	for _, msg := range messages {
+		switch msg.Type {
+		case recorder.MessageTypeVCLCall:
+			switch msg.Content {
+			case "HIT", "MISS", "PASS", "PIPE":
+				if strings.HasPrefix(outcome, "no ") {
+					outcome = "VCL_call " + msg.Content
+				}
+			case "BACKEND_FETCH":
+				fetches++
+			}
+		case recorder.MessageTypeBackendOpen:
+			if call, ok := recorder.ParseBackendCall(msg); ok {
+				backends = append(backends, call.BackendName)
+			}
+		}
+	}
+
+	parts := []string{outcome, fmt.Sprintf("%d VCL_call BACKEND_FETCH", fetches)}
+	if len(backends) > 0 {
+		parts = append(parts, "BackendOpen "+strings.Join(backends, ", "))
+	}
+	return "VSL: " + strings.Join(parts, ", ")
+}
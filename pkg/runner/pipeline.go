@@ -0,0 +1,95 @@
+package runner
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/assertion"
+	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/recorder"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// runPipelineTestWithSharedVCL sends the requests of a pipeline test on one
+// connection and checks each response, in order, against its step
+func (r *Runner) runPipelineTestWithSharedVCL(test testspec.TestSpec) (*TestResult, error) {
+	var logOffset int64
+	var err error
+	if r.recorder != nil {
+		logOffset, err = r.recorder.MarkPosition()
+		if err != nil {
+			r.logger.Warn("Failed to mark log position", "error", err)
+		}
+	}
+
+	reqs := make([]testspec.RequestSpec, len(test.Pipeline))
+	for i, step := range test.Pipeline {
+		reqs[i] = step.Request
+	}
+	pipelined, err := client.Pipeline(r.varnishURL, reqs, r.recordExchange)
+	if err != nil {
+		return nil, fmt.Errorf("pipelining requests: %w", err)
+	}
+	r.logger.Debug("Pipelined requests completed", "requests", len(reqs), "responses", len(pipelined.Responses), "closed", pipelined.Closed)
+	if r.recorder != nil {
+		if err := r.recorder.Flush(); err != nil {
+			r.logger.Warn("Failed to flush varnishlog", "error", err)
+		}
+	}
+
+	result := &TestResult{TestName: test.Name, Passed: true}
+	for i, step := range test.Pipeline {
+		prefix := fmt.Sprintf("Response %d (%s %s)", i+1, step.Request.Method, step.Request.URL)
+		if i >= len(pipelined.Responses) {
+			if !step.NoResponse {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: no response, Varnish closed the connection after %d response(s)%s",
+					prefix, len(pipelined.Responses), describeWriteErr(pipelined.WriteErr)))
+				result.SpecLocations = append(result.SpecLocations, failedLocations(&test, i+1, &assertion.Result{})...)
+			}
+			continue
+		}
+
+		response := pipelined.Responses[i]
+		r.redactor.AddHTTPHeaders(response.Headers)
+		if step.NoResponse {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: expected the connection to be closed without a response, got status %d",
+				prefix, response.Status))
+			result.SpecLocations = append(result.SpecLocations, failedLocations(&test, i+1, &assertion.Result{})...)
+			continue
+		}
+
+		assertResult := assertion.Check(step.Expectations, response, nil, nil, nil)
+		for _, msg := range assertResult.Errors {
+			result.Errors = append(result.Errors, prefix+": "+msg)
+		}
+		result.SpecLocations = append(result.SpecLocations, failedLocations(&test, i+1, assertResult)...)
+		if r.explain {
+			result.Explained = append(result.Explained, ExplainedStep{Step: i + 1, Explanations: assertResult.Explanations})
+		}
+	}
+	result.Passed = len(result.Errors) == 0
+
+	if (!result.Passed || r.collectTraces) && r.recorder != nil && r.vclShowResult != nil {
+		result.VCLTrace = r.collectTrace(r.vclShowResult, logOffset)
+		if messages, err := r.recorder.GetMessagesSince(logOffset); err != nil {
+			r.logger.Warn("Failed to read pipeline messages", "error", err)
+		} else {
+			r.attributeRequests(result.VCLTrace, recorder.SplitRequests(messages))
+		}
+	}
+	if r.collectTimeline && r.recorder != nil {
+		result.Timeline = r.buildTimeline(test.Name, []int64{logOffset}, []time.Duration{0})
+	}
+	if r.recorder != nil {
+		result.VCL = r.collectVCL(logOffset)
+	}
+	return result, nil
+}
+
+// describeWriteErr explains an early close that cut off the requests
+func describeWriteErr(err error) string {
+	if err == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (it stopped reading the requests: %v)", err)
+}
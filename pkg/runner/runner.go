@@ -1,6 +1,7 @@
 package runner
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,8 +18,11 @@ import (
 	"github.com/perbu/vcltest/pkg/backend"
 	"github.com/perbu/vcltest/pkg/client"
 	"github.com/perbu/vcltest/pkg/coverage"
+	"github.com/perbu/vcltest/pkg/formatter"
 	"github.com/perbu/vcltest/pkg/recorder"
+	"github.com/perbu/vcltest/pkg/redact"
 	"github.com/perbu/vcltest/pkg/testspec"
+	"github.com/perbu/vcltest/pkg/timeline"
 	"github.com/perbu/vcltest/pkg/varnishadm"
 	"github.com/perbu/vcltest/pkg/vclloader"
 	"github.com/perbu/vcltest/pkg/vclmod"
@@ -33,11 +38,13 @@ func convertRoutes(routes map[string]testspec.RouteSpec) map[string]backend.Rout
 	result := make(map[string]backend.RouteConfig, len(routes))
 	for path, spec := range routes {
 		result[path] = backend.RouteConfig{
-			Status:      spec.Status,
-			Headers:     spec.Headers,
-			Body:        spec.Body,
-			FailureMode: spec.FailureMode,
-			EchoRequest: spec.EchoRequest,
+			Status:         spec.Status,
+			Headers:        spec.Headers,
+			Body:           spec.Body,
+			FailureMode:    spec.FailureMode,
+			EchoRequest:    spec.EchoRequest,
+			EchoConnection: spec.EchoConnection,
+			Generate:       spec.Generate.Generated(),
 		}
 	}
 	return result
@@ -58,25 +65,69 @@ func sanitizeVCLName(name string) string {
 
 // TestResult represents the outcome of a single test
 type TestResult struct {
-	TestName string
-	Passed   bool
-	Errors   []string
-	VCLTrace *VCLTraceInfo // VCL execution trace (only populated on failure)
+	TestName string             `json:"test_name"`
+	ID       string             `json:"id"`                                                                           // Stable test ID (see testspec.TestID), set by the harness
+	Duration time.Duration      `json:"duration" jsonschema:"description=Wall-clock time of the test in nanoseconds"` // Wall-clock time of the test, set by the harness
+	Passed   bool               `json:"passed"`
+	Errors   []string           `json:"errors,omitempty"`
+	Failures []StepFailure      `json:"failures,omitempty"`  // Scenario assertion failures with their simulated time (scenario tests only)
+	VCLTrace *VCLTraceInfo      `json:"vcl_trace,omitempty"` // VCL execution trace (only populated on failure)
+	Timeline *timeline.Timeline `json:"timeline,omitempty"`  // Ordered VSL events (only with SetCollectTimeline)
+	Warmup   *WarmupReport      `json:"warmup,omitempty"`    // Warmup requests made before the test (only with warmup_from)
+	VCL      []TransactionVCL   `json:"vcl,omitempty"`       // VCL that handled each transaction, in log order
+
+	// SpecLocations are where the failed expectations are set in the test file
+	SpecLocations []testspec.Location `json:"spec_locations,omitempty"`
+
+	// VarnishParams are the parameters of the test's matrix cell
+	VarnishParams map[string]string `json:"varnish_params,omitempty"`
+
+	// Explained holds how each assertion was derived, per request (only with SetExplain)
+	Explained []ExplainedStep `json:"explained,omitempty"`
+
+	// Annotations from the test spec
+	Owner       string `json:"owner,omitempty"`
+	Link        string `json:"link,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// StepFailure is an assertion failure in a scenario step, with the position
+// of the step on the simulated clock
+type StepFailure struct {
+	Step    int           `json:"step"`                                                                             // 1-based step number
+	At      time.Duration `json:"at" jsonschema:"description=Simulated time offset from test start in nanoseconds"` // Simulated time offset from test start
+	Message string        `json:"message"`                                                                          // Assertion message, without the step prefix
+}
+
+// String formats the failure as it appears in Errors,
+// e.g. "Step 2 (at T+3600s simulated): Cache hit: expected true, got false"
+func (f StepFailure) String() string {
+	return fmt.Sprintf("Step %d (at %s): %s", f.Step, formatter.FormatSimulatedTime(f.At), f.Message)
 }
 
 // VCLTraceInfo contains VCL execution trace information
 type VCLTraceInfo struct {
-	Files        []VCLFileInfo // VCL files with execution traces (main + includes)
-	BackendCalls int
+	Files        []VCLFileInfo `json:"files"` // VCL files with execution traces (main + includes)
+	BackendCalls int           `json:"backend_calls"`
 }
 
 // VCLFileInfo contains source and execution trace for a single VCL file
 type VCLFileInfo struct {
-	ConfigID      int                  // Config ID from Varnish
-	Filename      string               // Full path to VCL file
-	Source        string               // VCL source code
-	ExecutedLines []int                // Lines that executed in this file (legacy, for backward compat)
-	Blocks        *coverage.FileBlocks // Block-level coverage analysis (new)
+	ConfigID      int                  `json:"config_id"`                // Config ID from Varnish
+	Filename      string               `json:"filename"`                 // Full path to VCL file
+	Source        string               `json:"source"`                   // VCL source code
+	RelativePath  string               `json:"relative_path,omitempty"`  // Path relative to the main VCL directory (empty for builtin)
+	ExecutedLines []int                `json:"executed_lines,omitempty"` // Lines that executed in this file (legacy, for backward compat)
+	Blocks        *coverage.FileBlocks `json:"blocks,omitempty"`         // Block-level coverage analysis (new)
+}
+
+// TransactionVCL is the VCL that handled a client or backend transaction of
+// the test, from varnishlog
+type TransactionVCL struct {
+	Kind      string `json:"kind"`                 // "req" or "bereq"
+	VCL       string `json:"vcl"`                  // Loaded VCL name
+	Label     string `json:"label,omitempty"`      // Label the VCL was reached through
+	ConfigIDs []int  `json:"config_ids,omitempty"` // Config IDs (source files) with executed lines
 }
 
 // TimeController interface for time manipulation in tests
@@ -99,6 +150,43 @@ type Runner struct {
 
 	// Mock backends for dynamic reconfiguration in scenario tests
 	mockBackends map[string]*backend.MockBackend
+
+	// collectTraces attaches VCL traces to passing tests too (for coverage recording)
+	collectTraces bool
+
+	// collectTimeline attaches a timeline of VSL events to every test result
+	collectTimeline bool
+
+	// redactor learns secret header values from responses (nil = no redaction)
+	redactor *redact.Redactor
+
+	// explain attaches assertion explanations to every test result
+	explain bool
+
+	// transport pools keep-alive connections to Varnish for the whole suite;
+	// roundTripper is it, or it wrapped by SetTransportWrapper, and
+	// httpClient uses that for requests without a cookie jar
+	transport    *http.Transport
+	roundTripper http.RoundTripper
+	httpClient   *http.Client
+
+	// recordExchange receives pipelined exchanges, which bypass the
+	// transport (nil = not recorded)
+	recordExchange client.ExchangeRecorder
+
+	// calls holds the backend calls of the running scenario, for
+	// calls_between expectations (nil outside scenarios)
+	calls *callHistory
+
+	// blockCache holds the coverage blocks of each loaded VCL file by config
+	// ID, so failing tests do not parse the same source again
+	blockCache map[int]cachedBlocks
+}
+
+// cachedBlocks is a coverage analysis of one VCL source, before trace matching
+type cachedBlocks struct {
+	source string
+	blocks *coverage.FileBlocks
 }
 
 // New creates a new test runner with a recorder
@@ -106,15 +194,56 @@ func New(varnishadm varnishadm.VarnishadmInterface, varnishURL, workDir string,
 	if logger == nil {
 		logger = slog.Default()
 	}
+	transport := client.NewTransport()
 	return &Runner{
-		varnishadm: varnishadm,
-		varnishURL: varnishURL,
-		workDir:    workDir,
-		logger:     logger,
-		recorder:   rec,
+		varnishadm:   varnishadm,
+		varnishURL:   varnishURL,
+		workDir:      workDir,
+		logger:       logger,
+		recorder:     rec,
+		transport:    transport,
+		roundTripper: transport,
+		httpClient:   client.NewHTTPClient(transport, nil),
 	}
 }
 
+// SetTransportWrapper wraps the transport of every request the runner makes
+// through MakeRequest. Pipelined requests use their own connection and are
+// not wrapped. Call it before running tests.
+func (r *Runner) SetTransportWrapper(wrap client.TransportWrapper) {
+	if wrap == nil || r.transport == nil {
+		return
+	}
+	r.roundTripper = wrap(r.transport)
+	r.httpClient = client.NewHTTPClient(r.roundTripper, nil)
+}
+
+// SetExchangeRecorder records the pipelined requests, which do not go through
+// the transport wrapper. Call it before running tests.
+func (r *Runner) SetExchangeRecorder(record client.ExchangeRecorder) {
+	r.recordExchange = record
+}
+
+// CloseIdleConnections closes the pooled connections to Varnish. Call it
+// before stopping Varnish, so it does not wait for idle sessions.
+func (r *Runner) CloseIdleConnections() {
+	if r.transport != nil {
+		r.transport.CloseIdleConnections()
+	}
+	if closer, ok := r.roundTripper.(interface{ CloseIdleConnections() }); ok && r.roundTripper != http.RoundTripper(r.transport) {
+		closer.CloseIdleConnections()
+	}
+}
+
+// newHTTPClient returns a client over the suite's pooled transport, with jar
+// for cookie persistence
+func (r *Runner) newHTTPClient(jar http.CookieJar) *http.Client {
+	if r.roundTripper == nil {
+		return client.NewHTTPClient(&http.Transport{DisableKeepAlives: true, ExpectContinueTimeout: client.ExpectContinueTimeout}, jar)
+	}
+	return client.NewHTTPClient(r.roundTripper, jar)
+}
+
 // SetTimeController sets the time controller for temporal testing
 func (r *Runner) SetTimeController(tc TimeController) {
 	r.timeController = tc
@@ -125,6 +254,30 @@ func (r *Runner) SetMockBackends(backends map[string]*backend.MockBackend) {
 	r.mockBackends = backends
 }
 
+// SetCollectTraces controls whether VCL traces are attached to all test results,
+// not only failing ones. Used when recording per-test coverage.
+func (r *Runner) SetCollectTraces(collect bool) {
+	r.collectTraces = collect
+}
+
+// SetCollectTimeline controls whether a timeline of client requests, VCL
+// states and backend fetches is attached to every test result
+func (r *Runner) SetCollectTimeline(collect bool) {
+	r.collectTimeline = collect
+}
+
+// SetExplain controls whether test results carry an explanation of how each
+// assertion's value was derived, pass or fail
+func (r *Runner) SetExplain(explain bool) {
+	r.explain = explain
+}
+
+// SetRedactor sets the redactor that records secret header values seen in
+// responses, so they can be masked in test output
+func (r *Runner) SetRedactor(redactor *redact.Redactor) {
+	r.redactor = redactor
+}
+
 // SetVCLShowResult sets the VCL show result for trace correlation
 // This is used when VCL is loaded at boot time (new simplified flow)
 func (r *Runner) SetVCLShowResult(vclShow *varnishadm.VCLShowResult) {
@@ -132,9 +285,90 @@ func (r *Runner) SetVCLShowResult(vclShow *varnishadm.VCLShowResult) {
 	r.loadedVCLName = "boot" // Mark as loaded
 }
 
-// parseDuration parses a duration string like "0s", "30s", "2m" into time.Duration
-func parseDuration(s string) (time.Duration, error) {
-	return time.ParseDuration(s)
+// setBackendsUp stops (up=false) or restarts (up=true) the listeners of the named backends
+func setBackendsUp(backends map[string]*backend.MockBackend, names []string, up bool) error {
+	for _, name := range names {
+		mock, ok := backends[name]
+		if !ok {
+			return fmt.Errorf("unknown backend %q", name)
+		}
+		var err error
+		if up {
+			err = mock.Up()
+		} else {
+			err = mock.Down()
+		}
+		if err != nil {
+			return fmt.Errorf("backend %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// restoreBackends restarts any shared mock backend left down by a scenario
+func (r *Runner) restoreBackends() {
+	for name, mock := range r.mockBackends {
+		if err := mock.Up(); err != nil {
+			r.logger.Warn("Failed to restart backend", "backend", name, "error", err)
+		}
+	}
+}
+
+// paramOverrides tracks varnishd parameters changed by a test, so they can be
+// restored to their original values afterwards
+type paramOverrides struct {
+	varnishadm varnishadm.VarnishadmInterface
+	original   map[string]string // Value before the test first changed it
+	order      []string          // Names in the order they were first changed
+}
+
+func newParamOverrides(adm varnishadm.VarnishadmInterface) *paramOverrides {
+	return &paramOverrides{varnishadm: adm, original: make(map[string]string)}
+}
+
+// set applies params via param.set (in name order), remembering original values
+func (p *paramOverrides) set(params map[string]string) error {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, saved := p.original[name]; !saved {
+			value, err := varnishadm.ParamGet(p.varnishadm, name)
+			if err != nil {
+				return fmt.Errorf("reading %s: %w", name, err)
+			}
+			p.original[name] = value
+			p.order = append(p.order, name)
+		}
+		if _, err := p.varnishadm.ParamSet(name, params[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore sets every changed parameter back to its original value, in one
+// batch so that no other command runs against a half-restored set
+func (p *paramOverrides) restore(logger *slog.Logger) {
+	cmds := make([]string, len(p.order))
+	for i, name := range p.order {
+		cmds[i] = fmt.Sprintf("param.set %s %s", name, varnishadm.QuoteArg(p.original[name]))
+	}
+	responses, err := p.varnishadm.Batch(cmds...)
+	if err != nil {
+		logger.Warn("Failed to restore parameters", "params", p.order, "error", err)
+	}
+	for i, resp := range responses {
+		if resp.StatusCode() != varnishadm.ClisOk {
+			name := p.order[i]
+			logger.Warn("Failed to restore parameter", "param", name, "value", p.original[name], "status", resp.StatusCode(), "error", resp.Payload())
+		}
+	}
+	p.original = make(map[string]string)
+	p.order = nil
 }
 
 // backendManager manages multiple mock backends for a test
@@ -155,12 +389,16 @@ func (r *Runner) startBackends(test testspec.TestSpec) (*backendManager, map[str
 	// Start backends from test.Backends map
 	for name, spec := range test.Backends {
 		cfg := backend.Config{
-			Status:      spec.Status,
-			Headers:     spec.Headers,
-			Body:        spec.Body,
-			FailureMode: spec.FailureMode,
-			Routes:      convertRoutes(spec.Routes),
-			EchoRequest: spec.EchoRequest,
+			Status:         spec.Status,
+			Headers:        spec.Headers,
+			Body:           spec.Body,
+			FailureMode:    spec.FailureMode,
+			Routes:         convertRoutes(spec.Routes),
+			EchoRequest:    spec.EchoRequest,
+			EchoConnection: spec.EchoConnection,
+			Generate:       spec.Generate.Generated(),
+			ServeDir:       spec.ServeDir,
+			Bandwidth:      int64(spec.Bandwidth),
 		}
 		// Apply default status if not set
 		if cfg.Status == 0 {
@@ -221,6 +459,291 @@ func (bm *backendManager) resetCallCounts() {
 	}
 }
 
+// mockCallCounts returns call counts for the shared mock backends
+func (r *Runner) mockCallCounts() map[string]int {
+	counts := make(map[string]int)
+	for name, backend := range r.mockBackends {
+		counts[name] = backend.GetCallCount()
+	}
+	return counts
+}
+
+// resetMockCallCounts resets call counts for the shared mock backends
+func (r *Runner) resetMockCallCounts() {
+	for _, backend := range r.mockBackends {
+		backend.ResetCallCount()
+	}
+}
+
+// lastRequests returns the last access log entry of each backend that
+// received a request
+func lastRequests(backends map[string]*backend.MockBackend) map[string]backend.Request {
+	last := make(map[string]backend.Request)
+	for name, mock := range backends {
+		if req, ok := mock.LastRequest(); ok {
+			last[name] = req
+		}
+	}
+	return last
+}
+
+// requestAndCheck makes the request to Varnish and checks the expectations
+// against the response. With expectations.eventually set, a failing check is
+// retried (request included) every interval until it passes or the timeout
+// expires, and the last attempt is reported. If resetCalls is set it runs
+// before each attempt, so backend call counts cover the reported attempt only.
+// previous holds the responses of earlier scenario steps (nil otherwise); the
+// response of the reported attempt is returned for later steps to compare with.
+// Route parameter expectations are checked against the access logs of backends.
+func (r *Runner) requestAndCheck(httpClient *http.Client, req testspec.RequestSpec, exp testspec.ExpectationsSpec, previous []*client.Response, backendCalls func() map[string]int, resetCalls func(), backends map[string]*backend.MockBackend) (*assertion.Result, *client.Response, error) {
+	timeout, interval := exp.Eventually.Durations()
+	deadline := time.Now().Add(timeout)
+
+	// Build URL for cookie jar lookup
+	var jar http.CookieJar
+	var reqURL *url.URL
+	if httpClient != nil && httpClient.Jar != nil {
+		jar = httpClient.Jar
+		reqURL, _ = url.Parse(r.varnishURL + req.URL)
+	}
+	if httpClient == nil {
+		httpClient = r.httpClient
+	}
+
+	for attempt := 1; ; attempt++ {
+		if resetCalls != nil {
+			resetCalls()
+		}
+
+		// Mark the log so the request's VSL records can back up explanations,
+		// and storage, TTL and ESI expectations
+		checkTTL := exp.Cache.ChecksTTL()
+		logStart := int64(-1)
+		if (r.explain || exp.Storage != "" || checkTTL || exp.ESI != nil) && r.recorder != nil {
+			if pos, err := r.recorder.MarkPosition(); err == nil {
+				logStart = pos
+			}
+		}
+
+		requestStart := time.Now()
+		response, err := client.MakeRequest(httpClient, r.varnishURL, req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("making request: %w", err)
+		}
+		r.redactor.AddHTTPHeaders(response.Headers)
+		r.logger.Debug("HTTP request completed", "url", req.URL, "status", response.Status, "attempt", attempt, "duration_ms", time.Since(requestStart).Milliseconds())
+
+		// Flush varnishlog to ensure logs are written
+		if r.recorder != nil {
+			if err := r.recorder.Flush(); err != nil {
+				r.logger.Warn("Failed to flush varnishlog", "error", err)
+			}
+		}
+
+		result := assertion.Check(exp, response, backendCalls(), jar, reqURL)
+		assertion.CheckPrevious(&exp.Response, response, previous, result)
+		if exp.Backend != nil {
+			assertion.CheckBackendParams(exp.Backend, lastRequests(backends), result)
+			if len(exp.Backend.CallsBetween) > 0 && r.calls != nil {
+				assertion.CheckCallsBetween(exp.Backend.CallsBetween, r.calls.calls(), result)
+			}
+		}
+		if exp.Continue != nil {
+			assertion.CheckContinue(exp.Continue, response, lastRequests(backends), result)
+		}
+		if exp.Cache != nil && exp.Cache.HitRatio != nil {
+			if err := r.withoutBackendCalls(backends, func() error {
+				return r.checkHitRatio(httpClient, req, exp.Cache.HitRatio, result)
+			}); err != nil {
+				return nil, nil, err
+			}
+		}
+		if exp.Cache != nil && exp.Cache.AENormalization != nil {
+			if err := r.withoutBackendCalls(backends, func() error {
+				return r.checkAENormalization(httpClient, req, exp.Cache.AENormalization, backendCalls, result)
+			}); err != nil {
+				return nil, nil, err
+			}
+		}
+		if exp.Cache != nil && exp.Cache.CookieVariation != nil {
+			if err := r.withoutBackendCalls(backends, func() error {
+				return r.checkCookieVariation(httpClient, req, exp.Cache.CookieVariation, backendCalls, result)
+			}); err != nil {
+				return nil, nil, err
+			}
+		}
+		if exp.Storage != "" {
+			r.checkStorage(exp.Storage, logStart, response, result)
+		}
+		if checkTTL {
+			r.checkTTL(exp.Cache, logStart, response, result)
+		}
+		if exp.ESI != nil {
+			r.checkESI(exp.ESI, logStart, response, result)
+		}
+		if r.explain && logStart >= 0 {
+			r.addVSLEvidence(result, logStart)
+		}
+		if result.Passed || exp.Eventually == nil {
+			return result, response, nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			result.Errors = append(result.Errors, fmt.Sprintf("eventually: expectations not met within %s (%d attempts)", timeout, attempt))
+			return result, response, nil
+		}
+
+		r.logger.Debug("Expectations not met yet, retrying", "attempt", attempt, "interval", interval)
+		time.Sleep(interval)
+	}
+}
+
+// withoutBackendCalls runs fn, which makes requests of its own (the passes
+// of hit_ratio, ae_normalization and cookie_variation), and then sets the
+// mock backends' call counters and access logs back, so that backend.calls
+// and calls_between of this and later steps do not count those fetches
+func (r *Runner) withoutBackendCalls(backends map[string]*backend.MockBackend, fn func() error) error {
+	snapshots := make(map[string]backend.CallSnapshot, len(backends))
+	for name, mock := range backends {
+		snapshots[name] = mock.SnapshotCalls()
+	}
+	defer func() {
+		for name, mock := range backends {
+			mock.RestoreCalls(snapshots[name])
+		}
+	}()
+	return fn()
+}
+
+// checkHitRatio requests each URL of a cache.hit_ratio expectation (by
+// default, req's) twice, with the headers of req, and checks the hit ratio
+// of the second pass
+func (r *Runner) checkHitRatio(httpClient *http.Client, req testspec.RequestSpec, spec *testspec.HitRatioSpec, result *assertion.Result) error {
+	exp := spec
+	if len(exp.URLs) == 0 {
+		exp = &testspec.HitRatioSpec{URLs: []string{req.URL}, Min: spec.Min, Max: spec.Max}
+	}
+	responses := make([]*client.Response, len(exp.URLs))
+	for pass := 1; pass <= 2; pass++ {
+		for i, u := range exp.URLs {
+			response, err := client.MakeRequest(httpClient, r.varnishURL, testspec.RequestSpec{
+				Method:  "GET",
+				URL:     u,
+				Headers: req.Headers,
+			})
+			if err != nil {
+				return fmt.Errorf("hit_ratio: requesting %s: %w", u, err)
+			}
+			r.redactor.AddHTTPHeaders(response.Headers)
+			responses[i] = response
+		}
+	}
+	r.logger.Debug("Hit ratio URLs requested", "urls", len(exp.URLs))
+
+	assertion.CheckHitRatio(exp, responses, result)
+	return nil
+}
+
+// checkAENormalization requests the URL of a cache.ae_normalization
+// expectation with each Accept-Encoding value, in two passes, and checks the
+// cached objects serving the second pass
+func (r *Runner) checkAENormalization(httpClient *http.Client, req testspec.RequestSpec, exp *testspec.AENormalizationSpec, backendCalls func() map[string]int, result *assertion.Result) error {
+	target := exp.URL
+	if target == "" {
+		target = req.URL
+	}
+	values := exp.Values
+	if len(values) == 0 {
+		values = testspec.DefaultAEValues
+	}
+
+	countFetches := func() int {
+		total := 0
+		for _, calls := range backendCalls() {
+			total += calls
+		}
+		return total
+	}
+	before := countFetches()
+
+	responses := make([]*client.Response, len(values))
+	for pass := 1; pass <= 2; pass++ {
+		for i, value := range values {
+			headers := make(map[string]string, len(req.Headers)+1)
+			for name, v := range req.Headers {
+				if !strings.EqualFold(name, "Accept-Encoding") {
+					headers[name] = v
+				}
+			}
+			if value != "" {
+				headers["Accept-Encoding"] = value
+			}
+			response, err := client.MakeRequest(httpClient, r.varnishURL, testspec.RequestSpec{
+				Method:  "GET",
+				URL:     target,
+				Headers: headers,
+			})
+			if err != nil {
+				return fmt.Errorf("ae_normalization: requesting %s with Accept-Encoding %q: %w", target, value, err)
+			}
+			r.redactor.AddHTTPHeaders(response.Headers)
+			responses[i] = response
+		}
+	}
+	r.logger.Debug("Accept-Encoding matrix requested", "url", target, "values", len(values))
+
+	assertion.CheckAENormalization(exp, values, responses, countFetches()-before, result)
+	return nil
+}
+
+// checkCookieVariation requests the URL of a cache.cookie_variation
+// expectation with each cookie combination, in two passes, and checks the
+// cached objects serving the second pass
+func (r *Runner) checkCookieVariation(httpClient *http.Client, req testspec.RequestSpec, exp *testspec.CookieVariationSpec, backendCalls func() map[string]int, result *assertion.Result) error {
+	target := exp.URL
+	if target == "" {
+		target = req.URL
+	}
+	rows := exp.Rows()
+
+	countFetches := func() int {
+		total := 0
+		for _, calls := range backendCalls() {
+			total += calls
+		}
+		return total
+	}
+	before := countFetches()
+
+	responses := make([]*client.Response, len(rows))
+	for pass := 1; pass <= 2; pass++ {
+		for i, row := range rows {
+			headers := make(map[string]string, len(req.Headers)+1)
+			for name, v := range req.Headers {
+				if !strings.EqualFold(name, "Cookie") {
+					headers[name] = v
+				}
+			}
+			if row.Cookie != "" {
+				headers["Cookie"] = row.Cookie
+			}
+			response, err := client.MakeRequest(httpClient, r.varnishURL, testspec.RequestSpec{
+				Method:  "GET",
+				URL:     target,
+				Headers: headers,
+			})
+			if err != nil {
+				return fmt.Errorf("cookie_variation: requesting %s with Cookie %q: %w", target, row.Cookie, err)
+			}
+			r.redactor.AddHTTPHeaders(response.Headers)
+			responses[i] = response
+		}
+	}
+	r.logger.Debug("Cookie matrix requested", "url", target, "combinations", len(rows))
+
+	assertion.CheckCookieVariation(rows, responses, countFetches()-before, result)
+	return nil
+}
+
 // replaceBackendsInVCL performs backend replacement using AST-based modification
 func (r *Runner) replaceBackendsInVCL(vclContent string, vclPath string, backends map[string]vclloader.BackendAddress) (string, error) {
 	// Convert to vclmod.BackendAddress type
@@ -276,26 +799,31 @@ func (r *Runner) extractVCLFiles(vclShow *varnishadm.VCLShowResult, execByConfig
 
 		// Perform block-level analysis
 		var blocks *coverage.FileBlocks
-		fb, err := coverage.AnalyzeVCL(entry.Source, entry.Filename)
+		fb, err := r.analyzeBlocks(entry)
 		if err != nil {
 			r.logger.Warn("Failed to analyze VCL for block coverage",
 				"file", entry.Filename, "error", err)
 		} else {
+			// Block logging is skipped unless enabled, since it runs per test
+			debug := r.logger.Enabled(context.Background(), slog.LevelDebug)
+
 			// Debug: log block structure before matching
-			for _, b := range fb.Blocks {
-				r.logger.Debug("Block found",
-					"type", b.Type,
-					"name", b.Name,
-					"header_line", b.HeaderLine,
-					"open_brace", b.OpenBrace,
-					"close_brace", b.CloseBrace)
-				for _, c := range b.Children {
-					r.logger.Debug("  Child block",
-						"type", c.Type,
-						"name", c.Name,
-						"header_line", c.HeaderLine,
-						"open_brace", c.OpenBrace,
-						"close_brace", c.CloseBrace)
+			if debug {
+				for _, b := range fb.Blocks {
+					r.logger.Debug("Block found",
+						"type", b.Type,
+						"name", b.Name,
+						"header_line", b.HeaderLine,
+						"open_brace", b.OpenBrace,
+						"close_brace", b.CloseBrace)
+					for _, c := range b.Children {
+						r.logger.Debug("  Child block",
+							"type", c.Type,
+							"name", c.Name,
+							"header_line", c.HeaderLine,
+							"open_brace", c.OpenBrace,
+							"close_brace", c.CloseBrace)
+					}
 				}
 			}
 
@@ -304,15 +832,17 @@ func (r *Runner) extractVCLFiles(vclShow *varnishadm.VCLShowResult, execByConfig
 			fb.ConfigID = entry.ConfigID
 
 			// Debug: log match results
-			for _, b := range fb.Blocks {
-				r.logger.Debug("Block coverage result",
-					"type", b.Type,
-					"name", b.Name,
-					"entered", b.Entered)
-				for _, c := range b.Children {
-					r.logger.Debug("  Child coverage result",
-						"type", c.Type,
-						"entered", c.Entered)
+			if debug {
+				for _, b := range fb.Blocks {
+					r.logger.Debug("Block coverage result",
+						"type", b.Type,
+						"name", b.Name,
+						"entered", b.Entered)
+					for _, c := range b.Children {
+						r.logger.Debug("  Child coverage result",
+							"type", c.Type,
+							"entered", c.Entered)
+					}
 				}
 			}
 
@@ -322,6 +852,7 @@ func (r *Runner) extractVCLFiles(vclShow *varnishadm.VCLShowResult, execByConfig
 		files = append(files, VCLFileInfo{
 			ConfigID:      entry.ConfigID,
 			Filename:      entry.Filename,
+			RelativePath:  r.relativeVCLPath(entry.Filename),
 			Source:        entry.Source, // Use pre-parsed source from VCLConfigEntry
 			ExecutedLines: executedLines,
 			Blocks:        blocks,
@@ -331,6 +862,98 @@ func (r *Runner) extractVCLFiles(vclShow *varnishadm.VCLShowResult, execByConfig
 	return files
 }
 
+// analyzeBlocks returns a fresh copy of the coverage blocks of a loaded VCL
+// file. The analysis is cached by config ID, since every failing test of the
+// suite traces the same loaded VCL.
+func (r *Runner) analyzeBlocks(entry varnishadm.VCLConfigEntry) (*coverage.FileBlocks, error) {
+	if cached, ok := r.blockCache[entry.ConfigID]; ok && cached.source == entry.Source {
+		return cached.blocks.Clone(), nil
+	}
+	fb, err := coverage.AnalyzeVCL(entry.Source, entry.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if r.blockCache == nil {
+		r.blockCache = make(map[int]cachedBlocks)
+	}
+	r.blockCache[entry.ConfigID] = cachedBlocks{source: entry.Source, blocks: fb.Clone()}
+	return fb, nil
+}
+
+// relativeVCLPath returns the path of a loaded VCL file relative to the vcl
+// directory in workDir, or "" if the file does not live there (e.g. builtin).
+func (r *Runner) relativeVCLPath(filename string) string {
+	vclDir := filepath.Join(r.workDir, "vcl")
+	rel, err := filepath.Rel(vclDir, filename)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return rel
+}
+
+// markStep flushes varnishlog and returns the log position where a timeline
+// step starts. Flushing first keeps the previous step's records out of it.
+func (r *Runner) markStep() int64 {
+	if err := r.recorder.Flush(); err != nil {
+		r.logger.Warn("Failed to flush varnishlog", "error", err)
+	}
+	offset, err := r.recorder.MarkPosition()
+	if err != nil {
+		r.logger.Warn("Failed to mark log position", "error", err)
+	}
+	return offset
+}
+
+// buildTimeline builds a test's timeline from the VSL logged from each
+// step's offset up to the next step
+func (r *Runner) buildTimeline(testName string, offsets []int64, ats []time.Duration) *timeline.Timeline {
+	messages, err := r.stepMessages(offsets)
+	if err != nil {
+		r.logger.Warn("Failed to read timeline messages", "error", err)
+		return nil
+	}
+	steps := make([]timeline.Step, len(offsets))
+	for i := range offsets {
+		steps[i] = timeline.Step{At: ats[i], Messages: messages[i]}
+	}
+	return timeline.Build(testName, steps)
+}
+
+// collectTrace builds trace information from VCL messages logged since offset
+func (r *Runner) collectTrace(vclShow *varnishadm.VCLShowResult, offset int64) *VCLTraceInfo {
+	messages, err := r.recorder.GetVCLMessagesSince(offset)
+	if err != nil {
+		r.logger.Warn("Failed to get VCL messages", "error", err)
+		return nil
+	}
+
+	// Get per-config execution using ConfigMap from Varnish
+	execByConfig := recorder.GetExecutedLinesByConfig(messages, vclShow.ConfigMap)
+
+	// Extract VCL files with execution traces
+	files := r.extractVCLFiles(vclShow, execByConfig)
+
+	summary := recorder.GetTraceSummary(messages)
+	return &VCLTraceInfo{
+		Files:        files,
+		BackendCalls: summary.BackendCalls,
+	}
+}
+
+// collectVCL returns the VCL that handled each transaction logged since offset
+func (r *Runner) collectVCL(offset int64) []TransactionVCL {
+	messages, err := r.recorder.GetMessagesSince(offset)
+	if err != nil {
+		r.logger.Warn("Failed to get VCL messages", "error", err)
+		return nil
+	}
+	var vcls []TransactionVCL
+	for _, t := range recorder.TransactionVCLs(messages) {
+		vcls = append(vcls, TransactionVCL{Kind: t.Kind, VCL: t.VCL, Label: t.Label, ConfigIDs: t.ConfigIDs})
+	}
+	return vcls
+}
+
 // LoadVCL loads VCL file and prepares it for sharing across all tests
 func (r *Runner) LoadVCL(vclPath string, backends map[string]vclloader.BackendAddress) error {
 	// Convert to vclmod.BackendAddress type
@@ -481,9 +1104,12 @@ func (r *Runner) RunTest(test testspec.TestSpec, vclPath string) (*TestResult, e
 	// Check if this is a scenario-based test
 	var result *TestResult
 	var err error
-	if test.IsScenario() {
+	switch {
+	case test.IsScenario():
 		result, err = r.runScenarioTest(test, vclPath)
-	} else {
+	case test.IsPipeline():
+		return nil, fmt.Errorf("pipeline tests need shared VCL (LoadVCL and RunTestWithSharedVCL)")
+	default:
 		result, err = r.runSingleRequestTest(test, vclPath)
 	}
 
@@ -502,14 +1128,40 @@ func (r *Runner) RunTestWithSharedVCL(test testspec.TestSpec) (*TestResult, erro
 	start := time.Now()
 	r.logger.Debug("Starting test execution with shared VCL", "test", test.Name)
 
+	// Matrix cell parameters apply to the whole test, warmup included
+	if len(test.VarnishParams) > 0 {
+		if r.varnishadm == nil {
+			return nil, fmt.Errorf("matrix parameters need varnishd")
+		}
+		params := newParamOverrides(r.varnishadm)
+		defer params.restore(r.logger)
+		if err := params.set(test.VarnishParams); err != nil {
+			return nil, fmt.Errorf("matrix: %w", err)
+		}
+	}
+
+	// Prime the cache; backend calls made by the warmup are not counted
+	var warmup *WarmupReport
+	if len(test.Warmup) > 0 {
+		warmup = r.warmup(test)
+		r.resetMockCallCounts()
+	}
+
 	// Check if this is a scenario-based test
 	var result *TestResult
 	var err error
-	if test.IsScenario() {
+	switch {
+	case test.IsScenario():
 		result, err = r.runScenarioTestWithSharedVCL(test)
-	} else {
+	case test.IsPipeline():
+		result, err = r.runPipelineTestWithSharedVCL(test)
+	default:
 		result, err = r.runSingleRequestTestWithSharedVCL(test)
 	}
+	if result != nil {
+		result.Warmup = warmup
+		result.VarnishParams = test.VarnishParams
+	}
 
 	duration := time.Since(start)
 	r.logger.Debug("Test execution completed", "test", test.Name, "passed", result != nil && result.Passed, "duration_ms", duration.Milliseconds())
@@ -614,34 +1266,21 @@ func (r *Runner) runSingleRequestTest(test testspec.TestSpec, vclPath string) (*
 		}
 	}
 
-	// Make HTTP request to Varnish
-	requestStart := time.Now()
-	response, err := client.MakeRequest(nil, r.varnishURL, test.Request)
+	// Make HTTP request to Varnish and check assertions (no cookie jar for single-request tests)
+	assertResult, _, err := r.requestAndCheck(nil, test.Request, test.Expectations, nil, bm.getCallCounts, bm.resetCallCounts, bm.backends)
 	if err != nil {
-		return nil, fmt.Errorf("making request: %w", err)
-	}
-	r.logger.Debug("HTTP request completed", "url", test.Request.URL, "status", response.Status, "duration_ms", time.Since(requestStart).Milliseconds())
-
-	// Flush varnishlog to ensure logs are written
-	if r.recorder != nil {
-		flushStart := time.Now()
-		if err := r.recorder.Flush(); err != nil {
-			r.logger.Warn("Failed to flush varnishlog", "error", err)
-		}
-		r.logger.Debug("Varnishlog flushed", "duration_ms", time.Since(flushStart).Milliseconds())
+		return nil, err
 	}
 
-	// Collect backend call counts
-	backendCalls := bm.getCallCounts()
-
-	// Check assertions (no cookie jar for single-request tests)
-	assertResult := assertion.Check(test.Expectations, response, backendCalls, nil, nil)
-
 	// Prepare test result
 	result := &TestResult{
-		TestName: test.Name,
-		Passed:   assertResult.Passed,
-		Errors:   assertResult.Errors,
+		TestName:      test.Name,
+		Passed:        assertResult.Passed,
+		Errors:        assertResult.Errors,
+		SpecLocations: failedLocations(&test, 0, assertResult),
+	}
+	if r.explain {
+		result.Explained = []ExplainedStep{{Explanations: assertResult.Explanations}}
 	}
 
 	// If test failed, collect and attach trace information
@@ -682,13 +1321,6 @@ func (r *Runner) runSingleRequestTest(test testspec.TestSpec, vclPath string) (*
 
 // runSingleRequestTestWithSharedVCL executes a single-request test with pre-loaded VCL
 func (r *Runner) runSingleRequestTestWithSharedVCL(test testspec.TestSpec) (*TestResult, error) {
-	// Reset backend call counts before test
-	if r.mockBackends != nil {
-		for _, backend := range r.mockBackends {
-			backend.ResetCallCount()
-		}
-	}
-
 	// Mark current log position before making request
 	var logOffset int64
 	var err error
@@ -699,59 +1331,32 @@ func (r *Runner) runSingleRequestTestWithSharedVCL(test testspec.TestSpec) (*Tes
 		}
 	}
 
-	// Make HTTP request to Varnish
-	requestStart := time.Now()
-	response, err := client.MakeRequest(nil, r.varnishURL, test.Request)
+	// Make HTTP request to Varnish and check assertions (no cookie jar for single-request tests)
+	assertResult, _, err := r.requestAndCheck(nil, test.Request, test.Expectations, nil, r.mockCallCounts, r.resetMockCallCounts, r.mockBackends)
 	if err != nil {
-		return nil, fmt.Errorf("making request: %w", err)
-	}
-	r.logger.Debug("HTTP request completed", "url", test.Request.URL, "status", response.Status, "duration_ms", time.Since(requestStart).Milliseconds())
-
-	// Flush varnishlog to ensure logs are written
-	if r.recorder != nil {
-		flushStart := time.Now()
-		if err := r.recorder.Flush(); err != nil {
-			r.logger.Warn("Failed to flush varnishlog", "error", err)
-		}
-		r.logger.Debug("Varnishlog flushed", "duration_ms", time.Since(flushStart).Milliseconds())
-	}
-
-	// Collect backend call counts
-	backendCalls := make(map[string]int)
-	if r.mockBackends != nil {
-		for name, backend := range r.mockBackends {
-			backendCalls[name] = backend.GetCallCount()
-		}
+		return nil, err
 	}
 
-	// Check assertions (no cookie jar for single-request tests)
-	assertResult := assertion.Check(test.Expectations, response, backendCalls, nil, nil)
-
 	// Prepare test result
 	result := &TestResult{
-		TestName: test.Name,
-		Passed:   assertResult.Passed,
-		Errors:   assertResult.Errors,
+		TestName:      test.Name,
+		Passed:        assertResult.Passed,
+		Errors:        assertResult.Errors,
+		SpecLocations: failedLocations(&test, 0, assertResult),
+	}
+	if r.explain {
+		result.Explained = []ExplainedStep{{Explanations: assertResult.Explanations}}
 	}
 
-	// If test failed, collect and attach trace information
-	if !assertResult.Passed && r.recorder != nil && r.vclShowResult != nil {
-		messages, err := r.recorder.GetVCLMessagesSince(logOffset)
-		if err != nil {
-			r.logger.Warn("Failed to get VCL messages", "error", err)
-		} else {
-			// Get per-config execution using ConfigMap from stored VCLShowResult
-			execByConfig := recorder.GetExecutedLinesByConfig(messages, r.vclShowResult.ConfigMap)
-
-			// Extract VCL files with execution traces
-			files := r.extractVCLFiles(r.vclShowResult, execByConfig)
-
-			summary := recorder.GetTraceSummary(messages)
-			result.VCLTrace = &VCLTraceInfo{
-				Files:        files,
-				BackendCalls: summary.BackendCalls,
-			}
-		}
+	// If test failed (or traces are requested), collect and attach trace information
+	if (!assertResult.Passed || r.collectTraces) && r.recorder != nil && r.vclShowResult != nil {
+		result.VCLTrace = r.collectTrace(r.vclShowResult, logOffset)
+	}
+	if r.collectTimeline && r.recorder != nil {
+		result.Timeline = r.buildTimeline(test.Name, []int64{logOffset}, []time.Duration{0})
+	}
+	if r.recorder != nil {
+		result.VCL = r.collectVCL(logOffset)
 	}
 
 	return result, nil
@@ -850,75 +1455,86 @@ func (r *Runner) runScenarioTest(test testspec.TestSpec, vclPath string) (*TestR
 		return nil, fmt.Errorf("creating cookie jar: %w", err)
 	}
 
-	// Create persistent HTTP client for this scenario
-	// DisableKeepAlives ensures connections are closed after each request,
-	// allowing varnish to shut down cleanly.
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-		},
-		Jar: jar,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
+	// HTTP client for this scenario, over the suite's connection pool
+	httpClient := r.newHTTPClient(jar)
+
+	// Parameters changed by set_param are restored when the test ends
+	params := newParamOverrides(r.varnishadm)
+	defer params.restore(r.logger)
 
 	// Execute scenario steps
 	var allErrors []string
+	var failures []StepFailure
+	var locations []testspec.Location
 	var firstFailedStep int = -1
 
+	// Response of each step, for comparisons with earlier steps
+	var responses []*client.Response
+	var explained []ExplainedStep
+
 	for stepIdx, step := range test.Scenario {
-		// Parse time offset
-		offset, err := parseDuration(step.At)
-		if err != nil {
-			return nil, fmt.Errorf("step %d: invalid time offset %q: %w", stepIdx+1, step.At, err)
-		}
+		offset := step.Offset()
 
 		// Advance time to this step's offset (absolute from test start)
 		if err := r.timeController.AdvanceTimeBy(offset); err != nil {
 			return nil, fmt.Errorf("step %d: failed to advance time: %w", stepIdx+1, err)
 		}
+		// Varnish may time out idle sessions once its clock has jumped
+		r.CloseIdleConnections()
 
-		r.logger.Debug("Executing scenario step", "step", stepIdx+1, "at", step.At)
-
-		// Make HTTP request to Varnish using persistent client with cookie jar
-		response, err := client.MakeRequest(httpClient, r.varnishURL, step.Request)
-		if err != nil {
-			return nil, fmt.Errorf("step %d: making request: %w", stepIdx+1, err)
+		// Apply varnishd parameter changes
+		if err := params.set(step.SetParam); err != nil {
+			return nil, fmt.Errorf("step %d: set_param: %w", stepIdx+1, err)
 		}
 
-		// Flush varnishlog to ensure logs are written
-		if r.recorder != nil {
-			if err := r.recorder.Flush(); err != nil {
-				r.logger.Warn("Failed to flush varnishlog", "error", err)
-			}
+		// Stop or restart backend listeners
+		if err := setBackendsUp(bm.backends, step.BackendDown, false); err != nil {
+			return nil, fmt.Errorf("step %d: backend_down: %w", stepIdx+1, err)
+		}
+		if err := setBackendsUp(bm.backends, step.BackendUp, true); err != nil {
+			return nil, fmt.Errorf("step %d: backend_up: %w", stepIdx+1, err)
 		}
 
-		// Collect backend call counts for this step
-		backendCalls := bm.getCallCounts()
-
-		// Build URL for cookie jar lookup
-		reqURL, _ := url.Parse(r.varnishURL + step.Request.URL)
+		r.logger.Debug("Executing scenario step", "step", stepIdx+1, "at", offset)
 
-		// Check assertions for this step
-		assertResult := assertion.Check(step.Expectations, response, backendCalls, jar, reqURL)
+		// Make HTTP request to Varnish using persistent client with cookie jar,
+		// and check assertions for this step (call counts are reset per step
+		// unless reset_backend_counts is false)
+		var resetCalls func()
+		if test.ResetsBackendCounts(stepIdx) {
+			resetCalls = bm.resetCallCounts
+		}
+		assertResult, response, err := r.requestAndCheck(httpClient, step.Request, step.Expectations, responses, bm.getCallCounts, resetCalls, bm.backends)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", stepIdx+1, err)
+		}
+		responses = append(responses, response)
+		if r.explain {
+			explained = append(explained, ExplainedStep{Step: stepIdx + 1, At: offset, Explanations: assertResult.Explanations})
+		}
 
 		if !assertResult.Passed {
 			if firstFailedStep == -1 {
 				firstFailedStep = stepIdx
 			}
+			locations = append(locations, failedLocations(&test, stepIdx+1, assertResult)...)
 			for _, err := range assertResult.Errors {
-				allErrors = append(allErrors, fmt.Sprintf("Step %d (at %s): %s", stepIdx+1, step.At, err))
+				failure := StepFailure{Step: stepIdx + 1, At: offset, Message: err}
+				failures = append(failures, failure)
+				allErrors = append(allErrors, failure.String())
 			}
 		}
 	}
 
 	// Prepare test result
 	result := &TestResult{
-		TestName: test.Name,
-		Passed:   len(allErrors) == 0,
-		Errors:   allErrors,
+		TestName:      test.Name,
+		Passed:        len(allErrors) == 0,
+		Errors:        allErrors,
+		Failures:      failures,
+		SpecLocations: locations,
 	}
+	result.Explained = explained
 
 	// If test failed, collect and attach trace information from first failed step
 	if !result.Passed && r.recorder != nil && vclShow != nil && firstFailedStep >= 0 {
@@ -969,46 +1585,74 @@ func (r *Runner) runScenarioTestWithSharedVCL(test testspec.TestSpec) (*TestResu
 		return nil, fmt.Errorf("creating cookie jar: %w", err)
 	}
 
-	// Create persistent HTTP client for this scenario
-	// DisableKeepAlives ensures connections are closed after each request,
-	// allowing varnish to shut down cleanly.
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-		},
-		Jar: jar,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+	// HTTP client for this scenario, over the suite's connection pool
+	httpClient := r.newHTTPClient(jar)
+
+	// Mark current log position so the trace only covers this test
+	var logOffset int64
+	if r.recorder != nil {
+		logOffset, err = r.recorder.MarkPosition()
+		if err != nil {
+			r.logger.Warn("Failed to mark log position", "error", err)
+		}
 	}
 
+	// Backends taken down by backend_down must not leak into later tests
+	defer r.restoreBackends()
+
+	// Parameters changed by set_param are restored when the test ends
+	params := newParamOverrides(r.varnishadm)
+	defer params.restore(r.logger)
+
+	// Backend calls of the whole scenario, for calls_between
+	r.calls = newCallHistory(r.mockBackends)
+	defer func() { r.calls = nil }()
+
 	// Execute scenario steps
 	var allErrors []string
+	var failures []StepFailure
+	var locations []testspec.Location
 	var firstFailedStep int = -1
 
+	// Response of each step, for comparisons with earlier steps
+	var responses []*client.Response
+	var explained []ExplainedStep
+
+	// Log position and simulated time of each step, for the timeline and
+	// to tell which step entered which VCL blocks
+	var stepOffsets []int64
+	var stepAts []time.Duration
+
 	for stepIdx, step := range test.Scenario {
-		// Parse time offset
-		offset, err := parseDuration(step.At)
-		if err != nil {
-			return nil, fmt.Errorf("step %d: invalid time offset %q: %w", stepIdx+1, step.At, err)
-		}
+		offset := step.Offset()
 
 		// Advance time to this step's offset (absolute from test start)
 		if err := r.timeController.AdvanceTimeBy(offset); err != nil {
 			return nil, fmt.Errorf("step %d: failed to advance time: %w", stepIdx+1, err)
 		}
+		// Varnish may time out idle sessions once its clock has jumped
+		r.CloseIdleConnections()
+		r.calls.mark(offset)
+		if r.recorder != nil {
+			stepOffsets = append(stepOffsets, r.markStep())
+			stepAts = append(stepAts, offset)
+		}
 
 		// Update backend configuration if specified in this step
 		if len(step.Backends) > 0 && r.mockBackends != nil {
 			for name, spec := range step.Backends {
 				if mock, ok := r.mockBackends[name]; ok {
 					cfg := backend.Config{
-						Status:      spec.Status,
-						Headers:     spec.Headers,
-						Body:        spec.Body,
-						FailureMode: spec.FailureMode,
-						Routes:      convertRoutes(spec.Routes),
-						EchoRequest: spec.EchoRequest,
+						Status:         spec.Status,
+						Headers:        spec.Headers,
+						Body:           spec.Body,
+						FailureMode:    spec.FailureMode,
+						Routes:         convertRoutes(spec.Routes),
+						EchoRequest:    spec.EchoRequest,
+						EchoConnection: spec.EchoConnection,
+						Generate:       spec.Generate.Generated(),
+						ServeDir:       spec.ServeDir,
+						Bandwidth:      int64(spec.Bandwidth),
 					}
 					// Apply default status if not set
 					if cfg.Status == 0 {
@@ -1022,78 +1666,75 @@ func (r *Runner) runScenarioTestWithSharedVCL(test testspec.TestSpec) (*TestResu
 			}
 		}
 
-		r.logger.Debug("Executing scenario step", "step", stepIdx+1, "at", step.At)
-
-		// Reset backend call counts before step
-		if r.mockBackends != nil {
-			for _, backend := range r.mockBackends {
-				backend.ResetCallCount()
-			}
+		// Apply varnishd parameter changes
+		if err := params.set(step.SetParam); err != nil {
+			return nil, fmt.Errorf("step %d: set_param: %w", stepIdx+1, err)
 		}
 
-		// Make HTTP request to Varnish using persistent client with cookie jar
-		response, err := client.MakeRequest(httpClient, r.varnishURL, step.Request)
-		if err != nil {
-			return nil, fmt.Errorf("step %d: making request: %w", stepIdx+1, err)
+		// Stop or restart backend listeners
+		if err := setBackendsUp(r.mockBackends, step.BackendDown, false); err != nil {
+			return nil, fmt.Errorf("step %d: backend_down: %w", stepIdx+1, err)
 		}
-
-		// Flush varnishlog to ensure logs are written
-		if r.recorder != nil {
-			if err := r.recorder.Flush(); err != nil {
-				r.logger.Warn("Failed to flush varnishlog", "error", err)
-			}
+		if err := setBackendsUp(r.mockBackends, step.BackendUp, true); err != nil {
+			return nil, fmt.Errorf("step %d: backend_up: %w", stepIdx+1, err)
 		}
 
-		// Collect backend call counts
-		backendCalls := make(map[string]int)
-		if r.mockBackends != nil {
-			for name, backend := range r.mockBackends {
-				backendCalls[name] = backend.GetCallCount()
-			}
-		}
-
-		// Build URL for cookie jar lookup
-		reqURL, _ := url.Parse(r.varnishURL + step.Request.URL)
+		r.logger.Debug("Executing scenario step", "step", stepIdx+1, "at", offset)
 
-		// Check assertions for this step
-		assertResult := assertion.Check(step.Expectations, response, backendCalls, jar, reqURL)
+		// Make HTTP request to Varnish using persistent client with cookie jar,
+		// and check assertions for this step (call counts are reset per step
+		// unless reset_backend_counts is false)
+		var resetCalls func()
+		if test.ResetsBackendCounts(stepIdx) {
+			resetCalls = r.calls.reset
+		}
+		assertResult, response, err := r.requestAndCheck(httpClient, step.Request, step.Expectations, responses, r.mockCallCounts, resetCalls, r.mockBackends)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", stepIdx+1, err)
+		}
+		responses = append(responses, response)
+		if r.explain {
+			explained = append(explained, ExplainedStep{Step: stepIdx + 1, At: offset, Explanations: assertResult.Explanations})
+		}
 
 		if !assertResult.Passed {
 			if firstFailedStep == -1 {
 				firstFailedStep = stepIdx
 			}
+			locations = append(locations, failedLocations(&test, stepIdx+1, assertResult)...)
 			for _, err := range assertResult.Errors {
-				allErrors = append(allErrors, fmt.Sprintf("Step %d (at %s): %s", stepIdx+1, step.At, err))
+				failure := StepFailure{Step: stepIdx + 1, At: offset, Message: err}
+				failures = append(failures, failure)
+				allErrors = append(allErrors, failure.String())
 			}
 		}
 	}
 
 	// Prepare test result
 	result := &TestResult{
-		TestName: test.Name,
-		Passed:   len(allErrors) == 0,
-		Errors:   allErrors,
-	}
-
-	// If test failed, collect and attach trace information
-	if !result.Passed && r.recorder != nil && r.vclShowResult != nil && firstFailedStep >= 0 {
-		messages, err := r.recorder.GetVCLMessages()
-		if err != nil {
-			r.logger.Warn("Failed to get VCL messages", "error", err)
+		TestName:      test.Name,
+		Passed:        len(allErrors) == 0,
+		Errors:        allErrors,
+		Failures:      failures,
+		SpecLocations: locations,
+	}
+	result.Explained = explained
+
+	// If test failed (or traces are requested), collect and attach trace information
+	if (firstFailedStep >= 0 || r.collectTraces) && r.recorder != nil && r.vclShowResult != nil {
+		result.VCLTrace = r.collectTrace(r.vclShowResult, logOffset)
+		if steps, err := r.stepMessages(stepOffsets); err != nil {
+			r.logger.Warn("Failed to read step messages", "error", err)
 		} else {
-			// Get per-config execution using ConfigMap from stored VCLShowResult
-			execByConfig := recorder.GetExecutedLinesByConfig(messages, r.vclShowResult.ConfigMap)
-
-			// Extract VCL files with execution traces
-			files := r.extractVCLFiles(r.vclShowResult, execByConfig)
-
-			summary := recorder.GetTraceSummary(messages)
-			result.VCLTrace = &VCLTraceInfo{
-				Files:        files,
-				BackendCalls: summary.BackendCalls,
-			}
+			r.attributeRequests(result.VCLTrace, steps)
 		}
 	}
+	if r.collectTimeline && len(stepOffsets) > 0 {
+		result.Timeline = r.buildTimeline(test.Name, stepOffsets, stepAts)
+	}
+	if r.recorder != nil {
+		result.VCL = r.collectVCL(logOffset)
+	}
 
 	return result, nil
 }
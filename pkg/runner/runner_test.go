@@ -1,12 +1,27 @@
 package runner
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/perbu/vcltest/pkg/assertion"
 	"github.com/perbu/vcltest/pkg/backend"
+	"github.com/perbu/vcltest/pkg/recorder"
 	"github.com/perbu/vcltest/pkg/testspec"
 	"github.com/perbu/vcltest/pkg/varnishadm"
 	"github.com/perbu/vcltest/pkg/vclloader"
@@ -82,94 +97,6 @@ func TestSanitizeVCLName(t *testing.T) {
 	}
 }
 
-func TestParseDuration(t *testing.T) {
-	tests := []struct {
-		name      string
-		input     string
-		expected  time.Duration
-		shouldErr bool
-	}{
-		{
-			name:      "zero seconds",
-			input:     "0s",
-			expected:  0,
-			shouldErr: false,
-		},
-		{
-			name:      "30 seconds",
-			input:     "30s",
-			expected:  30 * time.Second,
-			shouldErr: false,
-		},
-		{
-			name:      "2 minutes",
-			input:     "2m",
-			expected:  2 * time.Minute,
-			shouldErr: false,
-		},
-		{
-			name:      "1 hour",
-			input:     "1h",
-			expected:  time.Hour,
-			shouldErr: false,
-		},
-		{
-			name:      "complex duration",
-			input:     "1h30m45s",
-			expected:  time.Hour + 30*time.Minute + 45*time.Second,
-			shouldErr: false,
-		},
-		{
-			name:      "milliseconds",
-			input:     "500ms",
-			expected:  500 * time.Millisecond,
-			shouldErr: false,
-		},
-		{
-			name:      "microseconds",
-			input:     "100us",
-			expected:  100 * time.Microsecond,
-			shouldErr: false,
-		},
-		{
-			name:      "invalid format",
-			input:     "invalid",
-			expected:  0,
-			shouldErr: true,
-		},
-		{
-			name:      "empty string",
-			input:     "",
-			expected:  0,
-			shouldErr: true,
-		},
-		{
-			name:      "negative duration",
-			input:     "-30s",
-			expected:  -30 * time.Second,
-			shouldErr: false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result, err := parseDuration(tt.input)
-			if tt.shouldErr {
-				if err == nil {
-					t.Errorf("parseDuration(%q) expected error, got nil", tt.input)
-				}
-			} else {
-				if err != nil {
-					t.Errorf("parseDuration(%q) unexpected error: %v", tt.input, err)
-				}
-				if result != tt.expected {
-					t.Errorf("parseDuration(%q) = %v, want %v", tt.input, result, tt.expected)
-				}
-			}
-		})
-	}
-}
-
 func TestExtractVCLFiles(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -938,7 +865,7 @@ func TestRunTestWithSharedVCL_ScenarioRequiresTimeController(t *testing.T) {
 		Name: "scenario test",
 		Scenario: []testspec.ScenarioStep{
 			{
-				At: "0s",
+				At: new(testspec.Duration),
 				Request: testspec.RequestSpec{
 					Method: "GET",
 					URL:    "/",
@@ -973,7 +900,7 @@ func TestStartBackends_ScenarioBackendConfig(t *testing.T) {
 		},
 		Scenario: []testspec.ScenarioStep{
 			{
-				At: "0s",
+				At: new(testspec.Duration),
 			},
 		},
 	}
@@ -1023,18 +950,6 @@ func TestStartBackends_DefaultStatusApplied(t *testing.T) {
 	}
 }
 
-func TestParseDuration_WrapperFunction(t *testing.T) {
-	// Test the exported parseDuration function wrapper
-	d, err := parseDuration("1h30m")
-	if err != nil {
-		t.Fatalf("parseDuration() error: %v", err)
-	}
-	expected := time.Hour + 30*time.Minute
-	if d != expected {
-		t.Errorf("parseDuration(\"1h30m\") = %v, want %v", d, expected)
-	}
-}
-
 func TestTestResult_Structure(t *testing.T) {
 	// Test TestResult structure
 	result := &TestResult{
@@ -1195,3 +1110,833 @@ func TestStartBackends_ErrorOnStart(t *testing.T) {
 		t.Errorf("startBackends() created %d backends, want 3", len(addresses))
 	}
 }
+
+func TestCallHistory(t *testing.T) {
+	mock := backend.New(backend.Config{Status: 200})
+	addr, err := mock.Start()
+	if err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer mock.Stop()
+	get := func(path string) {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	// Requests before the first step belong to an earlier test
+	get("/leftover")
+	h := newCallHistory(map[string]*backend.MockBackend{"default": mock})
+	h.mark(0)
+	get("/first")
+	h.reset()
+	h.mark(30 * time.Second)
+	get("/second")
+
+	calls := h.calls()
+	if len(calls) != 2 || calls[0].URL != "/first" || calls[1].URL != "/second" {
+		t.Fatalf("calls = %+v, want /first and /second", calls)
+	}
+	if calls[0].At >= time.Second || calls[1].At < 30*time.Second || calls[1].At >= 31*time.Second {
+		t.Errorf("simulated times = %s, %s, want about 0s and 30s", calls[0].At, calls[1].At)
+	}
+	if mock.GetCallCount() != 1 {
+		t.Errorf("call count after reset = %d, want 1", mock.GetCallCount())
+	}
+}
+
+func TestSetBackendsUp(t *testing.T) {
+	mock := backend.New(backend.Config{Status: 200})
+	if _, err := mock.Start(); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	defer mock.Stop()
+	backends := map[string]*backend.MockBackend{"api": mock}
+
+	if err := setBackendsUp(backends, []string{"api"}, false); err != nil {
+		t.Fatalf("setBackendsUp(down) error: %v", err)
+	}
+	if !mock.IsDown() {
+		t.Error("backend should be down")
+	}
+
+	r := New(nil, "", "", slog.New(slog.NewTextHandler(os.Stderr, nil)), nil)
+	r.SetMockBackends(backends)
+	r.restoreBackends()
+	if mock.IsDown() {
+		t.Error("restoreBackends() should bring the backend back up")
+	}
+
+	if err := setBackendsUp(backends, []string{"missing"}, false); err == nil {
+		t.Error("setBackendsUp() with unknown backend should fail")
+	}
+}
+
+func TestParamOverrides(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	mock := varnishadm.NewMock(0, "secret", logger)
+	mock.SetResponse("param.show default_grace", varnishadm.NewVarnishResponse(varnishadm.ClisOk,
+		"default_grace\n        Value is: 10.000 [seconds] (default)\n"))
+	mock.SetResponse("param.show default_ttl", varnishadm.NewVarnishResponse(varnishadm.ClisOk,
+		"default_ttl\n        Value is: 120.000 [seconds] (default)\n"))
+	mock.SetResponse("param.show cc_command", varnishadm.NewVarnishResponse(varnishadm.ClisOk,
+		"cc_command\n        Value is: exec $CC -o %o %s (default)\n"))
+	for _, cmd := range []string{"param.set default_grace 0s", "param.set default_grace 5s", "param.set default_ttl 1",
+		"param.set default_grace 10.000", "param.set default_ttl 120.000",
+		`param.set cc_command "exec true"`, `param.set cc_command "exec $CC -o %o %s"`} {
+		mock.SetResponse(cmd, varnishadm.NewVarnishResponse(varnishadm.ClisOk, ""))
+	}
+
+	p := newParamOverrides(mock)
+	if err := p.set(map[string]string{"default_grace": "0s", "default_ttl": "1", "cc_command": "exec true"}); err != nil {
+		t.Fatalf("set() error: %v", err)
+	}
+	// A second change to the same parameter must not overwrite the saved original
+	if err := p.set(map[string]string{"default_grace": "5s"}); err != nil {
+		t.Fatalf("set() error: %v", err)
+	}
+	p.restore(logger)
+
+	// Values with spaces are quoted, so they are restored whole
+	want := []string{
+		"param.show cc_command", `param.set cc_command "exec true"`,
+		"param.show default_grace", "param.set default_grace 0s",
+		"param.show default_ttl", "param.set default_ttl 1",
+		"param.set default_grace 5s",
+		`param.set cc_command "exec $CC -o %o %s"`, "param.set default_grace 10.000", "param.set default_ttl 120.000",
+	}
+	got := mock.GetCallHistory()
+	if len(got) != len(want) {
+		t.Fatalf("commands = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("command %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRunTestWithSharedVCL_MatrixParams(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mock := varnishadm.NewMock(0, "secret", logger)
+	mock.SetResponse("param.show default_grace", varnishadm.NewVarnishResponse(varnishadm.ClisOk,
+		"default_grace\n        Value is: 10.000 [seconds] (default)\n"))
+	for _, cmd := range []string{"param.set default_grace 0s", "param.set default_grace 10.000"} {
+		mock.SetResponse(cmd, varnishadm.NewVarnishResponse(varnishadm.ClisOk, ""))
+	}
+
+	r := New(mock, server.URL, t.TempDir(), logger, nil)
+	r.loadedVCLName = "test-vcl"
+	test := testspec.TestSpec{
+		Name:          "cell",
+		Request:       testspec.RequestSpec{Method: "GET", URL: "/"},
+		Expectations:  testspec.ExpectationsSpec{Response: testspec.ResponseExpectations{Status: 200}},
+		VarnishParams: map[string]string{"default_grace": "0s"},
+	}
+	result, err := r.RunTestWithSharedVCL(test)
+	if err != nil {
+		t.Fatalf("RunTestWithSharedVCL() error = %v", err)
+	}
+	if !result.Passed || result.VarnishParams["default_grace"] != "0s" {
+		t.Errorf("result = %+v, want passed with the cell parameters", result)
+	}
+
+	var params []string
+	for _, cmd := range mock.GetCallHistory() {
+		if strings.HasPrefix(cmd, "param.") {
+			params = append(params, cmd)
+		}
+	}
+	want := []string{"param.show default_grace", "param.set default_grace 0s", "param.set default_grace 10.000"}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("param commands = %v, want %v", params, want)
+	}
+}
+
+func TestStepFailureString(t *testing.T) {
+	tests := []struct {
+		name     string
+		failure  StepFailure
+		expected string
+	}{
+		{
+			name:     "first step",
+			failure:  StepFailure{Step: 1, At: 0, Message: "Status: expected 200, got 503"},
+			expected: "Step 1 (at T+0s simulated): Status: expected 200, got 503",
+		},
+		{
+			name:     "one hour in",
+			failure:  StepFailure{Step: 3, At: time.Hour, Message: "Cache hit: expected true, got false"},
+			expected: "Step 3 (at T+3600s simulated): Cache hit: expected true, got false",
+		},
+		{
+			name:     "fractional seconds",
+			failure:  StepFailure{Step: 2, At: 1500 * time.Millisecond, Message: "Age: expected > 1s, got 0s"},
+			expected: "Step 2 (at T+1.5s simulated): Age: expected > 1s, got 0s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.failure.String(); got != tt.expected {
+				t.Errorf("String() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFailedLocations(t *testing.T) {
+	file := t.TempDir() + "/cache.yaml"
+	spec := `name: cached page
+request:
+  url: /page
+sequence:
+  - cache:
+      hit: false
+  - cache:
+      hit: true
+    response:
+      headers:
+        X-Cache: HIT
+`
+	if err := os.WriteFile(file, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests, err := testspec.Load(file)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	failed := func(fields ...string) *assertion.Result {
+		result := &assertion.Result{}
+		for _, field := range fields {
+			result.Explanations = append(result.Explanations, assertion.Explanation{Field: field})
+		}
+		return result
+	}
+
+	tt := []struct {
+		name    string
+		test    testspec.TestSpec
+		request int
+		result  *assertion.Result
+		want    []testspec.Location
+	}{
+		{
+			name:    "failed field",
+			test:    tests[0],
+			request: 2,
+			result:  failed("cache.hit", "response.headers.X-Cache"),
+			want: []testspec.Location{
+				{File: file, Line: 8, Request: 2, Field: "cache.hit"},
+				{File: file, Line: 11, Request: 2, Field: "response.headers.X-Cache"},
+			},
+		},
+		{
+			name:    "field the test does not set",
+			test:    tests[0],
+			request: 2,
+			result:  failed("backend.calls", "backend.calls"),
+			want:    []testspec.Location{{File: file, Line: 7, Request: 2, Field: "backend.calls"}},
+		},
+		{
+			name:    "closest key the test sets",
+			test:    tests[0],
+			request: 2,
+			result:  failed("response.status"),
+			want:    []testspec.Location{{File: file, Line: 9, Request: 2, Field: "response.status"}},
+		},
+		{
+			name:    "no failed field",
+			test:    tests[0],
+			request: 1,
+			result:  &assertion.Result{Errors: []string{"request failed"}},
+			want:    []testspec.Location{{File: file, Line: 5, Request: 1}},
+		},
+		{
+			name:    "passed",
+			test:    tests[0],
+			request: 1,
+			result:  &assertion.Result{Passed: true},
+		},
+		{
+			name:   "not loaded from a file",
+			test:   testspec.TestSpec{Name: "built in Go"},
+			result: failed("response.status"),
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			got := failedLocations(&tc.test, tc.request, tc.result)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("failedLocations() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequestAndCheckEventually(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	interval := testspec.Duration(10 * time.Millisecond)
+
+	tests := []struct {
+		name       string
+		failFirst  int32 // Requests answered with 503 before switching to 200
+		eventually *testspec.EventuallySpec
+		wantPassed bool
+		wantCalls  int32
+	}{
+		{
+			name:       "no eventually fails on first attempt",
+			failFirst:  2,
+			wantPassed: false,
+			wantCalls:  1,
+		},
+		{
+			name:       "eventually retries until passing",
+			failFirst:  2,
+			eventually: &testspec.EventuallySpec{Timeout: testspec.Duration(2 * time.Second), Interval: &interval},
+			wantPassed: true,
+			wantCalls:  3,
+		},
+		{
+			name:       "eventually gives up after timeout",
+			failFirst:  1000,
+			eventually: &testspec.EventuallySpec{Timeout: testspec.Duration(50 * time.Millisecond), Interval: &interval},
+			wantPassed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) <= tt.failFirst {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			r := New(nil, server.URL, t.TempDir(), logger, nil)
+			exp := testspec.ExpectationsSpec{
+				Response:   testspec.ResponseExpectations{Status: 200},
+				Eventually: tt.eventually,
+			}
+			result, _, err := r.requestAndCheck(nil, testspec.RequestSpec{Method: "GET", URL: "/"}, exp, nil, r.mockCallCounts, r.resetMockCallCounts, r.mockBackends)
+			if err != nil {
+				t.Fatalf("requestAndCheck() error = %v", err)
+			}
+			if result.Passed != tt.wantPassed {
+				t.Errorf("Passed = %v, want %v (errors: %v)", result.Passed, tt.wantPassed, result.Errors)
+			}
+			if tt.wantCalls != 0 && calls.Load() != tt.wantCalls {
+				t.Errorf("requests = %d, want %d", calls.Load(), tt.wantCalls)
+			}
+			if !tt.wantPassed && tt.eventually != nil {
+				last := result.Errors[len(result.Errors)-1]
+				if !strings.HasPrefix(last, "eventually: expectations not met within 50ms") {
+					t.Errorf("last error = %q, want eventually timeout", last)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestAndCheckHitRatio(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Fake cache: every path except /private is a hit from its second request on
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen[r.URL.Path]++
+		n := seen[r.URL.Path]
+		mu.Unlock()
+		if n > 1 && r.URL.Path != "/private" {
+			w.Header().Set("X-Varnish", "100 99")
+		} else {
+			w.Header().Set("X-Varnish", "100")
+		}
+	}))
+	defer server.Close()
+
+	r := New(nil, server.URL, t.TempDir(), logger, nil)
+	exp := testspec.ExpectationsSpec{
+		Response: testspec.ResponseExpectations{Status: 200},
+		Cache: &testspec.CacheExpectations{
+			HitRatio: &testspec.HitRatioSpec{URLs: []string{"/a", "/b", "/c", "/private"}, Min: 0.75},
+		},
+	}
+	result, _, err := r.requestAndCheck(nil, testspec.RequestSpec{Method: "GET", URL: "/"}, exp, nil, r.mockCallCounts, r.resetMockCallCounts, r.mockBackends)
+	if err != nil {
+		t.Fatalf("requestAndCheck() error = %v", err)
+	}
+	if !result.Passed {
+		t.Errorf("expected pass, got errors: %v", result.Errors)
+	}
+	for _, path := range []string{"/a", "/b", "/c", "/private"} {
+		if seen[path] != 2 {
+			t.Errorf("%s requested %d times, want 2", path, seen[path])
+		}
+	}
+}
+
+func TestScenarioHitRatioNotCounted(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	mock := backend.New(backend.Config{Status: 200})
+	addr, err := mock.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Stop()
+
+	// Fake Varnish without a cache: every request is a backend fetch
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		resp, err := http.Get("http://" + addr + r.URL.Path)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		resp.Body.Close()
+		w.Header().Set("X-Varnish", "100")
+	}))
+	defer server.Close()
+
+	r := New(varnishadm.NewMock(0, "secret", logger), server.URL, t.TempDir(), logger, nil)
+	r.loadedVCLName = "test-vcl"
+	r.SetTimeController(&mockTimeController{})
+	r.SetMockBackends(map[string]*backend.MockBackend{"default": mock})
+
+	one, two := 1, 2
+	noReset := false
+	at0, at1 := testspec.Duration(0), testspec.Duration(time.Second)
+	maxRatio := 0.0
+	test := testspec.TestSpec{
+		Name:               "hit ratio then cumulative counts",
+		ResetBackendCounts: &noReset,
+		Scenario: []testspec.ScenarioStep{
+			{
+				At:      &at0,
+				Request: testspec.RequestSpec{Method: "GET", URL: "/"},
+				Expectations: testspec.ExpectationsSpec{
+					Response: testspec.ResponseExpectations{Status: 200},
+					Backend:  &testspec.BackendExpectations{Calls: &one},
+					Cache:    &testspec.CacheExpectations{HitRatio: &testspec.HitRatioSpec{URLs: []string{"/a", "/b"}, Max: &maxRatio}},
+				},
+			},
+			{
+				At:      &at1,
+				Request: testspec.RequestSpec{Method: "GET", URL: "/"},
+				Expectations: testspec.ExpectationsSpec{
+					Response: testspec.ResponseExpectations{Status: 200},
+					Backend: &testspec.BackendExpectations{
+						Calls:        &two,
+						CallsBetween: testspec.CallWindows{{From: at0, To: at1, Calls: &one}},
+					},
+				},
+			},
+		},
+	}
+	result, err := r.RunTestWithSharedVCL(test)
+	if err != nil {
+		t.Fatalf("RunTestWithSharedVCL() error = %v", err)
+	}
+	if !result.Passed {
+		t.Errorf("the hit_ratio passes were counted as backend calls: %v", result.Errors)
+	}
+	if got := fetches.Load(); got != 6 {
+		t.Errorf("backend fetches = %d, want 6 (two steps and two passes over two URLs)", got)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var inFlight, maxInFlight atomic.Int32
+	var mu sync.Mutex
+	hosts := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		hosts[r.URL.Path] = r.Host
+		mu.Unlock()
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	test := testspec.TestSpec{
+		Name:              "warm",
+		WarmupConcurrency: 2,
+		Warmup: []testspec.RequestSpec{
+			{Method: "GET", URL: "/a"},
+			{Method: "GET", URL: "/broken"},
+			{Method: "GET", URL: "/b", Headers: map[string]string{"Host": "example.com"}},
+			{Method: "GET", URL: "/c"},
+		},
+	}
+	r := New(nil, server.URL, t.TempDir(), logger, nil)
+	report := r.warmup(test)
+
+	if report.Requests != 4 {
+		t.Errorf("Requests = %d, want 4", report.Requests)
+	}
+	if len(report.Failures) != 1 || report.Failures[0] != "/broken: status 502" {
+		t.Errorf("Failures = %v, want [/broken: status 502]", report.Failures)
+	}
+	if hosts["/b"] != "example.com" {
+		t.Errorf("Host of /b = %q, want example.com", hosts["/b"])
+	}
+	if maxInFlight.Load() > 2 {
+		t.Errorf("max in flight = %d, want at most 2", maxInFlight.Load())
+	}
+}
+
+func TestRequestAndCheckAENormalization(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Fake cache keyed by Accept-Encoding, unless the request asks for
+	// normalization (one shared object, as without Vary)
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	var xid int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Accept-Encoding")
+		if r.Header.Get("X-Normalize") == "yes" {
+			key = "normalized"
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		xid++
+		if obj, ok := objects[key]; ok {
+			w.Header().Set("X-Varnish", fmt.Sprintf("%d %s", xid, obj))
+			return
+		}
+		objects[key] = strconv.Itoa(xid)
+		w.Header().Set("X-Varnish", strconv.Itoa(xid))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		wantPass  bool
+		wantCount int
+	}{
+		{"normalized", map[string]string{"X-Normalize": "yes"}, true, 1},
+		{"one object per value", nil, false, len(testspec.DefaultAEValues)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			clear(objects)
+			mu.Unlock()
+
+			r := New(nil, server.URL, t.TempDir(), logger, nil)
+			exp := testspec.ExpectationsSpec{
+				Response: testspec.ResponseExpectations{Status: 200},
+				Cache:    &testspec.CacheExpectations{AENormalization: &testspec.AENormalizationSpec{URL: "/page"}},
+			}
+			req := testspec.RequestSpec{Method: "GET", URL: "/", Headers: tt.headers}
+			result, _, err := r.requestAndCheck(nil, req, exp, nil, r.mockCallCounts, r.resetMockCallCounts, r.mockBackends)
+			if err != nil {
+				t.Fatalf("requestAndCheck() error = %v", err)
+			}
+			if result.Passed != tt.wantPass {
+				t.Errorf("Passed = %v, want %v (errors: %v)", result.Passed, tt.wantPass, result.Errors)
+			}
+			mu.Lock()
+			n := len(objects)
+			mu.Unlock()
+			if n != tt.wantCount {
+				t.Errorf("cached %d objects, want %d", n, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestVSLEvidence(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+		want string
+	}{
+		{
+			name: "miss with fetch",
+			log: `*   << Request  >> 32769
+-   VCL_call       RECV
+-   VCL_call       MISS
+-   VCL_call       DELIVER
+**  << BeReq    >> 32770
+--  VCL_call       BACKEND_FETCH
+--  BackendOpen    22 default 127.0.0.1 8080 127.0.0.1 56783 connect
+--  VCL_call       BACKEND_RESPONSE
+`,
+			want: "VSL: VCL_call MISS, 1 VCL_call BACKEND_FETCH, BackendOpen default",
+		},
+		{
+			name: "hit",
+			log: `*   << Request  >> 32771
+-   VCL_call       RECV
+-   VCL_call       HIT
+-   VCL_call       DELIVER
+`,
+			want: "VSL: VCL_call HIT, 0 VCL_call BACKEND_FETCH",
+		},
+		{
+			name: "synthetic",
+			log: `*   << Request  >> 32772
+-   VCL_call       RECV
+-   VCL_call       SYNTH
+`,
+			want: "VSL: no VCL_call HIT/MISS/PASS/PIPE, 0 VCL_call BACKEND_FETCH",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := vslEvidence(recorder.ParseLog(tt.log)); got != tt.want {
+				t.Errorf("vslEvidence() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestAndCheck_ReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	r := New(nil, server.URL, t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	exp := testspec.ExpectationsSpec{Response: testspec.ResponseExpectations{Status: 200}}
+	for range 5 {
+		if _, _, err := r.requestAndCheck(nil, testspec.RequestSpec{Method: "GET", URL: "/"}, exp, nil, r.mockCallCounts, r.resetMockCallCounts, r.mockBackends); err != nil {
+			t.Fatalf("requestAndCheck() error = %v", err)
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("connections = %d, want 1 (pooled)", got)
+	}
+
+	// After closing idle connections, the next request dials again
+	r.CloseIdleConnections()
+	if _, _, err := r.requestAndCheck(nil, testspec.RequestSpec{Method: "GET", URL: "/"}, exp, nil, r.mockCallCounts, r.resetMockCallCounts, r.mockBackends); err != nil {
+		t.Fatalf("requestAndCheck() error = %v", err)
+	}
+	if got := conns.Load(); got != 2 {
+		t.Errorf("connections after CloseIdleConnections = %d, want 2", got)
+	}
+}
+
+// tracingTransport adds a header to every request and counts them
+type tracingTransport struct {
+	base   http.RoundTripper
+	count  atomic.Int32
+	closed atomic.Bool
+}
+
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tt.count.Add(1)
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Trace", "on")
+	return tt.base.RoundTrip(req)
+}
+
+func (tt *tracingTransport) CloseIdleConnections() {
+	tt.closed.Store(true)
+}
+
+func TestSetTransportWrapper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Trace", r.Header.Get("X-Trace"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	r := New(nil, server.URL, t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	tracer := &tracingTransport{}
+	r.SetTransportWrapper(func(base http.RoundTripper) http.RoundTripper {
+		tracer.base = base
+		return tracer
+	})
+
+	exp := testspec.ExpectationsSpec{Response: testspec.ResponseExpectations{Status: 200, Headers: map[string]string{"X-Trace": "on"}}}
+	jar, _ := cookiejar.New(nil)
+	for _, httpClient := range []*http.Client{nil, r.newHTTPClient(jar)} {
+		result, _, err := r.requestAndCheck(httpClient, testspec.RequestSpec{Method: "GET", URL: "/"}, exp, nil, r.mockCallCounts, nil, nil)
+		if err != nil {
+			t.Fatalf("requestAndCheck() error = %v", err)
+		}
+		if !result.Passed {
+			t.Errorf("requestAndCheck() errors = %v, want the wrapped transport's header", result.Errors)
+		}
+	}
+	if got := tracer.count.Load(); got != 2 {
+		t.Errorf("wrapped requests = %d, want 2", got)
+	}
+
+	r.CloseIdleConnections()
+	if !tracer.closed.Load() {
+		t.Error("CloseIdleConnections() did not reach the wrapped transport")
+	}
+}
+
+func TestAnalyzeBlocks_Cache(t *testing.T) {
+	r := &Runner{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	entry := varnishadm.VCLConfigEntry{
+		ConfigID: 0,
+		Filename: "/tmp/test.vcl",
+		Source:   "vcl 4.1;\n\nsub vcl_recv {\n  if (req.url == \"/\") {\n    return (pass);\n  }\n}\n",
+	}
+
+	first, err := r.analyzeBlocks(entry)
+	if err != nil {
+		t.Fatalf("analyzeBlocks() error = %v", err)
+	}
+	first.Blocks[0].Entered = true
+
+	// A cache hit must not share blocks with earlier results
+	second, err := r.analyzeBlocks(entry)
+	if err != nil {
+		t.Fatalf("analyzeBlocks() error = %v", err)
+	}
+	if second.Blocks[0].Entered {
+		t.Error("cached blocks share Entered flags with an earlier result")
+	}
+	if len(second.Blocks) != 1 || len(second.Blocks[0].Children) != 1 {
+		t.Fatalf("cached blocks = %+v, want vcl_recv with one if", second.Blocks)
+	}
+
+	// A different source under the same config ID is analyzed again
+	entry.Source = "vcl 4.1;\n\nsub vcl_recv {\n}\n\nsub vcl_deliver {\n}\n"
+	third, err := r.analyzeBlocks(entry)
+	if err != nil {
+		t.Fatalf("analyzeBlocks() error = %v", err)
+	}
+	if len(third.Blocks) != 2 {
+		t.Errorf("blocks after source change = %d, want 2", len(third.Blocks))
+	}
+}
+
+// benchmarkVCL is a VCL with enough branches for coverage analysis to cost
+// something: one sub per route, each with an if/elseif/else chain
+func benchmarkVCL() string {
+	var b strings.Builder
+	b.WriteString("vcl 4.1;\n\nbackend default { .host = \"127.0.0.1\"; }\n")
+	for i := range 20 {
+		fmt.Fprintf(&b, "\nsub route_%d {\n  if (req.url ~ \"^/a%d\") {\n    set req.http.X-Route = \"a\";\n  } elseif (req.url ~ \"^/b%d\") {\n    set req.http.X-Route = \"b\";\n  } else {\n    unset req.http.X-Route;\n  }\n}\n", i, i, i)
+	}
+	b.WriteString("\nsub vcl_recv {\n")
+	for i := range 20 {
+		fmt.Fprintf(&b, "  call route_%d;\n", i)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// BenchmarkRunTestWithSharedVCL measures the per-test overhead of the runner
+// for a single-request test, against an in-process server standing in for
+// Varnish, so Varnish's own time is excluded
+func BenchmarkRunTestWithSharedVCL(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Varnish", "32770 32768")
+		w.Header().Set("Age", "3")
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer server.Close()
+
+	r := New(nil, server.URL, b.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	r.SetVCLShowResult(nil)
+	hit := true
+	test := testspec.TestSpec{
+		Name:    "bench",
+		Request: testspec.RequestSpec{Method: "GET", URL: "/", Headers: map[string]string{"Accept": "text/html"}},
+		Expectations: testspec.ExpectationsSpec{
+			Response: testspec.ResponseExpectations{Status: 200, Headers: map[string]string{"Age": "3"}, BodyContains: "hello"},
+			Cache:    &testspec.CacheExpectations{Hit: &hit},
+		},
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		result, err := r.RunTestWithSharedVCL(test)
+		if err != nil || !result.Passed {
+			b.Fatalf("RunTestWithSharedVCL() = %+v, %v", result, err)
+		}
+	}
+}
+
+// BenchmarkExtractVCLFiles measures the coverage analysis attached to every
+// failing test; after the first test it is served from the block cache
+func BenchmarkExtractVCLFiles(b *testing.B) {
+	r := &Runner{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	source := benchmarkVCL()
+	vclShow := &varnishadm.VCLShowResult{
+		Entries: []varnishadm.VCLConfigEntry{{ConfigID: 0, Filename: "/tmp/bench.vcl", Size: len(source), Source: source}},
+	}
+	traced := map[int][]int{0: {12, 13, 110}}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if files := r.extractVCLFiles(vclShow, traced); len(files) != 1 || files[0].Blocks == nil {
+			b.Fatalf("extractVCLFiles() = %+v", files)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer server.Close()
+
+	r := New(nil, server.URL, t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	response, trace, err := r.Do(context.Background(), testspec.RequestSpec{URL: "/"})
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	if response.Status != http.StatusTeapot || response.Headers.Get("X-Method") != "GET" {
+		t.Errorf("Do() = %d %v, want 418 from a GET", response.Status, response.Headers)
+	}
+	if trace != nil {
+		t.Errorf("Do() trace = %+v, want nil without a recorder", trace)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := r.Do(ctx, testspec.RequestSpec{URL: "/"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Do() with a canceled context error = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,74 @@
+package runner
+
+import (
+	"slices"
+
+	"github.com/perbu/vcltest/pkg/assertion"
+	"github.com/perbu/vcltest/pkg/coverage"
+	"github.com/perbu/vcltest/pkg/recorder"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// failedLocations returns where the expectations that failed in the
+// assertion result of one request (0 for single-request tests) are set
+func failedLocations(test *testspec.TestSpec, request int, result *assertion.Result) []testspec.Location {
+	if result.Passed {
+		return nil
+	}
+	var locations []testspec.Location
+	add := func(field string) {
+		location, ok := test.ExpectationLocation(request, field)
+		if !ok {
+			return
+		}
+		location.Request, location.Field = request, field
+		if !slices.Contains(locations, location) {
+			locations = append(locations, location)
+		}
+	}
+	for _, e := range result.Explanations {
+		if !e.Passed {
+			add(e.Field)
+		}
+	}
+	if len(locations) == 0 {
+		add("")
+	}
+	return locations
+}
+
+// stepMessages returns the VSL of each step of a test, from its offset up
+// to the next step's
+func (r *Runner) stepMessages(offsets []int64) ([][]recorder.Message, error) {
+	if err := r.recorder.Flush(); err != nil {
+		r.logger.Warn("Failed to flush varnishlog", "error", err)
+	}
+	steps := make([][]recorder.Message, len(offsets))
+	for i, offset := range offsets {
+		end := int64(-1)
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		messages, err := r.recorder.GetMessagesBetween(offset, end)
+		if err != nil {
+			return nil, err
+		}
+		steps[i] = messages
+	}
+	return steps, nil
+}
+
+// attributeRequests records in the blocks of a trace which of the test's
+// requests entered them, given the VSL of each request. Tests that make a
+// single request are left alone.
+func (r *Runner) attributeRequests(trace *VCLTraceInfo, requests [][]recorder.Message) {
+	if trace == nil || len(requests) < 2 {
+		return
+	}
+	for i, messages := range requests {
+		execByConfig := recorder.GetExecutedLinesByConfig(messages, r.vclShowResult.ConfigMap)
+		for _, file := range trace.Files {
+			coverage.MatchRequestToBlocks(file.Blocks, execByConfig[file.ConfigID], i+1)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package runner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/perbu/vcltest/pkg/assertion"
+	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/recorder"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// checkStorage checks a storage expectation against varnishlog: the object
+// was fetched by this request (miss or pass), or by the earlier fetch whose
+// VXID is the second ID of the X-Varnish header (hit)
+func (r *Runner) checkStorage(expected string, logStart int64, response *client.Response, result *assertion.Result) {
+	if r.recorder == nil || logStart < 0 {
+		assertion.CheckStorage(expected, "", "this request: varnishlog is not recording", result)
+		return
+	}
+	messages, requestMessages, err := r.storageMessages(logStart)
+	if err != nil {
+		assertion.CheckStorage(expected, "", "this request: reading varnishlog: "+err.Error(), result)
+		return
+	}
+
+	vxid, source := deliveredFetch(requestMessages, response)
+	if vxid == "" {
+		assertion.CheckStorage(expected, "", source, result)
+		return
+	}
+	assertion.CheckStorage(expected, recorder.FetchStorage(messages)[vxid], source, result)
+}
+
+// checkTTL checks cache.ttl_gt, ttl_lt, ttl_respects_age and ttl_source
+// expectations against the TTL records of the fetch that created the
+// delivered object, found as for storage expectations
+func (r *Runner) checkTTL(exp *testspec.CacheExpectations, logStart int64, response *client.Response, result *assertion.Result) {
+	bounds := exp.TTLGt != nil || exp.TTLLt != nil
+	fail := func(source string) {
+		if bounds {
+			assertion.CheckTTL(exp, 0, false, source, result)
+		}
+		assertion.CheckFreshness(exp, nil, source, result)
+	}
+	if r.recorder == nil || logStart < 0 {
+		fail("this request: varnishlog is not recording")
+		return
+	}
+	messages, requestMessages, err := r.storageMessages(logStart)
+	if err != nil {
+		fail("this request: reading varnishlog: " + err.Error())
+		return
+	}
+
+	vxid, source := deliveredFetch(requestMessages, response)
+	if bounds {
+		ttl, found := recorder.FetchTTL(messages)[vxid]
+		assertion.CheckTTL(exp, ttl, found, source, result)
+	}
+	if freshness, found := recorder.FetchFreshness(messages)[vxid]; found {
+		assertion.CheckFreshness(exp, &freshness, source, result)
+	} else {
+		assertion.CheckFreshness(exp, nil, source, result)
+	}
+}
+
+// storageMessages returns the whole log so far, where earlier fetches are
+// found, and the messages of the request that started at logStart
+func (r *Runner) storageMessages(logStart int64) ([]recorder.Message, []recorder.Message, error) {
+	end, err := r.recorder.MarkPosition()
+	if err != nil {
+		return nil, nil, err
+	}
+	messages, err := r.recorder.GetMessagesBetween(0, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	requestMessages, err := r.recorder.GetMessagesBetween(logStart, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	return messages, requestMessages, nil
+}
+
+// deliveredFetch returns the VXID of the backend fetch that created the
+// delivered object, and a description of how it was found
+func deliveredFetch(requestMessages []recorder.Message, response *client.Response) (string, string) {
+	for _, msg := range requestMessages {
+		if vxid, reason, ok := recorder.ParseFetchLink(msg); ok && reason != "bgfetch" {
+			return vxid, fmt.Sprintf("fetch %s (%s by this request)", vxid, reason)
+		}
+	}
+	xVarnish := response.Headers.Get("X-Varnish")
+	if parts := strings.Fields(xVarnish); len(parts) == 2 {
+		return parts[1], fmt.Sprintf("fetch %s (cache hit, from X-Varnish %q)", parts[1], xVarnish)
+	}
+	return "", fmt.Sprintf("this request: no backend fetch and no cached object in X-Varnish %q", xVarnish)
+}
@@ -0,0 +1,55 @@
+package runner
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/perbu/vcltest/pkg/client"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// WarmupReport summarizes the warmup requests made before a test
+type WarmupReport struct {
+	Requests int      `json:"requests"`
+	Failures []string `json:"failures,omitempty"` // One per failed request: transport errors and 5xx responses
+}
+
+// warmup requests each URL of the test's warmup list, with at most
+// test.WarmupConcurrency requests in flight. Failures are reported but do
+// not fail the test.
+func (r *Runner) warmup(test testspec.TestSpec) *WarmupReport {
+	report := &WarmupReport{Requests: len(test.Warmup)}
+	failures := make([]string, len(test.Warmup))
+
+	concurrency := test.WarmupConcurrency
+	if concurrency <= 0 {
+		concurrency = testspec.DefaultWarmupConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, req := range test.Warmup {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			response, err := client.MakeRequest(r.httpClient, r.varnishURL, req)
+			switch {
+			case err != nil:
+				failures[i] = fmt.Sprintf("%s: %v", req.URL, err)
+			case response.Status >= 500:
+				failures[i] = fmt.Sprintf("%s: status %d", req.URL, response.Status)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Keep failures in file order
+	for _, f := range failures {
+		if f != "" {
+			report.Failures = append(report.Failures, f)
+		}
+	}
+	r.logger.Debug("Warmup completed", "test", test.Name, "requests", report.Requests, "failed", len(report.Failures))
+	return report
+}
@@ -3,13 +3,16 @@ package service
 import (
 	"context"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/perbu/vcltest/pkg/varnish"
 	"github.com/perbu/vcltest/pkg/varnishadm"
 )
 
-// NewManager creates a new service manager with the given configuration
+// NewManager creates a new service manager with the given configuration.
+// The manager works on a copy: the secret it reads and the ports it assigns
+// are not written back to config.
 func NewManager(config *Config) (*Manager, error) {
 	if config == nil {
 		return nil, fmt.Errorf("config cannot be nil")
@@ -20,6 +23,20 @@ func NewManager(config *Config) (*Manager, error) {
 	if config.VarnishConfig == nil {
 		return nil, fmt.Errorf("varnish config cannot be nil")
 	}
+	cfg, varnishCfg := *config, *config.VarnishConfig
+	cfg.VarnishConfig = &varnishCfg
+	config = &cfg
+	if config.SecretFile != "" {
+		secret, err := os.ReadFile(config.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading secret file: %w", err)
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("secret file %s is empty", config.SecretFile)
+		}
+		config.Secret = string(secret)
+		config.VarnishConfig.SecretFile = config.SecretFile
+	}
 	if config.Secret == "" {
 		return nil, fmt.Errorf("secret cannot be empty")
 	}
@@ -29,6 +46,8 @@ func NewManager(config *Config) (*Manager, error) {
 
 	// Create varnishadm server (no broker needed - simplified flow)
 	varnishadmServer := varnishadm.New(config.VarnishadmPort, config.Secret, config.Logger, nil)
+	varnishadmServer.SetCommandTimeout(config.CLITimeout)
+	varnishadmServer.SetReconnectPolicy(config.Reconnect)
 
 	// Create varnish manager
 	varnishManager := varnish.New(
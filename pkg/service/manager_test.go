@@ -4,6 +4,7 @@ import (
 	"context"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -96,6 +97,47 @@ func TestNewManager(t *testing.T) {
 	}
 }
 
+func TestNewManagerSecretFile(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	secretPath := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretPath, []byte("external-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newConfig := func(secretFile string) *Config {
+		return &Config{
+			SecretFile: secretFile,
+			VCLPath:    "/tmp/test.vcl",
+			VarnishConfig: &varnish.Config{
+				WorkDir:    "/tmp/test",
+				VarnishDir: "/tmp/test/varnish",
+			},
+			Logger: logger,
+		}
+	}
+
+	config := newConfig(secretPath)
+	mgr, err := NewManager(config)
+	if err != nil {
+		t.Fatalf("NewManager() unexpected error: %v", err)
+	}
+	// varnishd uses the whole file as the secret, trailing newline included
+	if mgr.config.Secret != "external-secret\n" {
+		t.Errorf("Secret = %q, want file contents", mgr.config.Secret)
+	}
+	if mgr.config.VarnishConfig.SecretFile != secretPath {
+		t.Errorf("VarnishConfig.SecretFile = %q, want %q", mgr.config.VarnishConfig.SecretFile, secretPath)
+	}
+	// The caller's config is left alone
+	if config.Secret != "" || config.VarnishConfig.SecretFile != "" {
+		t.Errorf("NewManager() modified its config: Secret %q, VarnishConfig.SecretFile %q", config.Secret, config.VarnishConfig.SecretFile)
+	}
+
+	if _, err := NewManager(newConfig(filepath.Join(t.TempDir(), "missing"))); err == nil {
+		t.Error("NewManager() expected error for missing secret file")
+	}
+}
+
 func TestManagerGetters(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 	config := &Config{
@@ -3,6 +3,7 @@ package service
 import (
 	"io"
 	"log/slog"
+	"time"
 
 	"github.com/perbu/vcltest/pkg/varnish"
 	"github.com/perbu/vcltest/pkg/varnishadm"
@@ -14,6 +15,16 @@ type Config struct {
 	VarnishadmPort uint16
 	// Secret is the shared secret for varnishadm authentication
 	Secret string
+	// SecretFile is an existing varnishd secret file passed as -S, for wrapped
+	// varnishd builds that manage their own. If set, the secret is read from it
+	// (the whole file, as varnishd does) and Secret is ignored.
+	SecretFile string
+	// CLITimeout bounds each varnishadm command including its response
+	// (default: 30s overall, 10s per socket operation)
+	CLITimeout time.Duration
+	// Reconnect controls backoff and give-up for varnishd connections that
+	// fail authentication (default: retry forever with 100ms-5s backoff)
+	Reconnect varnishadm.ReconnectPolicy
 	// VarnishCmd is the path to the varnishd executable (empty for PATH lookup)
 	VarnishCmd string
 	// VCLPath is the path to the VCL file to load (must be prepared with backend addresses)
@@ -40,3 +51,14 @@ func (m *Manager) SetVarnishadmTranscript(w io.Writer) {
 		server.SetTranscriptWriter(w)
 	}
 }
+
+// CLIState reports whether varnishd has connected to the CLI and the last CLI
+// exchanges, for startup diagnostics. Without a *Server (with a mock) it
+// reports a connection and no exchanges.
+func (m *Manager) CLIState() (connected bool, recent []string) {
+	server, ok := m.varnishadm.(*varnishadm.Server)
+	if !ok {
+		return true, nil
+	}
+	return server.Connected(), server.RecentExchanges()
+}
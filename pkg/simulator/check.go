@@ -0,0 +1,416 @@
+package simulator
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/perbu/vclparser/pkg/ast"
+
+	"github.com/perbu/vcltest/pkg/backend"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+// UnsupportedError reports a VCL construct or test feature the simulator cannot run
+type UnsupportedError struct {
+	Line   int // VCL line, 0 if not about a VCL construct
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+	}
+	return e.Reason
+}
+
+func unsupported(node ast.Node, format string, args ...any) error {
+	line := 0
+	if node != nil {
+		line = node.Start().Line
+	}
+	return &UnsupportedError{Line: line, Reason: fmt.Sprintf(format, args...)}
+}
+
+// subActions are the builtin subroutines the simulator runs, with the
+// actions each may return
+var subActions = map[string][]string{
+	"vcl_recv":             {"hash", "pass", "synth"},
+	"vcl_hash":             {"lookup"},
+	"vcl_miss":             {"fetch", "pass", "synth"},
+	"vcl_pass":             {"fetch", "synth"},
+	"vcl_backend_fetch":    {"fetch", "abandon"},
+	"vcl_backend_response": {"deliver", "abandon"},
+	"vcl_backend_error":    {"deliver"},
+	"vcl_deliver":          {"deliver", "synth"},
+	"vcl_synth":            {"deliver"},
+}
+
+// skippedSubs are never reached without a cache, VMODs, pipe or purge,
+// so their contents do not matter
+var skippedSubs = []string{"vcl_hit", "vcl_pipe", "vcl_purge", "vcl_init", "vcl_fini"}
+
+// anyAction is allowed in custom subroutines; the caller's actions are checked at runtime
+var anyAction = []string{"hash", "lookup", "pass", "synth", "fetch", "abandon", "deliver"}
+
+// Variables the simulator can read and write, besides <obj>.http.<name>
+var (
+	readable = []string{"req.url", "req.method", "bereq.url", "bereq.method",
+		"beresp.status", "beresp.reason", "resp.status", "resp.reason", "client.ip"}
+	writable = []string{"req.url", "req.method", "bereq.url", "bereq.method",
+		"beresp.status", "beresp.reason", "beresp.body", "resp.status", "resp.reason", "resp.body",
+		"req.backend_hint", "bereq.backend"}
+	// Cache controls, which have no effect without a cache
+	noOps = []string{"beresp.ttl", "beresp.grace", "beresp.keep", "beresp.uncacheable",
+		"beresp.do_stream", "req.hash_always_miss", "req.hash_ignore_busy"}
+	httpObjects = []string{"req", "bereq", "beresp", "resp"}
+)
+
+// isHeader reports whether name is an <obj>.http.<name> variable
+func isHeader(name string) bool {
+	parts := strings.SplitN(name, ".", 3)
+	return len(parts) == 3 && parts[1] == "http" && slices.Contains(httpObjects, parts[0])
+}
+
+// varName returns the dotted name of a variable expression, or "" if expr is not one
+func varName(expr ast.Expression) string {
+	switch x := expr.(type) {
+	case *ast.Identifier:
+		return x.Name
+	case *ast.MemberExpression:
+		object, property := varName(x.Object), varName(x.Property)
+		if object == "" || property == "" {
+			return ""
+		}
+		return object + "." + property
+	}
+	return ""
+}
+
+// checker validates a parsed VCL program and collects what the engine needs
+type checker struct {
+	e *Engine
+}
+
+func (c *checker) checkSub(sub *ast.SubDecl) error {
+	name := sub.Name
+	if slices.Contains(skippedSubs, name) {
+		return nil
+	}
+	actions, builtin := subActions[name]
+	if !builtin {
+		if strings.HasPrefix(name, "vcl_") {
+			return unsupported(sub, "sub %s", name)
+		}
+		actions = anyAction
+	}
+	return c.checkStmt(sub.Body, actions)
+}
+
+func (c *checker) checkStmt(stmt ast.Statement, actions []string) error {
+	switch s := stmt.(type) {
+	case *ast.BlockStatement:
+		for _, inner := range s.Statements {
+			if err := c.checkStmt(inner, actions); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *ast.IfStatement:
+		if err := c.checkExpr(s.Condition); err != nil {
+			return err
+		}
+		if err := c.checkStmt(s.Then, actions); err != nil {
+			return err
+		}
+		if s.Else != nil {
+			return c.checkStmt(s.Else, actions)
+		}
+		return nil
+
+	case *ast.SetStatement:
+		name := varName(s.Variable)
+		if s.Operator != "=" {
+			return unsupported(s, "set %s %s", name, s.Operator)
+		}
+		if slices.Contains(noOps, name) {
+			return nil
+		}
+		if !isHeader(name) && !slices.Contains(writable, name) {
+			return unsupported(s, "set %s", name)
+		}
+		if name == "req.backend_hint" || name == "bereq.backend" {
+			id, ok := s.Value.(*ast.Identifier)
+			if !ok {
+				return unsupported(s, "%s must be set to a backend (directors are not supported)", name)
+			}
+			if _, ok := c.e.backends[id.Name]; !ok {
+				return unsupported(s, "%s: unknown backend %s", name, id.Name)
+			}
+			return nil
+		}
+		return c.checkExpr(s.Value)
+
+	case *ast.UnsetStatement:
+		if name := varName(s.Variable); !isHeader(name) {
+			return unsupported(s, "unset %s", name)
+		}
+		return nil
+
+	case *ast.CallStatement:
+		id, ok := s.Function.(*ast.Identifier)
+		if !ok {
+			return unsupported(s, "call of %s", s.Function.String())
+		}
+		if _, builtin := subActions[id.Name]; builtin || c.e.subs[id.Name] == nil {
+			return unsupported(s, "call %s", id.Name)
+		}
+		return nil
+
+	case *ast.ReturnStatement:
+		switch a := s.Action.(type) {
+		case nil:
+			return nil
+		case *ast.Identifier:
+			if !slices.Contains(actions, a.Name) {
+				return unsupported(s, "return (%s)", a.Name)
+			}
+			return nil
+		case *ast.CallExpression:
+			if varName(a.Function) != "synth" || !slices.Contains(actions, "synth") {
+				return unsupported(s, "return (%s(...))", varName(a.Function))
+			}
+			if len(a.Arguments) < 1 || len(a.Arguments) > 2 {
+				return unsupported(s, "synth with %d arguments", len(a.Arguments))
+			}
+			for _, arg := range a.Arguments {
+				if err := c.checkExpr(arg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return unsupported(s, "return (%s)", s.Action.String())
+
+	case *ast.SyntheticStatement:
+		return c.checkExpr(s.Response)
+
+	case *ast.ExpressionStatement:
+		// Calls made for their side effects on the cache key or the log
+		if call, ok := s.Expression.(*ast.CallExpression); ok {
+			switch varName(call.Function) {
+			case "hash_data", "std.log", "std.syslog":
+				for _, arg := range call.Arguments {
+					if err := c.checkExpr(arg); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+		return unsupported(s, "statement %s", s.Expression.String())
+	}
+	return unsupported(stmt, "%s", nodeKind(stmt))
+}
+
+func (c *checker) checkExpr(expr ast.Expression) error {
+	switch x := expr.(type) {
+	case *ast.StringLiteral, *ast.IntegerLiteral, *ast.BooleanLiteral, *ast.DurationLiteral, *ast.TimeExpression:
+		return nil
+
+	case *ast.ParenthesizedExpression:
+		return c.checkExpr(x.Expression)
+
+	case *ast.Identifier, *ast.MemberExpression:
+		name := varName(x)
+		if !isHeader(name) && !slices.Contains(readable, name) {
+			return unsupported(x, "variable %s", name)
+		}
+		return nil
+
+	case *ast.UnaryExpression:
+		if x.Operator != "!" {
+			return unsupported(x, "operator %s", x.Operator)
+		}
+		return c.checkExpr(x.Operand)
+
+	case *ast.BinaryExpression:
+		switch x.Operator {
+		case "&&", "||", "==", "!=", "+", "-", "<", ">", "<=", ">=":
+		default:
+			return unsupported(x, "operator %s", x.Operator)
+		}
+		// The parser groups "a && b || c" as "a && (b || c)"; only trust explicit parentheses
+		if x.Operator == "&&" {
+			for _, side := range []ast.Expression{x.Left, x.Right} {
+				if b, ok := side.(*ast.BinaryExpression); ok && b.Operator == "||" {
+					return unsupported(x, "&& and || mixed without parentheses")
+				}
+			}
+		}
+		if err := c.checkExpr(x.Left); err != nil {
+			return err
+		}
+		return c.checkExpr(x.Right)
+
+	case *ast.RegexMatchExpression:
+		if err := c.checkExpr(x.Left); err != nil {
+			return err
+		}
+		switch right := x.Right.(type) {
+		case *ast.StringLiteral:
+			return c.compileRegexp(right)
+		case *ast.Identifier:
+			if _, ok := c.e.acls[right.Name]; !ok {
+				return unsupported(x, "unknown ACL %s", right.Name)
+			}
+			return nil
+		}
+		return unsupported(x, "match against %s", x.Right.String())
+
+	case *ast.CallExpression:
+		name := varName(x.Function)
+		switch name {
+		case "regsub", "regsuball":
+			if len(x.Arguments) != 3 {
+				return unsupported(x, "%s with %d arguments", name, len(x.Arguments))
+			}
+			pattern, ok := x.Arguments[1].(*ast.StringLiteral)
+			if !ok {
+				return unsupported(x, "%s with a non-literal pattern", name)
+			}
+			if err := c.compileRegexp(pattern); err != nil {
+				return err
+			}
+			for _, arg := range []ast.Expression{x.Arguments[0], x.Arguments[2]} {
+				if err := c.checkExpr(arg); err != nil {
+					return err
+				}
+			}
+			return nil
+		case "std.tolower", "std.toupper":
+			if len(x.Arguments) != 1 {
+				return unsupported(x, "%s with %d arguments", name, len(x.Arguments))
+			}
+			return c.checkExpr(x.Arguments[0])
+		}
+		return unsupported(x, "function %s", name)
+	}
+	return unsupported(expr, "%s", nodeKind(expr))
+}
+
+// compileRegexp compiles a VCL regex. Patterns RE2 cannot express
+// (lookaround, backreferences) are unsupported.
+func (c *checker) compileRegexp(lit *ast.StringLiteral) error {
+	if _, ok := c.e.regexps[lit.Value]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(lit.Value)
+	if err != nil {
+		return unsupported(lit, "regex %q: %v", lit.Value, err)
+	}
+	c.e.regexps[lit.Value] = re
+	return nil
+}
+
+// compileACL converts ACL entries to prefixes. Host names are unsupported.
+func compileACL(decl *ast.ACLDecl) ([]aclEntry, error) {
+	entries := make([]aclEntry, 0, len(decl.Entries))
+	for _, entry := range decl.Entries {
+		network, bits := entry.Network, -1
+		if b, ok := network.(*ast.BinaryExpression); ok && b.Operator == "/" {
+			mask, ok := b.Right.(*ast.IntegerLiteral)
+			if !ok {
+				return nil, unsupported(entry, "acl %s: entry %s", decl.Name, network.String())
+			}
+			network, bits = b.Left, int(mask.Value)
+		}
+		lit, ok := network.(*ast.StringLiteral)
+		if !ok {
+			return nil, unsupported(entry, "acl %s: entry %s", decl.Name, network.String())
+		}
+		addr, err := netip.ParseAddr(lit.Value)
+		if err != nil {
+			return nil, unsupported(entry, "acl %s: %q is not an IP address", decl.Name, lit.Value)
+		}
+		if bits < 0 {
+			bits = addr.BitLen()
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return nil, unsupported(entry, "acl %s: %v", decl.Name, err)
+		}
+		entries = append(entries, aclEntry{prefix: prefix, negated: entry.Negated})
+	}
+	return entries, nil
+}
+
+// nodeKind names an AST node type for messages, e.g. "restart statement"
+func nodeKind(node ast.Node) string {
+	kind := strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+	for _, suffix := range []string{"Statement", "Expression"} {
+		if name, ok := strings.CutSuffix(kind, suffix); ok && name != "" {
+			return strings.ToLower(name) + " " + strings.ToLower(suffix)
+		}
+	}
+	return kind
+}
+
+// standardMethods are the methods the builtin vcl_recv does not pipe
+var standardMethods = []string{"GET", "HEAD", "PUT", "POST", "TRACE", "OPTIONS", "DELETE", "PATCH"}
+
+// CheckTest returns an *UnsupportedError if the test needs something only varnishd provides
+func CheckTest(test testspec.TestSpec) error {
+	if test.IsScenario() {
+		return &UnsupportedError{Reason: "scenario tests need varnishd's cache and clock"}
+	}
+	if test.IsPipeline() {
+		return &UnsupportedError{Reason: "pipeline tests need varnishd's connection handling"}
+	}
+	if test.Expectations.Cache != nil {
+		return &UnsupportedError{Reason: "cache expectations need varnishd's cache"}
+	}
+	if test.Expectations.Storage != "" {
+		return &UnsupportedError{Reason: "storage expectations need varnishd's storage"}
+	}
+	if test.Expectations.ESI != nil {
+		return &UnsupportedError{Reason: "esi expectations need varnishd's ESI processing"}
+	}
+	if test.WarmupFrom != "" {
+		return &UnsupportedError{Reason: "warmup_from needs varnishd's cache"}
+	}
+	if len(test.VarnishParams) > 0 {
+		return &UnsupportedError{Reason: "matrix parameters need varnishd"}
+	}
+	if test.Request.ExpectContinue {
+		return &UnsupportedError{Reason: "expect_continue needs varnishd's connection handling"}
+	}
+	if method := test.Request.Method; method != "" && !slices.Contains(standardMethods, method) {
+		return &UnsupportedError{Reason: fmt.Sprintf("%s requests are piped", method)}
+	}
+	for name, spec := range test.Backends {
+		if spec.Bandwidth != 0 {
+			return &UnsupportedError{Reason: fmt.Sprintf("backend %s: bandwidth needs varnishd's streaming and timeouts", name)}
+		}
+		generated := spec.Generate != nil
+		modes := []string{spec.FailureMode}
+		for _, route := range spec.Routes {
+			modes = append(modes, route.FailureMode)
+			generated = generated || route.Generate != nil
+		}
+		if generated {
+			return &UnsupportedError{Reason: fmt.Sprintf("backend %s: generate tests varnishd's size limits", name)}
+		}
+		for _, mode := range modes {
+			switch mode {
+			case "", backend.FailureFailed, backend.FailureFrozen:
+			default:
+				return &UnsupportedError{Reason: fmt.Sprintf("backend %s: failure_mode %s depends on varnishd's limits", name, mode)}
+			}
+		}
+	}
+	return nil
+}
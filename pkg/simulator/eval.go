@@ -0,0 +1,420 @@
+package simulator
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/perbu/vclparser/pkg/ast"
+)
+
+// action is what a subroutine returned. An empty name is a plain "return;"
+// from a custom subroutine.
+type action struct {
+	name   string
+	status int // synth only
+	reason string
+}
+
+// Values are string, int64 or bool; nil is an unset header
+type value = any
+
+// exec runs statements until one returns
+func (t *task) exec(stmts []ast.Statement) (*action, error) {
+	for _, stmt := range stmts {
+		act, err := t.execStmt(stmt)
+		if err != nil || act != nil {
+			return act, err
+		}
+	}
+	return nil, nil
+}
+
+func (t *task) execStmt(stmt ast.Statement) (*action, error) {
+	switch s := stmt.(type) {
+	case *ast.BlockStatement:
+		return t.exec(s.Statements)
+
+	case *ast.IfStatement:
+		cond, err := t.eval(s.Condition)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return t.execStmt(s.Then)
+		}
+		if s.Else != nil {
+			return t.execStmt(s.Else)
+		}
+		return nil, nil
+
+	case *ast.SetStatement:
+		name := varName(s.Variable)
+		switch {
+		case name == "req.backend_hint" || name == "bereq.backend":
+			t.backend = s.Value.(*ast.Identifier).Name
+			return nil, nil
+		case slices.Contains(noOps, name):
+			return nil, nil
+		}
+		v, err := t.eval(s.Value)
+		if err != nil {
+			return nil, err
+		}
+		return nil, t.set(name, v)
+
+	case *ast.UnsetStatement:
+		obj, header := splitHeader(varName(s.Variable))
+		t.message(obj).header.Del(header)
+		return nil, nil
+
+	case *ast.CallStatement:
+		name := s.Function.(*ast.Identifier).Name
+		for _, sub := range t.e.subs[name] {
+			act, err := t.exec(sub.Body.Statements)
+			if err != nil {
+				return nil, fmt.Errorf("sub %s: %w", name, err)
+			}
+			if act != nil && act.name != "" {
+				return act, nil
+			}
+		}
+		return nil, nil
+
+	case *ast.ReturnStatement:
+		switch a := s.Action.(type) {
+		case nil:
+			return &action{}, nil
+		case *ast.Identifier:
+			return &action{name: a.Name}, nil
+		case *ast.CallExpression:
+			status, err := t.eval(a.Arguments[0])
+			if err != nil {
+				return nil, err
+			}
+			code, err := toInt(status)
+			if err != nil {
+				return nil, fmt.Errorf("synth status: %w", err)
+			}
+			act := &action{name: "synth", status: int(code)}
+			if len(a.Arguments) > 1 {
+				reason, err := t.eval(a.Arguments[1])
+				if err != nil {
+					return nil, err
+				}
+				act.reason = toString(reason)
+			}
+			return act, nil
+		}
+
+	case *ast.SyntheticStatement:
+		v, err := t.eval(s.Response)
+		if err != nil {
+			return nil, err
+		}
+		m := t.bodyTarget()
+		m.body = append(m.body, toString(v)...)
+		return nil, nil
+
+	case *ast.ExpressionStatement:
+		// hash_data and std.log have no effect without a cache or VSL
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", nodeKind(stmt))
+}
+
+// bodyTarget is the response synthetic() writes to in the current subroutine
+func (t *task) bodyTarget() *message {
+	if t.sub == "vcl_backend_error" {
+		return &t.beresp
+	}
+	return &t.resp
+}
+
+// message returns the request or response a variable prefix refers to
+func (t *task) message(obj string) *message {
+	switch obj {
+	case "req":
+		return &t.req
+	case "bereq":
+		return &t.bereq
+	case "beresp":
+		return &t.beresp
+	case "resp":
+		return &t.resp
+	}
+	return nil
+}
+
+// splitHeader splits "req.http.X-Foo" into "req" and "X-Foo"
+func splitHeader(name string) (obj, header string) {
+	parts := strings.SplitN(name, ".", 3)
+	return parts[0], parts[2]
+}
+
+func (t *task) get(name string) (value, error) {
+	if name == "client.ip" {
+		return t.clientIP, nil
+	}
+	if isHeader(name) {
+		obj, header := splitHeader(name)
+		values := t.message(obj).header.Values(header)
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values[0], nil
+	}
+	obj, field, _ := strings.Cut(name, ".")
+	m := t.message(obj)
+	switch field {
+	case "url":
+		return m.url, nil
+	case "method":
+		return m.method, nil
+	case "status":
+		return int64(m.status), nil
+	case "reason":
+		return m.reason, nil
+	}
+	return nil, fmt.Errorf("unexpected variable %s", name)
+}
+
+func (t *task) set(name string, v value) error {
+	if isHeader(name) {
+		obj, header := splitHeader(name)
+		t.message(obj).header.Set(header, toString(v))
+		return nil
+	}
+	obj, field, _ := strings.Cut(name, ".")
+	m := t.message(obj)
+	switch field {
+	case "url":
+		m.url = toString(v)
+	case "method":
+		m.method = toString(v)
+	case "status":
+		status, err := toInt(v)
+		if err != nil {
+			return fmt.Errorf("set %s: %w", name, err)
+		}
+		m.status = int(status)
+	case "reason":
+		m.reason = toString(v)
+	case "body":
+		m.body = []byte(toString(v))
+	}
+	return nil
+}
+
+func (t *task) eval(expr ast.Expression) (value, error) {
+	switch x := expr.(type) {
+	case *ast.StringLiteral:
+		return x.Value, nil
+	case *ast.IntegerLiteral:
+		return x.Value, nil
+	case *ast.BooleanLiteral:
+		return x.Value, nil
+	case *ast.DurationLiteral:
+		return x.Value, nil
+	case *ast.TimeExpression:
+		return x.Value, nil
+	case *ast.ParenthesizedExpression:
+		return t.eval(x.Expression)
+	case *ast.Identifier, *ast.MemberExpression:
+		return t.get(varName(x))
+
+	case *ast.UnaryExpression:
+		v, err := t.eval(x.Operand)
+		if err != nil {
+			return nil, err
+		}
+		return !truthy(v), nil
+
+	case *ast.BinaryExpression:
+		left, err := t.eval(x.Left)
+		if err != nil {
+			return nil, err
+		}
+		// Short-circuit
+		switch x.Operator {
+		case "&&":
+			if !truthy(left) {
+				return false, nil
+			}
+		case "||":
+			if truthy(left) {
+				return true, nil
+			}
+		}
+		right, err := t.eval(x.Right)
+		if err != nil {
+			return nil, err
+		}
+		return binary(x.Operator, left, right)
+
+	case *ast.RegexMatchExpression:
+		left, err := t.eval(x.Left)
+		if err != nil {
+			return nil, err
+		}
+		var matched bool
+		if acl, ok := x.Right.(*ast.Identifier); ok {
+			matched = t.e.aclMatch(acl.Name, toString(left))
+		} else {
+			matched = t.e.regexps[x.Right.(*ast.StringLiteral).Value].MatchString(toString(left))
+		}
+		if x.Operator == "!~" {
+			matched = !matched
+		}
+		return matched, nil
+
+	case *ast.CallExpression:
+		args := make([]string, len(x.Arguments))
+		for i, arg := range x.Arguments {
+			v, err := t.eval(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = toString(v)
+		}
+		switch varName(x.Function) {
+		case "regsub":
+			return t.e.regsub(args[0], args[1], args[2], false), nil
+		case "regsuball":
+			return t.e.regsub(args[0], args[1], args[2], true), nil
+		case "std.tolower":
+			return strings.ToLower(args[0]), nil
+		case "std.toupper":
+			return strings.ToUpper(args[0]), nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s", nodeKind(expr))
+}
+
+func binary(op string, left, right value) (value, error) {
+	switch op {
+	case "&&", "||":
+		return truthy(right), nil
+	case "==", "!=":
+		equal := toString(left) == toString(right)
+		if op == "!=" {
+			return !equal, nil
+		}
+		return equal, nil
+	case "+":
+		// Numbers add, anything else concatenates
+		l, lok := left.(int64)
+		r, rok := right.(int64)
+		if lok && rok {
+			return l + r, nil
+		}
+		return toString(left) + toString(right), nil
+	}
+
+	l, err := toInt(left)
+	if err != nil {
+		return nil, fmt.Errorf("operator %s: %w", op, err)
+	}
+	r, err := toInt(right)
+	if err != nil {
+		return nil, fmt.Errorf("operator %s: %w", op, err)
+	}
+	switch op {
+	case "-":
+		return l - r, nil
+	case "<":
+		return l < r, nil
+	case ">":
+		return l > r, nil
+	case "<=":
+		return l <= r, nil
+	case ">=":
+		return l >= r, nil
+	}
+	return nil, fmt.Errorf("unexpected operator %s", op)
+}
+
+// regsub replaces the first (or every) match of pattern in s. The
+// replacement refers to groups as \0 to \9.
+func (e *Engine) regsub(s, pattern, replacement string, all bool) string {
+	re := e.regexps[pattern]
+	var template strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		switch {
+		case c == '\\' && i+1 < len(replacement) && replacement[i+1] >= '0' && replacement[i+1] <= '9':
+			template.WriteString("${" + replacement[i+1:i+2] + "}")
+			i++
+		case c == '$':
+			template.WriteString("$$")
+		default:
+			template.WriteByte(c)
+		}
+	}
+
+	if all {
+		return re.ReplaceAllString(s, template.String())
+	}
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return s
+	}
+	expanded := re.ExpandString(nil, template.String(), s, loc)
+	return s[:loc[0]] + string(expanded) + s[loc[1]:]
+}
+
+// aclMatch reports whether ip matches the ACL. The most specific entry
+// decides, and negated entries reject.
+func (e *Engine) aclMatch(name, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	best := -1
+	matched := false
+	for _, entry := range e.acls[name] {
+		if entry.prefix.Contains(addr) && entry.prefix.Bits() > best {
+			best = entry.prefix.Bits()
+			matched = !entry.negated
+		}
+	}
+	return matched
+}
+
+// truthy is VCL's boolean conversion: headers are true when set
+func truthy(v value) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case string:
+		return true
+	}
+	return false
+}
+
+func toString(v value) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func toInt(v value) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("expected a number, got %v", v)
+}
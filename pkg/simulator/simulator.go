@@ -0,0 +1,515 @@
+// Package simulator runs a subset of VCL in-process, without varnishd, so
+// simple routing and header tests run in milliseconds. It is experimental:
+// Compile rejects VCL that uses anything outside the subset, CheckTest
+// rejects tests that need a cache, and callers fall back to varnishd.
+//
+// The simulated Varnish never caches. Every request that is not answered
+// with synth calls the backend, as the first request after a cache nuke
+// does in real Varnish.
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/perbu/vclparser/pkg/ast"
+	"github.com/perbu/vclparser/pkg/parser"
+)
+
+// Backend timeouts when the VCL does not set them (varnishd's defaults)
+const (
+	DefaultConnectTimeout   = 3500 * time.Millisecond
+	DefaultFirstByteTimeout = 60 * time.Second
+)
+
+// Via is the Via header added to fetched responses
+const Via = "1.1 varnish (Varnish/simulated)"
+
+// Engine serves HTTP requests by interpreting VCL
+type Engine struct {
+	subs           map[string][]*ast.SubDecl // Builtin subs may be defined more than once
+	acls           map[string][]aclEntry
+	regexps        map[string]*regexp.Regexp // By pattern
+	backends       map[string]*simBackend
+	defaultBackend string // The first declared backend
+	xid            atomic.Int64
+	logger         *slog.Logger
+}
+
+// simBackend is a VCL backend with the transport used to fetch from it
+type simBackend struct {
+	addr      string // host:port
+	transport *http.Transport
+}
+
+// aclEntry is one ACL line
+type aclEntry struct {
+	prefix  netip.Prefix
+	negated bool
+}
+
+// Compile parses the VCL file (resolving includes) and checks that the
+// simulator can run it. Backends listed in addresses are fetched from that
+// host:port instead of their declared one. VCL the simulator cannot run
+// returns an *UnsupportedError.
+func Compile(vclPath string, addresses map[string]string, logger *slog.Logger) (*Engine, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	content, err := os.ReadFile(vclPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading VCL: %w", err)
+	}
+	program, err := parser.Parse(string(content), vclPath,
+		parser.WithResolveIncludes(filepath.Dir(vclPath)),
+		parser.WithSkipSubroutineValidation(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("parsing VCL: %w", err)
+	}
+
+	e := &Engine{
+		subs:     make(map[string][]*ast.SubDecl),
+		acls:     make(map[string][]aclEntry),
+		regexps:  make(map[string]*regexp.Regexp),
+		backends: make(map[string]*simBackend),
+		logger:   logger,
+	}
+	for _, decl := range program.Declarations {
+		switch d := decl.(type) {
+		case *ast.ImportDecl:
+			if d.Module != "std" {
+				return nil, unsupported(d, "import %s (only std is supported)", d.Module)
+			}
+		case *ast.IncludeDecl, *ast.ProbeDecl:
+			// Includes are resolved by the parser; backends are always healthy
+		case *ast.BackendDecl:
+			b, err := newBackend(d, addresses[d.Name])
+			if err != nil {
+				return nil, err
+			}
+			e.backends[d.Name] = b
+			if e.defaultBackend == "" {
+				e.defaultBackend = d.Name
+			}
+		case *ast.ACLDecl:
+			entries, err := compileACL(d)
+			if err != nil {
+				return nil, err
+			}
+			e.acls[d.Name] = entries
+		case *ast.SubDecl:
+			e.subs[d.Name] = append(e.subs[d.Name], d)
+		default:
+			return nil, unsupported(decl, "%s", nodeKind(decl))
+		}
+	}
+	if e.defaultBackend == "" {
+		return nil, &UnsupportedError{Reason: "VCL without backends"}
+	}
+
+	c := &checker{e: e}
+	for _, subs := range e.subs {
+		for _, sub := range subs {
+			if err := c.checkSub(sub); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e, nil
+}
+
+// newBackend creates the fetch transport for a backend declaration.
+// addr overrides the declared .host and .port when set.
+func newBackend(decl *ast.BackendDecl, addr string) (*simBackend, error) {
+	var host, port string
+	connectTimeout, firstByteTimeout := DefaultConnectTimeout, DefaultFirstByteTimeout
+	for _, prop := range decl.Properties {
+		var err error
+		switch prop.Name {
+		case "host":
+			host, err = stringProperty(prop)
+		case "port":
+			port, err = stringProperty(prop)
+		case "connect_timeout":
+			connectTimeout, err = durationProperty(prop)
+		case "first_byte_timeout":
+			firstByteTimeout, err = durationProperty(prop)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("backend %s: %w", decl.Name, err)
+		}
+	}
+	if addr == "" {
+		if port == "" {
+			port = "80"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	return &simBackend{
+		addr: addr,
+		transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			ResponseHeaderTimeout: firstByteTimeout,
+			DisableCompression:    true, // Pass the backend's encoding through as varnishd does
+		},
+	}, nil
+}
+
+func stringProperty(prop *ast.BackendProperty) (string, error) {
+	lit, ok := prop.Value.(*ast.StringLiteral)
+	if !ok {
+		return "", fmt.Errorf(".%s: expected a string, got %s", prop.Name, prop.Value.String())
+	}
+	return lit.Value, nil
+}
+
+func durationProperty(prop *ast.BackendProperty) (time.Duration, error) {
+	var literal string
+	switch v := prop.Value.(type) {
+	case *ast.TimeExpression:
+		literal = v.Value
+	case *ast.DurationLiteral:
+		literal = v.Value
+	default:
+		return 0, fmt.Errorf(".%s: expected a duration, got %s", prop.Name, prop.Value.String())
+	}
+	seconds, err := parser.ParseDuration(literal)
+	if err != nil {
+		return 0, fmt.Errorf(".%s: %w", prop.Name, err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Close releases idle backend connections
+func (e *Engine) Close() {
+	for _, b := range e.backends {
+		b.transport.CloseIdleConnections()
+	}
+}
+
+// message is a request or response as seen by VCL
+type message struct {
+	method string
+	url    string
+	status int
+	reason string
+	header http.Header
+	body   []byte
+}
+
+// task is one client request on its way through the subroutines
+type task struct {
+	e        *Engine
+	xid      int64
+	clientIP string
+	sub      string // The builtin subroutine being run
+	backend  string // req.backend_hint, then bereq.backend
+	req      message
+	bereq    message
+	beresp   message
+	resp     message
+}
+
+// ServeHTTP runs a request through the VCL state machine
+func (e *Engine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	t := &task{
+		e:        e,
+		xid:      e.xid.Add(1),
+		clientIP: clientIP,
+		backend:  e.defaultBackend,
+		req: message{
+			method: r.Method,
+			url:    r.RequestURI,
+			header: r.Header.Clone(),
+			body:   body,
+		},
+	}
+	t.req.header.Set("Host", r.Host)
+	if xff := t.req.header.Get("X-Forwarded-For"); xff != "" {
+		t.req.header.Set("X-Forwarded-For", xff+", "+clientIP)
+	} else {
+		t.req.header.Set("X-Forwarded-For", clientIP)
+	}
+
+	if err := t.run(); err != nil {
+		// varnishd fails the request with a plain 503 when VCL fails
+		e.logger.Warn("Simulated VCL failed", "url", r.RequestURI, "error", err)
+		t.resp = message{status: http.StatusServiceUnavailable, reason: "VCL failed", header: make(http.Header)}
+		t.builtinSynth(&t.resp)
+	}
+	t.write(w)
+}
+
+// run moves the request through the subroutines, leaving the response in t.resp
+func (t *task) run() error {
+	act, err := t.call("vcl_recv")
+	if err != nil {
+		return err
+	}
+	pass := act.name == "pass"
+	switch act.name {
+	case "hash":
+		if _, err := t.call("vcl_hash"); err != nil {
+			return err
+		}
+		if act, err = t.call("vcl_miss"); err != nil {
+			return err
+		}
+		if act.name == "pass" {
+			pass = true
+			act, err = t.call("vcl_pass")
+		}
+	case "pass":
+		act, err = t.call("vcl_pass")
+	}
+	if err != nil {
+		return err
+	}
+
+	if act.name == "fetch" {
+		if act, err = t.fetch(pass); err != nil {
+			return err
+		}
+	}
+	if act.name == "synth" {
+		return t.synth(act)
+	}
+
+	// Deliver
+	t.resp.header.Set("X-Varnish", strconv.FormatInt(t.xid, 10))
+	t.resp.header.Set("Age", "0")
+	t.resp.header.Set("Via", Via)
+	if t.resp.status == http.StatusOK && !pass {
+		t.resp.header.Set("Accept-Ranges", "bytes")
+	}
+	if act, err = t.call("vcl_deliver"); err != nil {
+		return err
+	}
+	if act.name == "synth" {
+		return t.synth(act)
+	}
+	return nil
+}
+
+// Headers varnishd does not forward (hop-by-hop), and those it drops on a
+// cache miss because it fetches the whole object
+var (
+	hopByHop    = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "TE", "Trailer", "Transfer-Encoding", "Upgrade"}
+	missFilters = []string{"Range", "If-Range", "If-Modified-Since", "If-Unmodified-Since", "If-None-Match", "If-Match"}
+)
+
+// fetch runs the backend side and copies the backend response to t.resp.
+// Returns deliver, or synth if the fetch was abandoned.
+func (t *task) fetch(pass bool) (action, error) {
+	t.bereq = message{
+		method: t.req.method,
+		url:    t.req.url,
+		header: t.req.header.Clone(),
+	}
+	for _, name := range hopByHop {
+		t.bereq.header.Del(name)
+	}
+	if pass {
+		t.bereq.body = t.req.body
+	} else {
+		// A miss fetches the full object with GET, compressed if possible
+		t.bereq.method = http.MethodGet
+		for _, name := range missFilters {
+			t.bereq.header.Del(name)
+		}
+		t.bereq.header.Set("Accept-Encoding", "gzip")
+	}
+	t.bereq.header.Set("X-Varnish", strconv.FormatInt(t.e.xid.Add(1), 10))
+
+	act, err := t.call("vcl_backend_fetch")
+	if err != nil {
+		return action{}, err
+	}
+	if act.name == "abandon" {
+		return action{name: "synth", status: http.StatusServiceUnavailable, reason: "Backend fetch failed"}, nil
+	}
+
+	if err := t.fetchBackend(); err != nil {
+		t.e.logger.Debug("Simulated backend fetch failed", "backend", t.backend, "url", t.bereq.url, "error", err)
+		t.beresp = message{status: http.StatusServiceUnavailable, reason: "Backend fetch failed", header: make(http.Header)}
+		t.beresp.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		t.beresp.header.Set("Server", "Varnish")
+		act, err = t.call("vcl_backend_error")
+	} else {
+		act, err = t.call("vcl_backend_response")
+	}
+	if err != nil {
+		return action{}, err
+	}
+	if act.name == "abandon" {
+		return action{name: "synth", status: http.StatusServiceUnavailable, reason: "Backend fetch failed"}, nil
+	}
+
+	t.resp = message{
+		status: t.beresp.status,
+		reason: t.beresp.reason,
+		header: t.beresp.header.Clone(),
+		body:   t.beresp.body,
+	}
+	for _, name := range append(hopByHop, "Content-Length") {
+		t.resp.header.Del(name)
+	}
+	return action{name: "deliver"}, nil
+}
+
+// fetchBackend sends bereq to the selected backend and stores the response in beresp
+func (t *task) fetchBackend() error {
+	b, ok := t.e.backends[t.backend]
+	if !ok {
+		return fmt.Errorf("unknown backend %q", t.backend)
+	}
+
+	// Send the URL as VCL left it, without re-encoding
+	path, query, _ := strings.Cut(t.bereq.url, "?")
+	req := &http.Request{
+		Method:        t.bereq.method,
+		URL:           &url.URL{Scheme: "http", Host: b.addr, Opaque: path, RawQuery: query},
+		Header:        t.bereq.header.Clone(),
+		Host:          t.bereq.header.Get("Host"),
+		Body:          io.NopCloser(bytes.NewReader(t.bereq.body)),
+		ContentLength: int64(len(t.bereq.body)),
+	}
+	req.Header.Del("Host")
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""} // Suppress Go's default
+	}
+
+	resp, err := b.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+
+	reason := strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+	t.beresp = message{status: resp.StatusCode, reason: reason, header: resp.Header, body: body}
+	return nil
+}
+
+// synth builds a synthetic response and runs vcl_synth
+func (t *task) synth(act action) error {
+	reason := act.reason
+	if reason == "" {
+		reason = http.StatusText(act.status)
+	}
+	t.resp = message{status: act.status, reason: reason, header: make(http.Header)}
+	t.resp.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	t.resp.header.Set("Server", "Varnish")
+	t.resp.header.Set("X-Varnish", strconv.FormatInt(t.xid, 10))
+	_, err := t.call("vcl_synth")
+	return err
+}
+
+// write sends t.resp to the client
+func (t *task) write(w http.ResponseWriter) {
+	header := w.Header()
+	for name, values := range t.resp.header {
+		header[name] = values
+	}
+	status := t.resp.status
+	if status < 100 || status > 999 {
+		status = http.StatusServiceUnavailable
+	}
+	header.Set("Content-Length", strconv.Itoa(len(t.resp.body)))
+	w.WriteHeader(status)
+	if t.req.method != http.MethodHead {
+		_, _ = w.Write(t.resp.body)
+	}
+}
+
+// call runs the VCL's definitions of a builtin subroutine, then the builtin
+// behaviour if none of them returned
+func (t *task) call(name string) (action, error) {
+	t.sub = name
+	for _, sub := range t.e.subs[name] {
+		act, err := t.exec(sub.Body.Statements)
+		if err != nil {
+			return action{}, fmt.Errorf("%s: %w", name, err)
+		}
+		if act != nil && act.name != "" {
+			for _, allowed := range subActions[name] {
+				if act.name == allowed {
+					return *act, nil
+				}
+			}
+			return action{}, fmt.Errorf("%s: return (%s) is not supported here", name, act.name)
+		}
+	}
+	return t.builtin(name)
+}
+
+// builtin runs the relevant parts of builtin.vcl for a subroutine
+func (t *task) builtin(name string) (action, error) {
+	switch name {
+	case "vcl_recv":
+		switch {
+		case !slices.Contains(standardMethods, t.req.method):
+			return action{}, fmt.Errorf("vcl_recv: %s requests are piped, which is not supported", t.req.method)
+		case t.req.method != http.MethodGet && t.req.method != http.MethodHead:
+			return action{name: "pass"}, nil
+		case t.req.header.Get("Authorization") != "" || t.req.header.Get("Cookie") != "":
+			return action{name: "pass"}, nil
+		}
+		return action{name: "hash"}, nil
+	case "vcl_hash":
+		return action{name: "lookup"}, nil
+	case "vcl_miss", "vcl_pass", "vcl_backend_fetch":
+		return action{name: "fetch"}, nil
+	case "vcl_backend_error":
+		t.builtinSynth(&t.beresp)
+		return action{name: "deliver"}, nil
+	case "vcl_synth":
+		t.builtinSynth(&t.resp)
+		return action{name: "deliver"}, nil
+	}
+	return action{name: "deliver"}, nil
+}
+
+// builtinSynth fills in the builtin error page
+func (t *task) builtinSynth(m *message) {
+	m.header.Set("Content-Type", "text/html; charset=utf-8")
+	m.header.Set("Retry-After", "5")
+	m.body = []byte(fmt.Sprintf(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>%[1]d %[2]s</title>
+  </head>
+  <body>
+    <h1>Error %[1]d %[2]s</h1>
+    <p>%[2]s</p>
+    <h3>Guru Meditation:</h3>
+    <p>XID: %[3]d</p>
+    <hr>
+    <p>Varnish cache server</p>
+  </body>
+</html>
+`, m.status, m.reason, t.xid))
+}
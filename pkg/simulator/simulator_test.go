@@ -0,0 +1,332 @@
+package simulator
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/perbu/vcltest/pkg/backend"
+	"github.com/perbu/vcltest/pkg/testspec"
+)
+
+const testVCL = `vcl 4.1;
+import std;
+
+backend default { .host = "192.0.2.1"; .port = "80"; }
+backend api { .host = "192.0.2.2"; .port = "80"; }
+
+acl internal { "127.0.0.0"/8; !"127.0.0.2"; }
+
+sub vcl_recv {
+	if (req.url ~ "^/admin" && !(client.ip ~ internal)) {
+		return (synth(403, "Forbidden"));
+	}
+	if (req.url == "/old") {
+		return (synth(750, "/new"));
+	}
+	if (req.url ~ "^/api/") {
+		set req.backend_hint = api;
+		set req.url = regsub(req.url, "^/api(/.*)$", "\1");
+	}
+	set req.http.X-Host = std.tolower(req.http.host);
+	unset req.http.Cookie;
+	call normalize;
+}
+
+sub normalize {
+	if (!req.http.X-Lang) {
+		set req.http.X-Lang = "en";
+		return;
+	}
+	set req.http.X-Lang = regsuball(req.http.X-Lang, "[^a-z]", "");
+}
+
+sub vcl_backend_response {
+	set beresp.ttl = 1h;
+	set beresp.http.X-Backend-Status = beresp.status;
+}
+
+sub vcl_deliver {
+	unset resp.http.X-Varnish;
+	set resp.http.X-Served-By = "simulated " + resp.status;
+}
+
+sub vcl_synth {
+	if (resp.status == 750) {
+		set resp.status = 301;
+		set resp.http.Location = resp.reason;
+		return (deliver);
+	}
+}
+`
+
+// startEngine compiles vcl with the default and api backends pointed at mock backends
+func startEngine(t *testing.T, vcl string) (*httptest.Server, map[string]*backend.MockBackend) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.vcl")
+	if err := os.WriteFile(path, []byte(vcl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mocks := map[string]*backend.MockBackend{}
+	addresses := map[string]string{}
+	for _, name := range []string{"default", "api"} {
+		mock := backend.New(backend.Config{Status: 200, Body: name, EchoRequest: name == "api"})
+		addr, err := mock.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = mock.Stop() })
+		mocks[name] = mock
+		addresses[name] = addr
+	}
+
+	engine, err := Compile(path, addresses, nil)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	server := httptest.NewServer(engine)
+	t.Cleanup(func() {
+		server.Close()
+		engine.Close()
+	})
+	return server, mocks
+}
+
+func get(t *testing.T, server *httptest.Server, path string, headers map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestEngine(t *testing.T) {
+	server, mocks := startEngine(t, testVCL)
+
+	tests := []struct {
+		name        string
+		path        string
+		headers     map[string]string
+		wantStatus  int
+		wantHeaders map[string]string
+		wantBody    []string
+		wantCalls   map[string]int
+	}{
+		{
+			name:        "default backend",
+			path:        "/",
+			wantStatus:  200,
+			wantHeaders: map[string]string{"X-Backend-Status": "200", "X-Served-By": "simulated 200", "Age": "0", "Via": Via, "X-Varnish": ""},
+			wantBody:    []string{"default"},
+			wantCalls:   map[string]int{"default": 1},
+		},
+		{
+			name:       "routed and rewritten",
+			path:       "/api/users?id=1",
+			headers:    map[string]string{"Cookie": "a=b", "X-Lang": "en_gb"},
+			wantStatus: 200,
+			wantBody: []string{
+				`"url":"/users?id=1"`,
+				`"method":"GET"`,
+				`"X-Lang":["engb"]`,
+				`"X-Host":["127.0.0.1:`,
+				`"Accept-Encoding":["gzip"]`,
+				`"X-Forwarded-For":["127.0.0.1"]`,
+			},
+			wantCalls: map[string]int{"api": 1},
+		},
+		{
+			name:       "plain return from custom sub",
+			path:       "/api/",
+			wantStatus: 200,
+			wantBody:   []string{`"X-Lang":["en"]`},
+			wantCalls:  map[string]int{"api": 1},
+		},
+		{
+			name:        "synth redirect",
+			path:        "/old",
+			wantStatus:  301,
+			wantHeaders: map[string]string{"Location": "/new", "X-Served-By": ""},
+			wantCalls:   map[string]int{},
+		},
+		{
+			name:        "acl allows internal client",
+			path:        "/admin",
+			wantStatus:  200,
+			wantHeaders: map[string]string{"X-Served-By": "simulated 200"},
+			wantCalls:   map[string]int{"default": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mock := range mocks {
+				mock.ResetCallCount()
+			}
+			resp, body := get(t, server, tt.path, tt.headers)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %q)", resp.StatusCode, tt.wantStatus, body)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := resp.Header.Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(body, want) {
+					t.Errorf("body %q does not contain %q", body, want)
+				}
+			}
+			for name, mock := range mocks {
+				if got := mock.GetCallCount(); got != tt.wantCalls[name] {
+					t.Errorf("backend %s calls = %d, want %d", name, got, tt.wantCalls[name])
+				}
+			}
+		})
+	}
+}
+
+func TestEngine_SynthAndBackendError(t *testing.T) {
+	vcl := `vcl 4.1;
+backend default { .host = "127.0.0.1"; .port = "9"; .connect_timeout = 1s; }
+backend up { .host = "192.0.2.1"; }
+
+sub vcl_recv {
+	if (req.url == "/deny") {
+		return (synth(403));
+	}
+	if (req.url == "/custom") {
+		return (synth(404, "Gone"));
+	}
+	if (req.url == "/up") {
+		set req.backend_hint = up;
+	}
+}
+
+sub vcl_synth {
+	if (resp.status == 404) {
+		synthetic("custom " + resp.reason);
+		return (deliver);
+	}
+}
+`
+	path := filepath.Join(t.TempDir(), "test.vcl")
+	if err := os.WriteFile(path, []byte(vcl), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := Compile(path, nil, nil)
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	resp, body := get(t, server, "/deny", nil)
+	if resp.StatusCode != 403 || !strings.Contains(body, "Error 403 Forbidden") || resp.Header.Get("Retry-After") != "5" {
+		t.Errorf("builtin synth: status %d, body %q", resp.StatusCode, body)
+	}
+	resp, body = get(t, server, "/custom", nil)
+	if resp.StatusCode != 404 || body != "custom Gone" {
+		t.Errorf("custom synth: status %d, body %q", resp.StatusCode, body)
+	}
+	resp, body = get(t, server, "/", nil)
+	if resp.StatusCode != 503 || !strings.Contains(body, "Backend fetch failed") {
+		t.Errorf("backend error: status %d, body %q", resp.StatusCode, body)
+	}
+}
+
+func TestCompile_Unsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		vcl  string
+		want string // "" = supported
+	}{
+		{"vmod", `import directors;`, "import directors"},
+		{"restart", `sub vcl_recv { return (restart); }`, "line 4: return (restart)"},
+		{"pipe", `sub vcl_recv { return (pipe); }`, "return (pipe)"},
+		{"variable", `sub vcl_recv { if (req.restarts > 0) { return (pass); } }`, "variable req.restarts"},
+		{"set operator", `sub vcl_recv { set req.http.x += "a"; }`, "set req.http.x +="},
+		{"director", `sub vcl_recv { set req.backend_hint = std.backend("x"); }`, "directors are not supported"},
+		{"function", `sub vcl_recv { set req.http.x = std.querysort(req.url); }`, "function std.querysort"},
+		{"lookaround regex", `sub vcl_recv { if (req.url ~ "^/(?!api)") { return (pass); } }`, "regex"},
+		{"precedence", `sub vcl_recv { if (req.http.a && req.http.b || req.http.c) { return (pass); } }`, "without parentheses"},
+		{"parenthesized", `sub vcl_recv { if (req.http.a && (req.http.b || req.http.c)) { return (pass); } }`, ""},
+		{"unreachable subroutine", `sub vcl_hit { return (restart); }`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vcl := "vcl 4.1;\nimport std;\nbackend default { .host = \"192.0.2.1\"; }\n" + tt.vcl
+			path := filepath.Join(t.TempDir(), "test.vcl")
+			if err := os.WriteFile(path, []byte(vcl), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Compile(path, nil, nil)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Compile() error = %v, want nil", err)
+				}
+				return
+			}
+			var unsupportedErr *UnsupportedError
+			if !errors.As(err, &unsupportedErr) {
+				t.Fatalf("Compile() error = %v, want *UnsupportedError", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Compile() error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTest(t *testing.T) {
+	hit := true
+	tests := []struct {
+		name string
+		test testspec.TestSpec
+		want string // "" = supported
+	}{
+		{"simple", testspec.TestSpec{Request: testspec.RequestSpec{URL: "/"}}, ""},
+		{"scenario", testspec.TestSpec{Scenario: []testspec.ScenarioStep{{At: new(testspec.Duration)}}}, "scenario"},
+		{"cache", testspec.TestSpec{Expectations: testspec.ExpectationsSpec{Cache: &testspec.CacheExpectations{Hit: &hit}}}, "cache"},
+		{"piped method", testspec.TestSpec{Request: testspec.RequestSpec{URL: "/", Method: "PURGE"}}, "piped"},
+		{"matrix cell", testspec.TestSpec{Request: testspec.RequestSpec{URL: "/"}, VarnishParams: map[string]string{"default_grace": "0s"}}, "matrix"},
+		{"failed backend", testspec.TestSpec{Backends: map[string]testspec.BackendSpec{"default": {FailureMode: "failed"}}}, ""},
+		{"route failure mode", testspec.TestSpec{Backends: map[string]testspec.BackendSpec{
+			"default": {Routes: map[string]testspec.RouteSpec{"/x": {FailureMode: "truncated"}}},
+		}}, "failure_mode truncated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckTest(tt.test)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("CheckTest() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("CheckTest() = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
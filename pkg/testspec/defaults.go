@@ -0,0 +1,285 @@
+package testspec
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A document of a test file is a test, a list of tests, or defaults for
+// the tests that follow it in the file:
+//
+//	defaults:
+//	  request:
+//	    headers:
+//	      Host: www.example.com
+//	  backends:
+//	    default:
+//	      status: 200
+//
+// Defaults are merged into each following test: mappings are merged key by
+// key and the test's own values win. In scenario tests, default request and
+// expectations fields apply to every step, and in sequence tests default
+// expectations apply to every entry. A later defaults document replaces
+// the earlier one.
+//
+// Defaults can also be given per host, for VCL that serves several sites:
+//
+//	defaults:
+//	  hosts:
+//	    shop.example.com:
+//	      expectations:
+//	        response:
+//	          headers:
+//	            X-Brand: shop
+//
+// A test (or scenario step) whose request host, from request.host or the
+// Host header, matches a key gets that host's request and expectations
+// defaults. They win over the other defaults; the test's own values win
+// over both. Hosts are matched case-insensitively.
+
+// hostDefaults are the defaults for requests to one host
+type hostDefaults struct {
+	Request      RequestSpec      `yaml:"request,omitempty"`
+	Expectations ExpectationsSpec `yaml:"expectations,omitempty"`
+}
+
+// stepDefaultKeys are the defaults that scenario tests apply per step
+var stepDefaultKeys = []string{"request", "expectations"}
+
+// decodeDocument decodes the tests of one document, with the defaults merged
+// in and the presets they name expanded. doc is the document as read by a
+// node decoder; decoder is a strict decoder over the same file, positioned at
+// the same document, so that unknown fields are reported with their line in
+// the file. For a defaults document it returns the new defaults and no tests.
+func decodeDocument(decoder *yaml.Decoder, doc *yaml.Node, defaults *yaml.Node, presets map[string]*yaml.Node) ([]TestSpec, *yaml.Node, error) {
+	var root *yaml.Node
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		root = doc.Content[0]
+	}
+
+	var items []*yaml.Node
+	switch {
+	case root != nil && root.Kind == yaml.SequenceNode:
+		var tests []TestSpec
+		if err := decoder.Decode(&tests); err != nil {
+			return nil, nil, err
+		}
+		items = root.Content
+	case root != nil && root.Kind == yaml.MappingNode && len(root.Content) == 2 && root.Content[0].Value == "defaults":
+		var defaultsDoc struct {
+			Defaults struct {
+				TestSpec `yaml:",inline"`
+				Hosts    map[string]hostDefaults `yaml:"hosts"`
+			} `yaml:"defaults"`
+		}
+		if err := decoder.Decode(&defaultsDoc); err != nil {
+			return nil, nil, err
+		}
+		if defaultsDoc.Defaults.Name != "" {
+			return nil, nil, fmt.Errorf("defaults cannot set the test name")
+		}
+		return nil, root.Content[1], nil
+	default:
+		var test TestSpec
+		if err := decoder.Decode(&test); err != nil {
+			return nil, nil, err
+		}
+		if root == nil {
+			return []TestSpec{test}, nil, nil
+		}
+		items = []*yaml.Node{root}
+	}
+
+	// Fields were checked by the strict decoder, so the merged nodes can be
+	// decoded directly
+	tests := make([]TestSpec, len(items))
+	for i, item := range items {
+		merged, err := applyPresets(applyDocumentDefaults(item, defaults), presets)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := merged.Decode(&tests[i]); err != nil {
+			return nil, nil, err
+		}
+		tests[i].Lines = indexLines(item)
+	}
+	return tests, nil, nil
+}
+
+// applyDocumentDefaults returns a copy of a test node with the defaults
+// merged in. defaults may be nil.
+func applyDocumentDefaults(test, defaults *yaml.Node) *yaml.Node {
+	if defaults == nil {
+		return test
+	}
+	defaults, hosts := splitHostDefaults(defaults)
+	scenario := mappingValue(test, "scenario")
+	if scenario == nil || scenario.Kind != yaml.SequenceNode {
+		return applySequenceDefaults(test, mergeHostDefaults(defaults, test, hosts))
+	}
+
+	// Step-level defaults go to each step instead of the test
+	testDefaults := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	stepDefaults := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for i := 0; i+1 < len(defaults.Content); i += 2 {
+		target := testDefaults
+		for _, key := range stepDefaultKeys {
+			if defaults.Content[i].Value == key {
+				target = stepDefaults
+			}
+		}
+		target.Content = append(target.Content, defaults.Content[i], defaults.Content[i+1])
+	}
+	merged := mergeNodes(testDefaults, test)
+	steps := *mappingValue(merged, "scenario")
+	steps.Content = make([]*yaml.Node, len(scenario.Content))
+	for i, step := range scenario.Content {
+		steps.Content[i] = mergeHostDefaults(stepDefaults, step, hosts)
+	}
+	setMappingValue(merged, "scenario", &steps)
+	return merged
+}
+
+// splitHostDefaults separates the hosts entry of a defaults mapping from the
+// other defaults. The hosts are keyed in lower case.
+func splitHostDefaults(defaults *yaml.Node) (*yaml.Node, map[string]*yaml.Node) {
+	hostsNode := mappingValue(defaults, "hosts")
+	if hostsNode == nil {
+		return defaults, nil
+	}
+	hosts := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(hostsNode.Content); i += 2 {
+		hosts[strings.ToLower(hostsNode.Content[i].Value)] = hostsNode.Content[i+1]
+	}
+	return withoutKey(defaults, "hosts"), hosts
+}
+
+// applySequenceDefaults moves default expectations merged into a sequence
+// test to each of its entries. test is the node before merging.
+func applySequenceDefaults(test, merged *yaml.Node) *yaml.Node {
+	sequence := mappingValue(test, "sequence")
+	expectations := mappingValue(merged, "expectations")
+	if sequence == nil || sequence.Kind != yaml.SequenceNode || expectations == nil || mappingValue(test, "expectations") != nil {
+		return merged
+	}
+	entries := *sequence
+	entries.Content = make([]*yaml.Node, len(sequence.Content))
+	for i, entry := range sequence.Content {
+		entries.Content[i] = mergeNodes(expectations, entry)
+	}
+	merged = withoutKey(merged, "expectations")
+	setMappingValue(merged, "sequence", &entries)
+	return merged
+}
+
+// mergeHostDefaults merges the defaults into a test or scenario step node,
+// and the defaults of its request host between the two
+func mergeHostDefaults(defaults, test *yaml.Node, hosts map[string]*yaml.Node) *yaml.Node {
+	merged := mergeNodes(defaults, test)
+	if hostDefaults, ok := hosts[strings.ToLower(requestHost(merged))]; ok {
+		merged = mergeNodes(defaults, mergeNodes(hostDefaults, test))
+	}
+	return withoutDefaultHostHeader(test, merged)
+}
+
+// withoutDefaultHostHeader drops a default Host header from the merged node
+// when the test sets request.host, which then wins
+func withoutDefaultHostHeader(test, merged *yaml.Node) *yaml.Node {
+	request := mappingValue(test, "request")
+	if request == nil || mappingValue(request, "host") == nil || headerKey(mappingValue(request, "headers")) != "" {
+		return merged
+	}
+	mergedRequest := mappingValue(merged, "request")
+	headers := mappingValue(mergedRequest, "headers")
+	if key := headerKey(headers); key != "" {
+		setMappingValue(mergedRequest, "headers", withoutKey(headers, key))
+	}
+	return merged
+}
+
+// headerKey returns the key of the Host header in a headers node, or ""
+func headerKey(headers *yaml.Node) string {
+	if headers == nil || headers.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(headers.Content); i += 2 {
+		if strings.EqualFold(headers.Content[i].Value, "Host") {
+			return headers.Content[i].Value
+		}
+	}
+	return ""
+}
+
+// requestHost returns the host a test or step node requests, from
+// request.host or the Host header, or ""
+func requestHost(node *yaml.Node) string {
+	request := mappingValue(node, "request")
+	if request == nil {
+		return ""
+	}
+	if host := mappingValue(request, "host"); host != nil && host.Kind == yaml.ScalarNode {
+		return host.Value
+	}
+	headers := mappingValue(request, "headers")
+	if key := headerKey(headers); key != "" {
+		return mappingValue(headers, key).Value
+	}
+	return ""
+}
+
+// mergeNodes merges two YAML nodes. If both are mappings, the result has the
+// keys of both, merged recursively, with override winning on conflicts.
+// Otherwise the result is override.
+func mergeNodes(base, override *yaml.Node) *yaml.Node {
+	if base == nil || base.Kind != yaml.MappingNode || override.Kind != yaml.MappingNode {
+		return override
+	}
+	merged := *override
+	merged.Content = append([]*yaml.Node(nil), override.Content...)
+	for i := 0; i+1 < len(base.Content); i += 2 {
+		key, value := base.Content[i], base.Content[i+1]
+		if existing := mappingValue(override, key.Value); existing != nil {
+			setMappingValue(&merged, key.Value, mergeNodes(value, existing))
+			continue
+		}
+		merged.Content = append(merged.Content, key, value)
+	}
+	return &merged
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// withoutKey returns a copy of a mapping node without key
+func withoutKey(mapping *yaml.Node, key string) *yaml.Node {
+	rest := *mapping
+	rest.Content = nil
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key {
+			rest.Content = append(rest.Content, mapping.Content[i], mapping.Content[i+1])
+		}
+	}
+	return &rest
+}
+
+// setMappingValue replaces the value of an existing key in a mapping node
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+}
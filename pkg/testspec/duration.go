@@ -0,0 +1,46 @@
+package testspec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a length of time in a spec, written in YAML as a Go duration
+// ("90s", "2m", "1h30m") or a bare number of seconds (90)
+type Duration time.Duration
+
+// Seconds returns the duration as a floating point number of seconds
+func (d Duration) Seconds() float64 {
+	return time.Duration(d).Seconds()
+}
+
+// String formats the duration in seconds, e.g. "90s"
+func (d Duration) String() string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// UnmarshalYAML accepts a duration string or a number of seconds
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	if seconds, ok := scalarNumber(value); ok {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	if value.Kind != yaml.ScalarNode {
+		return invalidLiteral(value, fmt.Errorf("duration must be a number of seconds or a string like 90s or 2m"))
+	}
+	parsed, err := time.ParseDuration(strings.TrimSpace(value.Value))
+	if err != nil {
+		return invalidLiteral(value, fmt.Errorf("invalid duration %q: use a number of seconds or a string like 90s or 2m", value.Value))
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalYAML writes the duration in the form UnmarshalYAML reads
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
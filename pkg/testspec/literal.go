@@ -0,0 +1,92 @@
+package testspec
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// literalError is an invalid size, rate or duration literal, with its
+// position in the YAML and, once the loader has located it, its path
+type literalError struct {
+	line   int
+	column int
+	path   string // e.g. "scenario[1].expectations.eventually.timeout"
+	err    error
+}
+
+func (e *literalError) Error() string {
+	if e.path != "" {
+		return fmt.Sprintf("line %d: %s: %v", e.line, e.path, e.err)
+	}
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+func (e *literalError) Unwrap() error {
+	return e.err
+}
+
+// invalidLiteral returns the error for an invalid literal in value
+func invalidLiteral(value *yaml.Node, err error) error {
+	return &literalError{line: value.Line, column: value.Column, err: err}
+}
+
+// locateLiteral adds the path of an invalid literal in doc to err
+func locateLiteral(err error, doc *yaml.Node) error {
+	var literal *literalError
+	if errors.As(err, &literal) && literal.path == "" {
+		literal.path = nodePath(doc, literal.line, literal.column)
+	}
+	return err
+}
+
+// nodePath returns the path of the node at line and column under node, with
+// keys joined by dots and 0-based sequence indexes, or "" if there is none
+func nodePath(node *yaml.Node, line, column int) string {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			if path := nodePath(child, line, column); path != "" {
+				return path
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			if value.Line == line && value.Column == column {
+				return key
+			}
+			if path := nodePath(value, line, column); path != "" {
+				if path[0] == '[' {
+					return key + path
+				}
+				return key + "." + path
+			}
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			index := "[" + strconv.Itoa(i) + "]"
+			if item.Line == line && item.Column == column {
+				return index
+			}
+			if path := nodePath(item, line, column); path != "" {
+				if path[0] == '[' {
+					return index + path
+				}
+				return index + "." + path
+			}
+		}
+	}
+	return ""
+}
+
+// scalarNumber returns the value of a YAML number, and false if value is not one
+func scalarNumber(value *yaml.Node) (float64, bool) {
+	if value.Kind != yaml.ScalarNode || (value.Tag != "!!int" && value.Tag != "!!float") {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(value.Value, 64)
+	return n, err == nil
+}
@@ -2,33 +2,50 @@ package testspec
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"maps"
+	"mime"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Load reads and parses a YAML test file
-// Supports multiple test documents separated by ---
+// Supports multiple documents separated by ---, each a test, a list of tests
+// or defaults for the tests that follow (see decodeDocument)
 func Load(filename string) ([]TestSpec, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("reading test file: %w", err)
 	}
 
-	// Parse multiple YAML documents using yaml.v3 decoder
+	// Parse multiple YAML documents using yaml.v3 decoders. Each document is
+	// read twice, in lockstep: as a node, to tell tests from lists, defaults
+	// and presets, and strictly, to fail on unknown fields.
+	nodes := yaml.NewDecoder(bytes.NewReader(data))
 	decoder := yaml.NewDecoder(bytes.NewReader(data))
 	decoder.KnownFields(true) // Strict mode - fail on unknown fields
 
+	presets, err := decodePresets([]byte(builtinPresets), "built-in presets")
+	if err != nil {
+		return nil, err
+	}
+
 	var tests []TestSpec
+	var defaults *yaml.Node
 	docNum := 0
 
 	for {
-		var test TestSpec
-		err := decoder.Decode(&test)
+		var doc yaml.Node
+		err := nodes.Decode(&doc)
 		if err == io.EOF {
 			break
 		}
@@ -37,22 +54,53 @@ func Load(filename string) ([]TestSpec, error) {
 		}
 
 		docNum++
-
-		// Validate required fields
-		if err := validate(&test); err != nil {
-			return nil, fmt.Errorf("test %d (%q): %w", docNum, test.Name, err)
+		if value := presetsDocument(&doc); value != nil {
+			if err := decodePresetsDocument(decoder, value, filepath.Dir(filename), presets); err != nil {
+				return nil, fmt.Errorf("parsing presets document %d: %w", docNum, locateLiteral(err, &doc))
+			}
+			continue
 		}
+		docTests, docDefaults, err := decodeDocument(decoder, &doc, defaults, presets)
+		if err != nil {
+			return nil, fmt.Errorf("parsing test document %d: %w", docNum, locateLiteral(err, &doc))
+		}
+		if docDefaults != nil {
+			defaults = docDefaults
+			continue
+		}
+
+		for _, test := range docTests {
+			testNum := len(tests) + 1
+			test.File = filename
 
-		// Apply defaults
-		test.ApplyDefaults()
+			// Validate required fields
+			if err := validate(&test); err != nil {
+				return nil, fmt.Errorf("test %d (%q): %w", testNum, test.Name, err)
+			}
+
+			// Load fixture files relative to the test file
+			if err := resolveFixtures(&test, filepath.Dir(filename)); err != nil {
+				return nil, fmt.Errorf("test %d (%q): %w", testNum, test.Name, err)
+			}
 
-		tests = append(tests, test)
+			// Apply defaults
+			test.ApplyDefaults()
+
+			tests = append(tests, expandMatrix(test)...)
+		}
 	}
 
 	if len(tests) == 0 {
 		return nil, fmt.Errorf("no test documents found in %s", filename)
 	}
 
+	if _, err := InlineVCL(tests); err != nil {
+		return nil, err
+	}
+	if _, err := SuiteHooks(tests); err != nil {
+		return nil, err
+	}
+
 	return tests, nil
 }
 
@@ -61,17 +109,60 @@ func validate(test *TestSpec) error {
 	if test.Name == "" {
 		return fmt.Errorf("test name is required")
 	}
+	if test.Link != "" {
+		if u, err := url.Parse(test.Link); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("link must be an absolute URL, got %q", test.Link)
+		}
+	}
+
+	switch test.Engine {
+	case "", EngineVarnishd, EngineSimulated:
+		// Valid
+	default:
+		return fmt.Errorf("invalid engine %q, must be %q or %q", test.Engine, EngineVarnishd, EngineSimulated)
+	}
+
+	if err := validateHooks(test.Hooks); err != nil {
+		return err
+	}
+
+	if test.WarmupConcurrency < 0 {
+		return fmt.Errorf("warmup_concurrency must be positive, got %d", test.WarmupConcurrency)
+	}
+	if test.WarmupConcurrency > 0 && test.WarmupFrom == "" {
+		return fmt.Errorf("warmup_concurrency requires warmup_from")
+	}
+
+	if err := resolveHosts(test); err != nil {
+		return err
+	}
+	if err := validateMatrix(test.Matrix); err != nil {
+		return err
+	}
+
+	// A sequence is checked as the scenario it expands to
+	stepLabel := "scenario step"
+	if len(test.Sequence) > 0 {
+		if err := expandSequence(test); err != nil {
+			return err
+		}
+		stepLabel = "sequence"
+	}
 
 	// Check if this is a scenario-based test or single-request test
 	isScenario := len(test.Scenario) > 0
 	isSingleRequest := test.Request.URL != ""
+	isPipeline := len(test.Pipeline) > 0
 
 	// Must be either scenario or single-request, not both
 	if isScenario && isSingleRequest {
 		return fmt.Errorf("test cannot have both 'scenario' and 'request' fields")
 	}
-	if !isScenario && !isSingleRequest {
-		return fmt.Errorf("test must have either 'scenario' or 'request' field")
+	if isPipeline && (isScenario || isSingleRequest) {
+		return fmt.Errorf("test cannot have 'pipeline' with 'scenario' or 'request' fields")
+	}
+	if !isScenario && !isSingleRequest && !isPipeline {
+		return fmt.Errorf("test must have a 'scenario', 'request' or 'pipeline' field")
 	}
 
 	// Validate single-request test
@@ -84,6 +175,51 @@ func validate(test *TestSpec) error {
 				return err
 			}
 		}
+		if err := validateRedirects(test.Request, test.Expectations.Response); err != nil {
+			return err
+		}
+		if err := validateContinue(test.Request, test.Expectations.Continue); err != nil {
+			return err
+		}
+		if err := validateEventually(test.Expectations.Eventually); err != nil {
+			return err
+		}
+		if err := validateHitRatio(test.Expectations.Cache); err != nil {
+			return err
+		}
+		if err := validateAENormalization(test.Expectations.Cache); err != nil {
+			return err
+		}
+		if err := validateCookieVariation(test.Expectations.Cache); err != nil {
+			return err
+		}
+		if err := validateStorage(test.Expectations.Storage); err != nil {
+			return err
+		}
+		if err := validateTTLSource(test.Expectations.Cache); err != nil {
+			return err
+		}
+		if err := validateESI(test.Expectations.ESI); err != nil {
+			return err
+		}
+		if len(test.Expectations.Response.HeaderEqualsPrevious) > 0 || len(test.Expectations.Response.HeaderDiffersPrevious) > 0 {
+			return fmt.Errorf("header_equals_previous and header_differs_previous are only available in scenario steps")
+		}
+		if test.Expectations.Backend != nil && len(test.Expectations.Backend.CallsBetween) > 0 {
+			return fmt.Errorf("backend.calls_between is only available in scenario steps")
+		}
+	}
+
+	// Validate pipeline test
+	if isPipeline {
+		for name, spec := range test.Backends {
+			if err := validateBackendSpec(spec, fmt.Sprintf("backends.%s", name)); err != nil {
+				return err
+			}
+		}
+		if err := validatePipeline(test.Pipeline); err != nil {
+			return err
+		}
 	}
 
 	// Validate scenario-based test
@@ -92,39 +228,669 @@ func validate(test *TestSpec) error {
 			return fmt.Errorf("scenario must have at least one step")
 		}
 		for i, step := range test.Scenario {
-			if step.At == "" {
-				return fmt.Errorf("scenario step %d: 'at' field is required", i+1)
+			if step.At == nil {
+				return fmt.Errorf("%s %d: 'at' field is required", stepLabel, i+1)
+			}
+			if *step.At < 0 {
+				return fmt.Errorf("%s %d: 'at' must not be negative, got %s", stepLabel, i+1, step.At)
 			}
 			if step.Request.URL == "" {
-				return fmt.Errorf("scenario step %d: request.url is required", i+1)
+				return fmt.Errorf("%s %d: request.url is required", stepLabel, i+1)
 			}
 			if step.Expectations.Response.Status == 0 {
-				return fmt.Errorf("scenario step %d: expectations.response.status is required", i+1)
+				return fmt.Errorf("%s %d: expectations.response.status is required", stepLabel, i+1)
 			}
 			for name, spec := range step.Backends {
-				if err := validateBackendSpec(spec, fmt.Sprintf("scenario step %d: backends.%s", i+1, name)); err != nil {
+				if err := validateBackendSpec(spec, fmt.Sprintf("%s %d: backends.%s", stepLabel, i+1, name)); err != nil {
 					return err
 				}
 			}
+			if err := validateRedirects(step.Request, step.Expectations.Response); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validateContinue(step.Request, step.Expectations.Continue); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validateEventually(step.Expectations.Eventually); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validateHitRatio(step.Expectations.Cache); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validateAENormalization(step.Expectations.Cache); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validateCookieVariation(step.Expectations.Cache); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validateStorage(step.Expectations.Storage); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validateTTLSource(step.Expectations.Cache); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validateESI(step.Expectations.ESI); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validatePrevious(step.Expectations.Response, i+1); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			if err := validateCallWindows(step.Expectations.Backend); err != nil {
+				return fmt.Errorf("%s %d: %w", stepLabel, i+1, err)
+			}
+			for _, name := range step.BackendDown {
+				if slices.Contains(step.BackendUp, name) {
+					return fmt.Errorf("%s %d: backend %q is in both backend_down and backend_up", stepLabel, i+1, name)
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+// validateMatrix checks that every matrix cell sets parameters and that the
+// cells, which name the expanded tests, differ
+func validateMatrix(matrix *MatrixSpec) error {
+	if matrix == nil {
+		return nil
+	}
+	if len(matrix.VarnishParams) == 0 {
+		return fmt.Errorf("matrix.varnish_params must have at least one entry")
+	}
+	seen := make(map[string]bool)
+	for i, params := range matrix.VarnishParams {
+		if len(params) == 0 {
+			return fmt.Errorf("matrix.varnish_params[%d]: no parameters", i)
+		}
+		for name := range params {
+			if name == "" || strings.ContainsAny(name, " \t") {
+				return fmt.Errorf("matrix.varnish_params[%d]: invalid parameter name %q", i, name)
+			}
+		}
+		label := matrixLabel(params)
+		if seen[label] {
+			return fmt.Errorf("matrix.varnish_params[%d]: duplicate entry %s", i, label)
+		}
+		seen[label] = true
+	}
+	return nil
+}
+
+// expandMatrix returns one test per matrix cell, named after the cell, or
+// the test itself if it has no matrix
+func expandMatrix(test TestSpec) []TestSpec {
+	if test.Matrix == nil {
+		return []TestSpec{test}
+	}
+	cells := make([]TestSpec, len(test.Matrix.VarnishParams))
+	for i, params := range test.Matrix.VarnishParams {
+		cell := test
+		cell.Matrix = nil
+		cell.VarnishParams = params
+		cell.Name = fmt.Sprintf("%s [%s]", test.Name, matrixLabel(params))
+		cells[i] = cell
+	}
+	return cells
+}
+
+// matrixLabel formats parameters as "a=1, b=2", sorted by name
+func matrixLabel(params map[string]string) string {
+	names := slices.Sorted(maps.Keys(params))
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + params[name]
+	}
+	return strings.Join(parts, ", ")
+}
+
+// resolveHosts copies request.host into the Host header of the test's
+// requests, so that the client and reports see a single Host
+func resolveHosts(test *TestSpec) error {
+	if err := resolveHost(&test.Request); err != nil {
+		return err
+	}
+	for i := range test.Scenario {
+		if err := resolveHost(&test.Scenario[i].Request); err != nil {
+			return fmt.Errorf("scenario step %d: %w", i+1, err)
+		}
+	}
+	for i := range test.Pipeline {
+		if err := resolveHost(&test.Pipeline[i].Request); err != nil {
+			return fmt.Errorf("pipeline step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// resolveHost sets the Host header of a request from its host field
+func resolveHost(req *RequestSpec) error {
+	if req.Host == "" {
+		return nil
+	}
+	for key, value := range req.Headers {
+		if strings.EqualFold(key, "Host") {
+			if value != req.Host {
+				return fmt.Errorf("request.host %q conflicts with the %s header %q", req.Host, key, value)
+			}
+			delete(req.Headers, key)
+		}
+	}
+	if req.Headers == nil {
+		req.Headers = make(map[string]string)
+	}
+	req.Headers["Host"] = req.Host
+	return nil
+}
+
+// validatePipeline checks pipeline steps. Responses share a connection, so
+// expectations that need their own request or per-request VSL and backend
+// counters are not available.
+func validatePipeline(steps []PipelineStep) error {
+	noResponse := false
+	for i, step := range steps {
+		prefix := fmt.Sprintf("pipeline step %d", i+1)
+		if step.Request.URL == "" {
+			return fmt.Errorf("%s: request.url is required", prefix)
+		}
+		if step.Request.FollowRedirects {
+			return fmt.Errorf("%s: request.follow_redirects is not available in pipelines", prefix)
+		}
+		if step.Request.ExpectContinue {
+			return fmt.Errorf("%s: request.expect_continue is not available in pipelines", prefix)
+		}
+		if noResponse && !step.NoResponse {
+			return fmt.Errorf("%s: no_response must be set on every step after the first one with it", prefix)
+		}
+		noResponse = step.NoResponse
+		if step.NoResponse {
+			if !reflect.DeepEqual(step.Expectations, ExpectationsSpec{}) {
+				return fmt.Errorf("%s: no_response cannot have expectations", prefix)
+			}
+			continue
+		}
+
+		exp := step.Expectations
+		switch {
+		case exp.Response.Status == 0:
+			return fmt.Errorf("%s: expectations.response.status is required", prefix)
+		case exp.Backend != nil:
+			return fmt.Errorf("%s: backend expectations are not available in pipelines", prefix)
+		case exp.Cache != nil && (exp.Cache.HitRatio != nil || exp.Cache.AENormalization != nil || exp.Cache.CookieVariation != nil):
+			return fmt.Errorf("%s: cache.hit_ratio, ae_normalization and cookie_variation are not available in pipelines", prefix)
+		case exp.Cache.ChecksTTL():
+			return fmt.Errorf("%s: cache.ttl_gt, ttl_lt, ttl_respects_age and ttl_source are not available in pipelines", prefix)
+		case exp.Storage != "" || exp.Eventually != nil || len(exp.Cookies) > 0:
+			return fmt.Errorf("%s: storage, eventually and cookies are not available in pipelines", prefix)
+		case len(exp.Response.HeaderEqualsPrevious) > 0 || len(exp.Response.HeaderDiffersPrevious) > 0:
+			return fmt.Errorf("%s: header_equals_previous and header_differs_previous are only available in scenario steps", prefix)
+		case exp.Response.FinalURL != "" || len(exp.Response.RedirectChain) > 0:
+			return fmt.Errorf("%s: final_url and redirect_chain are not available in pipelines", prefix)
+		case exp.Continue != nil:
+			return fmt.Errorf("%s: continue expectations are not available in pipelines", prefix)
+		case exp.ESI != nil:
+			return fmt.Errorf("%s: esi expectations are not available in pipelines", prefix)
+		case exp.Response.BodySize != nil || exp.Response.BodyComplete != nil:
+			return fmt.Errorf("%s: body_size and body_complete are not available in pipelines", prefix)
+		}
+	}
+	if steps[0].NoResponse {
+		return fmt.Errorf("pipeline step 1: no_response needs an answered request before it")
+	}
+	return nil
+}
+
+// validatePrevious checks that header comparisons refer to earlier steps
+func validatePrevious(exp ResponseExpectations, step int) error {
+	checks := []struct {
+		field string
+		list  PreviousHeaderChecks
+	}{
+		{"header_equals_previous", exp.HeaderEqualsPrevious},
+		{"header_differs_previous", exp.HeaderDiffersPrevious},
+	}
+	for _, c := range checks {
+		field := c.field
+		for _, check := range c.list {
+			if check.Header == "" {
+				return fmt.Errorf("%s: header is required", field)
+			}
+			if check.Step < 1 || check.Step >= step {
+				return fmt.Errorf("%s: step must refer to an earlier step (1-%d), got %d", field, step-1, check.Step)
+			}
+		}
+	}
+	return nil
+}
+
+// validateCallWindows checks the windows of a backend.calls_between expectation
+func validateCallWindows(exp *BackendExpectations) error {
+	if exp == nil {
+		return nil
+	}
+	for _, w := range exp.CallsBetween {
+		if w.From < 0 || w.To <= w.From {
+			return fmt.Errorf("backend.calls_between: window %s-%s is empty, to must be after from", w.From, w.To)
+		}
+		if w.Calls == nil {
+			return fmt.Errorf("backend.calls_between: calls is required")
+		}
+		if *w.Calls < 0 {
+			return fmt.Errorf("backend.calls_between: calls must not be negative, got %d", *w.Calls)
+		}
+	}
+	return nil
+}
+
+// validateRedirects checks that redirect options and expectations are consistent
+func validateRedirects(req RequestSpec, exp ResponseExpectations) error {
+	if req.MaxRedirects < 0 {
+		return fmt.Errorf("request.max_redirects must be positive, got %d", req.MaxRedirects)
+	}
+	if req.FollowRedirects {
+		return nil
+	}
+	if req.MaxRedirects > 0 {
+		return fmt.Errorf("request.max_redirects requires request.follow_redirects")
+	}
+	if exp.FinalURL != "" || len(exp.RedirectChain) > 0 {
+		return fmt.Errorf("expectations.response.final_url and redirect_chain require request.follow_redirects")
+	}
+	return nil
+}
+
+// validateContinue checks that 100-continue expectations have a request
+// sent with Expect: 100-continue
+func validateContinue(req RequestSpec, exp *ContinueExpectations) error {
+	if req.ExpectContinue && req.Body == "" {
+		return fmt.Errorf("request.expect_continue requires request.body")
+	}
+	if exp == nil {
+		return nil
+	}
+	if !req.ExpectContinue {
+		return fmt.Errorf("expectations.continue requires request.expect_continue")
+	}
+	if exp.Within != nil && *exp.Within <= 0 {
+		return fmt.Errorf("expectations.continue.within must be positive, got %s", exp.Within)
+	}
+	return nil
+}
+
+// validateEventually checks the timeout and interval of an eventually block
+func validateEventually(exp *EventuallySpec) error {
+	if exp == nil {
+		return nil
+	}
+	if exp.Timeout <= 0 {
+		return fmt.Errorf("expectations.eventually.timeout must be positive, got %s", exp.Timeout)
+	}
+	if exp.Interval != nil && *exp.Interval <= 0 {
+		return fmt.Errorf("expectations.eventually.interval must be positive, got %s", exp.Interval)
+	}
+	return nil
+}
+
+// validateESI checks the counts and statuses of an esi expectation
+func validateESI(exp *ESIExpectations) error {
+	if exp == nil {
+		return nil
+	}
+	if exp.Includes != nil && *exp.Includes < 0 {
+		return fmt.Errorf("expectations.esi.includes must not be negative, got %d", *exp.Includes)
+	}
+	for url, status := range exp.Fragments {
+		if url == "" {
+			return fmt.Errorf("expectations.esi.fragments: empty fragment URL")
+		}
+		if status < 100 || status > 599 {
+			return fmt.Errorf("expectations.esi.fragments[%s]: status must be between 100 and 599, got %d", url, status)
+		}
+	}
+	return nil
+}
+
+// validateStorage checks the value of a storage expectation
+func validateStorage(storage string) error {
+	switch storage {
+	case "", StorageTransient, StorageMain:
+		return nil
+	}
+	return fmt.Errorf("expectations.storage must be %s or %s, got %q", StorageTransient, StorageMain, storage)
+}
+
+// validateTTLSource checks the value of a cache.ttl_source expectation
+func validateTTLSource(cache *CacheExpectations) error {
+	if cache == nil {
+		return nil
+	}
+	switch cache.TTLSource {
+	case "", TTLSourceSMaxAge, TTLSourceMaxAge, TTLSourceExpires, TTLSourceDefault:
+		return nil
+	}
+	return fmt.Errorf("expectations.cache.ttl_source must be %s, %s, %s or %s, got %q", TTLSourceSMaxAge, TTLSourceMaxAge, TTLSourceExpires, TTLSourceDefault, cache.TTLSource)
+}
+
+// validateHitRatio checks the bounds of a cache.hit_ratio expectation
+func validateHitRatio(cache *CacheExpectations) error {
+	if cache == nil || cache.HitRatio == nil {
+		return nil
+	}
+	ratio := cache.HitRatio
+	if ratio.Min < 0 || ratio.Min > 1 {
+		return fmt.Errorf("expectations.cache.hit_ratio.min must be between 0 and 1, got %v", ratio.Min)
+	}
+	switch {
+	case ratio.Max == nil:
+		if ratio.Min == 0 {
+			return fmt.Errorf("expectations.cache.hit_ratio needs min or max")
+		}
+	case *ratio.Max < 0 || *ratio.Max > 1:
+		return fmt.Errorf("expectations.cache.hit_ratio.max must be between 0 and 1, got %v", *ratio.Max)
+	case *ratio.Max < ratio.Min:
+		return fmt.Errorf("expectations.cache.hit_ratio.max (%v) is below min (%v)", *ratio.Max, ratio.Min)
+	}
+	return nil
+}
+
+// expandSequence rewrites a sequence test into a scenario that repeats the
+// test request, every step at 0s, with the sequence entries as step
+// expectations (status defaulting to 200)
+func expandSequence(test *TestSpec) error {
+	switch {
+	case len(test.Scenario) > 0 || len(test.Pipeline) > 0:
+		return fmt.Errorf("test cannot have 'sequence' with 'scenario' or 'pipeline' fields")
+	case test.Request.URL == "":
+		return fmt.Errorf("sequence requires request.url")
+	case !reflect.DeepEqual(test.Expectations, ExpectationsSpec{}):
+		return fmt.Errorf("test cannot have both 'sequence' and 'expectations' fields; put the expectations in the sequence")
+	}
+
+	test.Scenario = make([]ScenarioStep, len(test.Sequence))
+	for i, exp := range test.Sequence {
+		if exp.Response.Status == 0 {
+			exp.Response.Status = 200
+		}
+		req := test.Request
+		req.Headers = maps.Clone(req.Headers)
+		test.Scenario[i] = ScenarioStep{At: new(Duration), Request: req, Expectations: exp}
+	}
+	test.Request = RequestSpec{}
+	test.Sequence = nil
+	return nil
+}
+
+// validateAENormalization checks the URL and variant limit of a cache.ae_normalization expectation
+func validateAENormalization(cache *CacheExpectations) error {
+	if cache == nil || cache.AENormalization == nil {
+		return nil
+	}
+	if u := cache.AENormalization.URL; u != "" && !strings.HasPrefix(u, "/") {
+		return fmt.Errorf("expectations.cache.ae_normalization.url must be a path, got %q", u)
+	}
+	// Without a header the HTTP client would send its own Accept-Encoding: gzip
+	if slices.Contains(cache.AENormalization.Values, "") {
+		return fmt.Errorf("expectations.cache.ae_normalization.values must not contain empty values")
+	}
+	if cache.AENormalization.MaxVariants < 0 {
+		return fmt.Errorf("expectations.cache.ae_normalization.max_variants must be positive, got %d", cache.AENormalization.MaxVariants)
+	}
+	return nil
+}
+
+// validateCookieVariation checks the URL and cookies of a cache.cookie_variation expectation
+func validateCookieVariation(cache *CacheExpectations) error {
+	if cache == nil || cache.CookieVariation == nil {
+		return nil
+	}
+	cv := cache.CookieVariation
+	if cv.URL != "" && !strings.HasPrefix(cv.URL, "/") {
+		return fmt.Errorf("expectations.cache.cookie_variation.url must be a path, got %q", cv.URL)
+	}
+	if len(cv.Significant) == 0 {
+		return fmt.Errorf("expectations.cache.cookie_variation.significant must list at least one cookie")
+	}
+	for _, field := range []struct {
+		name    string
+		cookies []string
+	}{{"noise", cv.Noise}, {"significant", cv.Significant}} {
+		for _, cookie := range field.cookies {
+			name, _, ok := strings.Cut(cookie, "=")
+			if !ok || strings.TrimSpace(name) == "" || strings.Contains(cookie, ";") {
+				return fmt.Errorf("expectations.cache.cookie_variation.%s: expected a single name=value cookie, got %q", field.name, cookie)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveFixtures reads body_file contents into body and makes serve_dir
+// absolute. Relative paths are resolved against baseDir, the test file's directory.
+func resolveFixtures(test *TestSpec, baseDir string) error {
+	if err := resolveBackendFixtures(test.Backends, baseDir, "backends"); err != nil {
+		return err
+	}
+	for i := range test.Scenario {
+		if err := resolveBackendFixtures(test.Scenario[i].Backends, baseDir, fmt.Sprintf("scenario step %d: backends", i+1)); err != nil {
+			return err
+		}
+	}
+	if test.WarmupFrom != "" {
+		warmup, err := LoadWarmup(fixturePath(baseDir, test.WarmupFrom))
+		if err != nil {
+			return fmt.Errorf("warmup_from: %w", err)
+		}
+		test.Warmup = warmup
+	}
+	return nil
+}
+
+// resolveBackendFixtures resolves fixture paths of each backend and its routes
+func resolveBackendFixtures(backends map[string]BackendSpec, baseDir, context string) error {
+	for name, spec := range backends {
+		specContext := fmt.Sprintf("%s.%s", context, name)
+		if err := loadBodyFile(&spec.Body, &spec.Headers, spec.BodyFile, baseDir, specContext); err != nil {
+			return err
+		}
+
+		if spec.ServeDir != "" {
+			dir := fixturePath(baseDir, spec.ServeDir)
+			info, err := os.Stat(dir)
+			if err != nil {
+				return fmt.Errorf("%s: serve_dir: %w", specContext, err)
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("%s: serve_dir %s is not a directory", specContext, spec.ServeDir)
+			}
+			spec.ServeDir = dir
+		}
+
+		for path, route := range spec.Routes {
+			if err := loadBodyFile(&route.Body, &route.Headers, route.BodyFile, baseDir, fmt.Sprintf("%s.routes.%s", specContext, path)); err != nil {
+				return err
+			}
+			spec.Routes[path] = route
+		}
+		backends[name] = spec
+	}
+	return nil
+}
+
+// loadBodyFile reads bodyFile into body and sets Content-Type from the file
+// extension unless the headers already set it
+func loadBodyFile(body *string, headers *map[string]string, bodyFile, baseDir, context string) error {
+	if bodyFile == "" {
+		return nil
+	}
+	if *body != "" {
+		return fmt.Errorf("%s: body and body_file are mutually exclusive", context)
+	}
+
+	data, err := os.ReadFile(fixturePath(baseDir, bodyFile))
+	if err != nil {
+		return fmt.Errorf("%s: body_file: %w", context, err)
+	}
+	*body = string(data)
+
+	for name := range *headers {
+		if strings.EqualFold(name, "Content-Type") {
+			return nil
+		}
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(bodyFile)); contentType != "" {
+		if *headers == nil {
+			*headers = make(map[string]string)
+		}
+		(*headers)["Content-Type"] = contentType
+	}
+	return nil
+}
+
+// fixturePath resolves a fixture path relative to the test file's directory
+func fixturePath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
 // validateBackendSpec validates a backend specification
 func validateBackendSpec(spec BackendSpec, context string) error {
-	switch spec.FailureMode {
-	case "", "failed", "frozen":
+	if err := validateFailureMode(spec.FailureMode, context); err != nil {
+		return err
+	}
+	if err := validateGenerate(spec.Generate, spec.Body != "" || spec.BodyFile != "" || spec.ServeDir != "", spec.EchoRequest, spec.FailureMode); err != nil {
+		return fmt.Errorf("%s: %w", context, err)
+	}
+	if spec.EchoConnection && !spec.EchoRequest {
+		return fmt.Errorf("%s: echo_connection requires echo_request", context)
+	}
+	for path, route := range spec.Routes {
+		if err := validateFailureMode(route.FailureMode, fmt.Sprintf("%s.routes.%s", context, path)); err != nil {
+			return err
+		}
+		if err := validateGenerate(route.Generate, route.Body != "" || route.BodyFile != "", route.EchoRequest, route.FailureMode); err != nil {
+			return fmt.Errorf("%s.routes.%s: %w", context, path, err)
+		}
+		if route.EchoConnection && !route.EchoRequest {
+			return fmt.Errorf("%s.routes.%s: echo_connection requires echo_request", context, path)
+		}
+		if err := validateRoutePattern(path); err != nil {
+			return fmt.Errorf("%s.routes.%s: %w", context, path, err)
+		}
+	}
+	return nil
+}
+
+// validateGenerate checks a generated body, which replaces the configured
+// body, echo and failure modes
+func validateGenerate(gen *GenerateSpec, hasBody, echo bool, failureMode string) error {
+	if gen == nil {
+		return nil
+	}
+	if gen.Size == 0 {
+		return fmt.Errorf("generate.size is required")
+	}
+	if hasBody || echo || failureMode != "" {
+		return fmt.Errorf("generate cannot be combined with body, body_file, serve_dir, echo_request or failure_mode")
+	}
+	return nil
+}
+
+// validateRoutePattern checks that the parameters of a route pattern are
+// whole path segments with unique names, like /users/{id}/orders/{order}
+func validateRoutePattern(path string) error {
+	seen := make(map[string]bool)
+	for _, segment := range strings.Split(path, "/") {
+		if !strings.ContainsAny(segment, "{}") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(segment, "{"), "}")
+		if len(name)+2 != len(segment) || name == "" || strings.ContainsAny(name, "{}") {
+			return fmt.Errorf("invalid route parameter %q, parameters must be whole segments like {id}", segment)
+		}
+		if seen[name] {
+			return fmt.Errorf("route parameter {%s} is used twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// validateFailureMode checks that mode is empty or a known failure mode
+func validateFailureMode(mode, context string) error {
+	switch mode {
+	case "", "failed", "frozen", "truncated", "oversized_headers", "too_many_headers":
 		// Valid
 	default:
-		return fmt.Errorf("%s: invalid failure_mode %q, must be 'failed', 'frozen', or empty", context, spec.FailureMode)
+		return fmt.Errorf("%s: invalid failure_mode %q, must be 'failed', 'frozen', 'truncated', 'oversized_headers', 'too_many_headers', or empty", context, mode)
 	}
 	return nil
 }
 
+// InlineVCL returns the VCL embedded in the tests via vcl_source, or "" if none.
+// All tests share one VCL, so vcl_source may be set on any number of tests as
+// long as the sources are identical.
+func InlineVCL(tests []TestSpec) (string, error) {
+	var source, owner string
+	for _, test := range tests {
+		if test.VCLSource == "" {
+			continue
+		}
+		if source == "" {
+			source, owner = test.VCLSource, test.Name
+			continue
+		}
+		if test.VCLSource != source {
+			return "", fmt.Errorf("test %q: vcl_source differs from test %q (all tests in a file share one VCL)", test.Name, owner)
+		}
+	}
+	return source, nil
+}
+
+// SuiteHooks returns the suite hooks of a file's tests. Tests that set hooks
+// must agree, since they run once for the whole run. Nil if none set them.
+func SuiteHooks(tests []TestSpec) (*HooksSpec, error) {
+	var hooks *HooksSpec
+	var owner string
+	for _, test := range tests {
+		if test.Hooks == nil {
+			continue
+		}
+		if hooks == nil {
+			hooks, owner = test.Hooks, test.Name
+			continue
+		}
+		if !reflect.DeepEqual(test.Hooks, hooks) {
+			return nil, fmt.Errorf("test %q: hooks differ from test %q (hooks run once for the whole file; set them in a defaults document)", test.Name, owner)
+		}
+	}
+	return hooks, nil
+}
+
+// validateHooks checks that hook commands are not empty
+func validateHooks(hooks *HooksSpec) error {
+	if hooks == nil {
+		return nil
+	}
+	check := func(stage string, commands []string) error {
+		for i, command := range commands {
+			if strings.TrimSpace(command) == "" {
+				return fmt.Errorf("hooks.%s[%d]: empty command", stage, i)
+			}
+		}
+		return nil
+	}
+	if err := check("before_suite", hooks.BeforeSuite); err != nil {
+		return err
+	}
+	return check("after_suite", hooks.AfterSuite)
+}
+
 // ResolveVCL determines the VCL file path to use for tests.
 // Priority: 1) CLI flag (-vcl), 2) Same-named .vcl file
+// Inline VCL (vcl_source, -vcl -) is handled by the harness, which writes it
+// to its work directory.
 func ResolveVCL(testFilePath string, cliVCL string) (string, error) {
 	// Priority 1: CLI flag
 	if cliVCL != "" {
@@ -145,5 +911,21 @@ func ResolveVCL(testFilePath string, cliVCL string) (string, error) {
 	}
 
 	// No VCL found
-	return "", fmt.Errorf("no VCL file found: tried -vcl flag and %s", vclPath)
+	return "", fmt.Errorf("no VCL file found: tried -vcl flag, vcl_source and %s", vclPath)
+}
+
+// TestID returns a stable ID for a test: a hash of its file and name. The
+// file path is made relative to the working directory when it is below it,
+// so IDs match across checkouts in different locations.
+func TestID(testFile, name string) string {
+	path := filepath.Clean(testFile)
+	if filepath.IsAbs(path) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+				path = rel
+			}
+		}
+	}
+	sum := sha256.Sum256([]byte(filepath.ToSlash(path) + "\x00" + name))
+	return hex.EncodeToString(sum[:6])
 }
@@ -1,9 +1,13 @@
 package testspec
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestValidateBackendSpec_InvalidFailureMode(t *testing.T) {
@@ -15,6 +19,9 @@ func TestValidateBackendSpec_InvalidFailureMode(t *testing.T) {
 		{"empty failure mode is valid", "", false},
 		{"failed is valid", "failed", false},
 		{"frozen is valid", "frozen", false},
+		{"truncated is valid", "truncated", false},
+		{"oversized_headers is valid", "oversized_headers", false},
+		{"too_many_headers is valid", "too_many_headers", false},
 		{"invalid mode", "invalid", true},
 		{"typo fail", "fail", true},
 		{"typo freeze", "freeze", true},
@@ -30,6 +37,36 @@ func TestValidateBackendSpec_InvalidFailureMode(t *testing.T) {
 			if (err != nil) != tt.wantErr {
 				t.Errorf("validateBackendSpec() error = %v, wantErr %v", err, tt.wantErr)
 			}
+
+			// Routes are validated the same way
+			spec = BackendSpec{Routes: map[string]RouteSpec{"/": {FailureMode: tt.failureMode}}}
+			err = validateBackendSpec(spec, "test")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateBackendSpec() route error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRoutePattern(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"/users", false},
+		{"/users/{id}", false},
+		{"/users/{id}/orders/{order}", false},
+		{"/users/{}", true},
+		{"/users/id-{id}", true},
+		{"/users/{id", true},
+		{"/users/id}", true},
+		{"/users/{id}/friends/{id}", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if err := validateRoutePattern(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("validateRoutePattern() error = %v, wantErr %v", err, tt.wantErr)
+			}
 		})
 	}
 }
@@ -93,3 +130,1390 @@ expectations:
 		t.Errorf("Expected failure_mode 'failed', got %q", tests[0].Backends["default"].FailureMode)
 	}
 }
+
+func TestValidateRedirects(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     RequestSpec
+		exp     ResponseExpectations
+		wantErr bool
+	}{
+		{"no redirect options", RequestSpec{URL: "/"}, ResponseExpectations{Status: 301}, false},
+		{"follow with expectations", RequestSpec{URL: "/", FollowRedirects: true, MaxRedirects: 3}, ResponseExpectations{Status: 200, FinalURL: "/new", RedirectChain: []string{"/new"}}, false},
+		{"negative max_redirects", RequestSpec{URL: "/", FollowRedirects: true, MaxRedirects: -1}, ResponseExpectations{Status: 200}, true},
+		{"max_redirects without follow", RequestSpec{URL: "/", MaxRedirects: 3}, ResponseExpectations{Status: 200}, true},
+		{"final_url without follow", RequestSpec{URL: "/"}, ResponseExpectations{Status: 200, FinalURL: "/new"}, true},
+		{"redirect_chain without follow", RequestSpec{URL: "/"}, ResponseExpectations{Status: 200, RedirectChain: []string{"/new"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRedirects(tt.req, tt.exp)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateRedirects() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateContinue(t *testing.T) {
+	yes := true
+	fiftyMs, negative := Duration(50*time.Millisecond), Duration(-time.Second)
+	tests := []struct {
+		name    string
+		req     RequestSpec
+		exp     *ContinueExpectations
+		wantErr bool
+	}{
+		{"no continue", RequestSpec{URL: "/"}, nil, false},
+		{"expect_continue with body", RequestSpec{URL: "/", Body: "x", ExpectContinue: true}, &ContinueExpectations{Received: &yes, Within: &fiftyMs}, false},
+		{"expect_continue without body", RequestSpec{URL: "/", ExpectContinue: true}, nil, true},
+		{"expectations without expect_continue", RequestSpec{URL: "/", Body: "x"}, &ContinueExpectations{Received: &yes}, true},
+		{"negative within", RequestSpec{URL: "/", Body: "x", ExpectContinue: true}, &ContinueExpectations{Within: &negative}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateContinue(tt.req, tt.exp)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateContinue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateBackendSpec_Generate(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    BackendSpec
+		wantErr bool
+	}{
+		{"generated body", BackendSpec{Generate: &GenerateSpec{Size: 64 << 20, Gzip: true}}, false},
+		{"generated route", BackendSpec{Body: "small", Routes: map[string]RouteSpec{"/big": {Generate: &GenerateSpec{Size: 1 << 30, DeclaredSize: 2 << 30}}}}, false},
+		{"missing size", BackendSpec{Generate: &GenerateSpec{Gzip: true}}, true},
+		{"with body", BackendSpec{Body: "x", Generate: &GenerateSpec{Size: 1 << 20}}, true},
+		{"with failure mode", BackendSpec{Routes: map[string]RouteSpec{"/big": {FailureMode: "truncated", Generate: &GenerateSpec{Size: 1 << 20}}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBackendSpec(tt.spec, "backends.default")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateBackendSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateBackendSpec_EchoConnection(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    BackendSpec
+		wantErr bool
+	}{
+		{"with echo", BackendSpec{EchoRequest: true, EchoConnection: true}, false},
+		{"route with echo", BackendSpec{Routes: map[string]RouteSpec{"/conn": {EchoRequest: true, EchoConnection: true}}}, false},
+		{"without echo", BackendSpec{EchoConnection: true}, true},
+		{"route without echo", BackendSpec{EchoRequest: true, Routes: map[string]RouteSpec{"/conn": {EchoConnection: true}}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBackendSpec(tt.spec, "backends.default")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateBackendSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateCookieVariation(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    CookieVariationSpec
+		wantErr bool
+	}{
+		{"defaults", CookieVariationSpec{Significant: []string{"lang=fr"}}, false},
+		{"custom noise", CookieVariationSpec{URL: "/page", Noise: []string{"_ga=1"}, Significant: []string{"lang=fr", "currency=EUR"}}, false},
+		{"no significant cookies", CookieVariationSpec{}, true},
+		{"url not a path", CookieVariationSpec{URL: "page", Significant: []string{"lang=fr"}}, true},
+		{"cookie without value", CookieVariationSpec{Significant: []string{"lang"}}, true},
+		{"several cookies in one entry", CookieVariationSpec{Noise: []string{"_ga=1; _gid=2"}, Significant: []string{"lang=fr"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCookieVariation(&CacheExpectations{CookieVariation: &tt.spec})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateCookieVariation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateTTLSource(t *testing.T) {
+	tests := []struct {
+		source  string
+		wantErr bool
+	}{
+		{"", false},
+		{TTLSourceSMaxAge, false},
+		{TTLSourceExpires, false},
+		{TTLSourceDefault, false},
+		{"Cache-Control", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			err := validateTTLSource(&CacheExpectations{TTLSource: tt.source})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateTTLSource(%q) error = %v, wantErr %v", tt.source, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateESI(t *testing.T) {
+	negative := -1
+	tests := []struct {
+		name    string
+		spec    ESIExpectations
+		wantErr string
+	}{
+		{"fragments", ESIExpectations{Includes: new(int), Fragments: map[string]int{"/fragments/price": 500}}, ""},
+		{"negative includes", ESIExpectations{Includes: &negative}, "esi.includes must not be negative"},
+		{"invalid status", ESIExpectations{Fragments: map[string]int{"/fragments/price": 5000}}, "esi.fragments[/fragments/price]: status must be between 100 and 599"},
+		{"empty url", ESIExpectations{Fragments: map[string]int{"": 200}}, "empty fragment URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateESI(&tt.spec)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateESI() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateESI() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePipeline(t *testing.T) {
+	answered := func(url string) PipelineStep {
+		return PipelineStep{Request: RequestSpec{URL: url}, Expectations: ExpectationsSpec{Response: ResponseExpectations{Status: 200}}}
+	}
+	rejected := PipelineStep{Request: RequestSpec{URL: "/c"}, NoResponse: true}
+	tests := []struct {
+		name    string
+		steps   []PipelineStep
+		wantErr string
+	}{
+		{"answered", []PipelineStep{answered("/a"), answered("/b")}, ""},
+		{"rejected after first", []PipelineStep{answered("/a"), rejected, rejected}, ""},
+		{"missing url", []PipelineStep{answered("")}, "pipeline step 1: request.url is required"},
+		{"missing status", []PipelineStep{answered("/a"), {Request: RequestSpec{URL: "/b"}}}, "pipeline step 2: expectations.response.status is required"},
+		{"answer after rejection", []PipelineStep{answered("/a"), rejected, answered("/d")}, "pipeline step 3: no_response must be set"},
+		{"first rejected", []PipelineStep{rejected}, "pipeline step 1: no_response needs an answered request"},
+		{"backend expectation", []PipelineStep{{Request: RequestSpec{URL: "/a"}, Expectations: ExpectationsSpec{
+			Response: ResponseExpectations{Status: 200}, Backend: &BackendExpectations{Used: "api"}}}}, "backend expectations are not available"},
+		{"esi expectation", []PipelineStep{{Request: RequestSpec{URL: "/a"}, Expectations: ExpectationsSpec{
+			Response: ResponseExpectations{Status: 200}, ESI: &ESIExpectations{Includes: new(int)}}}}, "esi expectations are not available"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePipeline(tt.steps)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validatePipeline() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validatePipeline() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInlineVCL(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []TestSpec
+		want    string
+		wantErr bool
+	}{
+		{"none", []TestSpec{{Name: "a"}, {Name: "b"}}, "", false},
+		{"first test only", []TestSpec{{Name: "a", VCLSource: "vcl 4.1;"}, {Name: "b"}}, "vcl 4.1;", false},
+		{"identical repeats", []TestSpec{{Name: "a", VCLSource: "vcl 4.1;"}, {Name: "b", VCLSource: "vcl 4.1;"}}, "vcl 4.1;", false},
+		{"conflicting sources", []TestSpec{{Name: "a", VCLSource: "vcl 4.1;"}, {Name: "b", VCLSource: "vcl 4.0;"}}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := InlineVCL(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InlineVCL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("InlineVCL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuiteHooks(t *testing.T) {
+	seed := &HooksSpec{BeforeSuite: []string{"redis-cli flushall"}}
+	tests := []struct {
+		name    string
+		specs   []TestSpec
+		want    *HooksSpec
+		wantErr bool
+	}{
+		{"none", []TestSpec{{Name: "a"}, {Name: "b"}}, nil, false},
+		{"first test only", []TestSpec{{Name: "a", Hooks: seed}, {Name: "b"}}, seed, false},
+		{"identical repeats", []TestSpec{{Name: "a", Hooks: seed}, {Name: "b", Hooks: &HooksSpec{BeforeSuite: []string{"redis-cli flushall"}}}}, seed, false},
+		{"conflicting hooks", []TestSpec{{Name: "a", Hooks: seed}, {Name: "b", Hooks: &HooksSpec{AfterSuite: []string{"true"}}}}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SuiteHooks(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SuiteHooks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SuiteHooks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_Hooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    *HooksSpec
+		wantErr string
+	}{
+		{
+			name: "hooks in a defaults document",
+			yaml: `defaults:
+  hooks:
+    before_suite: ["docker compose up -d redis"]
+    after_suite: ["docker compose down"]
+---
+name: a
+request: {url: /}
+expectations: {response: {status: 200}}
+---
+name: b
+request: {url: /b}
+expectations: {response: {status: 200}}
+`,
+			want: &HooksSpec{BeforeSuite: []string{"docker compose up -d redis"}, AfterSuite: []string{"docker compose down"}},
+		},
+		{
+			name: "empty command",
+			yaml: `name: a
+hooks:
+  before_suite: ["  "]
+request: {url: /}
+expectations: {response: {status: 200}}
+`,
+			wantErr: "hooks.before_suite[0]: empty command",
+		},
+		{
+			name: "conflicting tests",
+			yaml: `name: a
+hooks: {before_suite: ["true"]}
+request: {url: /}
+expectations: {response: {status: 200}}
+---
+name: b
+hooks: {before_suite: ["false"]}
+request: {url: /}
+expectations: {response: {status: 200}}
+`,
+			wantErr: "hooks differ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hooks.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			specs, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			got, err := SuiteHooks(specs)
+			if err != nil {
+				t.Fatalf("SuiteHooks() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SuiteHooks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_Fixtures(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "fixtures", "public"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "fixtures", "product.json"), []byte(`{"id":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		backend     string
+		wantErr     bool
+		wantBody    string
+		wantType    string
+		wantRoute   string
+		wantServeOK bool
+	}{
+		{
+			name:     "body_file sets body and content type",
+			backend:  "body_file: fixtures/product.json",
+			wantBody: `{"id":1}`,
+			wantType: "application/json",
+		},
+		{
+			name: "explicit content type is kept",
+			backend: `body_file: fixtures/product.json
+    headers:
+      content-type: text/plain`,
+			wantBody: `{"id":1}`,
+		},
+		{
+			name: "route body_file",
+			backend: `routes:
+      /product:
+        body_file: fixtures/product.json`,
+			wantRoute: `{"id":1}`,
+		},
+		{
+			name:        "serve_dir is made absolute",
+			backend:     "serve_dir: fixtures/public",
+			wantServeOK: true,
+		},
+		{
+			name: "body and body_file conflict",
+			backend: `body: inline
+    body_file: fixtures/product.json`,
+			wantErr: true,
+		},
+		{"missing body_file", "body_file: fixtures/missing.json", true, "", "", "", false},
+		{"missing serve_dir", "serve_dir: fixtures/missing", true, "", "", "", false},
+		{"serve_dir is a file", "serve_dir: fixtures/product.json", true, "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testFile := filepath.Join(dir, "test.yaml")
+			content := "name: fixtures\nrequest:\n  url: /\nbackends:\n  default:\n    " + tt.backend + "\nexpectations:\n  response:\n    status: 200\n"
+			if err := os.WriteFile(testFile, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			tests, err := Load(testFile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			spec := tests[0].Backends["default"]
+			if spec.Body != tt.wantBody {
+				t.Errorf("Body = %q, want %q", spec.Body, tt.wantBody)
+			}
+			if tt.wantType != "" && spec.Headers["Content-Type"] != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", spec.Headers["Content-Type"], tt.wantType)
+			}
+			if tt.wantType == "" && spec.Headers["Content-Type"] != "" {
+				t.Errorf("Content-Type = %q, want it unset", spec.Headers["Content-Type"])
+			}
+			if got := spec.Routes["/product"].Body; got != tt.wantRoute {
+				t.Errorf("route Body = %q, want %q", got, tt.wantRoute)
+			}
+			if tt.wantServeOK && spec.ServeDir != filepath.Join(dir, "fixtures", "public") {
+				t.Errorf("ServeDir = %q, want absolute path under %s", spec.ServeDir, dir)
+			}
+		})
+	}
+}
+
+func TestValidate_Link(t *testing.T) {
+	tests := []struct {
+		link    string
+		wantErr bool
+	}{
+		{"", false},
+		{"https://tickets.example.com/OPS-123", false},
+		{"http://grafana.internal/d/varnish", false},
+		{"OPS-123", true},
+		{"/relative/path", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.link, func(t *testing.T) {
+			test := TestSpec{
+				Name:         "annotated",
+				Link:         tt.link,
+				Request:      RequestSpec{URL: "/"},
+				Expectations: ExpectationsSpec{Response: ResponseExpectations{Status: 200}},
+			}
+			err := validate(&test)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate_Engine(t *testing.T) {
+	tests := []struct {
+		engine  string
+		wantErr bool
+	}{
+		{"", false},
+		{EngineVarnishd, false},
+		{EngineSimulated, false},
+		{"varnish", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.engine, func(t *testing.T) {
+			test := TestSpec{
+				Name:         "engine",
+				Engine:       tt.engine,
+				Request:      RequestSpec{URL: "/"},
+				Expectations: ExpectationsSpec{Response: ResponseExpectations{Status: 200}},
+			}
+			err := validate(&test)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate_Previous(t *testing.T) {
+	step := func(exp ResponseExpectations) ScenarioStep {
+		exp.Status = 200
+		return ScenarioStep{At: new(Duration), Request: RequestSpec{URL: "/"}, Expectations: ExpectationsSpec{Response: exp}}
+	}
+	tests := []struct {
+		name    string
+		test    TestSpec
+		wantErr string
+	}{
+		{"earlier step", TestSpec{Scenario: []ScenarioStep{
+			step(ResponseExpectations{}),
+			step(ResponseExpectations{HeaderEqualsPrevious: PreviousHeaderChecks{{Header: "ETag", Step: 1}}}),
+		}}, ""},
+		{"same step", TestSpec{Scenario: []ScenarioStep{
+			step(ResponseExpectations{}),
+			step(ResponseExpectations{HeaderDiffersPrevious: PreviousHeaderChecks{{Header: "X-Request-ID", Step: 2}}}),
+		}}, "scenario step 2: header_differs_previous: step must refer to an earlier step (1-1), got 2"},
+		{"missing header", TestSpec{Scenario: []ScenarioStep{
+			step(ResponseExpectations{}),
+			step(ResponseExpectations{HeaderEqualsPrevious: PreviousHeaderChecks{{Step: 1}}}),
+		}}, "header is required"},
+		{"single request", TestSpec{
+			Request:      RequestSpec{URL: "/"},
+			Expectations: ExpectationsSpec{Response: ResponseExpectations{Status: 200, HeaderEqualsPrevious: PreviousHeaderChecks{{Header: "ETag", Step: 1}}}},
+		}, "only available in scenario steps"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test.Name = "previous"
+			err := validate(&tt.test)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTestID(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := TestID("tests/cache.yaml", "Cache hit")
+	if len(id) != 12 {
+		t.Errorf("TestID() = %q, want 12 hex characters", id)
+	}
+	if got := TestID("./tests//cache.yaml", "Cache hit"); got != id {
+		t.Errorf("TestID() with unclean path = %q, want %q", got, id)
+	}
+	if got := TestID(filepath.Join(wd, "tests", "cache.yaml"), "Cache hit"); got != id {
+		t.Errorf("TestID() with absolute path = %q, want %q", got, id)
+	}
+	if got := TestID("tests/cache.yaml", "Cache miss"); got == id {
+		t.Errorf("TestID() of another test = %q, want a different ID", got)
+	}
+}
+
+func TestLoadWarmup(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []RequestSpec
+		wantErr bool
+	}{
+		{
+			name: "url list",
+			content: `# Popular pages
+/products/1
+
+/products/2 | Accept-Encoding: gzip | X-Device: mobile
+https://shop.example.com/cart?id=3
+`,
+			want: []RequestSpec{
+				{Method: "GET", URL: "/products/1"},
+				{Method: "GET", URL: "/products/2", Headers: map[string]string{"Accept-Encoding": "gzip", "X-Device": "mobile"}},
+				{Method: "GET", URL: "/cart?id=3", Headers: map[string]string{"Host": "shop.example.com"}},
+			},
+		},
+		{
+			name: "sitemap",
+			content: `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/</loc></url>
+  <url><loc>https://example.com/about</loc><lastmod>2026-01-01</lastmod></url>
+</urlset>
+`,
+			want: []RequestSpec{
+				{Method: "GET", URL: "/", Headers: map[string]string{"Host": "example.com"}},
+				{Method: "GET", URL: "/about", Headers: map[string]string{"Host": "example.com"}},
+			},
+		},
+		{name: "relative path", content: "products/1\n", wantErr: true},
+		{name: "invalid header", content: "/a | no-colon\n", wantErr: true},
+		{name: "empty", content: "# nothing\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "urls.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadWarmup(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadWarmup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadWarmup() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_Warmup(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "urls.txt"), []byte("/a\n/b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testFile := filepath.Join(dir, "test.yaml")
+	content := `name: Warm cache
+warmup_from: urls.txt
+request:
+  url: /a
+expectations:
+  response:
+    status: 200
+`
+	if err := os.WriteFile(testFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests, err := Load(testFile)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if len(tests[0].Warmup) != 2 || tests[0].WarmupConcurrency != DefaultWarmupConcurrency {
+		t.Errorf("Warmup = %+v, concurrency %d", tests[0].Warmup, tests[0].WarmupConcurrency)
+	}
+}
+
+func TestLoad_Documents(t *testing.T) {
+	const defaults = `defaults:
+  request:
+    headers:
+      Host: www.example.com
+  expectations:
+    response:
+      status: 200
+  owner: web-team
+`
+	tests := []struct {
+		name    string
+		content string
+		check   func(t *testing.T, tests []TestSpec)
+		wantErr string
+	}{
+		{
+			name: "list of tests",
+			content: `- name: One
+  request:
+    url: /one
+  expectations:
+    response:
+      status: 200
+- name: Two
+  request:
+    url: /two
+  expectations:
+    response:
+      status: 404
+`,
+			check: func(t *testing.T, tests []TestSpec) {
+				if len(tests) != 2 || tests[1].Name != "Two" || tests[1].Expectations.Response.Status != 404 {
+					t.Errorf("tests = %+v", tests)
+				}
+			},
+		},
+		{
+			name: "defaults merged into following tests",
+			content: `name: Before defaults
+request:
+  url: /before
+expectations:
+  response:
+    status: 204
+---
+` + defaults + `---
+name: Own status
+request:
+  url: /a
+  headers:
+    Accept: text/html
+expectations:
+  response:
+    status: 301
+---
+- name: Default status
+  request:
+    url: /b
+`,
+			check: func(t *testing.T, tests []TestSpec) {
+				if len(tests) != 3 {
+					t.Fatalf("got %d tests, want 3", len(tests))
+				}
+				if tests[0].Owner != "" || tests[0].Request.Headers["Host"] != "" {
+					t.Errorf("defaults applied to earlier test: %+v", tests[0])
+				}
+				want := map[string]string{"Host": "www.example.com", "Accept": "text/html"}
+				if !reflect.DeepEqual(tests[1].Request.Headers, want) {
+					t.Errorf("headers = %v, want %v", tests[1].Request.Headers, want)
+				}
+				if tests[1].Expectations.Response.Status != 301 || tests[2].Expectations.Response.Status != 200 {
+					t.Errorf("statuses = %d, %d, want 301, 200", tests[1].Expectations.Response.Status, tests[2].Expectations.Response.Status)
+				}
+				if tests[2].Owner != "web-team" {
+					t.Errorf("owner = %q, want web-team", tests[2].Owner)
+				}
+			},
+		},
+		{
+			name: "request and expectations defaults apply to scenario steps",
+			content: defaults + `---
+name: Scenario
+scenario:
+  - at: 0s
+    request:
+      url: /a
+  - at: 10s
+    request:
+      url: /a
+    expectations:
+      response:
+        status: 304
+`,
+			check: func(t *testing.T, tests []TestSpec) {
+				steps := tests[0].Scenario
+				if steps[0].Request.Headers["Host"] != "www.example.com" || steps[0].Expectations.Response.Status != 200 {
+					t.Errorf("step 1 = %+v", steps[0])
+				}
+				if steps[1].Expectations.Response.Status != 304 {
+					t.Errorf("step 2 status = %d, want 304", steps[1].Expectations.Response.Status)
+				}
+				if tests[0].Request.URL != "" || tests[0].Owner != "web-team" {
+					t.Errorf("test = %+v", tests[0])
+				}
+			},
+		},
+		{
+			name: "reset_backend_counts default",
+			content: `defaults:
+  reset_backend_counts: false
+---
+name: Cumulative
+scenario:
+  - at: 0s
+    request:
+      url: /a
+    expectations:
+      response:
+        status: 200
+  - at: 10s
+    reset_backend_counts: true
+    request:
+      url: /a
+    expectations:
+      response:
+        status: 200
+`,
+			check: func(t *testing.T, tests []TestSpec) {
+				if tests[0].ResetsBackendCounts(0) || !tests[0].ResetsBackendCounts(1) {
+					t.Errorf("ResetsBackendCounts() = %v, %v, want false, true", tests[0].ResetsBackendCounts(0), tests[0].ResetsBackendCounts(1))
+				}
+			},
+		},
+		{
+			name: "host defaults",
+			content: defaults + `  hosts:
+    Shop.Example.com:
+      request:
+        headers:
+          Cookie: brand=shop
+      expectations:
+        response:
+          status: 302
+          headers:
+            X-Brand: shop
+---
+name: Shop
+request:
+  url: /
+  host: shop.example.com
+---
+name: Shop scenario
+scenario:
+  - at: 0s
+    request:
+      url: /
+      headers:
+        Host: shop.example.com
+  - at: 0s
+    request:
+      url: /
+    expectations:
+      response:
+        status: 200
+  - at: 0s
+    request:
+      url: /
+      host: shop.example.com
+    expectations:
+      response:
+        status: 200
+---
+name: Shop sequence
+request:
+  url: /
+  host: shop.example.com
+sequence:
+  - cache: {hit: false}
+  - response:
+      status: 200
+`,
+			check: func(t *testing.T, tests []TestSpec) {
+				want := map[string]string{"Host": "shop.example.com", "Cookie": "brand=shop"}
+				if !reflect.DeepEqual(tests[0].Request.Headers, want) {
+					t.Errorf("headers = %v, want %v", tests[0].Request.Headers, want)
+				}
+				if exp := tests[0].Expectations.Response; exp.Status != 302 || exp.Headers["X-Brand"] != "shop" {
+					t.Errorf("expectations = %+v, want the shop defaults", exp)
+				}
+				steps := tests[1].Scenario
+				if steps[0].Expectations.Response.Status != 302 || steps[0].Request.Headers["Cookie"] != "brand=shop" {
+					t.Errorf("step 1 = %+v, want the shop defaults", steps[0])
+				}
+				if steps[1].Request.Headers["Host"] != "www.example.com" || steps[1].Expectations.Response.Headers["X-Brand"] != "" {
+					t.Errorf("step 2 = %+v, want the file defaults", steps[1])
+				}
+				if exp := steps[2].Expectations.Response; exp.Status != 200 || exp.Headers["X-Brand"] != "shop" {
+					t.Errorf("step 3 expectations = %+v, want status 200 and the shop header", exp)
+				}
+				entries := tests[2].Scenario
+				if len(entries) != 2 || entries[0].Expectations.Response.Status != 302 || entries[1].Expectations.Response.Status != 200 {
+					t.Fatalf("sequence steps = %+v", entries)
+				}
+				if entries[0].Expectations.Response.Headers["X-Brand"] != "shop" || entries[0].Expectations.Cache.Hit == nil {
+					t.Errorf("sequence entry 1 = %+v, want the shop defaults and its own cache check", entries[0].Expectations)
+				}
+			},
+		},
+		{
+			name:    "host conflicts with Host header",
+			content: "name: x\nrequest:\n  url: /\n  host: a.example.com\n  headers:\n    host: b.example.com\nexpectations:\n  response:\n    status: 200\n",
+			wantErr: `request.host "a.example.com" conflicts with the host header`,
+		},
+		{
+			name:    "unknown field in host defaults",
+			content: "defaults:\n  hosts:\n    a.example.com:\n      backends: {}\n",
+			wantErr: "field backends not found",
+		},
+		{
+			name:    "unknown field in defaults",
+			content: "defaults:\n  request:\n    verb: GET\n",
+			wantErr: "field verb not found",
+		},
+		{
+			name:    "name in defaults",
+			content: "defaults:\n  name: Shared\n",
+			wantErr: "defaults cannot set the test name",
+		},
+		{
+			name: "unknown field reported with its line",
+			content: `name: One
+request:
+  url: /one
+expectations:
+  response:
+    status: 200
+---
+- name: Two
+  request:
+    url: /two
+    verb: GET
+`,
+			wantErr: "line 11: field verb not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testFile := filepath.Join(t.TempDir(), "test.yaml")
+			if err := os.WriteFile(testFile, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := Load(testFile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			tt.check(t, loaded)
+		})
+	}
+}
+
+func TestLoad_Sequence(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "expands to scenario",
+			yaml: `name: Cached
+request:
+  url: /page
+  headers:
+    Accept: text/html
+sequence:
+  - cache: {hit: false}
+  - cache: {hit: true}
+  - response:
+      headers:
+        X-Cache: HIT
+`,
+		},
+		{
+			name:    "with expectations",
+			yaml:    "name: x\nrequest:\n  url: /\nexpectations:\n  response:\n    status: 200\nsequence:\n  - cache: {hit: false}\n",
+			wantErr: "put the expectations in the sequence",
+		},
+		{
+			name:    "without request",
+			yaml:    "name: x\nsequence:\n  - cache: {hit: false}\n",
+			wantErr: "sequence requires request.url",
+		},
+		{
+			name:    "with scenario",
+			yaml:    "name: x\nrequest:\n  url: /\nscenario:\n  - at: 0s\n    request:\n      url: /\n    expectations:\n      response:\n        status: 200\nsequence:\n  - cache: {hit: false}\n",
+			wantErr: "'sequence' with 'scenario'",
+		},
+		{
+			name:    "invalid entry",
+			yaml:    "name: x\nrequest:\n  url: /\nsequence:\n  - cache: {hit: false}\n  - storage: disk\n",
+			wantErr: "sequence 2: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+
+			test := loaded[0]
+			if !test.IsScenario() || len(test.Scenario) != 3 || len(test.Sequence) != 0 || test.Request.URL != "" {
+				t.Fatalf("test = %+v, want a 3-step scenario", test)
+			}
+			for i, step := range test.Scenario {
+				if step.Offset() != 0 || step.Request.Method != "GET" || step.Request.URL != "/page" || step.Request.Headers["Accept"] != "text/html" {
+					t.Errorf("step %d request = %s %+v, want GET /page at 0s", i+1, step.At, step.Request)
+				}
+				if step.Expectations.Response.Status != 200 {
+					t.Errorf("step %d status = %d, want 200", i+1, step.Expectations.Response.Status)
+				}
+			}
+			if hit := test.Scenario[1].Expectations.Cache.Hit; hit == nil || !*hit {
+				t.Errorf("step 2 cache.hit = %v, want true", hit)
+			}
+		})
+	}
+}
+
+func TestLoad_Matrix(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name: "one test per cell",
+			yaml: `name: Grace
+matrix:
+  varnish_params:
+    - {default_grace: 0s}
+    - {default_grace: 60s, default_ttl: 10s}
+request:
+  url: /
+expectations:
+  response:
+    status: 200
+`,
+			wantNames: []string{"Grace [default_grace=0s]", "Grace [default_grace=60s, default_ttl=10s]"},
+		},
+		{
+			name: "matrix from defaults",
+			yaml: `defaults:
+  matrix:
+    varnish_params: [{default_grace: 0s}, {default_grace: 60s}]
+---
+- name: A
+  request: {url: /a}
+  expectations: {response: {status: 200}}
+- name: B
+  request: {url: /b}
+  expectations: {response: {status: 200}}
+`,
+			wantNames: []string{"A [default_grace=0s]", "A [default_grace=60s]", "B [default_grace=0s]", "B [default_grace=60s]"},
+		},
+		{
+			name:    "empty matrix",
+			yaml:    "name: x\nmatrix:\n  varnish_params: []\nrequest:\n  url: /\nexpectations:\n  response:\n    status: 200\n",
+			wantErr: "at least one entry",
+		},
+		{
+			name:    "empty cell",
+			yaml:    "name: x\nmatrix:\n  varnish_params: [{}]\nrequest:\n  url: /\nexpectations:\n  response:\n    status: 200\n",
+			wantErr: "varnish_params[0]: no parameters",
+		},
+		{
+			name:    "duplicate cell",
+			yaml:    "name: x\nmatrix:\n  varnish_params: [{default_grace: 0s}, {default_grace: 0s}]\nrequest:\n  url: /\nexpectations:\n  response:\n    status: 200\n",
+			wantErr: "duplicate entry default_grace=0s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+
+			var names []string
+			for _, test := range loaded {
+				names = append(names, test.Name)
+				if test.Matrix != nil || len(test.VarnishParams) == 0 {
+					t.Errorf("test %q: matrix = %v, params = %v, want an expanded cell", test.Name, test.Matrix, test.VarnishParams)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("names = %q, want %q", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestLoad_CallsBetween(t *testing.T) {
+	const scenario = `name: Grace
+scenario:
+  - at: 0s
+    request: {url: /}
+    expectations: {response: {status: 200}}
+  - at: 45s
+    request: {url: /}
+    expectations:
+      response: {status: 200}
+      backend:
+        calls_between: %s
+`
+	tests := []struct {
+		name        string
+		yaml        string
+		wantWindows int
+		wantErr     string
+	}{
+		{
+			name:        "single window",
+			yaml:        fmt.Sprintf(scenario, "{from: 10s, to: 60s, calls: 1}"),
+			wantWindows: 1,
+		},
+		{
+			name:        "list of windows",
+			yaml:        fmt.Sprintf(scenario, "[{from: 0s, to: 10s, calls: 1}, {from: 10s, to: 1m, calls: 0, backend: api}]"),
+			wantWindows: 2,
+		},
+		{
+			name:    "empty window",
+			yaml:    fmt.Sprintf(scenario, "{from: 60s, to: 10s, calls: 1}"),
+			wantErr: "scenario step 2: backend.calls_between: window 60s-10s is empty",
+		},
+		{
+			name:    "invalid duration",
+			yaml:    fmt.Sprintf(scenario, "{from: soon, to: 10s, calls: 1}"),
+			wantErr: `scenario[1].expectations.backend.calls_between.from: invalid duration "soon"`,
+		},
+		{
+			name:    "missing calls",
+			yaml:    fmt.Sprintf(scenario, "{from: 0s, to: 10s}"),
+			wantErr: "calls is required",
+		},
+		{
+			name:    "single request",
+			yaml:    "name: x\nrequest: {url: /}\nexpectations:\n  response: {status: 200}\n  backend:\n    calls_between: {from: 0s, to: 10s, calls: 1}\n",
+			wantErr: "only available in scenario steps",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if got := len(loaded[0].Scenario[1].Expectations.Backend.CallsBetween); got != tt.wantWindows {
+				t.Errorf("windows = %d, want %d", got, tt.wantWindows)
+			}
+		})
+	}
+}
+
+func TestLoad_Literals(t *testing.T) {
+	const single = "name: x\nrequest: {url: /}\nexpectations:\n  response: {status: 200}\n"
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{
+			name: "numbers and units",
+			yaml: single + "  eventually: {timeout: 2, interval: 250ms}\nbackends:\n  default: {bandwidth: 64k/s, generate: {size: 50MB, declared_size: 1024}}\n",
+		},
+		{
+			name:    "rate without per second",
+			yaml:    single + "backends:\n  default:\n    bandwidth: 1MB\n",
+			wantErr: `line 7: backends.default.bandwidth: invalid rate "1MB"`,
+		},
+		{
+			name:    "size in a route",
+			yaml:    single + "backends:\n  default:\n    routes:\n      /big: {generate: {size: lots}}\n",
+			wantErr: `line 8: backends.default.routes./big.generate.size: invalid size "lots"`,
+		},
+		{
+			name:    "size in a list of tests",
+			yaml:    "- name: a\n  request: {url: /}\n  expectations:\n    response: {status: 200}\n- name: b\n  request: {url: /}\n  expectations:\n    response: {status: 200, body_size: 12q}\n",
+			wantErr: `line 8: [1].expectations.response.body_size: invalid size "12q"`,
+		},
+		{
+			name:    "scenario offset",
+			yaml:    "name: x\nscenario:\n  - at: 0\n    request: {url: /}\n    expectations: {response: {status: 200}}\n  - at: soon\n    request: {url: /}\n    expectations: {response: {status: 200}}\n",
+			wantErr: `line 6: scenario[1].at: invalid duration "soon"`,
+		},
+		{
+			name:    "negative scenario offset",
+			yaml:    "name: x\nscenario:\n  - at: -1s\n    request: {url: /}\n    expectations: {response: {status: 200}}\n",
+			wantErr: "scenario step 1: 'at' must not be negative",
+		},
+		{
+			name:    "zero timeout",
+			yaml:    single + "  eventually: {timeout: 0s}\n",
+			wantErr: "expectations.eventually.timeout must be positive",
+		},
+		{
+			name:    "missing timeout",
+			yaml:    single + "  eventually: {interval: 1s}\n",
+			wantErr: "expectations.eventually.timeout must be positive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			test := loaded[0]
+			if timeout, interval := test.Expectations.Eventually.Durations(); timeout != 2*time.Second || interval != 250*time.Millisecond {
+				t.Errorf("eventually = %s, %s, want 2s, 250ms", timeout, interval)
+			}
+			backend := test.Backends["default"]
+			if backend.Bandwidth != 64<<10 || backend.Generate.Size != 50<<20 || backend.Generate.DeclaredSize != 1024 {
+				t.Errorf("bandwidth, size, declared_size = %d, %d, %d", backend.Bandwidth, backend.Generate.Size, backend.Generate.DeclaredSize)
+			}
+		})
+	}
+}
+
+func TestExpectationLocation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.yaml")
+	content := `name: single
+request: {url: /}
+expectations:
+  response: {status: 200}
+  cache: {hit: true}
+---
+- name: pipelined
+  pipeline:
+    - request: {url: /a}
+      expectations:
+        response: {status: 404}
+    - request: {url: /b}
+      no_response: true
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		test     int
+		request  int
+		field    string
+		wantLine int
+	}{
+		{name: "field", test: 0, field: "cache.hit", wantLine: 5},
+		{name: "unset field", test: 0, field: "backend.calls", wantLine: 3},
+		{name: "pipeline step", test: 1, request: 1, field: "response.status", wantLine: 11},
+		{name: "step without expectations", test: 1, request: 2, wantLine: 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := loaded[tt.test].ExpectationLocation(tt.request, tt.field)
+			if want := (Location{File: path, Line: tt.wantLine}); !ok || got != want {
+				t.Errorf("ExpectationLocation(%d, %q) = %v, %v, want %v", tt.request, tt.field, got, ok, want)
+			}
+		})
+	}
+
+	if _, ok := (&TestSpec{Name: "built in Go"}).ExpectationLocation(0, "cache.hit"); ok {
+		t.Error("ExpectationLocation() of a test not loaded from a file should fail")
+	}
+}
+
+func TestLoad_Presets(t *testing.T) {
+	sixty := Duration(time.Minute)
+	tests := []struct {
+		name    string
+		yaml    string
+		files   map[string]string
+		want    ExpectationsSpec
+		wantErr string
+	}{
+		{
+			name: "built-in preset",
+			yaml: "name: x\nrequest: {url: /logo.png}\nexpectations:\n  preset: static_asset_cached\n",
+			want: ExpectationsSpec{
+				Response: ResponseExpectations{Status: 200, Headers: map[string]string{"Set-Cookie": ""}},
+				Cache:    &CacheExpectations{HitRatio: &HitRatioSpec{Min: 1}},
+			},
+		},
+		{
+			name: "test values win",
+			yaml: "name: x\nrequest: {url: /}\nexpectations:\n  preset: html_short_ttl\n  response: {status: 203, headers: {X-Cache: HIT}}\n  cache: {ttl_lt: 60}\n",
+			want: ExpectationsSpec{
+				Response: ResponseExpectations{Status: 203, Headers: map[string]string{"X-Cache": "HIT"}},
+				Cache:    &CacheExpectations{TTLGt: new(Duration), TTLLt: &sixty},
+			},
+		},
+		{
+			name: "earlier presets win",
+			yaml: "presets:\n  moved: {response: {status: 301}}\n  found: {response: {status: 302, headers: {Location: /new}}}\n---\nname: x\nrequest: {url: /}\nexpectations:\n  preset: [moved, found]\n",
+			want: ExpectationsSpec{
+				Response: ResponseExpectations{Status: 301, Headers: map[string]string{"Location": "/new"}},
+			},
+		},
+		{
+			name: "inline presets document",
+			yaml: "presets:\n  json:\n    response: {status: 200, headers: {Content-Type: application/json}}\n---\nname: x\nrequest: {url: /}\nexpectations: {preset: json}\n",
+			want: ExpectationsSpec{
+				Response: ResponseExpectations{Status: 200, Headers: map[string]string{"Content-Type": "application/json"}},
+			},
+		},
+		{
+			name:  "presets file",
+			yaml:  "presets: presets.yaml\n---\nname: x\nrequest: {url: /}\nexpectations: {preset: gone, response: {status: 410}}\n",
+			files: map[string]string{"presets.yaml": "gone:\n  response: {headers: {Cache-Control: no-store}}\n"},
+			want: ExpectationsSpec{
+				Response: ResponseExpectations{Status: 410, Headers: map[string]string{"Cache-Control": "no-store"}},
+			},
+		},
+		{
+			name:    "conflicting presets",
+			yaml:    "name: x\nrequest: {url: /}\nexpectations:\n  preset: [api_not_cached, static_asset_cached]\n",
+			wantErr: "hit_ratio.max (0) is below min (1)",
+		},
+		{
+			name:    "unknown preset",
+			yaml:    "name: x\nrequest: {url: /}\nexpectations: {preset: fast}\n",
+			wantErr: `unknown preset "fast" (available: api_not_cached, html_short_ttl, static_asset_cached)`,
+		},
+		{
+			name:    "unknown field in preset",
+			yaml:    "presets:\n  json:\n    response: {status: 200, header: {}}\n---\nname: x\nrequest: {url: /}\nexpectations: {preset: json}\n",
+			wantErr: "field header not found",
+		},
+		{
+			name:    "nested preset",
+			yaml:    "presets:\n  cdn:\n    preset: static_asset_cached\n---\nname: x\nrequest: {url: /}\nexpectations: {preset: cdn}\n",
+			wantErr: "preset cdn cannot use other presets",
+		},
+		{
+			name:    "preset expectations are validated",
+			yaml:    "name: x\npipeline:\n  - request: {url: /}\n    expectations: {preset: html_short_ttl}\n",
+			wantErr: "cache.ttl_gt, ttl_lt, ttl_respects_age and ttl_source are not available in pipelines",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path := filepath.Join(dir, "test.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := Load(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if got := loaded[0].Expectations; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expectations = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoad_PresetsInSteps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.yaml")
+	yaml := `name: x
+request: {url: /api}
+sequence:
+  - preset: api_not_cached
+  - response: {status: 200}
+`
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	steps := loaded[0].Scenario
+	if cache := steps[0].Expectations.Cache; cache == nil || cache.HitRatio == nil || cache.HitRatio.Max == nil {
+		t.Errorf("step 1 cache = %+v, want hit_ratio with max", cache)
+	}
+	if steps[1].Expectations.Cache != nil {
+		t.Errorf("step 2 cache = %+v, want nil", steps[1].Expectations.Cache)
+	}
+}
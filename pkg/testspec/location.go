@@ -0,0 +1,90 @@
+package testspec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Location is a line in a test file, such as where a failed expectation is set
+type Location struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Request int    `json:"request,omitempty"` // 1-based scenario, sequence or pipeline step (multi-request tests only)
+	Field   string `json:"field,omitempty"`   // Failed assertion, e.g. "cache.hit"; empty when no single one is to blame
+}
+
+// String formats the location the way editors jump to it, e.g. "tests/cache.yaml:14"
+func (l Location) String() string {
+	return l.File + ":" + strconv.Itoa(l.Line)
+}
+
+// ExpectationLocation returns where field, an assertion name such as
+// "cache.hit", is set for the test's request: its 1-based scenario,
+// sequence or pipeline step, or 0 for a single-request test. Expectations
+// that come from defaults or presets resolve to the closest key the test
+// sets itself. It returns false for tests that were not loaded from a file.
+func (t *TestSpec) ExpectationLocation(request int, field string) (Location, bool) {
+	if t.File == "" || t.Lines == nil {
+		return Location{}, false
+	}
+	path := "expectations"
+	switch {
+	case request > 0 && len(t.Pipeline) > 0:
+		path = fmt.Sprintf("pipeline[%d].expectations", request-1)
+	case request > 0:
+		path = fmt.Sprintf("scenario[%d].expectations", request-1)
+	}
+	if field != "" {
+		path += "." + field
+	}
+	for {
+		if line, ok := t.Lines[path]; ok {
+			return Location{File: t.File, Line: line}, true
+		}
+		if path == "" {
+			return Location{}, false
+		}
+		path = path[:max(0, strings.LastIndexAny(path, ".["))]
+	}
+}
+
+// indexLines returns the line of each key under a test node, by path as
+// nodePath writes it, and of the test itself under "". Sequence entries are
+// indexed as the scenario steps they expand to.
+func indexLines(test *yaml.Node) map[string]int {
+	lines := map[string]int{"": test.Line}
+	var walk func(node *yaml.Node, path string)
+	walk = func(node *yaml.Node, path string) {
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i].Value
+				if path != "" {
+					key = path + "." + key
+				}
+				lines[key] = node.Content[i].Line
+				walk(node.Content[i+1], key)
+			}
+		case yaml.SequenceNode:
+			for i, item := range node.Content {
+				index := path + "[" + strconv.Itoa(i) + "]"
+				lines[index] = item.Line
+				walk(item, index)
+			}
+		}
+	}
+	walk(test, "")
+
+	for path, line := range lines {
+		rest, ok := strings.CutPrefix(path, "sequence[")
+		if !ok {
+			continue
+		}
+		index, rest, _ := strings.Cut(rest, "]")
+		lines["scenario["+index+"].expectations"+rest] = line
+	}
+	return lines
+}
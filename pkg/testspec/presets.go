@@ -0,0 +1,243 @@
+package testspec
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Expectations can name presets, bundles of expectations for common CDN
+// behaviors:
+//
+//	expectations:
+//	  preset: static_asset_cached
+//	  response:
+//	    headers:
+//	      Content-Type: image/png
+//
+// A preset is merged into the expectations like defaults: mappings key by
+// key, with the expectations' own values (and defaults) winning. With a list
+// of presets, earlier ones win over later ones.
+//
+// A presets document in the test file adds presets, or replaces built-in
+// ones, for the tests that follow it:
+//
+//	presets:
+//	  cached_json:
+//	    response:
+//	      headers:
+//	        Content-Type: application/json
+//	    cache:
+//	      hit_ratio:
+//	        min: 1
+//
+// or loads them from a file, relative to the test file, with the same
+// mapping of names to expectations:
+//
+//	presets: ../presets.yaml
+
+// builtinPresets are the presets available without a presets document
+const builtinPresets = `
+# Cacheable, and not personalized
+static_asset_cached:
+  response:
+    status: 200
+    headers:
+      Set-Cookie: ""
+  cache:
+    hit_ratio:
+      min: 1
+
+# Never served from cache
+api_not_cached:
+  cache:
+    hit_ratio:
+      max: 0
+
+# Cached, but for less than 10 minutes
+html_short_ttl:
+  response:
+    status: 200
+  cache:
+    ttl_gt: 0
+    ttl_lt: 10m
+`
+
+// presetsDocument returns the value of a presets document (a mapping with
+// the single key presets), or nil for other documents
+func presetsDocument(doc *yaml.Node) *yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode || len(root.Content) != 2 || root.Content[0].Value != "presets" {
+		return nil
+	}
+	return root.Content[1]
+}
+
+// decodePresetsDocument decodes a presets document into presets. value is
+// the document's presets value as read by a node decoder; decoder is a strict
+// decoder positioned at the same document. Files are relative to dir.
+func decodePresetsDocument(decoder *yaml.Decoder, value *yaml.Node, dir string, presets map[string]*yaml.Node) error {
+	var nodes map[string]*yaml.Node
+	if value.Kind == yaml.ScalarNode {
+		var doc struct {
+			Presets string `yaml:"presets"`
+		}
+		if err := decoder.Decode(&doc); err != nil {
+			return err
+		}
+		path := doc.Presets
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading presets file: %w", err)
+		}
+		if nodes, err = decodePresets(data, path); err != nil {
+			return err
+		}
+	} else {
+		var doc struct {
+			Presets map[string]ExpectationsSpec `yaml:"presets"`
+		}
+		if err := decoder.Decode(&doc); err != nil {
+			return err
+		}
+		var err error
+		if nodes, err = presetNodes(value); err != nil {
+			return err
+		}
+	}
+	maps.Copy(presets, nodes)
+	return nil
+}
+
+// decodePresets decodes a mapping of preset names to expectations, checking
+// the expectations strictly. source names the data in errors.
+func decodePresets(data []byte, source string) (map[string]*yaml.Node, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var specs map[string]ExpectationsSpec
+	if err := decoder.Decode(&specs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", source, err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", source, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	nodes, err := presetNodes(doc.Content[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	return nodes, nil
+}
+
+// presetNodes returns the presets of a mapping node of preset names to
+// expectations, checking that no preset names other presets
+func presetNodes(mapping *yaml.Node) (map[string]*yaml.Node, error) {
+	if mapping.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("presets must be a mapping of names to expectations")
+	}
+	nodes := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		name, node := mapping.Content[i].Value, mapping.Content[i+1]
+		switch {
+		case node.Kind != yaml.MappingNode:
+			return nil, fmt.Errorf("preset %s must be a mapping of expectations", name)
+		case mappingValue(node, "preset") != nil:
+			return nil, fmt.Errorf("preset %s cannot use other presets", name)
+		}
+		nodes[name] = node
+	}
+	return nodes, nil
+}
+
+// applyPresets returns a copy of a test node with the presets named by its
+// expectations merged in: the test's, and those of its scenario steps,
+// sequence entries and pipeline steps
+func applyPresets(test *yaml.Node, presets map[string]*yaml.Node) (*yaml.Node, error) {
+	if test.Kind != yaml.MappingNode {
+		return test, nil
+	}
+	merged := *test
+	merged.Content = append([]*yaml.Node(nil), test.Content...)
+
+	if exp := mappingValue(test, "expectations"); exp != nil {
+		expanded, err := expandPresets(exp, presets)
+		if err != nil {
+			return nil, fmt.Errorf("expectations: %w", err)
+		}
+		setMappingValue(&merged, "expectations", expanded)
+	}
+	if sequence := mappingValue(test, "sequence"); sequence != nil && sequence.Kind == yaml.SequenceNode {
+		entries := *sequence
+		entries.Content = make([]*yaml.Node, len(sequence.Content))
+		for i, entry := range sequence.Content {
+			expanded, err := expandPresets(entry, presets)
+			if err != nil {
+				return nil, fmt.Errorf("sequence %d: %w", i+1, err)
+			}
+			entries.Content[i] = expanded
+		}
+		setMappingValue(&merged, "sequence", &entries)
+	}
+	for _, key := range []string{"scenario", "pipeline"} {
+		steps := mappingValue(test, key)
+		if steps == nil || steps.Kind != yaml.SequenceNode {
+			continue
+		}
+		expandedSteps := *steps
+		expandedSteps.Content = make([]*yaml.Node, len(steps.Content))
+		for i, step := range steps.Content {
+			expandedSteps.Content[i] = step
+			exp := mappingValue(step, "expectations")
+			if exp == nil {
+				continue
+			}
+			expanded, err := expandPresets(exp, presets)
+			if err != nil {
+				return nil, fmt.Errorf("%s step %d: %w", key, i+1, err)
+			}
+			expandedStep := *step
+			expandedStep.Content = append([]*yaml.Node(nil), step.Content...)
+			setMappingValue(&expandedStep, "expectations", expanded)
+			expandedSteps.Content[i] = &expandedStep
+		}
+		setMappingValue(&merged, key, &expandedSteps)
+	}
+	return &merged, nil
+}
+
+// expandPresets merges the presets an expectations node names into it, and
+// drops the preset key
+func expandPresets(exp *yaml.Node, presets map[string]*yaml.Node) (*yaml.Node, error) {
+	preset := mappingValue(exp, "preset")
+	if preset == nil {
+		return exp, nil
+	}
+	var names PresetNames
+	if err := preset.Decode(&names); err != nil {
+		return nil, fmt.Errorf("preset: %w", err)
+	}
+	merged := withoutKey(exp, "preset")
+	for _, name := range names {
+		node, ok := presets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(slices.Sorted(maps.Keys(presets)), ", "))
+		}
+		merged = mergeNodes(node, merged)
+	}
+	return merged, nil
+}
@@ -0,0 +1,110 @@
+package testspec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Size is a number of bytes, written in YAML as a bare number (4096) or with
+// a unit: "512B", "128k", "64KB", "1.5GB". K, KB and KiB are all 1024 bytes.
+type Size int64
+
+// String formats the size in bytes, e.g. "1048576B"
+func (s Size) String() string {
+	return strconv.FormatInt(int64(s), 10) + "B"
+}
+
+// UnmarshalYAML accepts a number of bytes or a size with a unit
+func (s *Size) UnmarshalYAML(value *yaml.Node) error {
+	size, err := parseSizeNode(value)
+	if err != nil {
+		return invalidLiteral(value, err)
+	}
+	*s = Size(size)
+	return nil
+}
+
+// MarshalYAML writes the size as a number of bytes
+func (s Size) MarshalYAML() (interface{}, error) {
+	return int64(s), nil
+}
+
+// Rate is a number of bytes per second, written in YAML as a size per second
+// ("1MB/s", "64k/s") or a bare number of bytes per second
+type Rate int64
+
+// String formats the rate, e.g. "1048576B/s"
+func (r Rate) String() string {
+	return Size(r).String() + "/s"
+}
+
+// UnmarshalYAML accepts a size per second or a number of bytes per second.
+// The rate must be at least 1B/s.
+func (r *Rate) UnmarshalYAML(value *yaml.Node) error {
+	if _, ok := scalarNumber(value); !ok {
+		rate, found := strings.CutSuffix(strings.TrimSpace(value.Value), "/s")
+		if value.Kind != yaml.ScalarNode || !found {
+			return invalidLiteral(value, fmt.Errorf("invalid rate %q, expected a rate like '1MB/s'", value.Value))
+		}
+		value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: rate, Line: value.Line, Column: value.Column}
+	}
+	size, err := parseSizeNode(value)
+	if err != nil || size < 1 {
+		return invalidLiteral(value, fmt.Errorf("invalid rate %q, expected a positive rate like '1MB/s'", value.Value+"/s"))
+	}
+	*r = Rate(size)
+	return nil
+}
+
+// MarshalYAML writes the rate in the form UnmarshalYAML reads
+func (r Rate) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+// parseSizeNode parses a YAML number of bytes or a size with a unit
+func parseSizeNode(value *yaml.Node) (int64, error) {
+	if n, ok := scalarNumber(value); ok {
+		if n < 0 {
+			return 0, fmt.Errorf("invalid size %s, must not be negative", value.Value)
+		}
+		return int64(n), nil
+	}
+	if value.Kind != yaml.ScalarNode {
+		return 0, fmt.Errorf("size must be a number of bytes or a string like '512KB' or '1GB'")
+	}
+	return parseSize(value.Value)
+}
+
+// sizeUnits are the size suffixes, longest first so that "KB" is not read as "B"
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// parseSize parses a byte size like "512", "128k", "64KB" or "1.5GB"
+// (K = KB = KiB = 1024 bytes)
+func parseSize(s string) (int64, error) {
+	size := strings.ToUpper(strings.TrimSpace(s))
+
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if n, found := strings.CutSuffix(size, u.suffix); found {
+			size, unit = strings.TrimSpace(n), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(size, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a size like '512KB' or '1GB'", s)
+	}
+	return int64(n * float64(unit)), nil
+}
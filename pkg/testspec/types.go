@@ -1,5 +1,21 @@
 package testspec
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/invopop/jsonschema"
+	"github.com/perbu/vcltest/pkg/backend"
+)
+
+// HooksSpec holds shell commands run around the whole suite
+type HooksSpec struct {
+	BeforeSuite []string `yaml:"before_suite,omitempty" json:"before_suite,omitempty" jsonschema:"description=Commands run in order before varnishd starts (e.g. start a service a VMOD talks to); a failing command aborts the run"`
+	AfterSuite  []string `yaml:"after_suite,omitempty" json:"after_suite,omitempty" jsonschema:"description=Commands run in order after the tests\\, also when the run fails; a failing command fails the run"`
+}
+
 // TestSpec represents a single test case
 type TestSpec struct {
 	Name         string                 `yaml:"name" json:"name" jsonschema:"required,description=Name of the test case"`
@@ -7,41 +23,187 @@ type TestSpec struct {
 	Backends     map[string]BackendSpec `yaml:"backends,omitempty" json:"backends,omitempty" jsonschema:"description=Named backend response specifications"`
 	Expectations ExpectationsSpec       `yaml:"expectations,omitempty" json:"expectations,omitempty" jsonschema:"description=Test expectations for single-request tests"`
 	Scenario     []ScenarioStep         `yaml:"scenario,omitempty" json:"scenario,omitempty" jsonschema:"description=Multi-step temporal test scenario"`
+	Sequence     []ExpectationsSpec     `yaml:"sequence,omitempty" json:"sequence,omitempty" jsonschema:"description=Expectations for repeating the test request\\, in order (e.g. a miss then hits); shorthand for a scenario with every step at 0s sharing one client"`
+	Pipeline     []PipelineStep         `yaml:"pipeline,omitempty" json:"pipeline,omitempty" jsonschema:"description=Requests written to a single connection before any response is read (HTTP/1.1 pipelining); responses are checked in order"`
+	VCLSource    string                 `yaml:"vcl_source,omitempty" json:"vcl_source,omitempty" jsonschema:"description=Inline VCL under test (used for the whole file instead of a same-named .vcl file)"`
+	Redact       []string               `yaml:"redact,omitempty" json:"redact,omitempty" jsonschema:"description=Header names whose values are masked in all output and debug dumps (applies to the whole run)"`
+	Hooks        *HooksSpec             `yaml:"hooks,omitempty" json:"hooks,omitempty" jsonschema:"description=Shell commands run before and after the whole run (applies to the whole run; set it in a defaults document for a whole file)"`
+	Engine       string                 `yaml:"engine,omitempty" json:"engine,omitempty" jsonschema:"description=Where the test runs: varnishd (default) or simulated (experimental in-process VCL interpreter\\, falls back to varnishd for unsupported VCL),enum=varnishd,enum=simulated"`
+
+	WarmupFrom        string `yaml:"warmup_from,omitempty" json:"warmup_from,omitempty" jsonschema:"description=URL list (one per line\\, optional headers after '|') or sitemap to request before the test to prime the cache (relative to the test file)"`
+	WarmupConcurrency int    `yaml:"warmup_concurrency,omitempty" json:"warmup_concurrency,omitempty" jsonschema:"description=Parallel warmup requests (default: 8),minimum=1"`
+
+	// Scenario backend call counting; nil means true
+	ResetBackendCounts *bool `yaml:"reset_backend_counts,omitempty" json:"reset_backend_counts,omitempty" jsonschema:"description=Reset backend call counters (and access logs) before each scenario step (default: true); false counts from the start of the test. Set it in a defaults document for a whole file"`
+
+	// Warmup holds the requests loaded from WarmupFrom
+	Warmup []RequestSpec `yaml:"-" json:"-"`
+
+	// Environment permutations; the loader expands a test with a matrix
+	// into one test per cell
+	Matrix *MatrixSpec `yaml:"matrix,omitempty" json:"matrix,omitempty" jsonschema:"description=Run the test once per environment permutation\\, reported as separate tests named after the cell. Set it in a defaults document for a whole file"`
+
+	// VarnishParams are set via param.set for the whole test (one matrix
+	// cell) and restored afterwards
+	VarnishParams map[string]string `yaml:"-" json:"-"`
+
+	// File is the test file the test was loaded from, and Lines the line
+	// of each of the test's keys in it (see ExpectationLocation)
+	File  string         `yaml:"-" json:"-"`
+	Lines map[string]int `yaml:"-" json:"-"`
+
+	// Annotations, carried through to reports and the event stream
+	Owner       string `yaml:"owner,omitempty" json:"owner,omitempty" jsonschema:"description=Team or person responsible for this test"`
+	Link        string `yaml:"link,omitempty" json:"link,omitempty" jsonschema:"description=Ticket or dashboard URL for this test,format=uri"`
+	Description string `yaml:"description,omitempty" json:"description,omitempty" jsonschema:"description=What the test checks and why"`
 }
 
+// Test engines
+const (
+	EngineVarnishd  = "varnishd"  // Real varnishd (default)
+	EngineSimulated = "simulated" // In-process VCL subset interpreter (experimental)
+)
+
 // ScenarioStep represents a single step in a temporal test scenario
 type ScenarioStep struct {
-	At           string                 `yaml:"at" json:"at" jsonschema:"required,description=Time offset from test start (e.g. '0s' '30s' '2m'),pattern=^[0-9]+(s|m|h)$"`
+	At           *Duration              `yaml:"at" json:"at" jsonschema:"required,oneof_type=number;string,description=Time offset from test start (e.g. '0s' '30s' '2m'; a bare number is seconds)"`
 	Request      RequestSpec            `yaml:"request,omitempty" json:"request,omitempty" jsonschema:"description=HTTP request to make at this step"`
 	Backends     map[string]BackendSpec `yaml:"backends,omitempty" json:"backends,omitempty" jsonschema:"description=Backend response overrides for this step"`
 	Expectations ExpectationsSpec       `yaml:"expectations" json:"expectations" jsonschema:"required,description=Test expectations for this step"`
+	BackendDown  BackendNames           `yaml:"backend_down,omitempty" json:"backend_down,omitempty" jsonschema:"description=Backend name(s) to stop listening before this step's request (connection refused)"`
+	BackendUp    BackendNames           `yaml:"backend_up,omitempty" json:"backend_up,omitempty" jsonschema:"description=Backend name(s) to restart listening before this step's request"`
+	SetParam     map[string]string      `yaml:"set_param,omitempty" json:"set_param,omitempty" jsonschema:"description=varnishd parameters to change via param.set at this step (restored after the test)"`
+
+	ResetBackendCounts *bool `yaml:"reset_backend_counts,omitempty" json:"reset_backend_counts,omitempty" jsonschema:"description=Overrides the test's reset_backend_counts for this step"`
+}
+
+// Offset returns the step's time offset from the test start
+func (s ScenarioStep) Offset() time.Duration {
+	if s.At == nil {
+		return 0
+	}
+	return time.Duration(*s.At)
+}
+
+// MatrixSpec lists the environments a test runs under
+type MatrixSpec struct {
+	VarnishParams []map[string]string `yaml:"varnish_params" json:"varnish_params" jsonschema:"required,description=varnishd parameter sets (e.g. {default_grace: 0s}); the test runs once with each\\, set via param.set and restored afterwards,minItems=1"`
+}
+
+// PipelineStep is one request of a pipeline test and the expectations for
+// its response. Responses are matched to requests by order.
+type PipelineStep struct {
+	Request      RequestSpec      `yaml:"request" json:"request" jsonschema:"required,description=HTTP request to send on the shared connection"`
+	Expectations ExpectationsSpec `yaml:"expectations,omitempty" json:"expectations,omitempty" jsonschema:"description=Expectations for the response to this request (required unless no_response)"`
+	NoResponse   bool             `yaml:"no_response,omitempty" json:"no_response,omitempty" jsonschema:"description=Varnish must close the connection without answering this request (rejecting the rest of the pipeline); the following steps must set it too"`
+}
+
+// BackendNames is a list of backend names that can be written in YAML as a
+// single name (backend_down: api) or a list (backend_down: [api, auth])
+type BackendNames []string
+
+// UnmarshalYAML accepts either a single string or a list of strings
+func (b *BackendNames) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*b = BackendNames{single}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*b = list
+	return nil
+}
+
+// JSONSchemaExtend lets the schema accept a single name as well as a list
+func (BackendNames) JSONSchemaExtend(s *jsonschema.Schema) {
+	singleOrList(s)
+}
+
+// PresetNames is a list of expectation preset names that can be written in
+// YAML as a single name (preset: api_not_cached) or a list
+type PresetNames []string
+
+// UnmarshalYAML accepts either a single string or a list of strings
+func (p *PresetNames) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*p = PresetNames{single}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*p = list
+	return nil
+}
+
+// JSONSchemaExtend lets the schema accept a single name as well as a list
+func (PresetNames) JSONSchemaExtend(s *jsonschema.Schema) {
+	singleOrList(s)
 }
 
 // RequestSpec defines the HTTP request to make
 type RequestSpec struct {
 	Method  string            `yaml:"method,omitempty" json:"method,omitempty" jsonschema:"description=HTTP method (default: GET),enum=GET,enum=POST,enum=PUT,enum=DELETE,enum=HEAD,enum=PATCH,enum=OPTIONS"`
 	URL     string            `yaml:"url" json:"url" jsonschema:"required,description=URL path to request (e.g. '/api/users')"`
+	Host    string            `yaml:"host,omitempty" json:"host,omitempty" jsonschema:"description=Host header to send (the request still goes to the Varnish under test); selects per-host defaults"`
 	Headers map[string]string `yaml:"headers,omitempty" json:"headers,omitempty" jsonschema:"description=HTTP request headers"`
 	Body    string            `yaml:"body,omitempty" json:"body,omitempty" jsonschema:"description=Request body content"`
+
+	FollowRedirects bool `yaml:"follow_redirects,omitempty" json:"follow_redirects,omitempty" jsonschema:"description=Follow 3xx redirects through Varnish (default: false)"`
+	MaxRedirects    int  `yaml:"max_redirects,omitempty" json:"max_redirects,omitempty" jsonschema:"description=Maximum redirect hops when following redirects (default: 10),minimum=1"`
+
+	ExpectContinue bool `yaml:"expect_continue,omitempty" json:"expect_continue,omitempty" jsonschema:"description=Send Expect: 100-continue and hold the body back until Varnish answers 100 Continue (or 2s pass); requires a body"`
 }
 
 // RouteSpec defines response for a specific URL path
 type RouteSpec struct {
-	Status      int               `yaml:"status,omitempty" json:"status,omitempty" jsonschema:"description=HTTP status code (default: 404),minimum=100,maximum=599"`
-	Headers     map[string]string `yaml:"headers,omitempty" json:"headers,omitempty" jsonschema:"description=HTTP response headers"`
-	Body        string            `yaml:"body,omitempty" json:"body,omitempty" jsonschema:"description=Response body content"`
-	FailureMode string            `yaml:"failure_mode,omitempty" json:"failure_mode,omitempty" jsonschema:"description=Backend failure simulation (failed=connection reset, frozen=never responds),enum=failed,enum=frozen"`
-	EchoRequest bool              `yaml:"echo_request,omitempty" json:"echo_request,omitempty" jsonschema:"description=Return the incoming request as JSON (for testing VCL request transformations)"`
+	Status         int               `yaml:"status,omitempty" json:"status,omitempty" jsonschema:"description=HTTP status code (default: 404),minimum=100,maximum=599"`
+	Headers        map[string]string `yaml:"headers,omitempty" json:"headers,omitempty" jsonschema:"description=HTTP response headers"`
+	Body           string            `yaml:"body,omitempty" json:"body,omitempty" jsonschema:"description=Response body content"`
+	BodyFile       string            `yaml:"body_file,omitempty" json:"body_file,omitempty" jsonschema:"description=File to read the response body from (relative to the test file; sets Content-Type by extension)"`
+	FailureMode    string            `yaml:"failure_mode,omitempty" json:"failure_mode,omitempty" jsonschema:"description=Backend failure simulation (failed=connection reset\\, frozen=never responds\\, truncated=body shorter than Content-Length\\, oversized_headers=header larger than http_resp_hdr_len\\, too_many_headers=more headers than http_max_hdr),enum=failed,enum=frozen,enum=truncated,enum=oversized_headers,enum=too_many_headers"`
+	EchoRequest    bool              `yaml:"echo_request,omitempty" json:"echo_request,omitempty" jsonschema:"description=Return the incoming request as JSON (for testing VCL request transformations)"`
+	EchoConnection bool              `yaml:"echo_connection,omitempty" json:"echo_connection,omitempty" jsonschema:"description=Add the connection of the echoed request to the echo_request JSON: remote address\\, protocol version\\, Host\\, framing and TLS details"`
+	Generate       *GenerateSpec     `yaml:"generate,omitempty" json:"generate,omitempty" jsonschema:"description=Generate a large or highly compressible body instead of body (for testing size limits)"`
 }
 
 // BackendSpec defines the mock backend response
 type BackendSpec struct {
-	Status      int                  `yaml:"status,omitempty" json:"status,omitempty" jsonschema:"description=HTTP status code (default: 404),minimum=100,maximum=599"`
-	Headers     map[string]string    `yaml:"headers,omitempty" json:"headers,omitempty" jsonschema:"description=HTTP response headers from backend"`
-	Body        string               `yaml:"body,omitempty" json:"body,omitempty" jsonschema:"description=Response body content from backend"`
-	FailureMode string               `yaml:"failure_mode,omitempty" json:"failure_mode,omitempty" jsonschema:"description=Backend failure simulation (failed=connection reset, frozen=never responds),enum=failed,enum=frozen"`
-	Routes      map[string]RouteSpec `yaml:"routes,omitempty" json:"routes,omitempty" jsonschema:"description=URL path to response mapping for path-based routing"`
-	EchoRequest bool                 `yaml:"echo_request,omitempty" json:"echo_request,omitempty" jsonschema:"description=Return the incoming request as JSON (for testing VCL request transformations)"`
+	Status         int                  `yaml:"status,omitempty" json:"status,omitempty" jsonschema:"description=HTTP status code (default: 404),minimum=100,maximum=599"`
+	Headers        map[string]string    `yaml:"headers,omitempty" json:"headers,omitempty" jsonschema:"description=HTTP response headers from backend"`
+	Body           string               `yaml:"body,omitempty" json:"body,omitempty" jsonschema:"description=Response body content from backend"`
+	BodyFile       string               `yaml:"body_file,omitempty" json:"body_file,omitempty" jsonschema:"description=File to read the response body from (relative to the test file; sets Content-Type by extension)"`
+	ServeDir       string               `yaml:"serve_dir,omitempty" json:"serve_dir,omitempty" jsonschema:"description=Directory to serve static files from for paths without a route (relative to the test file; missing files fall back to status/body)"`
+	FailureMode    string               `yaml:"failure_mode,omitempty" json:"failure_mode,omitempty" jsonschema:"description=Backend failure simulation (failed=connection reset\\, frozen=never responds\\, truncated=body shorter than Content-Length\\, oversized_headers=header larger than http_resp_hdr_len\\, too_many_headers=more headers than http_max_hdr),enum=failed,enum=frozen,enum=truncated,enum=oversized_headers,enum=too_many_headers"`
+	Routes         map[string]RouteSpec `yaml:"routes,omitempty" json:"routes,omitempty" jsonschema:"description=URL path to response mapping for path-based routing; whole segments like {id} capture parameters that replace {id} in the route's body and header values"`
+	EchoRequest    bool                 `yaml:"echo_request,omitempty" json:"echo_request,omitempty" jsonschema:"description=Return the incoming request as JSON (for testing VCL request transformations)"`
+	EchoConnection bool                 `yaml:"echo_connection,omitempty" json:"echo_connection,omitempty" jsonschema:"description=Add the connection of the echoed request to the echo_request JSON: remote address\\, protocol version\\, Host\\, framing and TLS details"`
+	Bandwidth      Rate                 `yaml:"bandwidth,omitempty" json:"bandwidth,omitempty" jsonschema:"oneof_type=number;string,description=Pace response bodies to this rate (e.g. '1MB/s' '64k/s'; a bare number is bytes per second; K = KB = 1024 bytes)"`
+	Generate       *GenerateSpec        `yaml:"generate,omitempty" json:"generate,omitempty" jsonschema:"description=Generate a large or highly compressible body instead of body (for testing size limits)"`
+}
+
+// GenerateSpec describes a generated response body: size bytes of filler,
+// optionally gzip compressed, with an optionally misdeclared Content-Length
+type GenerateSpec struct {
+	Size         Size `yaml:"size" json:"size" jsonschema:"required,oneof_type=number;string,description=Body size before compression (e.g. '10MB' '128k' '1GB'; a bare number is bytes; K = KB = 1024 bytes)"`
+	Gzip         bool `yaml:"gzip,omitempty" json:"gzip,omitempty" jsonschema:"description=Send the body gzip compressed with Content-Encoding: gzip; filler compresses about 1000:1 (a compression bomb)"`
+	DeclaredSize Size `yaml:"declared_size,omitempty" json:"declared_size,omitempty" jsonschema:"oneof_type=number;string,description=Content-Length to declare regardless of the bytes sent (default: the actual length\\, or chunked when gzip); sending stops at this size\\, or the connection closes short of it"`
+}
+
+// Generated returns the mock backend's form of a generated body, or nil if
+// g is nil
+func (g *GenerateSpec) Generated() *backend.Generated {
+	if g == nil {
+		return nil
+	}
+	return &backend.Generated{Size: int64(g.Size), Gzip: g.Gzip, DeclaredSize: int64(g.DeclaredSize)}
 }
 
 // ExpectationsSpec defines all test expectations (nested structure)
@@ -50,6 +212,61 @@ type ExpectationsSpec struct {
 	Backend  *BackendExpectations `yaml:"backend,omitempty" json:"backend,omitempty" jsonschema:"description=Expected backend interaction"`
 	Cache    *CacheExpectations   `yaml:"cache,omitempty" json:"cache,omitempty" jsonschema:"description=Expected cache behavior"`
 	Cookies  map[string]string    `yaml:"cookies,omitempty" json:"cookies,omitempty" jsonschema:"description=Expected cookies in jar (name: value)"`
+	Storage  string               `yaml:"storage,omitempty" json:"storage,omitempty" jsonschema:"enum=transient,enum=main,description=Storage the delivered object was allocated in: transient (Transient\\, e.g. passes\\, uncacheable or short-lived objects and beresp.storage = storage.Transient) or main (any other storage). Read from VSL Storage records"`
+
+	ESI        *ESIExpectations      `yaml:"esi,omitempty" json:"esi,omitempty" jsonschema:"description=Expected ESI processing: the composite body\\, the status of each included fragment and whether the parent object was cached. Read from the VSL of the ESI subrequests"`
+	Continue   *ContinueExpectations `yaml:"continue,omitempty" json:"continue,omitempty" jsonschema:"description=Expected 100-continue handling (requires request.expect_continue)"`
+	Eventually *EventuallySpec       `yaml:"eventually,omitempty" json:"eventually,omitempty" jsonschema:"description=Retry the request until the expectations pass or the timeout expires"`
+
+	Preset PresetNames `yaml:"preset,omitempty" json:"preset,omitempty" jsonschema:"description=Named expectation bundle(s) merged into these expectations (built in: static_asset_cached\\, api_not_cached\\, html_short_ttl; more from a presets document). The expectations' own values win"`
+}
+
+// ContinueExpectations checks how Varnish handled a request sent with
+// Expect: 100-continue
+type ContinueExpectations struct {
+	Received          *bool     `yaml:"received,omitempty" json:"received,omitempty" jsonschema:"description=Whether Varnish answered 100 Continue before the final response"`
+	Within            *Duration `yaml:"within,omitempty" json:"within,omitempty" jsonschema:"oneof_type=number;string,description=Maximum time from sending the request headers to receiving 100 Continue (e.g. '100ms'; a bare number is seconds)"`
+	ExpectForwarded   *bool     `yaml:"expect_forwarded,omitempty" json:"expect_forwarded,omitempty" jsonschema:"description=Whether the backend request carried the Expect header (Varnish normally handles it itself)"`
+	BodyAfterContinue *bool     `yaml:"body_after_continue,omitempty" json:"body_after_continue,omitempty" jsonschema:"description=Whether the backend received the body only after the client got 100 Continue"`
+}
+
+// ESIExpectations checks how a response was assembled from ESI includes,
+// e.g. what a page looks like when a fragment fails
+type ESIExpectations struct {
+	Body         *string        `yaml:"body,omitempty" json:"body,omitempty" jsonschema:"description=Exact composite body after ESI processing"`
+	Includes     *int           `yaml:"includes,omitempty" json:"includes,omitempty" jsonschema:"description=Number of ESI subrequests made for the response (nested includes count),minimum=0"`
+	Fragments    map[string]int `yaml:"fragments,omitempty" json:"fragments,omitempty" jsonschema:"description=Status each fragment was delivered with to the ESI parser\\, by URL (e.g. /fragments/price: 500)"`
+	ParentCached *bool          `yaml:"parent_cached,omitempty" json:"parent_cached,omitempty" jsonschema:"description=Whether the parent object is cached after the request: it was a hit\\, or its fetch stored a cacheable object"`
+}
+
+// Values of expectations.storage
+const (
+	StorageTransient = "transient" // Varnish's Transient storage
+	StorageMain      = "main"      // Any other storage (malloc, file, ...)
+)
+
+// DefaultEventuallyInterval is the retry interval when eventually.interval is not set
+const DefaultEventuallyInterval = 100 * time.Millisecond
+
+// EventuallySpec retries a request and its expectations for effects that
+// complete in the background (background fetches, probe transitions).
+// Timeout and interval are wall-clock time, not simulated scenario time.
+type EventuallySpec struct {
+	Timeout  Duration  `yaml:"timeout" json:"timeout" jsonschema:"required,oneof_type=number;string,description=How long to keep retrying (e.g. '2s' '500ms'; a bare number is seconds)"`
+	Interval *Duration `yaml:"interval,omitempty" json:"interval,omitempty" jsonschema:"oneof_type=number;string,description=Delay between attempts (default: 100ms)"`
+}
+
+// Durations returns the timeout and interval, with the default interval
+// when it is not set. A nil spec returns zero durations.
+func (e *EventuallySpec) Durations() (timeout, interval time.Duration) {
+	if e == nil {
+		return 0, 0
+	}
+	interval = DefaultEventuallyInterval
+	if e.Interval != nil {
+		interval = time.Duration(*e.Interval)
+	}
+	return time.Duration(e.Timeout), interval
 }
 
 // ResponseExpectations validates what the client receives from Varnish
@@ -57,6 +274,53 @@ type ResponseExpectations struct {
 	Status       int               `yaml:"status" json:"status" jsonschema:"required,description=Expected HTTP status code,minimum=100,maximum=599"`
 	Headers      map[string]string `yaml:"headers,omitempty" json:"headers,omitempty" jsonschema:"description=Expected HTTP response headers"`
 	BodyContains string            `yaml:"body_contains,omitempty" json:"body_contains,omitempty" jsonschema:"description=Substring that must appear in response body"`
+
+	// Redirect expectations (require request.follow_redirects)
+	FinalURL      string   `yaml:"final_url,omitempty" json:"final_url,omitempty" jsonschema:"description=Expected URL after following redirects (path\\, or absolute URL if a redirect changed host)"`
+	RedirectChain []string `yaml:"redirect_chain,omitempty" json:"redirect_chain,omitempty" jsonschema:"description=Expected redirect Locations in order\\, each resolved against the previous URL"`
+
+	// Comparisons with the responses of earlier scenario steps
+	HeaderEqualsPrevious  PreviousHeaderChecks `yaml:"header_equals_previous,omitempty" json:"header_equals_previous,omitempty" jsonschema:"description=Response headers that must equal those of an earlier scenario step (e.g. the same ETag served from cache)"`
+	HeaderDiffersPrevious PreviousHeaderChecks `yaml:"header_differs_previous,omitempty" json:"header_differs_previous,omitempty" jsonschema:"description=Response headers that must differ from those of an earlier scenario step (e.g. a new X-Request-ID per request)"`
+
+	// Body size and completeness, for generated and streamed bodies
+	BodySize     *Size `yaml:"body_size,omitempty" json:"body_size,omitempty" jsonschema:"oneof_type=number;string,description=Exact number of body bytes received after transfer and content decoding (e.g. '10MB' '128k' or 1048576)"`
+	BodyComplete *bool `yaml:"body_complete,omitempty" json:"body_complete,omitempty" jsonschema:"description=Whether the body arrived in full; set false to accept a body cut short (by default it fails the test)"`
+
+	// Preset: the response must not be cached by browsers or shared caches downstream
+	NoStoreForClient bool `yaml:"no_store_for_client,omitempty" json:"no_store_for_client,omitempty" jsonschema:"description=Response must not be cacheable downstream: Cache-Control has no-store or private\\, and no ETag or Last-Modified validators are sent"`
+}
+
+// PreviousHeaderSpec compares a response header with the response of an
+// earlier scenario step
+type PreviousHeaderSpec struct {
+	Header string `yaml:"header" json:"header" jsonschema:"required,description=Response header to compare"`
+	Step   int    `yaml:"step" json:"step" jsonschema:"required,description=Earlier scenario step to compare with (1-based),minimum=1"`
+}
+
+// PreviousHeaderChecks is a list of header comparisons that can be written in
+// YAML as a single mapping ({header: ETag, step: 1}) or a list of them
+type PreviousHeaderChecks []PreviousHeaderSpec
+
+// UnmarshalYAML accepts either a single mapping or a list of mappings
+func (p *PreviousHeaderChecks) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single PreviousHeaderSpec
+	if err := unmarshal(&single); err == nil {
+		*p = PreviousHeaderChecks{single}
+		return nil
+	}
+
+	var list []PreviousHeaderSpec
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*p = list
+	return nil
+}
+
+// JSONSchemaExtend lets the schema accept a single mapping as well as a list
+func (PreviousHeaderChecks) JSONSchemaExtend(s *jsonschema.Schema) {
+	singleOrList(s)
 }
 
 // BackendExpectations validates backend interaction
@@ -74,11 +338,55 @@ type BackendExpectations struct {
 
 	// Per-backend map format
 	PerBackend map[string]BackendCallExpectation `yaml:"backends,omitempty" json:"backends,omitempty" jsonschema:"description=Per-backend call count expectations"`
+
+	// Call counts in windows of simulated time (scenario steps only)
+	CallsBetween CallWindows `yaml:"calls_between,omitempty" json:"calls_between,omitempty" jsonschema:"description=Backend calls made in a window of simulated time since the scenario started (one window or a list); only available in scenario steps"`
+}
+
+// CallWindow expects a number of backend calls in a window of simulated
+// time, from (inclusive) to to (exclusive)
+type CallWindow struct {
+	From    Duration `yaml:"from" json:"from" jsonschema:"required,oneof_type=number;string,description=Start of the window as an offset from the scenario start (e.g. '0s' '30s'; a bare number is seconds)"`
+	To      Duration `yaml:"to" json:"to" jsonschema:"required,oneof_type=number;string,description=End of the window (exclusive); calls made after the step's check are not seen"`
+	Calls   *int     `yaml:"calls" json:"calls" jsonschema:"required,description=Expected number of backend calls in the window,minimum=0"`
+	Backend string   `yaml:"backend,omitempty" json:"backend,omitempty" jsonschema:"description=Count only calls to this backend (default: all backends)"`
+}
+
+// CallWindows is a list of call windows that can be written in YAML as a
+// single mapping or a list
+type CallWindows []CallWindow
+
+// UnmarshalYAML accepts either a single window or a list of windows
+func (c *CallWindows) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single CallWindow
+	err := unmarshal(&single)
+	if err == nil {
+		*c = CallWindows{single}
+		return nil
+	}
+	// A window with an invalid bound is not a list either
+	var literal *literalError
+	if errors.As(err, &literal) {
+		return err
+	}
+
+	var list []CallWindow
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*c = list
+	return nil
+}
+
+// JSONSchemaExtend lets the schema accept a single window as well as a list
+func (CallWindows) JSONSchemaExtend(s *jsonschema.Schema) {
+	singleOrList(s)
 }
 
 // BackendCallExpectation defines expected calls for a specific backend
 type BackendCallExpectation struct {
-	Calls int `yaml:"calls" json:"calls" jsonschema:"required,description=Expected number of calls to this backend"`
+	Calls  int               `yaml:"calls" json:"calls" jsonschema:"required,description=Expected number of calls to this backend"`
+	Params map[string]string `yaml:"params,omitempty" json:"params,omitempty" jsonschema:"description=Route parameters (from a routes pattern like /users/{id}) the last request to this backend must have captured"`
 }
 
 // UnmarshalYAML implements custom unmarshaling to support simple string format
@@ -98,9 +406,151 @@ func (b *BackendExpectations) UnmarshalYAML(unmarshal func(interface{}) error) e
 
 // CacheExpectations validates cache-specific behavior
 type CacheExpectations struct {
-	Hit   *bool `yaml:"hit,omitempty" json:"hit,omitempty" jsonschema:"description=Whether response should be a cache hit (true) or miss (false)"`
-	AgeGt *int  `yaml:"age_gt,omitempty" json:"age_gt,omitempty" jsonschema:"description=Age header must be greater than this value in seconds"`
-	AgeLt *int  `yaml:"age_lt,omitempty" json:"age_lt,omitempty" jsonschema:"description=Age header must be less than this value in seconds"`
+	Hit   *bool     `yaml:"hit,omitempty" json:"hit,omitempty" jsonschema:"description=Whether response should be a cache hit (true) or miss (false)"`
+	AgeGt *Duration `yaml:"age_gt,omitempty" json:"age_gt,omitempty" jsonschema:"oneof_type=number;string,description=Age header must be greater than this duration (e.g. 90s or 2m; a bare number is seconds)"`
+	AgeLt *Duration `yaml:"age_lt,omitempty" json:"age_lt,omitempty" jsonschema:"oneof_type=number;string,description=Age header must be less than this duration (e.g. 90s or 2m; a bare number is seconds)"`
+
+	// TTL the delivered object was stored with, from VSL TTL records
+	TTLGt *Duration `yaml:"ttl_gt,omitempty" json:"ttl_gt,omitempty" jsonschema:"oneof_type=number;string,description=The delivered object must have been stored with a TTL greater than this duration (e.g. 0 or 1h; a bare number is seconds; read from the VSL TTL records of the fetch that created it)"`
+	TTLLt *Duration `yaml:"ttl_lt,omitempty" json:"ttl_lt,omitempty" jsonschema:"oneof_type=number;string,description=The delivered object must have been stored with a TTL less than this duration (e.g. 10m; a bare number is seconds; read from the VSL TTL records of the fetch that created it)"`
+
+	// Preset: the TTL honours the backend's (an upstream cache's) Age and
+	// freshness headers, derived the way varnishd does
+	TTLRespectsAge bool   `yaml:"ttl_respects_age,omitempty" json:"ttl_respects_age,omitempty" jsonschema:"description=The delivered object must have been stored with the freshness lifetime of its backend response (s-maxage\\, then max-age\\, then Expires) minus the response's Age header\\, within a second (read from the VSL of the fetch that created it)"`
+	TTLSource      string `yaml:"ttl_source,omitempty" json:"ttl_source,omitempty" jsonschema:"description=Header the delivered object's TTL must come from by Varnish's precedence (s-maxage over max-age over Expires; default: none of them\\, default_ttl applies)\\, without VCL overriding it,enum=s-maxage,enum=max-age,enum=expires,enum=default"`
+
+	HitRatio *HitRatioSpec `yaml:"hit_ratio,omitempty" json:"hit_ratio,omitempty" jsonschema:"description=Request a set of URLs twice and check the cache hit ratio of the second pass"`
+
+	// Preset: exotic Accept-Encoding values must share the cached variants
+	AENormalization *AENormalizationSpec `yaml:"ae_normalization,omitempty" json:"ae_normalization,omitempty" jsonschema:"description=Request a URL with a matrix of Accept-Encoding values (twice) and check that the second pass is served from at most max_variants cached objects (true for the defaults)"`
+
+	// Preset: noise cookies must share one cached object, significant cookies get their own
+	CookieVariation *CookieVariationSpec `yaml:"cookie_variation,omitempty" json:"cookie_variation,omitempty" jsonschema:"description=Request a URL with a matrix of irrelevant and significant cookies (twice) and check that noise cookies share one cached object while each significant cookie gets its own variant"`
+}
+
+// TTL sources of cache.ttl_source, in Varnish's order of precedence
+const (
+	TTLSourceSMaxAge = "s-maxage"
+	TTLSourceMaxAge  = "max-age"
+	TTLSourceExpires = "expires"
+	TTLSourceDefault = "default" // No freshness header: default_ttl
+)
+
+// ChecksTTL reports whether c has expectations on the TTL records of the
+// fetch that created the delivered object
+func (c *CacheExpectations) ChecksTTL() bool {
+	return c != nil && (c.TTLGt != nil || c.TTLLt != nil || c.TTLRespectsAge || c.TTLSource != "")
+}
+
+// HitRatioSpec checks that a set of URLs is cacheable: each URL is requested
+// twice and the hit ratio of the second pass must be at least Min (and at
+// most Max, to check that URLs are not cached)
+type HitRatioSpec struct {
+	URLs []string `yaml:"urls,omitempty" json:"urls,omitempty" jsonschema:"description=URL paths to request (with the test request's headers; default: the test request's URL)"`
+	Min  float64  `yaml:"min,omitempty" json:"min,omitempty" jsonschema:"description=Minimum fraction of second-pass requests that must be cache hits,minimum=0,maximum=1"`
+	Max  *float64 `yaml:"max,omitempty" json:"max,omitempty" jsonschema:"description=Maximum fraction of second-pass requests that may be cache hits (0: nothing may be cached),minimum=0,maximum=1"`
+}
+
+// DefaultAEValues is the Accept-Encoding matrix of ae_normalization: what
+// browsers, CDNs and HTTP libraries send
+var DefaultAEValues = []string{
+	"gzip",
+	"gzip, deflate",
+	"gzip, deflate, br",
+	"br, gzip",
+	"gzip;q=1.0, identity;q=0.5, *;q=0",
+	"x-gzip, gzip",
+	"deflate, gzip",
+	"br",
+	"deflate",
+	"identity",
+	"gzip;q=0",
+}
+
+// AENormalizationSpec checks that Varnish collapses Accept-Encoding values
+// into its canonical gzip handling: the URL is requested once per value to
+// fill the cache, then again, and the second pass must be all hits served
+// from at most MaxVariants objects
+type AENormalizationSpec struct {
+	URL         string   `yaml:"url,omitempty" json:"url,omitempty" jsonschema:"description=URL path to request (default: the test request's URL\\, with its other headers)"`
+	Values      []string `yaml:"values,omitempty" json:"values,omitempty" jsonschema:"description=Accept-Encoding values to send (default: a matrix of common values)"`
+	MaxVariants int      `yaml:"max_variants,omitempty" json:"max_variants,omitempty" jsonschema:"description=Maximum number of cached objects serving the values (default: 1; 2 if the backend sends Vary: Accept-Encoding),minimum=1"`
+}
+
+// UnmarshalYAML accepts true for the defaults, or a mapping
+func (a *AENormalizationSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		if !enabled {
+			return fmt.Errorf("ae_normalization: false is not supported, remove the field instead")
+		}
+		*a = AENormalizationSpec{}
+		return nil
+	}
+
+	type rawAENormalizationSpec AENormalizationSpec
+	return unmarshal((*rawAENormalizationSpec)(a))
+}
+
+// JSONSchemaExtend lets the schema accept true as well as a mapping
+func (AENormalizationSpec) JSONSchemaExtend(s *jsonschema.Schema) {
+	mapping := *s
+	*s = jsonschema.Schema{OneOf: []*jsonschema.Schema{{Type: "boolean", Const: true}, &mapping}}
+}
+
+// DefaultNoiseCookies are the cookies cookie_variation sends when noise is
+// not set: analytics and tracking cookies a cookie-whitelisting VCL must strip
+var DefaultNoiseCookies = []string{
+	"_ga=GA1.2.1234567890.1700000000",
+	"_gid=GA1.2.987654321.1700000000",
+	"_fbp=fb.1.1700000000000.1234567890",
+	"__utma=111872281.1234567890.1700000000.1700000000.1700000000.1",
+	"_hjSessionUser_1234=eyJpZCI6IjEyMyJ9",
+	"utm_source=newsletter",
+}
+
+// CookieVariationSpec checks a cookie-whitelisting VCL: the URL is requested
+// without cookies, with each noise cookie and with each significant cookie,
+// in two passes. On the second pass all noise-only requests must be hits on
+// one object, and each significant cookie must be served apart from the noise
+// object and from the other significant cookies, with or without noise added.
+type CookieVariationSpec struct {
+	URL         string   `yaml:"url,omitempty" json:"url,omitempty" jsonschema:"description=URL path to request (default: the test request's URL\\, with its other headers)"`
+	Noise       []string `yaml:"noise,omitempty" json:"noise,omitempty" jsonschema:"description=Cookies (name=value) the VCL must ignore (default: common analytics and tracking cookies)"`
+	Significant []string `yaml:"significant" json:"significant" jsonschema:"required,description=Cookies (name=value) that must vary the cached object"`
+}
+
+// CookieVariationRow is one request of the cookie_variation matrix
+type CookieVariationRow struct {
+	// Cookie is the Cookie header sent, empty for none
+	Cookie string
+
+	// Significant is the significant cookie carried, empty for noise-only rows
+	Significant string
+}
+
+// Rows returns the request matrix: no cookies, each noise cookie, all noise
+// cookies together, then each significant cookie alone and with the noise
+func (c *CookieVariationSpec) Rows() []CookieVariationRow {
+	noise := c.Noise
+	if len(noise) == 0 {
+		noise = DefaultNoiseCookies
+	}
+	allNoise := strings.Join(noise, "; ")
+
+	rows := []CookieVariationRow{{}}
+	for _, cookie := range noise {
+		rows = append(rows, CookieVariationRow{Cookie: cookie})
+	}
+	if len(noise) > 1 {
+		rows = append(rows, CookieVariationRow{Cookie: allNoise})
+	}
+	for _, cookie := range c.Significant {
+		rows = append(rows,
+			CookieVariationRow{Cookie: cookie, Significant: cookie},
+			CookieVariationRow{Cookie: cookie + "; " + allNoise, Significant: cookie})
+	}
+	return rows
 }
 
 // ApplyDefaults sets default values for optional fields
@@ -127,6 +577,13 @@ func (t *TestSpec) ApplyDefaults() {
 		if t.Expectations.Response.Status == 0 {
 			t.Expectations.Response.Status = 200
 		}
+
+		// Pipeline steps
+		for i := range t.Pipeline {
+			if t.Pipeline[i].Request.Method == "" {
+				t.Pipeline[i].Request.Method = "GET"
+			}
+		}
 	} else {
 		// For scenario-based tests, apply defaults to each step
 		for i := range t.Scenario {
@@ -151,9 +608,39 @@ func (t *TestSpec) ApplyDefaults() {
 			}
 		}
 	}
+
+	if t.WarmupFrom != "" && t.WarmupConcurrency == 0 {
+		t.WarmupConcurrency = DefaultWarmupConcurrency
+	}
 }
 
 // IsScenario returns true if this is a scenario-based test
 func (t *TestSpec) IsScenario() bool {
 	return len(t.Scenario) > 0
 }
+
+// ResetsBackendCounts reports whether backend call counters are reset
+// before scenario step i (0-based): the step's reset_backend_counts, else
+// the test's, else true
+func (t *TestSpec) ResetsBackendCounts(i int) bool {
+	if reset := t.Scenario[i].ResetBackendCounts; reset != nil {
+		return *reset
+	}
+	if t.ResetBackendCounts != nil {
+		return *t.ResetBackendCounts
+	}
+	return true
+}
+
+// IsPipeline returns true if this is a pipelined-requests test
+func (t *TestSpec) IsPipeline() bool {
+	return len(t.Pipeline) > 0
+}
+
+// singleOrList turns the schema of a list into one that also accepts a
+// single item, for types whose UnmarshalYAML reads either form
+func singleOrList(s *jsonschema.Schema) {
+	s.OneOf = []*jsonschema.Schema{s.Items, {Type: "array", Items: s.Items}}
+	s.Type = ""
+	s.Items = nil
+}
@@ -1,8 +1,11 @@
 package testspec
 
 import (
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/invopop/jsonschema"
 	"gopkg.in/yaml.v3"
 )
 
@@ -160,3 +163,287 @@ cache:
 		t.Error("expected cache hit to be true")
 	}
 }
+
+func TestBackendNames_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{"single name", `backend_down: api`, []string{"api"}},
+		{"list", `backend_down: [api, auth]`, []string{"api", "auth"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var step struct {
+				BackendDown BackendNames `yaml:"backend_down"`
+			}
+			if err := yaml.Unmarshal([]byte(tt.yaml), &step); err != nil {
+				t.Fatalf("failed to unmarshal: %v", err)
+			}
+			if len(step.BackendDown) != len(tt.want) {
+				t.Fatalf("got %v, want %v", step.BackendDown, tt.want)
+			}
+			for i := range tt.want {
+				if step.BackendDown[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", step.BackendDown, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPreviousHeaderChecks_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want PreviousHeaderChecks
+	}{
+		{"single mapping", `header_equals_previous: {header: ETag, step: 1}`, PreviousHeaderChecks{{Header: "ETag", Step: 1}}},
+		{"list", `header_equals_previous: [{header: ETag, step: 1}, {header: Last-Modified, step: 2}]`,
+			PreviousHeaderChecks{{Header: "ETag", Step: 1}, {Header: "Last-Modified", Step: 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var exp ResponseExpectations
+			if err := yaml.Unmarshal([]byte(tt.yaml), &exp); err != nil {
+				t.Fatalf("failed to unmarshal: %v", err)
+			}
+			if len(exp.HeaderEqualsPrevious) != len(tt.want) {
+				t.Fatalf("got %v, want %v", exp.HeaderEqualsPrevious, tt.want)
+			}
+			for i := range tt.want {
+				if exp.HeaderEqualsPrevious[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", exp.HeaderEqualsPrevious, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestSingleOrListSchema checks that the schema of fields that UnmarshalYAML
+// reads as one item or a list accepts both
+func TestSingleOrListSchema(t *testing.T) {
+	reflector := jsonschema.Reflector{DoNotReference: true, ExpandedStruct: true}
+	tests := []struct {
+		field  string
+		schema *jsonschema.Schema
+	}{
+		{"header_equals_previous", reflector.Reflect(&ResponseExpectations{})},
+		{"header_differs_previous", reflector.Reflect(&ResponseExpectations{})},
+		{"calls_between", reflector.Reflect(&BackendExpectations{})},
+		{"preset", reflector.Reflect(&ExpectationsSpec{})},
+		{"backend_down", reflector.Reflect(&ScenarioStep{})},
+		{"backend_up", reflector.Reflect(&ScenarioStep{})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			property, ok := tt.schema.Properties.Get(tt.field)
+			if !ok {
+				t.Fatalf("no property %s", tt.field)
+			}
+			var types []string
+			for _, s := range property.OneOf {
+				types = append(types, s.Type)
+			}
+			if len(types) != 2 || types[1] != "array" || property.OneOf[0] != property.OneOf[1].Items {
+				t.Errorf("oneOf types = %v, want the item or a list of it", types)
+			}
+		})
+	}
+}
+
+func TestEventuallySpec_Durations(t *testing.T) {
+	quarter := Duration(250 * time.Millisecond)
+	tests := []struct {
+		name         string
+		spec         *EventuallySpec
+		wantTimeout  time.Duration
+		wantInterval time.Duration
+	}{
+		{"nil", nil, 0, 0},
+		{"default interval", &EventuallySpec{Timeout: Duration(2 * time.Second)}, 2 * time.Second, DefaultEventuallyInterval},
+		{"explicit interval", &EventuallySpec{Timeout: Duration(2 * time.Second), Interval: &quarter}, 2 * time.Second, 250 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout, interval := tt.spec.Durations()
+			if timeout != tt.wantTimeout || interval != tt.wantInterval {
+				t.Errorf("Durations() = %v, %v, want %v, %v", timeout, interval, tt.wantTimeout, tt.wantInterval)
+			}
+		})
+	}
+}
+
+func TestRate_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		want    Rate
+		wantErr bool
+	}{
+		{yaml: "bandwidth: 1MB/s", want: 1 << 20},
+		{yaml: "bandwidth: 64KB/s", want: 64 << 10},
+		{yaml: "bandwidth: 64k/s", want: 64 << 10},
+		{yaml: "bandwidth: 1.5 kb/s", want: 1536},
+		{yaml: "bandwidth: 100B/s", want: 100},
+		{yaml: "bandwidth: 2048/s", want: 2048},
+		{yaml: "bandwidth: 2048", want: 2048},
+		{yaml: "bandwidth: 1MB", wantErr: true},
+		{yaml: "bandwidth: 0KB/s", wantErr: true},
+		{yaml: "bandwidth: 0", wantErr: true},
+		{yaml: "bandwidth: fast/s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			var spec BackendSpec
+			err := yaml.Unmarshal([]byte(tt.yaml), &spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if spec.Bandwidth != tt.want {
+				t.Errorf("bandwidth = %d, want %d", spec.Bandwidth, tt.want)
+			}
+		})
+	}
+}
+
+func TestSize_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		yaml         string
+		wantSize     Size
+		wantDeclared Size
+		wantErr      bool
+	}{
+		{yaml: "size: 10MB", wantSize: 10 << 20},
+		{yaml: "{size: 1.5GB, declared_size: 2GB}", wantSize: 3 << 29, wantDeclared: 2 << 30},
+		{yaml: "{size: 4096, declared_size: 1kb}", wantSize: 4096, wantDeclared: 1024},
+		{yaml: "size: 128k", wantSize: 128 << 10},
+		{yaml: "size: 50 MiB", wantSize: 50 << 20},
+		{yaml: "size: 2g", wantSize: 2 << 30},
+		{yaml: "size: 512B", wantSize: 512},
+		{yaml: "size: huge", wantErr: true},
+		{yaml: "size: 10TB", wantErr: true},
+		{yaml: "size: [1]", wantErr: true},
+		{yaml: "{size: 1MB, declared_size: -1}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			var spec GenerateSpec
+			err := yaml.Unmarshal([]byte(tt.yaml), &spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if spec.Size != tt.wantSize || spec.DeclaredSize != tt.wantDeclared {
+				t.Errorf("size, declared_size = %d, %d, want %d, %d", spec.Size, spec.DeclaredSize, tt.wantSize, tt.wantDeclared)
+			}
+		})
+	}
+}
+
+func TestAENormalizationSpec_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    *AENormalizationSpec
+		wantErr bool
+	}{
+		{"defaults", `ae_normalization: true`, &AENormalizationSpec{}, false},
+		{"mapping", `ae_normalization: {url: /page, values: [gzip, br], max_variants: 2}`,
+			&AENormalizationSpec{URL: "/page", Values: []string{"gzip", "br"}, MaxVariants: 2}, false},
+		{"false", `ae_normalization: false`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cache CacheExpectations
+			err := yaml.Unmarshal([]byte(tt.yaml), &cache)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want != nil && !reflect.DeepEqual(cache.AENormalization, tt.want) {
+				t.Errorf("got %+v, want %+v", cache.AENormalization, tt.want)
+			}
+		})
+	}
+}
+
+func TestAENormalizationSpec_JSONSchema(t *testing.T) {
+	reflector := jsonschema.Reflector{DoNotReference: true, ExpandedStruct: true}
+	property, ok := reflector.Reflect(&CacheExpectations{}).Properties.Get("ae_normalization")
+	if !ok {
+		t.Fatal("no property ae_normalization")
+	}
+	if len(property.OneOf) != 2 || property.OneOf[0].Const != true || property.OneOf[1].Type != "object" {
+		t.Errorf("oneOf = %+v, want true or a mapping", property.OneOf)
+	}
+}
+
+func TestCookieVariationSpec_Rows(t *testing.T) {
+	spec := CookieVariationSpec{Noise: []string{"_ga=1", "_gid=2"}, Significant: []string{"lang=fr"}}
+	want := []CookieVariationRow{
+		{},
+		{Cookie: "_ga=1"},
+		{Cookie: "_gid=2"},
+		{Cookie: "_ga=1; _gid=2"},
+		{Cookie: "lang=fr", Significant: "lang=fr"},
+		{Cookie: "lang=fr; _ga=1; _gid=2", Significant: "lang=fr"},
+	}
+	if got := spec.Rows(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Rows() = %+v, want %+v", got, want)
+	}
+
+	defaults := (&CookieVariationSpec{Significant: []string{"lang=fr"}}).Rows()
+	if len(defaults) != len(DefaultNoiseCookies)+4 {
+		t.Errorf("Rows() with default noise = %d rows, want %d", len(defaults), len(DefaultNoiseCookies)+4)
+	}
+}
+
+func TestDuration_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{yaml: "age_gt: 90", want: 90 * time.Second},
+		{yaml: "age_gt: 1.5", want: 1500 * time.Millisecond},
+		{yaml: "age_gt: 90s", want: 90 * time.Second},
+		{yaml: "age_gt: 2m", want: 2 * time.Minute},
+		{yaml: "age_gt: 1h30m", want: 90 * time.Minute},
+		{yaml: "age_gt: 1h30m45s", want: time.Hour + 30*time.Minute + 45*time.Second},
+		{yaml: "age_gt: 500ms", want: 500 * time.Millisecond},
+		{yaml: "age_gt: 100us", want: 100 * time.Microsecond},
+		{yaml: "age_gt: -30s", want: -30 * time.Second},
+		{yaml: "age_gt: soon", wantErr: true},
+		{yaml: "age_gt: ''", wantErr: true},
+		{yaml: "age_gt: [1]", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			var exp CacheExpectations
+			err := yaml.Unmarshal([]byte(tt.yaml), &exp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if exp.AgeGt == nil || time.Duration(*exp.AgeGt) != tt.want {
+				t.Errorf("age_gt = %v, want %s", exp.AgeGt, tt.want)
+			}
+		})
+	}
+
+	if got := Duration(2 * time.Minute).String(); got != "120s" {
+		t.Errorf("String() = %q, want %q", got, "120s")
+	}
+}
@@ -0,0 +1,108 @@
+package testspec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DefaultWarmupConcurrency is the number of parallel warmup requests when
+// warmup_concurrency is not set
+const DefaultWarmupConcurrency = 8
+
+// LoadWarmup reads the requests of a warmup_from file: a sitemap (XML with
+// <loc> entries) or a URL list with one URL per line, optionally followed by
+// headers separated by '|':
+//
+//	/products/1
+//	/products/2 | Accept-Encoding: gzip | X-Device: mobile
+//
+// Blank lines and lines starting with '#' are skipped. Absolute URLs are
+// requested by path, with their host as the Host header.
+func LoadWarmup(path string) ([]RequestSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading warmup file: %w", err)
+	}
+	var requests []RequestSpec
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		requests, err = parseSitemap(data)
+	} else {
+		requests, err = parseURLList(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("warmup file %s: %w", path, err)
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("warmup file %s has no URLs", path)
+	}
+	return requests, nil
+}
+
+// parseURLList parses a URL list, one request per line
+func parseURLList(data []byte) ([]RequestSpec, error) {
+	var requests []RequestSpec
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		req, err := warmupRequest(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		for _, field := range fields[1:] {
+			name, value, ok := strings.Cut(field, ":")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("line %d: invalid header %q, expected 'Name: value'", lineNum, strings.TrimSpace(field))
+			}
+			if req.Headers == nil {
+				req.Headers = make(map[string]string)
+			}
+			req.Headers[name] = strings.TrimSpace(value)
+		}
+		requests = append(requests, req)
+	}
+	return requests, scanner.Err()
+}
+
+// parseSitemap parses the <loc> entries of a sitemap
+func parseSitemap(data []byte) ([]RequestSpec, error) {
+	var sitemap struct {
+		URLs []struct {
+			Loc string `xml:"loc"`
+		} `xml:"url"`
+	}
+	if err := xml.Unmarshal(data, &sitemap); err != nil {
+		return nil, fmt.Errorf("parsing sitemap: %w", err)
+	}
+	var requests []RequestSpec
+	for _, u := range sitemap.URLs {
+		req, err := warmupRequest(strings.TrimSpace(u.Loc))
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, nil
+}
+
+// warmupRequest creates a GET request for a path or absolute URL
+func warmupRequest(raw string) (RequestSpec, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Host == "" && !strings.HasPrefix(raw, "/")) {
+		return RequestSpec{}, fmt.Errorf("invalid URL %q, expected a path or absolute URL", raw)
+	}
+	req := RequestSpec{Method: "GET", URL: u.RequestURI()}
+	if u.Host != "" {
+		req.Headers = map[string]string{"Host": u.Host}
+	}
+	return req, nil
+}
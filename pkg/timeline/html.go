@@ -0,0 +1,37 @@
+package timeline
+
+import (
+	"html/template"
+	"io"
+)
+
+var htmlTemplate = template.Must(template.New("timeline").Funcs(template.FuncMap{
+	"at": FormatAt,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>vcltest timeline</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td { padding: 2px 12px; font-family: monospace; white-space: nowrap; }
+tr.clock td { background: #eee; font-weight: bold; }
+tr.client td:last-child { color: #1a5fb4; }
+tr.vcl td:last-child { color: #26a269; }
+tr.backend td:last-child { color: #c64600; }
+</style>
+</head>
+<body>
+{{range .}}<h2>{{.TestName}}</h2>
+<table>
+{{range .Events}}<tr class="{{.Kind}}"><td>{{at .At}}</td><td>{{.Txn}}</td><td>{{.Kind}}</td><td>{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// WriteHTML renders timelines as a standalone HTML page
+func WriteHTML(w io.Writer, timelines []*Timeline) error {
+	return htmlTemplate.Execute(w, timelines)
+}
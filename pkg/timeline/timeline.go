@@ -0,0 +1,211 @@
+// Package timeline orders what happened during a test on a single time axis:
+// client requests, VCL subroutine calls, backend fetches and simulated clock
+// advances.
+//
+// Events come from the VSL records logged during each scenario step. An
+// event's time is the step's offset on the simulated clock plus the elapsed
+// time since the step's first VSL timestamp, so fetches and background
+// fetches appear where they happened relative to the client request.
+package timeline
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/recorder"
+)
+
+// Kind classifies a timeline event
+type Kind string
+
+const (
+	KindClock   Kind = "clock"   // Simulated clock set for a step
+	KindClient  Kind = "client"  // Client request and response
+	KindVCL     Kind = "vcl"     // Subroutine call and its return action
+	KindBackend Kind = "backend" // Backend fetch, connection and response
+)
+
+// Event is one entry on the timeline
+type Event struct {
+	At   time.Duration `json:"at" jsonschema:"description=Offset on the simulated clock from test start in nanoseconds"` // Offset on the simulated clock from test start
+	Kind Kind          `json:"kind" jsonschema:"enum=clock,enum=client,enum=vcl,enum=backend"`
+	Txn  string        `json:"txn,omitempty"` // VSL transaction, e.g. "req 32769" (empty for clock events)
+	Text string        `json:"text"`
+}
+
+// Timeline is the ordered events of one test
+type Timeline struct {
+	TestName string  `json:"test_name"`
+	Events   []Event `json:"events"`
+}
+
+// Step is the VSL logged during one scenario step.
+// Single-request tests have one step at offset 0.
+type Step struct {
+	At       time.Duration
+	Messages []recorder.Message
+}
+
+// transaction tracks a VSL transaction while its records are read
+type transaction struct {
+	name      string  // e.g. "req 32769"
+	first     float64 // First Timestamp (0 until seen)
+	last      float64 // Latest Timestamp (0 until seen)
+	method    string
+	sawURL    bool
+	call      string // Pending VCL_call
+	response  int    // Index of the client response event, -1 if none
+	backendTx bool
+}
+
+// pending is an event with its absolute VSL time, before it is placed on the axis
+type pending struct {
+	txn   *transaction
+	abs   float64
+	event Event
+}
+
+// Build creates the timeline of a test from the VSL of its steps
+func Build(testName string, steps []Step) *Timeline {
+	tl := &Timeline{TestName: testName}
+	for i, step := range steps {
+		tl.Events = append(tl.Events, Event{At: step.At, Kind: KindClock, Text: fmt.Sprintf("step %d", i+1)})
+		tl.Events = append(tl.Events, stepEvents(step)...)
+	}
+	return tl
+}
+
+// stepEvents converts the VSL of one step into events ordered by time
+func stepEvents(step Step) []Event {
+	var events []pending
+	var cur *transaction
+	add := func(kind Kind, text string) {
+		events = append(events, pending{txn: cur, abs: cur.last, event: Event{Kind: kind, Txn: cur.name, Text: text}})
+	}
+
+	for _, msg := range step.Messages {
+		if msg.Type == recorder.MessageTypeBegin {
+			fields := strings.Fields(msg.Content)
+			if len(fields) < 2 {
+				cur = nil
+				continue
+			}
+			cur = &transaction{name: fields[0] + " " + fields[1], response: -1, backendTx: fields[0] == "bereq"}
+			reason := ""
+			if len(fields) > 2 {
+				reason = fields[2]
+			}
+			switch {
+			case cur.backendTx && reason == "bgfetch":
+				add(KindBackend, "background fetch")
+			case cur.backendTx:
+				add(KindBackend, "fetch")
+			case reason == "restart" || reason == "esi":
+				add(KindClient, reason)
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+
+		switch msg.Type {
+		case recorder.MessageTypeTimestamp:
+			if ts, ok := parseTimestamp(msg.Content); ok {
+				if cur.first == 0 {
+					cur.first = ts
+				}
+				cur.last = ts
+			}
+		case recorder.MessageTypeReqMethod:
+			if cur.method == "" {
+				cur.method = msg.Content
+			}
+		case recorder.MessageTypeReqURL:
+			// Later ReqURL records are VCL rewrites of the same request
+			if !cur.sawURL {
+				cur.sawURL = true
+				add(KindClient, strings.TrimSpace(cur.method+" "+msg.Content))
+			}
+		case recorder.MessageTypeVCLCall:
+			cur.call = msg.Content
+		case recorder.MessageTypeVCLReturn:
+			if cur.call != "" {
+				add(KindVCL, fmt.Sprintf("vcl_%s → %s", strings.ToLower(cur.call), msg.Content))
+				cur.call = ""
+			}
+		case recorder.MessageTypeBackendOpen:
+			if call, ok := recorder.ParseBackendCall(msg); ok {
+				add(KindBackend, "connect to "+call.BackendName)
+			}
+		case recorder.MessageTypeBerespStatus:
+			add(KindBackend, "backend responded "+msg.Content)
+		case recorder.MessageTypeRespStatus:
+			// vcl_deliver and vcl_synth may change the status; keep the last
+			if cur.response >= 0 {
+				events[cur.response].abs = cur.last
+				events[cur.response].event.Text = "response " + msg.Content
+			} else {
+				cur.response = len(events)
+				add(KindClient, "response "+msg.Content)
+			}
+		}
+	}
+
+	// Records before a transaction's first Timestamp happened at its start
+	base := 0.0
+	for i := range events {
+		if events[i].abs == 0 {
+			events[i].abs = events[i].txn.first
+		}
+		if events[i].abs != 0 && (base == 0 || events[i].abs < base) {
+			base = events[i].abs
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].abs < events[j].abs })
+
+	out := make([]Event, len(events))
+	for i, p := range events {
+		out[i] = p.event
+		out[i].At = step.At
+		if p.abs > base {
+			out[i].At += time.Duration((p.abs - base) * float64(time.Second))
+		}
+	}
+	return out
+}
+
+// parseTimestamp returns the absolute time of a Timestamp record,
+// e.g. "Start: 1700000000.123456 0.000000 0.000000"
+func parseTimestamp(content string) (float64, bool) {
+	fields := strings.Fields(content)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ts, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return ts, true
+}
+
+// FormatAt formats an event time, e.g. "T+3600.012s"
+func FormatAt(at time.Duration) string {
+	return "T+" + strconv.FormatFloat(at.Seconds(), 'f', 3, 64) + "s"
+}
+
+// Text renders the timeline as aligned plain text
+func (t *Timeline) Text() string {
+	var b strings.Builder
+	for _, e := range t.Events {
+		if e.Kind == KindClock {
+			fmt.Fprintf(&b, "  %-14s ── %s ──\n", FormatAt(e.At), e.Text)
+			continue
+		}
+		fmt.Fprintf(&b, "  %-14s %-14s %-8s %s\n", FormatAt(e.At), e.Txn, e.Kind, e.Text)
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package timeline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/vcltest/pkg/recorder"
+)
+
+// A miss with its backend fetch, as logged by varnishlog -g request
+const missLog = `*   << Request  >> 32769
+-   Begin          req 32768 rxreq
+-   Timestamp      Start: 1700000000.000000 0.000000 0.000000
+-   ReqMethod      GET
+-   ReqURL         /page
+-   VCL_call       RECV
+-   ReqURL         /rewritten
+-   VCL_return     hash
+-   VCL_call       MISS
+-   VCL_return     fetch
+-   Timestamp      Fetch: 1700000000.250000 0.250000 0.250000
+-   RespStatus     200
+-   VCL_call       DELIVER
+-   RespStatus     203
+-   VCL_return     deliver
+-   Timestamp      Resp: 1700000000.251000 0.251000 0.001000
+**  << BeReq    >> 32770
+--  Begin          bereq 32769 fetch
+--  Timestamp      Start: 1700000000.001000 0.000000 0.000000
+--  VCL_call       BACKEND_FETCH
+--  VCL_return     fetch
+--  BackendOpen    22 default 127.0.0.1 8080 127.0.0.1 56783 connect
+--  Timestamp      Beresp: 1700000000.200000 0.199000 0.199000
+--  BerespStatus   200
+--  VCL_call       BACKEND_RESPONSE
+--  VCL_return     deliver
+`
+
+func TestBuild(t *testing.T) {
+	messages := recorder.ParseLog(missLog)
+	tl := Build("miss", []Step{{At: time.Hour, Messages: messages}})
+
+	want := []Event{
+		{At: time.Hour, Kind: KindClock, Text: "step 1"},
+		{At: time.Hour, Kind: KindClient, Txn: "req 32768", Text: "GET /page"},
+		{At: time.Hour, Kind: KindVCL, Txn: "req 32768", Text: "vcl_recv → hash"},
+		{At: time.Hour, Kind: KindVCL, Txn: "req 32768", Text: "vcl_miss → fetch"},
+		{At: time.Hour + time.Millisecond, Kind: KindBackend, Txn: "bereq 32769", Text: "fetch"},
+		{At: time.Hour + time.Millisecond, Kind: KindVCL, Txn: "bereq 32769", Text: "vcl_backend_fetch → fetch"},
+		{At: time.Hour + time.Millisecond, Kind: KindBackend, Txn: "bereq 32769", Text: "connect to default"},
+		{At: time.Hour + 200*time.Millisecond, Kind: KindBackend, Txn: "bereq 32769", Text: "backend responded 200"},
+		{At: time.Hour + 200*time.Millisecond, Kind: KindVCL, Txn: "bereq 32769", Text: "vcl_backend_response → deliver"},
+		{At: time.Hour + 250*time.Millisecond, Kind: KindClient, Txn: "req 32768", Text: "response 203"},
+		{At: time.Hour + 250*time.Millisecond, Kind: KindVCL, Txn: "req 32768", Text: "vcl_deliver → deliver"},
+	}
+	if len(tl.Events) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%s", len(tl.Events), len(want), tl.Text())
+	}
+	for i, e := range tl.Events {
+		// VSL timestamps are microseconds; compare at millisecond precision
+		e.At = e.At.Round(time.Millisecond)
+		if e != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	tl := Build("miss", []Step{{Messages: recorder.ParseLog(missLog)}, {At: 10 * time.Second}})
+	text := tl.Text()
+	for _, want := range []string{
+		"T+0.000s       ── step 1 ──",
+		"T+0.000s       req 32768      client   GET /page",
+		"T+0.200s       bereq 32769    backend  backend responded 200",
+		"T+10.000s      ── step 2 ──",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Text() missing %q:\n%s", want, text)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteHTML(&buf, []*Timeline{tl}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<tr class="vcl"><td>T&#43;0.000s</td><td>req 32768</td><td>vcl</td><td>vcl_recv → hash</td></tr>`) {
+		t.Errorf("WriteHTML() missing event row:\n%s", buf.String())
+	}
+}
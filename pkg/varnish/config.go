@@ -18,7 +18,10 @@ func BuildArgs(cfg *Config) []string {
 	}
 
 	// Basic arguments
-	secretPath := filepath.Join(cfg.WorkDir, "secret")
+	secretPath := cfg.SecretFile
+	if secretPath == "" {
+		secretPath = filepath.Join(cfg.WorkDir, "secret")
+	}
 	args = append(args, "-S", secretPath) // Enable auth on the CLI with secret file
 	args = append(args, "-M", fmt.Sprintf("localhost:%d", cfg.Varnish.AdminPort))
 	args = append(args, "-n", cfg.VarnishDir)
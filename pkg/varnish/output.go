@@ -0,0 +1,78 @@
+package varnish
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files in the work dir that capture varnishd's stdout and stderr, so its
+// output survives for startup failure reports and debug dumps
+const (
+	StdoutFile = "varnishd.stdout.log"
+	StderrFile = "varnishd.stderr.log"
+)
+
+// OutputFiles returns the paths of the varnishd output files in workDir
+func OutputFiles(workDir string) []string {
+	return []string{filepath.Join(workDir, StdoutFile), filepath.Join(workDir, StderrFile)}
+}
+
+// createOutputFiles creates (truncating) the varnishd output files
+func (m *Manager) createOutputFiles() (stdout, stderr *os.File, err error) {
+	paths := OutputFiles(m.workDir)
+	stdout, err = os.Create(paths[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating varnishd stdout file: %w", err)
+	}
+	stderr, err = os.Create(paths[1])
+	if err != nil {
+		stdout.Close()
+		return nil, nil, fmt.Errorf("creating varnishd stderr file: %w", err)
+	}
+	return stdout, stderr, nil
+}
+
+// OutputTail returns the last lines of varnishd's stderr and stdout in
+// workDir, each under a heading, or "" if varnishd printed nothing
+func OutputTail(workDir string, lines int) string {
+	var b strings.Builder
+	paths := OutputFiles(workDir)
+	for _, path := range []string{paths[1], paths[0]} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		text := strings.TrimRight(string(data), "\n")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		all := strings.Split(text, "\n")
+		tail := all[max(0, len(all)-lines):]
+		fmt.Fprintf(&b, "%s (last %d of %d lines):\n", filepath.Base(path), len(tail), len(all))
+		for _, line := range tail {
+			fmt.Fprintf(&b, "  %s\n", line)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// LastChildEvent returns the last line varnishd printed about its child
+// process (e.g. "Child (1234) Started" or "Child (1234) died signal=6"), or
+// "" if it printed none
+func LastChildEvent(workDir string) string {
+	var last string
+	for _, path := range OutputFiles(workDir) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.Contains(line, "Child (") {
+				last = strings.TrimSpace(line)
+			}
+		}
+	}
+	return last
+}
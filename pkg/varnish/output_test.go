@@ -0,0 +1,46 @@
+package varnish
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputTail(t *testing.T) {
+	dir := t.TempDir()
+	if got := OutputTail(dir, 3); got != "" {
+		t.Errorf("OutputTail() without files = %q, want empty", got)
+	}
+
+	var lines []string
+	for i := 1; i <= 5; i++ {
+		lines = append(lines, "Error: line "+string(rune('0'+i)))
+	}
+	if err := os.WriteFile(filepath.Join(dir, StderrFile), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, StdoutFile), []byte("\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "varnishd.stderr.log (last 3 of 5 lines):\n  Error: line 3\n  Error: line 4\n  Error: line 5"
+	if got := OutputTail(dir, 3); got != want {
+		t.Errorf("OutputTail() = %q, want %q", got, want)
+	}
+}
+
+func TestLastChildEvent(t *testing.T) {
+	dir := t.TempDir()
+	if got := LastChildEvent(dir); got != "" {
+		t.Errorf("LastChildEvent() without files = %q, want empty", got)
+	}
+
+	stdout := "Debug: Version: varnish-7.7.3\nChild launched OK\nInfo: Child (4242) Started\nInfo: Child (4242) said Child starts\n"
+	if err := os.WriteFile(filepath.Join(dir, StdoutFile), []byte(stdout), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := LastChildEvent(dir), "Info: Child (4242) said Child starts"; got != want {
+		t.Errorf("LastChildEvent() = %q, want %q", got, want)
+	}
+}
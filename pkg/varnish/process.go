@@ -3,11 +3,13 @@ package varnish
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -20,6 +22,11 @@ type Manager struct {
 	logger          *slog.Logger
 	timeControlFile string    // Path to faketime control file
 	testStartTime   time.Time // Test start time (t0) - all offsets are relative to this
+
+	procMu  sync.Mutex
+	pid     int   // varnishd's pid once started
+	exited  bool  // varnishd has exited
+	exitErr error // varnishd's exit status
 }
 
 // New creates a new Varnish manager
@@ -157,17 +164,30 @@ func (m *Manager) Start(ctx context.Context, varnishCmd string, args []string, t
 		}
 	}
 
-	// Route varnishd output through our structured logging
-	cmd.Stdout = newLogWriter(m.logger, "varnishd")
-	cmd.Stderr = newLogWriter(m.logger, "varnishd")
+	// Route varnishd output through our structured logging, and keep it in
+	// the work dir for failure reports
+	stdout, stderr, err := m.createOutputFiles()
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+	cmd.Stdout = io.MultiWriter(stdout, newLogWriter(m.logger, "varnishd"))
+	cmd.Stderr = io.MultiWriter(stderr, newLogWriter(m.logger, "varnishd"))
 
 	// Start Varnish
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("cmd.Start: %w", err)
 	}
+	m.procMu.Lock()
+	m.pid, m.exited, m.exitErr = cmd.Process.Pid, false, nil
+	m.procMu.Unlock()
 
 	// Wait for Varnish to exit
-	err := cmd.Wait()
+	err = cmd.Wait()
+	m.procMu.Lock()
+	m.exited, m.exitErr = true, err
+	m.procMu.Unlock()
 	duration := time.Since(start)
 	if err != nil {
 		m.logger.Debug("Varnish process failed", "duration_ms", duration.Milliseconds())
@@ -179,6 +199,23 @@ func (m *Manager) Start(ctx context.Context, varnishCmd string, args []string, t
 	return nil
 }
 
+// ProcessState describes the varnishd process: not started, running or
+// exited, with its pid and exit status
+func (m *Manager) ProcessState() string {
+	m.procMu.Lock()
+	defer m.procMu.Unlock()
+	switch {
+	case m.pid == 0:
+		return "not started"
+	case !m.exited:
+		return fmt.Sprintf("running (pid %d)", m.pid)
+	case m.exitErr != nil:
+		return fmt.Sprintf("exited (pid %d): %v", m.pid, m.exitErr)
+	default:
+		return fmt.Sprintf("exited (pid %d)", m.pid)
+	}
+}
+
 // setupFaketime configures the command environment for libfaketime
 func (m *Manager) setupFaketime(cmd *exec.Cmd, timeConfig *TimeConfig) error {
 	// Detect library path
@@ -123,6 +123,32 @@ func TestBuildArgs(t *testing.T) {
 	}
 }
 
+func TestBuildArgsSecretFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		secretFile string
+		want       string
+	}{
+		{"default in work dir", "", "/tmp/work/secret"},
+		{"external secret file", "/etc/varnish/secret", "/etc/varnish/secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := BuildArgs(&Config{WorkDir: "/tmp/work", VarnishDir: "/tmp/work/varnish", SecretFile: tt.secretFile})
+			for i, arg := range args {
+				if arg == "-S" && i+1 < len(args) {
+					if args[i+1] != tt.want {
+						t.Errorf("-S %s, want %s", args[i+1], tt.want)
+					}
+					return
+				}
+			}
+			t.Errorf("-S not found in args: %v", args)
+		})
+	}
+}
+
 // TestBuildArgsWithLicense is removed because it requires a valid cryptographically signed
 // license, which is complex to create for testing. The license flag functionality is simple:
 // when cfg.License.Text is non-empty, BuildArgs adds "-L /path/to/license.lic" to args.
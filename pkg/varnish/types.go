@@ -6,6 +6,7 @@ type Config struct {
 	VarnishDir  string
 	StorageArgs []string
 	VCLPath     string // Optional: VCL file to load on startup (for -f flag)
+	SecretFile  string // Optional: -S secret file (default: <WorkDir>/secret, written by PrepareWorkspace)
 
 	License LicenseConfig
 	Varnish VarnishConfig
@@ -124,7 +124,7 @@ func (v *Server) ParamShow(name string) (VarnishResponse, error) {
 
 // ParamSet sets the value of a parameter
 func (v *Server) ParamSet(name, value string) (VarnishResponse, error) {
-	cmd := fmt.Sprintf("param.set %s %s", name, value)
+	cmd := fmt.Sprintf("param.set %s %s", name, QuoteArg(value))
 	resp, err := v.Exec(cmd)
 	if err != nil {
 		return resp, err
@@ -135,6 +135,24 @@ func (v *Server) ParamSet(name, value string) (VarnishResponse, error) {
 	return resp, nil
 }
 
+// ParamShower is a minimal interface for types that can show parameters
+type ParamShower interface {
+	ParamShow(name string) (VarnishResponse, error)
+}
+
+// ParamGet returns the current value of a parameter in a form that param.set
+// accepts, e.g. "10.000" for default_grace or "8k" for a size parameter.
+func ParamGet(v ParamShower, name string) (string, error) {
+	resp, err := v.ParamShow(name)
+	if err != nil {
+		return "", err
+	}
+	if resp.statusCode != ClisOk {
+		return "", fmt.Errorf("param.show %s failed with status %d: %s", name, resp.statusCode, resp.payload)
+	}
+	return parseParamValue(resp.payload)
+}
+
 // ParamValue defines acceptable parameter value types
 type ParamValue interface {
 	int | bool | float64 | string | time.Duration | Size
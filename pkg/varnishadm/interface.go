@@ -16,6 +16,9 @@ type VarnishadmInterface interface {
 	Run(ctx context.Context) error
 	// Exec executes a command and returns the response
 	Exec(cmd string) (VarnishResponse, error)
+	// Batch executes commands back to back, with no other caller's command
+	// in between, and returns their responses in order
+	Batch(cmds ...string) ([]VarnishResponse, error)
 
 	// Standard commands
 	Ping() (VarnishResponse, error)
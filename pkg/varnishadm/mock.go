@@ -135,7 +135,27 @@ func (m *MockVarnishadm) Run(ctx context.Context) error {
 func (m *MockVarnishadm) Exec(cmd string) (VarnishResponse, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return m.exec(cmd)
+}
+
+// Batch executes commands in order under one lock, so no other command is
+// recorded between them
+func (m *MockVarnishadm) Batch(cmds ...string) ([]VarnishResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	responses := make([]VarnishResponse, 0, len(cmds))
+	for _, cmd := range cmds {
+		resp, err := m.exec(cmd)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, resp)
+	}
+	return responses, nil
+}
 
+// exec returns the mock response to a command; m.mu must be held
+func (m *MockVarnishadm) exec(cmd string) (VarnishResponse, error) {
 	// Add to call history
 	m.callHistory = append(m.callHistory, cmd)
 
@@ -348,7 +368,7 @@ func (m *MockVarnishadm) ParamShow(name string) (VarnishResponse, error) {
 
 // ParamSet sets the value of a parameter in the mock
 func (m *MockVarnishadm) ParamSet(name, value string) (VarnishResponse, error) {
-	cmd := fmt.Sprintf("param.set %s %s", name, value)
+	cmd := fmt.Sprintf("param.set %s %s", name, QuoteArg(value))
 	resp, err := m.Exec(cmd)
 	if err != nil {
 		return resp, err
@@ -277,3 +277,40 @@ func parseVCLShow(payload string) (*VCLShowResult, error) {
 
 	return result, nil
 }
+
+// parseParamValue extracts the value from param.show output
+// Expected format:
+// default_grace
+//
+//	Value is: 10.000 [seconds] (default)
+//	Minimum is: 0.000
+func parseParamValue(payload string) (string, error) {
+	for _, line := range strings.Split(payload, "\n") {
+		value, ok := strings.CutPrefix(strings.TrimSpace(line), "Value is:")
+		if !ok {
+			continue
+		}
+		// Drop the trailing "(default)" and unit annotations; the value
+		// itself may contain spaces (e.g. cc_command)
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "(default)"))
+		if i := strings.LastIndex(value, " ["); i >= 0 && strings.HasSuffix(value, "]") {
+			value = strings.TrimSpace(value[:i])
+		}
+		if value == "" {
+			break
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("no value found in param.show output")
+}
+
+// QuoteArg quotes a CLI argument that contains whitespace, quotes or
+// backslashes (or is empty) the way the varnish CLI parses it, so it
+// arrives as one argument; other arguments are returned as is.
+func QuoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"\\") {
+		return arg
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + r.Replace(arg) + `"`
+}
@@ -470,3 +470,75 @@ func TestParseVCLShow(t *testing.T) {
 		})
 	}
 }
+
+func TestParseParamValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "duration with default annotation",
+			payload: `default_grace
+        Value is: 10.000 [seconds] (default)
+        Minimum is: 0.000
+
+        Default grace period.`,
+			want: "10.000",
+		},
+		{
+			name: "size parameter",
+			payload: `workspace_client
+        Value is: 64k [bytes] (default)
+        Minimum is: 9k`,
+			want: "64k",
+		},
+		{
+			name:    "boolean without unit",
+			payload: "http_gzip_support\n        Value is: on (default)",
+			want:    "on",
+		},
+		{
+			name:    "value with spaces",
+			payload: "cc_command\n        Value is: exec $CC $CFLAGS %w -o %o %s (default)",
+			want:    "exec $CC $CFLAGS %w -o %o %s",
+		},
+		{
+			name:    "unit without default annotation",
+			payload: "thread_pool_watchdog\n        Value is: 60.000 [seconds]",
+			want:    "60.000",
+		},
+		{
+			name:    "no value line",
+			payload: "Unknown parameter",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseParamValue(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseParamValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseParamValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	tests := []struct{ arg, want string }{
+		{"10.000", "10.000"},
+		{"", `""`},
+		{"exec $CC -o %o %s", `"exec $CC -o %o %s"`},
+		{`say "hi"\n`, `"say \"hi\"\\n"`},
+	}
+	for _, tt := range tests {
+		if got := QuoteArg(tt.arg); got != tt.want {
+			t.Errorf("QuoteArg(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
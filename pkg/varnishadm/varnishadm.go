@@ -12,8 +12,11 @@ import (
 	"log/slog"
 	"net"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/borud/broker"
@@ -27,14 +30,38 @@ type Server struct {
 	logger         *slog.Logger
 	broker         *broker.Broker
 	reqCh          chan varnishRequest
-	listener       net.Listener // Listener for accepting connections (set by Listen())
-	banner         string       // Stores the Varnish CLI banner received on connection
-	bannerReceived bool         // Tracks if banner has been read for this connection
-	environment    string       // Stores the environment line (e.g., "Darwin,24.6.0,arm64,-jnone,-smse4,-sdefault,-hcritbit")
-	version        string       // Stores the Varnish version (e.g., "varnish-7.7.3")
-	transcript     io.Writer    // Optional writer for recording CLI traffic (for debugging)
+	listener       net.Listener    // Listener for accepting connections (set by Listen())
+	infoMu         sync.RWMutex    // Guards banner, environment and version, read by other goroutines
+	banner         string          // Stores the Varnish CLI banner received on connection
+	bannerReceived bool            // Tracks if banner has been read for this connection
+	environment    string          // Stores the environment line (e.g., "Darwin,24.6.0,arm64,-jnone,-smse4,-sdefault,-hcritbit")
+	version        string          // Stores the Varnish version (e.g., "varnish-7.7.3")
+	transcript     io.Writer       // Optional writer for recording CLI traffic (for debugging)
+	cmdTimeout     time.Duration   // Overall command timeout
+	ioTimeout      time.Duration   // Individual socket I/O operations
+	reconnect      ReconnectPolicy // Handling of failed varnishd connections
+	connected      atomic.Bool     // An authenticated varnishd connection is open
+	recentMu       sync.Mutex
+	recent         []string // Last CLI exchanges, for startup diagnostics
 }
 
+// ReconnectPolicy controls how the server handles varnishd connections that
+// fail authentication or drop before any command could run. varnishd keeps
+// redialing the -M address; the server waits a doubling backoff between
+// failed connections. Zero values use the defaults.
+type ReconnectPolicy struct {
+	// MaxAttempts is the number of consecutive failed connections after which
+	// Run gives up and returns the last error (default: 0, never give up)
+	MaxAttempts int
+	// InitialBackoff is the delay after the first failed connection (default: 100ms)
+	InitialBackoff time.Duration
+	// MaxBackoff caps the doubling delay (default: 5s)
+	MaxBackoff time.Duration
+}
+
+// ErrAuthRejected is returned (wrapped) when varnishd rejects the CLI secret
+var ErrAuthRejected = errors.New("varnishd rejected the CLI secret")
+
 // VarnishResponse is a type the maps the response
 // after issuing a command against VarnishAdm.
 type VarnishResponse struct {
@@ -60,9 +87,19 @@ func (vr VarnishResponse) Payload() string {
 	return vr.payload
 }
 
+// varnishRequest is a batch of commands for the connection to run back to
+// back. Requests are queued on reqCh and served one at a time, so commands
+// from concurrent callers never interleave on the connection.
 type varnishRequest struct {
-	command      string
-	responseChan chan VarnishResponse
+	commands     []string
+	responseChan chan batchResult // Buffered, so a caller that gave up never blocks the connection
+}
+
+// batchResult is the answer to a varnishRequest: a response per command, or
+// the connection error that ended the batch
+type batchResult struct {
+	responses []VarnishResponse
+	err       error
 }
 
 // Timeout constants for different operations
@@ -71,16 +108,56 @@ const (
 	readWriteTimeout  = 10 * time.Second // Individual socket I/O operations
 	authTimeout       = 5 * time.Second  // Authentication operations
 	publishTimeout    = 1 * time.Second  // Event publishing timeout
+
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+
+	recentExchanges = 8 // CLI exchanges kept for RecentExchanges
 )
 
 func New(port uint16, secret string, logger *slog.Logger, broker *broker.Broker) *Server {
 	return &Server{
-		Port:   port,
-		Secret: secret,
-		logger: logger,
-		broker: broker,
-		reqCh:  make(chan varnishRequest, 1),
+		Port:       port,
+		Secret:     secret,
+		logger:     logger,
+		broker:     broker,
+		reqCh:      make(chan varnishRequest, 1),
+		cmdTimeout: defaultCmdTimeout,
+		ioTimeout:  readWriteTimeout,
+	}
+}
+
+// SetCommandTimeout sets how long a command may take, including reading the
+// response (default: 30s overall, 10s per socket operation). Raise it for
+// slow VCL compiles. Call this before Run().
+func (v *Server) SetCommandTimeout(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	v.cmdTimeout = d
+	v.ioTimeout = d
+}
+
+// SetReconnectPolicy sets how failed varnishd connections are handled.
+// Call this before Run().
+func (v *Server) SetReconnectPolicy(p ReconnectPolicy) {
+	v.reconnect = p
+}
+
+// backoff returns the delay before accepting a connection after the given
+// number of consecutive failures
+func (p ReconnectPolicy) backoff(failures int) time.Duration {
+	delay, limit := p.InitialBackoff, p.MaxBackoff
+	if delay <= 0 {
+		delay = defaultInitialBackoff
+	}
+	if limit <= 0 {
+		limit = defaultMaxBackoff
+	}
+	for i := 1; i < failures && delay < limit; i++ {
+		delay *= 2
 	}
+	return min(delay, limit)
 }
 
 // Listen creates a TCP listener on the configured port (or a random port if Port is 0).
@@ -125,6 +202,7 @@ func (v *Server) Run(ctx context.Context) error {
 	}()
 	defer v.listener.Close()
 
+	failures := 0 // Consecutive connections that failed before authenticating
 	for {
 		conn, err := v.listener.Accept()
 		if err != nil {
@@ -143,10 +221,29 @@ func (v *Server) Run(ctx context.Context) error {
 		}
 		v.logger.Debug("VarnishAdm connection established from varnishd", "remote_addr", remoteAddr)
 
-		if err := v.handleConnection(ctx, conn); err != nil {
-			v.logger.Error("Error handling connection", "error", err)
+		err = v.handleConnection(ctx, conn)
+		if err == nil {
+			continue
+		}
+		v.logger.Error("Error handling connection", "error", err)
+
+		// A connection that authenticated was working; varnishd may redial at once
+		if v.bannerReceived {
+			failures = 0
+			continue
+		}
+		failures++
+		if v.reconnect.MaxAttempts > 0 && failures >= v.reconnect.MaxAttempts {
+			return fmt.Errorf("giving up after %d failed varnishd connections: %w", failures, err)
 		}
 
+		delay := v.reconnect.backoff(failures)
+		v.logger.Debug("Waiting before accepting next varnishd connection", "failures", failures, "backoff", delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
 	}
 }
 
@@ -157,12 +254,19 @@ func (v *Server) handleConnection(ctx context.Context, conn net.Conn) error {
 		return fmt.Errorf("conn is not a *net.TCPConn, it's a %T", conn)
 	}
 	defer tcpConn.Close()
+	defer v.connected.Store(false)
 
 	v.bannerReceived = false // Reset banner state for new connection
+	v.infoMu.Lock()
 	v.banner = ""
+	v.infoMu.Unlock()
+
+	// One reader for the connection, so pipelined responses are not lost
+	// between reads
+	reader := bufio.NewReader(tcpConn)
 
 	// Read the initial banner that Varnish sends on connection (includes authentication)
-	if err := v.readBanner(tcpConn); err != nil {
+	if err := v.readBanner(tcpConn, reader); err != nil {
 		v.logger.Error("Failed to read Varnish banner or authenticate", "error", err, "local_addr", tcpConn.LocalAddr(), "remote_addr", tcpConn.RemoteAddr())
 		return fmt.Errorf("banner/authentication failed: %w", err)
 	}
@@ -172,30 +276,36 @@ func (v *Server) handleConnection(ctx context.Context, conn net.Conn) error {
 		case <-ctx.Done():
 			return nil
 		case req := <-v.reqCh:
-			resp, err := v.run(tcpConn, req.command)
+			responses, err := v.runBatch(tcpConn, reader, req.commands)
+			req.responseChan <- batchResult{responses: responses, err: err}
 			if err != nil {
 				return fmt.Errorf("readFromConnection: %w", err)
 			}
-			if resp.statusCode != ClisOk {
-				// Don't warn for expected "already exists" or "already running" conditions
-				if resp.statusCode != 106 && resp.statusCode != 300 {
-					v.logger.Warn("command failed", "command", req.command, "status", resp.statusCode, "payload", truncatePayload(resp.payload, 200))
-				} else {
-					v.logger.Debug("command returned non-fatal status", "command", req.command, "status", resp.statusCode, "payload", truncatePayload(resp.payload, 100))
-				}
-			} else {
-				v.logger.Debug("command succeeded", "command", req.command, "status", resp.statusCode)
+			for i, resp := range responses {
+				v.logResponse(req.commands[i], resp)
 			}
-			req.responseChan <- resp
 		}
 	}
 }
 
+// logResponse logs the outcome of a command
+func (v *Server) logResponse(cmd string, resp VarnishResponse) {
+	switch {
+	case resp.statusCode == ClisOk:
+		v.logger.Debug("command succeeded", "command", cmd, "status", resp.statusCode)
+	case resp.statusCode == 106 || resp.statusCode == 300:
+		// Don't warn for expected "already exists" or "already running" conditions
+		v.logger.Debug("command returned non-fatal status", "command", cmd, "status", resp.statusCode, "payload", truncatePayload(resp.payload, 100))
+	default:
+		v.logger.Warn("command failed", "command", cmd, "status", resp.statusCode, "payload", truncatePayload(resp.payload, 200))
+	}
+}
+
 // readBanner reads the authentication challenge and performs authentication
 // Authentication is always required since we control Varnish startup with -S secret
-func (v *Server) readBanner(c *net.TCPConn) error {
+func (v *Server) readBanner(c *net.TCPConn, reader *bufio.Reader) error {
 
-	payload, statusCode, err := v.readFromConnection(c, authTimeout)
+	payload, statusCode, err := v.readFromConnection(c, reader, authTimeout)
 	if err != nil {
 		v.logger.Error("Authentication challenge read failed", "error", err, "timeout_used", authTimeout)
 		return fmt.Errorf("failed to read authentication challenge: %w", err)
@@ -206,7 +316,9 @@ func (v *Server) readBanner(c *net.TCPConn) error {
 
 	// Expect authentication challenge (status 107)
 	if statusCode != ClisAuth {
-		return fmt.Errorf("expected authentication challenge (status %d), got status %d: %s", ClisAuth, statusCode, strings.Trim(payload, "\n"))
+		return fmt.Errorf("expected authentication challenge (status %d), got status %d: %s\n"+
+			"  varnishd must be started with -S pointing at a secret file; vcltest requires CLI authentication",
+			ClisAuth, statusCode, strings.Trim(payload, "\n"))
 	}
 
 	// Extract challenge from payload
@@ -231,24 +343,29 @@ func (v *Server) readBanner(c *net.TCPConn) error {
 
 	// Send auth command
 	authCmd := "auth " + hex.EncodeToString(challengeBuffer.Bytes())
-	authResponse, err := v.run(c, authCmd)
+	authResponse, err := v.run(c, reader, authCmd)
 	challengeBuffer.Reset()
 
 	if err != nil {
 		return fmt.Errorf("authentication failed: %w", err)
 	}
 	if authResponse.statusCode != ClisOk {
-		return fmt.Errorf("authentication rejected by Varnish (status %d): %s", authResponse.statusCode, authResponse.payload)
+		return fmt.Errorf("%w (status %d): %s\n"+
+			"  The secret does not match the -S file varnishd was started with. If the secret file is\n"+
+			"  managed outside vcltest, point service.Config.SecretFile at it; the whole file, including\n"+
+			"  any trailing newline, is the secret",
+			ErrAuthRejected, authResponse.statusCode, strings.Trim(authResponse.payload, "\n"))
 	}
 
 	// Store the full banner and parse environment/version from auth response payload
-	v.banner = authResponse.payload
-	v.bannerReceived = true
-
-	// Parse environment and version from banner
 	env, version := parseBanner(authResponse.payload)
+	v.infoMu.Lock()
+	v.banner = authResponse.payload
 	v.environment = env
 	v.version = version
+	v.infoMu.Unlock()
+	v.bannerReceived = true
+	v.connected.Store(true)
 
 	// Publish connection event if broker is available
 	if v.broker != nil {
@@ -262,16 +379,22 @@ func (v *Server) readBanner(c *net.TCPConn) error {
 
 // GetBanner returns the stored Varnish CLI banner
 func (v *Server) GetBanner() string {
+	v.infoMu.RLock()
+	defer v.infoMu.RUnlock()
 	return v.banner
 }
 
 // GetEnvironment returns the parsed environment information
 func (v *Server) GetEnvironment() string {
+	v.infoMu.RLock()
+	defer v.infoMu.RUnlock()
 	return v.environment
 }
 
 // GetVersion returns the parsed Varnish version
 func (v *Server) GetVersion() string {
+	v.infoMu.RLock()
+	defer v.infoMu.RUnlock()
 	return v.version
 }
 
@@ -283,8 +406,33 @@ func (v *Server) SetTranscriptWriter(w io.Writer) {
 	v.transcript = w
 }
 
+// Connected reports whether varnishd is connected and authenticated
+func (v *Server) Connected() bool {
+	return v.connected.Load()
+}
+
+// RecentExchanges returns the last CLI commands and responses, oldest first,
+// in the transcript's "DIR STATUS CONTENT" form with content shortened
+func (v *Server) RecentExchanges() []string {
+	v.recentMu.Lock()
+	defer v.recentMu.Unlock()
+	return slices.Clone(v.recent)
+}
+
+// remember keeps a CLI exchange for RecentExchanges
+func (v *Server) remember(direction string, status int, content string) {
+	line := fmt.Sprintf("%s %d %s", direction, status, truncatePayload(strings.ReplaceAll(strings.TrimRight(content, "\n"), "\n", "\\n"), 200))
+	v.recentMu.Lock()
+	defer v.recentMu.Unlock()
+	v.recent = append(v.recent, line)
+	if len(v.recent) > recentExchanges {
+		v.recent = v.recent[len(v.recent)-recentExchanges:]
+	}
+}
+
 // writeTranscript writes a line to the transcript if enabled
 func (v *Server) writeTranscript(direction string, status int, content string) {
+	v.remember(direction, status, content)
 	if v.transcript == nil {
 		return
 	}
@@ -314,70 +462,121 @@ func parseBanner(banner string) (environment, version string) {
 	return
 }
 
-// Exec executes a given command and returns the output as a varnishresponse
+// Exec executes a given command and returns the output as a varnishresponse.
+// It is safe for concurrent use: commands are queued and run one at a time.
 func (v *Server) Exec(cmd string) (VarnishResponse, error) {
+	responses, err := v.Batch(cmd)
+	if err != nil {
+		return VarnishResponse{}, err
+	}
+	return responses[0], nil
+}
 
-	respCh := make(chan VarnishResponse)
-	v.reqCh <- varnishRequest{
-		command:      cmd,
-		responseChan: respCh,
+// Batch runs commands back to back on the CLI connection and returns their
+// responses in order. The commands are written together (pipelined) and no
+// command from another caller runs between them, so a sequence like
+// param.set followed by param.show sees its own changes. Every command runs
+// even if an earlier one fails; check the status of each response. The
+// batch gets the command timeout per command, measured from the call, so
+// waiting for the connection counts against it.
+func (v *Server) Batch(cmds ...string) ([]VarnishResponse, error) {
+	if len(cmds) == 0 {
+		return nil, nil
+	}
+	if slices.Contains(cmds, "") {
+		return nil, errors.New("empty command given")
+	}
+	respCh := make(chan batchResult, 1)
+	budget := v.cmdTimeout * time.Duration(len(cmds))
+	timeout := time.After(budget)
+	select {
+	case v.reqCh <- varnishRequest{commands: cmds, responseChan: respCh}:
+	case <-timeout:
+		v.logger.Error("Varnishadm command timed out waiting for varnishd", "commands", cmds, "timeout", budget)
+		return nil, fmt.Errorf("command timed out after %s: varnishd is not connected", budget)
 	}
 	select {
-	case resp := <-respCh:
-		// Logging is already done in readFromConnection, so just return the response
-		return resp, nil
-	case <-time.After(defaultCmdTimeout):
-		v.logger.Error("Varnishadm command timed out", "command", cmd, "timeout", defaultCmdTimeout)
-		return VarnishResponse{}, errors.New("command timed out")
+	case result := <-respCh:
+		// Logging is already done in handleConnection, so just return the responses
+		if result.err != nil {
+			return nil, fmt.Errorf("varnishd CLI connection failed: %w", result.err)
+		}
+		return result.responses, nil
+	case <-timeout:
+		v.logger.Error("Varnishadm command timed out", "commands", cmds, "timeout", budget)
+		return nil, fmt.Errorf("command timed out after %s", budget)
 	}
 }
 
-// run is the internal function to execute and read a command towards varnishadm
-func (v *Server) run(c *net.TCPConn, cmd string) (out VarnishResponse, err error) {
-	var writeBuffer bytes.Buffer
+// runBatch writes commands to the connection in one go, then reads their
+// responses in order
+func (v *Server) runBatch(c *net.TCPConn, reader *bufio.Reader, cmds []string) ([]VarnishResponse, error) {
+	if err := v.write(c, cmds...); err != nil {
+		return nil, err
+	}
+	responses := make([]VarnishResponse, 0, len(cmds))
+	for range cmds {
+		var resp VarnishResponse
+		var err error
+		resp.payload, resp.statusCode, err = v.readFromConnection(c, reader, v.ioTimeout)
+		v.writeTranscript("<<<", resp.statusCode, resp.payload)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, resp)
+	}
+	return responses, nil
+}
 
+// run is the internal function to execute and read a command towards varnishadm
+func (v *Server) run(c *net.TCPConn, reader *bufio.Reader, cmd string) (out VarnishResponse, err error) {
 	if len(cmd) == 0 {
 		out.statusCode = ClisSyntax
 		return out, errors.New("empty command given")
 	}
+	if err := v.write(c, cmd); err != nil {
+		out.statusCode = ClisComms
+		return out, err
+	}
+
+	// Read response with timeout
+	out.payload, out.statusCode, err = v.readFromConnection(c, reader, v.ioTimeout)
 
-	writeBuffer.WriteString(cmd)
-	writeBuffer.WriteString(NewLine)
+	// Log received response
+	v.writeTranscript("<<<", out.statusCode, out.payload)
 
-	// Log sent command (mask auth responses for security)
-	cmdForLog := cmd
-	if strings.HasPrefix(cmd, "auth ") {
-		cmdForLog = "auth <redacted>"
+	return out, err
+}
+
+// write sends commands to varnishd in a single write, one per line
+func (v *Server) write(c *net.TCPConn, cmds ...string) error {
+	var writeBuffer bytes.Buffer
+	for _, cmd := range cmds {
+		writeBuffer.WriteString(cmd)
+		writeBuffer.WriteString(NewLine)
+
+		// Log sent command (mask auth responses for security)
+		cmdForLog := cmd
+		if strings.HasPrefix(cmd, "auth ") {
+			cmdForLog = "auth <redacted>"
+		}
+		v.writeTranscript(">>>", 0, cmdForLog)
 	}
-	v.writeTranscript(">>>", 0, cmdForLog)
 
 	// Set deadline for write operation
-	deadline := time.Now().Add(readWriteTimeout)
+	deadline := time.Now().Add(v.ioTimeout)
 	if err := c.SetDeadline(deadline); err != nil {
-		out.statusCode = ClisComms
-		return out, fmt.Errorf("failed to set write deadline: %w", err)
+		return fmt.Errorf("failed to set write deadline: %w", err)
 	}
 
 	writtenBytes, err := c.Write(writeBuffer.Bytes())
-	writeBuffer.Reset()
-
 	if err != nil {
-		out.statusCode = ClisComms
-		return out, err
+		return err
 	}
-
 	if writtenBytes == 0 {
-		out.statusCode = ClisComms
-		return out, errors.New("Nothing was written on the varnish connection")
+		return errors.New("Nothing was written on the varnish connection")
 	}
-
-	// Read response with timeout
-	out.payload, out.statusCode, err = v.readFromConnection(c, readWriteTimeout)
-
-	// Log received response
-	v.writeTranscript("<<<", out.statusCode, out.payload)
-
-	return out, err
+	return nil
 }
 
 // executeCommand is the handler for EventBus VarnishAdm requests
@@ -394,13 +593,12 @@ func (v *Server) executeCommand(command string) (string, error) {
 // - 13 byte header: "SSS LLLLLLLL\n" where SSS is status code, LLLLLLLL is body length
 // - Body of exactly LLLLLLLL bytes
 // - Final newline
-func (v *Server) readFromConnection(conn *net.TCPConn, timeout time.Duration) (string, int, error) {
+func (v *Server) readFromConnection(conn *net.TCPConn, reader *bufio.Reader, timeout time.Duration) (string, int, error) {
 
 	deadline := time.Now().Add(timeout)
 	if err := conn.SetDeadline(deadline); err != nil {
 		return "", 0, fmt.Errorf("conn.SetDeadline(header): %w", err)
 	}
-	reader := bufio.NewReader(conn)
 
 	// Read the 13-byte header (including newline)
 	header := make([]byte, 13)
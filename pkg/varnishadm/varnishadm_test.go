@@ -1,9 +1,16 @@
 package varnishadm
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -282,3 +289,226 @@ without proper format`,
 		})
 	}
 }
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   ReconnectPolicy
+		failures int
+		want     time.Duration
+	}{
+		{"defaults first failure", ReconnectPolicy{}, 1, 100 * time.Millisecond},
+		{"defaults doubling", ReconnectPolicy{}, 3, 400 * time.Millisecond},
+		{"defaults capped", ReconnectPolicy{}, 20, 5 * time.Second},
+		{"custom", ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}, 2, 2 * time.Second},
+		{"custom capped", ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}, 3, 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.backoff(tt.failures); got != tt.want {
+				t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+// writeCLI writes a CLI protocol response: "SSS LLLLLLLL\n" + body + "\n"
+func writeCLI(t *testing.T, conn net.Conn, status int, body string) {
+	t.Helper()
+	if _, err := fmt.Fprintf(conn, "%03d %-8d\n%s\n", status, len(body), body); err != nil {
+		t.Errorf("writing CLI response: %v", err)
+	}
+}
+
+func TestServerRunGivesUpOnRejectedSecret(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := New(0, "wrong-secret", logger, nil)
+	server.SetReconnectPolicy(ReconnectPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	port, err := server.Listen()
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- server.Run(context.Background()) }()
+
+	// Play varnishd: send a challenge, reject whatever auth comes back
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		writeCLI(t, conn, ClisAuth, "abcdefghijklmnopqrstuvwxyzabcdef\n\nAuthentication required.\n")
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatalf("reading auth command: %v", err)
+		}
+		writeCLI(t, conn, ClisAuth, "abcdefghijklmnopqrstuvwxyzabcdef\n\nAuthentication required.\n")
+		conn.Close()
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrAuthRejected) {
+			t.Errorf("Run() error = %v, want ErrAuthRejected", err)
+		}
+		if !strings.Contains(err.Error(), "giving up after 2 failed varnishd connections") {
+			t.Errorf("Run() error = %v, want give-up message", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not give up")
+	}
+}
+
+func TestServerRecentExchanges(t *testing.T) {
+	server := New(0, "secret", slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	for i := range recentExchanges + 2 {
+		server.writeTranscript(">>>", 0, fmt.Sprintf("cmd %d", i))
+	}
+	server.writeTranscript("<<<", 200, "multi\nline\n")
+
+	recent := server.RecentExchanges()
+	if len(recent) != recentExchanges {
+		t.Fatalf("got %d exchanges, want %d: %q", len(recent), recentExchanges, recent)
+	}
+	if recent[0] != ">>> 0 cmd 3" {
+		t.Errorf("oldest exchange = %q, want %q", recent[0], ">>> 0 cmd 3")
+	}
+	if last := recent[len(recent)-1]; last != `<<< 200 multi\nline` {
+		t.Errorf("newest exchange = %q, want %q", last, `<<< 200 multi\nline`)
+	}
+}
+
+func TestServerExecWithoutVarnishd(t *testing.T) {
+	server := New(0, "secret", slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	server.SetCommandTimeout(50 * time.Millisecond)
+	// Fill the request buffer, as a command queued before varnishd connected would
+	server.reqCh <- varnishRequest{commands: []string{"ping"}}
+
+	_, err := server.Exec("ping")
+	if err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Fatalf("Exec() error = %v, want a not connected timeout", err)
+	}
+	if server.Connected() {
+		t.Error("Connected() = true without a varnishd connection")
+	}
+}
+
+func TestServerExecTimeoutIncludesQueueing(t *testing.T) {
+	server := New(0, "secret", slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	server.SetCommandTimeout(200 * time.Millisecond)
+	// A busy connection picks the command up late and never answers
+	server.reqCh <- varnishRequest{commands: []string{"ping"}}
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		<-server.reqCh
+		<-server.reqCh
+	}()
+
+	start := time.Now()
+	_, err := server.Exec("ping")
+	if err == nil || !strings.Contains(err.Error(), "timed out after 200ms") {
+		t.Fatalf("Exec() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Exec() took %s, want one 200ms timeout in all", elapsed)
+	}
+}
+
+func TestServerBatch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := New(0, "secret", logger, nil)
+	port, err := server.Listen()
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Run(ctx)
+
+	// Play varnishd: accept any auth, then answer every command line with
+	// itself, in the order the lines arrive
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	var (
+		mu       sync.Mutex
+		received []string
+	)
+	go func() {
+		writeCLI(t, conn, ClisAuth, "abcdefghijklmnopqrstuvwxyzabcdef\n\nAuthentication required.\n")
+		reader := bufio.NewReader(conn)
+		if _, err := reader.ReadString('\n'); err != nil {
+			return
+		}
+		writeCLI(t, conn, ClisOk, "-----------------------------\nVarnish Cache CLI 1.0\n-----------------------------\nvarnish-7.7.3 revision 0\n")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			mu.Lock()
+			received = append(received, line)
+			mu.Unlock()
+			writeCLI(t, conn, ClisOk, line)
+		}
+	}()
+
+	if responses, err := server.Batch(); err != nil || responses != nil {
+		t.Errorf("Batch() = %v, %v, want nothing", responses, err)
+	}
+	if _, err := server.Batch("ping", ""); err == nil {
+		t.Error("Batch() with an empty command succeeded")
+	}
+
+	const callers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmds := []string{fmt.Sprintf("param.set p%d 1", i), fmt.Sprintf("param.show p%d", i), fmt.Sprintf("ping %d", i)}
+			responses, err := server.Batch(cmds...)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j, resp := range responses {
+				if resp.Payload() != cmds[j] {
+					errs <- fmt.Errorf("caller %d: response %d = %q, want %q", i, j, resp.Payload(), cmds[j])
+				}
+			}
+			if resp, err := server.Exec(fmt.Sprintf("status %d", i)); err != nil || resp.Payload() != fmt.Sprintf("status %d", i) {
+				errs <- fmt.Errorf("caller %d: Exec() = %q, %v", i, resp.Payload(), err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Each batch reached varnishd as one contiguous run of lines
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != callers*4 {
+		t.Fatalf("varnishd received %d commands, want %d", len(received), callers*4)
+	}
+	for i, line := range received {
+		if !strings.HasPrefix(line, "param.set ") {
+			continue
+		}
+		caller := strings.Fields(line)[1][1:]
+		if i+2 >= len(received) || received[i+1] != "param.show p"+caller || received[i+2] != "ping "+caller {
+			t.Errorf("batch of caller %s interleaved: %q", caller, received[i:min(i+3, len(received))])
+		}
+	}
+	if server.GetVersion() != "varnish-7.7.3 revision 0" {
+		t.Errorf("GetVersion() = %q", server.GetVersion())
+	}
+}
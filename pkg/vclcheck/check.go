@@ -0,0 +1,344 @@
+// Package vclcheck compiles every VCL file under a directory and reports
+// per-file errors. It is a cheap syntax gate, separate from behavioral tests.
+package vclcheck
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/perbu/vclparser/pkg/parser"
+)
+
+// Checkers
+const (
+	Varnishd  = "varnishd"
+	VCLParser = "vclparser"
+)
+
+// includeStatement matches VCL include statements
+var includeStatement = regexp.MustCompile(`(?m)^\s*include\s+"([^"]+)"\s*;`)
+
+// vccMessage marks the start of a compiler error in varnishd output
+const vccMessage = "Message from VCC-compiler:"
+
+// Options configures a check
+type Options struct {
+	// Varnishd is the varnishd binary. If empty it is looked up in PATH,
+	// and vclparser is used if it is not found.
+	Varnishd string
+
+	// ParserOnly uses vclparser even if varnishd is available
+	ParserOnly bool
+
+	// Jobs is the number of files compiled in parallel (default: number of CPUs)
+	Jobs int
+}
+
+// Result is the outcome of checking one VCL file
+type Result struct {
+	Path     string   // Path relative to the checked directory
+	Checker  string   // Varnishd or VCLParser
+	Includes []string // Files under the directory that were checked through this one
+	Err      error    // nil if the file compiled
+}
+
+// Report is the outcome of checking a directory
+type Report struct {
+	Checker string
+	Results []Result // One per top-level file, sorted by path
+}
+
+// Failed returns the number of files that failed to compile
+func (r *Report) Failed() int {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Check compiles every .vcl file under dir. Files included by another file in
+// the directory are not compiled on their own (they are usually fragments
+// without a vcl version line); they are checked through the files including them.
+func Check(ctx context.Context, dir string, opts Options) (*Report, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("resolving directory: %w", err)
+	}
+
+	files, err := FindFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .vcl files found under %s", dir)
+	}
+
+	checker, varnishd := opts.checker()
+
+	includes, err := findIncludes(dir, files)
+	if err != nil {
+		return nil, err
+	}
+	roots := Roots(files, includes)
+
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	results := make([]Result, len(roots))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, path := range roots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			rel, _ := filepath.Rel(dir, path)
+			result := Result{Path: rel, Checker: checker}
+			for _, inc := range reachable(path, includes) {
+				incRel, _ := filepath.Rel(dir, inc)
+				result.Includes = append(result.Includes, incRel)
+			}
+			// A cycle is reported instead of handed to the compiler
+			if cycle := findCycle(path, includes); cycle != nil {
+				for i, f := range cycle {
+					cycle[i], _ = filepath.Rel(dir, f)
+				}
+				result.Err = fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+			} else if checker == Varnishd {
+				result.Err = compileVarnishd(ctx, varnishd, dir, path)
+			} else {
+				result.Err = parseFile(path)
+			}
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+
+	return &Report{Checker: checker, Results: results}, nil
+}
+
+// CompileFile compiles a single VCL file, with includes resolved against its
+// directory and includeDir. Returns the checker used.
+func CompileFile(ctx context.Context, path, includeDir string, opts Options) (string, error) {
+	checker, varnishd := opts.checker()
+	if checker == Varnishd {
+		return checker, compileVarnishd(ctx, varnishd, includeDir, path)
+	}
+	return checker, parseFile(path)
+}
+
+// checker returns the checker to use and, for Varnishd, the binary
+func (o Options) checker() (checker, varnishd string) {
+	if o.ParserOnly {
+		return VCLParser, ""
+	}
+	varnishd = o.Varnishd
+	if varnishd == "" {
+		varnishd, _ = exec.LookPath("varnishd")
+	}
+	if varnishd == "" {
+		return VCLParser, ""
+	}
+	return Varnishd, varnishd
+}
+
+// FindFiles returns the absolute paths of all .vcl files under dir, sorted
+func FindFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && filepath.Ext(path) == ".vcl" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walking %s: %w", dir, err)
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// findIncludes maps each file to the files under dir it includes directly.
+// Include paths are resolved against the including file's directory, then dir.
+func findIncludes(dir string, files []string) (map[string][]string, error) {
+	known := make(map[string]bool, len(files))
+	for _, f := range files {
+		known[f] = true
+	}
+
+	includes := make(map[string][]string)
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f, err)
+		}
+		for _, m := range includeStatement.FindAllStringSubmatch(string(content), -1) {
+			candidates := []string{filepath.Join(filepath.Dir(f), m[1]), filepath.Join(dir, m[1])}
+			if filepath.IsAbs(m[1]) {
+				candidates = []string{filepath.Clean(m[1])}
+			}
+			for _, candidate := range candidates {
+				if known[candidate] {
+					includes[f] = append(includes[f], candidate)
+					break
+				}
+			}
+		}
+	}
+	return includes, nil
+}
+
+// Roots returns the files that no other file includes, sorted. Files in an
+// include cycle (or included only from one) are not reached from those, so
+// the first file of each such group is a root too: every file is checked.
+func Roots(files []string, includes map[string][]string) []string {
+	included := make(map[string]bool)
+	for _, targets := range includes {
+		for _, t := range targets {
+			included[t] = true
+		}
+	}
+
+	var roots []string
+	reached := make(map[string]bool)
+	addRoot := func(f string) {
+		roots = append(roots, f)
+		reached[f] = true
+		for _, inc := range reachable(f, includes) {
+			reached[inc] = true
+		}
+	}
+	for _, f := range files {
+		if !included[f] {
+			addRoot(f)
+		}
+	}
+	for _, f := range files {
+		if !reached[f] {
+			addRoot(f)
+		}
+	}
+	slices.Sort(roots)
+	return roots
+}
+
+// findCycle returns an include cycle reachable from path, starting and
+// ending with the same file, or nil if there is none
+func findCycle(path string, includes map[string][]string) []string {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(string) []string
+	visit = func(f string) []string {
+		state[f] = visiting
+		stack = append(stack, f)
+		for _, inc := range includes[f] {
+			switch state[inc] {
+			case visiting:
+				start := slices.Index(stack, inc)
+				return append(slices.Clone(stack[start:]), inc)
+			case 0:
+				if cycle := visit(inc); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[f] = done
+		return nil
+	}
+	return visit(path)
+}
+
+// reachable returns the files transitively included from path, sorted
+func reachable(path string, includes map[string][]string) []string {
+	seen := map[string]bool{path: true}
+	queue := []string{path}
+	var found []string
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, inc := range includes[current] {
+			if !seen[inc] {
+				seen[inc] = true
+				found = append(found, inc)
+				queue = append(queue, inc)
+			}
+		}
+	}
+	slices.Sort(found)
+	return found
+}
+
+// compileVarnishd compiles path with `varnishd -C` in a throwaway instance
+// directory. Includes resolve against the file's directory and dir.
+func compileVarnishd(ctx context.Context, varnishd, dir, path string) error {
+	instanceDir, err := os.MkdirTemp("", "vcltest-check-*")
+	if err != nil {
+		return fmt.Errorf("creating instance directory: %w", err)
+	}
+	defer os.RemoveAll(instanceDir)
+
+	cmd := exec.CommandContext(ctx, varnishd,
+		"-C",
+		"-n", instanceDir,
+		"-p", "vcl_path="+filepath.Dir(path)+":"+dir,
+		"-f", path,
+	)
+	// On success the output is the generated C code; only errors matter
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if msg := compilerMessage(output.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("varnishd -C: %w", err)
+	}
+	return nil
+}
+
+// compilerMessage extracts the VCC error from varnishd output
+func compilerMessage(output string) string {
+	if i := strings.Index(output, vccMessage); i >= 0 {
+		output = output[i+len(vccMessage):]
+	}
+	return strings.TrimSpace(output)
+}
+
+// parseFile parses path and its includes with vclparser
+func parseFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading file: %w", err)
+	}
+	_, err = parser.Parse(string(content), path,
+		parser.WithResolveIncludes(filepath.Dir(path)),
+		parser.WithSkipSubroutineValidation(true),
+	)
+	return err
+}
@@ -0,0 +1,131 @@
+package vclcheck
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckParserOnly(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.vcl": `vcl 4.1;
+include "lib/acl.vcl";
+backend default { .host = "127.0.0.1"; .port = "8080"; }
+sub vcl_recv { call check_acl; }
+`,
+		"lib/acl.vcl": `sub check_acl {
+    if (req.url == "/admin") { return (synth(403)); }
+}
+`,
+		"broken.vcl": `vcl 4.1;
+backend default { .host = "127.0.0.1"; .port = "8080"; }
+sub vcl_recv { if (req.url == "/" { return (pass); } }
+`,
+		"README.md": "not vcl",
+	})
+
+	report, err := Check(context.Background(), dir, Options{ParserOnly: true})
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if report.Checker != VCLParser {
+		t.Errorf("Checker = %q, want %q", report.Checker, VCLParser)
+	}
+
+	// lib/acl.vcl is a fragment checked through main.vcl
+	if len(report.Results) != 2 {
+		t.Fatalf("got %d results, want 2: %+v", len(report.Results), report.Results)
+	}
+	broken, main := report.Results[0], report.Results[1]
+	if broken.Path != "broken.vcl" || broken.Err == nil {
+		t.Errorf("broken.vcl: got %+v, want a failure", broken)
+	}
+	if main.Path != "main.vcl" || main.Err != nil {
+		t.Errorf("main.vcl: got %+v, want success", main)
+	}
+	if !slices.Equal(main.Includes, []string{"lib/acl.vcl"}) {
+		t.Errorf("main.vcl includes = %v, want [lib/acl.vcl]", main.Includes)
+	}
+	if report.Failed() != 1 {
+		t.Errorf("Failed() = %d, want 1", report.Failed())
+	}
+}
+
+func TestCheckEmptyDirectory(t *testing.T) {
+	if _, err := Check(context.Background(), t.TempDir(), Options{ParserOnly: true}); err == nil {
+		t.Error("expected error for directory without .vcl files")
+	}
+}
+
+func TestRoots(t *testing.T) {
+	files := []string{"/v/a.vcl", "/v/b.vcl", "/v/c.vcl", "/v/d.vcl"}
+	includes := map[string][]string{
+		"/v/a.vcl": {"/v/b.vcl"},
+		"/v/b.vcl": {"/v/c.vcl"},
+	}
+	if got := Roots(files, includes); !slices.Equal(got, []string{"/v/a.vcl", "/v/d.vcl"}) {
+		t.Errorf("Roots() = %v, want [/v/a.vcl /v/d.vcl]", got)
+	}
+	if got := reachable("/v/a.vcl", includes); !slices.Equal(got, []string{"/v/b.vcl", "/v/c.vcl"}) {
+		t.Errorf("reachable() = %v, want [/v/b.vcl /v/c.vcl]", got)
+	}
+
+	// a, b and c include each other, so only d is included by no one
+	cyclic := map[string][]string{
+		"/v/a.vcl": {"/v/b.vcl"},
+		"/v/b.vcl": {"/v/c.vcl"},
+		"/v/c.vcl": {"/v/a.vcl"},
+	}
+	if got := Roots(files, cyclic); !slices.Equal(got, []string{"/v/a.vcl", "/v/d.vcl"}) {
+		t.Errorf("Roots() with a cycle = %v, want [/v/a.vcl /v/d.vcl]", got)
+	}
+	if got := findCycle("/v/a.vcl", cyclic); !slices.Equal(got, []string{"/v/a.vcl", "/v/b.vcl", "/v/c.vcl", "/v/a.vcl"}) {
+		t.Errorf("findCycle() = %v", got)
+	}
+	if got := findCycle("/v/a.vcl", includes); got != nil {
+		t.Errorf("findCycle() without a cycle = %v, want nil", got)
+	}
+}
+
+func TestCheckIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.vcl": "include \"b.vcl\";\n",
+		"b.vcl": "include \"a.vcl\";\n",
+	})
+
+	report, err := Check(context.Background(), dir, Options{ParserOnly: true})
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if len(report.Results) != 1 || report.Failed() != 1 {
+		t.Fatalf("results = %+v, want one failure", report.Results)
+	}
+	if got := report.Results[0].Err.Error(); got != "include cycle: a.vcl -> b.vcl -> a.vcl" {
+		t.Errorf("error = %q", got)
+	}
+}
+
+func TestCompilerMessage(t *testing.T) {
+	output := "Error:\nMessage from VCC-compiler:\nExpected ')' got '{'\n('/v/broken.vcl' Line 3 Pos 33)\nRunning VCC-compiler failed, exited with 2\n"
+	want := "Expected ')' got '{'\n('/v/broken.vcl' Line 3 Pos 33)\nRunning VCC-compiler failed, exited with 2"
+	if got := compilerMessage(output); got != want {
+		t.Errorf("compilerMessage() = %q, want %q", got, want)
+	}
+}
@@ -2,8 +2,10 @@ package vclmod
 
 import (
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"github.com/perbu/vclparser/pkg/ast"
 	"github.com/perbu/vclparser/pkg/parser"
@@ -20,12 +22,26 @@ type ProcessedVCLFile struct {
 // ProcessVCLWithIncludes processes a VCL file and all its includes
 // Returns a list of processed files that should be written to workdir
 func ProcessVCLWithIncludes(mainVCLPath string, backends map[string]BackendAddress) ([]ProcessedVCLFile, *ValidationResult, error) {
+	return ProcessVCLWithGuard(mainVCLPath, backends, nil)
+}
+
+// GuardFunc returns the address that a VCL backend without a mock is
+// rewritten to. original is the backend's declared .host and .port.
+type GuardFunc func(name string, original BackendAddress) BackendAddress
+
+// ProcessVCLWithGuard is ProcessVCLWithIncludes, but also rewrites the VCL
+// backends that are not in backends to the address returned by guard (if
+// non-nil), so that varnishd cannot reach the real hosts. Guarded backends
+// lose their .probe and .path, so health checks do not reach the guard and
+// the rewritten address is the one used.
+func ProcessVCLWithGuard(mainVCLPath string, backends map[string]BackendAddress, guard GuardFunc) ([]ProcessedVCLFile, *ValidationResult, error) {
 	walker := &includeWalker{
-		backends:     backends,
-		visitedFiles: make(map[string]bool),
+		backends:       backends,
+		guard:          guard,
+		visitedFiles:   make(map[string]bool),
 		processedFiles: make([]ProcessedVCLFile, 0),
-		vclBackends:  make(map[string]bool),
-		mainVCLDir:   filepath.Dir(mainVCLPath),
+		vclBackends:    make(map[string]bool),
+		mainVCLDir:     filepath.Dir(mainVCLPath),
 	}
 
 	// Walk the include tree
@@ -42,9 +58,30 @@ func ProcessVCLWithIncludes(mainVCLPath string, backends map[string]BackendAddre
 	return walker.processedFiles, result, nil
 }
 
+// IncludeTree walks a VCL file and its includes without modifying them. It
+// returns the absolute paths of the files (main file first) and the sorted
+// names of the backends they declare.
+func IncludeTree(mainVCLPath string) ([]string, []string, error) {
+	walker := &includeWalker{
+		visitedFiles: make(map[string]bool),
+		vclBackends:  make(map[string]bool),
+		mainVCLDir:   filepath.Dir(mainVCLPath),
+	}
+	if err := walker.walkFile(mainVCLPath, mainVCLPath); err != nil {
+		return nil, nil, err
+	}
+
+	files := make([]string, len(walker.processedFiles))
+	for i, file := range walker.processedFiles {
+		files[i] = file.AbsolutePath
+	}
+	return files, slices.Sorted(maps.Keys(walker.vclBackends)), nil
+}
+
 // includeWalker walks the include tree and processes each file
 type includeWalker struct {
 	backends       map[string]BackendAddress
+	guard          GuardFunc // Optional: address for backends not in backends
 	visitedFiles   map[string]bool
 	processedFiles []ProcessedVCLFile
 	vclBackends    map[string]bool // All backends found across all files
@@ -149,7 +186,13 @@ func (w *includeWalker) modifyBackendsInAST(program *ast.Program) (string, error
 		// Check if this backend should be modified
 		addr, shouldModify := w.backends[backendDecl.Name]
 		if !shouldModify {
-			continue
+			if w.guard == nil {
+				continue
+			}
+			addr = w.guard(backendDecl.Name, declaredAddress(backendDecl))
+			backendDecl.Properties = slices.DeleteFunc(backendDecl.Properties, func(prop *ast.BackendProperty) bool {
+				return prop.Name == "probe" || prop.Name == "path"
+			})
 		}
 
 		// Find or create .host and .port properties
@@ -223,7 +266,10 @@ func (w *includeWalker) validateBackends() *ValidationResult {
 
 	// Warn about VCL backends not defined in YAML
 	for vclName, used := range w.vclBackends {
-		if !used {
+		if !used && w.guard != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf(
+				"Backend %q defined in VCL not used in test - connections to it are blocked", vclName))
+		} else if !used {
 			result.Warnings = append(result.Warnings, fmt.Sprintf(
 				"Backend %q defined in VCL not used in test - will not be overridden", vclName))
 		}
@@ -231,3 +277,22 @@ func (w *includeWalker) validateBackends() *ValidationResult {
 
 	return result
 }
+
+// declaredAddress returns the .host and .port (or .path) of a backend
+// declaration, as far as they are string literals
+func declaredAddress(decl *ast.BackendDecl) BackendAddress {
+	var addr BackendAddress
+	for _, prop := range decl.Properties {
+		lit, ok := prop.Value.(*ast.StringLiteral)
+		if !ok {
+			continue
+		}
+		switch prop.Name {
+		case "host", "path":
+			addr.Host = lit.Value
+		case "port":
+			addr.Port = lit.Value
+		}
+	}
+	return addr
+}
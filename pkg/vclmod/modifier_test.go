@@ -1,6 +1,8 @@
 package vclmod
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -481,3 +483,53 @@ func TestFindClosestMatch(t *testing.T) {
 		}
 	}
 }
+
+// TestProcessVCLWithGuard tests that backends without a mock are rewritten to the guard
+func TestProcessVCLWithGuard(t *testing.T) {
+	dir := t.TempDir()
+	vclContent := `vcl 4.1;
+
+probe health {
+    .url = "/";
+}
+
+backend api {
+    .host = "127.0.0.1";
+    .port = "8080";
+}
+
+backend tracking {
+    .host = "tracking.example.com";
+    .port = "443";
+    .probe = health;
+}
+`
+	vclPath := filepath.Join(dir, "main.vcl")
+	if err := os.WriteFile(vclPath, []byte(vclContent), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var guarded []string
+	guard := func(name string, original BackendAddress) BackendAddress {
+		guarded = append(guarded, name+"="+original.Host+":"+original.Port)
+		return BackendAddress{Host: "127.0.0.1", Port: "9999"}
+	}
+	files, result, err := ProcessVCLWithGuard(vclPath, map[string]BackendAddress{"api": {Host: "127.0.0.1", Port: "8001"}}, guard)
+	if err != nil {
+		t.Fatalf("ProcessVCLWithGuard() error = %v", err)
+	}
+
+	if len(guarded) != 1 || guarded[0] != "tracking=tracking.example.com:443" {
+		t.Errorf("guarded = %v, want [tracking=tracking.example.com:443]", guarded)
+	}
+	modified := files[0].Content
+	if !strings.Contains(modified, `"9999"`) || !strings.Contains(modified, `"8001"`) {
+		t.Errorf("Expected mock and guard ports in VCL:\n%s", modified)
+	}
+	if strings.Contains(modified, "tracking.example.com") || strings.Contains(modified, ".probe") {
+		t.Errorf("Guarded backend should lose its host and probe:\n%s", modified)
+	}
+	if warnings := strings.Join(result.Warnings, " "); !strings.Contains(warnings, "connections to it are blocked") {
+		t.Errorf("Warning should mention the guard: %s", warnings)
+	}
+}